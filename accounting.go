@@ -0,0 +1,210 @@
+package dfs
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+const (
+	accountingFileName = "accounting.json" // File the traffic with peers is persisted to
+	accountingBucket   = time.Hour         // Traffic is aggregated in buckets of that long
+	accountingBuckets  = 30 * 24           // Buckets kept, covering the longest window reported
+	accountingInterval = time.Minute       // How often the traffic is persisted
+)
+
+// PeerTraffic is the bytes exchanged with a peer: the replicas each side
+// stored on behalf of the other, and the files each side served the other.
+type PeerTraffic struct {
+	Stored  int64 `json:"stored"`  // Bytes of replicas the peer stored on this server
+	Served  int64 `json:"served"`  // Bytes this server served the peer
+	Sent    int64 `json:"sent"`    // Bytes of replicas this server stored on the peer
+	Fetched int64 `json:"fetched"` // Bytes the peer served this server
+}
+
+// add returns the sum of t and o.
+func (t PeerTraffic) add(o PeerTraffic) PeerTraffic {
+	return PeerTraffic{
+		Stored:  t.Stored + o.Stored,
+		Served:  t.Served + o.Served,
+		Sent:    t.Sent + o.Sent,
+		Fetched: t.Fetched + o.Fetched,
+	}
+}
+
+// PeerAccount is the usage report of a peer: what this server holds for it,
+// and the traffic exchanged with it over the last hour, day and 30 days, and
+// since accounting started. Peers are accounted by node ID, or by address if
+// they didn't announce one.
+type PeerAccount struct {
+	Peer  string        `json:"peer"`  // Node ID of the peer
+	Held  storage.Usage `json:"held"`  // Replicas of the peer held by this server
+	Hour  PeerTraffic   `json:"hour"`  // Traffic of the last hour
+	Day   PeerTraffic   `json:"day"`   // Traffic of the last 24 hours
+	Month PeerTraffic   `json:"month"` // Traffic of the last 30 days
+	Total PeerTraffic   `json:"total"` // Traffic since accounting started
+}
+
+// peerLedger is the traffic exchanged with a peer, in total and by bucket.
+type peerLedger struct {
+	Total   PeerTraffic           `json:"total"`
+	Buckets map[int64]PeerTraffic `json:"buckets"` // Start of the bucket in Unix seconds → traffic
+}
+
+// accounts tracks the traffic exchanged with every peer, persisted as JSON so
+// it survives restarts.
+type accounts struct {
+	path string
+
+	mu      sync.Mutex
+	ledgers map[string]*peerLedger
+	dirty   bool // Whether traffic was added since the last save
+}
+
+// loadAccounts reads the traffic persisted at path. A missing file yields
+// none.
+func loadAccounts(path string) (*accounts, error) {
+	a := &accounts{path: path, ledgers: make(map[string]*peerLedger)}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	return a, json.Unmarshal(buf, &a.ledgers)
+}
+
+// add adds t to the traffic exchanged with peer at now, and drops the
+// buckets of peer older than the longest window.
+func (a *accounts) add(peer string, t PeerTraffic, now time.Time) {
+	bucket := now.Truncate(accountingBucket).Unix()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l := a.ledgers[peer]
+	if l == nil {
+		l = &peerLedger{Buckets: make(map[int64]PeerTraffic)}
+		a.ledgers[peer] = l
+	}
+	l.Total = l.Total.add(t)
+	l.Buckets[bucket] = l.Buckets[bucket].add(t)
+	for start := range l.Buckets {
+		if start <= bucket-int64(accountingBuckets*accountingBucket/time.Second) {
+			delete(l.Buckets, start)
+		}
+	}
+	a.dirty = true
+}
+
+// report returns the account of every peer with traffic at now, sorted by
+// peer.
+func (a *accounts) report(now time.Time) []PeerAccount {
+	bucket := now.Truncate(accountingBucket).Unix()
+	within := func(start int64, buckets int) bool {
+		return start > bucket-int64(buckets)*int64(accountingBucket/time.Second)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []PeerAccount{}
+	for peer, l := range a.ledgers {
+		account := PeerAccount{Peer: peer, Total: l.Total}
+		for start, t := range l.Buckets {
+			if within(start, 1) {
+				account.Hour = account.Hour.add(t)
+			}
+			if within(start, 24) {
+				account.Day = account.Day.add(t)
+			}
+			if within(start, accountingBuckets) {
+				account.Month = account.Month.add(t)
+			}
+		}
+		out = append(out, account)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Peer < out[j].Peer })
+	return out
+}
+
+// save persists the traffic if any was added since the last save.
+func (a *accounts) save() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return
+	}
+
+	buf, err := json.Marshal(a.ledgers)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.path), os.ModePerm)
+	}
+	if err == nil {
+		tmp := a.path + ".tmp"
+		if err = os.WriteFile(tmp, buf, 0o644); err == nil {
+			err = os.Rename(tmp, a.path)
+		}
+	}
+	if err != nil {
+		log.Printf("persisting peer accounts failed: %s", err)
+		return
+	}
+	a.dirty = false
+}
+
+// persistAccounts saves the traffic exchanged with peers every
+// accountingInterval until the server stops, which saves it a last time.
+func (s *FileServer) persistAccounts() {
+	ticker := time.NewTicker(accountingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.accounts.save()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// account adds t to the traffic exchanged with peer.
+func (s *FileServer) account(peer p2p.Peer, t PeerTraffic) {
+	s.accounts.add(scoreKey(peer), t, time.Now())
+}
+
+// accountAddr adds t to the traffic exchanged with the peer connected from
+// addr. Traffic of peers that went away in the meantime is lost.
+func (s *FileServer) accountAddr(addr string, t PeerTraffic) {
+	if peer, err := s.peer(addr); err == nil {
+		s.account(peer, t)
+	}
+}
+
+// Accounts returns the usage report of every peer this server exchanged
+// traffic with or holds replicas for, sorted by peer, as the foundation of
+// fairness policies or billing.
+func (s *FileServer) Accounts() []PeerAccount {
+	accounts := s.accounts.report(time.Now())
+	held := s.store.UsageByNamespace()
+	for i := range accounts {
+		accounts[i].Held = held[accounts[i].Peer]
+		delete(held, accounts[i].Peer)
+	}
+	for _, id := range s.knownPeerIDs() {
+		if u, ok := held[id]; ok {
+			accounts = append(accounts, PeerAccount{Peer: id, Held: u})
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Peer < accounts[j].Peer })
+	return accounts
+}
@@ -0,0 +1,90 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), accountingFileName)
+	a, err := loadAccounts(path)
+	require.NoError(t, err)
+
+	now := time.Date(2026, 5, 1, 12, 30, 0, 0, time.UTC)
+	a.add("peer", PeerTraffic{Stored: 1}, now.Add(-40*24*time.Hour)) // Dropped by the next add
+	a.add("peer", PeerTraffic{Stored: 10}, now.Add(-10*24*time.Hour))
+	a.add("peer", PeerTraffic{Served: 100}, now.Add(-3*time.Hour))
+	a.add("peer", PeerTraffic{Sent: 1000}, now.Add(-20*time.Minute))
+	a.add("other", PeerTraffic{Fetched: 5}, now)
+
+	report := a.report(now)
+	require.Len(t, report, 2)
+	assert.Equal(t, PeerAccount{Peer: "other", Hour: PeerTraffic{Fetched: 5}, Day: PeerTraffic{Fetched: 5}, Month: PeerTraffic{Fetched: 5}, Total: PeerTraffic{Fetched: 5}}, report[0])
+	assert.Equal(t, PeerAccount{
+		Peer:  "peer",
+		Hour:  PeerTraffic{Sent: 1000},
+		Day:   PeerTraffic{Served: 100, Sent: 1000},
+		Month: PeerTraffic{Stored: 10, Served: 100, Sent: 1000},
+		Total: PeerTraffic{Stored: 11, Served: 100, Sent: 1000},
+	}, report[1])
+
+	// The traffic survives restarts.
+	a.save()
+	loaded, err := loadAccounts(path)
+	require.NoError(t, err)
+	assert.Equal(t, report, loaded.report(now))
+}
+
+func TestAccountsPeers(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41358", StorageRoot: t.TempDir(), ID: "owner"})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41359", StorageRoot: t.TempDir(), ID: "replica", BootstrapNodes: []string{"127.0.0.1:41358"}})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	data := bytes.Repeat([]byte("a"), 1000)
+	require.NoError(t, s1.Store("a.txt", bytes.NewReader(data)))
+	require.Eventually(t, func() bool { return s2.store.Has("owner", s1.hashKey("a.txt")) }, 2*time.Second, 10*time.Millisecond)
+
+	// Fetch it back from the replica.
+	require.NoError(t, s1.store.Delete(s1.ID, "a.txt"))
+	r, err := s1.Get("a.txt")
+	require.NoError(t, err)
+	r.Close()
+
+	require.Eventually(t, func() bool {
+		accounts := s2.Accounts()
+		return len(accounts) == 1 && accounts[0].Total.Served > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	replica := s2.Accounts()[0]
+	assert.Equal(t, "owner", replica.Peer)
+	assert.Equal(t, PeerTraffic{Stored: 1016, Served: 1016}, replica.Total)
+	assert.Equal(t, replica.Total, replica.Hour)
+	assert.Equal(t, int64(1), replica.Held.Objects)
+
+	owner := s1.Accounts()
+	require.Len(t, owner, 1)
+	assert.Equal(t, "replica", owner[0].Peer)
+	assert.Equal(t, PeerTraffic{Sent: 1016, Fetched: 1000}, owner[0].Month)
+
+	// The admin API reports the same.
+	api := httptest.NewServer(s2.AdminHandler())
+	defer api.Close()
+	res, err := http.Get(api.URL + "/accounting")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var accounts []PeerAccount
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&accounts))
+	assert.Equal(t, s2.Accounts(), accounts)
+}
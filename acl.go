@@ -0,0 +1,266 @@
+package dfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// aclsFileName is the name of the file the ACLs of prefixes are kept in, inside the storage root.
+const aclsFileName = "acls.json"
+
+// principalKey is the context key of the principal requests are made for.
+type principalKey struct{}
+
+// ContextWithPrincipal returns ctx making requests for p, which the ACLs of
+// the objects fetched, stored and deleted with it are checked against.
+func ContextWithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal of ctx, nil if it has none.
+func principalFrom(ctx context.Context) *Principal {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+// MessageSetACL tells the peers holding a replica of a file about the ACL
+// its owner set on it.
+type MessageSetACL struct {
+	ID  string      // ID of the owner of the file
+	Key string      // Hashed key of the file
+	ACL storage.ACL // ACL of the file, nil if it has none
+}
+
+// aclTable holds the ACLs of prefixes, persisted as JSON so they survive
+// restarts.
+type aclTable struct {
+	path string
+
+	mu       sync.Mutex
+	prefixes map[string]storage.ACL
+}
+
+// loadACLs reads the ACLs persisted at path. A missing file yields none.
+func loadACLs(path string) (*aclTable, error) {
+	t := &aclTable{path: path, prefixes: make(map[string]storage.ACL)}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(buf, &t.prefixes)
+}
+
+// set sets the ACL of prefix, removing it if acl is empty.
+func (t *aclTable) set(prefix string, acl storage.ACL) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(acl) == 0 {
+		delete(t.prefixes, prefix)
+	} else {
+		t.prefixes[prefix] = acl
+	}
+
+	buf, err := json.Marshal(t.prefixes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// match returns the ACL of the longest prefix of key that has one, nil if
+// none has.
+func (t *aclTable) match(key string) storage.ACL {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		acl     storage.ACL
+		longest = -1
+	)
+	for prefix, a := range t.prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			acl, longest = a, len(prefix)
+		}
+	}
+	return acl
+}
+
+// isACLPrefix reports whether key names a prefix rather than an object: it is
+// empty or ends with a slash.
+func isACLPrefix(key string) bool {
+	return len(key) == 0 || strings.HasSuffix(key, "/")
+}
+
+// SetACL sets the ACL of the file stored under key, or of the files under
+// key if it is empty or ends with a slash, removing it if acl is empty. The
+// peers holding replicas of the file are told about its ACL, and check the
+// requests made for a principal against it, which peers forward; peers that
+// don't hold one yet get it along with the replica. The ACLs of prefixes
+// are checked by this server only. Gateways, which don't hold the files
+// stored through them, only set the ACLs of prefixes.
+func (s *FileServer) SetACL(key string, acl storage.ACL) error {
+	if len(acl) == 0 {
+		acl = nil
+	}
+	if isACLPrefix(key) {
+		return s.acls.set(key, acl)
+	}
+
+	err := s.store.UpdateMeta(s.ID, key, func(meta *storage.ObjectMeta) { meta.ACL = acl })
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(AuditACL, s.ID, s.hashKey(key), 0, "", nil)
+
+	msg := Message{Payload: MessageSetACL{ID: s.ID, Key: s.hashKey(key), ACL: acl}}
+	if err := s.broadcast(&msg); err != nil {
+		log.Printf("[%s] telling peers about the ACL of (%s) failed: %s", s.Transport.Addr(), key, err)
+	}
+	return nil
+}
+
+// ACLOf returns the ACL the file stored under key is accessed under: its own
+// or else that of the longest prefix of key with one, nil if none has. Keys
+// that are empty or end with a slash name prefixes, whose own ACL is
+// returned.
+func (s *FileServer) ACLOf(key string) storage.ACL {
+	if isACLPrefix(key) {
+		s.acls.mu.Lock()
+		defer s.acls.mu.Unlock()
+		return s.acls.prefixes[key]
+	}
+	if acl := s.objectACL(key); acl != nil {
+		return acl
+	}
+	return s.acls.match(key)
+}
+
+// objectACL returns the ACL set on the file stored under key, nil if it has
+// none.
+func (s *FileServer) objectACL(key string) storage.ACL {
+	meta, _ := s.store.Meta(s.ID, key)
+	return meta.ACL
+}
+
+// checkACL returns ErrForbidden unless the principal of ctx may do perm with
+// the file stored under key. Requests without a principal, and those of
+// principals with the admin scope, are allowed.
+func (s *FileServer) checkACL(ctx context.Context, key string, perm storage.Permission) error {
+	return checkPrincipal(principalFrom(ctx), s.ACLOf(key), key, perm)
+}
+
+// checkReplicaACL returns ErrForbidden unless the peer at addr may do perm
+// with the replica stored under key by id for p, according to the ACL its
+// owner set on it. The owner, as it identified itself in the handshake, is
+// allowed for itself, with no principal, and for principals with the admin
+// scope. Other peers only get what the ACL grants the subject of p, or what
+// it grants everyone if they ask with no principal.
+func (s *FileServer) checkReplicaACL(addr string, p *Principal, id string, key string, perm storage.Permission) error {
+	meta, _ := s.store.Meta(id, key)
+	if s.checkOwner(addr, id) == nil {
+		return checkPrincipal(p, meta.ACL, key, perm)
+	}
+	subject := ""
+	if p != nil {
+		subject = p.Subject
+	}
+	return checkPrincipal(&Principal{Subject: subject}, meta.ACL, key, perm)
+}
+
+// checkPrincipal returns ErrForbidden unless p may do perm with the object
+// under key according to acl.
+func checkPrincipal(p *Principal, acl storage.ACL, key string, perm storage.Permission) error {
+	if p == nil || p.Scope >= ScopeAdmin || acl == nil || acl.Allows(p.Subject, perm) {
+		return nil
+	}
+	return fmt.Errorf("%w: %q may not %s (%s)", ErrForbidden, p.Subject, perm, key)
+}
+
+// aclReplica gives the replica just received for msg the ACL it was sent
+// with, none included.
+func (s *FileServer) aclReplica(msg MessageStoreFile) {
+	err := s.store.UpdateMeta(msg.ID, msg.Key, func(meta *storage.ObjectMeta) { meta.ACL = msg.ACL })
+	if err != nil {
+		log.Printf("[%s] setting the ACL of (%s) failed: %s", s.Transport.Addr(), msg.Key, err)
+	}
+}
+
+// handleMessageSetACL sets the ACL of the local replica of a file, for its
+// owner.
+func (s *FileServer) handleMessageSetACL(rpc p2p.RPC, msg MessageSetACL) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	if err := s.checkOwner(rpc.From, msg.ID); err != nil {
+		return err // Only the owner of the file sets its ACL
+	}
+	if !s.store.Has(msg.ID, msg.Key) {
+		return nil // Gets the ACL along with the replica
+	}
+	err := s.store.UpdateMeta(msg.ID, msg.Key, func(meta *storage.ObjectMeta) { meta.ACL = msg.ACL })
+	s.audit(AuditACL, msg.ID, msg.Key, 0, rpc.From, err)
+	return err
+}
+
+// handleACLs adds the endpoints reading and setting the ACLs of files and
+// prefixes to mux.
+func (s *FileServer) handleACLs(mux *http.ServeMux) {
+	mux.HandleFunc("GET /acl/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		acl := s.ACLOf(r.PathValue("key"))
+		if acl == nil {
+			acl = storage.ACL{}
+		}
+		writeJSON(w, http.StatusOK, acl)
+	})
+
+	mux.HandleFunc("PUT /acl/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		var acl storage.ACL
+		if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.SetACL(r.PathValue("key"), acl); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /acl/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.SetACL(r.PathValue("key"), nil); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,107 @@
+package dfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/p2p/p2ptest"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLs(t *testing.T) {
+	s := newExportServer(t)
+	s.Auth = &AuthOpts{Authenticator: StaticTokens{
+		"alice-token": {Subject: "alice", Scope: ScopeWrite},
+		"bob-token":   {Subject: "bob", Scope: ScopeWrite},
+		"admin-token": {Subject: "ops", Scope: ScopeAdmin},
+	}}
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	do := func(method string, path string, token string, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Files without an ACL are open to the scope of the credentials.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/files/docs/a.txt", "alice-token", "contents"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/files/docs/a.txt", "bob-token", ""))
+
+	// The ACL of a prefix covers the files under it.
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/acl/docs/", "alice-token", "[]"), "ACLs are set with the admin scope")
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/acl/docs/", "admin-token", `[{"subject":"alice","allow":"read,write,delete"},{"subject":"*","allow":"read"}]`))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/files/docs/a.txt", "bob-token", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/files/docs/a.txt", "bob-token", "overwritten"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/files/docs/a.txt", "bob-token", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/files/docs/b.bin?uploads", "bob-token", ""))
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/files/other.txt", "bob-token", "contents"), "files outside the prefix are left alone")
+
+	// The ACL of a file takes precedence over that of its prefix.
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/acl/docs/a.txt", "admin-token", `[{"subject":"alice","allow":"read"}]`))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/files/docs/a.txt", "bob-token", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/files/docs/a.txt", "alice-token", ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/files/docs/a.txt", "admin-token", ""), "the admin scope isn't bound by ACLs")
+	assert.Equal(t, storage.ACL{{Subject: "alice", Allow: storage.PermRead}}, s.ACLOf("docs/a.txt"))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/acl/docs/missing.txt", "admin-token", "[]"))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/acl/docs/a.txt", "admin-token", ""))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/files/docs/a.txt", "alice-token", ""))
+
+	// The ACLs of prefixes survive restarts.
+	acls, err := loadACLs(filepath.Join(s.StorageRoot, aclsFileName))
+	require.NoError(t, err)
+	assert.Len(t, acls.match("docs/b.txt"), 2)
+	assert.Nil(t, acls.match("other.txt"))
+}
+
+func TestReplicaACL(t *testing.T) {
+	s := newExportServer(t)
+	alice := &Principal{Subject: "alice", Scope: ScopeWrite}
+	bob := &Principal{Subject: "bob", Scope: ScopeWrite}
+	require.NoError(t, s.OnPeer(p2ptest.NewPeer(p2ptest.PeerOpts{Addr: "peer:1", ID: "peer"})))
+	require.NoError(t, s.OnPeer(p2ptest.NewPeer(p2ptest.PeerOpts{Addr: "other:1", ID: "other"})))
+
+	// Replicas keep the ACL their owner sent, checked against the principal
+	// peers ask for.
+	msg := MessageStoreFile{ID: "peer", Key: "hash", Size: 7, ACL: storage.ACL{{Subject: "alice", Allow: storage.PermRead | storage.PermWrite}}}
+	require.NoError(t, s.receiveFile("peer:1", strings.NewReader("replica"), msg))
+	assert.NoError(t, s.checkReplicaACL("peer:1", alice, "peer", "hash", storage.PermRead))
+	assert.ErrorIs(t, s.checkReplicaACL("peer:1", bob, "peer", "hash", storage.PermRead), ErrForbidden)
+	assert.NoError(t, s.checkReplicaACL("peer:1", nil, "peer", "hash", storage.PermDelete), "owners asking for themselves")
+
+	// Other peers are held to the ACL, whatever they ask for.
+	assert.NoError(t, s.checkReplicaACL("other:1", alice, "peer", "hash", storage.PermRead))
+	assert.ErrorIs(t, s.checkReplicaACL("other:1", nil, "peer", "hash", storage.PermRead), ErrForbidden)
+	assert.ErrorIs(t, s.checkReplicaACL("other:1", &Principal{Subject: "bob", Scope: ScopeAdmin}, "peer", "hash", storage.PermRead), ErrForbidden)
+
+	msg.Principal = bob
+	assert.ErrorIs(t, s.receiveFile("peer:1", strings.NewReader("changed"), msg), ErrForbidden)
+	msg.Principal = alice
+	assert.ErrorIs(t, s.receiveFile("other:1", strings.NewReader("changed"), msg), ErrForbidden, "only owners overwrite replicas")
+	err := s.handleMessageDeleteFile(p2p.RPC{From: "peer:1"}, MessageDeleteFile{ID: "peer", Key: "hash", Principal: alice})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.True(t, s.store.Has("peer", "hash"))
+
+	// Only owners change the ACL.
+	err = s.handleMessageSetACL(p2p.RPC{From: "other:1"}, MessageSetACL{ID: "peer", Key: "hash"})
+	assert.ErrorIs(t, err, ErrForbidden)
+	meta, _ := s.store.Meta("peer", "hash")
+	assert.Equal(t, msg.ACL, meta.ACL)
+
+	// Owners changing the ACL tell the holders.
+	require.NoError(t, s.handleMessageSetACL(p2p.RPC{From: "peer:1"}, MessageSetACL{ID: "peer", Key: "hash", ACL: storage.ACL{{Subject: "*", Allow: storage.PermDelete}}}))
+	require.NoError(t, s.handleMessageDeleteFile(p2p.RPC{From: "peer:1"}, MessageDeleteFile{ID: "peer", Key: "hash", Principal: bob}))
+	assert.False(t, s.store.Has("peer", "hash"))
+}
@@ -0,0 +1,383 @@
+package dfs
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// ErrPeerNotFound is returned when an operation names a peer that isn't connected.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// PeerStatus describes a connected peer, for operators managing the topology.
+type PeerStatus struct {
+	Addr            string         `json:"addr"`                  // Remote address of the peer
+	ID              string         `json:"id"`                    // Node ID announced in the handshake
+	AdvertisedAddr  string         `json:"advertised_addr"`       // Address the peer announced to be dialed at, empty if unknown
+	Transport       string         `json:"transport"`             // Transport the peer is connected over
+	ProtocolVersion int            `json:"protocol_version"`      // Negotiated protocol version
+	Compression     string         `json:"compression,omitempty"` // Negotiated compression of messages, empty if none
+	Zone            string         `json:"zone,omitempty"`        // Zone the peer announced, empty if unknown
+	Tier            string         `json:"tier,omitempty"`        // Storage tier the peer announced, empty if unknown
+	Outbound        bool           `json:"outbound"`              // Whether this server dialed the peer
+	RTT             time.Duration  `json:"rtt"`                   // Round-trip time estimate in nanoseconds
+	ConnectedAt     time.Time      `json:"connected_at"`          // When the connection was established
+	Limits          p2p.PeerLimits `json:"limits"`                // Limits applied to the peer's traffic
+	Score           int            `json:"score"`                 // Penalties for breaking limits since its last ban
+	p2p.PeerStats
+}
+
+// Peers returns the status of every connected peer, sorted by address.
+func (s *FileServer) Peers() []PeerStatus {
+	peers := s.peerList()
+
+	out := make([]PeerStatus, 0, len(peers))
+	for _, peer := range peers {
+		out = append(out, PeerStatus{
+			Addr:            peer.RemoteAddr().String(),
+			ID:              peer.ID(),
+			AdvertisedAddr:  peer.AdvertisedAddr(),
+			Transport:       peer.TransportKind(),
+			ProtocolVersion: peer.ProtocolVersion(),
+			Compression:     peer.Compression(),
+			Zone:            peer.Zone(),
+			Tier:            peer.Tier(),
+			Outbound:        peer.Outbound(),
+			RTT:             peer.RTT(),
+			ConnectedAt:     peer.ConnectedAt(),
+			Limits:          peer.Limits(),
+			Score:           s.score(peer),
+			PeerStats:       peer.Stats(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+
+	return out
+}
+
+// Connect dials addr. The peer shows up in Peers once the handshake completes.
+func (s *FileServer) Connect(addr string) error {
+	return s.dial(addr)
+}
+
+// Disconnect closes the connection to the peer at addr and forgets it.
+func (s *FileServer) Disconnect(addr string) error {
+	peer, err := s.peer(addr)
+	if err != nil {
+		return err
+	}
+
+	s.peerLock.Lock()
+	if s.peers[addr] == peer {
+		delete(s.peers, addr)
+	}
+	s.peerLock.Unlock()
+
+	return peer.Close()
+}
+
+// SetPeerLimits changes the limits applied to the traffic of the peer at addr.
+func (s *FileServer) SetPeerLimits(addr string, limits p2p.PeerLimits) error {
+	if limits.MaxSendRate < 0 || limits.MaxRecvRate < 0 {
+		return errors.New("peer limits must not be negative")
+	}
+
+	peer, err := s.peer(addr)
+	if err != nil {
+		return err
+	}
+	peer.SetLimits(limits)
+
+	return nil
+}
+
+// AdminHandler returns the admin HTTP API of the server:
+//
+//	GET    /status              server status
+//	GET    /peers               connected peers with their stats
+//	GET    /cluster             every known node with its health, capacity and the files it owns
+//	GET    /hints               replicas owed to peers that missed them
+//	GET    /replication         replicas waiting in the replication queue, see ReplicationQueueOpts
+//	GET    /usage               objects and bytes held by namespace, see Usage
+//	GET    /accounting          bytes stored for and served to every peer, see Accounts
+//	GET    /tenants             what every tenant stored and transferred, see Tenants
+//	GET    /tenants/{tenant}    what a tenant stored and transferred, see TenantUsage
+//	GET    /popular[?n=10]      the objects read most, see Popular
+//	GET    /relay               connections carried as a relay, see RelayStats
+//	POST   /peers               connect to {"addr": "host:port"}, or to {"id": "..."} through a relay
+//	DELETE /peers/{addr}        disconnect a peer
+//	PUT    /peers/{addr}/limits set the limits of a peer to a p2p.PeerLimits body
+//	GET    /export[?since=RFC3339] the local store as a tar archive, see Export
+//	POST   /import              read an archive written by Export into the local store
+//	POST   /migrate             move this node to {"addr": "host:port"}, see MigrateTo
+//	POST   /repack              garbage collect the packs of the local store, see Repack
+//	POST   /rekey               move replicas stored under plain key hashes to lookup tokens, see RekeyReplicas
+//	GET    /dashboard/          web dashboard, / redirects to it
+//	GET    /capacity            disk usage of the local store
+//	GET    /throughput          transfer rates of the last five minutes
+//	GET    /events/recent       the last 100 events with their types
+//	GET    /files[?prefix=]     files this server stored, see List
+//	GET    /healthz             liveness, 503 unless the server is listening, see Health
+//	GET    /readyz              readiness, 503 unless every check of Health passes
+//	PUT    /files/{key...}      store the body under key, see StoreWithContent
+//	POST   /files/{key...}?uploads upload the file under key in parts, see serveMultipart
+//	GET    /files/{key...}      the file stored under key with its manifest as headers, see Stat
+//	DELETE /files/{key...}      delete the file stored under key, see Delete
+//	GET    /share/{token}       the file a share token grants access to, see CreateShareToken
+//	GET    /signed/{key...}     the file a pre-signed URL grants access to, see PresignURL
+//	PUT    /signed/{key...}     store the body as a pre-signed URL allows, see PresignURL
+//	*      /dav/...             the files of this server over WebDAV, see WebDAVHandler
+//	GET    /acl/{key...}        the ACL a file is accessed under, or that of a prefix ending with a slash, see ACLOf
+//	PUT    /acl/{key...}        set the ACL of a file or prefix to an ACL body, see SetACL
+//	DELETE /acl/{key...}        remove the ACL of a file or prefix
+//
+// With Auth set, requests need credentials: fetching files the read scope,
+// storing, deleting and retaining them the write scope and everything else
+// the admin scope. Health checks, share tokens and pre-signed URLs need none. CORS lets
+// browsers on other origins make the requests. Requests of tenants over
+// their bandwidth quota are answered with 429, files that would take them
+// over their storage quota refused with 507, see Quotas. Requests on files
+// their ACL doesn't allow are refused with 403, see ACL.
+//
+// Errors are answered with a JSON body holding the error and, for errors
+// wrapping one of the typed errors such as ErrKeyNotFound, its code.
+func (s *FileServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Status())
+	})
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Peers())
+	})
+
+	mux.HandleFunc("GET /cluster", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.ClusterState())
+	})
+
+	mux.HandleFunc("GET /hints", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.PendingHints())
+	})
+
+	mux.HandleFunc("GET /replication", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.PendingReplication())
+	})
+
+	mux.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Usage())
+	})
+
+	mux.HandleFunc("GET /accounting", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Accounts())
+	})
+
+	mux.HandleFunc("GET /tenants", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Tenants())
+	})
+
+	mux.HandleFunc("GET /tenants/{tenant}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.TenantUsage(r.PathValue("tenant")))
+	})
+
+	mux.HandleFunc("GET /popular", func(w http.ResponseWriter, r *http.Request) {
+		n := defaultPopularCount
+		if v := r.URL.Query().Get("n"); len(v) > 0 {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid count %q", v))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, s.Popular(n))
+	})
+
+	mux.HandleFunc("GET /relay", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.RelayStats())
+	})
+
+	mux.HandleFunc("POST /peers", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Addr string `json:"addr"`
+			ID   string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Addr) == 0 && len(req.ID) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("expected a JSON body with an addr or id"))
+			return
+		}
+		var err error
+		if len(req.Addr) > 0 {
+			err = s.Connect(req.Addr)
+		} else {
+			err = s.ConnectRelayed(req.ID)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("DELETE /peers/{addr}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Disconnect(r.PathValue("addr")); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /peers/{addr}/limits", func(w http.ResponseWriter, r *http.Request) {
+		var limits p2p.PeerLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.SetPeerLimits(r.PathValue("addr"), limits); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /export", func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if v := r.URL.Query().Get("since"); len(v) > 0 {
+			var err error
+			if since, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		if _, err := s.ExportSince(w, since); err != nil {
+			log.Printf("[%s] export failed: %s", s.Transport.Addr(), err) // Too late for an error response
+		}
+	})
+
+	mux.HandleFunc("POST /import", func(w http.ResponseWriter, r *http.Request) {
+		info, err := s.Import(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"node": info.Node, "objects": info.Objects, "bytes": info.Bytes})
+	})
+
+	mux.HandleFunc("POST /migrate", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Addr string `json:"addr"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Addr) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("expected a JSON body with an addr"))
+			return
+		}
+		info, err := s.MigrateTo(req.Addr)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("POST /repack", func(w http.ResponseWriter, r *http.Request) {
+		report, err := s.Repack()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+
+	mux.HandleFunc("POST /rekey", func(w http.ResponseWriter, r *http.Request) {
+		n, err := s.RekeyReplicas()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"files": n})
+	})
+
+	s.handleDashboard(mux)
+	s.handleHealth(mux)
+	s.handleFiles(mux)
+	s.handleSigned(mux)
+	s.handleACLs(mux)
+	mux.Handle("/dav/", s.WebDAVHandler("/dav"))
+
+	return s.withCORS(s.withAuth(mux))
+}
+
+// serveAdmin starts serving the admin HTTP API in the background.
+func (s *FileServer) serveAdmin() error {
+	ln, err := net.Listen("tcp", s.admin.Addr)
+	if err != nil {
+		return err
+	}
+	if s.AdminTLS != nil {
+		ln = tls.NewListener(ln, s.AdminTLS)
+	}
+
+	log.Printf("[%s] admin API listening on %s", s.Transport.Addr(), ln.Addr())
+
+	go func() {
+		if err := s.admin.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[%s] admin API stopped: %s", s.Transport.Addr(), err)
+		}
+	}()
+
+	return nil
+}
+
+// statusFor maps an error returned by the server to an HTTP status code.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrPeerNotFound), errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPeerUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrBandwidthQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrStorageQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrInvalidShareToken), errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrForbidden), errors.Is(err, ErrImmutable):
+		return http.StatusForbidden
+	case errors.Is(err, ErrStorageFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrSizeRequired):
+		return http.StatusLengthRequired
+	case errors.Is(err, ErrChecksumMismatch):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response, with the code of the typed
+// error it wraps if any.
+func writeError(w http.ResponseWriter, code int, err error) {
+	body := map[string]string{"error": err.Error()}
+	if name := errorCode(err); len(name) > 0 {
+		body["code"] = name
+	}
+	writeJSON(w, code, body)
+}
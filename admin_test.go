@@ -0,0 +1,65 @@
+package dfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41100")
+	s2 := makeServer(t, "127.0.0.1:41101")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	api := httptest.NewServer(s2.AdminHandler())
+	defer api.Close()
+
+	// Connect s2 to s1 at runtime.
+	res, err := http.Post(api.URL+"/peers", "application/json", strings.NewReader(`{"addr":"127.0.0.1:41100"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	peer := s2.Peers()[0]
+	assert.Equal(t, s1.ID, peer.ID)
+	assert.Equal(t, "tcp", peer.Transport)
+	assert.True(t, peer.Outbound)
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.False(t, s1.Peers()[0].Outbound)
+
+	// Limit the peer.
+	req, _ := http.NewRequest(http.MethodPut, api.URL+"/peers/"+peer.Addr+"/limits", strings.NewReader(`{"max_send_rate":4096}`))
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Get(api.URL + "/peers")
+	assert.Nil(t, err)
+	var peers []PeerStatus
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&peers))
+	assert.Len(t, peers, 1)
+	assert.Equal(t, p2p.PeerLimits{MaxSendRate: 4096}, peers[0].Limits)
+
+	// Disconnect it again; the peer is gone on both sides.
+	req, _ = http.NewRequest(http.MethodDelete, api.URL+"/peers/"+peer.Addr, nil)
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Empty(t, s2.Peers())
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 0 }, time.Second, 10*time.Millisecond)
+
+	// Unknown peers are reported as such.
+	res, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
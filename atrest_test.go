@@ -0,0 +1,49 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerEncryptAtRest(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:   t.TempDir(),
+		EncKey:        crypto.NewEncryptionKey(),
+		Hasher:        crypto.SHA256Hasher,
+		Transport:     p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0"}),
+		EncryptAtRest: true,
+	})
+	assert.NotEqual(t, s.EncKey, s.store.(*storage.Store).EncKey)
+
+	require.NoError(t, s.Store("a.txt", strings.NewReader("hello world")))
+	r, err := s.Get("a.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+
+	r, err = s.GetRange("a.txt", 6, 5)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(got))
+
+	// Chunked files are encrypted chunk by chunk.
+	s.ChunkSize = 4
+	require.NoError(t, s.Append("log", strings.NewReader("hello world")))
+	r, err = s.Get("log")
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(got))
+}
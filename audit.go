@@ -0,0 +1,298 @@
+package dfs
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditMaxSize  = 64 << 20 // Size at which the audit log is rotated
+	defaultAuditMaxFiles = 5        // Rotated audit logs kept
+)
+
+// AuditOpts configures the audit log, an append-only record of every
+// storage operation of a server.
+type AuditOpts struct {
+	Path       string             // File the log is appended to, one JSON record per line
+	MaxSize    int64              // Size at which the file is rotated to Path.1, Path.2, ... (default 64 MiB)
+	MaxFiles   int                // Rotated files kept besides the current one (default 5)
+	SigningKey ed25519.PrivateKey // Signs every record if set
+}
+
+// AuditOp is the kind of operation an audit record is about.
+type AuditOp string
+
+const (
+	AuditStore             AuditOp = "store"              // A file was stored locally
+	AuditGet               AuditOp = "get"                // A file was read, from local disk or a peer
+	AuditDelete            AuditOp = "delete"             // A file was deleted locally
+	AuditReplicaSent       AuditOp = "replica_sent"       // A replica was sent to a peer
+	AuditReplicaReceived   AuditOp = "replica_received"   // A peer's replica was stored
+	AuditReplicationFailed AuditOp = "replication_failed" // A replica couldn't be sent to a peer
+	AuditReplicaServed     AuditOp = "replica_served"     // A replica, or part of one, was sent to the peer owning it
+	AuditReplicaDeleted    AuditOp = "replica_deleted"    // A peer's replica was deleted at its request
+	AuditArchived          AuditOp = "archived"           // An object nobody read was moved to an archive node
+	AuditRetention         AuditOp = "retention"          // The retention of a file or replica was set
+	AuditACL               AuditOp = "acl"                // The ACL of a file or replica was set
+)
+
+// AuditRecord is a single entry of the audit log. Keys are recorded by their
+// hash only. Every record carries the hash of the line before it, so records
+// can't be removed or altered without breaking the chain.
+type AuditRecord struct {
+	Seq     uint64    `json:"seq"`               // Position of the record in the log, from 1
+	Time    time.Time `json:"time"`              // When the operation happened
+	Op      AuditOp   `json:"op"`                // What happened
+	ID      string    `json:"id"`                // Namespace (server ID) the file belongs to
+	KeyHash string    `json:"key_hash"`          // Hash of the key the file is stored under
+	Size    int64     `json:"size,omitempty"`    // Bytes stored, read or sent
+	Peer    string    `json:"peer,omitempty"`    // Address of the peer involved
+	PeerID  string    `json:"peer_id,omitempty"` // Node ID of the peer involved
+	Error   string    `json:"error,omitempty"`   // Why the operation failed, empty if it succeeded
+	Prev    string    `json:"prev"`              // SHA-256 of the previous line, hex encoded
+	Sig     []byte    `json:"sig,omitempty"`     // Ed25519 signature of the record without Sig
+}
+
+// auditLog appends records to the audit log file, rotating it by size.
+type auditLog struct {
+	opts AuditOpts
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64  // Size of the current file
+	seq  uint64 // Sequence number of the last record
+	prev string // Hash of the last line
+}
+
+// openAuditLog opens the audit log for appending, carrying on the sequence
+// and hash chain of the records already in it.
+func openAuditLog(opts AuditOpts) (*auditLog, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultAuditMaxSize
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = defaultAuditMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.Path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	l := &auditLog{opts: opts}
+
+	// Pick up where the last record left off, in the current file or the
+	// last rotated one if the current file is empty
+	for _, path := range []string{opts.Path + ".1", opts.Path} {
+		seq, prev, err := lastAuditRecord(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(prev) > 0 {
+			l.seq, l.prev = seq, prev
+		}
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// lastAuditRecord returns the sequence number and line hash of the last
+// record in the log file at path, if any.
+func lastAuditRecord(path string) (uint64, string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var last []byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		last = append(last[:0], sc.Bytes()...)
+	}
+	if err := sc.Err(); err != nil || len(last) == 0 {
+		return 0, "", err
+	}
+
+	var rec AuditRecord
+	if err := json.Unmarshal(last, &rec); err != nil {
+		return 0, "", fmt.Errorf("reading the last record of %s: %w", path, err)
+	}
+	return rec.Seq, lineHash(last), nil
+}
+
+// lineHash returns the hash a record chains to the line before it with.
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// open opens the current file for appending.
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// append numbers, chains and signs rec and writes it to the log.
+func (l *auditLog) append(rec AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+
+	rec.Seq = l.seq + 1
+	rec.Prev = l.prev
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if l.opts.SigningKey != nil {
+		rec.Sig = ed25519.Sign(l.opts.SigningKey, line)
+		if line, err = json.Marshal(rec); err != nil {
+			return err
+		}
+	}
+
+	if l.size > 0 && l.size+int64(len(line))+1 > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.prev = rec.Seq, lineHash(line)
+	return nil
+}
+
+// rotate moves the current file to Path.1, shifting the older ones up and
+// dropping the oldest, and starts a new file. The caller must hold l.mu.
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+
+	for i := l.opts.MaxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", l.opts.Path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", l.opts.Path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.opts.Path, l.opts.Path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// close closes the log file.
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// VerifyAuditLog checks that the records read from r are numbered in order,
+// each chained to the line before it, starting from the line hashed to prev
+// (empty for the first file of a log), and signed with pub if it isn't nil.
+// It returns the hash of the last line, to verify the next file of a rotated
+// log with, oldest first.
+func VerifyAuditLog(r io.Reader, pub ed25519.PublicKey, prev string) (string, error) {
+	var seq uint64
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return "", fmt.Errorf("record after %d: %w", seq, err)
+		}
+		if seq > 0 && rec.Seq != seq+1 {
+			return "", fmt.Errorf("record %d follows record %d", rec.Seq, seq)
+		}
+		if rec.Prev != prev {
+			return "", fmt.Errorf("record %d doesn't chain to the record before it", rec.Seq)
+		}
+		if pub != nil {
+			sig := rec.Sig
+			rec.Sig = nil
+			unsigned, err := json.Marshal(rec)
+			if err != nil {
+				return "", err
+			}
+			if !ed25519.Verify(pub, unsigned, sig) {
+				return "", fmt.Errorf("record %d has an invalid signature", rec.Seq)
+			}
+		}
+
+		seq, prev = rec.Seq, lineHash(line)
+	}
+	return prev, sc.Err()
+}
+
+// audit records an operation on the file under keyHash in namespace id in
+// the audit log, if there is one. addr is the address of the peer involved,
+// empty for local operations.
+func (s *FileServer) audit(op AuditOp, id string, keyHash string, size int64, addr string, opErr error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	rec := AuditRecord{
+		Time:    time.Now().UTC(),
+		Op:      op,
+		ID:      id,
+		KeyHash: keyHash,
+		Size:    size,
+		Peer:    addr,
+	}
+	if len(addr) > 0 {
+		if peer, err := s.peer(addr); err == nil {
+			rec.PeerID = peer.ID()
+		}
+	}
+	if opErr != nil {
+		rec.Error = opErr.Error()
+	}
+
+	if err := s.auditLog.append(rec); err != nil {
+		log.Printf("[%s] writing the audit log failed: %s", s.Transport.Addr(), err)
+	}
+}
@@ -0,0 +1,134 @@
+package dfs
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAudit returns the ops recorded in the audit log at path.
+func readAudit(t *testing.T, path string) []AuditRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var recs []AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec AuditRecord
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditLog(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	opts := AuditOpts{Path: filepath.Join(t.TempDir(), "audit.log"), MaxSize: 1024, MaxFiles: 2, SigningKey: priv}
+
+	l, err := openAuditLog(opts)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.append(AuditRecord{Op: AuditStore, KeyHash: fmt.Sprint(i)}))
+	}
+	require.NoError(t, l.close())
+
+	// Reopened, the log carries on the sequence and the chain
+	l, err = openAuditLog(opts)
+	require.NoError(t, err)
+	for i := 5; i < 10; i++ {
+		require.NoError(t, l.append(AuditRecord{Op: AuditStore, KeyHash: fmt.Sprint(i)}))
+	}
+	require.NoError(t, l.close())
+
+	// Rotated by size, keeping two old files and dropping the oldest records
+	_, err = os.Stat(opts.Path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	files := []string{opts.Path + ".2", opts.Path + ".1", opts.Path}
+	recs := readAudit(t, files[0])
+	prev := recs[0].Prev
+	for _, path := range files {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		prev, err = VerifyAuditLog(f, pub, prev)
+		f.Close()
+		assert.NoError(t, err, path)
+	}
+	last := readAudit(t, opts.Path)
+	assert.Equal(t, uint64(10), last[len(last)-1].Seq)
+
+	// Altering a record breaks its signature, removing one breaks the chain
+	var all string
+	for _, path := range files {
+		buf, err := os.ReadFile(path)
+		require.NoError(t, err)
+		all += string(buf)
+	}
+	altered := strings.Replace(all, `"key_hash":"9"`, `"key_hash":"x"`, 1)
+	_, err = VerifyAuditLog(strings.NewReader(altered), pub, recs[0].Prev)
+	assert.ErrorContains(t, err, "signature")
+
+	lines := strings.SplitAfter(all, "\n")
+	removed := strings.Join(append(lines[:1:1], lines[2:]...), "")
+	_, err = VerifyAuditLog(strings.NewReader(removed), nil, recs[0].Prev)
+	assert.Error(t, err)
+}
+
+func TestAuditStorageOperations(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41284")
+	s2 := makeServer(t, "127.0.0.1:41285", "127.0.0.1:41284")
+	for _, s := range []*FileServer{s1, s2} {
+		var err error
+		s.auditLog, err = openAuditLog(AuditOpts{Path: filepath.Join(s.StorageRoot, "audit.log")})
+		require.NoError(t, err)
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s2.Store("audited.txt", strings.NewReader("on the record")))
+	require.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("audited.txt")) }, time.Second, 10*time.Millisecond)
+	r, err := s2.Get("audited.txt")
+	require.NoError(t, err)
+	io.Copy(io.Discard, r)
+	r.Close()
+	require.NoError(t, s2.Delete("audited.txt"))
+	assert.Eventually(t, func() bool { return !s1.store.Has(s2.ID, s2.hashKey("audited.txt")) }, time.Second, 10*time.Millisecond)
+
+	ops := func(path string) []AuditOp {
+		var ops []AuditOp
+		for _, rec := range readAudit(t, path) {
+			assert.Equal(t, s2.ID, rec.ID)
+			assert.Equal(t, s2.hashKey("audited.txt"), rec.KeyHash)
+			assert.Empty(t, rec.Error)
+			ops = append(ops, rec.Op)
+		}
+		return ops
+	}
+	assert.Equal(t, []AuditOp{AuditStore, AuditReplicaSent, AuditGet, AuditDelete}, ops(filepath.Join(s2.StorageRoot, "audit.log")))
+	// The replica is deleted before the delete is recorded
+	assert.Eventually(t, func() bool { return len(readAudit(t, filepath.Join(s1.StorageRoot, "audit.log"))) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []AuditOp{AuditReplicaReceived, AuditReplicaDeleted}, ops(filepath.Join(s1.StorageRoot, "audit.log")))
+
+	// Records about peers name them
+	recs := readAudit(t, filepath.Join(s1.StorageRoot, "audit.log"))
+	assert.Equal(t, s2.ID, recs[0].PeerID)
+
+	f, err := os.Open(filepath.Join(s1.StorageRoot, "audit.log"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = VerifyAuditLog(f, nil, "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,144 @@
+package dfs
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Credentials are what a client of the admin API or a dialing peer presents
+// to authenticate.
+type Credentials struct {
+	Token string // Bearer token or API key, empty if none
+
+	// Certificates is the client certificate chain of the TLS connection,
+	// leaf first, nil without TLS or client certificate. Peers present none.
+	Certificates []*x509.Certificate
+
+	NodeID string // ID the peer announced in its handshake, empty for clients of the admin API
+}
+
+// Principal is who credentials belong to and what they allow.
+type Principal struct {
+	Subject string // Who the credentials belong to, such as a user, a service or a node, empty if unknown
+	Scope   Scope  // What the credentials allow
+	Tenant  string // Tenant the credentials act for, see FileServerOpts.Quotas; empty if none
+}
+
+// Authenticator checks credentials against an identity system. It returns
+// an error wrapping ErrUnauthorized for credentials it doesn't accept,
+// missing ones included.
+type Authenticator interface {
+	Authenticate(ctx context.Context, c Credentials) (Principal, error)
+}
+
+// AuthenticatorFunc is a function used as an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, c Credentials) (Principal, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	return f(ctx, c)
+}
+
+// ChainAuthenticators returns an Authenticator trying auths in order. It
+// returns the principal of the first that accepts the credentials, the error
+// of the first that fails for any reason other than ErrUnauthorized, and
+// ErrUnauthorized otherwise.
+func ChainAuthenticators(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, c Credentials) (Principal, error) {
+		var errs []error
+		for _, auth := range auths {
+			id, err := auth.Authenticate(ctx, c)
+			if err == nil {
+				return id, nil
+			}
+			if !errors.Is(err, ErrUnauthorized) {
+				return Principal{}, err
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return Principal{}, fmt.Errorf("%w: no authenticator", ErrUnauthorized)
+		}
+		return Principal{}, errors.Join(errs...)
+	})
+}
+
+// StaticTokens authenticates fixed tokens, such as API keys or a token
+// shared by the nodes of a cluster, as the principal they map to.
+type StaticTokens map[string]Principal
+
+// Authenticate returns the principal of the token of c.
+func (t StaticTokens) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	if len(c.Token) == 0 {
+		return Principal{}, fmt.Errorf("%w: no token", ErrUnauthorized)
+	}
+	for token, id := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			return id, nil
+		}
+	}
+	return Principal{}, fmt.Errorf("%w: unknown token", ErrUnauthorized)
+}
+
+// CertAuthenticator authenticates the client certificates of TLS
+// connections, such as those of the admin API served with AdminTLS, by the
+// common name of their subject.
+type CertAuthenticator struct {
+	// Roots are the CAs client certificates must chain to. If nil the chain
+	// verified by TLS is trusted, which needs AdminTLS to require and verify
+	// client certificates.
+	Roots *x509.CertPool
+
+	// Principals maps the common names of the certificates accepted to
+	// their principal; the common name is its Subject unless it names one.
+	// Other certificates are refused.
+	Principals map[string]Principal
+}
+
+// Authenticate returns the principal of the leaf certificate of c.
+func (a *CertAuthenticator) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	if len(c.Certificates) == 0 {
+		return Principal{}, fmt.Errorf("%w: no client certificate", ErrUnauthorized)
+	}
+	leaf := c.Certificates[0]
+	if a.Roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range c.Certificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         a.Roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return Principal{}, fmt.Errorf("%w: client certificate: %s", ErrUnauthorized, err)
+		}
+	}
+	id, ok := a.Principals[leaf.Subject.CommonName]
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: unknown client certificate %q", ErrUnauthorized, leaf.Subject.CommonName)
+	}
+	if len(id.Subject) == 0 {
+		id.Subject = leaf.Subject.CommonName
+	}
+	return id, nil
+}
+
+// peerAuthenticator returns the function the hello handshake checks the
+// credential of peers with: peers must authenticate with the admin scope.
+func peerAuthenticator(auth Authenticator) func(nodeID string, credential string) error {
+	return func(nodeID string, credential string) error {
+		id, err := auth.Authenticate(context.Background(), Credentials{Token: credential, NodeID: nodeID})
+		if err != nil {
+			return err
+		}
+		if id.Scope < ScopeAdmin {
+			return fmt.Errorf("%w: peer %s authenticated with the %s scope, not admin", ErrForbidden, nodeID, id.Scope)
+		}
+		return nil
+	}
+}
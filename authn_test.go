@@ -0,0 +1,115 @@
+package dfs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	tokens := StaticTokens{"cluster-token": {Subject: "cluster", Scope: ScopeAdmin}}
+	broken := AuthenticatorFunc(func(ctx context.Context, c Credentials) (Principal, error) {
+		return Principal{}, errors.New("provider unreachable")
+	})
+
+	p, err := ChainAuthenticators(&CertAuthenticator{}, tokens).Authenticate(ctx, Credentials{Token: "cluster-token"})
+	require.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "cluster", Scope: ScopeAdmin}, p)
+
+	_, err = ChainAuthenticators(&CertAuthenticator{}, tokens).Authenticate(ctx, Credentials{Token: "guess"})
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	_, err = ChainAuthenticators(tokens, broken).Authenticate(ctx, Credentials{Token: "guess"})
+	assert.NotErrorIs(t, err, ErrUnauthorized, "failures other than refusals are passed on")
+	_, err = ChainAuthenticators().Authenticate(ctx, Credentials{Token: "cluster-token"})
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	// Peers must authenticate with the admin scope.
+	check := peerAuthenticator(StaticTokens{"cluster-token": {Scope: ScopeAdmin}, "reader": {Scope: ScopeRead}})
+	assert.NoError(t, check("node-1", "cluster-token"))
+	assert.ErrorIs(t, check("node-1", "reader"), ErrForbidden)
+	assert.ErrorIs(t, check("node-1", ""), ErrUnauthorized)
+}
+
+// newTestCert returns a certificate for the common name cn signed by parent,
+// self-signed if parent is nil, with its key.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	ca := newTestCert(t, "dfs CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	backup := newTestCert(t, "backup", &ca)
+	stranger := newTestCert(t, "backup", nil) // Same name, not signed by the CA
+
+	s := newExportServer(t)
+	s.Auth = &AuthOpts{
+		APIKeys:       map[string]Scope{"reader": ScopeRead},
+		Authenticator: &CertAuthenticator{Roots: roots, Principals: map[string]Principal{"backup": {Scope: ScopeWrite, Tenant: "ops"}}},
+	}
+	api := httptest.NewUnstartedServer(s.AdminHandler())
+	api.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	api.StartTLS()
+	defer api.Close()
+	put := func(cert *tls.Certificate, apiKey string) int {
+		t.Helper()
+		client := api.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client.Transport = transport
+		req, _ := http.NewRequest(http.MethodPut, api.URL+"/files/a.txt", strings.NewReader("contents"))
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusCreated, put(&backup, ""))
+	meta, _ := s.store.Meta(s.ID, "a.txt")
+	assert.Equal(t, "ops", meta.Tenant)
+	assert.Equal(t, http.StatusUnauthorized, put(&stranger, ""))
+	assert.Equal(t, http.StatusUnauthorized, put(nil, ""))
+	assert.Equal(t, http.StatusForbidden, put(nil, "reader"), "API keys are checked first")
+}
@@ -0,0 +1,147 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSKMS wraps keys with a key of AWS Key Management Service, which never
+// leaves it. Requests are signed with Signature Version 4; the credentials
+// must be allowed kms:Encrypt and kms:Decrypt on the key.
+type AWSKMS struct {
+	Region string // Region of the key, such as eu-west-1
+	KeyID  string // ID, ARN or alias of the key wrapping the keys, such as alias/dfs
+
+	AccessKeyID     string // Access key of the credentials
+	SecretAccessKey string // Secret key of the credentials
+	SessionToken    string // Session token of temporary credentials, none if empty
+
+	Endpoint string       // URL of the service, https://kms.<Region>.amazonaws.com if empty
+	Client   *http.Client // Client making the requests, http.DefaultClient if nil
+}
+
+// Encrypt wraps plaintext, up to 4 KiB, with the key.
+func (k *AWSKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	var res struct {
+		CiphertextBlob []byte
+	}
+	if err := k.call(ctx, "Encrypt", map[string]any{"KeyId": k.KeyID, "Plaintext": plaintext}, &res); err != nil {
+		return nil, err
+	}
+	return res.CiphertextBlob, nil
+}
+
+// Decrypt unwraps a ciphertext returned by Encrypt.
+func (k *AWSKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	var res struct {
+		Plaintext []byte
+	}
+	if err := k.call(ctx, "Decrypt", map[string]any{"KeyId": k.KeyID, "CiphertextBlob": ciphertext}, &res); err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
+
+// call calls the action of the KMS JSON API with body and decodes the
+// answer into res. Byte slices are sent and answered base64 encoded, as
+// encoding/json does.
+func (k *AWSKMS) call(ctx context.Context, action string, body any, res any) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := k.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = "https://kms." + k.Region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if len(k.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", k.SessionToken)
+	}
+	signV4(req, buf, k.AccessKeyID, k.SecretAccessKey, k.Region, "kms", time.Now())
+
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&awsErr)
+		return fmt.Errorf("aws kms %s with key %q: %s %s %s", action, k.KeyID, resp.Status, awsErr.Type, awsErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// signV4 signs req, whose body is body, for service in region with AWS
+// Signature Version 4 at time now. Every header of req is signed, along with
+// its host and the X-Amz-Date header signV4 sets.
+func signV4(req *http.Request, body []byte, accessKeyID string, secretAccessKey string, region string, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	bodySum := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodySum[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
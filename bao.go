@@ -0,0 +1,113 @@
+package dfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+
+	"lukechampine.com/blake3/bao"
+)
+
+// baoGroup is the size of the groups of chunks Bao encodings are verified in,
+// as a power of two of BLAKE3 chunks: 16 KiB, the tree taking up 64 bytes per
+// group.
+const baoGroup = 4
+
+// baoGroupSize is the size of a group of baoGroup chunks in bytes.
+const baoGroupSize = 1024 << baoGroup
+
+// serveBao answers r with the file stored under key as a Bao encoding: the
+// file interleaved with the BLAKE3 tree hashing it, so downloaders knowing the
+// BLAKE3 hash of the file verify every group of chunks as it arrives and stop
+// at the first corrupt one rather than after reading the whole file. The tree
+// takes a pass over the file before it is sent, so the file is spooled to a
+// temporary file first.
+func (s *FileServer) serveBao(w http.ResponseWriter, r *http.Request, key string) {
+	f, err := s.GetContext(r.Context(), key)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	defer f.Close()
+
+	tmp, err := os.CreateTemp("", "dfs-bao-*")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, f)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	outboard := make([]byte, bao.EncodedSize(int(size), baoGroup, true))
+	if _, err := bao.Encode(&bufferAt{outboard}, io.NewSectionReader(tmp, 0, size), size, baoGroup, true); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(size+int64(len(outboard)), 10))
+	h.Set("X-Dfs-Bao-Group", strconv.Itoa(baoGroup))
+	if err := writeBao(w, io.NewSectionReader(tmp, 0, size), outboard); err != nil {
+		log.Printf("[%s] serving (%s) failed: %s", s.Transport.Addr(), key, err) // Too late for an error response
+	}
+}
+
+// writeBao writes the combined Bao encoding of data to w, given its outboard
+// encoding: the length of the data, then the parent nodes of the tree in
+// pre-order, each followed by its subtrees and every leaf by its group of
+// chunks.
+func writeBao(w io.Writer, data io.Reader, outboard []byte) error {
+	if len(outboard) < 8 {
+		return errors.New("outboard encoding too short")
+	}
+	if _, err := w.Write(outboard[:8]); err != nil {
+		return err
+	}
+	tree := outboard[8:]
+
+	var rec func(n uint64) error
+	rec = func(n uint64) error {
+		if n <= baoGroupSize {
+			_, err := io.CopyN(w, data, int64(n))
+			return err
+		}
+		if len(tree) < 64 {
+			return errors.New("outboard encoding too short")
+		}
+		if _, err := w.Write(tree[:64]); err != nil {
+			return err
+		}
+		tree = tree[64:]
+
+		mid := uint64(1) << (bits.Len64(n-1) - 1)
+		if err := rec(mid); err != nil {
+			return err
+		}
+		return rec(n - mid)
+	}
+	return rec(binary.LittleEndian.Uint64(outboard[:8]))
+}
+
+// bufferAt is an io.WriterAt writing to a buffer of the final size.
+type bufferAt struct {
+	buf []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b.buf)) {
+		return 0, fmt.Errorf("writing %d bytes at %d past the end of a %d byte buffer", len(p), off, len(b.buf))
+	}
+	return copy(b.buf[off:], p), nil
+}
@@ -0,0 +1,46 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+	"lukechampine.com/blake3/bao"
+)
+
+func TestServeBao(t *testing.T) {
+	s := newExportServer(t)
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	for _, size := range []int{0, 100, baoGroupSize, 5*baoGroupSize + 123} {
+		data := make([]byte, size)
+		rand.Read(data)
+		key := "bao/" + strconv.Itoa(size)
+		require.NoError(t, s.Store(key, bytes.NewReader(data)))
+
+		res, err := http.Get(api.URL + "/bao/" + key)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, int64(bao.EncodedSize(size, baoGroup, false)), res.ContentLength)
+		group, _ := strconv.Atoi(res.Header.Get("X-Dfs-Bao-Group"))
+
+		var buf bytes.Buffer
+		ok, err := bao.Decode(&buf, res.Body, nil, group, blake3.Sum256(data))
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.True(t, ok, "size %d", size)
+		assert.Equal(t, string(data), buf.String())
+	}
+
+	res, err := http.Get(api.URL + "/bao/missing")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
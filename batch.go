@@ -0,0 +1,414 @@
+package dfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// BatchFile is one of the files of a MessageStoreBatch.
+type BatchFile struct {
+	Key  string // Hashed key of the file
+	Size int64  // Size of the encrypted file in bytes
+}
+
+// MessageStoreBatch asks a peer to store the replicas of several files, which
+// follow it on the stream one after the other. The peer answers every file
+// with a response once it is stored, in order.
+type MessageStoreBatch struct {
+	ID    string      // ID of the owner of the files
+	Files []BatchFile // Files in the order they follow
+}
+
+// MessageGetBatch asks a peer for the replicas of several files. The peer
+// answers every file in order on the stream: with a response, followed by the
+// size and the data of the file if it serves it.
+type MessageGetBatch struct {
+	ID   string   // ID of the owner of the files
+	Keys []string // Hashed keys of the files
+}
+
+// StoreBatch stores several files like Store, sending the replicas bound for
+// each peer on a single stream, one after the other, rather than on a stream
+// of their own. Workloads of many small files save the round trip and the
+// messages of every file. Files are stored in the order of their keys; those
+// that fail don't stop the others, and the error returned joins their errors.
+func (s *FileServer) StoreBatch(files map[string]io.Reader) error {
+	var errs []error
+	keys := slices.Sorted(maps.Keys(files))
+	if s.Gateway {
+		for _, key := range keys {
+			if err := s.Store(key, files[key]); err != nil {
+				errs = append(errs, fmt.Errorf("storing (%s): %w", key, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	// Write every file to local storage, gathering the replicas to send to
+	// each peer.
+	var (
+		sizes    = make(map[string]int64)
+		replicas = make(map[string][]string) // Servers holding a copy of each file once replication is done
+		peers    = make(map[string]p2p.Peer)
+		batches  = make(map[string][]string) // Keys of the files to send to each peer, by address
+	)
+	s.wakeIdle() // Peers closed for being idle may be meant to get a copy
+	for _, key := range keys {
+		size, err := s.storeLocal(key, files[key], nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storing (%s): %w", key, err))
+			continue
+		}
+		sizes[key] = size
+		replicas[key] = []string{s.ID}
+
+		sendTo, targets := s.replicaPeers(key, size)
+		s.hintMissing(key, targets) // Servers that are down get the file when they return
+		for _, peer := range sendTo {
+			// Replicas sent in the background are recorded as held already
+			if s.queueReplica(peer, key, PriorityWrite) {
+				replicas[key] = append(replicas[key], peer.ID())
+				continue
+			}
+			addr := peer.RemoteAddr().String()
+			peers[addr] = peer
+			batches[addr] = append(batches[addr], key)
+		}
+	}
+	defer func() {
+		for key, size := range sizes {
+			s.recordStored(key, size, replicas[key])
+		}
+	}()
+
+	// Encrypt every file once, then send every peer its batch on a
+	// goroutine of its own.
+	spools := make(map[string]*spool)
+	defer func() {
+		for _, sp := range spools {
+			sp.close()
+		}
+	}()
+	for addr, batch := range batches {
+		batches[addr] = slices.DeleteFunc(batch, func(key string) bool {
+			if spools[key] != nil {
+				return false
+			}
+			sp, err := s.newSpool(key)
+			if err != nil {
+				s.replicationFailed(key, peers[addr], err)
+				return true
+			}
+			spools[key] = sp
+			return false
+		})
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for addr, batch := range batches {
+		wg.Add(1)
+		go func(peer p2p.Peer, batch []string) {
+			defer wg.Done()
+
+			sent := s.sendBatch(peer, batch, spools)
+			mu.Lock()
+			defer mu.Unlock()
+			for i, key := range batch {
+				if sent[i] != nil {
+					s.replicationFailed(key, peer, sent[i])
+					continue
+				}
+				replicas[key] = append(replicas[key], peer.ID())
+			}
+		}(peers[addr], batch)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// sendBatch sends peer the replicas of the files under keys, encrypted in
+// spools, on a single stream, and returns the error of every file, nil for
+// those the peer stored. Peers without multiplexing are sent the files one at
+// a time.
+func (s *FileServer) sendBatch(peer p2p.Peer, keys []string, spools map[string]*spool) []error {
+	errs := make([]error, len(keys))
+	fail := func(from int, err error) {
+		for i := from; i < len(keys); i++ {
+			errs[i] = err
+		}
+	}
+
+	stream, err := s.openStream(peer)
+	if errors.Is(err, p2p.ErrNotMultiplexed) {
+		for i, key := range keys {
+			msg := Message{Payload: MessageStoreFile{ID: s.ID, Key: s.hashKey(key), Size: spools[key].size, Frame: spools[key].frame()}}
+			errs[i] = s.replicate(context.Background(), peer, key, &msg, spools[key], nil)
+		}
+		return errs
+	}
+	if err != nil {
+		fail(0, err)
+		return errs
+	}
+	defer stream.Close()
+
+	msg := MessageStoreBatch{ID: s.ID}
+	for _, key := range keys {
+		msg.Files = append(msg.Files, BatchFile{Key: s.hashKey(key), Size: spools[key].size})
+	}
+	if err := writeMessage(stream, &Message{Payload: msg}); err != nil {
+		fail(0, err)
+		return errs
+	}
+
+	// The peer answers every file once it is stored, while the next ones
+	// are sent. Files it refuses are skipped over by the peer; a stream
+	// breaking off fails the files left.
+	answered := make(chan struct{})
+	go func() {
+		defer close(answered)
+		for i := range keys {
+			err := readResponse(stream)
+			var respErr *ResponseError
+			if err != nil && !errors.As(err, &respErr) {
+				fail(i, err)
+				stream.SetWriteDeadline(time.Now())
+				return
+			}
+			errs[i] = err
+		}
+	}()
+
+	for _, key := range keys {
+		if _, err := io.Copy(stream, spools[key].reader()); err != nil {
+			stream.Close() // Let the peer know no more is coming
+			break
+		}
+	}
+	<-answered
+
+	var sent int64
+	addr := peer.RemoteAddr().String()
+	for i, key := range keys {
+		if errs[i] == nil {
+			sent += spools[key].size
+			s.audit(AuditReplicaSent, s.ID, s.hashKey(key), spools[key].size, addr, nil)
+		}
+	}
+	s.account(peer, PeerTraffic{Sent: sent})
+	fmt.Printf("[%s] sent (%d) bytes of %d files to (%s)\n", s.Transport.Addr(), sent, len(keys), addr)
+	return errs
+}
+
+// handleMessageStoreBatch stores the replicas following a MessageStoreBatch,
+// answering each once it is stored.
+func (s *FileServer) handleMessageStoreBatch(rpc p2p.RPC, msg MessageStoreBatch) error {
+	if rpc.Conn == nil {
+		return errors.New("batches need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	var errs []error
+	for _, f := range msg.Files {
+		// Files refused are skipped over to get to the next one
+		r := &exactReader{r: rpc.Conn, left: f.Size}
+		err := s.receiveFile(rpc.From, r, MessageStoreFile{ID: msg.ID, Key: f.Key, Size: f.Size})
+		if _, derr := io.Copy(io.Discard, r); derr != nil {
+			return errors.Join(err, derr) // No more files follow
+		}
+		if werr := writeResponse(rpc.Conn, err); werr != nil {
+			return werr
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetBatch retrieves several files like Get, fetching those not held locally
+// from each peer on a single stream rather than on a stream of their own.
+// Files no peer served in a batch are fetched on their own. GetBatch returns
+// the files retrieved by key, which must be closed, even if others failed;
+// the error returned joins the errors of those.
+func (s *FileServer) GetBatch(keys []string) (map[string]io.ReadCloser, error) {
+	var missing []string
+	for _, key := range keys {
+		if !s.store.Has(s.ID, key) {
+			missing = append(missing, key)
+		}
+	}
+	slices.Sort(missing)
+	missing = slices.Compact(missing)
+
+	fetched := make(map[string]bool)
+	if len(missing) > 0 {
+		s.wakeIdle() // Peers closed for being idle may hold the files
+		for _, peer := range s.peerList() {
+			for _, key := range s.fetchBatch(peer, missing) {
+				fetched[key] = true
+			}
+			missing = slices.DeleteFunc(missing, func(key string) bool { return fetched[key] })
+			if len(missing) == 0 {
+				break
+			}
+		}
+	}
+
+	var errs []error
+	files := make(map[string]io.ReadCloser)
+	for _, key := range keys {
+		if files[key] != nil {
+			continue
+		}
+
+		var (
+			r   io.ReadCloser
+			err error
+		)
+		if fetched[key] {
+			if _, r, err = s.store.Read(s.ID, key); err == nil {
+				r, err = s.openChunked(r)
+			}
+		} else {
+			r, err = s.Get(key)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("getting (%s): %w", key, err))
+			continue
+		}
+		files[key] = r
+	}
+	return files, errors.Join(errs...)
+}
+
+// fetchBatch asks peer for the files under keys on a single stream, writing
+// those it serves to local storage, and returns their keys.
+func (s *FileServer) fetchBatch(peer p2p.Peer, keys []string) []string {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		if !errors.Is(err, p2p.ErrNotMultiplexed) {
+			log.Printf("[%s] open stream to (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		}
+		return nil
+	}
+	defer stream.Close()
+
+	msg := MessageGetBatch{ID: s.ID}
+	for _, key := range keys {
+		msg.Keys = append(msg.Keys, s.hashKey(key))
+	}
+	if err := writeMessage(stream, &Message{Payload: msg}); err != nil {
+		log.Printf("[%s] asking (%s) for %d files failed: %s", s.Transport.Addr(), peer.RemoteAddr(), len(keys), err)
+		return nil
+	}
+
+	var fetched []string
+	from := peer.RemoteAddr().String()
+	for _, key := range keys {
+		err := s.fetchBatchFile(stream, key, from)
+		var respErr *ResponseError
+		if errors.As(err, &respErr) {
+			continue // Not served, the next file follows
+		}
+		if err != nil {
+			log.Printf("[%s] fetching (%s) from (%s) failed: %s", s.Transport.Addr(), key, from, err)
+			break
+		}
+		fetched = append(fetched, key)
+	}
+	return fetched
+}
+
+// fetchBatchFile reads the answer for the file under key from stream, sent by
+// the peer at from in answer to a MessageGetBatch, and decrypts the file into
+// local storage. A peer not serving the file answers with a *ResponseError,
+// which is returned; other errors leave the stream unusable.
+func (s *FileServer) fetchBatchFile(stream io.Reader, key string, from string) error {
+	if err := readResponse(stream); err != nil {
+		return err
+	}
+	var size int64
+	if err := binary.Read(stream, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+
+	r := &exactReader{r: stream, left: size}
+	iv := make([]byte, crypto.IVSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return err
+	}
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	ctr, err := crypto.NewCTRAt(objectKey, iv, 0)
+	if err != nil {
+		return err
+	}
+	n, err := s.store.Write(s.ID, key, cipher.StreamReader{S: ctr, R: r})
+	s.audit(AuditGet, s.ID, s.hashKey(key), n, from, err)
+	s.accountAddr(from, PeerTraffic{Fetched: size - r.left})
+	if err != nil {
+		return err
+	}
+	s.events.emit(FileFetched{EventMeta: newEventMeta(), Key: key, Size: n, From: from})
+	return nil
+}
+
+// handleMessageGetBatch serves the files a MessageGetBatch asks for, one
+// after the other.
+func (s *FileServer) handleMessageGetBatch(rpc p2p.RPC, msg MessageGetBatch) error {
+	if rpc.Conn == nil {
+		return errors.New("batches need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	for _, key := range msg.Keys {
+		if err := s.serveBatchFile(rpc, msg.ID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveBatchFile answers the request of a batch for the file stored under key
+// by id. Files this server doesn't serve are answered with the reason; the
+// errors returned leave the stream unusable.
+func (s *FileServer) serveBatchFile(rpc p2p.RPC, id string, key string) error {
+	size, r, err := s.readReplica(id, key)
+	if err != nil {
+		return writeResponse(rpc.Conn, err)
+	}
+	defer r.Close()
+
+	if err := writeResponse(rpc.Conn, nil); err != nil {
+		return err
+	}
+	if err := binary.Write(rpc.Conn, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	n, err := sendFile(rpc.Conn, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("sent %d of %d bytes of (%s)", n, size, key)
+	}
+	s.audit(AuditReplicaServed, id, key, n, rpc.From, err)
+	s.accountAddr(rpc.From, PeerTraffic{Served: n})
+	return err
+}
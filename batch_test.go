@@ -0,0 +1,51 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41362", StorageRoot: t.TempDir(), ID: "owner"})
+	go s1.Start()
+	defer s1.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41363", StorageRoot: t.TempDir(), ID: "replica", BootstrapNodes: []string{"127.0.0.1:41362"}})
+	go s2.Start()
+	defer s2.Stop()
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	files := map[string]string{"a.txt": "first", "b.txt": "second", "c.txt": strings.Repeat("third", 1000)}
+	readers := make(map[string]io.Reader)
+	for key, contents := range files {
+		readers[key] = strings.NewReader(contents)
+	}
+	require.NoError(t, s1.StoreBatch(readers))
+	for key := range files {
+		assert.True(t, s1.store.Has(s1.ID, key))
+		assert.True(t, s2.store.Has("owner", s1.hashKey(key)), key)
+	}
+	assert.Empty(t, s1.PendingHints())
+
+	// Files held locally are read from disk, the others fetched from the
+	// peer in a batch, and files on no peer fail on their own.
+	require.NoError(t, s1.store.Delete(s1.ID, "b.txt"))
+	require.NoError(t, s1.store.Delete(s1.ID, "c.txt"))
+	got, err := s1.GetBatch([]string{"a.txt", "b.txt", "c.txt", "b.txt", "missing.txt"})
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorContains(t, err, "missing.txt")
+	require.Len(t, got, 3)
+	for key, contents := range files {
+		b, err := io.ReadAll(got[key])
+		require.NoError(t, err)
+		got[key].Close()
+		assert.Equal(t, contents, string(b), key)
+	}
+	assert.True(t, s1.store.Has(s1.ID, "c.txt"))
+}
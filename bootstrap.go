@@ -0,0 +1,148 @@
+package dfs
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBootstrapConcurrency   = 4               // Bootstrap nodes dialed at the same time.
+	defaultBootstrapRetryInterval = 2 * time.Second // Wait before the first retry of a failed dial.
+	maxBootstrapRetryInterval     = 2 * time.Minute // Upper bound for the retry backoff.
+)
+
+// BootstrapState describes how far along dialing a bootstrap node is.
+type BootstrapState string
+
+const (
+	BootstrapPending   BootstrapState = "pending"   // Not dialed yet.
+	BootstrapDialing   BootstrapState = "dialing"   // Dial in progress.
+	BootstrapConnected BootstrapState = "connected" // Dial succeeded.
+	BootstrapRetrying  BootstrapState = "retrying"  // Last dial failed, waiting to try again.
+)
+
+// BootstrapStatus reports the dialing progress of a single bootstrap node.
+type BootstrapStatus struct {
+	Addr        string         `json:"addr"`
+	State       BootstrapState `json:"state"`
+	Attempts    int            `json:"attempts"`
+	LastError   string         `json:"last_error,omitempty"`
+	LastAttempt time.Time      `json:"last_attempt"`
+}
+
+// bootstrapManager dials the configured bootstrap nodes concurrently, bounded
+// by a concurrency limit, and keeps retrying failed nodes in the background
+// with an exponential backoff until they connect or the server stops.
+type bootstrapManager struct {
+	dial          func(string) error // Dials a single address, usually Transport.Dial.
+	concurrency   int                // Maximum number of dials in flight.
+	retryInterval time.Duration      // Initial backoff after a failed dial.
+	quitch        <-chan struct{}    // Closed when the server stops.
+
+	mu     sync.Mutex
+	status map[string]*BootstrapStatus
+}
+
+// newBootstrapManager creates a manager for nodes, skipping empty and duplicate addresses.
+func newBootstrapManager(dial func(string) error, nodes []string, concurrency int, retryInterval time.Duration, quitch <-chan struct{}) *bootstrapManager {
+	if concurrency <= 0 {
+		concurrency = defaultBootstrapConcurrency
+	}
+	if retryInterval <= 0 {
+		retryInterval = defaultBootstrapRetryInterval
+	}
+
+	b := &bootstrapManager{
+		dial:          dial,
+		concurrency:   concurrency,
+		retryInterval: retryInterval,
+		quitch:        quitch,
+		status:        make(map[string]*BootstrapStatus),
+	}
+	for _, addr := range nodes {
+		if len(addr) == 0 {
+			continue // Skip empty addresses
+		}
+		b.status[addr] = &BootstrapStatus{Addr: addr, State: BootstrapPending}
+	}
+
+	return b
+}
+
+// start dials every bootstrap node in the background and returns immediately.
+func (b *bootstrapManager) start() {
+	sem := make(chan struct{}, b.concurrency)
+	for addr := range b.status {
+		go b.run(addr, sem)
+	}
+}
+
+// run dials addr until it succeeds or the server stops, doubling the wait
+// between attempts up to maxBootstrapRetryInterval.
+func (b *bootstrapManager) run(addr string, sem chan struct{}) {
+	backoff := b.retryInterval
+	for {
+		// Wait for a free dial slot.
+		select {
+		case sem <- struct{}{}:
+		case <-b.quitch:
+			return
+		}
+
+		b.update(addr, func(st *BootstrapStatus) {
+			st.State = BootstrapDialing
+			st.Attempts++
+			st.LastAttempt = time.Now()
+		})
+		err := b.dial(addr)
+		<-sem
+
+		if err == nil {
+			b.update(addr, func(st *BootstrapStatus) {
+				st.State = BootstrapConnected
+				st.LastError = ""
+			})
+			return
+		}
+
+		log.Printf("bootstrap dial to %s failed, retrying in %s: %s", addr, backoff, err)
+		b.update(addr, func(st *BootstrapStatus) {
+			st.State = BootstrapRetrying
+			st.LastError = err.Error()
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-b.quitch:
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxBootstrapRetryInterval {
+			backoff = maxBootstrapRetryInterval
+		}
+	}
+}
+
+// update applies fn to the status of addr under the lock.
+func (b *bootstrapManager) update(addr string, fn func(*BootstrapStatus)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn(b.status[addr])
+}
+
+// Status returns a snapshot of every bootstrap node's status, sorted by address.
+func (b *bootstrapManager) Status() []BootstrapStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]BootstrapStatus, 0, len(b.status))
+	for _, st := range b.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+
+	return out
+}
@@ -0,0 +1,65 @@
+package dfs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootstrapManager(t *testing.T) {
+	var (
+		inflight    int32
+		maxInflight int32
+		mu          sync.Mutex
+		attempts    = map[string]int{}
+	)
+
+	// Every node fails its first dial, so each of them has to be retried.
+	dial := func(addr string) error {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[addr]++
+		if attempts[addr] == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	quitch := make(chan struct{})
+	defer close(quitch)
+
+	nodes := []string{":3001", ":3002", ":3003", ":3004", ":3005", "", ":3001"}
+	b := newBootstrapManager(dial, nodes, 2, time.Millisecond, quitch)
+	b.start()
+
+	assert.Eventually(t, func() bool {
+		for _, st := range b.Status() {
+			if st.State != BootstrapConnected {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 5*time.Millisecond)
+
+	status := b.Status()
+	assert.Len(t, status, 5)
+	for _, st := range status {
+		assert.Equal(t, 2, st.Attempts)
+		assert.Empty(t, st.LastError)
+	}
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInflight), int32(2))
+}
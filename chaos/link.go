@@ -0,0 +1,183 @@
+// Package chaos injects network faults between in-process nodes. Nodes are
+// connected through Links, TCP proxies that can be cut, slowed down or made
+// to truncate traffic, and a Network groups them to partition the cluster.
+// A Transport wrapping the TCP transport of a node delays or drops its
+// traffic with single peers instead, without proxying it.
+package chaos
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Link is a TCP proxy standing in for the network between two nodes: one
+// dials the Link's address instead of the other's, and every fault applied
+// to the Link hits the traffic between them in both directions.
+type Link struct {
+	ln     net.Listener
+	target string
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{} // Both ends of every proxied connection
+	cut      bool                  // Connections are refused while set
+	latency  time.Duration         // Delay added to every chunk of data forwarded
+	truncate int64                 // Bytes after which new connections are cut, 0 for no limit
+}
+
+// NewLink listens on listenAddr and forwards every connection to target.
+func NewLink(listenAddr string, target string) (*Link, error) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Link{ln: ln, target: target, conns: make(map[net.Conn]struct{})}
+	go l.accept()
+	return l, nil
+}
+
+// Addr returns the address to dial to reach the target through the Link.
+func (l *Link) Addr() string {
+	return l.ln.Addr().String()
+}
+
+// Cut drops every connection through the Link and refuses new ones until Heal.
+func (l *Link) Cut() {
+	l.mu.Lock()
+	l.cut = true
+	conns := l.conns
+	l.conns = make(map[net.Conn]struct{})
+	l.mu.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// Heal lets connections through the Link again. Connections dropped by Cut
+// stay closed; the nodes have to dial again.
+func (l *Link) Heal() {
+	l.mu.Lock()
+	l.cut = false
+	l.mu.Unlock()
+}
+
+// SetLatency delays everything forwarded through the Link by d.
+func (l *Link) SetLatency(d time.Duration) {
+	l.mu.Lock()
+	l.latency = d
+	l.mu.Unlock()
+}
+
+// Truncate cuts connections opened from now on once n bytes have gone
+// through them in either direction, as if the network broke off mid-transfer.
+// Zero removes the limit.
+func (l *Link) Truncate(n int64) {
+	l.mu.Lock()
+	l.truncate = n
+	l.mu.Unlock()
+}
+
+// Close stops the Link and drops every connection through it.
+func (l *Link) Close() error {
+	l.Cut()
+	return l.ln.Close()
+}
+
+// accept proxies connections until the Link is closed.
+func (l *Link) accept() {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		go l.proxy(conn)
+	}
+}
+
+// proxy forwards conn to the target, applying the faults of the Link.
+func (l *Link) proxy(conn net.Conn) {
+	l.mu.Lock()
+	cut, budget := l.cut, l.truncate
+	l.mu.Unlock()
+	if cut {
+		conn.Close()
+		return
+	}
+
+	upstream, err := net.Dial("tcp", l.target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	if l.cut {
+		l.mu.Unlock()
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	l.conns[conn] = struct{}{}
+	l.conns[upstream] = struct{}{}
+	l.mu.Unlock()
+
+	limited := budget > 0
+	var (
+		budgetMu sync.Mutex // Guards budget, shared by both directions
+		wg       sync.WaitGroup
+	)
+	closeBoth := func() {
+		conn.Close()
+		upstream.Close()
+		l.mu.Lock()
+		delete(l.conns, conn)
+		delete(l.conns, upstream)
+		l.mu.Unlock()
+	}
+
+	forward := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		defer closeBoth()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				l.mu.Lock()
+				latency := l.latency
+				l.mu.Unlock()
+				if latency > 0 {
+					time.Sleep(latency)
+				}
+
+				// Let through what's left of the budget, then break off
+				out, exhausted := n, false
+				budgetMu.Lock()
+				if limited {
+					if int64(out) >= budget {
+						out, exhausted = int(budget), true
+					}
+					budget -= int64(out)
+				}
+				budgetMu.Unlock()
+				if _, err := dst.Write(buf[:out]); err != nil || exhausted {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go forward(upstream, conn)
+	go forward(conn, upstream)
+	wg.Wait()
+}
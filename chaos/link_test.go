@@ -0,0 +1,115 @@
+package chaos
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer echoes every connection back until the test ends.
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestLink(t *testing.T) {
+	l, err := NewLink("127.0.0.1:0", echoServer(t))
+	require.NoError(t, err)
+	defer l.Close()
+
+	echo := func() error {
+		conn, err := net.Dial("tcp", l.Addr())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		return err
+	}
+	require.NoError(t, echo())
+
+	// Cutting the link drops open connections and refuses new ones
+	conn, err := net.Dial("tcp", l.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	l.Cut()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Error(t, echo())
+
+	l.Heal()
+	require.NoError(t, echo())
+
+	// Latency applies to both directions
+	l.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, echo())
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	l.SetLatency(0)
+}
+
+func TestLinkTruncate(t *testing.T) {
+	l, err := NewLink("127.0.0.1:0", echoServer(t))
+	require.NoError(t, err)
+	defer l.Close()
+	l.Truncate(6)
+
+	conn, err := net.Dial("tcp", l.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// 4 bytes there and 2 of them back, then the connection breaks off
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	got, _ := io.ReadAll(conn)
+	assert.Equal(t, "pi", string(got))
+}
+
+func TestNetworkPartition(t *testing.T) {
+	target := echoServer(t)
+	n := NewNetwork()
+	defer n.Close()
+
+	ab, err := n.Connect("a", "b", "127.0.0.1:0", target)
+	require.NoError(t, err)
+	bc, err := n.Connect("b", "c", "127.0.0.1:0", target)
+	require.NoError(t, err)
+	assert.Same(t, ab, n.Link("a", "b"))
+
+	n.Partition("a")
+	assert.True(t, ab.cut)
+	assert.False(t, bc.cut)
+
+	n.Heal()
+	n.Kill("c")
+	assert.False(t, ab.cut)
+	assert.True(t, bc.cut)
+}
@@ -0,0 +1,100 @@
+package chaos
+
+import (
+	"sync"
+	"time"
+)
+
+// Network is the set of Links between the nodes of a cluster, by the names
+// of the nodes they connect, so faults can be applied to whole nodes or
+// groups of them.
+type Network struct {
+	mu    sync.Mutex
+	links map[[2]string]*Link
+}
+
+// NewNetwork returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{links: make(map[[2]string]*Link)}
+}
+
+// Connect adds a Link on listenAddr through which node a reaches node b,
+// listening on target.
+func (n *Network) Connect(a string, b string, listenAddr string, target string) (*Link, error) {
+	l, err := NewLink(listenAddr, target)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.links[[2]string{a, b}] = l
+	n.mu.Unlock()
+	return l, nil
+}
+
+// Link returns the Link node a reaches node b through, if any.
+func (n *Network) Link(a string, b string) *Link {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.links[[2]string{a, b}]
+}
+
+// Kill cuts every Link of node, as if it crashed or was unplugged.
+func (n *Network) Kill(node string) {
+	n.each(func(ends [2]string, l *Link) {
+		if ends[0] == node || ends[1] == node {
+			l.Cut()
+		}
+	})
+}
+
+// Partition cuts every Link between the nodes in group and the rest.
+func (n *Network) Partition(group ...string) {
+	in := make(map[string]bool, len(group))
+	for _, node := range group {
+		in[node] = true
+	}
+	n.each(func(ends [2]string, l *Link) {
+		if in[ends[0]] != in[ends[1]] {
+			l.Cut()
+		}
+	})
+}
+
+// Heal lets connections through every Link again.
+func (n *Network) Heal() {
+	n.each(func(_ [2]string, l *Link) { l.Heal() })
+}
+
+// SetLatency delays the traffic on every Link by d.
+func (n *Network) SetLatency(d time.Duration) {
+	n.each(func(_ [2]string, l *Link) { l.SetLatency(d) })
+}
+
+// Truncate makes new connections to and from node break off after n bytes.
+func (n *Network) Truncate(node string, bytes int64) {
+	n.each(func(ends [2]string, l *Link) {
+		if ends[0] == node || ends[1] == node {
+			l.Truncate(bytes)
+		}
+	})
+}
+
+// Close closes every Link.
+func (n *Network) Close() {
+	n.each(func(_ [2]string, l *Link) { l.Close() })
+}
+
+// each calls fn for every Link, outside the lock.
+func (n *Network) each(fn func(ends [2]string, l *Link)) {
+	n.mu.Lock()
+	links := make(map[[2]string]*Link, len(n.links))
+	for ends, l := range n.links {
+		links[ends] = l
+	}
+	n.mu.Unlock()
+
+	for ends, l := range links {
+		fn(ends, l)
+	}
+}
@@ -0,0 +1,284 @@
+package chaos
+
+import (
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// RetransmitTimeout is how late a dropped read or write goes through. TCP
+// doesn't lose data but sends it again once the packet carrying it goes
+// unacknowledged, so drops show up as stalls, never as gaps.
+const RetransmitTimeout = 200 * time.Millisecond
+
+// Faults are the faults a Transport injects into the traffic with a peer.
+type Faults struct {
+	Latency  time.Duration // Delay added to every read and write
+	DropRate float64       // Share of reads and writes dropped, delayed by RetransmitTimeout more
+}
+
+// Transport wraps a TCP transport, injecting faults into the traffic with
+// its peers: reads and writes on the peers themselves, on the streams opened
+// to them and on the streams they open. Faults delay the traffic but keep
+// to the deadlines of the connections, which fail as if the data hadn't
+// arrived in time.
+//
+// Set the callbacks of a server on the Transport rather than on the TCP
+// transport, so the server is handed the peers the faults are injected into.
+type Transport struct {
+	*p2p.TCPTransport
+	OnPeer           func(p2p.Peer) error // Called when a peer connects, which is refused on error
+	OnPeerDisconnect func(p2p.Peer)       // Called once a peer accepted by OnPeer is disconnected
+
+	rpcch   chan p2p.RPC
+	consume sync.Once
+	done    chan struct{}
+	close   sync.Once
+
+	mu     sync.Mutex
+	faults map[string]Faults        // By remote address, "" for every other peer
+	peers  map[p2p.Peer]*faultyPeer // Peers accepted, by the peer of the TCP transport
+}
+
+// NewTransport wraps t, taking over its OnPeer and OnPeerDisconnect
+// callbacks.
+func NewTransport(t *p2p.TCPTransport) *Transport {
+	tr := &Transport{
+		TCPTransport: t,
+		rpcch:        make(chan p2p.RPC),
+		done:         make(chan struct{}),
+		faults:       make(map[string]Faults),
+		peers:        make(map[p2p.Peer]*faultyPeer),
+	}
+	t.OnPeer = tr.onPeer
+	t.OnPeerDisconnect = tr.onPeerDisconnect
+	return tr
+}
+
+// SetFaults injects f into the traffic with the peer at the remote address
+// addr, or with every peer without faults of its own if addr is empty. Zero
+// Faults remove them.
+func (t *Transport) SetFaults(addr string, f Faults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f == (Faults{}) {
+		delete(t.faults, addr)
+		return
+	}
+	t.faults[addr] = f
+}
+
+// Consume returns the channel of the RPCs of the TCP transport, the streams
+// they carry injected with the faults of the peer that opened them.
+func (t *Transport) Consume() <-chan p2p.RPC {
+	t.consume.Do(func() { go t.forward() })
+	return t.rpcch
+}
+
+// Close stops consuming RPCs and closes the TCP transport.
+func (t *Transport) Close() error {
+	t.close.Do(func() { close(t.done) })
+	return t.TCPTransport.Close()
+}
+
+// forward hands the RPCs of the TCP transport to Consume until the
+// Transport is closed.
+func (t *Transport) forward() {
+	in := t.TCPTransport.Consume()
+	for {
+		select {
+		case rpc := <-in:
+			if rpc.Conn != nil {
+				rpc.Conn = &faultyConn{Conn: rpc.Conn, in: injector{t: t, addr: rpc.From}}
+			}
+			select {
+			case t.rpcch <- rpc:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// onPeer hands peer to OnPeer, injected with the faults of its address.
+func (t *Transport) onPeer(peer p2p.Peer) error {
+	fp := &faultyPeer{Peer: peer, in: injector{t: t, addr: peer.RemoteAddr().String()}}
+	if t.OnPeer != nil {
+		if err := t.OnPeer(fp); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.peers[peer] = fp
+	t.mu.Unlock()
+	return nil
+}
+
+// onPeerDisconnect hands the peer OnPeer was given for peer to
+// OnPeerDisconnect.
+func (t *Transport) onPeerDisconnect(peer p2p.Peer) {
+	t.mu.Lock()
+	fp, ok := t.peers[peer]
+	delete(t.peers, peer)
+	t.mu.Unlock()
+	if ok && t.OnPeerDisconnect != nil {
+		t.OnPeerDisconnect(fp)
+	}
+}
+
+// delay returns how long the next read or write with the peer at addr takes
+// longer.
+func (t *Transport) delay(addr string) time.Duration {
+	t.mu.Lock()
+	f, ok := t.faults[addr]
+	if !ok {
+		f = t.faults[""]
+	}
+	t.mu.Unlock()
+
+	d := f.Latency
+	if f.DropRate > 0 && rand.Float64() < f.DropRate {
+		d += RetransmitTimeout
+	}
+	return d
+}
+
+// injector delays the reads and writes of a connection with a peer by its
+// faults, up to the deadlines of the connection.
+type injector struct {
+	t    *Transport
+	addr string
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// wait delays a read, or a write if read is false, failing with
+// os.ErrDeadlineExceeded if its deadline passes first.
+func (in *injector) wait(read bool) error {
+	d := in.t.delay(in.addr)
+	if d <= 0 {
+		return nil
+	}
+
+	in.mu.Lock()
+	deadline := in.writeDeadline
+	if read {
+		deadline = in.readDeadline
+	}
+	in.mu.Unlock()
+
+	if !deadline.IsZero() && time.Until(deadline) < d {
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	}
+	time.Sleep(d)
+	return nil
+}
+
+// setDeadlines records the deadlines of the connection, leaving those that
+// are nil as they are.
+func (in *injector) setDeadlines(read *time.Time, write *time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if read != nil {
+		in.readDeadline = *read
+	}
+	if write != nil {
+		in.writeDeadline = *write
+	}
+}
+
+// faultyConn is a stream with a peer, injected with the faults of the peer.
+type faultyConn struct {
+	net.Conn
+	in injector
+}
+
+func (c *faultyConn) Read(b []byte) (int, error) {
+	if err := c.in.wait(true); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	if err := c.in.wait(false); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *faultyConn) SetDeadline(t time.Time) error {
+	c.in.setDeadlines(&t, &t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *faultyConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadlines(&t, nil)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *faultyConn) SetWriteDeadline(t time.Time) error {
+	c.in.setDeadlines(nil, &t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// faultyPeer is a peer injected with its faults, as are the streams opened
+// to it.
+type faultyPeer struct {
+	p2p.Peer
+	in injector
+}
+
+func (p *faultyPeer) Read(b []byte) (int, error) {
+	if err := p.in.wait(true); err != nil {
+		return 0, err
+	}
+	return p.Peer.Read(b)
+}
+
+func (p *faultyPeer) Write(b []byte) (int, error) {
+	if err := p.in.wait(false); err != nil {
+		return 0, err
+	}
+	return p.Peer.Write(b)
+}
+
+func (p *faultyPeer) Send(b []byte) error {
+	if err := p.in.wait(false); err != nil {
+		return err
+	}
+	return p.Peer.Send(b)
+}
+
+func (p *faultyPeer) SetDeadline(t time.Time) error {
+	p.in.setDeadlines(&t, &t)
+	return p.Peer.SetDeadline(t)
+}
+
+func (p *faultyPeer) SetReadDeadline(t time.Time) error {
+	p.in.setDeadlines(&t, nil)
+	return p.Peer.SetReadDeadline(t)
+}
+
+func (p *faultyPeer) SetWriteDeadline(t time.Time) error {
+	p.in.setDeadlines(nil, &t)
+	return p.Peer.SetWriteDeadline(t)
+}
+
+// OpenStream opens a stream to the peer, injected with its faults.
+func (p *faultyPeer) OpenStream() (net.Conn, error) {
+	stream, err := p.Peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConn{Conn: stream, in: injector{t: p.in.t, addr: p.in.addr}}, nil
+}
@@ -0,0 +1,85 @@
+package chaos
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	newTCPTransport := func(onPeer func(p2p.Peer) error) *p2p.TCPTransport {
+		return p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0", HandshakeFunc: p2p.NOPHandshakeFunc, Decoder: p2p.DefaultDecoder{}, OnPeer: onPeer, Multiplex: true})
+	}
+	tr := NewTransport(newTCPTransport(nil))
+	require.NoError(t, tr.ListenAndAccept())
+	connected, disconnected := make(chan p2p.Peer, 1), make(chan p2p.Peer, 1)
+	tr.OnPeer = func(p p2p.Peer) error { connected <- p; return nil }
+	tr.OnPeerDisconnect = func(p p2p.Peer) { disconnected <- p }
+	remotes := make(chan p2p.Peer, 1)
+	other := newTCPTransport(func(p p2p.Peer) error { remotes <- p; return nil })
+
+	c1, c2 := net.Pipe()
+	tr.Attach(c1, true, "tcp")
+	other.Attach(c2, false, "tcp")
+	peer, remote := <-connected, <-remotes
+	addr := peer.RemoteAddr().String()
+
+	timed := func(fn func()) time.Duration {
+		start := time.Now()
+		fn()
+		return time.Since(start)
+	}
+	send := func(stream net.Conn, payload string) {
+		_, err := stream.Write(append([]byte{p2p.IncomingMessage}, payload...))
+		require.NoError(t, err)
+	}
+
+	// Streams opened to a slow peer are slowed down.
+	tr.SetFaults(addr, Faults{Latency: 50 * time.Millisecond})
+	stream, err := peer.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+	assert.GreaterOrEqual(t, timed(func() { send(stream, "hello") }), 50*time.Millisecond)
+	rpc := <-other.Consume()
+	assert.Equal(t, "hello", string(rpc.Payload))
+
+	// So are the streams it opens, up to their deadlines.
+	back, err := remote.OpenStream()
+	require.NoError(t, err)
+	defer back.Close()
+	send(back, "ping")
+	rpc = <-tr.Consume()
+	assert.Equal(t, "ping", string(rpc.Payload))
+	_, err = back.Write([]byte("pong"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	rpc.Conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = rpc.Conn.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	rpc.Conn.SetReadDeadline(time.Time{})
+	_, err = io.ReadFull(rpc.Conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+
+	// Dropped writes go through once retransmitted.
+	tr.SetFaults(addr, Faults{DropRate: 1})
+	assert.GreaterOrEqual(t, timed(func() { send(stream, "lost") }), RetransmitTimeout)
+	tr.SetFaults(addr, Faults{})
+	assert.Less(t, timed(func() { send(stream, "fast") }), RetransmitTimeout)
+
+	// Peers are disconnected as they were connected.
+	remote.Close()
+	select {
+	case p := <-disconnected:
+		assert.Same(t, peer, p)
+	case <-time.After(time.Second):
+		t.Fatal("the peer never disconnected")
+	}
+	require.NoError(t, tr.Close())
+}
@@ -0,0 +1,196 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/chaos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// simCluster is a cluster of in-process nodes connected through chaos Links,
+// one per pair of nodes, so faults can be injected between them.
+type simCluster struct {
+	t     *testing.T
+	nodes []*FileServer
+	net   *chaos.Network
+	dials [][2]int // Pairs of nodes, the first dialing the second through their Link
+}
+
+// newSimCluster starts n fully connected nodes listening on port and the
+// ports after it, followed by the ports of the Links between them.
+func newSimCluster(t *testing.T, n int, port int) *simCluster {
+	c := &simCluster{t: t, net: chaos.NewNetwork()}
+	t.Cleanup(c.net.Close)
+
+	links := port + n
+	bootstrap := make([][]string, n)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			target := fmt.Sprintf("127.0.0.1:%d", port+i)
+			l, err := c.net.Connect(c.name(j), c.name(i), fmt.Sprintf("127.0.0.1:%d", links), target)
+			require.NoError(t, err)
+			links++
+
+			bootstrap[j] = append(bootstrap[j], l.Addr())
+			c.dials = append(c.dials, [2]int{j, i})
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		s := makeServer(t, fmt.Sprintf("127.0.0.1:%d", port+i), bootstrap[i]...)
+		c.nodes = append(c.nodes, s)
+		go s.Start()
+		t.Cleanup(s.Stop)
+		time.Sleep(100 * time.Millisecond) // Listening before the next node dials it
+	}
+	c.waitConnected()
+
+	return c
+}
+
+// name returns the name of node i in the Network.
+func (c *simCluster) name(i int) string {
+	return fmt.Sprintf("node%d", i)
+}
+
+// waitConnected waits until every node is connected to every other one.
+func (c *simCluster) waitConnected() {
+	require.Eventually(c.t, func() bool {
+		for _, s := range c.nodes {
+			if len(s.Peers()) != len(c.nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// waitPeers waits until node i is connected to want peers.
+func (c *simCluster) waitPeers(i int, want int) {
+	require.Eventually(c.t, func() bool { return len(c.nodes[i].Peers()) == want }, 5*time.Second, 10*time.Millisecond)
+}
+
+// heal lifts every fault and dials the connections that were dropped again.
+func (c *simCluster) heal() {
+	c.net.Heal()
+	for _, pair := range c.dials {
+		addr := c.net.Link(c.name(pair[0]), c.name(pair[1])).Addr()
+		if _, err := c.nodes[pair[0]].peer(addr); err != nil {
+			require.NoError(c.t, c.nodes[pair[0]].Connect(addr))
+		}
+	}
+	c.waitConnected()
+}
+
+// replicas returns how many nodes hold a copy of the file node owner stored under key.
+func (c *simCluster) replicas(owner int, key string) int {
+	s := c.nodes[owner]
+	n := 0
+	for i, node := range c.nodes {
+		if i == owner && node.store.Has(s.ID, key) || i != owner && node.store.Has(s.ID, s.hashKey(key)) {
+			n++
+		}
+	}
+	return n
+}
+
+// assertReplicas asserts that eventually want nodes hold a copy of the file
+// node owner stored under key.
+func (c *simCluster) assertReplicas(owner int, key string, want int) {
+	assert.Eventually(c.t, func() bool { return c.replicas(owner, key) == want }, 5*time.Second, 10*time.Millisecond,
+		"want %d replicas of %s, have %d", want, key, c.replicas(owner, key))
+}
+
+// assertIntact asserts that node i reads back data under key.
+func (c *simCluster) assertIntact(i int, key string, data []byte) {
+	r, err := c.nodes[i].Get(key)
+	if !assert.NoError(c.t, err) {
+		return
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.NoError(c.t, err)
+	assert.True(c.t, bytes.Equal(data, got), "%s read back %d bytes that differ from the %d stored", key, len(got), len(data))
+}
+
+// randomData returns n random bytes.
+func randomData(t *testing.T, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+func TestChaosReplication(t *testing.T) {
+	c := newSimCluster(t, 4, 41231)
+
+	data := randomData(t, 256<<10)
+	require.NoError(t, c.nodes[0].Store("healthy.bin", bytes.NewReader(data)))
+	c.assertReplicas(0, "healthy.bin", 4)
+
+	// Lose the local copy; it comes back from the replicas intact
+	require.NoError(t, c.nodes[0].store.Delete(c.nodes[0].ID, "healthy.bin"))
+	c.assertIntact(0, "healthy.bin", data)
+}
+
+func TestChaosKill(t *testing.T) {
+	c := newSimCluster(t, 4, 41241)
+
+	c.net.Kill(c.name(3))
+	c.waitPeers(0, 2)
+	c.waitPeers(3, 0)
+
+	data := randomData(t, 64<<10)
+	require.NoError(t, c.nodes[0].Store("killed.bin", bytes.NewReader(data)))
+	c.assertReplicas(0, "killed.bin", 3)
+	assert.Len(t, c.nodes[0].PendingHints(), 1)
+
+	// The node missing the file gets it once it is back
+	c.heal()
+	c.assertReplicas(0, "killed.bin", 4)
+	assert.Empty(t, c.nodes[0].PendingHints())
+}
+
+func TestChaosPartition(t *testing.T) {
+	c := newSimCluster(t, 4, 41251)
+
+	c.net.Partition(c.name(0), c.name(1))
+	for i := range c.nodes {
+		c.waitPeers(i, 1)
+	}
+
+	data := randomData(t, 64<<10)
+	require.NoError(t, c.nodes[0].Store("partitioned.bin", bytes.NewReader(data)))
+	c.assertReplicas(0, "partitioned.bin", 2)
+
+	// The other side of the partition gets it once the partition heals
+	c.heal()
+	c.assertReplicas(0, "partitioned.bin", 4)
+	assert.Empty(t, c.nodes[0].PendingHints())
+}
+
+func TestChaosLatencyAndTruncation(t *testing.T) {
+	c := newSimCluster(t, 4, 41261)
+
+	c.net.SetLatency(5 * time.Millisecond)
+	data := randomData(t, 512<<10)
+	require.NoError(t, c.nodes[0].Store("slow.bin", bytes.NewReader(data)))
+	c.assertReplicas(0, "slow.bin", 4)
+	c.net.SetLatency(0)
+
+	// Connections to node 1 now break off mid-transfer; downloads that hit it
+	// resume from another replica
+	c.net.Truncate(c.name(1), 64<<10)
+	c.net.Kill(c.name(1))
+	c.waitPeers(1, 0)
+	c.heal()
+
+	require.NoError(t, c.nodes[0].store.Delete(c.nodes[0].ID, "slow.bin"))
+	c.assertIntact(0, "slow.bin", data)
+}
@@ -0,0 +1,411 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+const (
+	// chunkManifestMagic starts every chunk manifest, telling it apart from regular file contents.
+	chunkManifestMagic = "dfs-chunks:v1\n"
+
+	defaultChunkSize = 1 << 20 // Chunk size used unless FileServerOpts.ChunkSize says otherwise
+
+	chunkKeySep = "#chunk-" // Separates the key of a file from the hash in the keys of its chunks
+)
+
+// ChunkManifest describes a file stored in chunks. The manifest is stored
+// under the file's key, every chunk as an object of its own, so changing part
+// of a file only rewrites and re-replicates the chunks that changed.
+//
+// Every chunk but the last one is exactly ChunkSize bytes long.
+type ChunkManifest struct {
+	Size      int64      `json:"size"`       // Size of the whole file in bytes
+	ChunkSize int64      `json:"chunk_size"` // Size of every chunk but the last
+	Chunks    []ChunkRef `json:"chunks"`     // Chunks in file order
+}
+
+// ChunkRef references a single chunk of a file.
+type ChunkRef struct {
+	Key  string `json:"key"`  // Key the chunk is stored under
+	Size int64  `json:"size"` // Size of the chunk in bytes
+	Hash string `json:"hash"` // Hash of the chunk's contents, checked when it is read
+}
+
+// encode returns the manifest as stored.
+func (m *ChunkManifest) encode() []byte {
+	buf, _ := json.Marshal(m)
+	return append([]byte(chunkManifestMagic), buf...)
+}
+
+// decodeChunkManifest parses a manifest produced by encode.
+func decodeChunkManifest(b []byte) (*ChunkManifest, error) {
+	if !bytes.HasPrefix(b, []byte(chunkManifestMagic)) {
+		return nil, errors.New("not a chunk manifest")
+	}
+
+	m := &ChunkManifest{}
+	if err := json.Unmarshal(b[len(chunkManifestMagic):], m); err != nil {
+		return nil, fmt.Errorf("invalid chunk manifest: %w", err)
+	}
+	if m.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk manifest: chunk size %d", m.ChunkSize)
+	}
+
+	return m, nil
+}
+
+// isChunkManifest reports whether the object read by r is a chunk manifest,
+// without moving r's read offset.
+func isChunkManifest(r io.Reader) bool {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return false
+	}
+
+	magic := make([]byte, len(chunkManifestMagic))
+	n, _ := ra.ReadAt(magic, 0)
+	return n == len(magic) && string(magic) == chunkManifestMagic
+}
+
+// openChunked returns r unchanged unless it reads a chunk manifest, in which
+// case it returns a reader over the contents of the chunked file.
+func (s *FileServer) openChunked(r io.ReadCloser) (io.ReadCloser, error) {
+	if !isChunkManifest(r) {
+		return r, nil
+	}
+
+	m, err := readChunkManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{s: s, m: m, idx: -1}, nil
+}
+
+// readChunkManifest reads and closes the manifest read by r.
+func readChunkManifest(r io.ReadCloser) (*ChunkManifest, error) {
+	defer r.Close()
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunkManifest(buf)
+}
+
+// chunkReader reads a chunked file, fetching chunks from the network as
+// needed. Like the files of regular objects, it can be read at any offset
+// and seeked; only the chunks read are fetched.
+type chunkReader struct {
+	s   *FileServer
+	m   *ChunkManifest // Manifest of the file, nil once closed
+	off int64          // Offset Read continues at
+
+	mu  sync.Mutex
+	idx int    // Index of the chunk in cur, -1 if none
+	cur []byte // Chunk read last, kept for the reads that follow within it
+}
+
+// chunk returns the contents of the chunk at idx.
+func (r *chunkReader) chunk(idx int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if idx != r.idx {
+		data, err := r.s.readChunk(r.m.Chunks[idx])
+		if err != nil {
+			return nil, err
+		}
+		r.idx, r.cur = idx, data
+	}
+	return r.cur, nil
+}
+
+func (r *chunkReader) ReadAt(b []byte, off int64) (int, error) {
+	if r.m == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(b) {
+		if off >= r.m.Size {
+			return n, io.EOF
+		}
+		idx := int(off / r.m.ChunkSize)
+		if idx >= len(r.m.Chunks) {
+			return n, io.ErrUnexpectedEOF
+		}
+		data, err := r.chunk(idx)
+		if err != nil {
+			return n, err
+		}
+		within := off - int64(idx)*r.m.ChunkSize
+		if within >= int64(len(data)) {
+			return n, io.ErrUnexpectedEOF // Chunk shorter than the manifest says
+		}
+		copied := copy(b[n:], data[within:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if r.m == nil {
+		return 0, os.ErrClosed
+	}
+	if r.off >= r.m.Size {
+		return 0, io.EOF
+	}
+
+	// Reads stop at the end of a chunk, fetching at most one
+	within := r.off % r.m.ChunkSize
+	if rest := r.m.ChunkSize - within; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := r.ReadAt(b, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // Reported by the next Read
+	}
+	return n, err
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	if r.m == nil {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.m.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Len returns the number of bytes left to read, for sizeOf.
+func (r *chunkReader) Len() int {
+	if r.m == nil {
+		return 0
+	}
+	return int(max(r.m.Size-r.off, 0))
+}
+
+// Close stops reading, leaving the chunks not read yet unfetched.
+func (r *chunkReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.m, r.cur = nil, nil
+	return nil
+}
+
+// readChunk returns the contents of a chunk, checking them against its hash.
+func (s *FileServer) readChunk(ref ChunkRef) ([]byte, error) {
+	r, err := s.get(ref.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.Hasher.Sum(data) != ref.Hash {
+		return nil, fmt.Errorf("%w: chunk (%s) is corrupt", ErrChecksumMismatch, ref.Key)
+	}
+
+	return data, nil
+}
+
+// storeChunk stores data as a chunk of the file under key, on behalf of the
+// tenant of ctx. Chunks are named after their contents, so unchanged chunks
+// keep their key and are never sent again.
+func (s *FileServer) storeChunk(ctx context.Context, key string, data []byte) (ChunkRef, error) {
+	ref := ChunkRef{
+		Size: int64(len(data)),
+		Hash: s.Hasher.Sum(data),
+	}
+	ref.Key = key + chunkKeySep + ref.Hash
+
+	if s.store.Has(s.ID, ref.Key) {
+		return ref, nil // Same contents at another offset, or written before
+	}
+	return ref, s.StoreContext(ctx, ref.Key, bytes.NewReader(data))
+}
+
+// isChunkKey reports whether key is the key of a chunk, or of a block of a
+// volume, rather than of a file.
+func isChunkKey(key string) bool {
+	return strings.Contains(key, chunkKeySep) || strings.Contains(key, volumeBlockSep)
+}
+
+// Append appends the contents of r to the file stored under key, creating it
+// if it doesn't exist. Only the last chunk and the ones added are written.
+func (s *FileServer) Append(key string, r io.Reader) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	m, err := s.loadChunked(key)
+	if err != nil {
+		return err
+	}
+	return s.writeChunked(key, m, m.Size, r)
+}
+
+// WriteAt writes the contents of r to the file stored under key, starting at
+// offset. The file grows if the data extends past its end; offset itself must
+// not be past the end. Only the chunks the data overlaps are rewritten.
+func (s *FileServer) WriteAt(key string, offset int64, r io.Reader) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	m, err := s.loadChunked(key)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > m.Size {
+		return fmt.Errorf("offset %d is outside of (%s), which is %d bytes long", offset, key, m.Size)
+	}
+	return s.writeChunked(key, m, offset, r)
+}
+
+// lockKey serializes read-modify-write operations on key. It returns the unlock function.
+func (s *FileServer) lockKey(key string) func() {
+	v, _ := s.keyLocks.LoadOrStore(key, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// loadChunked returns the manifest of the file stored under key. Files that
+// don't exist yet get an empty manifest; regular files are split into chunks,
+// which only rewrites them the first time they are changed.
+func (s *FileServer) loadChunked(key string) (*ChunkManifest, error) {
+	m := &ChunkManifest{ChunkSize: s.ChunkSize}
+	if m.ChunkSize <= 0 {
+		m.ChunkSize = defaultChunkSize
+	}
+
+	r, err := s.get(key, nil)
+	if errors.Is(err, ErrKeyNotFound) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isChunkManifest(r) {
+		return readChunkManifest(r)
+	}
+
+	defer r.Close()
+	if err := s.writeChunks(key, m, 0, r); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeChunked writes r into the file under key at offset and stores the
+// updated manifest. Chunks no longer referenced are removed from local disk.
+func (s *FileServer) writeChunked(key string, m *ChunkManifest, offset int64, r io.Reader) error {
+	previous := make(map[string]bool, len(m.Chunks))
+	for _, ref := range m.Chunks {
+		previous[ref.Key] = true
+	}
+
+	if err := s.writeChunks(key, m, offset, r); err != nil {
+		return err
+	}
+	prev, _ := s.store.Meta(s.ID, key)
+	if err := s.Store(key, bytes.NewReader(m.encode())); err != nil {
+		return err
+	}
+	// The description of the file outlives its manifest, the checksum of which isn't the file's
+	s.store.UpdateMeta(s.ID, key, func(meta *storage.ObjectMeta) {
+		meta.Content = meta.Content.DescribedAs(prev.Content)
+		meta.Content.Checksum = ""
+	})
+
+	for _, ref := range m.Chunks {
+		delete(previous, ref.Key)
+	}
+	for chunkKey := range previous {
+		s.store.Delete(s.ID, chunkKey)
+	}
+
+	return nil
+}
+
+// writeChunks overlays the data read from r onto m at offset, storing every
+// chunk it touches. offset must not be past the end of the file.
+func (s *FileServer) writeChunks(key string, m *ChunkManifest, offset int64, r io.Reader) error {
+	idx := int(offset / m.ChunkSize)
+	within := offset % m.ChunkSize
+
+	for {
+		// Contents of the chunk before this write. Only the last chunk may be
+		// shorter than within, and only when offset is at the end of the file.
+		var data []byte
+		if idx < len(m.Chunks) {
+			var err error
+			if data, err = s.readChunk(m.Chunks[idx]); err != nil {
+				return err
+			}
+		}
+
+		buf := make([]byte, m.ChunkSize-within)
+		n, readErr := io.ReadFull(r, buf)
+		if n == 0 {
+			if readErr == io.EOF {
+				return nil
+			}
+			return readErr
+		}
+
+		if end := within + int64(n); int64(len(data)) < end {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		copy(data[within:], buf[:n])
+
+		ref, err := s.storeChunk(context.Background(), key, data)
+		if err != nil {
+			return err
+		}
+		if idx < len(m.Chunks) {
+			m.Chunks[idx] = ref
+		} else {
+			m.Chunks = append(m.Chunks, ref)
+		}
+		if end := int64(idx)*m.ChunkSize + within + int64(n); end > m.Size {
+			m.Size = end
+		}
+
+		switch {
+		case readErr == io.ErrUnexpectedEOF:
+			return nil // r ran out within this chunk
+		case readErr != nil:
+			return readErr
+		}
+		idx++
+		within = 0
+	}
+}
@@ -0,0 +1,125 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// manifestOf returns the chunk manifest stored locally under key.
+func manifestOf(t *testing.T, s *FileServer, key string) *ChunkManifest {
+	t.Helper()
+	_, r, err := s.store.Read(s.ID, key)
+	assert.Nil(t, err)
+	m, err := readChunkManifest(r)
+	assert.Nil(t, err)
+	return m
+}
+
+// contentsOf returns the contents of the file stored under key.
+func contentsOf(t *testing.T, s *FileServer, key string) string {
+	t.Helper()
+	r, err := s.Get(key)
+	assert.Nil(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestAppendWriteAt(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41140")
+	s.ChunkSize = 4
+
+	assert.Nil(t, s.Append("log", strings.NewReader("hello")))
+	assert.Nil(t, s.Append("log", strings.NewReader(" world")))
+	assert.Equal(t, "hello world", contentsOf(t, s, "log"))
+
+	before := manifestOf(t, s, "log")
+	assert.Equal(t, int64(11), before.Size)
+	assert.Len(t, before.Chunks, 3)
+
+	// Overwriting the middle only touches the chunks it overlaps.
+	assert.Nil(t, s.WriteAt("log", 4, strings.NewReader("XX")))
+	assert.Equal(t, "hellXXworld", contentsOf(t, s, "log"))
+	after := manifestOf(t, s, "log")
+	assert.Equal(t, before.Chunks[0], after.Chunks[0])
+	assert.NotEqual(t, before.Chunks[1], after.Chunks[1])
+	assert.Equal(t, before.Chunks[2], after.Chunks[2])
+	assert.False(t, s.store.Has(s.ID, before.Chunks[1].Key), "replaced chunk should be removed")
+
+	// Writing past the end grows the file.
+	assert.Nil(t, s.WriteAt("log", 9, strings.NewReader("LD and more")))
+	assert.Equal(t, "hellXXworLD and more", contentsOf(t, s, "log"))
+	assert.Equal(t, int64(20), manifestOf(t, s, "log").Size)
+
+	assert.NotNil(t, s.WriteAt("log", 21, strings.NewReader("gap")))
+	assert.NotNil(t, s.WriteAt("log", -1, strings.NewReader("negative")))
+}
+
+func TestChunkedSeek(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41364")
+	s.ChunkSize = 4
+
+	assert.Nil(t, s.Append("file", strings.NewReader("0123456789abc")))
+	r, err := s.Get("file")
+	assert.Nil(t, err)
+	defer r.Close()
+
+	b := make([]byte, 6)
+	n, err := r.(io.ReaderAt).ReadAt(b, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "345678", string(b[:n]))
+	n, err = r.(io.ReaderAt).ReadAt(b, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "abc", string(b[:n]))
+
+	offset, err := r.(io.Seeker).Seek(-5, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), offset)
+	rest, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "89abc", string(rest))
+	assert.Equal(t, int64(0), sizeOf(r))
+}
+
+func TestAppendConvertsRegularFile(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41141")
+	s.ChunkSize = 4
+
+	assert.Nil(t, s.Store("file", bytes.NewReader([]byte("0123456789"))))
+	assert.Nil(t, s.Append("file", strings.NewReader("abc")))
+	assert.Equal(t, "0123456789abc", contentsOf(t, s, "file"))
+	assert.Len(t, manifestOf(t, s, "file").Chunks, 4)
+}
+
+func TestAppendReplicates(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41142")
+	s2 := makeServer(t, "127.0.0.1:41143", "127.0.0.1:41142")
+	s2.ChunkSize = 4
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s2.Append("log", strings.NewReader("replicated data")))
+	m := manifestOf(t, s2, "log")
+	assert.Eventually(t, func() bool {
+		for _, ref := range m.Chunks {
+			if !s1.store.Has(s2.ID, s2.hashKey(ref.Key)) {
+				return false
+			}
+		}
+		return s1.store.Has(s2.ID, s2.hashKey("log"))
+	}, time.Second, 10*time.Millisecond)
+
+	// Lose everything locally, the file comes back from the peer chunk by chunk.
+	assert.Nil(t, s2.store.Clear())
+	assert.Equal(t, "replicated data", contentsOf(t, s2, "log"))
+}
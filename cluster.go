@@ -0,0 +1,230 @@
+package dfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// nodeInfoTimeout bounds how long ClusterState waits for a peer to describe itself.
+const nodeInfoTimeout = 2 * time.Second
+
+// Health of a node as seen from the server reporting the cluster state.
+const (
+	NodeHealthy      = "healthy"      // Connected and answering
+	NodeUnresponsive = "unresponsive" // Connected but not answering in time
+	NodeDown         = "down"         // Known bootstrap node that isn't connected
+)
+
+// ClusterState is a snapshot of the network as seen from one server.
+type ClusterState struct {
+	Self  string      `json:"self"`  // ID of the server reporting the state
+	Nodes []NodeState `json:"nodes"` // Every known node, this one included, sorted by ID
+}
+
+// NodeState describes a single node of the network.
+type NodeState struct {
+	ID       string        `json:"id,omitempty"`       // Node ID, empty for nodes never connected to
+	Addr     string        `json:"addr"`               // Address the node listens on, if known, else the one it is connected from
+	Self     bool          `json:"self,omitempty"`     // Whether this is the reporting server
+	Zone     string        `json:"zone,omitempty"`     // Zone the node runs in, empty if unknown
+	Tier     string        `json:"tier,omitempty"`     // Storage tier of the node, empty if unknown
+	Health   string        `json:"health"`             // NodeHealthy, NodeUnresponsive or NodeDown
+	RTT      time.Duration `json:"rtt,omitempty"`      // Round-trip time estimate in nanoseconds
+	Capacity *Capacity     `json:"capacity,omitempty"` // Storage of the node, nil if it didn't answer
+	Relay    bool          `json:"relay,omitempty"`    // Whether the node carries connections for its peers, see RelayOpts
+	Owns     []string      `json:"owns,omitempty"`     // Hashed keys of the files of the reporting server placed on the node, sorted
+}
+
+// Capacity describes the storage of a node.
+type Capacity struct {
+	Total   int64 `json:"total"`   // Size of the file system holding the storage root, in bytes
+	Free    int64 `json:"free"`    // Bytes available on that file system
+	Used    int64 `json:"used"`    // Bytes taken up by stored objects
+	Objects int   `json:"objects"` // Number of stored objects, replicas included
+}
+
+// MessageNodeInfo asks a peer to describe itself. The peer answers on the
+// same stream with a gob encoded nodeInfo.
+type MessageNodeInfo struct{}
+
+// nodeInfo is the answer to a MessageNodeInfo.
+type nodeInfo struct {
+	ID         string
+	ListenAddr string
+	Capacity   Capacity
+	Relay      bool // Whether the node carries connections for its peers, see RelayOpts
+}
+
+// ClusterState returns every node this server knows of: itself, its peers and
+// the bootstrap nodes it isn't connected to, with their health, capacity and
+// the files of this server they own a copy of. Ownership follows Placement:
+// the servers the coordinator placed a file on or, without a coordinator, the
+// ones picked for its key. This server owns every file it stored.
+//
+// Peers are asked for their capacity concurrently; ones that don't answer
+// within a few seconds are reported as unresponsive.
+func (s *FileServer) ClusterState() ClusterState {
+	state := ClusterState{Self: s.ID}
+
+	state.Nodes = append(state.Nodes, NodeState{
+		ID:       s.ID,
+		Addr:     s.advertiseAddr(),
+		Self:     true,
+		Zone:     s.Zone,
+		Tier:     s.Tier,
+		Health:   NodeHealthy,
+		Capacity: s.capacity(),
+		Relay:    s.Relay != nil,
+	})
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	connected := make(map[string]bool)
+	for _, peer := range s.peerList() {
+		node := NodeState{
+			ID:     peer.ID(),
+			Addr:   p2p.DialAddr(peer),
+			Zone:   peer.Zone(),
+			Tier:   peer.Tier(),
+			Health: NodeUnresponsive,
+			RTT:    peer.RTT(),
+		}
+		mu.Lock()
+		connected[node.Addr] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+
+			if info, err := s.askNodeInfo(peer); err == nil {
+				node.Health = NodeHealthy
+				node.Capacity = &info.Capacity
+				node.Relay = info.Relay
+				if len(info.ID) > 0 {
+					node.ID = info.ID
+				}
+				if len(info.ListenAddr) > 0 {
+					node.Addr = info.ListenAddr
+					mu.Lock()
+					connected[info.ListenAddr] = true
+					mu.Unlock()
+				}
+			}
+
+			mu.Lock()
+			state.Nodes = append(state.Nodes, node)
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	for _, b := range s.bootstrap.Status() {
+		if !connected[b.Addr] && b.State != BootstrapConnected {
+			state.Nodes = append(state.Nodes, NodeState{Addr: b.Addr, Health: NodeDown})
+		}
+	}
+
+	s.assignOwnership(state.Nodes)
+	sort.SliceStable(state.Nodes, func(i, j int) bool {
+		a, b := state.Nodes[i], state.Nodes[j]
+		if a.ID != b.ID {
+			return len(b.ID) == 0 || (len(a.ID) > 0 && a.ID < b.ID)
+		}
+		return a.Addr < b.Addr
+	})
+
+	return state
+}
+
+// assignOwnership sets the hashed keys of the files of this server every node
+// with an ID owns a copy of. Files whose placement can't be looked up are
+// left out.
+func (s *FileServer) assignOwnership(nodes []NodeState) {
+	byID := make(map[string]*NodeState)
+	for i := range nodes {
+		if len(nodes[i].ID) > 0 {
+			byID[nodes[i].ID] = &nodes[i]
+		}
+	}
+
+	for _, meta := range s.List("") {
+		placement, err := s.Placement(meta.Key)
+		if err != nil {
+			log.Printf("[%s] looking up the placement of (%s) failed: %s", s.Transport.Addr(), meta.Key, err)
+			continue
+		}
+		hash := s.hashKey(meta.Key)
+		for _, id := range append([]string{s.ID}, placement.Replicas...) {
+			if node, ok := byID[id]; ok {
+				node.Owns = append(node.Owns, hash)
+			}
+		}
+	}
+	for _, node := range byID {
+		sort.Strings(node.Owns)
+	}
+}
+
+// capacity reports the storage of this server.
+func (s *FileServer) capacity() *Capacity {
+	usage := s.Usage()
+	c := &Capacity{Used: usage.PhysicalBytes, Objects: int(usage.Objects)}
+
+	// The storage root is created by the first write, measure its parent until then
+	dir := s.StorageRoot
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	c.Total, c.Free, _ = diskUsage(dir)
+
+	return c
+}
+
+// askNodeInfo asks peer to describe itself.
+func (s *FileServer) askNodeInfo(peer p2p.Peer) (*nodeInfo, error) {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return nil, err // The answer needs a stream of its own
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(nodeInfoTimeout))
+
+	if err := writeMessage(stream, &Message{Payload: MessageNodeInfo{}}); err != nil {
+		return nil, err
+	}
+
+	info := &nodeInfo{}
+	if err := gob.NewDecoder(stream).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// handleMessageNodeInfo describes this server to the peer asking.
+func (s *FileServer) handleMessageNodeInfo(rpc p2p.RPC) error {
+	if rpc.Conn == nil {
+		return errors.New("node info requests need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	return gob.NewEncoder(rpc.Conn).Encode(nodeInfo{
+		ID:         s.ID,
+		ListenAddr: s.advertiseAddr(),
+		Capacity:   *s.capacity(),
+		Relay:      s.Relay != nil,
+	})
+}
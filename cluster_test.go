@@ -0,0 +1,111 @@
+package dfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterState(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41180")
+	s2 := makeServer(t, "127.0.0.1:41181", "127.0.0.1:41180", "127.0.0.1:41189") // Nothing listens on 41189
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s1.Store("cluster.txt", strings.NewReader("some data")))
+
+	state := s2.ClusterState()
+	assert.Equal(t, s2.ID, state.Self)
+	assert.Len(t, state.Nodes, 3)
+
+	nodes := make(map[string]NodeState)
+	for _, node := range state.Nodes {
+		nodes[node.Addr] = node
+	}
+
+	self := nodes["127.0.0.1:41181"]
+	assert.True(t, self.Self)
+	assert.Equal(t, NodeHealthy, self.Health)
+
+	peer := nodes["127.0.0.1:41180"] // Reported at its listen address, not the one it connected from
+	assert.Equal(t, s1.ID, peer.ID)
+	assert.Equal(t, NodeHealthy, peer.Health)
+	if assert.NotNil(t, peer.Capacity) {
+		assert.Equal(t, 1, peer.Capacity.Objects)
+		assert.Equal(t, int64(9), peer.Capacity.Used)
+		assert.Greater(t, peer.Capacity.Total, int64(0))
+	}
+
+	down := nodes["127.0.0.1:41189"]
+	assert.Equal(t, NodeDown, down.Health)
+	assert.Equal(t, down, state.Nodes[2], "nodes never connected to come last")
+
+	api := httptest.NewServer(s2.AdminHandler())
+	defer api.Close()
+	res, err := http.Get(api.URL + "/cluster")
+	assert.Nil(t, err)
+	var fromAPI ClusterState
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&fromAPI))
+	assert.Len(t, fromAPI.Nodes, 3)
+}
+
+func TestClusterOwnership(t *testing.T) {
+	for i, coordinated := range []bool{false, true} {
+		port := 41380 + 3*i
+		s1 := makeServer(t, "127.0.0.1:"+strconv.Itoa(port))
+		s2 := makeServer(t, "127.0.0.1:"+strconv.Itoa(port+1), s1.Transport.Addr())
+		s3 := makeServer(t, "127.0.0.1:"+strconv.Itoa(port+2), s1.Transport.Addr(), s2.Transport.Addr())
+		servers := []*FileServer{s1, s2, s3}
+		for _, s := range servers {
+			if coordinated {
+				s.Coordinator = s3.ID
+			}
+			s.ReplicationFactor = 1
+			go s.Start()
+			defer s.Stop()
+			time.Sleep(100 * time.Millisecond)
+		}
+		require.Eventually(t, func() bool { return len(s1.Peers()) == 2 && len(s3.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+		var keys []string
+		for j := 0; j < 8; j++ {
+			key := "owned-" + strconv.Itoa(j)
+			require.NoError(t, s1.Store(key, strings.NewReader(key)))
+			keys = append(keys, s1.hashKey(key))
+		}
+		held := func(s *FileServer) []string {
+			var out []string
+			for _, key := range keys {
+				if s.store.Has(s1.ID, key) {
+					out = append(out, key)
+				}
+			}
+			return out
+		}
+		require.Eventually(t, func() bool { return len(held(s2))+len(held(s3)) == len(keys) }, 2*time.Second, 10*time.Millisecond)
+
+		// Every node owns the files it holds a copy of, and s1 all of its own.
+		state := s1.ClusterState()
+		require.Len(t, state.Nodes, 3)
+		for _, node := range state.Nodes {
+			switch node.ID {
+			case s1.ID:
+				assert.ElementsMatch(t, keys, node.Owns)
+			case s2.ID:
+				assert.ElementsMatch(t, held(s2), node.Owns, "coordinated: %t", coordinated)
+			case s3.ID:
+				assert.ElementsMatch(t, held(s3), node.Owns, "coordinated: %t", coordinated)
+			}
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"golang.org/x/crypto/ssh"
+)
+
+// secretSize is the size of the node ID and the encryption key in bytes.
+const secretSize = 32
+
+// config is the configuration of the daemon.
+type config struct {
+	ListenAddr    string            // Address to listen for peers on
+	AdvertiseAddr string            // Address peers should dial this node at, ListenAddr if empty
+	Bootstrap     []string          // Addresses of the nodes to connect to
+	StorageRoot   string            // Directory files are stored in
+	KeyFile       string            // File holding the encryption key, <StorageRoot>/enc.key if empty
+	AdminAddr     string            // Address to serve the admin HTTP API on, disabled if empty
+	Gateway       bool              // Stream stored files to peers without keeping them
+	EncryptAtRest bool              // Encrypt the files on disk with a key derived from the encryption key
+	Relay         bool              // Carry connections between peers that can't connect directly
+	Fsck          bool              // Check the store against its index and repair it on start
+	Protocol      int               // Highest protocol version spoken with peers, the latest if zero
+	Zone          string            // Failure domain of the node, replicas are spread across
+	Tier          string            // Storage tier of the node, hot, warm or cold
+	ColdAfter     time.Duration     // Move objects unused for that long to archive nodes, disabled if zero
+	ProveEvery    time.Duration     // Challenge peers to prove they hold their replicas that often, disabled if zero
+	PackBelow     int64             // Pack the objects of up to that many bytes into pack files, disabled if zero
+	MmapAbove     int64             // Read the objects of at least that many bytes through a memory mapping, disabled if zero
+	MaxStreams    int               // Streams handled at once, each way, unlimited if zero
+	PeerStreams   int               // Streams of a single peer handled at once, each way, unlimited if zero
+	ForegroundIO  int               // Reads of files served done at once, unlimited if zero
+	BackgroundIO  int               // Disk IO of maintenance work done at once, unlimited if zero
+	Layout        storage.CASLayout // Directory layout of the store, the objects are moved to on start
+	SFTPAddr      string            // Address to serve SFTP on, disabled if empty
+	SFTPKeys      string            // authorized_keys file of the SFTP tenants, <StorageRoot>/sftp_keys if empty
+	APIKeys       string            // File of the API keys of the admin API and their scopes, the API is open if empty
+	JWTSecret     string            // File holding the secret of the JWTs accepted by the admin API, JWTs are refused if empty
+	CORSOrigins   []string          // Origins browsers may call the admin API from
+	Quotas        string            // File of the storage and bandwidth quotas of the tenants of the API keys and JWTs
+	OIDCIssuer    string            // OpenID Connect provider whose tokens the admin API accepts, none if empty
+	OIDCAudience  string            // Audience the tokens of OIDCIssuer must be issued for, any if empty
+	TLSCert       string            // Certificate file the admin API is served over TLS with, plain HTTP if empty
+	TLSKey        string            // Key file of TLSCert
+	ClientCA      string            // File of the CAs client certificates of the admin API must be signed by, none are asked for if empty
+	ClientCerts   string            // File of the common names of the client certificates accepted and their scopes
+	PeerToken     string            // File holding the token peers must present in the handshake, any peer is accepted if empty
+	KMS           string            // KMS wrapping the keys of the node, as vault:<key> or aws:<key ID>; they are kept in plaintext if empty
+}
+
+// parseConfig parses the command line args, falling back to the environment
+// variables looked up with lookupEnv for flags that aren't given.
+func parseConfig(args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	env := func(name string, def string) string {
+		if v, ok := lookupEnv(name); ok {
+			return v
+		}
+		return def
+	}
+
+	var (
+		cfg       config
+		bootstrap string
+		origins   string
+		layout    string
+		envErr    error // First environment variable that didn't parse
+	)
+	fs := flag.NewFlagSet("dfsd", flag.ContinueOnError)
+	fs.StringVar(&cfg.ListenAddr, "listen", env("DFS_LISTEN_ADDR", ":3000"), "address to listen for peers on")
+	fs.StringVar(&cfg.AdvertiseAddr, "advertise", env("DFS_ADVERTISE_ADDR", ""), "address peers should dial this node at, the listen address if empty")
+	fs.StringVar(&bootstrap, "bootstrap", env("DFS_BOOTSTRAP", ""), "comma separated addresses of nodes to connect to")
+	fs.StringVar(&cfg.StorageRoot, "root", env("DFS_STORAGE_ROOT", "dfs_data"), "directory files are stored in")
+	fs.StringVar(&cfg.KeyFile, "key-file", env("DFS_KEY_FILE", ""), "file holding the hex encoded encryption key (default <root>/enc.key)")
+	fs.StringVar(&cfg.AdminAddr, "admin", env("DFS_ADMIN_ADDR", ""), "address to serve the admin HTTP API on, disabled if empty")
+	fs.StringVar(&cfg.Zone, "zone", env("DFS_ZONE", ""), "rack or availability zone of the node, replicas are spread across zones")
+	fs.StringVar(&cfg.Tier, "tier", env("DFS_TIER", ""), "storage tier of the node: hot, warm or cold")
+	fs.StringVar(&cfg.SFTPAddr, "sftp", env("DFS_SFTP_ADDR", ""), "address to serve SFTP on, disabled if empty")
+	fs.StringVar(&cfg.SFTPKeys, "sftp-keys", env("DFS_SFTP_KEYS", ""), "authorized_keys file of the SFTP tenants, the comment of every key naming its tenant (default <root>/sftp_keys)")
+	fs.StringVar(&cfg.APIKeys, "api-keys", env("DFS_API_KEYS", ""), "file of the API keys the admin API requires, one per line followed by its scope: read, write or admin, and optionally its tenant")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret-file", env("DFS_JWT_SECRET_FILE", ""), "file holding the secret of the HS256 JWTs the admin API accepts, their scope claim naming their scope")
+	fs.StringVar(&cfg.Quotas, "quotas", env("DFS_QUOTAS", ""), "file of the quotas of tenants, one per line followed by the bytes it may store and transfer a day, 0 for no limit")
+	fs.StringVar(&cfg.OIDCIssuer, "oidc-issuer", env("DFS_OIDC_ISSUER", ""), "URL of the OpenID Connect provider whose tokens the admin API accepts, their scope claim naming their scope")
+	fs.StringVar(&cfg.OIDCAudience, "oidc-audience", env("DFS_OIDC_AUDIENCE", ""), "audience the OpenID Connect tokens must be issued for, such as the client ID of the node, any if empty")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", env("DFS_TLS_CERT", ""), "PEM certificate file to serve the admin API over TLS with, plain HTTP if empty")
+	fs.StringVar(&cfg.TLSKey, "tls-key", env("DFS_TLS_KEY", ""), "PEM key file of the -tls-cert certificate")
+	fs.StringVar(&cfg.ClientCA, "client-ca", env("DFS_CLIENT_CA", ""), "PEM file of the CAs the client certificates of the admin API must be signed by")
+	fs.StringVar(&cfg.ClientCerts, "client-certs", env("DFS_CLIENT_CERTS", ""), "file of the common names of the client certificates the admin API accepts, one per line followed by its scope and optionally its tenant")
+	fs.StringVar(&cfg.PeerToken, "peer-token-file", env("DFS_PEER_TOKEN_FILE", ""), "file holding the token of the cluster, which nodes present to each other and require of their peers")
+	fs.StringVar(&cfg.KMS, "kms", env("DFS_KMS", ""), "KMS wrapping the encryption key and the keys of groups and files: vault:<transit key> or aws:<key ID>, plaintext keys if empty")
+	fs.StringVar(&origins, "cors-origins", env("DFS_CORS_ORIGINS", ""), "comma separated origins browsers may call the admin API from, * for any")
+	fs.StringVar(&layout, "layout", env("DFS_LAYOUT", "default"), "directory layout of the store: default, fanout, or <block size>x<depth>")
+	boolEnv := func(name string) bool {
+		v, err := strconv.ParseBool(env(name, "false"))
+		if err != nil && envErr == nil {
+			envErr = fmt.Errorf("%s: %w", name, err)
+		}
+		return v
+	}
+	fs.BoolVar(&cfg.Gateway, "gateway", boolEnv("DFS_GATEWAY"), "stream files stored through the admin API to peers without keeping them")
+	fs.BoolVar(&cfg.EncryptAtRest, "encrypt-at-rest", boolEnv("DFS_ENCRYPT_AT_REST"), "encrypt the files on disk with a key derived from the encryption key")
+	fs.BoolVar(&cfg.Relay, "relay", boolEnv("DFS_RELAY"), "carry connections between peers that can't connect directly")
+	fs.BoolVar(&cfg.Fsck, "fsck", boolEnv("DFS_FSCK"), "check the store against its index and repair it on start")
+	protocol, err := strconv.Atoi(env("DFS_PROTOCOL", "0"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_PROTOCOL: %w", err)
+	}
+	fs.IntVar(&cfg.Protocol, "protocol", protocol, "highest protocol version spoken with peers, the latest if 0")
+	coldAfter, err := time.ParseDuration(env("DFS_COLD_AFTER", "0s"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_COLD_AFTER: %w", err)
+	}
+	fs.DurationVar(&cfg.ColdAfter, "cold-after", coldAfter, "move objects unused for that long to cold nodes, disabled if 0")
+	proveEvery, err := time.ParseDuration(env("DFS_PROVE_EVERY", "0s"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_PROVE_EVERY: %w", err)
+	}
+	fs.DurationVar(&cfg.ProveEvery, "prove-every", proveEvery, "challenge peers to prove they still hold their replicas that often, disabled if 0")
+	packBelow, err := strconv.ParseInt(env("DFS_PACK_BELOW", "0"), 10, 64)
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_PACK_BELOW: %w", err)
+	}
+	fs.Int64Var(&cfg.PackBelow, "pack-below", packBelow, "pack the objects of up to that many bytes into pack files, disabled if 0")
+	mmapAbove, err := strconv.ParseInt(env("DFS_MMAP_ABOVE", "0"), 10, 64)
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_MMAP_ABOVE: %w", err)
+	}
+	fs.Int64Var(&cfg.MmapAbove, "mmap-above", mmapAbove, "read the objects of at least that many bytes through a memory mapping, disabled if 0")
+	maxStreams, err := strconv.Atoi(env("DFS_MAX_STREAMS", "0"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_MAX_STREAMS: %w", err)
+	}
+	fs.IntVar(&cfg.MaxStreams, "max-streams", maxStreams, "streams to and from peers handled at once each way, the others waiting their turn, unlimited if 0")
+	peerStreams, err := strconv.Atoi(env("DFS_PEER_STREAMS", "0"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_PEER_STREAMS: %w", err)
+	}
+	fs.IntVar(&cfg.PeerStreams, "peer-streams", peerStreams, "streams to and from a single peer handled at once each way, unlimited if 0")
+	foregroundIO, err := strconv.Atoi(env("DFS_FOREGROUND_IO", "0"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_FOREGROUND_IO: %w", err)
+	}
+	fs.IntVar(&cfg.ForegroundIO, "foreground-io", foregroundIO, "reads of files served to users and peers done at once, unlimited if 0")
+	backgroundIO, err := strconv.Atoi(env("DFS_BACKGROUND_IO", "0"))
+	if err != nil && envErr == nil {
+		envErr = fmt.Errorf("DFS_BACKGROUND_IO: %w", err)
+	}
+	fs.IntVar(&cfg.BackgroundIO, "background-io", backgroundIO, "disk IO of replication, tiering and proofs done at once, waiting on reads served, unlimited if 0")
+	if envErr != nil {
+		return config{}, envErr
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	for _, addr := range strings.Split(bootstrap, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			cfg.Bootstrap = append(cfg.Bootstrap, addr)
+		}
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+		}
+	}
+	if len(cfg.ListenAddr) == 0 || len(cfg.StorageRoot) == 0 {
+		return config{}, errors.New("the listen address and storage root must not be empty")
+	}
+	if cfg.Protocol != 0 && (cfg.Protocol < p2p.MinProtocolVersion || cfg.Protocol > p2p.ProtocolVersion) {
+		return config{}, fmt.Errorf("protocol version must be between %d and %d", p2p.MinProtocolVersion, p2p.ProtocolVersion)
+	}
+	if cfg.PackBelow < 0 {
+		return config{}, errors.New("the pack threshold must not be negative")
+	}
+	if cfg.MmapAbove < 0 {
+		return config{}, errors.New("the mmap threshold must not be negative")
+	}
+	if cfg.MaxStreams < 0 || cfg.PeerStreams < 0 {
+		return config{}, errors.New("the stream limits must not be negative")
+	}
+	if cfg.ForegroundIO < 0 || cfg.BackgroundIO < 0 {
+		return config{}, errors.New("the IO budgets must not be negative")
+	}
+	if (len(cfg.TLSCert) == 0) != (len(cfg.TLSKey) == 0) {
+		return config{}, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if len(cfg.ClientCA) > 0 && len(cfg.TLSCert) == 0 {
+		return config{}, errors.New("-client-ca needs the admin API served over TLS, see -tls-cert")
+	}
+	if len(cfg.ClientCerts) > 0 && len(cfg.ClientCA) == 0 {
+		return config{}, errors.New("-client-certs needs the CAs of the certificates, see -client-ca")
+	}
+	if provider, key, _ := strings.Cut(cfg.KMS, ":"); len(cfg.KMS) > 0 && (provider != "vault" && provider != "aws" || len(key) == 0) {
+		return config{}, fmt.Errorf("unknown KMS %q, must be vault:<transit key> or aws:<key ID>", cfg.KMS)
+	}
+	switch cfg.Tier {
+	case "", dfs.TierHot, dfs.TierWarm, dfs.TierCold:
+	default:
+		return config{}, fmt.Errorf("unknown storage tier %q, must be hot, warm or cold", cfg.Tier)
+	}
+	if cfg.Layout, err = parseLayout(layout); err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+// parseLayout parses the name of a store layout, or its block size and depth
+// written as 2x2.
+func parseLayout(s string) (storage.CASLayout, error) {
+	switch s {
+	case "default":
+		return storage.DefaultCASLayout, nil
+	case "fanout":
+		return storage.FanOutCASLayout, nil
+	}
+
+	block, depth, _ := strings.Cut(s, "x")
+	blockSize, err1 := strconv.Atoi(block)
+	levels, err2 := strconv.Atoi(depth)
+	if err1 != nil || err2 != nil || blockSize <= 0 || levels <= 0 {
+		return storage.CASLayout{}, fmt.Errorf("unknown store layout %q, must be default, fanout or <block size>x<depth>", s)
+	}
+	return storage.CASLayout{BlockSize: blockSize, Depth: levels}, nil
+}
+
+// keyFile returns the path of the file holding the encryption key.
+func (c config) keyFile() string {
+	if len(c.KeyFile) > 0 {
+		return c.KeyFile
+	}
+	return filepath.Join(c.StorageRoot, "enc.key")
+}
+
+// sftpKeysFile returns the path of the authorized_keys file of the SFTP tenants.
+func (c config) sftpKeysFile() string {
+	if len(c.SFTPKeys) > 0 {
+		return c.SFTPKeys
+	}
+	return filepath.Join(c.StorageRoot, "sftp_keys")
+}
+
+// sftpOpts returns the SFTP server of the node, nil unless SFTPAddr is set.
+// Its host key is kept in <root>/sftp_host_key, created on the first start.
+func (c config) sftpOpts() (*dfs.SFTPOpts, error) {
+	if len(c.SFTPAddr) == 0 {
+		return nil, nil
+	}
+	hostKey, err := loadOrCreateHostKey(filepath.Join(c.StorageRoot, "sftp_host_key"))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(c.sftpKeysFile())
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := parseTenants(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.sftpKeysFile(), err)
+	}
+	return &dfs.SFTPOpts{Addr: c.SFTPAddr, HostKey: hostKey, Tenants: tenants}, nil
+}
+
+// authOpts returns the credentials the admin API requires, nil unless API
+// keys, a JWT secret, an OpenID Connect provider or client certificates are
+// configured.
+func (c config) authOpts() (*dfs.AuthOpts, error) {
+	if len(c.APIKeys) == 0 && len(c.JWTSecret) == 0 && len(c.OIDCIssuer) == 0 && len(c.ClientCerts) == 0 {
+		return nil, nil
+	}
+	opts := &dfs.AuthOpts{}
+	if len(c.APIKeys) > 0 {
+		buf, err := os.ReadFile(c.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		if opts.APIKeys, opts.Tenants, err = parseAPIKeys(buf); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.APIKeys, err)
+		}
+	}
+	if len(c.JWTSecret) > 0 {
+		secret, err := readSecret(c.JWTSecret)
+		if err != nil {
+			return nil, err
+		}
+		opts.JWTSecret = secret
+	}
+
+	var auths []dfs.Authenticator
+	if len(c.ClientCerts) > 0 {
+		buf, err := os.ReadFile(c.ClientCerts)
+		if err != nil {
+			return nil, err
+		}
+		scopes, tenants, err := parseAPIKeys(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.ClientCerts, err)
+		}
+		certs := &dfs.CertAuthenticator{Principals: make(map[string]dfs.Principal)}
+		for name, scope := range scopes {
+			certs.Principals[name] = dfs.Principal{Scope: scope, Tenant: tenants[name]}
+		}
+		auths = append(auths, certs)
+	}
+	if len(c.OIDCIssuer) > 0 {
+		auths = append(auths, &dfs.OIDCAuthenticator{Issuer: c.OIDCIssuer, Audience: c.OIDCAudience, TenantClaim: "sub"})
+	}
+	if len(auths) > 0 {
+		opts.Authenticator = dfs.ChainAuthenticators(auths...)
+	}
+	return opts, nil
+}
+
+// adminTLS returns the TLS configuration of the admin API, nil unless
+// TLSCert is set. With ClientCA set, clients may present certificates signed
+// by its CAs.
+func (c config) adminTLS() (*tls.Config, error) {
+	if len(c.TLSCert) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(c.ClientCA) > 0 {
+		buf, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", c.ClientCA)
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// peerAuth returns the authenticator of the peers of the node and the
+// credential it presents them, nil and empty unless PeerToken is set: nodes
+// of the cluster present its token to each other.
+func (c config) peerAuth() (dfs.Authenticator, string, error) {
+	if len(c.PeerToken) == 0 {
+		return nil, "", nil
+	}
+	token, err := readSecret(c.PeerToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return dfs.StaticTokens{string(token): {Subject: "cluster", Scope: dfs.ScopeAdmin}}, string(token), nil
+}
+
+// kms returns the KMS wrapping the keys of the node, nil unless KMS is set.
+// Vault is reached at VAULT_ADDR with VAULT_TOKEN, AWS KMS in AWS_REGION with
+// the credentials of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, looked up with getenv.
+func (c config) kms(getenv func(string) string) (dfs.KMS, error) {
+	provider, key, _ := strings.Cut(c.KMS, ":")
+	switch provider {
+	case "vault":
+		if len(getenv("VAULT_ADDR")) == 0 || len(getenv("VAULT_TOKEN")) == 0 {
+			return nil, errors.New("-kms vault needs VAULT_ADDR and VAULT_TOKEN")
+		}
+		return &dfs.VaultKMS{Addr: getenv("VAULT_ADDR"), Token: getenv("VAULT_TOKEN"), Key: key}, nil
+	case "aws":
+		region := getenv("AWS_REGION")
+		if len(region) == 0 {
+			region = getenv("AWS_DEFAULT_REGION")
+		}
+		if len(region) == 0 || len(getenv("AWS_ACCESS_KEY_ID")) == 0 || len(getenv("AWS_SECRET_ACCESS_KEY")) == 0 {
+			return nil, errors.New("-kms aws needs AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return &dfs.AWSKMS{
+			Region:          region,
+			KeyID:           key,
+			AccessKeyID:     getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	return nil, nil
+}
+
+// readSecret returns the secret held by the file at path, surrounding
+// whitespace trimmed.
+func readSecret(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(buf)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s holds no secret", path)
+	}
+	return secret, nil
+}
+
+// parseAPIKeys parses a file of API keys, one per line followed by its
+// scope and optionally its tenant. Empty lines and lines starting with # are
+// skipped.
+func parseAPIKeys(buf []byte) (map[string]dfs.Scope, map[string]string, error) {
+	keys := make(map[string]dfs.Scope)
+	var tenants map[string]string
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, nil, fmt.Errorf("line %d must be an API key followed by its scope and optionally its tenant", i+1)
+		}
+		scope, err := dfs.ParseScope(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		keys[fields[0]] = scope
+		if len(fields) == 3 {
+			if tenants == nil {
+				tenants = make(map[string]string)
+			}
+			tenants[fields[0]] = fields[2]
+		}
+	}
+	return keys, tenants, nil
+}
+
+// quotas returns the quotas of the tenants listed in the Quotas file, nil
+// if there is none.
+func (c config) quotas() (map[string]dfs.TenantQuota, error) {
+	if len(c.Quotas) == 0 {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(c.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := parseQuotas(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Quotas, err)
+	}
+	return quotas, nil
+}
+
+// parseQuotas parses a file of tenant quotas, one tenant per line followed
+// by the bytes it may store and the bytes it may transfer a day, 0 for no
+// limit. Empty lines and lines starting with # are skipped.
+func parseQuotas(buf []byte) (map[string]dfs.TenantQuota, error) {
+	quotas := make(map[string]dfs.TenantQuota)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d must be a tenant followed by its storage and daily bandwidth quota", i+1)
+		}
+		var q dfs.TenantQuota
+		var err error
+		if q.Storage, err = strconv.ParseInt(fields[1], 10, 64); err != nil || q.Storage < 0 {
+			return nil, fmt.Errorf("line %d: invalid storage quota %q", i+1, fields[1])
+		}
+		if q.Bandwidth, err = strconv.ParseInt(fields[2], 10, 64); err != nil || q.Bandwidth < 0 {
+			return nil, fmt.Errorf("line %d: invalid bandwidth quota %q", i+1, fields[2])
+		}
+		quotas[fields[0]] = q
+	}
+	return quotas, nil
+}
+
+// parseTenants parses the SFTP tenants of an authorized_keys file. The
+// comment of every key is the name of the tenant logging in with it, keys
+// sharing a name share its files.
+func parseTenants(buf []byte) ([]dfs.SFTPTenant, error) {
+	var (
+		tenants []dfs.SFTPTenant
+		index   = make(map[string]int) // Position of every tenant in tenants
+	)
+	for len(bytes.TrimSpace(buf)) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = rest
+
+		name := strings.Trim(path.Clean("/"+comment), "/")
+		if len(name) == 0 || name != comment {
+			return nil, fmt.Errorf("key %s must be followed by the name of its tenant, not %q", ssh.FingerprintSHA256(key), comment)
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(tenants)
+			index[name] = i
+			tenants = append(tenants, dfs.SFTPTenant{Name: name})
+		}
+		tenants[i].Keys = append(tenants[i].Keys, key)
+	}
+	return tenants, nil
+}
+
+// loadOrCreateHostKey reads the SSH private key in the file at path, first
+// writing a new ed25519 key to it if the file doesn't exist.
+func loadOrCreateHostKey(path string) (ssh.Signer, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(priv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(buf)
+}
+
+// wrappedKeyPrefix starts the key files holding the encryption key wrapped by
+// a KMS, followed by the base64 encoded ciphertext.
+const wrappedKeyPrefix = "kms:"
+
+// loadOrCreateKey reads the encryption key in the file at path like
+// loadOrCreate. With kms set, the file holds the key wrapped by it instead:
+// new keys are written wrapped, and keys the file holds in plaintext are
+// wrapped and the file rewritten.
+func loadOrCreateKey(ctx context.Context, path string, kms dfs.KMS) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	wrapped, isWrapped := strings.CutPrefix(strings.TrimSpace(string(buf)), wrappedKeyPrefix)
+	switch {
+	case isWrapped && kms == nil:
+		return nil, fmt.Errorf("%s holds a key wrapped by a KMS, see -kms", path)
+	case isWrapped:
+		ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key, err := kms.Decrypt(ctx, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping the key in %s: %w", path, err)
+		}
+		if len(key) != secretSize {
+			return nil, fmt.Errorf("%s must wrap %d bytes", path, secretSize)
+		}
+		return key, nil
+	case kms == nil:
+		return loadOrCreate(path)
+	}
+
+	key := make([]byte, secretSize)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	} else if key, err = loadOrCreate(path); err != nil {
+		return nil, err
+	}
+	ciphertext, err := kms.Encrypt(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping the key in %s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(wrappedKeyPrefix+base64.StdEncoding.EncodeToString(ciphertext)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, os.Rename(tmp, path)
+}
+
+// idFile returns the path of the file holding the ID of the node.
+func (c config) idFile() string {
+	return filepath.Join(c.StorageRoot, "node.id")
+}
+
+// loadOrCreate reads the hex encoded 32 byte secret in the file at path,
+// first writing a random one to it if the file doesn't exist.
+func loadOrCreate(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		secret := make([]byte, secretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		return secret, os.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(secret) != secretSize {
+		return nil, fmt.Errorf("%s must hold %d hex encoded bytes", path, secretSize)
+	}
+	return secret, nil
+}
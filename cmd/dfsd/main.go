@@ -0,0 +1,191 @@
+// Command dfsd runs a node of the distributed file storage network until it
+// receives SIGINT or SIGTERM.
+//
+// It is configured with flags or, for containers, with environment variables.
+// Flags take precedence over the environment:
+//
+//	-listen          DFS_LISTEN_ADDR     address to listen for peers on (default :3000)
+//	-advertise       DFS_ADVERTISE_ADDR  address peers should dial this node at, the listen address if empty
+//	-bootstrap       DFS_BOOTSTRAP       comma separated addresses of nodes to connect to
+//	-root            DFS_STORAGE_ROOT    directory files are stored in (default dfs_data)
+//	-key-file        DFS_KEY_FILE        file holding the hex encoded encryption key (default <root>/enc.key)
+//	-admin           DFS_ADMIN_ADDR      address to serve the admin HTTP API on, disabled if empty
+//	-zone            DFS_ZONE            rack or availability zone of the node, replicas are spread across zones
+//	-tier            DFS_TIER            storage tier of the node: hot, warm or cold
+//	-cold-after      DFS_COLD_AFTER      move objects unused for that long to cold nodes, disabled if 0
+//	-prove-every     DFS_PROVE_EVERY     challenge peers to prove they still hold their replicas that often, disabled if 0
+//	-pack-below      DFS_PACK_BELOW      pack the objects of up to that many bytes into pack files, disabled if 0
+//	-mmap-above      DFS_MMAP_ABOVE      read the objects of at least that many bytes through a memory mapping, disabled if 0
+//	-max-streams     DFS_MAX_STREAMS     streams to and from peers handled at once each way, the others waiting their turn, unlimited if 0
+//	-peer-streams    DFS_PEER_STREAMS    streams to and from a single peer handled at once each way, unlimited if 0
+//	-foreground-io   DFS_FOREGROUND_IO   reads of files served to users and peers done at once, unlimited if 0
+//	-background-io   DFS_BACKGROUND_IO   disk IO of replication, tiering and proofs done at once, waiting on reads served, unlimited if 0
+//	-layout          DFS_LAYOUT          directory layout of the store: default, fanout, or <block size>x<depth>
+//	-sftp            DFS_SFTP_ADDR       address to serve SFTP on, disabled if empty
+//	-sftp-keys       DFS_SFTP_KEYS       authorized_keys file of the SFTP tenants, the comment of every key naming its tenant (default <root>/sftp_keys)
+//	-api-keys        DFS_API_KEYS        file of the API keys the admin API requires, one per line followed by its scope: read, write or admin, and optionally its tenant
+//	-quotas          DFS_QUOTAS          file of the quotas of tenants, one per line followed by the bytes it may store and transfer a day, 0 for no limit
+//	-jwt-secret-file DFS_JWT_SECRET_FILE file holding the secret of the HS256 JWTs the admin API accepts, their scope claim naming their scope
+//	-oidc-issuer     DFS_OIDC_ISSUER     URL of the OpenID Connect provider whose tokens the admin API accepts, their scope claim naming their scope
+//	-oidc-audience   DFS_OIDC_AUDIENCE   audience the OpenID Connect tokens must be issued for, such as the client ID of the node, any if empty
+//	-tls-cert        DFS_TLS_CERT        PEM certificate file to serve the admin API over TLS with, plain HTTP if empty
+//	-tls-key         DFS_TLS_KEY         PEM key file of the -tls-cert certificate
+//	-client-ca       DFS_CLIENT_CA       PEM file of the CAs the client certificates of the admin API must be signed by
+//	-client-certs    DFS_CLIENT_CERTS    file of the common names of the client certificates the admin API accepts, one per line followed by its scope and optionally its tenant
+//	-peer-token-file DFS_PEER_TOKEN_FILE file holding the token of the cluster, which nodes present to each other and require of their peers
+//	-kms             DFS_KMS             KMS wrapping the encryption key and the keys of groups and files: vault:<transit key> or aws:<key ID>, plaintext keys if empty
+//	-cors-origins    DFS_CORS_ORIGINS    comma separated origins browsers may call the admin API from, * for any
+//	-gateway         DFS_GATEWAY         stream files stored through the admin API to peers without keeping them (true or false)
+//	-encrypt-at-rest DFS_ENCRYPT_AT_REST encrypt the files on disk with a key derived from the encryption key (true or false)
+//	-relay           DFS_RELAY           carry connections between peers that can't connect directly (true or false)
+//	-fsck            DFS_FSCK            check the store against its index and repair it on start (true or false)
+//	-protocol        DFS_PROTOCOL        highest protocol version spoken with peers, the latest if 0
+//
+// The key file and the ID of the node, kept in <root>/node.id, are created on
+// the first start. Both must be kept to read the files stored by the node
+// after a restart. Starting a node with another -layout moves its objects to
+// the new layout before it joins the network. Serving SFTP creates the host
+// key of the node in <root>/sftp_host_key; a tenant logging in with a key of
+// -sftp-keys sees the files stored below its name.
+//
+// With -kms, the key file holds the encryption key wrapped by the KMS, and a
+// key file holding it in plaintext is rewritten wrapped. Vault is reached at
+// VAULT_ADDR with VAULT_TOKEN, AWS KMS in AWS_REGION with the credentials of
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+)
+
+func main() {
+	cfg, err := parseConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, s); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServer returns the node described by cfg, loading its ID and encryption
+// key or creating them on the first start.
+func newServer(cfg config) (*dfs.FileServer, error) {
+	id, err := loadOrCreate(cfg.idFile())
+	if err != nil {
+		return nil, err
+	}
+	kms, err := cfg.kms(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	key, err := loadOrCreateKey(ctx, cfg.keyFile(), kms)
+	if err != nil {
+		return nil, err
+	}
+	sftpOpts, err := cfg.sftpOpts()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := cfg.authOpts()
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := cfg.quotas()
+	if err != nil {
+		return nil, err
+	}
+	adminTLS, err := cfg.adminTLS()
+	if err != nil {
+		return nil, err
+	}
+	peerAuth, peerToken, err := cfg.peerAuth()
+	if err != nil {
+		return nil, err
+	}
+	var cors *dfs.CORSOpts
+	if len(cfg.CORSOrigins) > 0 {
+		cors = &dfs.CORSOpts{AllowedOrigins: cfg.CORSOrigins}
+	}
+	var relay *dfs.RelayOpts
+	if cfg.Relay {
+		relay = &dfs.RelayOpts{}
+	}
+	var proofs *dfs.ProofOpts
+	if cfg.ProveEvery > 0 {
+		proofs = &dfs.ProofOpts{Interval: cfg.ProveEvery}
+	}
+
+	return dfs.NewNode(dfs.NodeOpts{
+		ListenAddr:     cfg.ListenAddr,
+		AdvertiseAddr:  cfg.AdvertiseAddr,
+		StorageRoot:    cfg.StorageRoot,
+		BootstrapNodes: cfg.Bootstrap,
+		ID:             hex.EncodeToString(id),
+		EncKey:         key,
+		AdminAddr:      cfg.AdminAddr,
+		Gateway:        cfg.Gateway,
+		EncryptAtRest:  cfg.EncryptAtRest,
+		Protocol:       cfg.Protocol,
+		Zone:           cfg.Zone,
+		Tier:           cfg.Tier,
+		ColdAfter:      cfg.ColdAfter,
+		Layout:         cfg.Layout,
+		SFTP:           sftpOpts,
+		Relay:          relay,
+		Proofs:         proofs,
+		Fsck:           cfg.Fsck,
+		PackThreshold:  cfg.PackBelow,
+		MmapThreshold:  cfg.MmapAbove,
+		MaxStreams:     cfg.MaxStreams,
+		MaxPeerStreams: cfg.PeerStreams,
+		ForegroundIO:   cfg.ForegroundIO,
+		BackgroundIO:   cfg.BackgroundIO,
+		Auth:           auth,
+		CORS:           cors,
+		Quotas:         quotas,
+		AdminTLS:       adminTLS,
+		PeerAuth:       peerAuth,
+		PeerCredential: peerToken,
+		KMS:            kms,
+	}), nil
+}
+
+// run runs s until ctx is done, then stops it and waits for it to shut down.
+func run(ctx context.Context, s *dfs.FileServer) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		log.Printf("[%s] shutting down", s.Transport.Addr())
+		s.Stop()
+		return <-errc
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+func TestParseConfig(t *testing.T) {
+	env := map[string]string{
+		"DFS_LISTEN_ADDR":     ":4000",
+		"DFS_ADVERTISE_ADDR":  "node1:4000",
+		"DFS_BOOTSTRAP":       "a:3000, b:3000,",
+		"DFS_STORAGE_ROOT":    "/data",
+		"DFS_ADMIN_ADDR":      ":8080",
+		"DFS_GATEWAY":         "true",
+		"DFS_ENCRYPT_AT_REST": "1",
+		"DFS_PROTOCOL":        "1",
+		"DFS_ZONE":            "eu-1a",
+		"DFS_TIER":            "hot",
+		"DFS_COLD_AFTER":      "72h",
+		"DFS_PROVE_EVERY":     "1h",
+		"DFS_PACK_BELOW":      "4096",
+		"DFS_MMAP_ABOVE":      "1048576",
+		"DFS_MAX_STREAMS":     "64",
+		"DFS_BACKGROUND_IO":   "2",
+		"DFS_API_KEYS":        "/secrets/api_keys",
+		"DFS_QUOTAS":          "/secrets/quotas",
+		"DFS_OIDC_ISSUER":     "https://id.example.com",
+		"DFS_PEER_TOKEN_FILE": "/secrets/peer_token",
+		"DFS_KMS":             "vault:dfs",
+		"DFS_CORS_ORIGINS":    "https://a.example.com, https://b.example.com",
+		"DFS_LAYOUT":          "fanout",
+		"DFS_SFTP_ADDR":       ":2022",
+		"DFS_RELAY":           "true",
+		"DFS_FSCK":            "true",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg, err := parseConfig(nil, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, config{ListenAddr: ":4000", AdvertiseAddr: "node1:4000", Bootstrap: []string{"a:3000", "b:3000"}, StorageRoot: "/data", AdminAddr: ":8080", Gateway: true, EncryptAtRest: true, Protocol: 1, Zone: "eu-1a", Tier: "hot", ColdAfter: 72 * time.Hour, ProveEvery: time.Hour, PackBelow: 4096, MmapAbove: 1 << 20, MaxStreams: 64, BackgroundIO: 2, Layout: storage.FanOutCASLayout, SFTPAddr: ":2022", APIKeys: "/secrets/api_keys", Quotas: "/secrets/quotas", OIDCIssuer: "https://id.example.com", PeerToken: "/secrets/peer_token", KMS: "vault:dfs", CORSOrigins: []string{"https://a.example.com", "https://b.example.com"}, Relay: true, Fsck: true}, cfg)
+	assert.Equal(t, "/data/enc.key", cfg.keyFile())
+	assert.Equal(t, "/data/sftp_keys", cfg.sftpKeysFile())
+
+	// Flags take precedence over the environment.
+	cfg, err = parseConfig([]string{"-listen", ":5000", "-bootstrap", "", "-key-file", "/secrets/key", "-sftp-keys", "/secrets/tenants"}, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, ":5000", cfg.ListenAddr)
+	assert.Empty(t, cfg.Bootstrap)
+	assert.Equal(t, "/secrets/key", cfg.keyFile())
+	assert.Equal(t, "/secrets/tenants", cfg.sftpKeysFile())
+
+	cfg, err = parseConfig(nil, func(string) (string, bool) { return "", false })
+	require.NoError(t, err)
+	assert.Equal(t, ":3000", cfg.ListenAddr)
+	assert.Equal(t, "dfs_data", cfg.StorageRoot)
+	assert.Equal(t, storage.DefaultCASLayout, cfg.Layout)
+
+	cfg, err = parseConfig([]string{"-layout", "3x4"}, lookupEnv)
+	require.NoError(t, err)
+	assert.Equal(t, storage.CASLayout{BlockSize: 3, Depth: 4}, cfg.Layout)
+
+	_, err = parseConfig([]string{"-root", ""}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"extra"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-protocol", "99"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-tier", "lukewarm"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-layout", "deep"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-tls-cert", "/secrets/cert.pem"}, lookupEnv)
+	assert.Error(t, err, "the certificate needs its key")
+	_, err = parseConfig([]string{"-client-certs", "/secrets/client_certs"}, lookupEnv)
+	assert.Error(t, err, "client certificates need their CAs")
+	_, err = parseConfig([]string{"-kms", "gcp:dfs"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-kms", "aws:"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-layout", "0x2"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-pack-below", "-1"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-mmap-above", "-1"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-peer-streams", "-1"}, lookupEnv)
+	assert.Error(t, err)
+	_, err = parseConfig([]string{"-background-io", "-1"}, lookupEnv)
+	assert.Error(t, err)
+	env["DFS_GATEWAY"] = "sometimes"
+	_, err = parseConfig(nil, lookupEnv)
+	assert.Error(t, err)
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets", "enc.key")
+
+	created, err := loadOrCreate(path)
+	require.NoError(t, err)
+	assert.Len(t, created, secretSize)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	loaded, err := loadOrCreate(path)
+	require.NoError(t, err)
+	assert.Equal(t, created, loaded)
+
+	require.NoError(t, os.WriteFile(path, []byte("not hex"), 0o600))
+	_, err = loadOrCreate(path)
+	assert.Error(t, err)
+}
+
+// testKMS wraps keys by reversing them, which is enough to tell wrapped keys
+// apart from plaintext ones.
+type testKMS struct{}
+
+func (testKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return append([]byte("wrapped:"), reversed(plaintext)...), nil
+}
+
+func (testKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return reversed(bytes.TrimPrefix(ciphertext, []byte("wrapped:"))), nil
+}
+
+func reversed(b []byte) []byte {
+	r := bytes.Clone(b)
+	slices.Reverse(r)
+	return r
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "enc.key")
+
+	// Keys kept in plaintext are wrapped once a KMS is set.
+	plain, err := loadOrCreateKey(ctx, path, nil)
+	require.NoError(t, err)
+	wrapped, err := loadOrCreateKey(ctx, path, testKMS{})
+	require.NoError(t, err)
+	assert.Equal(t, plain, wrapped)
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), wrappedKeyPrefix))
+	assert.NotContains(t, string(buf), hex.EncodeToString(plain))
+
+	loaded, err := loadOrCreateKey(ctx, path, testKMS{})
+	require.NoError(t, err)
+	assert.Equal(t, plain, loaded)
+	_, err = loadOrCreateKey(ctx, path, nil)
+	assert.ErrorContains(t, err, "wrapped by a KMS")
+
+	created, err := loadOrCreateKey(ctx, filepath.Join(t.TempDir(), "new.key"), testKMS{})
+	require.NoError(t, err)
+	assert.Len(t, created, secretSize)
+
+	env := map[string]string{"VAULT_ADDR": "https://vault:8200", "VAULT_TOKEN": "s.token"}
+	kms, err := config{KMS: "vault:dfs"}.kms(func(name string) string { return env[name] })
+	require.NoError(t, err)
+	assert.Equal(t, &dfs.VaultKMS{Addr: "https://vault:8200", Token: "s.token", Key: "dfs"}, kms)
+	_, err = config{KMS: "aws:alias/dfs"}.kms(func(name string) string { return env[name] })
+	assert.ErrorContains(t, err, "AWS_REGION")
+}
+
+func TestSFTPOpts(t *testing.T) {
+	root := t.TempDir()
+	cfg := config{StorageRoot: root, SFTPAddr: ":2022"}
+
+	alice, err := loadOrCreateHostKey(filepath.Join(root, "alice"))
+	require.NoError(t, err)
+	bob, err := loadOrCreateHostKey(filepath.Join(root, "bob"))
+	require.NoError(t, err)
+	keys := string(ssh.MarshalAuthorizedKey(alice.PublicKey()))
+	keys = strings.TrimSpace(keys) + " alice\n\n# Bob has two\n" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(bob.PublicKey()))) + " bob\n"
+	keys += strings.TrimSpace(string(ssh.MarshalAuthorizedKey(alice.PublicKey()))) + " bob\n"
+	require.NoError(t, os.WriteFile(cfg.sftpKeysFile(), []byte(keys), 0o600))
+
+	opts, err := cfg.sftpOpts()
+	require.NoError(t, err)
+	assert.Equal(t, ":2022", opts.Addr)
+	require.Len(t, opts.Tenants, 2)
+	assert.Equal(t, "alice", opts.Tenants[0].Name)
+	assert.Len(t, opts.Tenants[0].Keys, 1)
+	assert.Equal(t, "bob", opts.Tenants[1].Name)
+	assert.Len(t, opts.Tenants[1].Keys, 2)
+
+	// The host key is kept across restarts.
+	again, err := cfg.sftpOpts()
+	require.NoError(t, err)
+	assert.Equal(t, opts.HostKey.PublicKey().Marshal(), again.HostKey.PublicKey().Marshal())
+
+	_, err = parseTenants(ssh.MarshalAuthorizedKey(alice.PublicKey()))
+	assert.Error(t, err, "keys must name their tenant")
+	_, err = parseTenants([]byte(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(alice.PublicKey()))) + " ../escape\n"))
+	assert.Error(t, err)
+
+	opts, err = config{StorageRoot: root}.sftpOpts()
+	require.NoError(t, err)
+	assert.Nil(t, opts, "SFTP is disabled without an address")
+}
+
+func TestAuthOpts(t *testing.T) {
+	root := t.TempDir()
+	cfg := config{APIKeys: filepath.Join(root, "api_keys"), JWTSecret: filepath.Join(root, "jwt_secret")}
+	require.NoError(t, os.WriteFile(cfg.APIKeys, []byte("# Dashboards\nreadkey read\n\nci-key   write acme\n"), 0o600))
+	require.NoError(t, os.WriteFile(cfg.JWTSecret, []byte("s3cret\n"), 0o600))
+
+	opts, err := cfg.authOpts()
+	require.NoError(t, err)
+	assert.Equal(t, &dfs.AuthOpts{
+		APIKeys:   map[string]dfs.Scope{"readkey": dfs.ScopeRead, "ci-key": dfs.ScopeWrite},
+		Tenants:   map[string]string{"ci-key": "acme"},
+		JWTSecret: []byte("s3cret"),
+	}, opts)
+
+	_, _, err = parseAPIKeys([]byte("key\n"))
+	assert.Error(t, err, "keys must have a scope")
+	_, _, err = parseAPIKeys([]byte("key root\n"))
+	assert.Error(t, err)
+
+	quotas, err := parseQuotas([]byte("# tenant storage bandwidth\nacme 1073741824 0\nbeta 0 1048576\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]dfs.TenantQuota{"acme": {Storage: 1 << 30}, "beta": {Bandwidth: 1 << 20}}, quotas)
+	_, err = parseQuotas([]byte("acme 1GB 0\n"))
+	assert.Error(t, err)
+
+	opts, err = config{}.authOpts()
+	require.NoError(t, err)
+	assert.Nil(t, opts, "the admin API is open without credentials")
+
+	// Client certificates are accepted by their common name.
+	cfg = config{ClientCerts: filepath.Join(root, "client_certs")}
+	require.NoError(t, os.WriteFile(cfg.ClientCerts, []byte("backup write ops\n"), 0o600))
+	opts, err = cfg.authOpts()
+	require.NoError(t, err)
+	p, err := opts.Authenticator.Authenticate(context.Background(), dfs.Credentials{Certificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "backup"}}}})
+	require.NoError(t, err)
+	assert.Equal(t, dfs.Principal{Subject: "backup", Scope: dfs.ScopeWrite, Tenant: "ops"}, p)
+
+	// Peers present the token of the cluster.
+	cfg = config{PeerToken: filepath.Join(root, "peer_token")}
+	require.NoError(t, os.WriteFile(cfg.PeerToken, []byte("cluster-token\n"), 0o600))
+	auth, token, err := cfg.peerAuth()
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-token", token)
+	p, err = auth.Authenticate(context.Background(), dfs.Credentials{Token: "cluster-token"})
+	require.NoError(t, err)
+	assert.Equal(t, dfs.ScopeAdmin, p.Scope)
+	auth, _, err = config{}.peerAuth()
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+}
+
+func TestRun(t *testing.T) {
+	root := t.TempDir()
+	cfg := config{ListenAddr: "127.0.0.1:41296", StorageRoot: root}
+
+	s, err := newServer(cfg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, s) }()
+	require.Eventually(t, func() bool { return s.Health().Live }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("run didn't return after the context was done")
+	}
+
+	// A restarted node keeps its identity.
+	restarted, err := newServer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, s.ID, restarted.ID)
+	assert.Equal(t, s.EncKey, restarted.EncKey)
+
+	// Listening failing is reported.
+	other, err := newServer(config{ListenAddr: "256.0.0.1:1", StorageRoot: root})
+	require.NoError(t, err)
+	assert.Error(t, run(context.Background(), other))
+}
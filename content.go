@@ -0,0 +1,31 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// StoreWithContent is StoreContext, recording the content type, filename and
+// metadata of m in the manifest of the file. Gateways keep no manifests.
+func (s *FileServer) StoreWithContent(ctx context.Context, key string, r io.Reader, m storage.ContentManifest) error {
+	if err := s.StoreContext(ctx, key, r); err != nil {
+		return err
+	}
+	if s.Gateway {
+		return nil
+	}
+	return s.store.SetContent(s.ID, key, m)
+}
+
+// Stat returns the metadata of the file stored under key, its manifest
+// included.
+func (s *FileServer) Stat(key string) (storage.ObjectMeta, error) {
+	meta, ok := s.store.Meta(s.ID, key)
+	if !ok {
+		return storage.ObjectMeta{}, fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+	return meta, nil
+}
@@ -0,0 +1,114 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentManifest(t *testing.T) {
+	s := newExportServer(t)
+	sum := sha256.Sum256([]byte("a,b\n1,2\n"))
+
+	require.NoError(t, s.StoreWithContent(context.Background(), "data.csv", strings.NewReader("a,b\n1,2\n"), storage.ContentManifest{
+		ContentType: "text/csv",
+		Filename:    "report.csv",
+		Metadata:    map[string]string{"author": "ops"},
+		Checksum:    "ignored",
+	}))
+	meta, err := s.Stat("data.csv")
+	require.NoError(t, err)
+	require.NotNil(t, meta.Content)
+	assert.Equal(t, "text/csv", meta.Content.ContentType)
+	assert.Equal(t, "report.csv", meta.Content.Filename)
+	assert.Equal(t, map[string]string{"author": "ops"}, meta.Content.Metadata)
+	assert.Equal(t, hex.EncodeToString(sum[:]), meta.Content.Checksum)
+	assert.Empty(t, meta.Content.Encryption)
+
+	// Storing the file again replaces its description.
+	require.NoError(t, s.Store("data.csv", strings.NewReader("other")))
+	meta, err = s.Stat("data.csv")
+	require.NoError(t, err)
+	assert.Empty(t, meta.Content.ContentType)
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), meta.Content.Checksum)
+
+	_, err = s.Stat("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Chunked files keep their description but have no checksum.
+	s.ChunkSize = 4
+	require.NoError(t, s.Append("log", strings.NewReader("hello")))
+	require.NoError(t, s.store.SetContent(s.ID, "log", storage.ContentManifest{ContentType: "text/plain"}))
+	require.NoError(t, s.Append("log", strings.NewReader(" world")))
+	meta, err = s.Stat("log")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.Content.ContentType)
+	assert.Empty(t, meta.Content.Checksum)
+
+	// Manifests travel with exports.
+	s.ChunkSize = 0
+	require.NoError(t, s.StoreWithContent(context.Background(), "data.csv", strings.NewReader("a,b\n"), storage.ContentManifest{ContentType: "text/csv"}))
+	var archive bytes.Buffer
+	_, err = s.Export(&archive)
+	require.NoError(t, err)
+	dst := newExportServer(t)
+	_, err = dst.Import(&archive)
+	require.NoError(t, err)
+	meta, ok := dst.store.Meta(s.ID, "data.csv")
+	require.True(t, ok)
+	assert.Equal(t, "text/csv", meta.Content.ContentType)
+}
+
+func TestContentHeaders(t *testing.T) {
+	s := newExportServer(t)
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, api.URL+"/files/img/1", strings.NewReader("png bytes"))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("Content-Disposition", `attachment; filename="cat.png"`)
+	req.Header.Set("X-Dfs-Meta-Camera", "pinhole")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	meta, err := s.Stat("img/1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"camera": "pinhole"}, meta.Content.Metadata)
+
+	res, err = http.Get(api.URL + "/files/img/1")
+	require.NoError(t, err)
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, `inline; filename=cat.png`, res.Header.Get("Content-Disposition"))
+	assert.Equal(t, "pinhole", res.Header.Get("X-Dfs-Meta-Camera"))
+	assert.Equal(t, meta.Content.Checksum, res.Header.Get("X-Dfs-Checksum-Sha256"))
+
+	// Shared files are attachments named after their manifest.
+	token, err := s.CreateShareToken("img/1", time.Minute)
+	require.NoError(t, err)
+	res, err = http.Get(api.URL + "/share/" + token)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, `attachment; filename=cat.png`, res.Header.Get("Content-Disposition"))
+
+	req, _ = http.NewRequest(http.MethodPut, api.URL+"/files/bad", strings.NewReader("x"))
+	req.Header.Set("Content-Type", "not a type;")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
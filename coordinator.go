@@ -0,0 +1,405 @@
+package dfs
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	// CoordinatorElected makes the leader of the metadata service the coordinator.
+	CoordinatorElected = "elected"
+
+	defaultReplicationFactor = 2               // Replicas placed per file unless ReplicationFactor says otherwise
+	coordinatorTimeout       = 5 * time.Second // How long the coordinator gets to answer
+)
+
+// ErrNoCoordinator is returned when coordinator mode is enabled but the
+// coordinator is unknown or not connected.
+var ErrNoCoordinator = errors.New("coordinator not available")
+
+// Placement lists the servers a file is replicated to, as assigned by the coordinator.
+type Placement struct {
+	Owner    string   `json:"owner"`    // ID of the server the file belongs to
+	Key      string   `json:"key"`      // Key the file was stored under, its lookup token on the coordinator
+	Size     int64    `json:"size"`     // Size of the file in bytes
+	Replicas []string `json:"replicas"` // IDs of the servers assigned a copy, the owner not included
+	Version  uint64   `json:"version"`  // Increases with every placement the coordinator makes
+}
+
+// MessageCoordinate asks the coordinator to place a file or arbitrate its
+// delete. The coordinator answers on the same stream with a gob encoded
+// coordinateReply.
+type MessageCoordinate struct {
+	Op    string // "place", "delete" or "lookup"
+	Owner string // ID of the server the file belongs to
+	Key   string // Lookup token of the key the file was stored under, see hashKey
+	Size  int64  // Size of the file, for placing it
+}
+
+// coordinateReply is the answer to a MessageCoordinate.
+type coordinateReply struct {
+	Placement Placement
+	Err       string
+	NotFound  bool // Err wraps ErrKeyNotFound
+}
+
+// coordinator is the state of the server while it acts as coordinator. It is
+// kept in memory only; an elected coordinator falls back to the replica sets
+// of the metadata service for files placed by its predecessors.
+type coordinator struct {
+	mu         sync.Mutex
+	placements map[string]Placement // By owner and key
+	assigned   map[string]int64     // Bytes placed on each server, to spread new files
+	version    uint64
+}
+
+// CoordinatorID returns the ID of the server acting as coordinator, empty if
+// coordinator mode is disabled or no coordinator has been elected yet.
+func (s *FileServer) CoordinatorID() string {
+	if s.Coordinator != CoordinatorElected {
+		return s.Coordinator
+	}
+
+	if m := s.meta.Load(); m != nil {
+		return m.leader()
+	}
+	reply, err := s.metaRequest(MessageMetaRequest{Leader: true})
+	if err != nil {
+		return ""
+	}
+	return reply.Leader
+}
+
+// Placement returns where the file stored under key is replicated: as asked
+// of the coordinator or, when coordinator mode is disabled, the known peers
+// picked for it by key, see ReplicationFactor.
+func (s *FileServer) Placement(key string) (Placement, error) {
+	if len(s.Coordinator) > 0 {
+		placement, err := s.coordinate(MessageCoordinate{Op: "lookup", Owner: s.ID, Key: s.hashKey(key)})
+		if err != nil {
+			return Placement{}, err
+		}
+		placement.Key = key // The coordinator only knows its token
+		return placement, nil
+	}
+
+	meta, ok := s.store.Meta(s.ID, key)
+	if !ok {
+		return Placement{}, fmt.Errorf("%w: (%s)", ErrKeyNotFound, key)
+	}
+	return Placement{Owner: s.ID, Key: key, Size: meta.Size, Replicas: s.pickReplicas(key)}, nil
+}
+
+// replicaPeers returns the peers a new version of the file under key is sent
+// to, and the IDs of every server meant to get a copy, connected or not: the
+// ones the coordinator places it on or, when coordinator mode is disabled,
+// ReplicationFactor known peers picked by key, every one if zero. If the
+// coordinator can't be reached the file is sent to every peer rather than to
+// none.
+func (s *FileServer) replicaPeers(key string, size int64) ([]p2p.Peer, []string) {
+	peers := s.peerList()
+	if len(s.Coordinator) == 0 {
+		if s.ReplicationFactor <= 0 {
+			return peers, s.knownPeerIDs()
+		}
+		return replicasOf(peers, s.pickReplicas(key))
+	}
+
+	placement, err := s.coordinate(MessageCoordinate{Op: "place", Owner: s.ID, Key: s.hashKey(key), Size: size})
+	if err != nil {
+		log.Printf("[%s] placing (%s) failed, replicating to every peer: %s", s.Transport.Addr(), key, err)
+		return peers, s.knownPeerIDs()
+	}
+
+	return replicasOf(peers, placement.Replicas)
+}
+
+// replicasOf returns the peers among peers with the IDs of replicas, along
+// with replicas.
+func replicasOf(peers []p2p.Peer, replicas []string) ([]p2p.Peer, []string) {
+	var out []p2p.Peer
+	for _, peer := range peers {
+		if slices.Contains(replicas, peer.ID()) {
+			out = append(out, peer)
+		}
+	}
+	return out, replicas
+}
+
+// pickReplicas returns the IDs of the known peers meant to get a copy of the
+// file under key when coordinator mode is disabled: ReplicationFactor of
+// them picked by key, every one if zero.
+func (s *FileServer) pickReplicas(key string) []string {
+	if s.ReplicationFactor <= 0 {
+		return s.knownPeerIDs()
+	}
+	return rendezvous(s.knownPeerIDs(), recordKey(s.ID, key), s.ReplicationFactor)
+}
+
+// rendezvous picks n of ids for key by highest random weight, so every
+// server picks the same ones for the same key and a server joining or
+// leaving moves only the keys it is picked for.
+func rendezvous(ids []string, key string, n int) []string {
+	weight := func(id string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		return h.Sum64()
+	}
+	ids = slices.Clone(ids)
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := weight(ids[i]), weight(ids[j])
+		if a != b {
+			return a > b
+		}
+		return ids[i] < ids[j]
+	})
+	return ids[:min(n, len(ids))]
+}
+
+// deleteReplicas removes the replicas of the file under key from peers, for
+// the principal of ctx. In coordinator mode the coordinator arbitrates the
+// delete and tells the servers it placed the file on; otherwise every peer is
+// told.
+func (s *FileServer) deleteReplicas(ctx context.Context, key string) error {
+	if len(s.Coordinator) == 0 {
+		return s.broadcast(&Message{Payload: MessageDeleteFile{ID: s.ID, Key: s.hashKey(key), Principal: principalFrom(ctx)}})
+	}
+
+	_, err := s.coordinate(MessageCoordinate{Op: "delete", Owner: s.ID, Key: s.hashKey(key)})
+	return err
+}
+
+// coordinate serves req on the coordinator, locally or by asking it.
+func (s *FileServer) coordinate(req MessageCoordinate) (Placement, error) {
+	id := s.CoordinatorID()
+	switch {
+	case len(s.Coordinator) == 0:
+		return Placement{}, errors.New("coordinator mode is not enabled")
+	case len(id) == 0:
+		return Placement{}, ErrNoCoordinator
+	case id == s.ID:
+		return s.coord.serve(s, req)
+	}
+
+	for _, peer := range s.peerList() {
+		if peer.ID() == id {
+			return s.askCoordinator(peer, req)
+		}
+	}
+	return Placement{}, fmt.Errorf("%w: not connected to (%s)", ErrNoCoordinator, id)
+}
+
+// askCoordinator sends req to the coordinator and waits for the answer.
+func (s *FileServer) askCoordinator(peer p2p.Peer, req MessageCoordinate) (Placement, error) {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return Placement{}, err // The answer needs a stream of its own
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(coordinatorTimeout))
+
+	if err := writeMessage(stream, &Message{Payload: req}); err != nil {
+		return Placement{}, err
+	}
+
+	var reply coordinateReply
+	if err := gob.NewDecoder(stream).Decode(&reply); err != nil {
+		return Placement{}, err
+	}
+	if reply.NotFound {
+		return Placement{}, fmt.Errorf("coordinator (%s): %w", peer.RemoteAddr(), ErrKeyNotFound)
+	}
+	if len(reply.Err) > 0 {
+		return Placement{}, fmt.Errorf("coordinator (%s): %s", peer.RemoteAddr(), reply.Err)
+	}
+	return reply.Placement, nil
+}
+
+// handleMessageCoordinate serves a request from a peer if this server is the coordinator.
+func (s *FileServer) handleMessageCoordinate(rpc p2p.RPC, req MessageCoordinate) error {
+	if rpc.Conn == nil {
+		return errors.New("coordinator requests need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	var reply coordinateReply
+	if s.CoordinatorID() != s.ID {
+		reply.Err = "not the coordinator"
+	} else if placement, err := s.coord.serve(s, req); err != nil {
+		reply.Err = err.Error()
+		reply.NotFound = errors.Is(err, ErrKeyNotFound)
+	} else {
+		reply.Placement = placement
+	}
+
+	return gob.NewEncoder(rpc.Conn).Encode(reply)
+}
+
+// serve handles req on the coordinator s.
+func (c *coordinator) serve(s *FileServer, req MessageCoordinate) (Placement, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.placements == nil {
+		c.placements = make(map[string]Placement)
+		c.assigned = make(map[string]int64)
+	}
+	id := recordKey(req.Owner, req.Key)
+
+	switch req.Op {
+	case "place":
+		placement := c.place(s, req)
+		c.placements[id] = placement
+		return placement, nil
+
+	case "lookup":
+		placement, ok := c.lookup(s, req)
+		if !ok {
+			return Placement{}, fmt.Errorf("%w: (%s) has not been placed", ErrKeyNotFound, req.Key)
+		}
+		return placement, nil
+
+	case "delete":
+		// Deletes and placements of a key are serialized here, so a delete
+		// never races a store the coordinator has already placed.
+		placement, ok := c.lookup(s, req)
+		delete(c.placements, id)
+		if ok {
+			for _, replica := range placement.Replicas {
+				c.assigned[replica] -= placement.Size
+			}
+		}
+
+		msg := &Message{Payload: MessageDeleteFile{ID: req.Owner, Key: req.Key}}
+		var peers []p2p.Peer
+		for _, peer := range s.peerList() {
+			if !ok || slices.Contains(placement.Replicas, peer.ID()) {
+				peers = append(peers, peer) // Files placed elsewhere are deleted everywhere
+			}
+		}
+		if (!ok || slices.Contains(placement.Replicas, s.ID)) && s.store.Has(req.Owner, req.Key) {
+			s.store.Delete(req.Owner, req.Key)
+		}
+		return placement, s.broadcastTo(peers, msg)
+	}
+
+	return Placement{}, fmt.Errorf("unknown coordinator operation %q", req.Op)
+}
+
+// place assigns the servers the file of req is replicated to: the ones with
+// the fewest bytes placed on them so far, never the owner itself, in zones
+// none of the others is in as far as possible. Cold servers, which archive
+// what nobody reads, come last.
+func (c *coordinator) place(s *FileServer, req MessageCoordinate) Placement {
+	candidates := []string{s.ID}
+	zones := map[string]string{s.ID: s.Zone}
+	cold := map[string]bool{s.ID: s.Tier == TierCold}
+	for _, peer := range s.peerList() {
+		candidates = append(candidates, peer.ID())
+		zones[peer.ID()] = peer.Zone()
+		cold[peer.ID()] = peer.Tier() == TierCold
+	}
+
+	var eligible []string
+	for _, id := range candidates {
+		if id != req.Owner && len(id) > 0 && !slices.Contains(eligible, id) {
+			eligible = append(eligible, id)
+		}
+	}
+	sort.Slice(eligible, func(i, j int) bool {
+		if cold[eligible[i]] != cold[eligible[j]] {
+			return cold[eligible[j]]
+		}
+		a, b := c.assigned[eligible[i]], c.assigned[eligible[j]]
+		if a != b {
+			return a < b
+		}
+		return eligible[i] < eligible[j]
+	})
+
+	n := s.ReplicationFactor
+	if n <= 0 {
+		n = defaultReplicationFactor
+	}
+	if n > len(eligible) {
+		n = len(eligible)
+	}
+
+	replicas := spreadZones(eligible, zones, zones[req.Owner], n)
+
+	// A new version replaces the previous placement
+	if prev, ok := c.placements[recordKey(req.Owner, req.Key)]; ok {
+		for _, replica := range prev.Replicas {
+			c.assigned[replica] -= prev.Size
+		}
+	}
+
+	c.version++
+	placement := Placement{
+		Owner:    req.Owner,
+		Key:      req.Key,
+		Size:     req.Size,
+		Replicas: replicas,
+		Version:  c.version,
+	}
+	for _, replica := range placement.Replicas {
+		c.assigned[replica] += req.Size
+	}
+	return placement
+}
+
+// lookup returns the placement of the file of req, from memory or, for files
+// placed by a previous elected coordinator, from the metadata service.
+func (c *coordinator) lookup(s *FileServer, req MessageCoordinate) (Placement, bool) {
+	if placement, ok := c.placements[recordKey(req.Owner, req.Key)]; ok {
+		return placement, true
+	}
+
+	m := s.meta.Load()
+	if m == nil {
+		return Placement{}, false
+	}
+	rec, ok := m.fsm.lookup(req.Owner, req.Key)
+	if !ok || rec.Deleted {
+		return Placement{}, false
+	}
+
+	placement := Placement{Owner: rec.Owner, Key: rec.Key, Size: rec.Size}
+	for _, id := range rec.Replicas {
+		if id != rec.Owner {
+			placement.Replicas = append(placement.Replicas, id)
+		}
+	}
+	return placement, true
+}
+
+// spreadZones picks n of candidates, in order of preference, taking the
+// first candidate of every zone not yet holding a copy before filling up
+// with the rest. Servers of unknown zone share the empty one; ownerZone
+// holds a copy already.
+func spreadZones(candidates []string, zones map[string]string, ownerZone string, n int) []string {
+	used := map[string]bool{ownerZone: true}
+	picked := make([]string, 0, n)
+	var rest []string
+	for _, id := range candidates {
+		if len(picked) < n && !used[zones[id]] {
+			used[zones[id]] = true
+			picked = append(picked, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	return append(picked, rest[:n-len(picked)]...)
+}
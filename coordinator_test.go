@@ -0,0 +1,103 @@
+package dfs
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoordinator(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41200")
+	s2 := makeServer(t, "127.0.0.1:41201", "127.0.0.1:41200")
+	s3 := makeServer(t, "127.0.0.1:41202", "127.0.0.1:41200", "127.0.0.1:41201")
+	s4 := makeServer(t, "127.0.0.1:41203", "127.0.0.1:41200", "127.0.0.1:41201", "127.0.0.1:41202")
+	servers := []*FileServer{s1, s2, s3, s4}
+	for _, s := range servers {
+		s.Coordinator = s1.ID
+		s.ReplicationFactor = 1
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s4.Peers()) == 3 && len(s1.Peers()) == 3 }, time.Second, 10*time.Millisecond)
+
+	// holders returns the servers holding a replica of key stored by s4.
+	holders := func(key string) []string {
+		var ids []string
+		for _, s := range servers[:3] {
+			if s.store.Has(s4.ID, s4.hashKey(key)) {
+				ids = append(ids, s.ID)
+			}
+		}
+		return ids
+	}
+
+	assert.Nil(t, s4.Store("a", strings.NewReader("first file")))
+	a, err := s4.Placement("a")
+	assert.Nil(t, err)
+	assert.Len(t, a.Replicas, 1)
+	assert.Eventually(t, func() bool { return len(holders("a")) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, a.Replicas, holders("a"))
+
+	// The next file goes to a server with less data placed on it.
+	assert.Nil(t, s4.Store("b", strings.NewReader("second file")))
+	b, err := s4.Placement("b")
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.Replicas, b.Replicas)
+	assert.Greater(t, b.Version, a.Version)
+
+	// Deletes go through the coordinator, which removes the replicas it placed.
+	assert.Nil(t, s4.Delete("a"))
+	assert.Eventually(t, func() bool { return len(holders("a")) == 0 }, time.Second, 10*time.Millisecond)
+	_, err = s4.Placement("a")
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+}
+
+func TestSpreadZones(t *testing.T) {
+	zones := map[string]string{"a1": "a", "a2": "a", "b1": "b", "c1": "c", "x": ""}
+	assert.Equal(t, []string{"a1", "c1"}, spreadZones([]string{"a1", "a2", "b1", "c1"}, zones, "b", 2))
+	assert.Equal(t, []string{"a1", "b1", "c1", "a2"}, spreadZones([]string{"a1", "a2", "b1", "c1"}, zones, "", 4))
+	// Without zones, the order of preference is kept.
+	assert.Equal(t, []string{"x", "y"}, spreadZones([]string{"x", "y", "z"}, zones, "", 2))
+}
+
+func TestCoordinatorZones(t *testing.T) {
+	zones := []string{"a", "a", "c", "b"}
+	var servers []*FileServer
+	for i, zone := range zones {
+		var bootstrap []string
+		for _, s := range servers {
+			bootstrap = append(bootstrap, s.Transport.Addr())
+		}
+		s := NewNode(NodeOpts{ListenAddr: "127.0.0.1:" + strconv.Itoa(41316+i), StorageRoot: t.TempDir(), BootstrapNodes: bootstrap, Zone: zone})
+		servers = append(servers, s)
+	}
+	s1, s2, s3, s4 := servers[0], servers[1], servers[2], servers[3]
+	for _, s := range servers {
+		s.Coordinator = s1.ID
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s4.Peers()) == 3 && len(s1.Peers()) == 3 }, time.Second, 10*time.Millisecond)
+	for _, p := range s1.Peers() {
+		if p.ID == s4.ID {
+			assert.Equal(t, "b", p.Zone)
+		}
+	}
+
+	// Files of s4, in zone b, get one replica in zone a and one in zone c.
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, s4.Store(key, strings.NewReader("file "+key)))
+		p, err := s4.Placement(key)
+		assert.Nil(t, err)
+		assert.Len(t, p.Replicas, 2)
+		assert.Contains(t, p.Replicas, s3.ID)
+		assert.True(t, slices.Contains(p.Replicas, s1.ID) != slices.Contains(p.Replicas, s2.ID), "one replica in zone a: %v", p.Replicas)
+	}
+}
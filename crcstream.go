@@ -0,0 +1,114 @@
+package dfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// crcChunkSize is the most data a chunk of a checked stream carries.
+const crcChunkSize = 64 * 1024
+
+// crcTable is the Castagnoli polynomial chunks are checked with.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcWriter writes a file to a peer in chunks, each its length as 4 bytes
+// big-endian, the data, then the CRC32C of the data as 4 bytes big-endian,
+// so the peer detects a stream cut short or corrupted at the end of the
+// chunk it happens in. Flush must be called once the file is written.
+type crcWriter struct {
+	w   io.Writer
+	buf []byte // Data of the chunk being filled, framed room included
+}
+
+// newCRCWriter returns a writer of chunks to w.
+func newCRCWriter(w io.Writer) *crcWriter {
+	return &crcWriter{w: w, buf: make([]byte, 4, 4+crcChunkSize+4)}
+}
+
+// Write buffers b, writing every chunk it fills.
+func (cw *crcWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), 4+crcChunkSize-len(cw.buf))
+		cw.buf = append(cw.buf, b[:n]...)
+		b = b[n:]
+		written += n
+		if len(cw.buf) == 4+crcChunkSize {
+			if err := cw.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush writes the chunk being filled, if it holds any data.
+func (cw *crcWriter) Flush() error {
+	data := cw.buf[4:]
+	if len(data) == 0 {
+		return nil
+	}
+	binary.BigEndian.PutUint32(cw.buf, uint32(len(data)))
+	cw.buf = binary.BigEndian.AppendUint32(cw.buf, crc32.Checksum(data, crcTable))
+	_, err := cw.w.Write(cw.buf)
+	cw.buf = cw.buf[:4]
+	return err
+}
+
+// crcReader reads the data of the chunks a crcWriter wrote. A chunk is only
+// handed out once it was read in full and its CRC32C matched; it fails with
+// ErrChecksumMismatch otherwise, and with io.ErrUnexpectedEOF if the stream
+// ends within a chunk.
+type crcReader struct {
+	r    io.Reader
+	buf  []byte // The chunk last read
+	data []byte // Data of the chunk not read yet
+}
+
+// newCRCReader returns a reader of the chunks read from r.
+func newCRCReader(r io.Reader) *crcReader {
+	return &crcReader{r: r, buf: make([]byte, crcChunkSize+4)}
+}
+
+func (cr *crcReader) Read(b []byte) (int, error) {
+	if len(cr.data) == 0 {
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+// next reads and checks the next chunk. The stream ending before it is
+// io.EOF.
+func (cr *crcReader) next() error {
+	var header [4]byte
+	if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated chunk header", err)
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > crcChunkSize {
+		return fmt.Errorf("%w: chunk of %d bytes", ErrChecksumMismatch, n)
+	}
+
+	chunk := cr.buf[:n+4]
+	if _, err := io.ReadFull(cr.r, chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%w: chunk of %d bytes cut short", err, n)
+	}
+	data, sum := chunk[:n], binary.BigEndian.Uint32(chunk[n:])
+	if crc32.Checksum(data, crcTable) != sum {
+		return fmt.Errorf("%w: chunk of %d bytes", ErrChecksumMismatch, n)
+	}
+	cr.data = data
+	return nil
+}
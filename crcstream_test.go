@@ -0,0 +1,91 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRCStream(t *testing.T) {
+	for _, size := range []int{0, 1, crcChunkSize - 1, crcChunkSize, crcChunkSize + 1, 3*crcChunkSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		// Written in writes of any size, the data reads back whole.
+		stream := new(bytes.Buffer)
+		cw := newCRCWriter(stream)
+		for rest := data; len(rest) > 0; {
+			n := min(len(rest), 1000+size/3)
+			_, err := cw.Write(rest[:n])
+			require.NoError(t, err)
+			rest = rest[n:]
+		}
+		require.NoError(t, cw.Flush())
+		chunks := (size + crcChunkSize - 1) / crcChunkSize
+		assert.Equal(t, size+8*chunks, stream.Len(), "%d bytes", size)
+
+		got, err := io.ReadAll(newCRCReader(bytes.NewReader(stream.Bytes())))
+		require.NoError(t, err)
+		assert.Equal(t, len(data), len(got))
+		assert.True(t, bytes.Equal(data, got), "%d bytes", size)
+	}
+}
+
+func TestCRCStreamDamaged(t *testing.T) {
+	data := make([]byte, 2*crcChunkSize+10)
+	rand.Read(data)
+	stream := new(bytes.Buffer)
+	cw := newCRCWriter(stream)
+	cw.Write(data)
+	require.NoError(t, cw.Flush())
+
+	// A flipped bit fails the chunk it is in, none of which is read.
+	corrupt := bytes.Clone(stream.Bytes())
+	corrupt[4+crcChunkSize+4+4+100] ^= 1
+	got, err := io.ReadAll(newCRCReader(bytes.NewReader(corrupt)))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.Equal(t, data[:crcChunkSize], got)
+
+	// So do lengths no writer writes.
+	corrupt = bytes.Clone(stream.Bytes())
+	corrupt[0] = 0xff
+	_, err = io.ReadAll(newCRCReader(bytes.NewReader(corrupt)))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// Streams cut short within a chunk fail, wherever they are cut.
+	for _, n := range []int{2, 4 + 10, 4 + crcChunkSize + 2, stream.Len() - 1} {
+		got, err := io.ReadAll(newCRCReader(bytes.NewReader(stream.Bytes()[:n])))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "cut at %d", n)
+		assert.Equal(t, data[:len(got)], got)
+	}
+}
+
+func TestReceiveChunkedReplica(t *testing.T) {
+	s := newExportServer(t)
+	data := []byte("a replica sent in chunks")
+	frame := replicaFrameOf(int64(len(data)))
+	frame.Chunked = true
+	msg := MessageStoreFile{ID: "peer", Key: "key", Size: frame.Size(), Frame: frame}
+
+	stream := new(bytes.Buffer)
+	cw := newCRCWriter(stream)
+	cw.Write(data)
+	require.NoError(t, cw.Flush())
+
+	// A replica damaged on the way isn't kept.
+	corrupt := bytes.Clone(stream.Bytes())
+	corrupt[10] ^= 1
+	assert.ErrorIs(t, s.receiveFile("127.0.0.1:1", bytes.NewReader(corrupt), msg), ErrChecksumMismatch)
+	assert.False(t, s.store.Has("peer", "key"))
+
+	require.NoError(t, s.receiveFile("127.0.0.1:1", stream, msg))
+	_, r, err := s.store.Read("peer", "key")
+	require.NoError(t, err)
+	got, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,259 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// GenerateID generates a random 32-byte ID and returns it as a hexadecimal string.
+func GenerateID() string {
+	buf := make([]byte, 32)
+	io.ReadFull(rand.Reader, buf)
+	return hex.EncodeToString(buf)
+}
+
+// NewEncryptionKey generates a new random 32-byte encryption key.
+func NewEncryptionKey() []byte {
+	keyBuf := make([]byte, 32)
+	io.ReadFull(rand.Reader, keyBuf)
+	return keyBuf
+}
+
+// DeriveKey derives the 32-byte encryption key of a single file from a master key.
+func DeriveKey(master []byte, key string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("object:" + key))
+	return mac.Sum(nil)
+}
+
+// DeriveSubkey derives a key for the given purpose from a master key, such
+// as the key the local store is encrypted with at rest. Purposes never start
+// with "object:", so subkeys are distinct from the key of any file.
+func DeriveSubkey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// SealKey encrypts and authenticates key with AES-GCM under kek, for keeping
+// it on disk. It returns the nonce followed by the ciphertext.
+func SealKey(kek []byte, key []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// OpenKey reverses SealKey.
+func OpenKey(kek []byte, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// newGCM returns an AES-GCM cipher under key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey encrypts key so that only the owner of the recipient's private key can
+// recover it. It performs an X25519 exchange with a fresh ephemeral key and seals
+// key with AES-GCM under the shared secret. It returns the ephemeral public key
+// and the sealed key (nonce followed by ciphertext).
+func WrapKey(recipient *ecdh.PublicKey, key []byte) ([]byte, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newWrapCipher(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return ephemeral.PublicKey().Bytes(), aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey reverses WrapKey using the recipient's private key.
+func UnwrapKey(priv *ecdh.PrivateKey, ephemeral []byte, wrapped []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newWrapCipher(shared, ephemeral, priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// newWrapCipher derives the AES-GCM cipher used by WrapKey from an X25519 shared
+// secret, binding it to both public keys involved in the exchange.
+func newWrapCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// copyBufPool holds the 32KB buffers copyStream transforms data in.
+var copyBufPool = sync.Pool{New: func() any {
+	b := make([]byte, 32*1024)
+	return &b
+}}
+
+// copyStream reads from the src Reader, applies the cipher stream transformation, and writes to the dst Writer.
+// It returns the number of bytes written or an error.
+func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+	pooled := copyBufPool.Get().(*[]byte) // Reuse a 32KB buffer.
+	defer copyBufPool.Put(pooled)
+
+	var (
+		buf = *pooled
+		nw  = blockSize // Initialize nw to block size.
+	)
+	for {
+		n, err := src.Read(buf) // Read from src into the buffer.
+		if n > 0 {
+			stream.XORKeyStream(buf, buf[:n]) // Apply the XOR transformation on the buffer.
+			nn, err := dst.Write(buf[:n])     // Write the transformed data to dst.
+			if err != nil {
+				return 0, err
+			}
+			nw += nn // Increment nw by the number of bytes written.
+		}
+		if err == io.EOF { // Stop reading at the end of the file.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return nw, nil
+}
+
+// CopyDecrypt decrypts data from the src Reader and writes the plaintext to the dst Writer.
+// It returns the number of bytes written or an error.
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key) // Create a new AES cipher block using the key.
+	if err != nil {
+		return 0, err
+	}
+
+	// Read the IV from the src Reader. The IV size is equal to the block size.
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)                     // Create a new CTR stream cipher using the block and IV.
+	return copyStream(stream, block.BlockSize(), src, dst) // Decrypt and copy the data.
+}
+
+// CopyEncrypt encrypts data from the src Reader and writes the ciphertext to the dst Writer.
+// It returns the number of bytes written or an error.
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key) // Create a new AES cipher block using the key.
+	if err != nil {
+		return 0, err
+	}
+
+	iv := make([]byte, block.BlockSize()) // Create a random IV with the block size.
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
+
+	// Prepend the IV to the output before the ciphertext.
+	if _, err := dst.Write(iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)                     // Create a new CTR stream cipher using the block and IV.
+	return copyStream(stream, block.BlockSize(), src, dst) // Encrypt and copy the data.
+}
+
+// IVSize is the size of the IV CopyEncrypt writes before the ciphertext,
+// the block size of AES.
+const IVSize = aes.BlockSize
+
+// CipherAESCTR is the cipher replicas are encrypted with by CopyEncrypt:
+// AES-256 in CTR mode under the key of the file, from a random IV.
+const CipherAESCTR = "aes-256-ctr"
+
+// NewCTRAt returns the CTR stream CopyEncrypt used for the byte at offset of
+// the plaintext, so a range of a file can be decrypted without the data before it.
+func NewCTRAt(key []byte, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The counter starts at the IV and is incremented once per block.
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/int64(block.BlockSize())))
+	ctr := make([]byte, block.BlockSize())
+	b := counter.Bytes()
+	if len(b) > len(ctr) {
+		b = b[len(b)-len(ctr):] // The counter wraps around
+	}
+	copy(ctr[len(ctr)-len(b):], b)
+
+	stream := cipher.NewCTR(block, ctr)
+
+	// Skip the part of the first block before offset.
+	skip := make([]byte, offset%int64(block.BlockSize()))
+	stream.XORKeyStream(skip, skip)
+
+	return stream, nil
+}
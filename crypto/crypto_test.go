@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// TestCopyEncryptDecrypt tests the encryption and decryption process using CopyEncrypt and CopyDecrypt.
+func TestCopyEncryptDecrypt(t *testing.T) {
+	payload := "Foo not bar"                // The original data to be encrypted.
+	src := bytes.NewReader([]byte(payload)) // Source reader for the original data.
+	dst := new(bytes.Buffer)                // Destination buffer to hold the encrypted data.
+	key := NewEncryptionKey()               // Generate a new encryption key.
+
+	// Encrypt the data from src and write it to dst.
+	_, err := CopyEncrypt(key, src, dst)
+	if err != nil {
+		t.Error(err) // Report an error if encryption fails.
+	}
+
+	fmt.Println(len(payload))      // Print the length of the original data.
+	fmt.Println(len(dst.String())) // Print the length of the encrypted data.
+
+	out := new(bytes.Buffer) // Buffer to hold the decrypted data.
+
+	// Decrypt the data from dst and write it to out.
+	nw, err := CopyDecrypt(key, dst, out)
+	if err != nil {
+		t.Error(err) // Report an error if decryption fails.
+	}
+
+	// Verify that the number of written bytes matches the expected size (IV + payload).
+	if nw != 16+len(payload) { // 16 bytes for IV and the length of the payload.
+		t.Fail() // Mark the test as failed if the size doesn't match.
+	}
+
+	// Verify that the decrypted data matches the original payload.
+	if out.String() != payload {
+		t.Errorf("decryption failed!!!")
+	}
+}
+
+func TestNewCTRAt(t *testing.T) {
+	key := NewEncryptionKey()
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 100)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	iv, ciphertext := encrypted.Bytes()[:16], encrypted.Bytes()[16:]
+
+	// Decrypting from any offset yields the plaintext from that offset on.
+	for _, offset := range []int64{0, 1, 15, 16, 17, 1000, int64(len(payload)) - 1} {
+		stream, err := NewCTRAt(key, iv, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, len(payload)-int(offset))
+		stream.XORKeyStream(out, ciphertext[offset:])
+		if !bytes.Equal(out, payload[offset:]) {
+			t.Errorf("decrypting from offset %d failed", offset)
+		}
+	}
+
+	// The counter wraps around like cipher.NewCTR does.
+	iv = bytes.Repeat([]byte{0xff}, 16)
+	want := make([]byte, 32)
+	stream, _ := NewCTRAt(key, iv, 0)
+	stream.XORKeyStream(want, want)
+	got := make([]byte, 16)
+	stream, _ = NewCTRAt(key, iv, 16)
+	stream.XORKeyStream(got, got)
+	if !bytes.Equal(got, want[16:]) {
+		t.Error("counter did not wrap around")
+	}
+}
+
+// BenchmarkCopyEncrypt measures encrypting a 1MB file, reusing copyStream's buffers.
+func BenchmarkCopyEncrypt(b *testing.B) {
+	key := NewEncryptionKey()
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	src := bytes.NewReader(payload)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src.Reset(payload)
+		if _, err := CopyEncrypt(key, src, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Package crypto holds the cryptography of the distributed file storage
+// network: the AES-CTR encryption of replicas and the keys it uses, derived
+// from the master key of a node or exchanged with X25519 for groups and
+// shares, and the hash functions keys are turned into storage paths and
+// lookup tokens with.
+//
+// Replicas are encrypted with CopyEncrypt under a key DeriveKey derives for
+// every file, and decrypted with CopyDecrypt, or from any offset with
+// NewCTRAt. Keys kept on disk are sealed with SealKey, and keys sent to a
+// single peer wrapped for it with WrapKey.
+package crypto
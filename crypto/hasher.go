@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+// Hasher is a hash function used for content addressing: turning keys into
+// storage paths and into the key hashes objects are replicated under.
+type Hasher struct {
+	Name string           // Short name of the hash function, e.g. "sha256"
+	New  func() hash.Hash // Returns a new hash.Hash computing the function
+}
+
+var (
+	// MD5Hasher is what nodes hashed keys with before hashers were configurable. Only use
+	// it to stay compatible with nodes that haven't been upgraded yet.
+	MD5Hasher = Hasher{Name: "md5", New: md5.New}
+	// SHA1Hasher is what CASPathTransformFunc uses.
+	SHA1Hasher = Hasher{Name: "sha1", New: sha1.New}
+	// SHA256Hasher hashes with SHA-256.
+	SHA256Hasher = Hasher{Name: "sha256", New: sha256.New}
+	// BLAKE3Hasher hashes with BLAKE3 and a 256-bit output. It is the fastest of the lot.
+	BLAKE3Hasher = Hasher{Name: "blake3", New: func() hash.Hash { return blake3.New(32, nil) }}
+)
+
+// HasherByName returns the hasher called name.
+func HasherByName(name string) (Hasher, error) {
+	for _, h := range []Hasher{MD5Hasher, SHA1Hasher, SHA256Hasher, BLAKE3Hasher} {
+		if h.Name == name {
+			return h, nil
+		}
+	}
+	return Hasher{}, fmt.Errorf("unknown hasher %q", name)
+}
+
+// Sum returns the hex encoded digest of data.
+func (h Hasher) Sum(data []byte) string {
+	hh := h.New()
+	hh.Write(data)
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// Token returns the hex encoded HMAC of data under secret, computed with the
+// hash function of h. Tokens are as long as digests, but can't be derived
+// from data without the secret.
+func (h Hasher) Token(secret []byte, data []byte) string {
+	mac := hmac.New(h.New, secret)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
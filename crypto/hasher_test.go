@@ -0,0 +1,19 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashers(t *testing.T) {
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", SHA256Hasher.Sum(nil))
+	assert.Equal(t, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", BLAKE3Hasher.Sum(nil))
+
+	h, err := HasherByName("blake3")
+	assert.Nil(t, err)
+	assert.Equal(t, BLAKE3Hasher.Sum([]byte("key")), h.Sum([]byte("key")))
+
+	_, err = HasherByName("crc32")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,158 @@
+package dfs
+
+import (
+	"embed"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// recentEventCount is the number of events kept for the dashboard.
+	recentEventCount = 100
+
+	// throughputInterval is how often the traffic of the peers is sampled.
+	throughputInterval = time.Second
+
+	// throughputSamples is the number of throughput samples kept, five minutes worth.
+	throughputSamples = 300
+)
+
+// ThroughputSample is the transfer rate of the server, summed over all peers,
+// during one sampling interval.
+type ThroughputSample struct {
+	Time     time.Time `json:"time"`      // End of the interval
+	SendRate float64   `json:"send_rate"` // Bytes per second sent to peers
+	RecvRate float64   `json:"recv_rate"` // Bytes per second received from peers
+}
+
+// throughputSampler turns the byte counters of the peers into transfer rates.
+type throughputSampler struct {
+	mu      sync.Mutex
+	last    map[p2p.Peer]p2p.PeerStats // Counters of every connected peer at the last sample
+	at      time.Time                  // When the last sample was taken
+	samples []ThroughputSample         // Oldest first, at most throughputSamples
+}
+
+// sampleThroughput samples the traffic of the peers until the server is stopped.
+func (s *FileServer) sampleThroughput() {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.throughput.sample(s.peerList(), now)
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// sample records the rates of peers since the last sample. Peers that
+// connected in between count from zero, and peers that went away are left out.
+func (t *throughputSampler) sample(peers []p2p.Peer, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sent, recv int64
+	last := make(map[p2p.Peer]p2p.PeerStats)
+	for _, peer := range peers {
+		stats := peer.Stats()
+		prev := t.last[peer]
+		sent += stats.BytesSent - prev.BytesSent
+		recv += stats.BytesReceived - prev.BytesReceived
+		last[peer] = stats
+	}
+
+	if !t.at.IsZero() {
+		secs := now.Sub(t.at).Seconds()
+		if secs > 0 {
+			t.samples = append(t.samples, ThroughputSample{
+				Time:     now,
+				SendRate: float64(sent) / secs,
+				RecvRate: float64(recv) / secs,
+			})
+			if n := len(t.samples); n > throughputSamples {
+				t.samples = append(t.samples[:0:0], t.samples[n-throughputSamples:]...)
+			}
+		}
+	}
+	t.last, t.at = last, now
+}
+
+// Throughput returns the transfer rates of the last five minutes, oldest first.
+func (s *FileServer) Throughput() []ThroughputSample {
+	return s.throughput.get()
+}
+
+// get returns a copy of the samples.
+func (t *throughputSampler) get() []ThroughputSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]ThroughputSample{}, t.samples...)
+}
+
+// RecentEvents returns the last 100 events of the server, oldest first.
+func (s *FileServer) RecentEvents() []Event {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	return append([]Event{}, s.events.recent...)
+}
+
+// typedEvent is an event with the name of its type, as served to the dashboard.
+type typedEvent struct {
+	Type  string `json:"type"`
+	Event Event  `json:"event"`
+}
+
+// List returns the files this server stored whose key starts with prefix,
+// sorted by key. Replicas held for other nodes are not included.
+func (s *FileServer) List(prefix string) []storage.ObjectMeta {
+	out := []storage.ObjectMeta{}
+	for meta := range s.store.Objects() {
+		if meta.ID == s.ID && strings.HasPrefix(meta.Key, prefix) {
+			out = append(out, meta)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// handleDashboard adds the web dashboard and the endpoints only it uses to mux.
+func (s *FileServer) handleDashboard(mux *http.ServeMux) {
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+	mux.Handle("GET /dashboard/", http.FileServerFS(dashboardFiles))
+
+	mux.HandleFunc("GET /capacity", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.capacity())
+	})
+
+	mux.HandleFunc("GET /throughput", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Throughput())
+	})
+
+	mux.HandleFunc("GET /events/recent", func(w http.ResponseWriter, r *http.Request) {
+		events := s.RecentEvents()
+		out := make([]typedEvent, 0, len(events))
+		for _, ev := range events {
+			out = append(out, typedEvent{Type: reflect.TypeOf(ev).Name(), Event: ev})
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+
+	mux.HandleFunc("GET /files", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.List(r.URL.Query().Get("prefix")))
+	})
+}
@@ -0,0 +1,106 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(v))
+}
+
+func TestDashboard(t *testing.T) {
+	s := newExportServer(t)
+	require.NoError(t, s.Store("docs/a.txt", strings.NewReader("first")))
+	require.NoError(t, s.Store("docs/b.txt", strings.NewReader("second")))
+	require.NoError(t, s.Store("c.txt", strings.NewReader("third")))
+	_, err := s.store.Write("peer", "replica", strings.NewReader("someone else's"))
+	require.NoError(t, err)
+
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	res, err := http.Get(api.URL + "/")
+	require.NoError(t, err)
+	page, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, api.URL+"/dashboard/", res.Request.URL.String())
+	assert.Contains(t, string(page), "<title>DFS node</title>")
+
+	var files []storage.ObjectMeta
+	getJSON(t, api.URL+"/files?prefix=docs/", &files)
+	require.Len(t, files, 2)
+	assert.Equal(t, "docs/a.txt", files[0].Key)
+	assert.Equal(t, "docs/b.txt", files[1].Key)
+	getJSON(t, api.URL+"/files", &files)
+	assert.Len(t, files, 3, "replicas aren't listed")
+
+	var capacity Capacity
+	getJSON(t, api.URL+"/capacity", &capacity)
+	assert.Equal(t, 4, capacity.Objects)
+
+	var events []struct {
+		Type  string          `json:"type"`
+		Event json.RawMessage `json:"event"`
+	}
+	getJSON(t, api.URL+"/events/recent", &events)
+	require.Len(t, events, 6, "every store emits FileStored and KeyChanged")
+	assert.Equal(t, "FileStored", events[0].Type)
+	assert.Equal(t, "KeyChanged", events[1].Type)
+	var stored FileStored
+	require.NoError(t, json.Unmarshal(events[0].Event, &stored))
+	assert.Equal(t, "docs/a.txt", stored.Key)
+}
+
+func TestRecentEventsAreBounded(t *testing.T) {
+	s := newExportServer(t)
+	for i := 0; i < recentEventCount+10; i++ {
+		s.events.emit(FileStored{EventMeta: newEventMeta(), Size: int64(i)})
+	}
+
+	events := s.RecentEvents()
+	require.Len(t, events, recentEventCount)
+	assert.Equal(t, int64(10), events[0].(FileStored).Size)
+	assert.Equal(t, int64(recentEventCount+9), events[recentEventCount-1].(FileStored).Size)
+}
+
+func TestThroughput(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41289")
+	s2 := makeServer(t, "127.0.0.1:41290", "127.0.0.1:41289")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// Sample on the side, the servers sample once a second on their own
+	var sampler throughputSampler
+	now := time.Now()
+	sampler.sample(s2.peerList(), now)
+	assert.Empty(t, sampler.get(), "the first sample only sets the baseline")
+
+	require.NoError(t, s2.Store("big", bytes.NewReader(make([]byte, 64<<10))))
+	require.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("big")) }, 2*time.Second, 10*time.Millisecond)
+
+	sampler.sample(s2.peerList(), now.Add(2*time.Second))
+	samples := sampler.get()
+	require.Len(t, samples, 1)
+	assert.Greater(t, samples[0].SendRate, float64(32<<10), "64KiB over two seconds")
+	assert.Eventually(t, func() bool { return len(s2.Throughput()) > 0 }, 3*time.Second, 50*time.Millisecond)
+}
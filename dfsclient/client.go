@@ -0,0 +1,296 @@
+// Package dfsclient stores, fetches, deletes, retains and lists files on the
+// distributed file storage network through the file API of its nodes, for
+// applications that use the network without running a storage node.
+//
+// A node serves the API on its admin address (dfsd -admin). Files are stored
+// by the node the client talks to and replicated to its peers like any file
+// the node stores itself; they belong to that node, so a client keeps using
+// the same node for as long as it answers. Clients given an EncryptionKey
+// encrypt files end to end, the nodes never seeing them in the clear.
+package dfsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned for the failures the nodes report, matching the errors of
+// the same name of the dfs package.
+var (
+	// ErrKeyNotFound is returned for keys that aren't stored.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrPeerUnavailable is returned when the node can't reach the peers that
+	// could hold a file.
+	ErrPeerUnavailable = errors.New("peer unavailable")
+	// ErrChecksumMismatch is returned for files that turned out corrupt.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrQuotaExceeded is returned for files over the limits of the node.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrInvalidKey is returned for keys the node can't store files under.
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrImmutable is returned for files that can't be overwritten or
+	// deleted, being retained.
+	ErrImmutable = errors.New("immutable")
+	// ErrUnauthorized is returned when the node refuses the Token of the
+	// client, or requires one and none is set.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNoNode is returned when none of the nodes could be reached.
+	ErrNoNode = errors.New("no node reachable")
+)
+
+// errorCodes maps the codes of error responses to the errors returned for them.
+var errorCodes = map[string]error{
+	"key_not_found":     ErrKeyNotFound,
+	"peer_unavailable":  ErrPeerUnavailable,
+	"checksum_mismatch": ErrChecksumMismatch,
+	"quota_exceeded":    ErrQuotaExceeded,
+	"invalid_key":       ErrInvalidKey,
+	"immutable":         ErrImmutable,
+	"unauthorized":      ErrUnauthorized,
+	"forbidden":         ErrUnauthorized,
+}
+
+// Options configures a Client.
+type Options struct {
+	Nodes      []string     // Base URLs of the admin APIs of the nodes, such as http://node1:8080
+	HTTPClient *http.Client // Client making the requests, http.DefaultClient if nil
+	Token      string       // API key or JWT sent as bearer token, for nodes requiring credentials
+
+	// EncryptionKey encrypts files end to end, disabled if nil. Files are
+	// encrypted by the client before they are sent, each under a data key of
+	// its own wrapped with the 32 byte EncryptionKey, and decrypted by Get,
+	// so nodes only ever hold ciphertext and wrapped keys and their operators
+	// need not be trusted. Files are authenticated as they are read; altered
+	// or cut off ones fail with ErrDecryption. Sizes listed are those of the
+	// ciphertext.
+	EncryptionKey []byte
+}
+
+// Object describes a stored file.
+type Object struct {
+	Key     string            `json:"key"`            // Key the file is stored under
+	Size    int64             `json:"size"`           // Size of the file in bytes
+	ModTime time.Time         `json:"mod_time"`       // Time the file was last written
+	Tags    map[string]string `json:"tags,omitempty"` // User defined tags
+
+	Retention *Retention `json:"retention,omitempty"` // Keeps the file from being deleted or overwritten, nil if nothing does
+}
+
+// Retention keeps a file from being deleted or overwritten until a date, or
+// for as long as a legal hold is placed on it.
+type Retention struct {
+	Until     time.Time `json:"until,omitempty"`      // Earliest time the file may be deleted, can only be moved later
+	LegalHold bool      `json:"legal_hold,omitempty"` // Keeps the file whatever Until says until lifted
+}
+
+// Client talks to the nodes of the network. Requests go to the node that
+// last answered, moving on to the next node only when it can't be reached.
+// It is safe for concurrent use.
+type Client struct {
+	nodes []string
+	http  *http.Client
+	token string // Bearer token sent with every request, none if empty
+	kek   []byte // Key files are encrypted end to end with, nil if they aren't
+
+	mu      sync.Mutex
+	current int // Index of the node requests go to first
+}
+
+// New returns a client of the given nodes.
+func New(opts Options) (*Client, error) {
+	if len(opts.Nodes) == 0 {
+		return nil, errors.New("dfsclient: no nodes given")
+	}
+
+	if opts.EncryptionKey != nil && len(opts.EncryptionKey) != keySize {
+		return nil, fmt.Errorf("dfsclient: encryption key must be %d bytes", keySize)
+	}
+
+	c := &Client{http: opts.HTTPClient, token: opts.Token, kek: opts.EncryptionKey}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	for _, node := range opts.Nodes {
+		u, err := url.Parse(node)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return nil, fmt.Errorf("dfsclient: invalid node URL %q", node)
+		}
+		c.nodes = append(c.nodes, strings.TrimSuffix(node, "/"))
+	}
+
+	return c, nil
+}
+
+// Store stores the contents of r under key. Bodies that can't be sent again
+// are only sent to one node: if r isn't an io.Seeker, Store doesn't move on
+// to the next node once it started sending r.
+func (c *Client) Store(ctx context.Context, key string, r io.Reader) error {
+	if c.kek != nil {
+		er, err := newEncryptReader(c.kek, key, r)
+		if err != nil {
+			return err
+		}
+		r = er
+	}
+	res, err := c.do(ctx, http.MethodPut, filePath(key), r)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get returns the contents of the file stored under key, decrypted if the
+// client encrypts files end to end. The caller must close the reader.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, filePath(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.kek == nil {
+		return res.Body, nil
+	}
+	r, err := newDecryptReader(c.kek, key, res.Body)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Delete deletes the file stored under key, replicas included.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, filePath(key), nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// SetRetention sets the retention of the file stored under key, replicas
+// included. Shortening it fails with ErrImmutable.
+func (c *Client) SetRetention(ctx context.Context, key string, r Retention) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(ctx, http.MethodPut, (&url.URL{Path: "/retention/" + key}).EscapedPath(), bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// List returns the files whose key starts with prefix, sorted by key.
+func (c *Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	res, err := c.do(ctx, http.MethodGet, "/files?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var objects []Object
+	if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// filePath returns the path of the file API for key.
+func filePath(key string) string {
+	return (&url.URL{Path: "/files/" + key}).EscapedPath()
+}
+
+// do sends a request to the current node, moving on to the next one while
+// they can't be reached. It returns the response of the first node that
+// answered, or the error it answered with.
+func (c *Client) do(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+	// Bodies are sent again to the next node only if they can be rewound.
+	var start int64
+	seeker, rewindable := body.(io.Seeker)
+	if body == nil {
+		rewindable = true
+	} else if rewindable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewindable = false
+		}
+	}
+
+	c.mu.Lock()
+	first := c.current
+	c.mu.Unlock()
+
+	var errs []error
+	for i := range c.nodes {
+		n := (first + i) % len(c.nodes)
+		if i > 0 {
+			if !rewindable {
+				break
+			}
+			if seeker != nil {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					break
+				}
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.nodes[n]+path, body)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Body = io.NopCloser(body) // Leave closing r to the caller
+		}
+		if len(c.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.current = n
+		c.mu.Unlock()
+
+		if res.StatusCode >= 300 {
+			defer res.Body.Close()
+			return nil, responseError(res)
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrNoNode, errors.Join(errs...))
+}
+
+// responseError returns the error an error response of the API stands for.
+func responseError(res *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&body); err != nil || len(body.Error) == 0 {
+		return fmt.Errorf("dfsclient: %s", res.Status)
+	}
+	if err, ok := errorCodes[body.Code]; ok {
+		return fmt.Errorf("%w: %s", err, body.Error)
+	}
+	return fmt.Errorf("dfsclient: %s: %s", res.Status, body.Error)
+}
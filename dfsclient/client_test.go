@@ -0,0 +1,95 @@
+package dfsclient
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	s := dfs.NewNode(dfs.NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: t.TempDir()})
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	// The first node is down, the client moves on to the next one.
+	down := httptest.NewServer(nil)
+	down.Close()
+	c, err := New(Options{Nodes: []string{down.URL, api.URL + "/"}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, c.Store(ctx, "docs/a b.txt", strings.NewReader("first")))
+	require.NoError(t, c.Store(ctx, "docs/b.txt", strings.NewReader("second")))
+	require.NoError(t, c.Store(ctx, "other.txt", strings.NewReader("third")))
+
+	r, err := c.Get(ctx, "docs/a b.txt")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(b))
+
+	objects, err := c.List(ctx, "docs/")
+	require.NoError(t, err)
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "docs/a b.txt", objects[0].Key)
+		assert.Equal(t, int64(len("first")), objects[0].Size)
+		assert.Equal(t, "docs/b.txt", objects[1].Key)
+	}
+
+	// Retained files are kept until the hold is lifted.
+	require.NoError(t, c.SetRetention(ctx, "docs/b.txt", Retention{LegalHold: true}))
+	objects, err = c.List(ctx, "docs/b")
+	require.NoError(t, err)
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, &Retention{LegalHold: true}, objects[0].Retention)
+	}
+	assert.ErrorIs(t, c.Delete(ctx, "docs/b.txt"), ErrImmutable)
+	assert.ErrorIs(t, c.Store(ctx, "docs/b.txt", strings.NewReader("overwritten")), ErrImmutable)
+	require.NoError(t, c.SetRetention(ctx, "docs/b.txt", Retention{}))
+	assert.ErrorIs(t, c.SetRetention(ctx, "missing.txt", Retention{LegalHold: true}), ErrKeyNotFound)
+
+	require.NoError(t, c.Delete(ctx, "docs/b.txt"))
+	_, err = c.Get(ctx, "docs/b.txt")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, c.Delete(ctx, "docs/b.txt"), ErrKeyNotFound)
+
+	s.MaxFileSize = 4
+	assert.ErrorIs(t, c.Store(ctx, "large.txt", strings.NewReader("too large")), ErrQuotaExceeded)
+
+	// Nodes that can't be reached are reported as such.
+	c, err = New(Options{Nodes: []string{down.URL}})
+	require.NoError(t, err)
+	_, err = c.Get(ctx, "other.txt")
+	assert.ErrorIs(t, err, ErrNoNode)
+
+	_, err = New(Options{})
+	assert.Error(t, err)
+	_, err = New(Options{Nodes: []string{"node1:8080"}})
+	assert.Error(t, err)
+}
+
+func TestClientToken(t *testing.T) {
+	s := dfs.NewNode(dfs.NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: t.TempDir(), Auth: &dfs.AuthOpts{APIKeys: map[string]dfs.Scope{"secret": dfs.ScopeWrite}}})
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	ctx := context.Background()
+
+	c, err := New(Options{Nodes: []string{api.URL}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, c.Store(ctx, "a.txt", strings.NewReader("first")), ErrUnauthorized)
+
+	c, err = New(Options{Nodes: []string{api.URL}, Token: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, c.Store(ctx, "a.txt", strings.NewReader("first")))
+	require.NoError(t, c.SetRetention(ctx, "a.txt", Retention{}))
+	objects, err := c.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+}
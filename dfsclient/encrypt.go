@@ -0,0 +1,265 @@
+package dfsclient
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Files encrypted end to end are stored as a header followed by segments.
+// The header holds the data key of the file, wrapped with the key of the
+// client and bound to the key the file is stored under, and the nonce prefix
+// of the segments. Every segment seals up to segmentSize bytes of the file
+// with AES-GCM under the data key, numbered in its nonce and the last one
+// flagged, so segments can't be reordered, dropped or cut off unnoticed.
+const (
+	encryptionMagic = "dfe1"
+	keySize         = 32
+	noncePrefixSize = 7
+	wrappedKeySize  = 12 + keySize + 16 // Nonce, data key and tag
+	headerSize      = len(encryptionMagic) + wrappedKeySize + noncePrefixSize
+	segmentSize     = 64 << 10
+	tagSize         = 16
+)
+
+// ErrDecryption is returned for files that don't decrypt with the key of the
+// client: stored by another client or without encryption, or altered by a
+// node.
+var ErrDecryption = errors.New("decryption failed")
+
+// newAEAD returns AES-GCM under key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of segment n: the nonce prefix of the file,
+// n, and whether it is the last one.
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader reads the file src reads, encrypted for storing under key.
+type encryptReader struct {
+	kek  []byte // Key of the client, wrapping the data key
+	key  string // Key the file is stored under
+	src  *bufio.Reader
+	aead cipher.AEAD // Sealing the segments under the data key
+
+	seeker io.ReadSeeker // src, if it can be rewound
+	start  int64         // Offset of src the file starts at
+
+	prefix []byte // Nonce prefix of the segments
+	buf    []byte // Encrypted bytes not read yet
+	seg    uint32 // Number of the next segment
+	done   bool   // Whether the last segment was sealed
+	pos    int64  // Encrypted bytes read
+	plain  []byte // Segment being sealed
+	sealed []byte // Segment sealed
+}
+
+// newEncryptReader returns a reader of the file src reads, encrypted under a
+// new data key wrapped with kek.
+func newEncryptReader(kek []byte, key string, src io.Reader) (*encryptReader, error) {
+	e := &encryptReader{
+		kek:    kek,
+		key:    key,
+		src:    bufio.NewReaderSize(src, segmentSize),
+		plain:  make([]byte, segmentSize),
+		sealed: make([]byte, 0, segmentSize+tagSize),
+	}
+	if seeker, ok := src.(io.ReadSeeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			e.seeker, e.start = seeker, start
+		}
+	}
+	return e, e.begin()
+}
+
+// begin starts the file over with a data key and nonce prefix of its own, so
+// no nonce is ever used twice even if src reads differently the next time.
+func (e *encryptReader) begin() error {
+	dataKey := make([]byte, keySize)
+	e.prefix = make([]byte, noncePrefixSize)
+	wrapNonce := make([]byte, 12)
+	for _, b := range [][]byte{dataKey, e.prefix, wrapNonce} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return err
+		}
+	}
+
+	wrap, err := newAEAD(e.kek)
+	if err != nil {
+		return err
+	}
+	if e.aead, err = newAEAD(dataKey); err != nil {
+		return err
+	}
+
+	header := append([]byte(encryptionMagic), wrapNonce...)
+	header = wrap.Seal(header, wrapNonce, dataKey, []byte(encryptionMagic+e.key))
+	e.buf = append(header, e.prefix...)
+	e.seg, e.done, e.pos = 0, false, 0
+	return nil
+}
+
+func (e *encryptReader) Read(b []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, e.buf)
+	e.buf = e.buf[n:]
+	e.pos += int64(n)
+	return n, nil
+}
+
+// seal reads and seals the next segment.
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true // The file ends right at the end of the segment
+		} else if err != nil {
+			return err
+		}
+	}
+
+	e.sealed = e.aead.Seal(e.sealed[:0], segmentNonce(e.prefix, e.seg, last), e.plain[:n], nil)
+	e.buf = e.sealed
+	e.seg++
+	e.done = last
+	return nil
+}
+
+// Seek supports what Client.do needs to send the file again: telling the
+// offset, and rewinding to the start if src can be. The file is encrypted
+// anew when rewound.
+func (e *encryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case whence == io.SeekCurrent && offset == 0:
+		return e.pos, nil
+	case whence == io.SeekStart && offset == 0 && e.seeker != nil:
+		if _, err := e.seeker.Seek(e.start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		e.src.Reset(e.seeker)
+		return 0, e.begin()
+	}
+	return 0, errors.New("dfsclient: encrypted files can only be rewound to their start")
+}
+
+// decryptReader reads the plaintext of the encrypted file src reads.
+type decryptReader struct {
+	src  io.ReadCloser
+	r    *bufio.Reader
+	aead cipher.AEAD
+
+	prefix []byte // Nonce prefix of the segments
+	buf    []byte // Plaintext not read yet
+	plain  []byte // Segment opened
+	sealed []byte // Segment being opened
+	seg    uint32 // Number of the next segment
+	done   bool   // Whether the last segment was opened
+}
+
+// newDecryptReader reads the header of the file stored under key that src
+// reads, unwrapping its data key with kek.
+func newDecryptReader(kek []byte, key string, src io.ReadCloser) (*decryptReader, error) {
+	r := bufio.NewReaderSize(src, segmentSize+tagSize)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: reading the header of (%s): %w", ErrDecryption, key, err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("%w: (%s) is not encrypted end to end", ErrDecryption, key)
+	}
+
+	wrap, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := header[len(encryptionMagic) : len(encryptionMagic)+wrappedKeySize]
+	dataKey, err := wrap.Open(nil, wrapped[:12], wrapped[12:], []byte(encryptionMagic+key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: the data key of (%s) doesn't unwrap with the key of the client", ErrDecryption, key)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		src:    src,
+		r:      r,
+		aead:   aead,
+		prefix: header[headerSize-noncePrefixSize:],
+		plain:  make([]byte, 0, segmentSize),
+		sealed: make([]byte, segmentSize+tagSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(b []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	d.plain, err = d.aead.Open(d.plain[:0], segmentNonce(d.prefix, d.seg, last), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d was altered or the file cut off", ErrDecryption, d.seg)
+	}
+	d.buf = d.plain
+	d.seg++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
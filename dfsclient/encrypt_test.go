@@ -0,0 +1,122 @@
+package dfsclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encrypt returns data encrypted under kek for storing under key.
+func encrypt(t *testing.T, kek []byte, key string, data []byte) []byte {
+	r, err := newEncryptReader(kek, key, bytes.NewReader(data))
+	require.NoError(t, err)
+	sealed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return sealed
+}
+
+// decrypt returns the plaintext of sealed, stored under key.
+func decrypt(kek []byte, key string, sealed []byte) ([]byte, error) {
+	r, err := newDecryptReader(kek, key, io.NopCloser(bytes.NewReader(sealed)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryption(t *testing.T) {
+	kek := make([]byte, keySize)
+	rand.Read(kek)
+	for _, size := range []int{0, 1, segmentSize, 2*segmentSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		sealed := encrypt(t, kek, "key", data)
+		segments := max(1, (size+segmentSize-1)/segmentSize)
+		assert.Len(t, sealed, headerSize+size+segments*tagSize)
+		got, err := decrypt(kek, "key", sealed)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		// Files don't decrypt with another key, under another key, or altered.
+		other := make([]byte, keySize)
+		rand.Read(other)
+		_, err = decrypt(other, "key", sealed)
+		assert.ErrorIs(t, err, ErrDecryption)
+		_, err = decrypt(kek, "other", sealed)
+		assert.ErrorIs(t, err, ErrDecryption)
+		altered := bytes.Clone(sealed)
+		altered[len(altered)-1] ^= 1
+		_, err = decrypt(kek, "key", altered)
+		assert.ErrorIs(t, err, ErrDecryption)
+	}
+
+	// Files cut off at a segment boundary are told apart from complete ones.
+	sealed := encrypt(t, kek, "key", make([]byte, 2*segmentSize+7))
+	_, err := decrypt(kek, "key", sealed[:headerSize+segmentSize+tagSize])
+	assert.ErrorIs(t, err, ErrDecryption)
+	_, err = decrypt(kek, "key", []byte("plaintext file"))
+	assert.ErrorIs(t, err, ErrDecryption)
+
+	// Rewinding encrypts the file anew.
+	r, err := newEncryptReader(kek, "key", bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+	first, _ := io.ReadAll(r)
+	_, err = r.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	second, _ := io.ReadAll(r)
+	assert.NotEqual(t, first, second)
+	got, err := decrypt(kek, "key", second)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(got))
+}
+
+func TestClientEncryption(t *testing.T) {
+	root := t.TempDir()
+	s := dfs.NewNode(dfs.NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: root})
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	kek := make([]byte, keySize)
+	rand.Read(kek)
+	c, err := New(Options{Nodes: []string{api.URL}, EncryptionKey: kek})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	secret := []byte("only the client reads this")
+	require.NoError(t, c.Store(ctx, "secret.txt", bytes.NewReader(secret)))
+	r, err := c.Get(ctx, "secret.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, secret, got)
+
+	// The node only ever gets the ciphertext.
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			buf, _ := os.ReadFile(path)
+			assert.NotContains(t, string(buf), string(secret), path)
+		}
+		return nil
+	})
+	plain, err := New(Options{Nodes: []string{api.URL}})
+	require.NoError(t, err)
+	r, err = plain.Get(ctx, "secret.txt")
+	require.NoError(t, err)
+	sealed, _ := io.ReadAll(r)
+	r.Close()
+	assert.NotContains(t, string(sealed), string(secret))
+
+	_, err = New(Options{Nodes: []string{api.URL}, EncryptionKey: []byte("short")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package dfsclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"lukechampine.com/blake3"
+	"lukechampine.com/blake3/bao"
+)
+
+// Root returns the BLAKE3 hash of the file r reads, for fetching it with
+// GetVerified later. For files encrypted end to end it is the hash of the
+// file as stored, the ciphertext.
+func Root(r io.Reader) ([32]byte, error) {
+	var root [32]byte
+	h := blake3.New(32, nil)
+	if _, err := io.Copy(h, r); err != nil {
+		return root, err
+	}
+	copy(root[:], h.Sum(nil))
+	return root, nil
+}
+
+// GetVerified fetches the file stored under key like Get, verifying it
+// against root, its BLAKE3 hash, as it streams: the node sends it along with
+// the tree hashing it, and every group of chunks is checked before it is read,
+// so a corrupt or malicious stream fails with ErrChecksumMismatch at the first
+// bad group rather than after the whole file.
+func (c *Client) GetVerified(ctx context.Context, key string, root [32]byte) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, (&url.URL{Path: "/bao/" + key}).EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	group, err := strconv.Atoi(res.Header.Get("X-Dfs-Bao-Group"))
+	if err != nil || group < 0 || group > 10 {
+		res.Body.Close()
+		return nil, fmt.Errorf("dfsclient: bad group size %q for (%s)", res.Header.Get("X-Dfs-Bao-Group"), key)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer res.Body.Close()
+		ok, err := bao.Decode(pw, res.Body, nil, group, root)
+		if err == nil && !ok {
+			err = fmt.Errorf("%w: (%s) doesn't match its root", ErrChecksumMismatch, key)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	if c.kek == nil {
+		return pr, nil
+	}
+	r, err := newDecryptReader(c.kek, key, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	return r, nil
+}
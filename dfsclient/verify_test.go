@@ -0,0 +1,73 @@
+package dfsclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetVerified(t *testing.T) {
+	s := dfs.NewNode(dfs.NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: t.TempDir()})
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	c, err := New(Options{Nodes: []string{api.URL}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	data := make([]byte, 200<<10)
+	rand.Read(data)
+	require.NoError(t, c.Store(ctx, "a.bin", bytes.NewReader(data)))
+	root, err := Root(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	r, err := c.GetVerified(ctx, "a.bin", root)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// A stream not matching the root fails before handing out anything,
+	var wrong [32]byte
+	r, err = c.GetVerified(ctx, "a.bin", wrong)
+	require.NoError(t, err)
+	b, err = io.ReadAll(r)
+	r.Close()
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.Empty(t, b)
+
+	// and one corrupted along the way at the first bad group, rather than
+	// after the whole file.
+	tamper := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := http.Get(api.URL + r.URL.Path)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		body[len(body)/2] ^= 1
+		w.Header().Set("X-Dfs-Bao-Group", res.Header.Get("X-Dfs-Bao-Group"))
+		w.Write(body)
+	}))
+	defer tamper.Close()
+	c, err = New(Options{Nodes: []string{tamper.URL}})
+	require.NoError(t, err)
+	r, err = c.GetVerified(ctx, "a.bin", root)
+	require.NoError(t, err)
+	b, err = io.ReadAll(r)
+	r.Close()
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.NotEmpty(t, b)
+	assert.Less(t, len(b), len(data))
+	assert.Equal(t, data[:len(b)], b)
+}
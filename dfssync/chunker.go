@@ -0,0 +1,78 @@
+package dfssync
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// windowSize is the number of bytes the rolling checksum covers.
+const windowSize = 64
+
+// buzTable maps every byte to the random value the rolling checksum mixes in
+// for it. Every client must split files alike to share chunks, so the table
+// is derived from a fixed seed.
+var buzTable = func() (t [256]uint64) {
+	x := uint64(0x64667373796e6331) // splitmix64, seeded with "dfssync1"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker splits a stream into chunks at the offsets where a buzhash of the
+// last windowSize bytes has its low bits zero. The cut points depend on the
+// contents around them only, so inserting or removing bytes changes the
+// chunks near the change and leaves the others as they were, like rsync.
+type chunker struct {
+	r        *bufio.Reader
+	min, max int    // Bounds of the size of the chunks but the last
+	mask     uint64 // Chunks are cut where the checksum has these bits zero
+}
+
+// newChunker returns a chunker of r cutting chunks of avg bytes on average,
+// a power of two; no chunk is smaller than a quarter of that or larger than
+// four times it.
+func newChunker(r io.Reader, avg int) *chunker {
+	return &chunker{
+		r:    bufio.NewReaderSize(r, 64<<10),
+		min:  avg / 4,
+		max:  avg * 4,
+		mask: uint64(avg) - 1,
+	}
+}
+
+// next returns the next chunk, or io.EOF once the stream has been read.
+func (c *chunker) next() ([]byte, error) {
+	var (
+		chunk []byte
+		sum   uint64
+	)
+	for len(chunk) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+		sum = bits.RotateLeft64(sum, 1) ^ buzTable[b]
+		if len(chunk) > windowSize {
+			// The rotation of the byte leaving the window is a full turn, a no-op
+			sum ^= buzTable[chunk[len(chunk)-windowSize-1]]
+		}
+		if len(chunk) >= c.min && sum&c.mask == 0 {
+			break
+		}
+	}
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
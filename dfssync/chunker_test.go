@@ -0,0 +1,54 @@
+package dfssync
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// split returns the chunks of data.
+func split(t *testing.T, data []byte, avg int) [][]byte {
+	var chunks [][]byte
+	ch := newChunker(bytes.NewReader(data), avg)
+	for {
+		chunk, err := ch.next()
+		if err == io.EOF {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := split(t, data, 4096)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	assert.Greater(t, len(chunks), 100)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), 1024)
+		assert.LessOrEqual(t, len(chunk), 4*4096)
+	}
+
+	// Inserting bytes only changes the chunks around them.
+	edited := append(append(append([]byte{}, data[:300000]...), "inserted"...), data[300000:]...)
+	before := make(map[string]bool)
+	for _, chunk := range chunks {
+		before[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range split(t, edited, 4096) {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+
+	assert.Empty(t, split(t, nil, 4096))
+}
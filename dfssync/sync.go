@@ -0,0 +1,470 @@
+// Package dfssync backs up local directories to the distributed file storage
+// network and restores them, sending only what changed since the last sync,
+// like rsync.
+//
+// Files are split into chunks at cut points chosen by a rolling checksum of
+// their contents, so an edit anywhere in a file only changes the chunks
+// around it. Every chunk is stored once below the prefix synced to, named
+// after the SHA-256 of its contents, and every file as a manifest listing its
+// chunks under <prefix>/<path of the file>:
+//
+//	backups/laptop/docs/report.pdf            manifest of docs/report.pdf
+//	backups/laptop/.dfssync/chunks/<sha256>   chunk shared by every file holding it
+//
+// Push compares the directory against the stored manifests and uploads the
+// chunks the network doesn't hold yet; Pull downloads the chunks missing from
+// the local copies of the files. A prefix should only be synced to by one
+// client at a time.
+package dfssync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/dfsclient"
+)
+
+const (
+	// manifestMagic starts every manifest, telling it apart from other files.
+	manifestMagic = "dfs-sync:v1\n"
+
+	// reservedDir is the directory below the prefix holding the chunks. Local
+	// files within a directory of that name at the top are not synced.
+	reservedDir = ".dfssync"
+
+	defaultChunkSize = 1 << 20 // Average chunk size unless Options says otherwise
+)
+
+// ErrNotManifest is returned by Pull for files below the prefix that weren't
+// stored by Push.
+var ErrNotManifest = errors.New("not a sync manifest")
+
+// Options configures a sync.
+type Options struct {
+	// ChunkSize is the average size of the chunks files are split into, a
+	// power of two (default 1 MiB). Pushes with another size than the last
+	// one store every file anew.
+	ChunkSize int
+
+	// Delete deletes what is missing from the source of the sync: files
+	// stored under the prefix after a Push, local files after a Pull.
+	Delete bool
+}
+
+// Stats tells what a sync did.
+type Stats struct {
+	Files     int   // Files the source holds
+	Unchanged int   // Files skipped as their size and modification time matched
+	Chunks    int   // Chunks sent by Push, or fetched by Pull
+	Bytes     int64 // Bytes of the chunks sent or fetched
+	Reused    int   // Chunks of changed files found at the destination already
+	Deleted   int   // Files deleted at the destination, see Options.Delete
+}
+
+// Manifest describes a file stored by Push.
+type Manifest struct {
+	Size    int64       `json:"size"`     // Size of the file in bytes
+	Mode    fs.FileMode `json:"mode"`     // Permission bits
+	ModTime time.Time   `json:"mod_time"` // Modification time
+	Chunks  []Chunk     `json:"chunks"`   // Chunks in file order
+}
+
+// Chunk references a chunk of a file.
+type Chunk struct {
+	Hash string `json:"hash"` // Hex encoded SHA-256 of the contents, the name of the chunk
+	Size int64  `json:"size"` // Size of the chunk in bytes
+}
+
+// encode returns the manifest as stored.
+func (m *Manifest) encode() []byte {
+	buf, _ := json.Marshal(m)
+	return append([]byte(manifestMagic), buf...)
+}
+
+// decodeManifest parses a manifest produced by encode.
+func decodeManifest(b []byte) (*Manifest, error) {
+	if !bytes.HasPrefix(b, []byte(manifestMagic)) {
+		return nil, ErrNotManifest
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b[len(manifestMagic):], m); err != nil {
+		return nil, fmt.Errorf("invalid sync manifest: %w", err)
+	}
+	return m, nil
+}
+
+// unchanged reports whether the local file described by info still is the
+// one m describes, going by its size and modification time.
+func (m *Manifest) unchanged(info fs.FileInfo) bool {
+	return m.Size == info.Size() && m.ModTime.Equal(info.ModTime())
+}
+
+// syncer syncs a directory with the files under a prefix.
+type syncer struct {
+	c      *dfsclient.Client
+	prefix string
+	opts   Options
+	stats  Stats
+}
+
+func newSyncer(c *dfsclient.Client, prefix string, opts Options) (*syncer, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.ChunkSize < windowSize || opts.ChunkSize&(opts.ChunkSize-1) != 0 {
+		return nil, fmt.Errorf("dfssync: chunk size %d must be a power of two of at least %d", opts.ChunkSize, windowSize)
+	}
+	return &syncer{c: c, prefix: strings.Trim(prefix, "/"), opts: opts}, nil
+}
+
+// key returns the key of the manifest of the file at rel.
+func (s *syncer) key(rel string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, rel), "/")
+}
+
+// chunkKey returns the key of the chunk named hash.
+func (s *syncer) chunkKey(hash string) string {
+	return s.key(path.Join(reservedDir, "chunks", hash))
+}
+
+// remote lists the manifests stored under the prefix, by the path of their
+// file, and the chunks stored.
+func (s *syncer) remote(ctx context.Context) (files map[string]bool, chunks map[string]bool, err error) {
+	list := s.prefix + "/"
+	if s.prefix == "" {
+		list = ""
+	}
+	objects, err := s.c.List(ctx, list)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, chunks = make(map[string]bool), make(map[string]bool)
+	chunkDir := s.chunkKey("") + "/"
+	for _, obj := range objects {
+		if hash, ok := strings.CutPrefix(obj.Key, chunkDir); ok {
+			chunks[hash] = true
+		} else if !isReserved(strings.TrimPrefix(obj.Key, list)) {
+			files[strings.TrimPrefix(obj.Key, list)] = true
+		}
+	}
+	return files, chunks, nil
+}
+
+// isReserved reports whether the slash separated path rel lies within the
+// directory of the chunks.
+func isReserved(rel string) bool {
+	return rel == reservedDir || strings.HasPrefix(rel, reservedDir+"/")
+}
+
+// manifest fetches the manifest of the file at rel.
+func (s *syncer) manifest(ctx context.Context, rel string) (*Manifest, error) {
+	r, err := s.c.Get(ctx, s.key(rel))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeManifest(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.key(rel), err)
+	}
+	return m, nil
+}
+
+// Push backs up the regular files of the directory dir to the files under
+// prefix. Files whose size and modification time match their manifest are
+// skipped without reading them; the others are split into chunks, and only
+// the chunks the network doesn't hold are sent. Chunks no file references
+// anymore are deleted once the manifests are stored.
+func Push(ctx context.Context, c *dfsclient.Client, dir string, prefix string, opts Options) (Stats, error) {
+	s, err := newSyncer(c, prefix, opts)
+	if err != nil {
+		return Stats{}, err
+	}
+	files, chunks, err := s.remote(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	used := make(map[string]bool) // Chunks the stored files reference
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isReserved(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil // Directories are implied by the paths of their files
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		s.stats.Files++
+
+		var m *Manifest
+		if files[rel] {
+			if m, err = s.manifest(ctx, rel); err != nil && !errors.Is(err, ErrNotManifest) {
+				return err
+			}
+			delete(files, rel)
+		}
+		if m != nil && m.unchanged(info) {
+			s.stats.Unchanged++
+		} else if m, err = s.pushFile(ctx, p, rel, info, chunks); err != nil {
+			return fmt.Errorf("pushing %s failed: %w", rel, err)
+		}
+		for _, chunk := range m.Chunks {
+			used[chunk.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return s.stats, err
+	}
+
+	// Files missing locally are kept unless deleted, and so are their chunks.
+	for rel := range files {
+		if s.opts.Delete {
+			if err := s.c.Delete(ctx, s.key(rel)); err != nil && !errors.Is(err, dfsclient.ErrKeyNotFound) {
+				return s.stats, err
+			}
+			s.stats.Deleted++
+			continue
+		}
+		m, err := s.manifest(ctx, rel)
+		if errors.Is(err, ErrNotManifest) {
+			continue
+		}
+		if err != nil {
+			return s.stats, err
+		}
+		for _, chunk := range m.Chunks {
+			used[chunk.Hash] = true
+		}
+	}
+	for hash := range chunks {
+		if !used[hash] {
+			if err := s.c.Delete(ctx, s.chunkKey(hash)); err != nil && !errors.Is(err, dfsclient.ErrKeyNotFound) {
+				return s.stats, err
+			}
+		}
+	}
+	return s.stats, nil
+}
+
+// pushFile stores the chunks of the file at p the network doesn't hold yet,
+// adding them to chunks, then its manifest.
+func (s *syncer) pushFile(ctx context.Context, p string, rel string, info fs.FileInfo, chunks map[string]bool) (*Manifest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &Manifest{Mode: info.Mode().Perm(), ModTime: info.ModTime()}
+	ch := newChunker(f, s.opts.ChunkSize)
+	for {
+		data, err := ch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		chunk := Chunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		if chunks[chunk.Hash] {
+			s.stats.Reused++
+		} else {
+			if err := s.c.Store(ctx, s.chunkKey(chunk.Hash), bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+			chunks[chunk.Hash] = true
+			s.stats.Chunks++
+			s.stats.Bytes += chunk.Size
+		}
+		m.Chunks = append(m.Chunks, chunk)
+		m.Size += chunk.Size
+	}
+
+	// The file changed while it was read, its manifest would not match it
+	if m.Size != info.Size() {
+		return nil, fmt.Errorf("file changed while it was read: %d bytes instead of %d", m.Size, info.Size())
+	}
+	return m, s.c.Store(ctx, s.key(rel), bytes.NewReader(m.encode()))
+}
+
+// Pull restores the files under prefix to the directory dir, creating it if
+// it doesn't exist. Local files whose size and modification time match their
+// manifest are left alone; the others are rebuilt from the chunks they share
+// with their manifest, and only the chunks missing locally are fetched.
+func Pull(ctx context.Context, c *dfsclient.Client, prefix string, dir string, opts Options) (Stats, error) {
+	s, err := newSyncer(c, prefix, opts)
+	if err != nil {
+		return Stats{}, err
+	}
+	files, _, err := s.remote(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	for rel := range files {
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return s.stats, fmt.Errorf("dfssync: stored path %q escapes the destination", rel)
+		}
+		m, err := s.manifest(ctx, rel)
+		if err != nil {
+			return s.stats, err
+		}
+		s.stats.Files++
+
+		if info, err := os.Stat(target); err == nil && info.Mode().IsRegular() && m.unchanged(info) {
+			s.stats.Unchanged++
+			continue
+		}
+		if err := s.pullFile(ctx, target, m); err != nil {
+			return s.stats, fmt.Errorf("pulling %s failed: %w", rel, err)
+		}
+	}
+
+	if s.opts.Delete {
+		err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || files[filepath.ToSlash(rel)] {
+				return nil
+			}
+			s.stats.Deleted++
+			return os.Remove(p)
+		})
+		if err != nil {
+			return s.stats, err
+		}
+	}
+	return s.stats, nil
+}
+
+// pullFile writes the file described by m to target, taking the chunks the
+// current file at target holds from it.
+func (s *syncer) pullFile(ctx context.Context, target string, m *Manifest) error {
+	local, err := s.localChunks(target)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".dfssync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Gone once renamed to target
+
+	for _, chunk := range m.Chunks {
+		data, ok := local[chunk.Hash]
+		if ok {
+			s.stats.Reused++
+		} else if data, err = s.fetchChunk(ctx, chunk); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), m.Mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), m.ModTime, m.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// localChunks splits the file at target into chunks, by hash. A missing file
+// has none.
+func (s *syncer) localChunks(target string) (map[string][]byte, error) {
+	chunks := make(map[string][]byte)
+	f, err := os.Open(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return chunks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ch := newChunker(f, s.opts.ChunkSize)
+	for {
+		data, err := ch.next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		chunks[hex.EncodeToString(sum[:])] = data
+	}
+}
+
+// fetchChunk fetches a chunk, checking its contents against its hash.
+func (s *syncer) fetchChunk(ctx context.Context, chunk Chunk) ([]byte, error) {
+	r, err := s.c.Get(ctx, s.chunkKey(chunk.Hash))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != chunk.Hash {
+		return nil, fmt.Errorf("%w: chunk %s is corrupt", dfsclient.ErrChecksumMismatch, chunk.Hash)
+	}
+	s.stats.Chunks++
+	s.stats.Bytes += int64(len(data))
+	return data, nil
+}
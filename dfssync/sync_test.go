@@ -0,0 +1,103 @@
+package dfssync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/inagib21/DistributedFileStorageGo/dfsclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushPull(t *testing.T) {
+	s := dfs.NewNode(dfs.NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: t.TempDir()})
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	c, err := dfsclient.New(dfsclient.Options{Nodes: []string{api.URL}})
+	require.NoError(t, err)
+	ctx := context.Background()
+	opts := Options{ChunkSize: 4096}
+
+	src := t.TempDir()
+	big := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(big)
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "docs"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "docs", "big.bin"), big, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "small.txt"), []byte("small"), 0o644))
+
+	stats, err := Push(ctx, c, src, "backups/laptop", opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Files)
+	assert.Equal(t, int64(len(big)+len("small")), stats.Bytes)
+	first := stats.Chunks
+
+	// Nothing changed, nothing is read or sent.
+	stats, err = Push(ctx, c, src, "backups/laptop", opts)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Files: 2, Unchanged: 2}, stats)
+
+	// An edit in the middle only sends the chunks around it.
+	edited := append(append(append([]byte{}, big[:100000]...), "edit"...), big[100000:]...)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "docs", "big.bin"), edited, 0o600))
+	stats, err = Push(ctx, c, src, "backups/laptop", opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Unchanged)
+	assert.LessOrEqual(t, stats.Chunks, 2)
+	assert.Greater(t, stats.Reused, first/2)
+	assert.Less(t, stats.Bytes, int64(len(edited))/4)
+
+	// Chunks only the old version referenced are gone.
+	objects, err := c.List(ctx, "backups/laptop/.dfssync/")
+	require.NoError(t, err)
+	stored := 0
+	for _, obj := range objects {
+		stored += int(obj.Size)
+	}
+	assert.Equal(t, len(edited)+len("small"), stored)
+
+	// Restoring to an empty directory fetches everything.
+	dst := t.TempDir()
+	stats, err = Pull(ctx, c, "backups/laptop", dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Files)
+	got, err := os.ReadFile(filepath.Join(dst, "docs", "big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, edited, got)
+	info, err := os.Stat(filepath.Join(dst, "small.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+	srcInfo, err := os.Stat(filepath.Join(src, "small.txt"))
+	require.NoError(t, err)
+	assert.True(t, srcInfo.ModTime().Equal(info.ModTime()))
+
+	// Restoring over a stale copy fetches the changed chunks only.
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "docs", "big.bin"), big, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "stray.txt"), []byte("stray"), 0o600))
+	stats, err = Pull(ctx, c, "backups/laptop", dst, Options{ChunkSize: 4096, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Unchanged)
+	assert.LessOrEqual(t, stats.Chunks, 2)
+	assert.Equal(t, 1, stats.Deleted)
+	got, err = os.ReadFile(filepath.Join(dst, "docs", "big.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(edited, got))
+	assert.NoFileExists(t, filepath.Join(dst, "stray.txt"))
+
+	// Files deleted locally are deleted with Delete, their chunks with them.
+	require.NoError(t, os.Remove(filepath.Join(src, "docs", "big.bin")))
+	stats, err = Push(ctx, c, src, "backups/laptop", Options{ChunkSize: 4096, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Deleted)
+	objects, err = c.List(ctx, "backups/laptop/")
+	require.NoError(t, err)
+	assert.Len(t, objects, 2, "the manifest and chunk of small.txt")
+
+	_, err = Push(ctx, c, src, "backups/laptop", Options{ChunkSize: 1000})
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// dirManifestVersion is the version of the DirManifest format written by StoreDir.
+const dirManifestVersion = 1
+
+// DirManifest describes a directory stored with StoreDir. It is stored under
+// the directory's key, the contents of every file under a key of its own.
+type DirManifest struct {
+	Version int        `json:"version"` // Format version, currently 1
+	Entries []DirEntry `json:"entries"` // Directories, files and symlinks, parents before children
+}
+
+// DirEntry is a single directory, file or symlink of a stored directory.
+type DirEntry struct {
+	Path    string      `json:"path"`             // Slash separated path relative to the stored directory
+	Mode    fs.FileMode `json:"mode"`             // Type and permission bits
+	Size    int64       `json:"size,omitempty"`   // Size of regular files
+	ModTime time.Time   `json:"mod_time"`         // Modification time
+	Target  string      `json:"target,omitempty"` // Link target of symlinks
+}
+
+// dirEntryKey returns the key the contents of the file at rel are stored under.
+func dirEntryKey(key string, rel string) string {
+	return key + "/" + rel
+}
+
+// StoreDir stores the directory tree at root under key, preserving its
+// structure, file modes, modification times and symlinks. Other kinds of
+// files, such as devices and sockets, are skipped.
+func (s *FileServer) StoreDir(key string, root string) error {
+	manifest := DirManifest{Version: dirManifestVersion}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil // The root itself is recreated by GetDir
+		}
+		rel = filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := DirEntry{
+			Path:    rel,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+
+		switch {
+		case info.Mode().IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if entry.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if err := s.storeFile(dirEntryKey(key, rel), p); err != nil {
+				return fmt.Errorf("storing %s failed: %w", rel, err)
+			}
+		default:
+			return nil // Devices, sockets and pipes can't be restored meaningfully
+		}
+
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return s.Store(key, bytes.NewReader(buf))
+}
+
+// storeFile stores the contents of the file at p under key.
+func (s *FileServer) storeFile(key string, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.Store(key, f)
+}
+
+// GetDir restores the directory stored under key to dest, creating dest if
+// it doesn't exist. Files are fetched from the network if they aren't held
+// locally. Entries with paths escaping dest are rejected.
+func (s *FileServer) GetDir(key string, dest string) error {
+	manifest, err := s.dirManifest(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+
+	// Directory times and modes are set last, creating their children would
+	// change the times and a read-only mode would prevent creating them.
+	var (
+		dirs  []DirEntry
+		links = make(map[string]bool) // Symlinks restored so far
+	)
+	for _, entry := range manifest.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) || path.Clean(entry.Path) != entry.Path || underSymlink(entry.Path, links) {
+			return fmt.Errorf("%w: directory entry %q escapes the destination", ErrInvalidKey, entry.Path)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(entry.Path))
+
+		switch {
+		case entry.Mode.IsDir():
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return err
+			}
+			dirs = append(dirs, entry)
+		case entry.Mode&fs.ModeSymlink != 0:
+			os.Remove(target)
+			if err := os.Symlink(entry.Target, target); err != nil && runtime.GOOS != "windows" {
+				return err // Windows needs extra privileges for symlinks, skip them there
+			}
+			links[entry.Path] = true
+		case entry.Mode.IsRegular():
+			if err := s.getFile(dirEntryKey(key, entry.Path), target, entry); err != nil {
+				return fmt.Errorf("restoring %s failed: %w", entry.Path, err)
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dest, filepath.FromSlash(dirs[i].Path))
+		if err := os.Chmod(target, dirs[i].Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// underSymlink reports whether any parent of the slash separated path p is one
+// of links. Writing there would follow the link, possibly out of the destination.
+func underSymlink(p string, links map[string]bool) bool {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if links[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// dirManifest fetches and decodes the manifest of the directory stored under key.
+func (s *FileServer) dirManifest(key string) (*DirManifest, error) {
+	r, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest := &DirManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("(%s) is not a stored directory: %w", key, err)
+	}
+	if manifest.Version != dirManifestVersion {
+		return nil, fmt.Errorf("(%s) is not a stored directory: unsupported manifest version %d", key, manifest.Version)
+	}
+
+	return manifest, nil
+}
+
+// getFile restores the file stored under key to target with the mode and time of entry.
+func (s *FileServer) getFile(key string, target string, entry DirEntry) error {
+	r, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// The umask may have stripped bits from the mode OpenFile created the file with
+	if err := os.Chmod(target, entry.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, entry.ModTime, entry.ModTime)
+}
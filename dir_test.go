@@ -0,0 +1,80 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreGetDir(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41130")
+
+	src := t.TempDir()
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "docs", "nested"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "readme.txt"), []byte("hello"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "docs", "run.sh"), []byte("#!/bin/sh"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "docs", "nested", "empty"), nil, 0o600))
+	assert.Nil(t, os.Chtimes(filepath.Join(src, "readme.txt"), mtime, mtime))
+	if runtime.GOOS != "windows" {
+		assert.Nil(t, os.Symlink("readme.txt", filepath.Join(src, "link")))
+	}
+
+	assert.Nil(t, s.StoreDir("backup", src))
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	assert.Nil(t, s.GetDir("backup", dest))
+
+	b, err := os.ReadFile(filepath.Join(dest, "readme.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	info, err := os.Stat(filepath.Join(dest, "readme.txt"))
+	assert.Nil(t, err)
+	assert.True(t, info.ModTime().Equal(mtime))
+
+	info, err = os.Stat(filepath.Join(dest, "docs", "nested", "empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	if runtime.GOOS != "windows" {
+		info, err = os.Stat(filepath.Join(dest, "docs", "run.sh"))
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+		target, err := os.Readlink(filepath.Join(dest, "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, "readme.txt", target)
+	}
+
+	// Regular files aren't directories.
+	assert.Nil(t, s.Store("plain", bytes.NewReader([]byte("not a manifest"))))
+	assert.NotNil(t, s.GetDir("plain", t.TempDir()))
+}
+
+func TestGetDirRejectsEscapes(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41131")
+
+	manifests := []DirManifest{
+		{Version: dirManifestVersion, Entries: []DirEntry{{Path: "../evil", Mode: 0o644}}},
+		{Version: dirManifestVersion, Entries: []DirEntry{{Path: "/etc/evil", Mode: 0o644}}},
+		{Version: dirManifestVersion, Entries: []DirEntry{
+			{Path: "link", Mode: os.ModeSymlink | 0o777, Target: t.TempDir()},
+			{Path: "link/evil", Mode: 0o644},
+		}},
+	}
+	for _, manifest := range manifests {
+		buf, _ := json.Marshal(manifest)
+		assert.Nil(t, s.Store("evil", bytes.NewReader(buf)))
+
+		err := s.GetDir("evil", t.TempDir())
+		assert.True(t, errors.Is(err, ErrInvalidKey), "%v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package dfs
+
+import "errors"
+
+// diskUsage is not supported on this platform.
+func diskUsage(path string) (total int64, free int64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package dfs
+
+import "syscall"
+
+// diskUsage returns the total and available bytes of the file system holding path.
+func diskUsage(path string) (total int64, free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(uint64(st.Blocks) * uint64(st.Bsize)), int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
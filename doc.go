@@ -0,0 +1,24 @@
+// Package dfs is a node of the distributed file storage network, for
+// applications to embed. A node stores files on its disk, encrypts a copy of
+// each for its peers and replicates it to them, and fetches the files it lost
+// back from the peers holding them.
+//
+// New returns a node made from options, already listening and connected to
+// its bootstrap nodes; NewNode returns one configured with NodeOpts, and
+// NewFileServer one over any p2p.Transport, both to be run with Start. Files
+// are stored, fetched and deleted with the Store, Get and Delete methods of
+// FileServer and their variants taking a context.
+//
+// The local storage of a node is a storage.Store, which the storage package
+// can open on its own to inspect or repair a storage root; servers take any
+// Store through FileServerOpts.Storage. The crypto package holds the
+// encryption of replicas and the hash functions of keys.
+// The p2p package is the transport nodes talk over, and the command
+// cmd/dfsd runs a node configured with flags. Applications using the network
+// without running a node use the dfsclient package against the admin API of
+// a node, and dfssync to back up directories.
+//
+// The server used to be built as package main. Nodes still register the
+// messages they exchange under the names they had then, so they keep talking
+// to older nodes.
+package dfs
@@ -0,0 +1,127 @@
+package dfs
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// defaultListenAddr is the address nodes made by New listen on unless
+// WithListenAddr or WithTransport says otherwise, the default of dfsd.
+const defaultListenAddr = ":3000"
+
+// Node is a server embedded in the process importing the package, made with
+// New. It serves its peers from the moment New returns until Close; Store,
+// Get, Delete and the other methods of FileServer may be called in between.
+type Node struct {
+	*FileServer
+
+	done      chan struct{} // Closed once the server stopped handling messages
+	closeOnce sync.Once
+}
+
+// Option configures the node made by New.
+type Option func(*nodeConfig)
+
+// nodeConfig is what the options of New configure.
+type nodeConfig struct {
+	opts      NodeOpts
+	transport p2p.Transport // Transport of the node, a TCP transport of its own if nil
+}
+
+// WithListenAddr makes the node listen for peers on addr, :3000 by default.
+func WithListenAddr(addr string) Option {
+	return func(c *nodeConfig) { c.opts.ListenAddr = addr }
+}
+
+// WithStorageRoot stores the files of the node in the directory root, the
+// listen address followed by _network by default.
+func WithStorageRoot(root string) Option {
+	return func(c *nodeConfig) { c.opts.StorageRoot = root }
+}
+
+// WithBootstrap connects the node to the nodes at addrs once started.
+func WithBootstrap(addrs ...string) Option {
+	return func(c *nodeConfig) { c.opts.BootstrapNodes = append(c.opts.BootstrapNodes, addrs...) }
+}
+
+// WithIdentity gives the node the ID its files are stored under and the key
+// they are encrypted with, both generated by default. Nodes started again
+// must be given the same to read the files they stored before.
+func WithIdentity(id string, encKey []byte) Option {
+	return func(c *nodeConfig) { c.opts.ID, c.opts.EncKey = id, encKey }
+}
+
+// WithReplication places every new file on n servers besides the node, as
+// placed by the coordinator set with WithCoordinator or, without one, on n
+// of its peers picked by the key of the file. Files are replicated to every
+// peer if n is zero.
+func WithReplication(n int) Option {
+	return func(c *nodeConfig) { c.opts.ReplicationFactor = n }
+}
+
+// WithCoordinator makes the server with the given ID, or CoordinatorElected,
+// place the new files of the node and arbitrate its deletes, see
+// FileServerOpts.Coordinator.
+func WithCoordinator(id string) Option {
+	return func(c *nodeConfig) { c.opts.Coordinator = id }
+}
+
+// WithAdminAddr serves the admin HTTP API of the node on addr.
+func WithAdminAddr(addr string) Option {
+	return func(c *nodeConfig) { c.opts.AdminAddr = addr }
+}
+
+// WithTransport runs the node over t instead of a TCP transport of its own,
+// listening where t does. The handshake is then up to t, the options of
+// NodeOpts about it ignored; the callbacks of TCP and UDP transports are set
+// to those of the node, other transports must call them themselves.
+func WithTransport(t p2p.Transport) Option {
+	return func(c *nodeConfig) { c.transport = t }
+}
+
+// WithNodeOpts lets fn set the options of the node no other option sets,
+// such as its zone or its quotas; see NodeOpts.
+func WithNodeOpts(fn func(*NodeOpts)) Option {
+	return func(c *nodeConfig) { fn(&c.opts) }
+}
+
+// New returns a node made with options, like NewNode, listening for peers
+// and connecting to its bootstrap nodes. Close it once done.
+func New(options ...Option) (*Node, error) {
+	var c nodeConfig
+	for _, option := range options {
+		option(&c)
+	}
+	if c.transport == nil && len(c.opts.ListenAddr) == 0 {
+		c.opts.ListenAddr = defaultListenAddr
+	}
+	if c.opts.ReplicationFactor < 0 {
+		return nil, errors.New("the replication factor must not be negative")
+	}
+
+	s := newNode(c.opts, c.transport)
+	if err := s.start(); err != nil {
+		if s.running.Load() {
+			s.Transport.Close() // Listening already, serving something else failed
+		}
+		return nil, err
+	}
+	n := &Node{FileServer: s, done: make(chan struct{})}
+	go func() {
+		defer close(n.done)
+		s.loop()
+	}()
+	return n, nil
+}
+
+// Close stops the node and waits for it to close its transport. Closing it
+// again does nothing.
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		n.Stop()
+		<-n.done
+	})
+	return nil
+}
@@ -0,0 +1,51 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	n1, err := New(WithListenAddr("127.0.0.1:41367"), WithStorageRoot(t.TempDir()), WithIdentity("first", crypto.NewEncryptionKey()))
+	require.NoError(t, err)
+	defer n1.Close()
+
+	// Nodes can run over transports of their own.
+	transport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:41368",
+		HandshakeFunc: p2p.NewHelloHandshakeFunc(p2p.HelloConfig{NodeID: "second"}),
+		Decoder:       p2p.DefaultDecoder{},
+		Multiplex:     true,
+	})
+	n2, err := New(WithTransport(transport), WithStorageRoot(t.TempDir()), WithIdentity("second", nil), WithBootstrap("127.0.0.1:41367"), WithReplication(1))
+	require.NoError(t, err)
+	defer n2.Close()
+	assert.Equal(t, 1, n2.ReplicationFactor)
+	require.Eventually(t, func() bool { return len(n1.Peers()) == 1 && len(n2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, n2.Store("a.txt", strings.NewReader("embedded")))
+	require.Eventually(t, func() bool { return n1.store.Has("second", n2.hashKey("a.txt")) }, time.Second, 10*time.Millisecond)
+	require.NoError(t, n2.store.Delete("second", "a.txt"))
+	r, err := n2.Get("a.txt")
+	require.NoError(t, err)
+	got, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "embedded", string(got))
+	require.NoError(t, n2.Delete("a.txt"))
+
+	// The address is taken.
+	_, err = New(WithListenAddr("127.0.0.1:41367"), WithStorageRoot(t.TempDir()))
+	assert.Error(t, err)
+	_, err = New(WithListenAddr("127.0.0.1:0"), WithStorageRoot(t.TempDir()), WithReplication(-1))
+	assert.Error(t, err)
+
+	assert.NoError(t, n1.Close())
+	assert.NoError(t, n1.Close(), "closing again does nothing")
+}
@@ -0,0 +1,46 @@
+package dfs
+
+import (
+	"errors"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// Errors returned by Store, Get and Delete, and the methods built on them, so
+// applications can tell failures apart with errors.Is. The errors returned
+// wrap one of them along with the details.
+var (
+	// ErrKeyNotFound is returned for keys that aren't stored: not locally for
+	// Delete, and neither locally nor by any peer for Get.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrPeerUnavailable is returned by Get for files that aren't stored
+	// locally when no peer could be asked for them, or the peers that could
+	// hold them failed to answer. Unlike ErrKeyNotFound, the file may turn up
+	// once the peers are reachable again.
+	ErrPeerUnavailable = errors.New("peer unavailable")
+
+	// ErrChecksumMismatch is returned for data that doesn't match the checksum
+	// it was stored or sent with, such as a corrupt chunk.
+	ErrChecksumMismatch = storage.ErrChecksumMismatch
+
+	// ErrInvalidKey is returned for keys and IDs that don't map to a path
+	// inside the storage root.
+	ErrInvalidKey = storage.ErrInvalidKey
+
+	// ErrImmutable is returned for writes to keys already stored in a
+	// write-once namespace, and for deletes and writes of objects whose
+	// retention hasn't expired yet, see ErrImmutable. It wraps
+	// ErrPermissionDenied.
+	ErrImmutable = storage.ErrImmutable
+
+	// ErrQuotaExceeded is returned for files over a size or bandwidth limit:
+	// by Store for files over MaxFileSize, and for files a peer refused to
+	// take for being over its own limits.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// ErrNotFound is ErrKeyNotFound.
+//
+// Deprecated: Use ErrKeyNotFound.
+var ErrNotFound = ErrKeyNotFound
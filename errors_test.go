@@ -0,0 +1,46 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedErrors(t *testing.T) {
+	s := newExportServer(t)
+
+	// A lone node knows the keys it doesn't have.
+	_, err := s.Get("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, s.Delete("missing"), ErrKeyNotFound)
+
+	// A node that should have peers can't tell without them.
+	s.BootstrapNodes = []string{"127.0.0.1:1"}
+	_, err = s.Get("missing")
+	assert.ErrorIs(t, err, ErrPeerUnavailable)
+	assert.NotErrorIs(t, err, ErrKeyNotFound)
+	s.BootstrapNodes = nil
+
+	// Files over MaxFileSize aren't stored, whether their size is known up front or not.
+	s.MaxFileSize = 4
+	assert.ErrorIs(t, s.Store("large", strings.NewReader("too large")), ErrQuotaExceeded)
+	assert.ErrorIs(t, s.Store("large", io.MultiReader(strings.NewReader("too large"))), ErrQuotaExceeded)
+	assert.False(t, s.store.Has(s.ID, "large"))
+	assert.NoError(t, s.Store("small", strings.NewReader("fits")))
+	s.MaxFileSize = 0
+
+	// Corrupt chunks are reported when read.
+	s.ChunkSize = 4
+	require.NoError(t, s.Append("log", strings.NewReader("hello world")))
+	chunk := manifestOf(t, s, "log").Chunks[1]
+	_, err = s.store.Write(s.ID, chunk.Key, strings.NewReader("evil"))
+	require.NoError(t, err)
+	r, err := s.Get("log")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
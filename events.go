@@ -0,0 +1,124 @@
+package dfs
+
+import (
+	"sync"
+	"time"
+)
+
+// eventBufferSize is the number of events buffered per subscriber.
+const eventBufferSize = 64
+
+// Event is something that happened on a FileServer. It is one of
+// PeerConnected, PeerDisconnected, FileStored, FileFetched, ReplicationFailed,
+// KeyChanged, PeerPenalized, FileArchived, FileSpread or ProofFailed.
+type Event interface {
+	// EventTime returns when the event happened.
+	EventTime() time.Time
+}
+
+// EventMeta holds the fields common to all events.
+type EventMeta struct {
+	Time time.Time `json:"time"` // When the event happened
+}
+
+// EventTime returns when the event happened.
+func (m EventMeta) EventTime() time.Time { return m.Time }
+
+// PeerConnected is emitted when a peer has connected and completed the handshake.
+type PeerConnected struct {
+	EventMeta
+	Addr      string `json:"addr"`      // Remote address of the peer
+	ID        string `json:"id"`        // Node ID announced by the peer
+	Transport string `json:"transport"` // Transport the peer is connected over
+}
+
+// PeerDisconnected is emitted when a connected peer went away.
+type PeerDisconnected struct {
+	EventMeta
+	Addr string `json:"addr"` // Remote address of the peer
+	ID   string `json:"id"`   // Node ID announced by the peer
+}
+
+// FileStored is emitted when a file was written to the local store, either
+// by Store or as a replica sent by a peer.
+type FileStored struct {
+	EventMeta
+	ID   string `json:"id"`             // Namespace (server ID) the file belongs to
+	Key  string `json:"key"`            // Key the file was stored under
+	Size int64  `json:"size"`           // Bytes written to disk
+	From string `json:"from,omitempty"` // Peer that sent the replica, empty for local writes
+}
+
+// FileFetched is emitted when Get had to fetch a file from the network.
+type FileFetched struct {
+	EventMeta
+	Key  string `json:"key"`  // Key passed to Get
+	Size int64  `json:"size"` // Bytes received from the peer
+	From string `json:"from"` // Peer the file was fetched from
+}
+
+// ReplicationFailed is emitted when a file stored locally could not be sent to a peer.
+type ReplicationFailed struct {
+	EventMeta
+	Key   string `json:"key"`   // Key passed to Store
+	Peer  string `json:"peer"`  // Peer the replica was meant for
+	Error string `json:"error"` // What went wrong
+}
+
+// eventBus fans events out to subscribers.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	recent []Event // Last events emitted, oldest first, for RecentEvents
+}
+
+// Subscribe returns a channel receiving every event of the server from now on,
+// and a function that cancels the subscription and closes the channel.
+//
+// Events are delivered without blocking the server: a subscriber that falls
+// more than 64 events behind misses events until it catches up.
+func (s *FileServer) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	s.events.mu.Lock()
+	if s.events.subs == nil {
+		s.events.subs = make(map[chan Event]struct{})
+	}
+	s.events.subs[ch] = struct{}{}
+	s.events.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			delete(s.events.subs, ch)
+			s.events.mu.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+// emit delivers ev to every subscriber that has room for it.
+func (b *eventBus) emit(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recent = append(b.recent, ev)
+	if n := len(b.recent); n > recentEventCount {
+		b.recent = append(b.recent[:0:0], b.recent[n-recentEventCount:]...)
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default: // Subscriber is behind, drop the event
+		}
+	}
+}
+
+// newEventMeta returns the metadata for an event happening now.
+func newEventMeta() EventMeta {
+	return EventMeta{Time: time.Now()}
+}
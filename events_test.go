@@ -0,0 +1,81 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextEvent returns the next event of type T on ch, skipping any others.
+func nextEvent[T Event](t *testing.T, ch <-chan Event) T {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if v, ok := ev.(T); ok {
+				return v
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("timed out waiting for %T", zero)
+			return zero
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41110")
+	s2 := makeServer(t, "127.0.0.1:41111")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ev1, cancel1 := s1.Subscribe()
+	defer cancel1()
+	ev2, cancel2 := s2.Subscribe()
+	defer cancel2()
+
+	assert.Nil(t, s2.Connect("127.0.0.1:41110"))
+	assert.Equal(t, s2.ID, nextEvent[PeerConnected](t, ev1).ID)
+	connected := nextEvent[PeerConnected](t, ev2)
+	assert.Equal(t, s1.ID, connected.ID)
+
+	assert.Nil(t, s2.Store("events.txt", bytes.NewReader([]byte("some data"))))
+	local := nextEvent[FileStored](t, ev2)
+	assert.Equal(t, "events.txt", local.Key)
+	assert.Equal(t, int64(9), local.Size)
+	assert.Empty(t, local.From)
+
+	replica := nextEvent[FileStored](t, ev1)
+	assert.Equal(t, s2.ID, replica.ID)
+	assert.Equal(t, s2.hashKey("events.txt"), replica.Key)
+	assert.NotEmpty(t, replica.From)
+
+	assert.Nil(t, s2.Disconnect(connected.Addr))
+	assert.Equal(t, s2.ID, nextEvent[PeerDisconnected](t, ev1).ID)
+}
+
+func TestEventBus(t *testing.T) {
+	s := &FileServer{}
+	ch, cancel := s.Subscribe()
+
+	// A subscriber that doesn't keep up loses events instead of blocking the server.
+	for i := 0; i < eventBufferSize+10; i++ {
+		s.events.emit(FileStored{EventMeta: newEventMeta(), Key: "key"})
+	}
+	assert.Len(t, ch, eventBufferSize)
+
+	// Cancelling closes the channel once it has been drained.
+	cancel()
+	cancel()
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, eventBufferSize, n)
+}
@@ -0,0 +1,29 @@
+package dfs
+
+import (
+	"io"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// Export writes every object of the local store, replicas of other servers'
+// files included, and its metadata to w as a tar archive, for backups and
+// moving a node. The server keeps serving reads and writes meanwhile.
+func (s *FileServer) Export(w io.Writer) (storage.ArchiveInfo, error) {
+	return s.ExportSince(w, time.Time{})
+}
+
+// ExportSince is Export leaving out the objects last written before since,
+// for incremental backups. Objects deleted since aren't recorded; importing
+// a full export followed by incremental ones brings back every object
+// written in between.
+func (s *FileServer) ExportSince(w io.Writer, since time.Time) (storage.ArchiveInfo, error) {
+	return s.store.Export(w, s.ID, since)
+}
+
+// Import reads an archive written by Export into the local store, replacing
+// objects under the same keys and restoring their tags and modification times.
+func (s *FileServer) Import(r io.Reader) (storage.ArchiveInfo, error) {
+	return s.store.Import(r)
+}
@@ -0,0 +1,105 @@
+package dfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExportServer returns a server on a temporary store that isn't started.
+func newExportServer(t *testing.T) *FileServer {
+	return NewFileServer(FileServerOpts{
+		StorageRoot: t.TempDir(),
+		EncKey:      crypto.NewEncryptionKey(),
+		Hasher:      crypto.SHA256Hasher,
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0"}),
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	src := newExportServer(t)
+	require.NoError(t, src.Store("a.txt", strings.NewReader("first")))
+	require.NoError(t, src.store.SetTags(src.ID, "a.txt", map[string]string{"kind": "text"}))
+	_, err := src.store.Write("peer", "replica", strings.NewReader("someone else's"))
+	require.NoError(t, err)
+
+	var full bytes.Buffer
+	info, err := src.Export(&full)
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.Objects)
+	assert.Equal(t, int64(len("first")+len("someone else's")), info.Bytes)
+
+	// Only what was written after the full export goes into the incremental one
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, src.Store("b.txt", strings.NewReader("second")))
+	var incremental bytes.Buffer
+	info, err = src.ExportSince(&incremental, since)
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Objects)
+
+	dst := newExportServer(t)
+	info, err = dst.Import(&full)
+	require.NoError(t, err)
+	assert.Equal(t, src.ID, info.Node)
+	assert.Equal(t, 2, info.Objects)
+	_, err = dst.Import(&incremental)
+	require.NoError(t, err)
+
+	for _, obj := range []struct{ id, key, data string }{
+		{src.ID, "a.txt", "first"},
+		{src.ID, "b.txt", "second"},
+		{"peer", "replica", "someone else's"},
+	} {
+		_, r, err := dst.store.Read(obj.id, obj.key)
+		require.NoError(t, err)
+		got, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, obj.data, string(got))
+
+		want, _ := src.store.Meta(obj.id, obj.key)
+		meta, _ := dst.store.Meta(obj.id, obj.key)
+		assert.True(t, want.ModTime.Equal(meta.ModTime))
+		assert.Equal(t, want.Tags, meta.Tags)
+	}
+}
+
+func TestImportRejectsForeignArchives(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/passwd", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	_, err := newExportServer(t).Import(&buf)
+	assert.ErrorContains(t, err, "not an export archive")
+}
+
+func TestAdminExportImport(t *testing.T) {
+	src, dst := newExportServer(t), newExportServer(t)
+	require.NoError(t, src.Store("over-http.txt", strings.NewReader("archived")))
+
+	api := httptest.NewServer(src.AdminHandler())
+	defer api.Close()
+	res, err := http.Get(api.URL + "/export?since=" + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+
+	api2 := httptest.NewServer(dst.AdminHandler())
+	defer api2.Close()
+	res2, err := http.Post(api2.URL+"/import", "application/x-tar", res.Body)
+	require.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusOK, res2.StatusCode)
+	assert.True(t, dst.store.Has(src.ID, "over-http.txt"))
+}
@@ -0,0 +1,295 @@
+package dfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// Codes identifying the typed errors in error responses of the admin API, so
+// clients can tell failures apart without parsing messages.
+const (
+	codeKeyNotFound      = "key_not_found"
+	codePeerUnavailable  = "peer_unavailable"
+	codeChecksumMismatch = "checksum_mismatch"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeInvalidKey       = "invalid_key"
+	codeImmutable        = "immutable"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+)
+
+// errorCode returns the code of the typed error err wraps, empty if none.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return codeKeyNotFound
+	case errors.Is(err, ErrPeerUnavailable):
+		return codePeerUnavailable
+	case errors.Is(err, ErrChecksumMismatch):
+		return codeChecksumMismatch
+	case errors.Is(err, ErrQuotaExceeded):
+		return codeQuotaExceeded
+	case errors.Is(err, ErrInvalidKey):
+		return codeInvalidKey
+	case errors.Is(err, ErrImmutable):
+		return codeImmutable
+	case errors.Is(err, ErrUnauthorized):
+		return codeUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return codeForbidden
+	default:
+		return ""
+	}
+}
+
+// handleFiles adds the endpoints storing, fetching and deleting files,
+// fetching them for streaming verification and setting their retention to
+// mux, for clients that use the network without running a node, and the one
+// serving files to the holders of share tokens.
+func (s *FileServer) handleFiles(mux *http.ServeMux) {
+	mux.HandleFunc("PUT /files/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if s.serveMultipart(w, r, key) {
+			return
+		}
+		s.serveStore(w, r, key)
+	})
+
+	mux.HandleFunc("POST /files/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.serveMultipart(w, r, r.PathValue("key")) {
+			writeError(w, http.StatusBadRequest, errors.New("POST starts or completes multipart uploads, with ?uploads or ?uploadId="))
+		}
+	})
+
+	mux.HandleFunc("GET /files/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		s.serveFile(w, r, r.PathValue("key"), "")
+	})
+
+	mux.HandleFunc("GET /bao/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		s.serveBao(w, r, r.PathValue("key"))
+	})
+
+	mux.HandleFunc("GET /share/{token}", func(w http.ResponseWriter, r *http.Request) {
+		key, err := s.verifyShareToken(r.PathValue("token"), time.Now())
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		s.serveFile(w, r, key, "attachment")
+	})
+
+	mux.HandleFunc("DELETE /files/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		if s.serveMultipart(w, r, r.PathValue("key")) {
+			return
+		}
+		if err := s.DeleteContext(r.Context(), r.PathValue("key")); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /retention/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		var retention storage.Retention
+		if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.SetRetention(r.PathValue("key"), retention); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// serveStore stores the body of r under key, described by its headers.
+func (s *FileServer) serveStore(w http.ResponseWriter, r *http.Request, key string) {
+	var body io.Reader = r.Body
+	if r.ContentLength >= 0 {
+		body = &exactReader{r: r.Body, left: r.ContentLength} // Gateways need the size up front
+	}
+	m, err := contentOf(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.StoreWithContent(r.Context(), key, body, m); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveFile answers r with the file stored under key, described by its
+// manifest. Files are served as attachments if disposition says so, named
+// after their manifest or else their key. Range requests are answered with
+// just the ranges asked for, so players and archive readers can seek; files
+// held by peers only are asked from them for just those ranges. The checksum
+// of the file is its ETag, so conditional requests are answered without the
+// file when it hasn't changed.
+func (s *FileServer) serveFile(w http.ResponseWriter, r *http.Request, key string, disposition string) {
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	if r.Header.Get("Range") != "" && !s.store.Has(s.ID, key) {
+		f, err = s.openRangeFile(r.Context(), key)
+	} else {
+		f, err = s.GetContext(r.Context(), key)
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	defer f.Close()
+
+	var m storage.ContentManifest
+	meta, err := s.Stat(key)
+	if err == nil && meta.Content != nil {
+		m = *meta.Content // Files fetched through gateways have none
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	if m.ContentType != "" {
+		h.Set("Content-Type", m.ContentType)
+	}
+	filename := m.Filename
+	if filename == "" && disposition == "attachment" {
+		filename = path.Base(key)
+	}
+	if filename != "" {
+		if disposition == "" {
+			disposition = "inline"
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	}
+	for k, v := range m.Metadata {
+		h.Set(metaHeaderPrefix+k, v)
+	}
+	if m.Checksum != "" {
+		h.Set("X-Dfs-Checksum-Sha256", m.Checksum)
+		h.Set("Etag", strconv.Quote(m.Checksum))
+	}
+	if m.Encryption != "" {
+		h.Set("X-Dfs-Encryption", m.Encryption)
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", meta.ModTime, rs)
+		return
+	}
+	if size := sizeOf(f); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("[%s] serving (%s) failed: %s", s.Transport.Addr(), key, err) // Too late for an error response
+	}
+}
+
+// rangeFile reads a file held by peers through range requests, asking for
+// the rest of the file from wherever it was seeked to, so serving a range of
+// the file doesn't fetch all of it first.
+type rangeFile struct {
+	s    *FileServer
+	ctx  context.Context // Context the ranges are fetched with
+	key  string
+	size int64         // Size of the whole file
+	off  int64         // Offset Read continues at
+	r    io.ReadCloser // Range being read from off, nil until the next Read
+}
+
+// openRangeFile returns a rangeFile reading the file stored under key for
+// the principal of ctx.
+func (s *FileServer) openRangeFile(ctx context.Context, key string) (*rangeFile, error) {
+	r, size, err := s.getRange(ctx, key, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	return &rangeFile{s: s, ctx: ctx, key: key, size: size}, nil
+}
+
+func (f *rangeFile) Read(b []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if f.r == nil {
+		r, _, err := f.s.getRange(f.ctx, f.key, f.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+	}
+	n, err := f.r.Read(b)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *rangeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != f.off && f.r != nil {
+		f.r.Close() // The next Read asks for the range at offset
+		f.r = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *rangeFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.Close()
+}
+
+// metaHeaderPrefix prefixes the headers carrying the user metadata of files.
+const metaHeaderPrefix = "X-Dfs-Meta-"
+
+// contentOf returns the description of a file stored with headers h: its
+// Content-Type, the filename of its Content-Disposition and the metadata of
+// its X-Dfs-Meta-* headers, keyed by the lowercased rest of their names.
+func contentOf(h http.Header) (storage.ContentManifest, error) {
+	var m storage.ContentManifest
+	if ct := h.Get("Content-Type"); ct != "" {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return m, fmt.Errorf("invalid Content-Type: %w", err)
+		}
+		m.ContentType = ct
+	}
+	if cd := h.Get("Content-Disposition"); cd != "" {
+		_, params, err := mime.ParseMediaType(cd)
+		if err != nil {
+			return m, fmt.Errorf("invalid Content-Disposition: %w", err)
+		}
+		m.Filename = params["filename"]
+	}
+	for name, values := range h {
+		if k, ok := strings.CutPrefix(name, metaHeaderPrefix); ok && k != "" {
+			if m.Metadata == nil {
+				m.Metadata = make(map[string]string)
+			}
+			m.Metadata[strings.ToLower(k)] = values[0]
+		}
+	}
+	return m, nil
+}
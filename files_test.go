@@ -0,0 +1,76 @@
+package dfs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesAPI(t *testing.T) {
+	s := newExportServer(t)
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, api.URL+"/files/dir/a.txt", strings.NewReader("contents"))
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, err = http.Get(api.URL + "/files/dir/a.txt")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(len("contents")), res.ContentLength)
+	assert.Equal(t, "contents", string(b))
+
+	// Ranges are served on their own, for players and archive readers.
+	req, _ = http.NewRequest(http.MethodGet, api.URL+"/files/dir/a.txt", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	b, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, "bytes 3-5/8", res.Header.Get("Content-Range"))
+	assert.Equal(t, "ten", string(b))
+
+	// Unchanged files aren't sent again.
+	etag, modified := res.Header.Get("Etag"), res.Header.Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, modified)
+	for header, value := range map[string]string{"If-None-Match": etag, "If-Modified-Since": modified} {
+		req, _ = http.NewRequest(http.MethodGet, api.URL+"/files/dir/a.txt", nil)
+		req.Header.Set(header, value)
+		res, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotModified, res.StatusCode, header)
+	}
+	req, _ = http.NewRequest(http.MethodGet, api.URL+"/files/dir/a.txt", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodDelete, api.URL+"/files/dir/a.txt", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	// Typed errors come with their code.
+	res, err = http.Get(api.URL + "/files/dir/a.txt")
+	require.NoError(t, err)
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, codeKeyNotFound, body["code"])
+}
@@ -0,0 +1,44 @@
+package dfs
+
+import "sync"
+
+// flightGroup coalesces the calls made for the same key at the same time, so
+// a file missing locally is fetched from the network once however many
+// goroutines ask for it, and written to disk once.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight // Calls in progress by key
+}
+
+// flight is a call in progress, closing done once it returned err.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do calls fn unless a call for key is in progress already, in which case it
+// waits for that call to return instead. It returns the error of the call and
+// whether it was made by another caller.
+func (g *flightGroup) do(key string, fn func() error) (shared bool, err error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.err = fn()
+	return false, f.err
+}
@@ -0,0 +1,100 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var (
+		g       flightGroup
+		calls   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+		shared  atomic.Int32
+	)
+	errFetch := errors.New("fetch failed")
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := g.do("key", func() error {
+				calls.Add(1)
+				<-release
+				return errFetch
+			})
+			assert.ErrorIs(t, err, errFetch)
+			if s {
+				shared.Add(1)
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // Let the others join the call
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(9), shared.Load())
+
+	// Calls made after the call returned aren't shared.
+	s, err := g.do("key", func() error { return nil })
+	assert.False(t, s)
+	assert.NoError(t, err)
+	assert.Empty(t, g.flights)
+}
+
+func TestGetMissStorm(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41327")
+	s2 := makeServer(t, "127.0.0.1:41328", "127.0.0.1:41327")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	data := bytes.Repeat([]byte("fetched once "), 4096)
+	require.NoError(t, s2.Store("storm.txt", bytes.NewReader(data)))
+	require.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("storm.txt")) }, time.Second, 10*time.Millisecond)
+	require.NoError(t, s2.store.Delete(s2.ID, "storm.txt"))
+
+	events, cancel := s2.Subscribe()
+	defer cancel()
+
+	// Every Get finds the file missing, but only one fetches it.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s2.Get("storm.txt")
+			if !assert.NoError(t, err) {
+				return
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, data, got)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, "storm.txt", nextEvent[FileFetched](t, events).Key)
+	for {
+		select {
+		case ev := <-events:
+			_, fetched := ev.(FileFetched)
+			assert.False(t, fetched, "file fetched twice")
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
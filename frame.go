@@ -0,0 +1,52 @@
+package dfs
+
+import (
+	"fmt"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// errUnknownFrame refuses replicas framed in a way the server can't read.
+var errUnknownFrame = fmt.Errorf("%w: unknown replica framing", ErrPermissionDenied)
+
+// ReplicaFrame describes the stream of an encrypted replica, sent after the
+// MessageStoreFile announcing it and stored as it is: the IV, then the
+// ciphertext of the file. Receivers read exactly Size bytes of it.
+type ReplicaFrame struct {
+	Cipher string // Cipher of the ciphertext, crypto.CipherAESCTR
+	IVSize int    // Bytes of IV the stream starts with
+	Length int64  // Bytes of ciphertext following the IV, as many as the file has
+
+	// Chunked tells the stream is sent in chunks by a crcWriter, which
+	// take more than Size bytes on the wire.
+	Chunked bool
+}
+
+// newReplicaFrame returns the frame crypto.CopyEncrypt writes a file of length
+// bytes in.
+func newReplicaFrame(length int64) *ReplicaFrame {
+	return &ReplicaFrame{Cipher: crypto.CipherAESCTR, IVSize: crypto.IVSize, Length: length}
+}
+
+// replicaFrameOf returns the frame of a replica taking size bytes, IV
+// included.
+func replicaFrameOf(size int64) *ReplicaFrame {
+	return newReplicaFrame(size - crypto.IVSize)
+}
+
+// Size returns the bytes of the stream, IV included.
+func (f *ReplicaFrame) Size() int64 {
+	return int64(f.IVSize) + f.Length
+}
+
+// check returns an error if the stream can't be read with crypto.CopyDecrypt, or
+// doesn't take size bytes.
+func (f *ReplicaFrame) check(size int64) error {
+	if f.Cipher != crypto.CipherAESCTR || f.IVSize != crypto.IVSize || f.Length < 0 {
+		return fmt.Errorf("%w: %s with a %d byte IV", errUnknownFrame, f.Cipher, f.IVSize)
+	}
+	if f.Size() != size {
+		return fmt.Errorf("%w: a %d byte stream announced as %d bytes", errUnknownFrame, f.Size(), size)
+	}
+	return nil
+}
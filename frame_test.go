@@ -0,0 +1,45 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// TestReplicaFrame tests that frames describe the stream crypto.CopyEncrypt writes,
+// and that streams framed otherwise are refused.
+func TestReplicaFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("framed"), 100)
+	encrypted := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(crypto.NewEncryptionKey(), bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := newReplicaFrame(int64(len(payload)))
+	if frame.Size() != int64(encrypted.Len()) {
+		t.Errorf("frame of %d bytes for a %d byte stream", frame.Size(), encrypted.Len())
+	}
+	if *replicaFrameOf(int64(encrypted.Len())) != *frame {
+		t.Errorf("frame of the stored replica %+v, want %+v", replicaFrameOf(int64(encrypted.Len())), frame)
+	}
+
+	for _, msg := range []MessageStoreFile{
+		{Size: frame.Size(), Frame: frame},
+		{Size: frame.Size()}, // Older servers don't frame their streams
+	} {
+		if err := msg.checkFrame(); err != nil {
+			t.Errorf("%+v refused: %s", msg.Frame, err)
+		}
+	}
+	for _, msg := range []MessageStoreFile{
+		{Size: frame.Size() + 1, Frame: frame},
+		{Size: frame.Size(), Frame: &ReplicaFrame{Cipher: "chacha20", IVSize: crypto.IVSize, Length: frame.Length}},
+		{Size: frame.Size(), Frame: &ReplicaFrame{Cipher: crypto.CipherAESCTR, IVSize: 12, Length: frame.Length + 4}},
+	} {
+		if err := msg.checkFrame(); !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("%+v of %d bytes accepted: %v", msg.Frame, msg.Size, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package dfs
+
+import "github.com/inagib21/DistributedFileStorageGo/storage"
+
+// Fsck checks the local store of the server against its index, see
+// storage.Store.Fsck.
+func (s *FileServer) Fsck(repair bool) (storage.FsckReport, error) {
+	return s.store.Fsck(repair)
+}
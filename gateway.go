@@ -0,0 +1,175 @@
+package dfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// ErrSizeRequired is returned by gateways for files whose size isn't known up
+// front, which they can't announce to the peers they stream the file to.
+var ErrSizeRequired = errors.New("size of the file must be known up front")
+
+// errGatewayReplica refuses the replicas peers send to a gateway.
+var errGatewayReplica = fmt.Errorf("%w: gateways don't keep replicas", ErrStorageFull)
+
+// storeThrough streams the file under key to the peers it is placed on
+// without keeping a copy, for gateways. The file is encrypted once as it is
+// read and sent to every peer at the same time, at the pace of the slowest;
+// peers failing drop out without holding up the others. It fails unless at
+// least one peer stored the file.
+func (s *FileServer) storeThrough(ctx context.Context, key string, r io.Reader, progress *progressTracker) error {
+	size := sizeOf(r)
+	if size < 0 {
+		return fmt.Errorf("%w: (%s)", ErrSizeRequired, key)
+	}
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return fmt.Errorf("%w: (%s) has %d bytes", ErrFileTooLarge, key, size)
+	}
+	if err := s.newObjectKey(key); err != nil {
+		return err
+	}
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.wakeIdle() // Peers closed for being idle may be meant to get the file
+	sendTo, _ := s.replicaPeers(key, size)
+	if len(sendTo) == 0 {
+		return fmt.Errorf("%w: no peer to store (%s) on", ErrPeerUnavailable, key)
+	}
+
+	frame := newReplicaFrame(size)
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:        s.ID,
+			Key:       s.hashKey(key),
+			Size:      frame.Size(),
+			Frame:     frame,
+			Tenant:    tenantFrom(ctx),
+			Principal: principalFrom(ctx),
+		},
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		replicas []string
+		errs     []error
+		pipes    []*io.PipeWriter
+	)
+	for _, peer := range sendTo {
+		addr := peer.RemoteAddr().String()
+		progress.addPeer(addr, frame.Size())
+
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+
+			ctx, span := s.startPeerSpan(ctx, "dfs.replicate", peer)
+			err := s.sendObject(peer, s.withTrace(ctx, &msg), func(w io.Writer) (int64, error) {
+				return io.Copy(progress.writer(w, addr), pr)
+			})
+			pr.CloseWithError(err) // Stop the file being written to this peer
+			endSpan(span, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				var respErr *ResponseError
+				if !errors.As(err, &respErr) {
+					err = fmt.Errorf("%w: %w", ErrPeerUnavailable, err)
+				}
+				errs = append(errs, err)
+				progress.fail(addr, err)
+				s.throughFailed(key, peer, err)
+				return
+			}
+			replicas = append(replicas, peer.ID())
+			s.audit(AuditReplicaSent, s.ID, msg.Payload.(MessageStoreFile).Key, frame.Size(), addr, nil)
+		}(peer)
+	}
+
+	fan := &fanout{}
+	for _, pw := range pipes {
+		fan.ws = append(fan.ws, pw)
+	}
+	_, err = crypto.CopyEncrypt(objectKey, progress.reader(&exactReader{r: r, left: size}, ""), fan)
+	for _, pw := range pipes {
+		pw.CloseWithError(err) // Peers still reading get the end of the file, or the error
+	}
+	wg.Wait()
+
+	if err == nil && len(replicas) == 0 || errors.Is(err, errFanoutDone) {
+		err = fmt.Errorf("no peer stored (%s): %w", key, errors.Join(errs...))
+	}
+	s.audit(AuditStore, s.ID, s.hashKey(key), size, "", err)
+	if err != nil {
+		return err
+	}
+
+	s.events.emit(FileStored{EventMeta: newEventMeta(), ID: s.ID, Key: key, Size: size})
+	s.keyChanged(KeyStored, key, size)
+	s.recordStored(key, size, replicas)
+	return nil
+}
+
+// throughFailed reports that the file under key couldn't be streamed to peer.
+// Unlike replicationFailed it leaves no hint, there being no copy to hand off.
+func (s *FileServer) throughFailed(key string, peer p2p.Peer, err error) {
+	log.Printf("[%s] streaming (%s) to (%s) failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+	s.audit(AuditReplicationFailed, s.ID, s.hashKey(key), 0, peer.RemoteAddr().String(), err)
+	s.events.emit(ReplicationFailed{EventMeta: newEventMeta(), Key: key, Peer: peer.RemoteAddr().String(), Error: err.Error()})
+}
+
+// errFanoutDone is returned by a fanout once every writer failed.
+var errFanoutDone = errors.New("every writer failed")
+
+// fanout writes to every writer in ws, dropping the ones that fail. It fails
+// with errFanoutDone once none is left.
+type fanout struct {
+	ws []io.Writer
+}
+
+func (f *fanout) Write(b []byte) (int, error) {
+	left := 0
+	for i, w := range f.ws {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(b); err != nil {
+			f.ws[i] = nil
+			continue
+		}
+		left++
+	}
+	if left == 0 {
+		return 0, errFanoutDone
+	}
+	return len(b), nil
+}
+
+// deleteThrough asks the peers to delete the file under key, for gateways,
+// which don't hold it. Whether any of them did can't be told.
+func (s *FileServer) deleteThrough(ctx context.Context, key string) error {
+	err := s.deleteReplicas(ctx, key)
+	s.audit(AuditDelete, s.ID, s.hashKey(key), 0, "", err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPeerUnavailable, err)
+	}
+
+	s.forgetObjectKey(key)
+	s.recordDeleted(key)
+	s.keyChanged(KeyDeleted, key, 0)
+	return nil
+}
@@ -0,0 +1,60 @@
+package dfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGateway(t *testing.T) {
+	g := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41308", StorageRoot: t.TempDir(), Gateway: true})
+	s1 := makeServer(t, "127.0.0.1:41309", "127.0.0.1:41308")
+	s2 := makeServer(t, "127.0.0.1:41310", "127.0.0.1:41308")
+	for _, s := range []*FileServer{g, s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(g.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	api := httptest.NewServer(g.AdminHandler())
+	defer api.Close()
+
+	// Uploads go straight to the storage nodes.
+	req, _ := http.NewRequest(http.MethodPut, api.URL+"/files/a.txt", strings.NewReader("through the gateway"))
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.False(t, g.store.Has(g.ID, "a.txt"))
+	assert.True(t, s1.store.Has(g.ID, g.hashKey("a.txt")))
+	assert.True(t, s2.store.Has(g.ID, g.hashKey("a.txt")))
+
+	// Files of unknown size can't be announced.
+	err = g.Store("b.txt", io.MultiReader(strings.NewReader("unknown size")))
+	assert.ErrorIs(t, err, ErrSizeRequired)
+
+	// The gateway keeps no replicas of its peers' files.
+	require.NoError(t, s1.Store("c.txt", strings.NewReader("not for the gateway")))
+	assert.False(t, g.store.Has(s1.ID, s1.hashKey("c.txt")))
+
+	// Files are deleted from the peers holding them.
+	require.NoError(t, g.Delete("a.txt"))
+	require.Eventually(t, func() bool {
+		return !s1.store.Has(g.ID, g.hashKey("a.txt")) && !s2.store.Has(g.ID, g.hashKey("a.txt"))
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// And fetched from them.
+	require.NoError(t, g.Store("d.txt", strings.NewReader("fetched back")))
+	r, err := g.Get("d.txt")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "fetched back", string(b))
+}
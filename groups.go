@@ -0,0 +1,344 @@
+package dfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// groupsFileName is the name of the file the keys of the groups this server
+// is a member of are kept in, inside the storage root.
+const groupsFileName = "groups.json"
+
+// groupNamespacePrefix starts the namespaces the files of key groups are
+// stored in, see groupNamespace.
+const groupNamespacePrefix = "group-"
+
+var (
+	// ErrGroupExists is returned when creating or joining a group this server
+	// already is a member of.
+	ErrGroupExists = errors.New("group already exists")
+	// ErrNotGroupMember is returned for groups this server has no key of.
+	ErrNotGroupMember = errors.New("not a member of the group")
+)
+
+// MessageGroupKey hands the key of a group to a new member, wrapped for the
+// member's public key.
+type MessageGroupKey struct {
+	Group      string // Name of the group
+	Ephemeral  []byte // Ephemeral X25519 public key used to wrap the group key
+	WrappedKey []byte // Group key, sealed for the member
+}
+
+// keyRing holds the keys of the groups a server is a member of, persisted
+// sealed with a key derived from the server's encryption key, or wrapped by
+// its KMS if it has one.
+type keyRing struct {
+	path string
+	kek  []byte // Key the group keys are sealed with on disk
+	kms  KMS    // KMS wrapping the group keys on disk instead, nil if none
+
+	mu   sync.Mutex
+	keys map[string][]byte // Group name → group key
+}
+
+// sealedGroupKey is a group key as persisted.
+type sealedGroupKey struct {
+	Group string `json:"group"`
+	Key   []byte `json:"key"`           // Group key sealed with the kek of the ring
+	KMS   bool   `json:"kms,omitempty"` // Whether Key is wrapped by the KMS instead
+}
+
+// loadKeyRing reads the group keys persisted at path. A missing file yields
+// no groups. With kms set, keys sealed with kek are wrapped by it instead,
+// and the ring persisted again.
+func loadKeyRing(path string, kek []byte, kms KMS) (*keyRing, error) {
+	ring := &keyRing{path: path, kek: kek, kms: kms, keys: make(map[string][]byte)}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ring, nil
+	}
+	if err != nil {
+		return ring, err
+	}
+
+	var sealed []sealedGroupKey
+	if err := json.Unmarshal(buf, &sealed); err != nil {
+		return ring, err
+	}
+	resave := false
+	for _, g := range sealed {
+		var key []byte
+		switch {
+		case g.KMS && kms == nil:
+			return ring, fmt.Errorf("the key of group %q is wrapped by a KMS, but none is set", g.Group)
+		case g.KMS:
+			key, err = kmsDecrypt(kms, g.Key)
+		default:
+			key, err = crypto.OpenKey(kek, g.Key)
+			resave = resave || kms != nil
+		}
+		if err != nil {
+			return ring, fmt.Errorf("opening the key of group %q: %w", g.Group, err)
+		}
+		ring.keys[g.Group] = key
+	}
+	if resave {
+		ring.mu.Lock()
+		defer ring.mu.Unlock()
+		return ring, ring.save()
+	}
+	return ring, nil
+}
+
+// get returns the key of group.
+func (r *keyRing) get(group string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.keys[group]
+	return key, ok
+}
+
+// add adds the key of a group that isn't in the ring yet and persists the ring.
+func (r *keyRing) add(group string, key []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[group]; ok {
+		return fmt.Errorf("%w: %q", ErrGroupExists, group)
+	}
+	r.keys[group] = key
+	if err := r.save(); err != nil {
+		delete(r.keys, group)
+		return err
+	}
+	return nil
+}
+
+// names returns the names of the groups in the ring, sorted.
+func (r *keyRing) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.keys))
+	for name := range r.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save persists the ring. The caller must hold r.mu.
+func (r *keyRing) save() error {
+	sealed := make([]sealedGroupKey, 0, len(r.keys))
+	for group, key := range r.keys {
+		if r.kms != nil {
+			buf, err := kmsEncrypt(r.kms, key)
+			if err != nil {
+				return err
+			}
+			sealed = append(sealed, sealedGroupKey{Group: group, Key: buf, KMS: true})
+			continue
+		}
+		buf, err := crypto.SealKey(r.kek, key)
+		if err != nil {
+			return err
+		}
+		sealed = append(sealed, sealedGroupKey{Group: group, Key: buf})
+	}
+
+	buf, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// CreateGroup creates a key group with this server as its only member. Files
+// stored in a group are encrypted with the group's key, which only its
+// members hold; add members with AddGroupMember.
+func (s *FileServer) CreateGroup(name string) error {
+	if len(name) == 0 {
+		return errors.New("group name must not be empty")
+	}
+	return s.groups.add(name, crypto.NewEncryptionKey())
+}
+
+// Groups returns the names of the groups this server is a member of.
+func (s *FileServer) Groups() []string {
+	return s.groups.names()
+}
+
+// AddGroupMember sends the key of group, wrapped for pub, to the connected
+// peer with the given ID, making it a member. Members can't be removed: a
+// peer that held the key can read the files stored with it.
+func (s *FileServer) AddGroupMember(group string, peerID string, pub *ecdh.PublicKey) error {
+	key, ok := s.groups.get(group)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotGroupMember, group)
+	}
+
+	s.peerLock.Lock()
+	peer := s.peerByID(peerID)
+	s.peerLock.Unlock()
+	if peer == nil {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, peerID)
+	}
+
+	ephemeral, wrapped, err := crypto.WrapKey(pub, key)
+	if err != nil {
+		return err
+	}
+	return s.broadcastTo([]p2p.Peer{peer}, &Message{
+		Payload: MessageGroupKey{Group: group, Ephemeral: ephemeral, WrappedKey: wrapped},
+	})
+}
+
+// handleMessageGroupKey joins the group whose key a member sent.
+func (s *FileServer) handleMessageGroupKey(rpc p2p.RPC, msg MessageGroupKey) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	key, err := crypto.UnwrapKey(s.IdentityKey, msg.Ephemeral, msg.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("key of group %q was not wrapped for this server: %w", msg.Group, err)
+	}
+	if err := s.groups.add(msg.Group, key); err != nil {
+		return err // Keys of groups already joined aren't replaced
+	}
+	log.Printf("[%s] joined group %q through (%s)", s.Transport.Addr(), msg.Group, rpc.From)
+	return nil
+}
+
+// groupNamespace returns the namespace the files of group are stored in on
+// every server, in place of the ID of the server that stored them, so any
+// member can fetch them.
+func (s *FileServer) groupNamespace(group string, groupKey []byte) string {
+	return groupNamespacePrefix + s.groupToken(groupKey, "group:"+group)
+}
+
+// groupToken returns the lookup token of key in the group with groupKey.
+// Tokens are keyed with a secret derived from the group key, so every member
+// derives the same ones, having been handed the key on joining, while peers
+// that aren't members can't recover keys from them.
+func (s *FileServer) groupToken(groupKey []byte, key string) string {
+	return s.Hasher.Token(crypto.DeriveSubkey(groupKey, "lookup"), []byte(key))
+}
+
+// StoreInGroup stores the contents of r under key in group. The file is
+// encrypted with a key derived from the group key and replicated to every
+// peer, members or not; only members can read it, with GetFromGroup.
+func (s *FileServer) StoreInGroup(group string, key string, r io.Reader) error {
+	groupKey, ok := s.groups.get(group)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotGroupMember, group)
+	}
+	ns, hash := s.groupNamespace(group, groupKey), s.groupToken(groupKey, key)
+
+	sp, err := encryptSpool(crypto.DeriveKey(groupKey, key), r)
+	if err != nil {
+		return err
+	}
+	defer sp.close()
+
+	// The file is kept encrypted like the replicas peers hold
+	if _, err := s.store.Write(ns, hash, sp.reader()); err != nil {
+		return err
+	}
+
+	msg := Message{Payload: MessageStoreFile{ID: ns, Key: hash, Size: sp.size, Frame: sp.frame()}}
+	var wg sync.WaitGroup
+	for _, peer := range s.peerList() {
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+			if err := s.replicate(context.Background(), peer, key, &msg, sp, nil); err != nil {
+				log.Printf("[%s] sending (%s) of group %q to (%s) failed: %s", s.Transport.Addr(), key, group, peer.RemoteAddr(), err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return nil
+}
+
+// GetFromGroup returns the contents of the file stored under key in group,
+// fetching it from the network unless it is held locally. The returned reader
+// should be closed.
+func (s *FileServer) GetFromGroup(group string, key string) (io.ReadCloser, error) {
+	groupKey, ok := s.groups.get(group)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotGroupMember, group)
+	}
+	ns, hash := s.groupNamespace(group, groupKey), s.groupToken(groupKey, key)
+
+	if !s.store.Has(ns, hash) {
+		req := MessageGetFile{ID: ns, Key: hash}
+		if _, _, err := s.fetch(req, nil, func(r io.Reader, _ int64, _ string) (int64, error) {
+			return s.store.Write(ns, hash, r)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	_, r, err := s.store.Read(ns, hash)
+	if err != nil {
+		return nil, err
+	}
+	return decryptReader(crypto.DeriveKey(groupKey, key), r)
+}
+
+// DeleteFromGroup deletes the file stored under key in group, locally and on
+// every peer.
+func (s *FileServer) DeleteFromGroup(group string, key string) error {
+	groupKey, ok := s.groups.get(group)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotGroupMember, group)
+	}
+	ns, hash := s.groupNamespace(group, groupKey), s.groupToken(groupKey, key)
+
+	if s.store.Has(ns, hash) {
+		if err := s.store.Delete(ns, hash); err != nil {
+			return err
+		}
+	}
+	return s.broadcast(&Message{Payload: MessageDeleteFile{ID: ns, Key: hash}})
+}
+
+// decryptReader returns a reader of the plaintext of the file encrypted with
+// key that r reads, closing r when closed.
+func decryptReader(key []byte, r io.ReadCloser) (io.ReadCloser, error) {
+	iv := make([]byte, crypto.IVSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		r.Close()
+		return nil, err
+	}
+	ctr, err := crypto.NewCTRAt(key, iv, 0)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return &streamReadCloser{Reader: cipher.StreamReader{S: ctr, R: r}, Closer: r}, nil
+}
@@ -0,0 +1,69 @@
+package dfs
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyGroups(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41311")
+	s2 := makeServer(t, "127.0.0.1:41312", "127.0.0.1:41311")
+	s3 := makeServer(t, "127.0.0.1:41313", "127.0.0.1:41311")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s1.CreateGroup("research"))
+	assert.ErrorIs(t, s1.CreateGroup("research"), ErrGroupExists)
+	require.NoError(t, s1.AddGroupMember("research", s2.ID, s2.PublicKey()))
+	require.Eventually(t, func() bool { return len(s2.Groups()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"research"}, s2.Groups())
+	assert.ErrorIs(t, s1.AddGroupMember("research", "nobody", s3.PublicKey()), ErrPeerNotFound)
+
+	require.NoError(t, s1.StoreInGroup("research", "data.csv", strings.NewReader("private dataset")))
+
+	// Members read the file, the replica held by others is of no use to them.
+	r, err := s2.GetFromGroup("research", "data.csv")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "private dataset", string(got))
+
+	// Others hold the replica under a token only members can derive.
+	groupKey, _ := s1.groups.get("research")
+	ns, hash := s1.groupNamespace("research", groupKey), s1.groupToken(groupKey, "data.csv")
+	assert.True(t, s3.store.Has(ns, hash))
+	assert.NotEqual(t, crypto.SHA256Hasher.Sum([]byte("data.csv")), hash)
+	_, err = s3.GetFromGroup("research", "data.csv")
+	assert.ErrorIs(t, err, ErrNotGroupMember)
+
+	// Every member stores in the group.
+	require.NoError(t, s2.StoreInGroup("research", "notes.txt", strings.NewReader("from a member")))
+	r, err = s1.GetFromGroup("research", "notes.txt")
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "from a member", string(got))
+
+	require.NoError(t, s1.DeleteFromGroup("research", "data.csv"))
+	require.Eventually(t, func() bool { return !s3.store.Has(ns, hash) }, 2*time.Second, 10*time.Millisecond)
+
+	// Group keys survive restarts, sealed with the encryption key.
+	ring, err := loadKeyRing(filepath.Join(s2.StorageRoot, groupsFileName), crypto.DeriveSubkey(s2.EncKey, "groups"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"research"}, ring.names())
+	_, err = loadKeyRing(filepath.Join(s2.StorageRoot, groupsFileName), crypto.DeriveSubkey(crypto.NewEncryptionKey(), "groups"), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,22 @@
+package dfs
+
+import (
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashKey(t *testing.T) {
+	s1 := NewFileServer(FileServerOpts{EncKey: crypto.NewEncryptionKey(), Hasher: crypto.SHA256Hasher, StorageRoot: t.TempDir()})
+	s2 := NewFileServer(FileServerOpts{EncKey: crypto.NewEncryptionKey(), Hasher: crypto.SHA256Hasher, StorageRoot: t.TempDir()})
+
+	// Keys can't be recovered from their tokens by hashing guesses of them,
+	token := s1.hashKey("key")
+	assert.Len(t, token, 64)
+	assert.NotEqual(t, crypto.SHA256Hasher.Sum([]byte("key")), token)
+	assert.Equal(t, token, s1.hashKey("key"))
+	// and differ from server to server.
+	assert.NotEqual(t, s2.hashKey("key"), token)
+	assert.Equal(t, crypto.SHA256Hasher.Token(crypto.DeriveSubkey(s1.EncKey, "lookup"), []byte("key")), token)
+}
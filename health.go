@@ -0,0 +1,129 @@
+package dfs
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// HealthCheck is the outcome of a single check made by Health.
+type HealthCheck struct {
+	Name   string `json:"name"`             // listener, peers, disk, index or meta
+	OK     bool   `json:"ok"`               // Whether the check passed
+	Detail string `json:"detail,omitempty"` // What was found, or why the check failed
+}
+
+// Health describes whether a server is alive and ready to serve requests.
+type Health struct {
+	Live   bool          `json:"live"`   // The server is listening for peers
+	Ready  bool          `json:"ready"`  // Every check passed
+	Checks []HealthCheck `json:"checks"` // The checks made
+}
+
+// Health checks the server: whether its transport is listening, it is
+// connected to a peer (when it has bootstrap nodes to connect to), its
+// storage root is writable, its metadata index is persisted and, if it runs
+// the metadata service, whether the service has a leader.
+func (s *FileServer) Health() Health {
+	checks := []HealthCheck{
+		s.checkListener(),
+		s.checkPeers(),
+		s.checkDisk(),
+		s.checkIndex(),
+	}
+	if s.Meta != nil {
+		checks = append(checks, s.checkMeta())
+	}
+
+	h := Health{Live: checks[0].OK, Ready: true, Checks: checks}
+	for _, c := range checks {
+		h.Ready = h.Ready && c.OK
+	}
+	return h
+}
+
+// checkListener checks that the server was started and isn't stopped.
+func (s *FileServer) checkListener() HealthCheck {
+	if !s.running.Load() {
+		return HealthCheck{Name: "listener", Detail: "not listening"}
+	}
+	return HealthCheck{Name: "listener", OK: true, Detail: s.Transport.Addr()}
+}
+
+// checkPeers checks that the server is connected to a peer. Servers without
+// bootstrap nodes may be the first node of a network and pass without one.
+func (s *FileServer) checkPeers() HealthCheck {
+	n := len(s.peerList())
+	return HealthCheck{
+		Name:   "peers",
+		OK:     n > 0 || len(s.BootstrapNodes) == 0,
+		Detail: fmt.Sprintf("%d connected", n),
+	}
+}
+
+// checkDisk checks that files can be written to the storage root. The probe
+// is named like the temporary files of writes, so a crash leaves nothing
+// behind that the store doesn't clean up.
+func (s *FileServer) checkDisk() HealthCheck {
+	err := func() error {
+		if err := os.MkdirAll(s.StorageRoot, os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(s.StorageRoot, "health.*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write([]byte("ok"))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}()
+	if err != nil {
+		return HealthCheck{Name: "disk", Detail: err.Error()}
+	}
+	return HealthCheck{Name: "disk", OK: true}
+}
+
+// checkIndex checks that the metadata index was loaded and last persisted fine.
+func (s *FileServer) checkIndex() HealthCheck {
+	if err := s.store.Health(); err != nil {
+		return HealthCheck{Name: "index", Detail: err.Error()}
+	}
+	return HealthCheck{Name: "index", OK: true, Detail: fmt.Sprintf("%d objects", s.store.Len())}
+}
+
+// checkMeta checks that the metadata service is running and has a leader.
+func (s *FileServer) checkMeta() HealthCheck {
+	if s.meta.Load() == nil {
+		return HealthCheck{Name: "meta", Detail: "not running"}
+	}
+	leader := s.MetaLeader()
+	if len(leader) == 0 {
+		return HealthCheck{Name: "meta", Detail: "no leader"}
+	}
+	return HealthCheck{Name: "meta", OK: true, Detail: "leader " + leader}
+}
+
+// handleHealth adds the health endpoints to mux. They answer 503 Service
+// Unavailable when the server isn't alive or ready respectively.
+func (s *FileServer) handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+		code := http.StatusOK
+		if !h.Live {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		h := s.Health()
+		code := http.StatusOK
+		if !h.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+}
@@ -0,0 +1,101 @@
+package dfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// healthOf fetches path from api, returning the status code and the health reported.
+func healthOf(t *testing.T, api *httptest.Server, path string) (int, Health) {
+	t.Helper()
+	res, err := http.Get(api.URL + path)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var h Health
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&h))
+	return res.StatusCode, h
+}
+
+// check returns the check called name.
+func check(h Health, name string) HealthCheck {
+	for _, c := range h.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return HealthCheck{}
+}
+
+func TestHealth(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41293")
+	s2 := makeServer(t, "127.0.0.1:41294", "127.0.0.1:41293")
+
+	api := httptest.NewServer(s2.AdminHandler())
+	defer api.Close()
+
+	// Not started yet: neither alive nor ready.
+	code, h := healthOf(t, api, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, h.Live)
+	code, _ = healthOf(t, api, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// Listening, but not connected to its bootstrap node.
+	go s2.Start()
+	require.Eventually(t, func() bool { return s2.Health().Live }, time.Second, 10*time.Millisecond)
+	code, _ = healthOf(t, api, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, h = healthOf(t, api, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, check(h, "peers").OK)
+	assert.True(t, check(h, "disk").OK)
+	assert.True(t, check(h, "index").OK)
+
+	// Ready once the bootstrap node is up.
+	go s1.Start()
+	defer s1.Stop()
+	require.Eventually(t, func() bool { return s2.Connect("127.0.0.1:41293") == nil }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return s2.Health().Ready }, 2*time.Second, 10*time.Millisecond)
+	code, h = healthOf(t, api, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1 connected", check(h, "peers").Detail)
+
+	s2.Stop()
+	code, _ = healthOf(t, api, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestHealthChecksStorage(t *testing.T) {
+	s := newExportServer(t)
+	assert.True(t, s.checkDisk().OK)
+	assert.True(t, s.checkIndex().OK)
+	assert.True(t, s.checkPeers().OK, "servers without bootstrap nodes may be alone")
+
+	// A storage root that can't be created isn't writable.
+	blocker := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0o644))
+	root := s.StorageRoot
+	s.StorageRoot = filepath.Join(blocker, "root")
+	assert.False(t, s.checkDisk().OK)
+	s.StorageRoot = root
+
+	// The index is unhealthy while it can't be persisted, and healthy again once it is.
+	// A directory in the way of its write-ahead log keeps it from logging.
+	wal := filepath.Join(s.StorageRoot, "index.wal")
+	require.NoError(t, os.MkdirAll(wal, os.ModePerm))
+	assert.Error(t, s.Store("unindexed", strings.NewReader("data")))
+	assert.False(t, s.checkIndex().OK)
+	require.NoError(t, os.Remove(wal))
+	require.NoError(t, s.Store("indexed", strings.NewReader("data")))
+	assert.True(t, s.checkIndex().OK)
+}
@@ -0,0 +1,226 @@
+package dfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// hintsFileName is the name of the file pending hints are kept in, inside the storage root.
+const hintsFileName = "hints.json"
+
+// Hint is a replica owed to a peer that was down or failed to receive it
+// when the file was stored. It is delivered when the peer connects again.
+type Hint struct {
+	Peer    string    `json:"peer"`    // ID of the peer the replica is owed to
+	Key     string    `json:"key"`     // Key of the file, stored locally
+	Created time.Time `json:"created"` // When the replica was first missed
+}
+
+// hintLog holds the pending hints of a server, persisted as JSON so they
+// survive restarts.
+type hintLog struct {
+	path string
+
+	mu    sync.Mutex
+	hints map[string]map[string]time.Time // Peer ID → key → creation time
+}
+
+// loadHints reads the hints persisted at path. A missing file yields no hints.
+func loadHints(path string) (*hintLog, error) {
+	l := &hintLog{path: path, hints: make(map[string]map[string]time.Time)}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+
+	var hints []Hint
+	if err := json.Unmarshal(buf, &hints); err != nil {
+		return l, err
+	}
+	for _, h := range hints {
+		l.addLocked(h.Peer, h.Key, h.Created)
+	}
+	return l, nil
+}
+
+// add records that peer is owed the file under key.
+func (l *hintLog) add(peer string, key string) {
+	if len(peer) == 0 {
+		return // Peers that didn't announce an ID can't be recognized when they return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.hints[peer][key]; ok {
+		return // The newest version is delivered either way
+	}
+	l.addLocked(peer, key, time.Now())
+	l.save()
+}
+
+func (l *hintLog) addLocked(peer string, key string, created time.Time) {
+	if l.hints[peer] == nil {
+		l.hints[peer] = make(map[string]time.Time)
+	}
+	l.hints[peer][key] = created
+}
+
+// take removes and returns the keys owed to peer, oldest first.
+func (l *hintLog) take(peer string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owed := l.hints[peer]
+	if len(owed) == 0 {
+		return nil
+	}
+	delete(l.hints, peer)
+	l.save()
+
+	keys := make([]string, 0, len(owed))
+	for key := range owed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return owed[keys[i]].Before(owed[keys[j]]) })
+	return keys
+}
+
+// list returns every pending hint, sorted by peer and key.
+func (l *hintLog) list() []Hint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hints := []Hint{}
+	for peer, owed := range l.hints {
+		for key, created := range owed {
+			hints = append(hints, Hint{Peer: peer, Key: key, Created: created})
+		}
+	}
+	sort.Slice(hints, func(i, j int) bool {
+		if hints[i].Peer != hints[j].Peer {
+			return hints[i].Peer < hints[j].Peer
+		}
+		return hints[i].Key < hints[j].Key
+	})
+	return hints
+}
+
+// save persists the hints. The caller must hold l.mu.
+func (l *hintLog) save() {
+	var hints []Hint
+	for peer, owed := range l.hints {
+		for key, created := range owed {
+			hints = append(hints, Hint{Peer: peer, Key: key, Created: created})
+		}
+	}
+
+	buf, err := json.Marshal(hints)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(l.path), os.ModePerm)
+	}
+	if err == nil {
+		tmp := l.path + ".tmp"
+		if err = os.WriteFile(tmp, buf, 0o644); err == nil {
+			err = os.Rename(tmp, l.path)
+		}
+	}
+	if err != nil {
+		log.Printf("persisting hints failed: %s", err)
+	}
+}
+
+// PendingHints returns the replicas owed to peers that missed them.
+func (s *FileServer) PendingHints() []Hint {
+	return s.hints.list()
+}
+
+// hintMissing records a hint for every server in ids that should have
+// received the file under key but isn't connected.
+func (s *FileServer) hintMissing(key string, ids []string) {
+	connected := make(map[string]bool)
+	for _, peer := range s.peerList() {
+		connected[peer.ID()] = true
+	}
+	for _, id := range ids {
+		if id != s.ID && !connected[id] {
+			s.hints.add(id, key)
+		}
+	}
+}
+
+// knownPeerIDs returns the IDs of every peer this server has been connected to.
+func (s *FileServer) knownPeerIDs() []string {
+	var ids []string
+	s.knownPeers.Range(func(id, _ any) bool {
+		ids = append(ids, id.(string))
+		return true
+	})
+	return ids
+}
+
+// handoff delivers the replicas owed to peer, which just connected. Replicas
+// that fail to send are hinted again for the next time.
+func (s *FileServer) handoff(peer p2p.Peer) {
+	for _, key := range s.hints.take(peer.ID()) {
+		if !s.store.Has(s.ID, key) {
+			continue // Deleted in the meantime
+		}
+		if s.queueReplica(peer, key, PriorityRepair) {
+			continue
+		}
+		if err := s.sendReplica(peer, key); err != nil {
+			s.replicationFailed(key, peer, err)
+			continue
+		}
+		log.Printf("[%s] handed off (%s) to (%s)", s.Transport.Addr(), key, peer.RemoteAddr())
+		s.audit(AuditReplicaSent, s.ID, s.hashKey(key), 0, peer.RemoteAddr().String(), nil)
+	}
+}
+
+// sendReplica sends the locally stored file under key to a single peer.
+func (s *FileServer) sendReplica(peer p2p.Peer, key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	size, r, err := s.readObject(ioBackground, s.ID, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	frame := newReplicaFrame(size)
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:        s.ID,
+			Key:       s.hashKey(key),
+			Size:      frame.Size(),
+			Frame:     frame,
+			Retention: s.retentionOf(key),
+			Tenant:    s.tenantOf(key),
+			ACL:       s.objectACL(key),
+		},
+	}
+	return s.sendObject(peer, &msg, func(w io.Writer) (int64, error) {
+		if s.queue != nil {
+			w = s.queue.limit.writer(w)
+		}
+		n, err := crypto.CopyEncrypt(objectKey, r, w)
+		return int64(n), err
+	})
+}
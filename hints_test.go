@@ -0,0 +1,42 @@
+package dfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41210")
+	s2 := makeServer(t, "127.0.0.1:41211", "127.0.0.1:41210")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// s2 goes away; the replica it misses is hinted.
+	assert.Nil(t, s1.Disconnect(s1.Peers()[0].Addr))
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 0 }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s1.Store("hinted.txt", strings.NewReader("missed while away")))
+	hints := s1.PendingHints()
+	if assert.Len(t, hints, 1) {
+		assert.Equal(t, s2.ID, hints[0].Peer)
+		assert.Equal(t, "hinted.txt", hints[0].Key)
+	}
+	assert.False(t, s2.store.Has(s1.ID, s1.hashKey("hinted.txt")))
+
+	// Hints survive a restart.
+	reloaded, err := loadHints(s1.hints.path)
+	assert.Nil(t, err)
+	assert.Len(t, reloaded.list(), 1)
+
+	// The replica is delivered once s2 is back.
+	assert.Nil(t, s2.Connect("127.0.0.1:41210"))
+	assert.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("hinted.txt")) }, 2*time.Second, 10*time.Millisecond)
+	assert.Empty(t, s1.PendingHints())
+}
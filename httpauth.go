@@ -0,0 +1,324 @@
+package dfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnauthorized is returned for requests to the admin API without valid
+	// credentials when AuthOpts requires them.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden is returned for requests beyond the scope of their
+	// credentials.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Scope is what a credential of the admin API allows. Every scope allows
+// what the scopes before it do.
+type Scope int
+
+const (
+	ScopeRead  Scope = iota + 1 // Fetch and list files
+	ScopeWrite                  // Store and delete files as well
+	ScopeAdmin                  // Everything the admin API does
+)
+
+// scopeNames are the names of the scopes, as in JWT scope claims.
+var scopeNames = map[Scope]string{ScopeRead: "read", ScopeWrite: "write", ScopeAdmin: "admin"}
+
+func (s Scope) String() string {
+	if name, ok := scopeNames[s]; ok {
+		return name
+	}
+	return "scope(" + strconv.Itoa(int(s)) + ")"
+}
+
+// ParseScope returns the scope named read, write or admin.
+func ParseScope(name string) (Scope, error) {
+	for scope, n := range scopeNames {
+		if n == name {
+			return scope, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q, must be read, write or admin", name)
+}
+
+// AuthOpts requires the requests to the admin API to carry credentials, as
+// "Authorization: Bearer <credential>", an X-Api-Key header for API keys or
+// the client certificate of a TLS connection, see FileServerOpts.AdminTLS.
+// Health checks, share tokens and pre-signed URLs need none.
+//
+// Credentials act for a tenant, whose files count against its quota, see
+// FileServerOpts.Quotas.
+type AuthOpts struct {
+	APIKeys map[string]Scope  // API keys accepted and what each allows
+	Tenants map[string]string // Tenant of every API key, also its subject in ACLs; keys of none count against no quota
+
+	// Authenticator checks the credentials APIKeys and JWTSecret don't
+	// accept, such as client certificates or the tokens of an OpenID Connect
+	// provider, see CertAuthenticator and OIDCAuthenticator. Nil if none.
+	Authenticator Authenticator
+
+	// JWTSecret is the key of the HS256 JSON Web Tokens accepted, whose
+	// "scope" claim names what they allow, the broadest scope if it lists
+	// several, and whose "sub" claim names their tenant. Tokens past their
+	// "exp" or before their "nbf" are refused. JWTs aren't accepted if nil.
+	JWTSecret []byte
+}
+
+// CORSOpts lets browsers on other origins call the admin API and the
+// pre-signed URLs.
+type CORSOpts struct {
+	AllowedOrigins []string      // Origins allowed, such as https://app.example.com, any if it holds "*"
+	AllowedMethods []string      // Methods allowed, GET, HEAD, PUT, POST and DELETE if empty
+	AllowedHeaders []string      // Request headers allowed, those asked for by preflight requests if empty
+	ExposedHeaders []string      // Response headers exposed besides the simple ones, ETag, Content-Range and the X-Dfs-* headers of files if empty
+	MaxAge         time.Duration // How long browsers may cache preflight responses, not at all if zero
+}
+
+// defaultCORSMethods are the methods allowed unless CORSOpts says otherwise.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete}
+
+// withCORS answers the cross-origin requests CORS allows, preflight requests
+// included, and passes everything else on to h. Requests from origins not
+// allowed are passed on without CORS headers, for browsers to refuse.
+func (s *FileServer) withCORS(h http.Handler) http.Handler {
+	if s.CORS == nil {
+		return h
+	}
+	c := s.CORS
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	exposed := c.ExposedHeaders
+	if len(exposed) == 0 {
+		exposed = []string{"Etag", "Content-Range", "Content-Disposition", "X-Dfs-Checksum-Sha256", "X-Dfs-Encryption"}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !slices.Contains(c.AllowedOrigins, origin) && !slices.Contains(c.AllowedOrigins, "*") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Allow-Origin", origin)
+
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requested == "" {
+			header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflight requests are answered here, without credentials
+		if !slices.Contains(methods, requested) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		} else if asked := r.Header.Get("Access-Control-Request-Headers"); asked != "" {
+			header.Set("Access-Control-Allow-Headers", asked)
+		}
+		if c.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// withAuth passes the requests carrying credentials that allow them on to
+// h, for their principal and on behalf of its tenant, answering the others
+// with 401 or 403, and those of tenants over their bandwidth quota with 429.
+func (s *FileServer) withAuth(h http.Handler) http.Handler {
+	if s.Auth == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredScope(r)
+		if required == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p, err := s.Auth.authenticate(r, time.Now())
+		if err == nil && p.Scope < required {
+			err = fmt.Errorf("%w: %s %s needs the %s scope, have %s", ErrForbidden, r.Method, r.URL.Path, required, p.Scope)
+		}
+		if err != nil {
+			if errors.Is(err, ErrUnauthorized) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="dfs"`)
+			}
+			writeError(w, statusFor(err), err)
+			return
+		}
+		r = r.WithContext(ContextWithPrincipal(r.Context(), p))
+		if len(p.Tenant) > 0 {
+			r = r.WithContext(ContextWithTenant(r.Context(), p.Tenant))
+			var ok bool
+			if w, r, ok = s.meterTenant(w, r, p.Tenant); !ok {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requiredScope returns the scope r needs, zero for requests anyone may make.
+func requiredScope(r *http.Request) Scope {
+	path := r.URL.Path
+	switch {
+	case path == "/healthz" || path == "/readyz",
+		strings.HasPrefix(path, "/share/"), strings.HasPrefix(path, signedPathPrefix):
+		return 0 // Carrying credentials of their own, if any
+	case path == "/files" || strings.HasPrefix(path, "/files/") || strings.HasPrefix(path, "/bao/") ||
+		strings.HasPrefix(path, "/retention/") || strings.HasPrefix(path, "/dav/"):
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			return ScopeRead
+		}
+		return ScopeWrite
+	default:
+		return ScopeAdmin
+	}
+}
+
+// authenticate returns the principal of the credentials of r: API keys and
+// JWTs signed with JWTSecret first, then the credentials Authenticator
+// accepts.
+func (a *AuthOpts) authenticate(r *http.Request, now time.Time) (Principal, error) {
+	var c Credentials
+	c.Token = r.Header.Get("X-Api-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		c.Token = strings.TrimSpace(bearer)
+	}
+	if r.TLS != nil {
+		c.Certificates = r.TLS.PeerCertificates
+	}
+	if c.Token == "" && len(c.Certificates) == 0 {
+		return Principal{}, fmt.Errorf("%w: no credentials", ErrUnauthorized)
+	}
+
+	if c.Token != "" {
+		for key, scope := range a.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(c.Token)) == 1 {
+				return Principal{Subject: a.Tenants[key], Scope: scope, Tenant: a.Tenants[key]}, nil
+			}
+		}
+		if a.JWTSecret != nil && strings.Count(c.Token, ".") == 2 {
+			p, err := verifyJWT(c.Token, a.JWTSecret, now)
+			if err == nil || a.Authenticator == nil {
+				return p, err
+			}
+		}
+	}
+	if a.Authenticator != nil {
+		return a.Authenticator.Authenticate(r.Context(), c)
+	}
+	return Principal{}, fmt.Errorf("%w: unknown API key", ErrUnauthorized)
+}
+
+// jwtHeader is the header of a JSON Web Token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtTimes are the claims of a JSON Web Token limiting when it is valid.
+type jwtTimes struct {
+	Exp *int64 `json:"exp"`
+	Nbf *int64 `json:"nbf"`
+}
+
+// check returns why the token isn't valid at now, empty if it is.
+func (t jwtTimes) check(now time.Time) string {
+	if t.Exp != nil && now.Unix() >= *t.Exp {
+		return "expired"
+	}
+	if t.Nbf != nil && now.Unix() < *t.Nbf {
+		return "not valid yet"
+	}
+	return ""
+}
+
+// decodeJWT decodes the header and the claims of the JSON Web Token into
+// header and claims, returning the signed part of the token and its
+// signature, which the caller must verify.
+func decodeJWT(token string, header *jwtHeader, claims any) ([]byte, []byte, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("not a JWT")
+	}
+	buf, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(buf, header) != nil {
+		return nil, nil, errors.New("malformed header")
+	}
+	buf, err = enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(buf, claims) != nil {
+		return nil, nil, errors.New("malformed claims")
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("malformed signature")
+	}
+	return []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// verifyJWT returns the principal of the HS256 JSON Web Token signed with
+// secret.
+func verifyJWT(token string, secret []byte, now time.Time) (Principal, error) {
+	invalid := func(reason string) (Principal, error) {
+		return Principal{}, fmt.Errorf("%w: invalid token: %s", ErrUnauthorized, reason)
+	}
+
+	var (
+		header jwtHeader
+		claims struct {
+			jwtTimes
+			Scope string `json:"scope"`
+			Sub   string `json:"sub"`
+		}
+	)
+	signed, sig, err := decodeJWT(token, &header, &claims)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	if header.Alg != "HS256" {
+		return invalid("algorithm " + header.Alg + " isn't HS256")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return invalid("bad signature")
+	}
+	if reason := claims.check(now); reason != "" {
+		return invalid(reason)
+	}
+	var scope Scope
+	for _, name := range strings.Fields(claims.Scope) {
+		if s, err := ParseScope(name); err == nil {
+			scope = max(scope, s)
+		}
+	}
+	if scope == 0 {
+		return invalid("no scope")
+	}
+	return Principal{Subject: claims.Sub, Scope: scope, Tenant: claims.Sub}, nil
+}
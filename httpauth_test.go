@@ -0,0 +1,108 @@
+package dfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT returns an HS256 JWT of claims signed with secret.
+func signJWT(claims string, secret []byte) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAdminAuth(t *testing.T) {
+	secret := []byte("jwt secret")
+	s := newExportServer(t)
+	s.Auth = &AuthOpts{APIKeys: map[string]Scope{"reader": ScopeRead, "writer": ScopeWrite}, JWTSecret: secret}
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	status := func(method string, path string, credential string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader("contents"))
+		if credential != "" {
+			req.Header.Set("Authorization", "Bearer "+credential)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodPut, "/files/a.txt", ""))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodPut, "/files/a.txt", "guess"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPut, "/files/a.txt", "reader"))
+	assert.Equal(t, http.StatusCreated, status(http.MethodPut, "/files/a.txt", "writer"))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/files/a.txt", "reader"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/status", "writer"))
+	assert.NotEqual(t, http.StatusUnauthorized, status(http.MethodGet, "/healthz", ""))
+
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/files/a.txt", nil)
+	req.Header.Set("X-Api-Key", "reader")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// JWTs carry their scope and expiry.
+	exp := time.Now().Add(time.Hour).Unix()
+	admin := signJWT(`{"sub":"ops","scope":"read admin","exp":`+strconv.FormatInt(exp, 10)+`}`, secret)
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/status", admin))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/status", signJWT(`{"scope":"admin","exp":1}`, secret)))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/status", signJWT(`{"scope":"admin"}`, []byte("other secret"))))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/files/a.txt", signJWT(`{"sub":"nobody"}`, secret)))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"scope":"admin"}`)) + "."
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/status", none))
+}
+
+func TestAdminCORS(t *testing.T) {
+	s := newExportServer(t)
+	s.CORS = &CORSOpts{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour}
+	s.Auth = &AuthOpts{APIKeys: map[string]Scope{"reader": ScopeRead}}
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	// Preflight requests are answered without credentials.
+	req, _ := http.NewRequest(http.MethodOptions, api.URL+"/files/a.txt", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "authorization, range")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "authorization, range", res.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "3600", res.Header.Get("Access-Control-Max-Age"))
+
+	req, _ = http.NewRequest(http.MethodGet, api.URL+"/files/a.txt", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Authorization", "Bearer reader")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, res.Header.Get("Access-Control-Expose-Headers"), "Etag")
+
+	// Other origins get no CORS headers.
+	req, _ = http.NewRequest(http.MethodGet, api.URL+"/healthz", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,114 @@
+package dfs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// redialWait bounds how long waking an idle peer waits for the connection to be set up.
+const redialWait = 2 * time.Second
+
+// idleReaper closes connections to peers without traffic for IdleTimeout and
+// remembers the ones this server dialed, so they can be dialed again once
+// they are needed.
+type idleReaper struct {
+	mu     sync.Mutex
+	seen   map[p2p.Peer]activity // Traffic of every connected peer at its last change
+	reaped map[string]bool       // Addresses of dialed peers closed for being idle
+}
+
+// activity is the traffic of a peer and since when it has been unchanged.
+type activity struct {
+	bytes int64
+	since time.Time
+}
+
+// reapIdle closes idle peers until the server is stopped.
+func (s *FileServer) reapIdle() {
+	interval := s.IdleTimeout / 4
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reapIdleOnce(time.Now())
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// reapIdleOnce closes the peers that have been idle for IdleTimeout at now.
+func (s *FileServer) reapIdleOnce(now time.Time) {
+	r := &s.idle
+	r.mu.Lock()
+	if r.seen == nil {
+		r.seen = make(map[p2p.Peer]activity)
+		r.reaped = make(map[string]bool)
+	}
+
+	var idle []p2p.Peer
+	seen := make(map[p2p.Peer]activity)
+	for _, peer := range s.peerList() {
+		stats := peer.Stats()
+		a, ok := r.seen[peer]
+		if total := stats.BytesSent + stats.BytesReceived; !ok || total != a.bytes {
+			a = activity{bytes: total, since: now}
+		}
+		seen[peer] = a
+
+		if now.Sub(a.since) >= s.IdleTimeout {
+			idle = append(idle, peer)
+			if peer.Outbound() {
+				r.reaped[peer.RemoteAddr().String()] = true
+			}
+		}
+	}
+	r.seen = seen // Forget peers that are gone
+	r.mu.Unlock()
+
+	for _, peer := range idle {
+		log.Printf("[%s] closing idle connection to (%s)", s.Transport.Addr(), peer.RemoteAddr())
+		s.Disconnect(peer.RemoteAddr().String())
+	}
+}
+
+// wakeIdle dials the peers closed for being idle again, now that they are
+// needed, and waits a moment for them to connect.
+func (s *FileServer) wakeIdle() {
+	r := &s.idle
+	r.mu.Lock()
+	addrs := make([]string, 0, len(r.reaped))
+	for addr := range r.reaped {
+		addrs = append(addrs, addr)
+	}
+	clear(r.reaped)
+	r.mu.Unlock()
+	if len(addrs) == 0 {
+		return
+	}
+
+	for _, addr := range addrs {
+		if err := s.dial(addr); err != nil {
+			log.Printf("[%s] redialing idle peer (%s) failed: %s", s.Transport.Addr(), addr, err)
+		}
+	}
+
+	deadline := time.Now().Add(redialWait)
+	for time.Now().Before(deadline) {
+		connected := 0
+		for _, addr := range addrs {
+			if _, err := s.peer(addr); err == nil {
+				connected++
+			}
+		}
+		if connected == len(addrs) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
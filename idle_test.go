@@ -0,0 +1,29 @@
+package dfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleReaper(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41226")
+	s2 := makeServer(t, "127.0.0.1:41227", "127.0.0.1:41226")
+	s2.IdleTimeout = 200 * time.Millisecond
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Without traffic the connection is closed on both ends.
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 0 && len(s1.Peers()) == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	// Storing a file dials s1 again and replicates to it.
+	assert.Nil(t, s2.Store("woken", strings.NewReader("after a nap")))
+	assert.Len(t, s2.Peers(), 1)
+	assert.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("woken")) }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, s2.PendingHints())
+}
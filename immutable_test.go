@@ -0,0 +1,44 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableReplicas(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41351", StorageRoot: t.TempDir(), ID: "owner"})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41352", StorageRoot: t.TempDir(), BootstrapNodes: []string{"127.0.0.1:41351"}, Immutable: map[string]time.Duration{"owner": 0}})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	key := s1.hashKey("a.txt")
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("first")))
+	require.Eventually(t, func() bool { return s2.store.Has("owner", key) }, 2*time.Second, 10*time.Millisecond)
+	replica := func() []byte {
+		_, r, err := s2.store.Read("owner", key)
+		require.NoError(t, err)
+		defer r.Close()
+		b, _ := io.ReadAll(r)
+		return b
+	}
+	first := replica()
+
+	// The replica refuses to be overwritten, and isn't sent again later.
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("second")))
+	assert.Equal(t, first, replica())
+	assert.Empty(t, s1.hints.list())
+
+	// Nor is it deleted.
+	require.NoError(t, s1.Delete("a.txt"))
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, s2.store.Has("owner", key))
+}
@@ -0,0 +1,28 @@
+package dfs
+
+import (
+	"log"
+	"time"
+)
+
+// indexCompactInterval is how often servers compact the index if it
+// changed, persisting the reads recorded since as well.
+const indexCompactInterval = time.Minute
+
+// compactIndex compacts the metadata index of the store every
+// indexCompactInterval until the server is stopped.
+func (s *FileServer) compactIndex() {
+	ticker := time.NewTicker(indexCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.store.CompactIndex(); err != nil {
+				log.Printf("[%s] could not compact metadata index: %s", s.Transport.Addr(), err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
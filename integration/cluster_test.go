@@ -0,0 +1,183 @@
+package integration
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cluster is a cluster of nodes listening on ephemeral ports, each with a
+// storage root of its own. Nodes are known by their index, and node i is
+// given the ID "node<i>".
+type cluster struct {
+	t       *testing.T
+	options []dfs.Option // Options of every node
+
+	addrs []string
+	roots []string
+	keys  [][]byte
+	nodes []*dfs.Node // Nil while the node is down
+}
+
+// newCluster starts n fully connected nodes made with options.
+func newCluster(t *testing.T, n int, options ...dfs.Option) *cluster {
+	c := &cluster{t: t, options: options}
+	for i := 0; i < n; i++ {
+		c.addrs = append(c.addrs, freeAddr(t))
+		c.roots = append(c.roots, filepath.Join(t.TempDir(), "root"))
+		c.keys = append(c.keys, randomBytes(t, 32))
+		c.nodes = append(c.nodes, nil)
+	}
+	t.Cleanup(func() {
+		for i, node := range c.nodes {
+			if node != nil {
+				c.stop(i)
+			}
+		}
+	})
+	for i := range c.nodes {
+		c.start(i)
+	}
+	c.waitConnected()
+	return c
+}
+
+// freeAddr returns an address on the loopback interface with a port nothing
+// listens on, as picked by the system.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// randomBytes returns n random bytes.
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+// id returns the ID of node i.
+func (c *cluster) id(i int) string {
+	return fmt.Sprintf("node%d", i)
+}
+
+// up returns the indexes of the nodes running.
+func (c *cluster) up() []int {
+	var up []int
+	for i, node := range c.nodes {
+		if node != nil {
+			up = append(up, i)
+		}
+	}
+	return up
+}
+
+// start starts node i with its address, storage root and identity,
+// connecting it to the nodes running.
+func (c *cluster) start(i int) {
+	var bootstrap []string
+	for _, j := range c.up() {
+		bootstrap = append(bootstrap, c.addrs[j])
+	}
+	options := append([]dfs.Option{
+		dfs.WithListenAddr(c.addrs[i]),
+		dfs.WithStorageRoot(c.roots[i]),
+		dfs.WithIdentity(c.id(i), c.keys[i]),
+		dfs.WithBootstrap(bootstrap...),
+	}, c.options...)
+	node, err := dfs.New(options...)
+	require.NoError(c.t, err)
+	c.nodes[i] = node
+}
+
+// stop closes node i. A closed node stops listening but leaves the
+// connections with its peers open, so they hang up on it as they would on
+// a node that crashed.
+func (c *cluster) stop(i int) {
+	require.NoError(c.t, c.nodes[i].Close())
+	c.nodes[i] = nil
+	for _, j := range c.up() {
+		for _, p := range c.nodes[j].Peers() {
+			if p.ID == c.id(i) {
+				c.nodes[j].Disconnect(p.Addr)
+			}
+		}
+	}
+}
+
+// wipe loses the storage root of node i, which must be down, so it comes
+// back with nothing on disk.
+func (c *cluster) wipe(i int) {
+	require.Nil(c.t, c.nodes[i], "node%d is running", i)
+	c.roots[i] = filepath.Join(c.t.TempDir(), "root")
+}
+
+// waitConnected waits until every node running is connected to every other
+// one.
+func (c *cluster) waitConnected() {
+	up := c.up()
+	require.Eventually(c.t, func() bool {
+		for _, i := range up {
+			if len(c.nodes[i].Peers()) != len(up)-1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// holders returns the indexes of the nodes other than owner holding want
+// replicas of the files node owner stored, as counted in their stores.
+func (c *cluster) holders(owner int, want int64) []int {
+	var holders []int
+	for _, i := range c.up() {
+		if i != owner && c.nodes[i].Usage().Namespaces[c.id(owner)].Objects == want {
+			holders = append(holders, i)
+		}
+	}
+	return holders
+}
+
+// assertReplicated asserts that eventually the nodes running besides owner
+// hold want replicas of the files node owner stored.
+func (c *cluster) assertReplicated(owner int, want int64) {
+	others := len(c.up()) - 1
+	assert.Eventually(c.t, func() bool { return len(c.holders(owner, want)) == others }, 5*time.Second, 10*time.Millisecond,
+		"want %d nodes holding %d replicas of the files of node%d, have %v", others, want, owner, c.holders(owner, want))
+}
+
+// assertIntact asserts that node i reads back data under key.
+func (c *cluster) assertIntact(i int, key string, data []byte) {
+	r, err := c.nodes[i].Get(key)
+	if !assert.NoError(c.t, err, "node%d gets %s", i, key) {
+		return
+	}
+	defer r.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	require.NoError(c.t, err)
+	assert.Equal(c.t, sha256.Sum256(data), [sha256.Size]byte(h.Sum(nil)), "checksum of %s read by node%d", key, i)
+}
+
+// assertConsistent asserts that the storage of every node running holds
+// what its index says, every object matching its checksum.
+func (c *cluster) assertConsistent() {
+	for _, i := range c.up() {
+		report, err := c.nodes[i].Fsck(false)
+		if assert.NoError(c.t, err) {
+			assert.True(c.t, report.OK(), "storage of node%d: %+v", i, report)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// Package integration tests clusters of nodes end to end. Its tests boot
+// real nodes in the process, talking TCP on ephemeral ports of the loopback
+// interface and storing their files in directories of their own, and drive
+// them through the API of package dfs only: files are stored, fetched and
+// deleted, nodes fail and come back, and the storage of every node is
+// checked against the files it should hold and their checksums.
+//
+// The package holds no code of its own; run its tests with go test.
+package integration
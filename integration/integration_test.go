@@ -0,0 +1,110 @@
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	dfs "github.com/inagib21/DistributedFileStorageGo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 5)
+
+	// Files stored on a node are replicated to every other one.
+	files := map[string][]byte{
+		"empty.bin": {},
+		"small.txt": []byte("a small file"),
+		"large.bin": randomBytes(t, 4<<20),
+	}
+	for key, data := range files {
+		require.NoError(t, c.nodes[0].Store(key, bytes.NewReader(data)))
+	}
+	c.assertReplicated(0, 3)
+	for key, data := range files {
+		c.assertIntact(0, key, data)
+	}
+
+	// Other nodes storing files under the same keys keep them apart.
+	other := []byte("another file under the same key")
+	require.NoError(t, c.nodes[2].Store("small.txt", bytes.NewReader(other)))
+	c.assertReplicated(2, 1)
+	c.assertIntact(2, "small.txt", other)
+	c.assertIntact(0, "small.txt", files["small.txt"])
+
+	// Deleting a file removes every replica of it, and of it only.
+	require.NoError(t, c.nodes[0].Delete("large.bin"))
+	c.assertReplicated(0, 2)
+	c.assertReplicated(2, 1)
+	_, err := c.nodes[0].Get("large.bin")
+	assert.True(t, errors.Is(err, dfs.ErrKeyNotFound), "large.bin is gone: %v", err)
+	assert.EqualValues(t, 2, c.nodes[0].Usage().Namespaces[c.id(0)].Objects)
+
+	c.assertConsistent()
+}
+
+func TestReplicationFactor(t *testing.T) {
+	c := newCluster(t, 5, dfs.WithReplication(2))
+
+	// Without a coordinator, every file goes to as many nodes as the
+	// replication factor says.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.nodes[0].Store(fmt.Sprintf("file%d.bin", i), bytes.NewReader(randomBytes(t, 1024))))
+	}
+	replicas := func() int64 {
+		var n int64
+		for _, i := range c.up()[1:] {
+			n += c.nodes[i].Usage().Namespaces[c.id(0)].Objects
+		}
+		return n
+	}
+	assert.Eventually(t, func() bool { return replicas() == 20 }, 5*time.Second, 10*time.Millisecond, "have %d replicas", replicas())
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 20, replicas(), "no more than two replicas per file")
+	assert.Less(t, len(c.holders(0, 10)), 2, "files spread over the nodes")
+
+	c.assertConsistent()
+}
+
+func TestNodeFailure(t *testing.T) {
+	c := newCluster(t, 5)
+	before := randomBytes(t, 1<<20)
+	require.NoError(t, c.nodes[0].Store("before.bin", bytes.NewReader(before)))
+	c.assertReplicated(0, 1)
+
+	// A node holding replicas fails. The files stored meanwhile go to the
+	// other nodes and are owed to it.
+	c.stop(1)
+	during := randomBytes(t, 1<<20)
+	require.NoError(t, c.nodes[0].Store("during.bin", bytes.NewReader(during)))
+	c.assertReplicated(0, 2)
+	hints := c.nodes[0].PendingHints()
+	if assert.Len(t, hints, 1) {
+		assert.Equal(t, c.id(1), hints[0].Peer)
+		assert.Equal(t, "during.bin", hints[0].Key)
+	}
+	c.assertIntact(0, "during.bin", during)
+
+	// Back with its storage as it left it, the node is handed the replicas
+	// it missed.
+	c.start(1)
+	c.waitConnected()
+	c.assertReplicated(0, 2)
+	assert.Eventually(t, func() bool { return len(c.nodes[0].PendingHints()) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// The node owning the files fails and loses its disk. Back with nothing
+	// stored, it fetches its files from the nodes holding their replicas.
+	c.stop(0)
+	c.wipe(0)
+	c.start(0)
+	c.waitConnected()
+	c.assertIntact(0, "before.bin", before)
+	c.assertIntact(0, "during.bin", during)
+	c.assertReplicated(0, 2)
+
+	c.assertConsistent()
+}
@@ -0,0 +1,194 @@
+package dfs
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sync"
+)
+
+// sendTurnSize is the most of an object handed to a peer connection in a
+// single turn, see scheduledFile.sendTo.
+const sendTurnSize = 256 * 1024
+
+// errIOStopped fails disk IO waiting for its turn when the server stops.
+var errIOStopped = errors.New("server stopped while waiting for the disk")
+
+// ioClass is the priority class of disk IO.
+type ioClass int
+
+const (
+	ioForeground ioClass = iota // Reads serving users and the peers fetching for them
+	ioBackground                // Replication, tiering, proofs and handoffs
+	ioClasses
+)
+
+// ioScheduler caps the disk IO of each class done at once. Background IO
+// doesn't start while foreground IO is waiting for its turn, and foreground
+// IO gets the turns freed first, so maintenance work yields to serving
+// reads rather than adding to their latency.
+type ioScheduler struct {
+	budget [ioClasses]int // IO at once of each class, unlimited if zero
+
+	mu      sync.Mutex
+	active  [ioClasses]int
+	waiting [ioClasses][]chan struct{} // Closed when the IO gets its turn
+}
+
+// newIOScheduler returns a scheduler of foreground and background IO at
+// once, or nil if neither is limited.
+func newIOScheduler(foreground int, background int) *ioScheduler {
+	if foreground <= 0 && background <= 0 {
+		return nil
+	}
+	return &ioScheduler{budget: [ioClasses]int{ioForeground: foreground, ioBackground: background}}
+}
+
+// acquire waits for the turn of IO of class until quit closes. The function
+// returned ends the IO.
+func (sc *ioScheduler) acquire(class ioClass, quit <-chan struct{}) (func(), error) {
+	if sc == nil {
+		return func() {}, nil
+	}
+
+	sc.mu.Lock()
+	if len(sc.waiting[class]) == 0 && sc.free(class) {
+		sc.active[class]++
+		sc.mu.Unlock()
+		return func() { sc.end(class) }, nil
+	}
+	turn := make(chan struct{})
+	sc.waiting[class] = append(sc.waiting[class], turn)
+	sc.mu.Unlock()
+
+	select {
+	case <-turn:
+		return func() { sc.end(class) }, nil
+	case <-quit:
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	select {
+	case <-turn:
+		sc.active[class]-- // Got its turn meanwhile, which goes to the next
+		sc.dispatch()
+	default:
+		sc.waiting[class] = slices.DeleteFunc(sc.waiting[class], func(c chan struct{}) bool { return c == turn })
+		sc.dispatch() // Background IO may go once no foreground IO waits
+	}
+	return nil, errIOStopped
+}
+
+// free reports whether IO of class may start now.
+func (sc *ioScheduler) free(class ioClass) bool {
+	if class == ioBackground && len(sc.waiting[ioForeground]) > 0 {
+		return false
+	}
+	return sc.budget[class] <= 0 || sc.active[class] < sc.budget[class]
+}
+
+// end counts IO of class as done and starts the IO now allowed to.
+func (sc *ioScheduler) end(class ioClass) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active[class]--
+	sc.dispatch()
+}
+
+// dispatch starts waiting IO while the budgets allow, foreground IO first.
+func (sc *ioScheduler) dispatch() {
+	for class := range ioClasses {
+		for len(sc.waiting[class]) > 0 && sc.free(class) {
+			close(sc.waiting[class][0])
+			sc.waiting[class] = sc.waiting[class][1:]
+			sc.active[class]++
+		}
+	}
+}
+
+// file returns r, an object read from the store, taking a turn of class for
+// every read, or r itself if sc is nil. Like the objects of the store, the
+// file returned can be read at any offset and seeked.
+func (sc *ioScheduler) file(class ioClass, r io.ReadCloser, quit <-chan struct{}) io.ReadCloser {
+	if sc == nil {
+		return r
+	}
+	return &scheduledFile{ReadCloser: r, sc: sc, class: class, quit: quit}
+}
+
+// scheduledFile is an object of the store read in turns of an ioScheduler.
+type scheduledFile struct {
+	io.ReadCloser
+	sc    *ioScheduler
+	class ioClass
+	quit  <-chan struct{}
+}
+
+func (f *scheduledFile) Read(b []byte) (int, error) {
+	end, err := f.sc.acquire(f.class, f.quit)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	return f.ReadCloser.Read(b)
+}
+
+// sendTo hands the object beneath f to w, sendTurnSize bytes a turn, so
+// connections sending files with sendfile still see one rather than f.
+func (f *scheduledFile) sendTo(w io.ReaderFrom) (int64, error) {
+	var written int64
+	for {
+		end, err := f.sc.acquire(f.class, f.quit)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.ReadFrom(&io.LimitedReader{R: f.ReadCloser, N: sendTurnSize})
+		end()
+		written += n
+		if err != nil || n < sendTurnSize {
+			return written, err
+		}
+	}
+}
+
+func (f *scheduledFile) ReadAt(b []byte, off int64) (int, error) {
+	ra, ok := f.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("object can't be read at an offset")
+	}
+	end, err := f.sc.acquire(f.class, f.quit)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	return ra.ReadAt(b, off)
+}
+
+func (f *scheduledFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("object can't be seeked")
+	}
+	return seeker.Seek(offset, whence)
+}
+
+// readObject opens the object stored under key by id for IO of class.
+func (s *FileServer) readObject(class ioClass, id string, key string) (int64, io.ReadCloser, error) {
+	size, r, err := s.store.Read(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	return size, s.disk.file(class, r, s.quitch), nil
+}
+
+// writeReplica writes the replica read from r to the store under key of id,
+// taking a turn of background IO throughout.
+func (s *FileServer) writeReplica(id string, key string, r io.Reader) (int64, error) {
+	end, err := s.disk.acquire(ioBackground, s.quitch)
+	if err != nil {
+		return 0, err
+	}
+	defer end()
+	return s.store.Write(id, key, r)
+}
@@ -0,0 +1,125 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOScheduler(t *testing.T) {
+	assert.Nil(t, newIOScheduler(0, 0))
+	var unlimited *ioScheduler
+	end, err := unlimited.acquire(ioBackground, nil)
+	require.NoError(t, err)
+	end()
+
+	sc := newIOScheduler(1, 1)
+	endFg, err := sc.acquire(ioForeground, nil)
+	require.NoError(t, err)
+	endBg, err := sc.acquire(ioBackground, nil)
+	require.NoError(t, err)
+
+	// IO over the budget of its class waits for its turn.
+	started := make(chan ioClass)
+	wait := func(class ioClass) {
+		end, err := sc.acquire(class, nil)
+		if assert.NoError(t, err) {
+			started <- class
+			end()
+		}
+	}
+	waiting := func(class ioClass) int {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return len(sc.waiting[class])
+	}
+	go wait(ioBackground)
+	assert.Eventually(t, func() bool { return waiting(ioBackground) == 1 }, time.Second, time.Millisecond)
+	go wait(ioForeground)
+	assert.Eventually(t, func() bool { return waiting(ioForeground) == 1 }, time.Second, time.Millisecond)
+
+	// Background IO doesn't go while foreground IO waits, even with its
+	// own budget to spare.
+	endBg()
+	select {
+	case class := <-started:
+		t.Fatalf("IO of class %d started", class)
+	case <-time.After(20 * time.Millisecond):
+	}
+	endFg()
+	assert.ElementsMatch(t, []ioClass{ioForeground, ioBackground}, []ioClass{<-started, <-started})
+
+	// IO waiting when the server stops fails.
+	endFg, err = sc.acquire(ioForeground, nil)
+	require.NoError(t, err)
+	quit := make(chan struct{})
+	close(quit)
+	_, err = sc.acquire(ioForeground, quit)
+	assert.ErrorIs(t, err, errIOStopped)
+	endFg()
+	assert.Eventually(t, func() bool {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return sc.active == [ioClasses]int{}
+	}, time.Second, time.Millisecond)
+	assert.Zero(t, waiting(ioForeground))
+}
+
+func TestScheduledFile(t *testing.T) {
+	s := newExportServer(t)
+	s.disk = newIOScheduler(1, 1)
+	require.NoError(t, s.Store("a.txt", strings.NewReader("read in turns")))
+
+	// Files read in turns can still be read at any offset and seeked.
+	r, err := s.Get("a.txt")
+	require.NoError(t, err)
+	defer r.Close()
+	require.IsType(t, &scheduledFile{}, r)
+	buf := make([]byte, 5)
+	_, err = r.(io.ReaderAt).ReadAt(buf, 8)
+	require.NoError(t, err)
+	assert.Equal(t, "turns", string(buf))
+	_, err = r.(io.Seeker).Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "in turns", string(rest))
+	assert.Equal(t, [ioClasses]int{}, s.disk.active, "every read ended its turn")
+
+	// Files served to peers are handed to the connection as files, so it can
+	// send them with sendfile.
+	_, r, err = s.readObject(ioForeground, s.ID, "a.txt")
+	require.NoError(t, err)
+	defer r.Close()
+	var sink fileSink
+	n, err := sendFile(&sink, r)
+	require.NoError(t, err)
+	assert.EqualValues(t, len("read in turns"), n)
+	assert.Equal(t, "read in turns", sink.String())
+	assert.Positive(t, sink.files)
+	assert.Equal(t, [ioClasses]int{}, s.disk.active, "every send ended its turn")
+}
+
+// fileSink is a buffer counting the files its ReadFrom is handed, on their
+// own or limited by an io.LimitedReader.
+type fileSink struct {
+	bytes.Buffer
+	files int
+}
+
+func (w *fileSink) ReadFrom(r io.Reader) (int64, error) {
+	f := r
+	if lr, ok := r.(*io.LimitedReader); ok {
+		f = lr.R
+	}
+	if _, ok := f.(*os.File); ok {
+		w.files++
+	}
+	return w.Buffer.ReadFrom(r)
+}
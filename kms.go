@@ -0,0 +1,211 @@
+package dfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// dataKeysFileName is the name of the file the wrapped data keys of files
+// are kept in, inside the storage root.
+const dataKeysFileName = "datakeys.json"
+
+// kmsTimeout bounds every request made to a KMS.
+const kmsTimeout = 10 * time.Second
+
+// KMS is an external key management service, such as AWS KMS or the transit
+// engine of HashiCorp Vault, wrapping keys under a master key that never
+// leaves it. See FileServerOpts.KMS for the keys a server has it wrap.
+type KMS interface {
+	// Encrypt wraps plaintext, returning a ciphertext only Decrypt recovers
+	// it from.
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	// Decrypt unwraps a ciphertext returned by Encrypt.
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// kmsEncrypt wraps key with kms, bounded by kmsTimeout.
+func kmsEncrypt(kms KMS, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapped, err := kms.Encrypt(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping a key with the KMS: %w", err)
+	}
+	return wrapped, nil
+}
+
+// kmsDecrypt unwraps a key wrapped by kmsEncrypt, bounded by kmsTimeout.
+func kmsDecrypt(kms KMS, wrapped []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	key, err := kms.Decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping a key with the KMS: %w", err)
+	}
+	return key, nil
+}
+
+// dataKeyTable holds the data keys of files, the random keys they are
+// encrypted with on other nodes, persisted wrapped by a KMS. Keys are
+// unwrapped the first time they are used and kept in memory after.
+type dataKeyTable struct {
+	path string
+	kms  KMS
+
+	mu      sync.Mutex
+	wrapped map[string][]byte // Key of the file → its data key, wrapped
+	plain   map[string][]byte // Key of the file → its data key, for those unwrapped so far
+}
+
+// loadDataKeys reads the data keys persisted at path. A missing file yields
+// none.
+func loadDataKeys(path string, kms KMS) (*dataKeyTable, error) {
+	t := &dataKeyTable{path: path, kms: kms, wrapped: make(map[string][]byte), plain: make(map[string][]byte)}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(buf, &t.wrapped)
+}
+
+// get returns the data key of the file under key, and whether it has one.
+func (t *dataKeyTable) get(key string) ([]byte, bool, error) {
+	t.mu.Lock()
+	plain, cached := t.plain[key]
+	wrapped, ok := t.wrapped[key]
+	t.mu.Unlock()
+	if cached || !ok {
+		return plain, cached, nil
+	}
+
+	plain, err := kmsDecrypt(t.kms, wrapped)
+	if err != nil {
+		return nil, true, fmt.Errorf("data key of (%s): %w", key, err)
+	}
+	t.mu.Lock()
+	t.plain[key] = plain
+	t.mu.Unlock()
+	return plain, true, nil
+}
+
+// create gives the file under key a new data key, unless it has one.
+func (t *dataKeyTable) create(key string) error {
+	t.mu.Lock()
+	_, ok := t.wrapped[key]
+	t.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	plain := crypto.NewEncryptionKey()
+	wrapped, err := kmsEncrypt(t.kms, plain) // Not holding the lock while the KMS answers
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.wrapped[key]; ok {
+		return nil // Created by a concurrent store of the same file
+	}
+	t.wrapped[key], t.plain[key] = wrapped, plain
+	if err := t.save(); err != nil {
+		delete(t.wrapped, key)
+		delete(t.plain, key)
+		return err
+	}
+	return nil
+}
+
+// adopt adds the wrapped data keys of files that have none, such as those
+// of a migrated identity, and persists them.
+func (t *dataKeyTable) adopt(keys map[string][]byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	added := false
+	for key, wrapped := range keys {
+		if _, ok := t.wrapped[key]; !ok {
+			t.wrapped[key], added = wrapped, true
+		}
+	}
+	if !added {
+		return nil
+	}
+	return t.save()
+}
+
+// remove forgets the data key of the file under key, leaving the replicas
+// encrypted with it unreadable.
+func (t *dataKeyTable) remove(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.wrapped[key]; !ok {
+		return nil
+	}
+	delete(t.wrapped, key)
+	delete(t.plain, key)
+	return t.save()
+}
+
+// snapshot returns a copy of the wrapped data keys.
+func (t *dataKeyTable) snapshot() map[string][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make(map[string][]byte, len(t.wrapped))
+	for key, wrapped := range t.wrapped {
+		keys[key] = wrapped
+	}
+	return keys
+}
+
+// save persists the wrapped data keys. The caller must hold t.mu.
+func (t *dataKeyTable) save() error {
+	buf, err := json.Marshal(t.wrapped)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// newObjectKey gives the file about to be stored under key a data key of
+// its own if the server has a KMS and the file has none yet, see objectKey.
+func (s *FileServer) newObjectKey(key string) error {
+	if s.dataKeys == nil {
+		return nil
+	}
+	return s.dataKeys.create(key)
+}
+
+// forgetObjectKey drops the data key of the file deleted from under key, so
+// replicas peers failed to delete can't be read anymore.
+func (s *FileServer) forgetObjectKey(key string) {
+	if s.dataKeys == nil {
+		return
+	}
+	if err := s.dataKeys.remove(key); err != nil {
+		log.Printf("[%s] forgetting the data key of (%s) failed: %s", s.Transport.Addr(), key, err)
+	}
+}
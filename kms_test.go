@@ -0,0 +1,199 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKMS is a KMS sealing keys with a master key of its own, counting the
+// keys it unwrapped.
+type testKMS struct {
+	master    []byte
+	unwrapped atomic.Int32
+}
+
+func (k *testKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return crypto.SealKey(k.master, plaintext)
+}
+
+func (k *testKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	k.unwrapped.Add(1)
+	return crypto.OpenKey(k.master, ciphertext)
+}
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case of the Signature Version 4 test suite.
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestVaultKMS(t *testing.T) {
+	master := crypto.NewEncryptionKey()
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/secrets/encrypt/dfs":
+			plaintext, _ := base64.StdEncoding.DecodeString(body["plaintext"])
+			sealed, _ := crypto.SealKey(master, plaintext)
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(sealed)}})
+		case "/v1/secrets/decrypt/dfs":
+			sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+			plaintext, err := crypto.OpenKey(master, sealed)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+
+	kms := &VaultKMS{Addr: vault.URL + "/", Token: "s.token", Key: "dfs", Mount: "secrets"}
+	key := crypto.NewEncryptionKey()
+	wrapped, err := kms.Encrypt(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(wrapped), "vault:v1:"))
+	unwrapped, err := kms.Decrypt(context.Background(), wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	kms.Token = "s.revoked"
+	_, err = kms.Decrypt(context.Background(), wrapped)
+	assert.ErrorContains(t, err, "permission denied")
+}
+
+func TestAWSKMS(t *testing.T) {
+	master := crypto.NewEncryptionKey()
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		day := time.Now().UTC().Format("20060102")
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"+day+"/eu-west-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, ") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "IncompleteSignatureException"})
+			return
+		}
+		var body struct {
+			KeyId          string
+			Plaintext      []byte
+			CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.KeyId != "alias/dfs" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "NotFoundException"})
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			sealed, _ := crypto.SealKey(master, body.Plaintext)
+			json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": sealed})
+		case "TrentService.Decrypt":
+			plaintext, _ := crypto.OpenKey(master, body.CiphertextBlob)
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": plaintext})
+		}
+	}))
+	defer aws.Close()
+
+	kms := &AWSKMS{Region: "eu-west-1", KeyID: "alias/dfs", AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session", Endpoint: aws.URL}
+	key := crypto.NewEncryptionKey()
+	wrapped, err := kms.Encrypt(context.Background(), key)
+	require.NoError(t, err)
+	unwrapped, err := kms.Decrypt(context.Background(), wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	kms.KeyID = "alias/other"
+	_, err = kms.Encrypt(context.Background(), key)
+	assert.ErrorContains(t, err, "NotFoundException")
+}
+
+func TestKMSDataKeys(t *testing.T) {
+	kms := &testKMS{master: crypto.NewEncryptionKey()}
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41365", StorageRoot: t.TempDir(), KMS: kms})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41366", StorageRoot: t.TempDir(), BootstrapNodes: []string{"127.0.0.1:41365"}})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// Files get a random data key, wrapped by the KMS, their replicas are
+	// encrypted with.
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("enveloped")))
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("a.txt")) }, time.Second, 10*time.Millisecond)
+	dataKey, err := s1.objectKey("a.txt")
+	require.NoError(t, err)
+	assert.NotEqual(t, crypto.DeriveKey(s1.EncKey, "a.txt"), dataKey)
+	buf, err := os.ReadFile(filepath.Join(s1.StorageRoot, dataKeysFileName))
+	require.NoError(t, err)
+	assert.NotContains(t, string(buf), base64.StdEncoding.EncodeToString(dataKey))
+
+	// Restarted, the server unwraps the data key to read the replica.
+	keys, err := loadDataKeys(filepath.Join(s1.StorageRoot, dataKeysFileName), kms)
+	require.NoError(t, err)
+	s1.dataKeys = keys
+	require.NoError(t, s1.store.Delete(s1.ID, "a.txt"))
+	r, err := s1.Get("a.txt")
+	require.NoError(t, err)
+	got, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "enveloped", string(got))
+	assert.EqualValues(t, 1, kms.unwrapped.Load())
+	r, err = s1.Get("a.txt")
+	require.NoError(t, err)
+	r.Close()
+	assert.EqualValues(t, 1, kms.unwrapped.Load(), "data keys are unwrapped once")
+
+	// Deleting the file drops its data key.
+	require.NoError(t, s1.Delete("a.txt"))
+	_, ok, _ := s1.dataKeys.get("a.txt")
+	assert.False(t, ok)
+}
+
+func TestKMSKeyRing(t *testing.T) {
+	kms := &testKMS{master: crypto.NewEncryptionKey()}
+	path := filepath.Join(t.TempDir(), groupsFileName)
+	kek := crypto.NewEncryptionKey()
+
+	// Keys sealed before the KMS was set are wrapped by it once loaded.
+	ring, err := loadKeyRing(path, kek, nil)
+	require.NoError(t, err)
+	require.NoError(t, ring.add("research", crypto.NewEncryptionKey()))
+	want, _ := ring.get("research")
+	ring, err = loadKeyRing(path, kek, kms)
+	require.NoError(t, err)
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Contains(buf, []byte(`"kms":true`)))
+
+	ring, err = loadKeyRing(path, nil, kms)
+	require.NoError(t, err)
+	got, _ := ring.get("research")
+	assert.Equal(t, want, got)
+	_, err = loadKeyRing(path, kek, nil)
+	assert.ErrorContains(t, err, "wrapped by a KMS")
+}
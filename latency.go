@@ -0,0 +1,87 @@
+package dfs
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	// rttJitter is the largest share by which the round-trip time of a holder
+	// is scaled up at random when ranking holders, so holders about as close
+	// as each other share the reads instead of the closest taking them all.
+	rttJitter = 0.2
+
+	// locateGrace is how long locate waits for further holders to answer once
+	// the first did, before ranking the ones it heard of.
+	locateGrace = 10 * time.Millisecond
+)
+
+// heartbeat probes the peers every HeartbeatInterval until the server stops.
+func (s *FileServer) heartbeat() {
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.probePeers()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// probePeers measures the round-trip time of every multiplexed peer at once.
+func (s *FileServer) probePeers() {
+	var wg sync.WaitGroup
+	for _, peer := range s.peerList() {
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+			if err := s.probe(peer); err != nil && !errors.Is(err, p2p.ErrNotMultiplexed) {
+				log.Printf("[%s] probing (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// probe measures the round-trip time of peer with a lookup of no file, which
+// every multiplexed peer answers, and folds it into the estimate of the peer.
+func (s *FileServer) probe(peer p2p.Peer) error {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	start := time.Now()
+	if _, err := hasFile(stream, s.ID, ""); err != nil {
+		return err
+	}
+	peer.ObserveRTT(time.Since(start))
+	return nil
+}
+
+// rankHolders sorts peers by their round-trip time estimate, each scaled up
+// by a random share of at most rttJitter. Peers without an estimate come last.
+func rankHolders(peers []p2p.Peer) []p2p.Peer {
+	scores := make(map[p2p.Peer]float64, len(peers))
+	for _, peer := range peers {
+		scores[peer] = float64(peer.RTT()) * (1 + rttJitter*rand.Float64())
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := scores[peers[i]], scores[peers[j]]
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		return a < b
+	})
+	return peers
+}
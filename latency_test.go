@@ -0,0 +1,54 @@
+package dfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// rttPeer is a peer with a fixed round-trip time estimate.
+type rttPeer struct {
+	p2p.Peer
+	rtt time.Duration
+}
+
+func (p *rttPeer) RTT() time.Duration { return p.rtt }
+
+func TestRankHolders(t *testing.T) {
+	near := &rttPeer{rtt: time.Millisecond}
+	far := &rttPeer{rtt: 10 * time.Millisecond}
+	unknown := &rttPeer{}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, []p2p.Peer{near, far, unknown}, rankHolders([]p2p.Peer{unknown, far, near}))
+	}
+
+	// Holders about as close take turns being first.
+	a, b := &rttPeer{rtt: 10 * time.Millisecond}, &rttPeer{rtt: 10*time.Millisecond + time.Microsecond}
+	first := map[p2p.Peer]bool{}
+	for i := 0; i < 100; i++ {
+		first[rankHolders([]p2p.Peer{a, b})[0]] = true
+	}
+	assert.Len(t, first, 2)
+}
+
+func TestHeartbeat(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41325")
+	s2 := makeServer(t, "127.0.0.1:41326", "127.0.0.1:41325")
+	s2.HeartbeatInterval = 20 * time.Millisecond
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// Probes are lookups, counted as traffic.
+	sent := s2.Peers()[0].BytesSent
+	require.Eventually(t, func() bool { return s2.Peers()[0].BytesSent > sent+2 }, time.Second, 10*time.Millisecond)
+	assert.Greater(t, s2.Peers()[0].RTT, time.Duration(0))
+	assert.NoError(t, s2.probe(s2.peerList()[0]))
+}
@@ -0,0 +1,204 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	defaultPeerBytesInterval = time.Minute      // Interval MaxPeerBytes applies to
+	defaultBanScore          = 100              // Score at which a peer is banned
+	defaultBanDuration       = 10 * time.Minute // How long a ban lasts
+)
+
+// Penalties added to the score of a peer for every violation.
+const (
+	penaltyProtocolError = 50 // Sent bytes that aren't a message, or an oversized one
+	penaltyFileTooLarge  = 50 // Announced a file over MaxFileSize
+	penaltyOverQuota     = 25 // Sent more than MaxPeerBytes in an interval
+)
+
+var (
+	// ErrFileTooLarge is returned for files over MaxFileSize. It wraps ErrQuotaExceeded.
+	ErrFileTooLarge = fmt.Errorf("%w: file exceeds the maximum file size", ErrQuotaExceeded)
+	// ErrPeerOverQuota is returned for files that would take a peer over
+	// MaxPeerBytes. It wraps ErrQuotaExceeded.
+	ErrPeerOverQuota = fmt.Errorf("%w: peer exceeds the bytes it may send per interval", ErrQuotaExceeded)
+	// ErrPeerBanned is returned by OnPeer for peers banned for misbehaving.
+	ErrPeerBanned = errors.New("peer is banned")
+)
+
+// PeerPenalized is emitted when a peer broke one of the limits and got a
+// penalty. Peers whose score reaches BanScore are disconnected and banned.
+type PeerPenalized struct {
+	EventMeta
+	Addr   string `json:"addr"`   // Remote address of the peer
+	ID     string `json:"id"`     // Node ID announced by the peer
+	Reason string `json:"reason"` // Limit the peer broke
+	Score  int    `json:"score"`  // Score of the peer after the penalty
+	Banned bool   `json:"banned"` // Whether the peer got banned
+}
+
+// peerScores tracks how peers misbehave and how many bytes they sent, by
+// node ID, or by address for peers that didn't announce one.
+type peerScores struct {
+	mu     sync.Mutex
+	scores map[string]int        // Penalties of every peer since its last ban
+	banned map[string]time.Time  // When the ban of every banned peer ends
+	usage  map[string]*peerUsage // Bytes every peer sent in the current interval
+}
+
+// peerUsage counts the bytes a peer sent since start.
+type peerUsage struct {
+	start time.Time
+	bytes int64
+}
+
+// scoreKey returns the key peer is tracked under.
+func scoreKey(peer p2p.Peer) string {
+	if len(peer.ID()) > 0 {
+		return peer.ID()
+	}
+	return peer.RemoteAddr().String()
+}
+
+// init allocates the maps on first use.
+func (ps *peerScores) init() {
+	if ps.scores == nil {
+		ps.scores = make(map[string]int)
+		ps.banned = make(map[string]time.Time)
+		ps.usage = make(map[string]*peerUsage)
+	}
+}
+
+// score returns the current score of peer.
+func (s *FileServer) score(peer p2p.Peer) int {
+	ps := &s.scores
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.scores[scoreKey(peer)]
+}
+
+// banned reports whether peer is banned at now.
+func (s *FileServer) banned(peer p2p.Peer, now time.Time) bool {
+	ps := &s.scores
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	until, ok := ps.banned[scoreKey(peer)]
+	if ok && !now.Before(until) {
+		delete(ps.banned, scoreKey(peer))
+		return false
+	}
+	return ok
+}
+
+// penalize adds points to the score of peer for breaking a limit with err.
+// Peers reaching BanScore are disconnected and refused for BanDuration.
+func (s *FileServer) penalize(peer p2p.Peer, points int, err error) {
+	banScore, banDuration := s.BanScore, s.BanDuration
+	if banScore <= 0 {
+		banScore = defaultBanScore
+	}
+	if banDuration <= 0 {
+		banDuration = defaultBanDuration
+	}
+
+	ps := &s.scores
+	key := scoreKey(peer)
+	ps.mu.Lock()
+	ps.init()
+	ps.scores[key] += points
+	score := ps.scores[key]
+	ban := score >= banScore
+	if ban {
+		ps.banned[key] = time.Now().Add(banDuration)
+		delete(ps.scores, key) // Start over once the ban ends
+	}
+	ps.mu.Unlock()
+
+	addr := peer.RemoteAddr().String()
+	log.Printf("[%s] penalized (%s) with %d points, score %d: %s", s.Transport.Addr(), addr, points, score, err)
+	s.events.emit(PeerPenalized{EventMeta: newEventMeta(), Addr: addr, ID: peer.ID(), Reason: err.Error(), Score: score, Banned: ban})
+
+	if ban {
+		log.Printf("[%s] banning (%s) for %s", s.Transport.Addr(), addr, banDuration)
+		s.Disconnect(addr)
+	}
+}
+
+// OnProtocolError penalizes peers whose messages the transport rejected.
+func (s *FileServer) OnProtocolError(peer p2p.Peer, err error) {
+	s.penalize(peer, penaltyProtocolError, err)
+}
+
+// admitFile checks the file of size bytes announced by peer against
+// MaxFileSize and MaxPeerBytes, penalizing the peer if it breaks either.
+func (s *FileServer) admitFile(peer p2p.Peer, size int64, now time.Time) error {
+	if size < 0 || s.MaxFileSize > 0 && size > s.MaxFileSize {
+		err := fmt.Errorf("%w: announced %d bytes", ErrFileTooLarge, size)
+		s.penalize(peer, penaltyFileTooLarge, err)
+		return err
+	}
+	if s.MaxPeerBytes <= 0 {
+		return nil
+	}
+
+	interval := s.PeerBytesInterval
+	if interval <= 0 {
+		interval = defaultPeerBytesInterval
+	}
+
+	ps := &s.scores
+	ps.mu.Lock()
+	ps.init()
+	u := ps.usage[scoreKey(peer)]
+	if u == nil || now.Sub(u.start) >= interval {
+		u = &peerUsage{start: now}
+		ps.usage[scoreKey(peer)] = u
+	}
+	over := u.bytes+size > s.MaxPeerBytes
+	if !over {
+		u.bytes += size
+	}
+	used := u.bytes
+	ps.mu.Unlock()
+
+	if over {
+		err := fmt.Errorf("%w: %d bytes sent, %d more announced", ErrPeerOverQuota, used, size)
+		s.penalize(peer, penaltyOverQuota, err)
+		return err
+	}
+	return nil
+}
+
+// limitFileSize returns r failing with ErrFileTooLarge once it has read more
+// than MaxFileSize bytes, r itself if MaxFileSize is zero.
+func (s *FileServer) limitFileSize(r io.Reader) io.Reader {
+	if s.MaxFileSize <= 0 {
+		return r
+	}
+	return &fileSizeLimiter{r: r, max: s.MaxFileSize, left: s.MaxFileSize}
+}
+
+// fileSizeLimiter reads from r until more than max bytes were read.
+type fileSizeLimiter struct {
+	r    io.Reader
+	max  int64
+	left int64
+}
+
+func (l *fileSizeLimiter) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, l.max)
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package dfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerByteQuota(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41281")
+	s.MaxFileSize = 100
+	s.MaxPeerBytes = 150
+	s.PeerBytesInterval = time.Minute
+	peer := &flakyPeer{}
+
+	now := time.Now()
+	assert.ErrorIs(t, s.admitFile(peer, 101, now), ErrFileTooLarge)
+	assert.Equal(t, penaltyFileTooLarge, s.score(peer))
+	assert.False(t, s.banned(peer, now))
+
+	// The second violation reaches the ban score
+	assert.ErrorIs(t, s.admitFile(peer, -1, now), ErrFileTooLarge)
+	assert.True(t, s.banned(peer, now))
+	assert.False(t, s.banned(peer, now.Add(defaultBanDuration+time.Second)))
+	assert.Zero(t, s.score(peer))
+
+	assert.Nil(t, s.admitFile(peer, 100, now))
+	assert.ErrorIs(t, s.admitFile(peer, 100, now.Add(time.Second)), ErrPeerOverQuota)
+	assert.Equal(t, penaltyOverQuota, s.score(peer))
+
+	// The quota starts over every interval
+	assert.Nil(t, s.admitFile(peer, 100, now.Add(time.Minute)))
+}
+
+func TestMaxFileSize(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41282")
+	s2 := makeServer(t, "127.0.0.1:41283", "127.0.0.1:41282")
+	s1.MaxFileSize = 16
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	events, cancel := s1.Subscribe()
+	defer cancel()
+
+	// s1 refuses the file and penalizes s2
+	assert.Nil(t, s2.Store("big.txt", strings.NewReader("more than sixteen bytes")))
+	var penalized PeerPenalized
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case ev := <-events:
+				if p, ok := ev.(PeerPenalized); ok {
+					penalized = p
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, s2.ID, penalized.ID)
+	assert.False(t, penalized.Banned)
+	assert.False(t, s1.store.Has(s2.ID, s2.hashKey("big.txt")))
+	assert.Equal(t, penaltyFileTooLarge, s1.Peers()[0].Score)
+
+	// Once more and s2 is banned: disconnected and refused when it comes back
+	assert.Nil(t, s2.Store("bigger.txt", strings.NewReader("even more than sixteen bytes")))
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 0 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s2.Connect("127.0.0.1:41282"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, s1.Peers())
+}
@@ -0,0 +1,149 @@
+package dfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// MessageHasFile asks a peer whether it holds a file. The peer answers on the
+// same stream with a gob encoded HasFileReply.
+type MessageHasFile struct {
+	ID  string // ID of the node that stored the file
+	Key string // Hashed key of the file
+}
+
+// HasFileReply is the answer to a MessageHasFile.
+type HasFileReply struct {
+	Has  bool  // Whether the peer holds the file
+	Size int64 // Size of the replica on disk, 0 unless Has or Pieces is set
+
+	// Pieces of the replica a peer downloading it in swarm mode holds
+	// already, and can serve as ranges. See SwarmOpts.
+	Pieces []byte
+}
+
+// hasFile asks peer over stream whether it holds the file stored under key by id.
+func hasFile(stream net.Conn, id, key string) (HasFileReply, error) {
+	var reply HasFileReply
+	if err := writeMessage(stream, &Message{Payload: MessageHasFile{ID: id, Key: key}}); err != nil {
+		return reply, err
+	}
+	return reply, gob.NewDecoder(stream).Decode(&reply)
+}
+
+// hasFileAnswer is the answer of a peer to a MessageHasFile, or why it gave none.
+type hasFileAnswer struct {
+	peer  p2p.Peer
+	reply HasFileReply
+	err   error
+}
+
+// locate asks the multiplexed peers in parallel whether they hold the file
+// stored under key by id, and calls try with each holder until try returns
+// true: first the holders answering within locateGrace of the first one,
+// closest first as ranked by rankHolders, then the others in the order
+// their answers arrive. The time each peer takes to answer is folded into
+// its round-trip time estimate. Peers that couldn't answer, such as
+// nodes that don't know MessageHasFile yet, are tried after the holders;
+// peers answering they don't have the file aren't tried at all. locate
+// reports whether a try succeeded and returns the peers without multiplexing,
+// which can't be asked.
+func (s *FileServer) locate(id, key string, try func(p2p.Peer) bool) (found bool, legacy []p2p.Peer) {
+	peers := s.peerList()
+	answers := make(chan hasFileAnswer, len(peers))
+	asked := 0
+	for _, peer := range peers {
+		stream, err := s.openStream(peer)
+		if errors.Is(err, p2p.ErrNotMultiplexed) {
+			legacy = append(legacy, peer)
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] open stream to (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			continue
+		}
+
+		asked++
+		go func(peer p2p.Peer, stream net.Conn) {
+			defer stream.Close()
+			start := time.Now()
+			reply, err := hasFile(stream, id, key)
+			if err == nil {
+				peer.ObserveRTT(time.Since(start))
+			}
+			answers <- hasFileAnswer{peer: peer, reply: reply, err: err}
+		}(peer, stream)
+	}
+
+	// The channel is buffered for every answer, so the askers finish even
+	// when a holder is found before all of them answered.
+	var (
+		holders []p2p.Peer
+		unknown []p2p.Peer
+		grace   <-chan time.Time // Fires locateGrace after the first holder answered
+	)
+collect:
+	for asked > 0 {
+		select {
+		case answer := <-answers:
+			asked--
+			switch {
+			case answer.err != nil:
+				unknown = append(unknown, answer.peer)
+			case answer.reply.Has:
+				holders = append(holders, answer.peer)
+				if grace == nil {
+					grace = time.After(locateGrace)
+				}
+			}
+		case <-grace:
+			break collect
+		}
+	}
+	for _, peer := range rankHolders(holders) {
+		if try(peer) {
+			return true, legacy
+		}
+	}
+	for ; asked > 0; asked-- {
+		answer := <-answers
+		if answer.err != nil {
+			unknown = append(unknown, answer.peer)
+			continue
+		}
+		if answer.reply.Has && try(answer.peer) {
+			return true, legacy
+		}
+	}
+	for _, peer := range unknown {
+		if try(peer) {
+			return true, legacy
+		}
+	}
+
+	return false, legacy
+}
+
+// handleMessageHasFile tells the peer asking whether this server holds a file.
+func (s *FileServer) handleMessageHasFile(rpc p2p.RPC, msg MessageHasFile) error {
+	if rpc.Conn == nil {
+		return errors.New("file lookups need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	var reply HasFileReply
+	if s.store.Has(msg.ID, msg.Key) {
+		reply.Has = true
+		if meta, ok := s.store.Meta(msg.ID, msg.Key); ok {
+			reply.Size = meta.Size
+		}
+	} else if d := s.swarms.get(msg.ID, msg.Key); d != nil {
+		reply.Size, reply.Pieces = d.size, d.snapshot()
+	}
+	return gob.NewEncoder(rpc.Conn).Encode(reply)
+}
@@ -0,0 +1,113 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeLegacyServer returns a node whose transport doesn't multiplex, so files
+// are sent over the connection shared with the messages.
+func makeLegacyServer(t testing.TB, listenAddr string, nodes ...string) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:    t.TempDir(),
+		EncKey:         crypto.NewEncryptionKey(),
+		Hasher:         crypto.SHA256Hasher,
+		Transport:      tr,
+		BootstrapNodes: nodes,
+	})
+	tr.OnPeer = s.OnPeer
+	return s
+}
+
+func TestLocate(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41301")
+	s2 := makeServer(t, "127.0.0.1:41302", "127.0.0.1:41301")
+	s3 := makeServer(t, "127.0.0.1:41303", "127.0.0.1:41301")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	data := []byte("only one peer keeps this")
+	require.NoError(t, s1.Store("key", bytes.NewReader(data)))
+	require.Eventually(t, func() bool {
+		return s2.store.Has(s1.ID, s1.hashKey("key")) && s3.store.Has(s1.ID, s1.hashKey("key"))
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s2.store.Delete(s1.ID, s1.hashKey("key")))
+	require.NoError(t, s1.store.Delete(s1.ID, "key"))
+
+	// Only the peer answering it holds the file is tried.
+	var tried []p2p.Peer
+	found, legacy := s1.locate(s1.ID, s1.hashKey("key"), func(peer p2p.Peer) bool {
+		tried = append(tried, peer)
+		return true
+	})
+	assert.True(t, found)
+	assert.Empty(t, legacy)
+	require.Len(t, tried, 1)
+	assert.Equal(t, s3.ID, tried[0].ID())
+
+	r, err := s1.Get("key")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Nobody is tried for a file no peer holds.
+	tried = nil
+	found, _ = s1.locate(s1.ID, s1.hashKey("missing"), func(peer p2p.Peer) bool {
+		tried = append(tried, peer)
+		return true
+	})
+	assert.False(t, found)
+	assert.Empty(t, tried)
+	_, err = s1.Get("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestGetLegacy(t *testing.T) {
+	s1 := makeLegacyServer(t, "127.0.0.1:41304")
+	s2 := makeLegacyServer(t, "127.0.0.1:41305", "127.0.0.1:41304")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// A peer without the file says so instead of leaving the request hanging.
+	_, err := s1.Get("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// The connection is still usable afterwards.
+	data := []byte("sent over the shared connection")
+	replica := new(bytes.Buffer)
+	objectKey, err := s1.objectKey("key")
+	require.NoError(t, err)
+	_, err = crypto.CopyEncrypt(objectKey, bytes.NewReader(data), replica)
+	require.NoError(t, err)
+	_, err = s2.store.Write(s1.ID, s1.hashKey("key"), replica)
+	require.NoError(t, err)
+
+	r, err := s1.Get("key")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,370 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MessageType identifies the payload of a message in its header. Types are
+// never renumbered: a peer that doesn't know one rejects the message instead
+// of misreading it.
+type MessageType uint16
+
+// The types of the payloads servers exchange.
+const (
+	TypeStoreFile       MessageType = 1
+	TypeGetFile         MessageType = 2
+	TypeHasFile         MessageType = 3
+	TypeGetRange        MessageType = 4
+	TypeSearch          MessageType = 5
+	TypeDeleteFile      MessageType = 6
+	TypeKeyChanged      MessageType = 7
+	TypeNodeInfo        MessageType = 8
+	TypeMetaRequest     MessageType = 9
+	TypeCoordinate      MessageType = 10
+	TypeMigrateObject   MessageType = 11
+	TypeMigrateIdentity MessageType = 12
+	TypeNodeMoved       MessageType = 13
+	TypeGroupKey        MessageType = 14
+	TypeRelay           MessageType = 15
+	TypeRelayed         MessageType = 16
+	TypeSetRetention    MessageType = 17
+	TypeChallenge       MessageType = 18
+	TypeStoreBatch      MessageType = 19
+	TypeGetBatch        MessageType = 20
+	TypeSetACL          MessageType = 21
+	TypeRekeyReplicas   MessageType = 22
+)
+
+const (
+	// messageMagic starts the header of every message. Messages encoded by
+	// older servers are a gob stream, which never starts with a zero byte.
+	messageMagic byte = 0x00
+	// messageFormat is the version of the header and payload encoding.
+	messageFormat byte = 1
+	// messageFormatZstd is messageFormat with the headers and payload
+	// compressed as a zstd frame, prefixed with its length. It is only sent
+	// to peers that negotiated p2p.CompressionZstd.
+	messageFormatZstd byte = 2
+	// minCompressedSize is the size of the headers and payload below which
+	// messages are sent as they are, compressing them saving next to nothing.
+	minCompressedSize = 128
+	// messageHeaderSize is the size of the fixed header: magic, format and type.
+	messageHeaderSize = 4
+	// typedMessagesVersion is the protocol version messages got their header
+	// in. Peers speaking an older one, or none, are sent messages gob encoded
+	// as a whole, which every server decodes.
+	typedMessagesVersion = 2
+	// chunkedStreamsVersion is the protocol version files started to be sent
+	// between peers in chunks checked with a CRC32C, see crcWriter.
+	chunkedStreamsVersion = 3
+)
+
+// messageDecoders decodes the payload of each message type.
+var messageDecoders = map[MessageType]func(io.Reader) (any, error){
+	TypeStoreFile:       decodePayload[MessageStoreFile],
+	TypeGetFile:         decodePayload[MessageGetFile],
+	TypeHasFile:         decodePayload[MessageHasFile],
+	TypeGetRange:        decodePayload[MessageGetRange],
+	TypeSearch:          decodePayload[MessageSearch],
+	TypeDeleteFile:      decodePayload[MessageDeleteFile],
+	TypeKeyChanged:      decodePayload[MessageKeyChanged],
+	TypeNodeInfo:        decodePayload[MessageNodeInfo],
+	TypeMetaRequest:     decodePayload[MessageMetaRequest],
+	TypeCoordinate:      decodePayload[MessageCoordinate],
+	TypeMigrateObject:   decodePayload[MessageMigrateObject],
+	TypeMigrateIdentity: decodePayload[MessageMigrateIdentity],
+	TypeNodeMoved:       decodePayload[MessageNodeMoved],
+	TypeGroupKey:        decodePayload[MessageGroupKey],
+	TypeRelay:           decodePayload[MessageRelay],
+	TypeRelayed:         decodePayload[MessageRelayed],
+	TypeSetRetention:    decodePayload[MessageSetRetention],
+	TypeChallenge:       decodePayload[MessageChallenge],
+	TypeStoreBatch:      decodePayload[MessageStoreBatch],
+	TypeGetBatch:        decodePayload[MessageGetBatch],
+	TypeSetACL:          decodePayload[MessageSetACL],
+	TypeRekeyReplicas:   decodePayload[MessageRekeyReplicas],
+}
+
+// messageTypeOf returns the type of payload.
+func messageTypeOf(payload any) (MessageType, error) {
+	switch payload.(type) {
+	case MessageStoreFile:
+		return TypeStoreFile, nil
+	case MessageGetFile:
+		return TypeGetFile, nil
+	case MessageHasFile:
+		return TypeHasFile, nil
+	case MessageGetRange:
+		return TypeGetRange, nil
+	case MessageSearch:
+		return TypeSearch, nil
+	case MessageDeleteFile:
+		return TypeDeleteFile, nil
+	case MessageKeyChanged:
+		return TypeKeyChanged, nil
+	case MessageNodeInfo:
+		return TypeNodeInfo, nil
+	case MessageMetaRequest:
+		return TypeMetaRequest, nil
+	case MessageCoordinate:
+		return TypeCoordinate, nil
+	case MessageMigrateObject:
+		return TypeMigrateObject, nil
+	case MessageMigrateIdentity:
+		return TypeMigrateIdentity, nil
+	case MessageNodeMoved:
+		return TypeNodeMoved, nil
+	case MessageGroupKey:
+		return TypeGroupKey, nil
+	case MessageRelay:
+		return TypeRelay, nil
+	case MessageRelayed:
+		return TypeRelayed, nil
+	case MessageSetRetention:
+		return TypeSetRetention, nil
+	case MessageChallenge:
+		return TypeChallenge, nil
+	case MessageStoreBatch:
+		return TypeStoreBatch, nil
+	case MessageGetBatch:
+		return TypeGetBatch, nil
+	case MessageSetACL:
+		return TypeSetACL, nil
+	case MessageRekeyReplicas:
+		return TypeRekeyReplicas, nil
+	}
+	return 0, fmt.Errorf("no message type for payload %T", payload)
+}
+
+// decodePayload decodes a payload of type T. Payloads are gob encoded as
+// their concrete type, which the header names, so they need no registration.
+func decodePayload[T any](r io.Reader) (any, error) {
+	var v T
+	if err := gob.NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// versioned is implemented by peers and the streams opened to them, which
+// know the protocol version negotiated with the peer.
+type versioned interface {
+	ProtocolVersion() int
+}
+
+// protocolVersionOf returns the protocol version spoken with the peer w
+// writes to, 0 if unknown.
+func protocolVersionOf(w io.Writer) int {
+	if v, ok := w.(versioned); ok {
+		return v.ProtocolVersion()
+	}
+	return 0
+}
+
+// compressed is implemented by peers and the streams opened to them, which
+// know the compression of messages negotiated with the peer.
+type compressed interface {
+	Compression() string
+}
+
+// compressionOf returns the compression of messages negotiated with the peer
+// w writes to, empty if none.
+func compressionOf(w io.Writer) string {
+	if c, ok := w.(compressed); ok {
+		return c.Compression()
+	}
+	return ""
+}
+
+// encodeMessage encodes msg for a peer speaking the given protocol version:
+// the fixed header naming the type of its payload, its headers as a count
+// followed by length-prefixed keys and values, then its payload.
+func encodeMessage(msg *Message, version int) ([]byte, error) {
+	typ, err := messageTypeOf(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if version < typedMessagesVersion {
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	buf.Write([]byte{messageMagic, messageFormat})
+	binary.Write(buf, binary.BigEndian, uint16(typ))
+
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(keys))))
+	for _, k := range keys {
+		writeString(buf, k)
+		writeString(buf, msg.Headers[k])
+	}
+
+	if err := gob.NewEncoder(buf).Encode(msg.Payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zstdEncoder and zstdDecoder compress and decompress messages. Both are
+// safe for concurrent use with EncodeAll and DecodeAll.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(p2p.DefaultMaxMessageSize))
+		return dec
+	})
+)
+
+// compressMessage returns the message b encoded by encodeMessage compressed
+// with the given algorithm, as negotiated with the peer. Messages encoded as
+// a whole for older peers, small ones and ones that don't shrink are
+// returned as they are.
+func compressMessage(b []byte, compression string) []byte {
+	if compression != p2p.CompressionZstd || len(b) < messageHeaderSize+minCompressedSize || b[0] != messageMagic || b[1] != messageFormat {
+		return b
+	}
+
+	frame := zstdEncoder().EncodeAll(b[messageHeaderSize:], nil)
+	out := make([]byte, messageHeaderSize, messageHeaderSize+binary.MaxVarintLen64+len(frame))
+	copy(out, b[:messageHeaderSize])
+	out[1] = messageFormatZstd
+	out = binary.AppendUvarint(out, uint64(len(frame)))
+	out = append(out, frame...)
+	if len(out) >= len(b) {
+		return b
+	}
+	return out
+}
+
+// decodeMessage decodes a message encoded by encodeMessage or, for older
+// servers, a gob encoded Message.
+func decodeMessage(b []byte, msg *Message) error {
+	return readMessage(bytes.NewReader(b), msg)
+}
+
+// messageReader is what messages are read from: gob reads nothing past the
+// end of a value from readers that are also byte readers.
+type messageReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// readMessage reads a message like decodeMessage, reading nothing past its
+// end, so whatever follows it can be read from r next.
+func readMessage(r messageReader, msg *Message) error {
+	var header [messageHeaderSize]byte
+	magic, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: empty message", p2p.ErrInvalidMessage)
+	}
+	if magic != messageMagic {
+		r.UnreadByte()
+		return gob.NewDecoder(r).Decode(msg)
+	}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return fmt.Errorf("%w: truncated message header", p2p.ErrInvalidMessage)
+	}
+	if header[1] != messageFormat && header[1] != messageFormatZstd {
+		return fmt.Errorf("%w: unknown message format %d", p2p.ErrInvalidMessage, header[1])
+	}
+	typ := MessageType(binary.BigEndian.Uint16(header[2:]))
+	decode, ok := messageDecoders[typ]
+	if !ok {
+		return fmt.Errorf("%w: unknown message type %d", p2p.ErrInvalidMessage, typ)
+	}
+	if header[1] == messageFormatZstd {
+		if r, err = decompressMessage(r); err != nil {
+			return err
+		}
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: reading headers: %w", p2p.ErrInvalidMessage, err)
+	}
+	msg.Headers = nil
+	for i := uint64(0); i < n; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return err
+		}
+		v, err := readString(r)
+		if err != nil {
+			return err
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[k] = v
+	}
+
+	payload, err := decode(r)
+	if err != nil {
+		return fmt.Errorf("%w: decoding payload of type %d: %w", p2p.ErrInvalidMessage, typ, err)
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// decompressMessage reads the compressed headers and payload of a message in
+// messageFormatZstd, returning a reader of them.
+func decompressMessage(r messageReader) (messageReader, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading compressed message: %w", p2p.ErrInvalidMessage, err)
+	}
+	if n > p2p.DefaultMaxMessageSize {
+		return nil, fmt.Errorf("%w: compressed message of %d bytes", p2p.ErrInvalidMessage, n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("%w: truncated compressed message", p2p.ErrInvalidMessage)
+	}
+	b, err := zstdDecoder().DecodeAll(frame, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompressing message: %w", p2p.ErrInvalidMessage, err)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// writeString writes s prefixed with its length.
+func writeString(buf *bytes.Buffer, s string) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	buf.WriteString(s)
+}
+
+// readString reads a string written by writeString, no longer than the
+// largest message.
+func readString(r messageReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: reading header: %w", p2p.ErrInvalidMessage, err)
+	}
+	if n > p2p.DefaultMaxMessageSize {
+		return "", fmt.Errorf("%w: header of %d bytes", p2p.ErrInvalidMessage, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", fmt.Errorf("%w: truncated header", p2p.ErrInvalidMessage)
+	}
+	return string(b), nil
+}
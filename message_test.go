@@ -0,0 +1,153 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	for typ, decode := range messageDecoders {
+		zero, err := decode(bytes.NewReader(mustGob(t, struct{}{})))
+		require.NoError(t, err, "type %d", typ)
+		got, err := messageTypeOf(zero)
+		require.NoError(t, err)
+		assert.Equal(t, typ, got)
+	}
+
+	msg := &Message{
+		Payload: MessageGetRange{ID: "id", Key: "key", Offset: 4, Length: 8},
+		Headers: map[string]string{"traceparent": "00-abc", "b": ""},
+	}
+	b, err := encodeMessage(msg, p2p.ProtocolVersion)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{messageMagic, messageFormat, 0, byte(TypeGetRange)}, b[:messageHeaderSize])
+
+	var decoded Message
+	require.NoError(t, decodeMessage(b, &decoded))
+	assert.Equal(t, msg, &decoded)
+
+	// Peers speaking the first version, or none, get the whole message gob
+	// encoded, which servers of every version understand.
+	for _, version := range []int{0, 1} {
+		legacy, err := encodeMessage(msg, version)
+		require.NoError(t, err)
+		var old Message
+		require.NoError(t, gob.NewDecoder(bytes.NewReader(legacy)).Decode(&old))
+		assert.Equal(t, msg, &old)
+		decoded = Message{}
+		require.NoError(t, decodeMessage(legacy, &decoded))
+		assert.Equal(t, msg, &decoded)
+	}
+
+	_, err = encodeMessage(&Message{Payload: "not a message"}, p2p.ProtocolVersion)
+	assert.Error(t, err)
+
+	for _, bad := range [][]byte{
+		{messageMagic, messageFormat},
+		{messageMagic, messageFormatZstd + 1, 0, byte(TypeGetFile), 0},
+		{messageMagic, messageFormat, 0xff, 0xff, 0},
+		{messageMagic, messageFormat, 0, byte(TypeGetFile), 5, 1, 'a'},
+		{messageMagic, messageFormat, 0, byte(TypeGetFile), 0, 1, 2, 3},
+	} {
+		assert.ErrorIs(t, decodeMessage(bad, &Message{}), p2p.ErrInvalidMessage, "%v", bad)
+	}
+}
+
+func TestMessageCompression(t *testing.T) {
+	msg := &Message{
+		Payload: MessageGetFile{ID: strings.Repeat("id", 64), Key: strings.Repeat("key", 64)},
+		Headers: map[string]string{"traceparent": "00-abc"},
+	}
+	b, err := encodeMessage(msg, p2p.ProtocolVersion)
+	require.NoError(t, err)
+
+	// Messages are compressed for peers that negotiated it only.
+	assert.Equal(t, b, compressMessage(b, ""))
+	z := compressMessage(b, p2p.CompressionZstd)
+	assert.Less(t, len(z), len(b))
+	assert.Equal(t, []byte{messageMagic, messageFormatZstd, 0, byte(TypeGetFile)}, z[:messageHeaderSize])
+	var decoded Message
+	require.NoError(t, decodeMessage(z, &decoded))
+	assert.Equal(t, msg, &decoded)
+
+	// Nothing after the message is read with it.
+	r := bytes.NewReader(append(append([]byte(nil), z...), "data"...))
+	decoded = Message{}
+	require.NoError(t, readMessage(r, &decoded))
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "data", string(rest))
+
+	// Small messages and ones for older peers are sent as they are.
+	small, err := encodeMessage(&Message{Payload: MessageGetFile{ID: "id", Key: "key"}}, p2p.ProtocolVersion)
+	require.NoError(t, err)
+	assert.Equal(t, small, compressMessage(small, p2p.CompressionZstd))
+	legacy, err := encodeMessage(msg, p2p.MinProtocolVersion)
+	require.NoError(t, err)
+	assert.Equal(t, legacy, compressMessage(legacy, p2p.CompressionZstd))
+
+	corrupt := append([]byte(nil), z...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	assert.ErrorIs(t, decodeMessage(corrupt, &Message{}), p2p.ErrInvalidMessage)
+	assert.ErrorIs(t, decodeMessage(z[:len(z)-1], &Message{}), p2p.ErrInvalidMessage)
+}
+
+// mustGob returns the gob encoding of v.
+func mustGob(t *testing.T, v any) []byte {
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(v))
+	return buf.Bytes()
+}
+
+func TestMixedProtocolVersions(t *testing.T) {
+	// A node that wasn't upgraded yet, and one that was.
+	old := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41314", StorageRoot: t.TempDir(), Protocol: p2p.MinProtocolVersion})
+	upgraded := makeServer(t, "127.0.0.1:41315", "127.0.0.1:41314")
+	for _, s := range []*FileServer{old, upgraded} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(old.Peers()) == 1 && len(upgraded.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, p2p.MinProtocolVersion, upgraded.Peers()[0].ProtocolVersion)
+
+	require.NoError(t, upgraded.Store("a.txt", strings.NewReader("from the new node")))
+	require.Eventually(t, func() bool { return old.store.Has(upgraded.ID, upgraded.hashKey("a.txt")) }, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, old.Store("b.txt", strings.NewReader("from the old node")))
+	require.NoError(t, old.store.Delete(old.ID, "b.txt"))
+	r, err := old.Get("b.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "from the old node", string(got))
+}
+
+func TestMixedCompression(t *testing.T) {
+	plain := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41348", StorageRoot: t.TempDir(), NoCompression: true})
+	s1 := makeServer(t, "127.0.0.1:41349", "127.0.0.1:41348")
+	s2 := makeServer(t, "127.0.0.1:41350", "127.0.0.1:41349")
+	for _, s := range []*FileServer{plain, s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	peer, _ := peerStatus(s1, plain.ID)
+	assert.Empty(t, peer.Compression)
+	peer, _ = peerStatus(s1, s2.ID)
+	assert.Equal(t, p2p.CompressionZstd, peer.Compression)
+
+	require.NoError(t, s1.Store("a.txt", strings.NewReader(strings.Repeat("compressible ", 100))))
+	require.Eventually(t, func() bool {
+		return plain.store.Has(s1.ID, s1.hashKey("a.txt")) && s2.store.Has(s1.ID, s1.hashKey("a.txt"))
+	}, 2*time.Second, 10*time.Millisecond)
+}
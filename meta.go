@@ -0,0 +1,563 @@
+package dfs
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	metaApplyTimeout = 5 * time.Second // How long a metadata change may take to commit
+	metaPeerTimeout  = 5 * time.Second // How long peers get to answer forwarded metadata requests
+)
+
+var (
+	// ErrNoMetaLeader is returned when the metadata service has no leader to
+	// commit changes, for instance while a new one is being elected.
+	ErrNoMetaLeader = errors.New("metadata service has no leader")
+
+	// ErrMetaDisabled is returned by metadata operations on servers without
+	// FileServerOpts.Meta.
+	ErrMetaDisabled = errors.New("metadata service is not enabled")
+)
+
+// MetaOpts enables the raft backed metadata service, keeping the replica
+// sets of keys, deletes and quotas strongly consistent across the network.
+// Files themselves are still stored and replicated peer to peer.
+//
+// Only some nodes, usually three or five, need to run raft. The others leave
+// BindAddr empty and send their changes to the peers that do.
+type MetaOpts struct {
+	BindAddr string // Address raft listens on, empty to only use the service through peers
+	DataDir  string // Where raft keeps its log and snapshots (default StorageRoot + "_raft")
+
+	// Voters of a new metadata cluster, by server ID and raft address. Set it
+	// on a single node the first time the cluster starts; it is ignored once
+	// the node has state of its own.
+	Bootstrap []MetaServer
+
+	// Admins are the IDs of the servers allowed to set quotas besides those
+	// running raft. Other servers may only change the records of their own
+	// files. The servers running raft check it, so give them all the same.
+	Admins []string
+}
+
+// MetaServer is a member of the metadata cluster.
+type MetaServer struct {
+	ID   string `json:"id"`   // ID of the FileServer running raft
+	Addr string `json:"addr"` // Address its raft transport listens on
+}
+
+// ObjectRecord is the metadata of a file kept by the metadata service.
+type ObjectRecord struct {
+	Owner    string    `json:"owner"`             // ID of the server the file belongs to
+	Key      string    `json:"key"`               // Lookup token of the key the file was stored under, the key itself as returned by Lookup
+	Size     int64     `json:"size"`              // Size of the file in bytes
+	Replicas []string  `json:"replicas"`          // IDs of the servers holding a copy
+	Deleted  bool      `json:"deleted,omitempty"` // Whether the file has been deleted
+	Updated  time.Time `json:"updated"`           // When the record last changed
+	Version  uint64    `json:"version"`           // Raft index of the last change
+}
+
+// metaCommand is a change to the metadata, as stored in the raft log.
+type metaCommand struct {
+	Op     string       `json:"op"` // "put", "delete" or "quota"
+	Record ObjectRecord `json:"record"`
+	Owner  string       `json:"owner,omitempty"`
+	Quota  int64        `json:"quota,omitempty"`
+}
+
+// metaState is the replicated metadata.
+type metaState struct {
+	Records map[string]ObjectRecord `json:"records"` // By owner and key
+	Quotas  map[string]int64        `json:"quotas"`  // Bytes each owner may store
+}
+
+// metaFSM applies committed metadata changes.
+type metaFSM struct {
+	mu    sync.RWMutex
+	state metaState
+}
+
+// recordKey returns the key of the record of the file owner stored under key.
+func recordKey(owner string, key string) string {
+	return owner + "/" + key
+}
+
+// newMetaFSM returns an FSM holding no metadata.
+func newMetaFSM() *metaFSM {
+	return &metaFSM{state: metaState{
+		Records: make(map[string]ObjectRecord),
+		Quotas:  make(map[string]int64),
+	}}
+}
+
+// Apply applies a committed metaCommand.
+func (f *metaFSM) Apply(l *raft.Log) any {
+	var cmd metaCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Op {
+	case "put":
+		cmd.Record.Version = l.Index
+		cmd.Record.Deleted = false
+		f.state.Records[recordKey(cmd.Record.Owner, cmd.Record.Key)] = cmd.Record
+	case "delete":
+		// Deletes leave a tombstone so nodes that missed them can find out
+		cmd.Record.Version = l.Index
+		cmd.Record.Deleted = true
+		cmd.Record.Replicas = nil
+		f.state.Records[recordKey(cmd.Record.Owner, cmd.Record.Key)] = cmd.Record
+	case "quota":
+		if cmd.Quota > 0 {
+			f.state.Quotas[cmd.Owner] = cmd.Quota
+		} else {
+			delete(f.state.Quotas, cmd.Owner)
+		}
+	default:
+		return fmt.Errorf("unknown metadata operation %q", cmd.Op)
+	}
+	return nil
+}
+
+// Snapshot captures the metadata for compacting the raft log.
+func (f *metaFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	buf, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, err
+	}
+	return metaSnapshot(buf), nil
+}
+
+// Restore replaces the metadata with a snapshot.
+func (f *metaFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	state := metaState{}
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	if state.Records == nil {
+		state.Records = make(map[string]ObjectRecord)
+	}
+	if state.Quotas == nil {
+		state.Quotas = make(map[string]int64)
+	}
+
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	return nil
+}
+
+// lookup returns the record of the file owner stored under key.
+func (f *metaFSM) lookup(owner string, key string) (ObjectRecord, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	rec, ok := f.state.Records[recordKey(owner, key)]
+	return rec, ok
+}
+
+// quota returns the quota of owner, zero if it has none.
+func (f *metaFSM) quota(owner string) int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.state.Quotas[owner]
+}
+
+// metaSnapshot is the JSON encoded metaState of a snapshot.
+type metaSnapshot []byte
+
+func (s metaSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s metaSnapshot) Release() {}
+
+// metaService is a raft node of the metadata cluster.
+type metaService struct {
+	raft      *raft.Raft
+	fsm       *metaFSM
+	transport *raft.NetworkTransport
+	logs      *raftboltdb.BoltStore
+}
+
+// startMeta starts the metadata service if the server runs raft.
+func (s *FileServer) startMeta() error {
+	if s.Meta == nil || len(s.Meta.BindAddr) == 0 {
+		return nil
+	}
+
+	dir := s.Meta.DataDir
+	if len(dir) == 0 {
+		dir = filepath.Clean(s.StorageRoot) + "_raft" // Next to the store, which owns everything below its root
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(s.ID)
+	config.LogOutput = log.Writer()
+	config.LogLevel = "WARN"
+
+	addr, err := net.ResolveTCPAddr("tcp", s.Meta.BindAddr)
+	if err != nil {
+		return err
+	}
+	transport, err := raft.NewTCPTransport(s.Meta.BindAddr, addr, 3, 10*time.Second, log.Writer())
+	if err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, log.Writer())
+	if err != nil {
+		transport.Close()
+		return err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		transport.Close()
+		return err
+	}
+
+	m := &metaService{fsm: newMetaFSM(), transport: transport, logs: logs}
+	if m.raft, err = raft.NewRaft(config, m.fsm, logs, logs, snapshots, transport); err != nil {
+		transport.Close()
+		logs.Close()
+		return err
+	}
+
+	if len(s.Meta.Bootstrap) > 0 {
+		existing, err := raft.HasExistingState(logs, logs, snapshots)
+		if err != nil {
+			m.close()
+			return err
+		}
+		if !existing {
+			var servers []raft.Server
+			for _, member := range s.Meta.Bootstrap {
+				servers = append(servers, raft.Server{ID: raft.ServerID(member.ID), Address: raft.ServerAddress(member.Addr)})
+			}
+			if err := m.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+				m.close()
+				return err
+			}
+		}
+	}
+
+	s.meta.Store(m)
+	return nil
+}
+
+// close shuts the raft node down.
+func (m *metaService) close() {
+	m.raft.Shutdown().Error()
+	m.transport.Close()
+	m.logs.Close()
+}
+
+// leader returns the server ID of the current leader, empty if there is none.
+func (m *metaService) leader() string {
+	_, id := m.raft.LeaderWithID()
+	return string(id)
+}
+
+// member reports whether the server with the given ID is a member of the
+// metadata cluster.
+func (m *metaService) member(id string) bool {
+	f := m.raft.GetConfiguration()
+	if f.Error() != nil {
+		return false
+	}
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.ID) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MetaLeader returns the server ID of the leader of the metadata cluster as
+// known to this server. It is empty while there is no leader or if this
+// server doesn't run raft.
+func (s *FileServer) MetaLeader() string {
+	m := s.meta.Load()
+	if m == nil {
+		return ""
+	}
+	return m.leader()
+}
+
+// Lookup returns the record of the file stored under key by this server. The
+// read is linearizable: it reflects every change committed before it.
+func (s *FileServer) Lookup(key string) (ObjectRecord, error) {
+	rec, err := s.LookupOwner(s.ID, s.hashKey(key))
+	if err != nil {
+		return ObjectRecord{}, err
+	}
+	rec.Key = key // The metadata service only knows its token
+	return rec, nil
+}
+
+// LookupOwner returns the record of the file owner stored under the key with
+// the lookup token key. Records are kept under tokens, so the metadata
+// service never learns keys; only the owner can derive the tokens of its own.
+func (s *FileServer) LookupOwner(owner string, key string) (ObjectRecord, error) {
+	reply, err := s.metaRequest(MessageMetaRequest{Owner: owner, Key: key})
+	if err != nil {
+		return ObjectRecord{}, err
+	}
+	if reply.Record == nil {
+		return ObjectRecord{}, fmt.Errorf("%w: no record of (%s)", ErrKeyNotFound, key)
+	}
+	return *reply.Record, nil
+}
+
+// SetQuota sets the number of bytes owner may store. Zero removes the quota.
+func (s *FileServer) SetQuota(owner string, bytes int64) error {
+	_, err := s.metaRequest(MessageMetaRequest{Command: &metaCommand{Op: "quota", Owner: owner, Quota: bytes}})
+	return err
+}
+
+// Quota returns the number of bytes owner may store, zero if it has no quota.
+func (s *FileServer) Quota(owner string) (int64, error) {
+	reply, err := s.metaRequest(MessageMetaRequest{Owner: owner, Quota: true})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Quota, nil
+}
+
+// recordStored records the replica set of a file this server just stored.
+// It is a no-op unless the metadata service is enabled.
+func (s *FileServer) recordStored(key string, size int64, replicas []string) {
+	if s.Meta == nil || isChunkKey(key) {
+		return
+	}
+
+	rec := ObjectRecord{Owner: s.ID, Key: s.hashKey(key), Size: size, Replicas: replicas, Updated: time.Now()}
+	if _, err := s.metaRequest(MessageMetaRequest{Command: &metaCommand{Op: "put", Record: rec}}); err != nil {
+		log.Printf("[%s] recording (%s) in the metadata service failed: %s", s.Transport.Addr(), key, err)
+	}
+}
+
+// recordDeleted records that a file of this server was deleted.
+func (s *FileServer) recordDeleted(key string) {
+	if s.Meta == nil || isChunkKey(key) {
+		return
+	}
+
+	rec := ObjectRecord{Owner: s.ID, Key: s.hashKey(key), Updated: time.Now()}
+	if _, err := s.metaRequest(MessageMetaRequest{Command: &metaCommand{Op: "delete", Record: rec}}); err != nil {
+		log.Printf("[%s] recording the delete of (%s) in the metadata service failed: %s", s.Transport.Addr(), key, err)
+	}
+}
+
+// MessageMetaRequest carries a metadata change or read to a peer running
+// raft. The peer answers on the same stream with a gob encoded metaReply.
+type MessageMetaRequest struct {
+	Command   *metaCommand // Change to commit, nil for reads
+	Owner     string       // Owner of the record or quota to read
+	Key       string       // Lookup token of the key of the record to read, ignored for quota reads
+	Quota     bool         // Read the quota of Owner instead of a record
+	Leader    bool         // Read the server ID of the leader instead of a record
+	Forwarded bool         // Sent by a follower to its leader, must not be forwarded again
+	From      string       // ID of the server the follower forwards the request of
+}
+
+// metaReply is the answer to a MessageMetaRequest.
+type metaReply struct {
+	Record    *ObjectRecord
+	Quota     int64
+	Leader    string
+	Err       string
+	Forbidden bool // The requesting server may not make the change
+}
+
+// metaRequest serves req on the leader of the metadata cluster: locally if
+// this server leads it, else by asking the leader, or, on servers not running
+// raft, any peer that does.
+func (s *FileServer) metaRequest(req MessageMetaRequest) (*metaReply, error) {
+	if s.Meta == nil {
+		return nil, ErrMetaDisabled
+	}
+
+	if m := s.meta.Load(); m != nil {
+		if m.raft.State() == raft.Leader {
+			return m.serve(req)
+		}
+		leader := m.leader()
+		if len(leader) == 0 {
+			return nil, ErrNoMetaLeader
+		}
+		if len(req.From) == 0 {
+			req.From = s.ID // Made by this server
+		}
+		for _, peer := range s.peerList() {
+			if peer.ID() == leader {
+				req.Forwarded = true
+				return s.askMeta(peer, req)
+			}
+		}
+		return nil, fmt.Errorf("%w: not connected to leader (%s)", ErrNoMetaLeader, leader)
+	}
+
+	err := errors.New("no peer runs the metadata service")
+	for _, peer := range s.peerList() {
+		reply, askErr := s.askMeta(peer, req)
+		if askErr == nil {
+			return reply, nil
+		}
+		err = askErr
+	}
+	return nil, err
+}
+
+// serve commits or reads req on the leader.
+func (m *metaService) serve(req MessageMetaRequest) (*metaReply, error) {
+	if req.Command != nil {
+		buf, err := json.Marshal(req.Command)
+		if err != nil {
+			return nil, err
+		}
+		f := m.raft.Apply(buf, metaApplyTimeout)
+		if err := f.Error(); err != nil {
+			return nil, err
+		}
+		if err, ok := f.Response().(error); ok {
+			return nil, err
+		}
+		return &metaReply{}, nil
+	}
+
+	// Make sure no newer leader has committed changes we don't know of
+	if err := m.raft.VerifyLeader().Error(); err != nil {
+		return nil, err
+	}
+	if req.Leader {
+		return &metaReply{Leader: m.leader()}, nil
+	}
+	if req.Quota {
+		return &metaReply{Quota: m.fsm.quota(req.Owner)}, nil
+	}
+	if rec, ok := m.fsm.lookup(req.Owner, req.Key); ok {
+		return &metaReply{Record: &rec}, nil
+	}
+	return &metaReply{}, nil
+}
+
+// askMeta sends req to peer and waits for the answer.
+func (s *FileServer) askMeta(peer p2p.Peer, req MessageMetaRequest) (*metaReply, error) {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return nil, err // The answer needs a stream of its own
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(metaPeerTimeout))
+
+	if err := writeMessage(stream, &Message{Payload: req}); err != nil {
+		return nil, err
+	}
+
+	reply := &metaReply{}
+	if err := gob.NewDecoder(stream).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Forbidden {
+		return nil, fmt.Errorf("(%s): %w", peer.RemoteAddr(), ErrForbidden)
+	}
+	if len(reply.Err) > 0 {
+		return nil, fmt.Errorf("(%s): %s", peer.RemoteAddr(), reply.Err)
+	}
+	return reply, nil
+}
+
+// handleMessageMetaRequest serves a metadata request from a peer, passing
+// it on to the leader if this server is a follower.
+func (s *FileServer) handleMessageMetaRequest(rpc p2p.RPC, req MessageMetaRequest) error {
+	if rpc.Conn == nil {
+		return errors.New("metadata requests need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	var (
+		reply *metaReply
+		err   error
+		m     = s.meta.Load()
+	)
+	if m == nil {
+		err = ErrMetaDisabled
+	} else if err = s.authorizeMeta(m, rpc.From, &req); err == nil {
+		if req.Forwarded && m.raft.State() != raft.Leader {
+			err = ErrNoMetaLeader // Leadership changed in the meantime
+		} else {
+			reply, err = s.metaRequest(req)
+		}
+	}
+	if err != nil {
+		reply = &metaReply{Err: err.Error(), Forbidden: errors.Is(err, ErrForbidden)}
+	}
+
+	return gob.NewEncoder(rpc.Conn).Encode(reply)
+}
+
+// authorizeMeta sets the server req was made by: the peer at addr, or the
+// server it forwards the request of if the peer is a member of the metadata
+// cluster. It returns ErrForbidden unless that server may make the change req
+// carries: changes to records of its own files, or to quotas if it is a
+// member or one of MetaOpts.Admins. Reads are allowed to every peer.
+func (s *FileServer) authorizeMeta(m *metaService, addr string, req *MessageMetaRequest) error {
+	peer, err := s.peer(addr)
+	if err != nil {
+		return err
+	}
+	if req.Forwarded && !m.member(peer.ID()) {
+		return fmt.Errorf("%w: (%s) isn't a member of the metadata cluster to forward requests", ErrForbidden, peer.ID())
+	}
+	if !req.Forwarded {
+		req.From = peer.ID()
+	}
+
+	cmd := req.Command
+	if cmd == nil {
+		return nil
+	}
+	switch cmd.Op {
+	case "quota":
+		if !m.member(req.From) && !slices.Contains(s.Meta.Admins, req.From) {
+			return fmt.Errorf("%w: (%s) may not set quotas", ErrForbidden, req.From)
+		}
+	default:
+		if cmd.Record.Owner != req.From || len(cmd.Owner) > 0 && cmd.Owner != req.From {
+			return fmt.Errorf("%w: (%s) may not change the records of (%s)", ErrForbidden, req.From, cmd.Record.Owner)
+		}
+	}
+	return nil
+}
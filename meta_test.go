@@ -0,0 +1,90 @@
+package dfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaService(t *testing.T) {
+	// s1 and s2 run raft, s3 and s4 only use the service through them
+	s1 := makeServer(t, "127.0.0.1:41190")
+	s2 := makeServer(t, "127.0.0.1:41191", "127.0.0.1:41190")
+	s3 := makeServer(t, "127.0.0.1:41192", "127.0.0.1:41190", "127.0.0.1:41191")
+	s4 := makeServer(t, "127.0.0.1:41194", "127.0.0.1:41190", "127.0.0.1:41191")
+
+	voters := []MetaServer{{ID: s1.ID, Addr: "127.0.0.1:41195"}, {ID: s2.ID, Addr: "127.0.0.1:41196"}}
+	admins := []string{s4.ID}
+	s1.Meta = &MetaOpts{BindAddr: voters[0].Addr, DataDir: t.TempDir(), Bootstrap: voters, Admins: admins}
+	s2.Meta = &MetaOpts{BindAddr: voters[1].Addr, DataDir: t.TempDir(), Admins: admins}
+	s3.Meta = &MetaOpts{}
+	s4.Meta = &MetaOpts{}
+
+	for _, s := range []*FileServer{s1, s2, s3, s4} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s3.Peers()) == 2 && len(s4.Peers()) == 2 && len(s1.Peers()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(s1.MetaLeader()) > 0 && s1.MetaLeader() == s2.MetaLeader() }, 10*time.Second, 50*time.Millisecond)
+	assert.Empty(t, s3.MetaLeader())
+
+	// Stores are recorded with the servers that received a copy.
+	assert.Nil(t, s3.Store("meta.txt", strings.NewReader("some data")))
+	rec, err := s3.Lookup("meta.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, s3.ID, rec.Owner)
+	assert.Equal(t, "meta.txt", rec.Key)
+	assert.Equal(t, int64(9), rec.Size)
+	assert.ElementsMatch(t, []string{s1.ID, s2.ID, s3.ID}, rec.Replicas)
+	assert.False(t, rec.Deleted)
+
+	// Every node sees the same record, whichever it asks, under the lookup
+	// token of the key.
+	for _, s := range []*FileServer{s1, s2} {
+		other, err := s.LookupOwner(s3.ID, s3.hashKey("meta.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, rec.Version, other.Version)
+		assert.Equal(t, s3.hashKey("meta.txt"), other.Key)
+	}
+	_, err = s1.LookupOwner(s3.ID, "meta.txt")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	assert.Nil(t, s3.Delete("meta.txt"))
+	rec, err = s3.Lookup("meta.txt")
+	assert.Nil(t, err)
+	assert.True(t, rec.Deleted)
+	assert.Empty(t, rec.Replicas)
+
+	_, err = s3.Lookup("missing")
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+
+	// Servers may only change the records of their own files, even when
+	// claiming to forward the request of another.
+	forged := ObjectRecord{Owner: s4.ID, Key: "forged.txt", Updated: time.Now()}
+	_, err = s3.metaRequest(MessageMetaRequest{Command: &metaCommand{Op: "put", Record: forged}})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = s3.metaRequest(MessageMetaRequest{Command: &metaCommand{Op: "delete", Record: forged}, Forwarded: true, From: s4.ID})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = s4.LookupOwner(s4.ID, "forged.txt")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Quotas are set by the members of the metadata cluster and the admins.
+	for _, s := range []*FileServer{s1, s2, s4} {
+		assert.Nil(t, s.SetQuota(s3.ID, 1024))
+	}
+	assert.ErrorIs(t, s3.SetQuota(s3.ID, 0), ErrForbidden)
+	quota, err := s1.Quota(s3.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), quota)
+}
+
+func TestMetaDisabled(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41193")
+
+	_, err := s.Lookup("key")
+	assert.True(t, errors.Is(err, ErrMetaDisabled))
+}
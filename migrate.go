@@ -0,0 +1,314 @@
+package dfs
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// identityFileName is the name of the file a migrated identity is kept in, inside the storage root.
+const identityFileName = "identity.json"
+
+// ErrMigrationRefused is returned when the target of a migration doesn't accept migrations.
+var ErrMigrationRefused = errors.New("migration refused by the target")
+
+// Identity is what makes a node itself: the ID its files are stored under,
+// the keys they are encrypted with, and the nodes it talks to. Migrating a
+// node hands its identity to the target, which takes it over when started
+// from the same storage root again.
+type Identity struct {
+	ID          string   `json:"id"`           // Node ID
+	EncKey      []byte   `json:"enc_key"`      // Key files are encrypted with
+	IdentityKey []byte   `json:"identity_key"` // X25519 key share bundles are wrapped with
+	Peers       []string `json:"peers"`        // Addresses the node's peers listen on
+
+	// DataKeys are the data keys of the files of the node wrapped by its
+	// KMS, see FileServerOpts.KMS, which the target must have access to.
+	DataKeys map[string][]byte `json:"data_keys,omitempty"`
+}
+
+// LoadIdentity returns the identity migrated to the storage root at root,
+// or nil if none was.
+func LoadIdentity(root string) (*Identity, error) {
+	buf, err := os.ReadFile(filepath.Join(root, identityFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{}
+	if err := json.Unmarshal(buf, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// MigrationInfo summarizes a migration done by MigrateTo.
+type MigrationInfo struct {
+	Target  string `json:"target"`  // Address of the node migrated to
+	Objects int    `json:"objects"` // Number of objects moved, replicas included
+	Bytes   int64  `json:"bytes"`   // Total size of the objects moved
+}
+
+// MessageMigrateObject moves an object to the target of a migration. The
+// object follows on the same stream; the target answers with a migrateAck
+// carrying the SHA-256 of what it stored.
+type MessageMigrateObject struct {
+	ID      string                   // Namespace (server ID) the object belongs to
+	Key     string                   // Key the object is stored under
+	Size    int64                    // Size of the object in bytes
+	ModTime time.Time                // Time the object was last written
+	Tags    map[string]string        // Tags of the object
+	Content *storage.ContentManifest // Manifest of the object, its checksum recomputed by the target
+}
+
+// MessageMigrateIdentity hands the identity of a node to the target of its
+// migration, once all objects are moved. The target answers with a migrateAck.
+type MessageMigrateIdentity struct {
+	Identity Identity
+}
+
+// MessageNodeMoved tells peers that the node with ID now lives at Addr.
+type MessageNodeMoved struct {
+	ID   string
+	Addr string
+}
+
+// migrateAck is the answer of the target of a migration.
+type migrateAck struct {
+	Sum string // Hex SHA-256 of the object stored, empty for identities
+	Err string // Why the target failed, empty if it didn't
+}
+
+// MigrateTo moves every object of the local store, replicas included, and
+// the identity of this server to the server at addr, which must set
+// AcceptMigration. Every object is checked against its SHA-256 after the
+// transfer. Peers are then told that this node moved to addr; the target
+// takes over once restarted from its storage root, see LoadIdentity.
+//
+// The identity includes the encryption key, so the connection to addr
+// should be encrypted.
+func (s *FileServer) MigrateTo(addr string) (MigrationInfo, error) {
+	info := MigrationInfo{Target: addr}
+
+	peer, err := s.peer(addr)
+	if err != nil {
+		if err := s.Connect(addr); err != nil {
+			return info, err
+		}
+		if peer, err = s.waitPeer(addr, redialWait); err != nil {
+			return info, err
+		}
+	}
+
+	// Copy-on-write view of the index, writers keep going
+	metas := slices.Collect(s.store.Objects())
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].ID != metas[j].ID {
+			return metas[i].ID < metas[j].ID
+		}
+		return metas[i].Key < metas[j].Key
+	})
+
+	for _, meta := range metas {
+		n, err := s.migrateObject(peer, meta)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted since the index was read
+		}
+		if err != nil {
+			return info, fmt.Errorf("migrating (%s) failed: %w", meta.Key, err)
+		}
+		info.Objects++
+		info.Bytes += n
+	}
+
+	identity := Identity{ID: s.ID, EncKey: s.EncKey, IdentityKey: s.IdentityKey.Bytes()}
+	if s.dataKeys != nil {
+		identity.DataKeys = s.dataKeys.snapshot()
+	}
+	for _, node := range s.ClusterState().Nodes {
+		if !node.Self && node.ID != peer.ID() && len(node.ID) > 0 {
+			identity.Peers = append(identity.Peers, node.Addr)
+		}
+	}
+	if _, err := s.migrateRequest(peer, &Message{Payload: MessageMigrateIdentity{Identity: identity}}, nil); err != nil {
+		return info, fmt.Errorf("migrating the identity failed: %w", err)
+	}
+
+	log.Printf("[%s] migrated %d objects (%d bytes) to (%s)", s.Transport.Addr(), info.Objects, info.Bytes, addr)
+	if err := s.broadcast(&Message{Payload: MessageNodeMoved{ID: s.ID, Addr: addr}}); err != nil {
+		log.Printf("[%s] telling peers about the move failed: %s", s.Transport.Addr(), err)
+	}
+	return info, nil
+}
+
+// waitPeer waits up to timeout for the peer at addr to connect.
+func (s *FileServer) waitPeer(addr string, timeout time.Duration) (p2p.Peer, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		peer, err := s.peer(addr)
+		if err == nil || time.Now().After(deadline) {
+			return peer, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// migrateObject sends a single object to peer and checks what it stored.
+func (s *FileServer) migrateObject(peer p2p.Peer, meta storage.ObjectMeta) (int64, error) {
+	size, r, err := s.store.Read(meta.ID, meta.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	msg := Message{Payload: MessageMigrateObject{ID: meta.ID, Key: meta.Key, Size: size, ModTime: meta.ModTime, Tags: meta.Tags, Content: meta.Content}}
+	ack, err := s.migrateRequest(peer, &msg, io.TeeReader(r, h))
+	if err != nil {
+		return 0, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); ack.Sum != sum {
+		return 0, fmt.Errorf("%w: sent %s, target stored %s", ErrChecksumMismatch, sum, ack.Sum)
+	}
+	return size, nil
+}
+
+// migrateRequest sends msg to peer on a stream of its own, followed by data
+// if not nil, and returns the answer.
+func (s *FileServer) migrateRequest(peer p2p.Peer, msg *Message, data io.Reader) (*migrateAck, error) {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return nil, err // Migrations need a stream per object
+	}
+	defer stream.Close()
+
+	if err := writeMessage(stream, msg); err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if _, err := io.Copy(stream, data); err != nil {
+			return nil, err
+		}
+	}
+
+	ack := &migrateAck{}
+	if err := gob.NewDecoder(stream).Decode(ack); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrMigrationRefused // Closed without an answer
+		}
+		return nil, err
+	}
+	if len(ack.Err) > 0 {
+		return nil, errors.New(ack.Err)
+	}
+	return ack, nil
+}
+
+// handleMessageMigrateObject stores an object moved to this server.
+func (s *FileServer) handleMessageMigrateObject(rpc p2p.RPC, msg MessageMigrateObject) error {
+	if rpc.Conn == nil || !s.AcceptMigration {
+		if rpc.Conn != nil {
+			rpc.Conn.Close()
+		}
+		return fmt.Errorf("[%s] refusing to take over (%s)", s.Transport.Addr(), msg.Key)
+	}
+	defer rpc.Conn.Close()
+
+	h := sha256.New()
+	n, err := s.store.Write(msg.ID, msg.Key, io.TeeReader(io.LimitReader(rpc.Conn, msg.Size), h))
+	if err == nil && n != msg.Size {
+		s.store.Delete(msg.ID, msg.Key)
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = s.store.UpdateMeta(msg.ID, msg.Key, func(meta *storage.ObjectMeta) {
+			meta.ModTime = msg.ModTime
+			meta.Tags = msg.Tags
+			meta.Content = meta.Content.DescribedAs(msg.Content)
+		})
+	}
+
+	ack := migrateAck{Sum: hex.EncodeToString(h.Sum(nil))}
+	if err != nil {
+		ack = migrateAck{Err: err.Error()}
+	}
+	return gob.NewEncoder(rpc.Conn).Encode(ack)
+}
+
+// handleMessageMigrateIdentity keeps the identity of the node migrated to
+// this server, to take it over when started from the storage root again.
+func (s *FileServer) handleMessageMigrateIdentity(rpc p2p.RPC, msg MessageMigrateIdentity) error {
+	if rpc.Conn == nil || !s.AcceptMigration {
+		if rpc.Conn != nil {
+			rpc.Conn.Close()
+		}
+		return fmt.Errorf("[%s] refusing to take over the identity of (%s)", s.Transport.Addr(), msg.Identity.ID)
+	}
+	defer rpc.Conn.Close()
+
+	err := s.saveIdentity(msg.Identity)
+	ack := migrateAck{}
+	if err != nil {
+		ack.Err = err.Error()
+	} else {
+		log.Printf("[%s] took over the identity of (%s), restart to assume it", s.Transport.Addr(), msg.Identity.ID)
+	}
+	return gob.NewEncoder(rpc.Conn).Encode(ack)
+}
+
+// saveIdentity persists id in the storage root, readable by its owner only.
+func (s *FileServer) saveIdentity(id Identity) error {
+	if _, err := ecdh.X25519().NewPrivateKey(id.IdentityKey); err != nil {
+		return fmt.Errorf("invalid identity key: %w", err)
+	}
+
+	buf, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StorageRoot, os.ModePerm); err != nil {
+		return err
+	}
+	path := filepath.Join(s.StorageRoot, identityFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// handleMessageNodeMoved records the new address of a node that moved and
+// drops the connection to its old one.
+func (s *FileServer) handleMessageNodeMoved(rpc p2p.RPC, msg MessageNodeMoved) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	// Only the node itself may say it moved
+	peer, err := s.peer(rpc.From)
+	if err != nil || peer.ID() != msg.ID {
+		return fmt.Errorf("[%s] ignoring move of (%s) announced by (%s)", s.Transport.Addr(), msg.ID, rpc.From)
+	}
+
+	log.Printf("[%s] node (%s) moved to (%s)", s.Transport.Addr(), msg.ID, msg.Addr)
+	s.knownPeers.Store(msg.ID, msg.Addr)
+	return s.Disconnect(rpc.From)
+}
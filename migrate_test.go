@@ -0,0 +1,60 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateTo(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41286", "127.0.0.1:41288")
+	s2 := makeServer(t, "127.0.0.1:41287")
+	s3 := makeServer(t, "127.0.0.1:41288")
+	s2.AcceptMigration = true
+	for _, s := range []*FileServer{s3, s2, s1} {
+		go s.Start()
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer s3.Stop()
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s1.Store("moving.txt", strings.NewReader("packed up")))
+	require.NoError(t, s1.store.SetTags(s1.ID, "moving.txt", map[string]string{"box": "1"}))
+
+	// Targets have to accept migrations
+	_, err := s1.MigrateTo("127.0.0.1:41288")
+	assert.ErrorIs(t, err, ErrMigrationRefused)
+
+	info, err := s1.MigrateTo("127.0.0.1:41287")
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Objects)
+	meta, ok := s2.store.Meta(s1.ID, "moving.txt")
+	require.True(t, ok)
+	assert.Equal(t, "1", meta.Tags["box"])
+
+	// Peers learn about the move and let go of the old node
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 0 }, time.Second, 10*time.Millisecond)
+	addr, _ := s3.knownPeers.Load(s1.ID)
+	assert.Equal(t, "127.0.0.1:41287", addr)
+
+	// Restarted from its storage root, the target is the migrated node
+	s1.Stop()
+	s2.Stop()
+	time.Sleep(100 * time.Millisecond)
+	moved := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41287", StorageRoot: s2.StorageRoot})
+	go moved.Start()
+	defer moved.Stop()
+	assert.Equal(t, s1.ID, moved.ID)
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, s1.ID, s3.Peers()[0].ID)
+
+	r, err := moved.Get("moving.txt")
+	require.NoError(t, err)
+	got, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "packed up", string(got))
+}
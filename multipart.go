@@ -0,0 +1,388 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+const (
+	maxUploadParts     = 10000          // Highest part number of a multipart upload
+	multipartUploadTTL = 24 * time.Hour // Uploads no part was added to for that long are aborted
+)
+
+// MultipartUpload is a file being uploaded in parts, see
+// CreateMultipartUpload.
+type MultipartUpload struct {
+	ID       string `json:"upload_id"`
+	Key      string `json:"key"`
+	PartSize int64  `json:"part_size"` // Every part but the last must be a multiple of it
+}
+
+// CompletedPart is a part to assemble a multipart upload from, with the ETag
+// its upload returned.
+type CompletedPart struct {
+	Part int    `json:"part"`
+	ETag string `json:"etag"`
+}
+
+// uploadedPart is a part of a multipart upload, stored as chunks.
+type uploadedPart struct {
+	etag   string
+	size   int64
+	chunks []ChunkRef
+}
+
+// multipartUpload is the state of a multipart upload in progress.
+type multipartUpload struct {
+	MultipartUpload
+	content storage.ContentManifest // Description of the file, recorded once it is complete
+	parts   map[int]uploadedPart    // Parts by number, the last upload of each
+	stored  map[string]bool         // Keys of every chunk stored for the upload, replaced parts included
+	touched time.Time               // Last time the upload was created or a part added
+}
+
+// uploadTable holds the multipart uploads in progress. Uploads live in memory
+// only, so they don't survive restarts.
+type uploadTable struct {
+	mu sync.Mutex
+	m  map[string]*multipartUpload
+}
+
+// get returns the upload with id, which must be of key. The caller must hold
+// t.mu.
+func (t *uploadTable) get(key string, id string) (*multipartUpload, error) {
+	u, ok := t.m[id]
+	if !ok || u.Key != key {
+		return nil, fmt.Errorf("%w: no multipart upload (%s) of (%s)", ErrKeyNotFound, id, key)
+	}
+	return u, nil
+}
+
+// referenced returns the keys of the chunks stored for the uploads of key
+// other than the one with id. The caller must hold t.mu.
+func (t *uploadTable) referenced(key string, id string) map[string]bool {
+	refs := make(map[string]bool)
+	for _, u := range t.m {
+		if u.Key != key || u.ID == id {
+			continue
+		}
+		for chunkKey := range u.stored {
+			refs[chunkKey] = true
+		}
+	}
+	return refs
+}
+
+// CreateMultipartUpload starts uploading the file under key in parts, which
+// are uploaded with UploadPart, in parallel and again if they fail, and
+// assembled into a chunked file by CompleteMultipartUpload. The content type,
+// filename and metadata of m describe the file once it is complete. Uploads
+// no part was added to for a day are aborted.
+func (s *FileServer) CreateMultipartUpload(key string, m storage.ContentManifest) (MultipartUpload, error) {
+	partSize := s.ChunkSize
+	if partSize <= 0 {
+		partSize = defaultChunkSize
+	}
+	u := &multipartUpload{
+		MultipartUpload: MultipartUpload{ID: crypto.GenerateID(), Key: key, PartSize: partSize},
+		content:         m,
+		parts:           make(map[int]uploadedPart),
+		stored:          make(map[string]bool),
+		touched:         time.Now(),
+	}
+
+	s.uploads.mu.Lock()
+	if s.uploads.m == nil {
+		s.uploads.m = make(map[string]*multipartUpload)
+	}
+	var expired []*multipartUpload
+	for _, other := range s.uploads.m {
+		if time.Since(other.touched) > multipartUploadTTL {
+			expired = append(expired, other)
+		}
+	}
+	s.uploads.m[u.ID] = u
+	s.uploads.mu.Unlock()
+
+	for _, other := range expired {
+		if err := s.AbortMultipartUpload(other.Key, other.ID); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return MultipartUpload{}, err
+		}
+	}
+	return u.MultipartUpload, nil
+}
+
+// UploadPart stores the data of r as the part numbered part, from 1 to 10000,
+// of the multipart upload id of key, replacing any earlier upload of that
+// part. It returns the ETag of the part, which CompleteMultipartUpload checks.
+func (s *FileServer) UploadPart(key string, id string, part int, r io.Reader) (string, error) {
+	return s.UploadPartContext(context.Background(), key, id, part, r)
+}
+
+// UploadPartContext is UploadPart, storing the part on behalf of the tenant
+// of ctx, see ContextWithTenant.
+func (s *FileServer) UploadPartContext(ctx context.Context, key string, id string, part int, r io.Reader) (string, error) {
+	if part < 1 || part > maxUploadParts {
+		return "", fmt.Errorf("part number %d is not between 1 and %d", part, maxUploadParts)
+	}
+	s.uploads.mu.Lock()
+	u, err := s.uploads.get(key, id)
+	s.uploads.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	// Parts are split into chunks as they are read
+	var (
+		p      uploadedPart
+		hashes []string
+		buf    = make([]byte, u.PartSize)
+	)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			ref, err := s.storeChunk(ctx, key, buf[:n])
+			if err != nil {
+				return "", err
+			}
+			p.chunks = append(p.chunks, ref)
+			p.size += ref.Size
+			hashes = append(hashes, ref.Hash)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if p.size == 0 {
+		return "", fmt.Errorf("part %d of (%s) is empty", part, key)
+	}
+	p.etag = s.Hasher.Sum([]byte(strings.Join(hashes, "")))
+
+	s.uploads.mu.Lock()
+	defer s.uploads.mu.Unlock()
+	if u, err = s.uploads.get(key, id); err != nil {
+		return "", err // Completed or aborted while the part was uploaded
+	}
+	u.parts[part] = p
+	for _, ref := range p.chunks {
+		u.stored[ref.Key] = true
+	}
+	u.touched = time.Now()
+	return p.etag, nil
+}
+
+// CompleteMultipartUpload assembles the parts of the multipart upload id of
+// key into the file stored under key, in the order of parts, which must be
+// ascending. The chunks of the parts are the chunks of the file, so nothing
+// is copied; every part but the last must thus be a multiple of the part
+// size. Chunks of the file it replaces and of parts left out are removed from
+// local disk.
+func (s *FileServer) CompleteMultipartUpload(key string, id string, parts []CompletedPart) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	s.uploads.mu.Lock()
+	u, err := s.uploads.get(key, id)
+	if err != nil {
+		s.uploads.mu.Unlock()
+		return err
+	}
+	m := &ChunkManifest{ChunkSize: u.PartSize}
+	for i, cp := range parts {
+		p, ok := u.parts[cp.Part]
+		switch {
+		case i > 0 && cp.Part <= parts[i-1].Part:
+			err = fmt.Errorf("parts of (%s) must be in ascending order", key)
+		case !ok:
+			err = fmt.Errorf("part %d of (%s) wasn't uploaded", cp.Part, key)
+		case strings.Trim(cp.ETag, `"`) != p.etag:
+			err = fmt.Errorf("part %d of (%s) has ETag %q, not %q", cp.Part, key, p.etag, cp.ETag)
+		case i < len(parts)-1 && p.size%u.PartSize != 0:
+			err = fmt.Errorf("part %d of (%s) is %d bytes, not a multiple of %d", cp.Part, key, p.size, u.PartSize)
+		}
+		if err != nil {
+			s.uploads.mu.Unlock()
+			return err
+		}
+		m.Chunks = append(m.Chunks, p.chunks...)
+		m.Size += p.size
+	}
+	s.uploads.mu.Unlock()
+	if len(parts) == 0 {
+		return fmt.Errorf("no parts to complete (%s) with", key)
+	}
+
+	unused := make(map[string]bool)
+	if prev := s.localManifest(key); prev != nil {
+		for _, ref := range prev.Chunks {
+			unused[ref.Key] = true
+		}
+	}
+	if err := s.Store(key, bytes.NewReader(m.encode())); err != nil {
+		return err
+	}
+	if !s.Gateway {
+		// The checksum of the manifest isn't the file's
+		s.store.UpdateMeta(s.ID, key, func(meta *storage.ObjectMeta) {
+			meta.Content = meta.Content.DescribedAs(&u.content)
+			meta.Content.Checksum = ""
+		})
+	}
+
+	s.uploads.mu.Lock()
+	delete(s.uploads.m, id)
+	for chunkKey := range u.stored {
+		unused[chunkKey] = true
+	}
+	for chunkKey := range s.uploads.referenced(key, id) {
+		delete(unused, chunkKey)
+	}
+	s.uploads.mu.Unlock()
+	for _, ref := range m.Chunks {
+		delete(unused, ref.Key)
+	}
+	for chunkKey := range unused {
+		s.store.Delete(s.ID, chunkKey)
+	}
+	return nil
+}
+
+// AbortMultipartUpload drops the multipart upload id of key, removing the
+// chunks of its parts from local disk unless the file under key uses them.
+func (s *FileServer) AbortMultipartUpload(key string, id string) error {
+	unlock := s.lockKey(key)
+	defer unlock()
+
+	s.uploads.mu.Lock()
+	u, err := s.uploads.get(key, id)
+	if err != nil {
+		s.uploads.mu.Unlock()
+		return err
+	}
+	delete(s.uploads.m, id)
+	keep := s.uploads.referenced(key, id)
+	s.uploads.mu.Unlock()
+
+	if m := s.localManifest(key); m != nil {
+		for _, ref := range m.Chunks {
+			keep[ref.Key] = true
+		}
+	}
+	for chunkKey := range u.stored {
+		if !keep[chunkKey] {
+			s.store.Delete(s.ID, chunkKey)
+		}
+	}
+	return nil
+}
+
+// localManifest returns the chunk manifest stored locally under key, nil
+// unless key holds a chunked file on local disk.
+func (s *FileServer) localManifest(key string) *ChunkManifest {
+	if !s.store.Has(s.ID, key) {
+		return nil
+	}
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return nil
+	}
+	if !isChunkManifest(r) {
+		r.Close()
+		return nil
+	}
+	m, err := readChunkManifest(r)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// serveMultipart answers the S3-style multipart upload requests on the file
+// under key, telling them apart by their query:
+//
+//	POST   ?uploads                   start an upload, see CreateMultipartUpload
+//	PUT    ?uploadId=&partNumber=     upload a part, see UploadPart
+//	POST   ?uploadId=                 complete the upload with a {"parts": [...]} body
+//	DELETE ?uploadId=                 abort the upload
+//
+// It reports whether r was one of them.
+func (s *FileServer) serveMultipart(w http.ResponseWriter, r *http.Request, key string) bool {
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		if err := s.checkACL(r.Context(), key, storage.PermWrite); err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		m, err := contentOf(r.Header)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		u, err := s.CreateMultipartUpload(key, m)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		writeJSON(w, http.StatusOK, u)
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		part, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid part number %q", query.Get("partNumber")))
+			return true
+		}
+		etag, err := s.UploadPartContext(r.Context(), key, id, part, r.Body)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		w.Header().Set("Etag", strconv.Quote(etag))
+		writeJSON(w, http.StatusOK, CompletedPart{Part: part, ETag: etag})
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var body struct {
+			Parts []CompletedPart `json:"parts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		if err := s.checkACL(r.Context(), key, storage.PermWrite); err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		if err := s.CompleteMultipartUpload(key, id, body.Parts); err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if err := s.AbortMultipartUpload(key, id); err != nil {
+			writeError(w, statusFor(err), err)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	s := newExportServer(t)
+	s.ChunkSize = 4
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	do := func(method string, url string, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := do(http.MethodPost, "/files/big.txt?uploads", "")
+	var u MultipartUpload
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&u))
+	res.Body.Close()
+	assert.Equal(t, MultipartUpload{ID: u.ID, Key: "big.txt", PartSize: 4}, u)
+
+	// Parts are uploaded in parallel, and again after failing.
+	parts := []string{"01234567", "abcd", "xyz"}
+	etags := make([]string, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := do(http.MethodPut, fmt.Sprintf("/files/big.txt?uploadId=%s&partNumber=%d", u.ID, i+1), part)
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			etags[i] = res.Header.Get("Etag")
+		}()
+	}
+	wg.Wait()
+	etag, err := s.UploadPart("big.txt", u.ID, 2, strings.NewReader("ABCD"))
+	require.NoError(t, err)
+	stale := etags[1]
+	etags[1] = etag
+
+	complete := func(parts ...CompletedPart) *http.Response {
+		body, _ := json.Marshal(map[string]any{"parts": parts})
+		return do(http.MethodPost, "/files/big.txt?uploadId="+u.ID, string(body))
+	}
+	res = complete(CompletedPart{1, etags[0]}, CompletedPart{2, stale})
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = complete(CompletedPart{3, etags[2]}, CompletedPart{2, etags[1]})
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = complete(CompletedPart{1, etags[0]}, CompletedPart{2, etags[1]}, CompletedPart{3, etags[2]})
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = do(http.MethodGet, "/files/big.txt", "")
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "01234567ABCDxyz", string(b))
+	assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+	m := manifestOf(t, s, "big.txt")
+	assert.Len(t, m.Chunks, 4)
+	assert.False(t, s.store.Has(s.ID, "big.txt#chunk-"+s.Hasher.Sum([]byte("abcd"))), "replaced part should be removed")
+	_, err = s.UploadPart("big.txt", u.ID, 4, strings.NewReader("late"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Parts must line up with the chunks, and aborted uploads leave nothing behind.
+	u, err = s.CreateMultipartUpload("big.txt", storage.ContentManifest{})
+	require.NoError(t, err)
+	etag1, err := s.UploadPart("big.txt", u.ID, 1, strings.NewReader("odd"))
+	require.NoError(t, err)
+	etag2, err := s.UploadPart("big.txt", u.ID, 2, bytes.NewReader([]byte("0123")))
+	require.NoError(t, err)
+	assert.Error(t, s.CompleteMultipartUpload("big.txt", u.ID, []CompletedPart{{1, etag1}, {2, etag2}}))
+	res = do(http.MethodDelete, "/files/big.txt?uploadId="+u.ID, "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.False(t, s.store.Has(s.ID, "big.txt#chunk-"+s.Hasher.Sum([]byte("odd"))))
+	assert.True(t, s.store.Has(s.ID, m.Chunks[0].Key), "chunks of the file should be kept")
+	assert.Equal(t, "01234567ABCDxyz", contentsOf(t, s, "big.txt"))
+}
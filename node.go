@@ -0,0 +1,221 @@
+package dfs
+
+import (
+	"crypto/ecdh"
+	"crypto/tls"
+	"log"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// NodeOpts configures a server talking to its peers over TCP, as run by dfsd.
+type NodeOpts struct {
+	ListenAddr     string            // Address the TCP transport listens on
+	AdvertiseAddr  string            // Address peers are told to dial this node at, ListenAddr if empty
+	StorageRoot    string            // Root directory for file storage, ListenAddr + "_network" if empty
+	BootstrapNodes []string          // Nodes to connect to on start
+	ID             string            // Node ID announced to peers, generated if empty
+	EncKey         []byte            // Encryption key of the files, generated if nil
+	AdminAddr      string            // Address to serve the admin HTTP API on, disabled if empty
+	Gateway        bool              // Stream stored files to peers without keeping them, see FileServerOpts.Gateway
+	EncryptAtRest  bool              // Encrypt the objects on disk, see storage.StoreOpts.EncryptAtRest
+	Protocol       int               // Highest protocol version spoken with peers, see p2p.HelloConfig.Version
+	NoCompression  bool              // Send messages to peers uncompressed, see p2p.HelloConfig.Compression
+	Zone           string            // Failure domain of the node, see FileServerOpts.Zone
+	Tier           string            // Storage tier of the node, see FileServerOpts.Tier
+	ColdAfter      time.Duration     // Move objects unused for that long to archive nodes, see TieringOpts, disabled if zero
+	Layout         storage.CASLayout // Directory layout of the store, storage.DefaultCASLayout if zero
+	SFTP           *SFTPOpts         // Serve the files over SFTP, disabled if nil
+	Swarm          *SwarmOpts        // Fetch large files from many peers at once, disabled if nil
+	Proofs         *ProofOpts        // Challenge peers to prove they still hold their replicas, disabled if nil
+	Auth           *AuthOpts         // Require credentials on the admin API, open to anyone if nil
+	CORS           *CORSOpts         // Answer cross-origin requests to the admin API, disabled if nil
+	AdminTLS       *tls.Config       // Serve the admin API over TLS, see FileServerOpts.AdminTLS
+
+	ReplicationQueue *ReplicationQueueOpts // Replicate files in the background by priority, disabled if nil
+	Relay            *RelayOpts            // Carry connections between peers that can't connect directly, disabled if nil
+	Fsck             bool                  // Check the store against its index and repair it on start, see storage.Store.Fsck
+	PackThreshold    int64                 // Pack objects of up to that many bytes into pack files, see storage.StoreOpts.PackThreshold, disabled if zero
+	MmapThreshold    int64                 // Read objects of at least that many bytes through a memory mapping, see storage.StoreOpts.MmapThreshold, disabled if zero
+
+	Immutable map[string]time.Duration // Write-once namespaces and the retention of their objects, see storage.StoreOpts.Immutable
+	Quotas    map[string]TenantQuota   // Storage and bandwidth quotas of the tenants of Auth, see FileServerOpts.Quotas
+	KMS       KMS                      // Wraps the keys of groups and files the node keeps on disk, see FileServerOpts.KMS
+
+	// PeerAuth authenticates the credentials peers present in the handshake,
+	// refusing peers whose credentials don't grant the admin scope; every
+	// peer is accepted if nil. PeerCredential is the credential the node
+	// presents to its peers, such as a token shared by the cluster.
+	PeerAuth       Authenticator
+	PeerCredential string
+
+	// Coordinator is the ID of the server placing new files on
+	// ReplicationFactor servers besides their owner, see
+	// FileServerOpts.Coordinator. If empty, files are replicated to
+	// ReplicationFactor peers picked by their key, every peer if zero.
+	Coordinator       string
+	ReplicationFactor int
+
+	// MaxStreams and MaxPeerStreams cap the streams handled at once overall
+	// and per peer, see FileServerOpts.MaxStreams; unlimited if zero.
+	MaxStreams     int
+	MaxPeerStreams int
+
+	// ForegroundIO and BackgroundIO cap the disk IO serving files and doing
+	// maintenance work at once, see FileServerOpts.ForegroundIO; unlimited
+	// if zero.
+	ForegroundIO int
+	BackgroundIO int
+}
+
+// NewNode returns a server with a multiplexed TCP transport, hashing keys and
+// content-addressing its store with SHA-256. A node migrated to the storage
+// root with MigrateTo takes precedence over ID and EncKey: the server takes
+// over its identity and reconnects with its peers. Stores laid out
+// differently than Layout are migrated to it with storage.MigrateLayout, and
+// checked and repaired with storage.Store.Fsck if Fsck is set.
+func NewNode(opts NodeOpts) *FileServer {
+	return newNode(opts, nil)
+}
+
+// newNode is NewNode, running over transport instead of a TCP transport of
+// its own if not nil. The options of the handshake are then up to the
+// transport, and so are its callbacks unless it is a TCP or UDP transport.
+func newNode(opts NodeOpts, transport p2p.Transport) *FileServer {
+	if len(opts.ListenAddr) == 0 && transport != nil {
+		opts.ListenAddr = transport.Addr()
+	}
+	if len(opts.StorageRoot) == 0 {
+		opts.StorageRoot = opts.ListenAddr + "_network"
+	}
+	if len(opts.ID) == 0 {
+		opts.ID = crypto.GenerateID() // Unique identifier of the server, announced to peers in the handshake.
+	}
+	if opts.EncKey == nil {
+		opts.EncKey = crypto.NewEncryptionKey()
+	}
+	var identityKey *ecdh.PrivateKey
+
+	// Take over the identity of a node migrated to this storage root.
+	if identity, err := LoadIdentity(opts.StorageRoot); err != nil {
+		log.Printf("loading the migrated identity failed: %s", err)
+	} else if identity != nil {
+		opts.ID, opts.EncKey = identity.ID, identity.EncKey
+		identityKey, _ = ecdh.X25519().NewPrivateKey(identity.IdentityKey)
+		opts.BootstrapNodes = append(opts.BootstrapNodes, identity.Peers...) // Reconnect with the peers of the node
+	}
+
+	// Move the objects of a store laid out differently before opening it.
+	if moved, err := storage.MigrateLayout(opts.StorageRoot, crypto.SHA256Hasher, opts.Layout); err != nil {
+		log.Printf("migrating the store layout failed: %s", err)
+	} else if moved > 0 {
+		log.Printf("moved %d objects to the new store layout", moved)
+	}
+
+	if transport == nil {
+		transport = newNodeTransport(opts)
+	}
+
+	// Define options for the FileServer, including encryption, storage path, and peer nodes.
+	fileServerOpts := FileServerOpts{
+		ID:             opts.ID,             // Same ID the handshake announces.
+		EncKey:         opts.EncKey,         // Encryption key for securing data.
+		IdentityKey:    identityKey,         // Key share bundles are wrapped with, generated if nil.
+		StorageRoot:    opts.StorageRoot,    // Root directory for file storage.
+		Hasher:         crypto.SHA256Hasher, // Hash keys and content-address the store with SHA-256.
+		Transport:      transport,           // Set the transport mechanism to the transport created earlier.
+		BootstrapNodes: opts.BootstrapNodes, // List of initial nodes to connect with for bootstrapping the network.
+		AdvertiseAddr:  opts.AdvertiseAddr,  // Address peers reach the server at.
+		AdminAddr:      opts.AdminAddr,      // Address of the admin HTTP API.
+		Gateway:        opts.Gateway,        // Whether to keep the files stored through the server.
+		EncryptAtRest:  opts.EncryptAtRest,  // Whether to encrypt the objects on disk.
+		Zone:           opts.Zone,           // Zone replicas are spread across.
+		Tier:           opts.Tier,           // Tier of the storage the node runs on.
+		Layout:         opts.Layout,         // Directory layout of the store.
+		SFTP:           opts.SFTP,           // SFTP server, disabled if nil.
+		Swarm:          opts.Swarm,          // Swarm downloads, disabled if nil.
+		Proofs:         opts.Proofs,         // Proof-of-storage challenges, disabled if nil.
+		Relay:          opts.Relay,          // Relay for other peers, disabled if nil.
+		Auth:           opts.Auth,           // Credentials required by the admin API, open if nil.
+		CORS:           opts.CORS,           // Cross-origin requests to the admin API, disabled if nil.
+		AdminTLS:       opts.AdminTLS,       // TLS of the admin API, plain HTTP if nil.
+		Immutable:      opts.Immutable,      // Write-once namespaces.
+	}
+	if opts.ColdAfter > 0 {
+		fileServerOpts.Tiering = &TieringOpts{ColdAfter: opts.ColdAfter} // Move unused objects to archive nodes.
+	}
+	fileServerOpts.ReplicationQueue = opts.ReplicationQueue // Background replication, disabled if nil.
+	fileServerOpts.PackThreshold = opts.PackThreshold       // Small objects packed together, disabled if zero.
+	fileServerOpts.MmapThreshold = opts.MmapThreshold       // Large objects read through a memory mapping, disabled if zero.
+	fileServerOpts.Quotas = opts.Quotas                     // Quotas of the tenants, unlimited if nil.
+	fileServerOpts.KMS = opts.KMS                           // KMS wrapping the keys on disk, derived from EncKey if nil.
+
+	// Place new files through the coordinator, if any.
+	fileServerOpts.Coordinator = opts.Coordinator
+	fileServerOpts.ReplicationFactor = opts.ReplicationFactor
+
+	// Take turns between peers once the streams are at their limits.
+	fileServerOpts.MaxStreams = opts.MaxStreams
+	fileServerOpts.MaxPeerStreams = opts.MaxPeerStreams
+
+	// Serve files before doing maintenance work on the disk.
+	fileServerOpts.ForegroundIO = opts.ForegroundIO
+	fileServerOpts.BackgroundIO = opts.BackgroundIO
+
+	// Create a new FileServer instance using the options defined above.
+	s := NewFileServer(fileServerOpts)
+
+	// Check the store before the node serves anything from it.
+	if opts.Fsck {
+		if report, err := s.Fsck(true); err != nil {
+			log.Printf("checking the store failed: %s", err)
+		} else {
+			log.Printf("checked %d objects: %d missing, %d unindexed (%d indexed again), %d corrupt, %d orphaned directories",
+				report.Objects, len(report.Missing), len(report.Unindexed), len(report.Reindexed), len(report.Corrupt), len(report.Orphans))
+		}
+	}
+
+	switch t := transport.(type) {
+	case *p2p.TCPTransport:
+		// Set the OnPeer callback function for handling new peer connections.
+		t.OnPeer = s.OnPeer
+		// Forget peers again once they disconnect.
+		t.OnPeerDisconnect = s.OnPeerDisconnect
+		// Penalize peers sending messages the transport rejects.
+		t.OnProtocolError = s.OnProtocolError
+	case *p2p.UDPTransport:
+		t.OnPeer, t.OnPeerDisconnect, t.OnProtocolError = s.OnPeer, s.OnPeerDisconnect, s.OnProtocolError
+	}
+
+	return s
+}
+
+// newNodeTransport returns the multiplexed TCP transport of the node
+// described by opts.
+func newNodeTransport(opts NodeOpts) *p2p.TCPTransport {
+	// Announce the node ID, its zone, its tier, the protocol versions it speaks
+	// and the compression of messages it reads in the handshake.
+	hello := p2p.HelloConfig{NodeID: opts.ID, Version: opts.Protocol, Zone: opts.Zone, Tier: opts.Tier}
+	if !opts.NoCompression {
+		hello.Compression = []string{p2p.CompressionZstd}
+	}
+	// Present the credential of the node and check those of its peers.
+	hello.Credential = opts.PeerCredential
+	if opts.PeerAuth != nil {
+		hello.Authenticate = peerAuthenticator(opts.PeerAuth)
+	}
+
+	// Define TCP transport options, including the listening address and handshake function.
+	tcptransportOpts := p2p.TCPTransportOpts{
+		ListenAddr:    opts.ListenAddr,                  // Address on which the server listens for connections.
+		AdvertiseAddr: opts.AdvertiseAddr,               // Address peers dial back, announced in the handshake.
+		HandshakeFunc: p2p.NewHelloHandshakeFunc(hello), // Exchange node IDs and protocol versions.
+		Decoder:       p2p.DefaultDecoder{},             // Default message decoder for incoming data.
+		Multiplex:     true,                             // Run transfers on their own streams.
+	}
+	// Create a new TCP transport instance based on the options provided.
+	return p2p.NewTCPTransport(tcptransportOpts)
+}
@@ -0,0 +1,70 @@
+package dfs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeServer returns a node listening on listenAddr, storing its files in a
+// temporary directory of t and bootstrapping from nodes.
+func makeServer(t testing.TB, listenAddr string, nodes ...string) *FileServer {
+	return NewNode(NodeOpts{ListenAddr: listenAddr, StorageRoot: t.TempDir(), BootstrapNodes: nodes})
+}
+
+func TestNewNode(t *testing.T) {
+	root := t.TempDir()
+	key := crypto.NewEncryptionKey()
+	s := NewNode(NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: root, ID: "node", EncKey: key, AdminAddr: "127.0.0.1:0"})
+	assert.Equal(t, "node", s.ID)
+	assert.Equal(t, key, s.EncKey)
+	assert.Equal(t, root, s.StorageRoot)
+	assert.NotNil(t, s.admin)
+
+	// A migrated identity takes precedence.
+	identity := Identity{ID: "migrated", EncKey: crypto.NewEncryptionKey(), Peers: []string{"127.0.0.1:1"}}
+	buf, err := json.Marshal(identity)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, identityFileName), buf, 0o600))
+	s = NewNode(NodeOpts{ListenAddr: "127.0.0.1:0", StorageRoot: root, ID: "node", EncKey: key, BootstrapNodes: []string{"127.0.0.1:2"}})
+	assert.Equal(t, "migrated", s.ID)
+	assert.Equal(t, identity.EncKey, s.EncKey)
+	assert.Equal(t, []string{"127.0.0.1:2", "127.0.0.1:1"}, s.BootstrapNodes)
+
+	s = NewNode(NodeOpts{ListenAddr: "127.0.0.1:41295"})
+	defer os.RemoveAll(s.StorageRoot)
+	assert.Equal(t, "127.0.0.1:41295_network", s.StorageRoot)
+	assert.Len(t, s.ID, 64)
+	assert.Len(t, s.EncKey, 32)
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	// s1 is reached through an address other than the one it listens on,
+	// as behind NAT or a container port mapping.
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41297", StorageRoot: t.TempDir(), AdvertiseAddr: "dfs1.example:3000"})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41298", StorageRoot: t.TempDir(), AdvertiseAddr: "dfs2.example:3000", BootstrapNodes: []string{"127.0.0.1:41297"}})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// Peers are known by the address they announced, not the one they connect from.
+	assert.Equal(t, "dfs2.example:3000", s1.Peers()[0].AdvertisedAddr)
+	assert.Equal(t, "dfs1.example:3000", s2.Peers()[0].AdvertisedAddr)
+	addr, _ := s1.knownPeers.Load(s2.ID)
+	assert.Equal(t, "dfs2.example:3000", addr)
+
+	var addrs []string
+	for _, node := range s2.ClusterState().Nodes {
+		addrs = append(addrs, node.Addr)
+	}
+	assert.ElementsMatch(t, []string{"dfs1.example:3000", "dfs2.example:3000"}, addrs)
+}
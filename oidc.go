@@ -0,0 +1,278 @@
+package dfs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcKeysTTL      = time.Hour   // How long the keys of a provider are used before they are fetched again
+	oidcRefetchAfter = time.Minute // How long tokens signed with unknown keys wait before the keys are fetched again
+)
+
+// OIDCAuthenticator authenticates the tokens issued by an OpenID Connect
+// provider, such as Keycloak, Okta, Auth0 or Google, verifying their RS256
+// or ES256 signature with the keys the provider publishes. The keys are
+// found through the discovery document of the provider and fetched again
+// every hour, or when a token is signed with a key not seen before.
+type OIDCAuthenticator struct {
+	Issuer   string       // URL of the provider, which tokens must be issued by; its discovery document is at <Issuer>/.well-known/openid-configuration
+	Audience string       // Audience tokens must be issued for, such as the client ID of the gateway; any if empty
+	Client   *http.Client // Client fetching the keys, http.DefaultClient if nil
+
+	// ScopeClaim is the claim listing what a token allows, as a space
+	// separated string or a list, such as "groups" or "roles"; "scope" if
+	// empty. Scopes maps its values to the scope they grant, the broadest
+	// one counting; values named read, write and admin grant those scopes
+	// if nil.
+	ScopeClaim string
+	Scopes     map[string]Scope
+
+	TenantClaim string // Claim naming the tenant of a token, see FileServerOpts.Quotas; tokens have none if empty
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // Keys of the provider by key ID
+	fetched time.Time                   // When the keys were last fetched
+}
+
+// Authenticate returns the principal of the token of c, whose subject is
+// the "sub" claim of the token.
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, c Credentials) (Principal, error) {
+	invalid := func(reason string) (Principal, error) {
+		return Principal{}, fmt.Errorf("%w: invalid OIDC token: %s", ErrUnauthorized, reason)
+	}
+	if len(c.Token) == 0 {
+		return Principal{}, fmt.Errorf("%w: no token", ErrUnauthorized)
+	}
+
+	var (
+		header jwtHeader
+		claims map[string]any
+	)
+	signed, sig, err := decodeJWT(c.Token, &header, &claims)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return Principal{}, err
+	}
+	if err := verifySignature(header.Alg, key, signed, sig); err != nil {
+		return invalid(err.Error())
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.Issuer {
+		return invalid(fmt.Sprintf("issued by %q, not %q", iss, a.Issuer))
+	}
+	if len(a.Audience) > 0 && !slices.Contains(claimValues(claims["aud"]), a.Audience) {
+		return invalid("not issued for " + a.Audience)
+	}
+	times := jwtTimes{Exp: numericClaim(claims["exp"]), Nbf: numericClaim(claims["nbf"])}
+	if times.Exp == nil {
+		return invalid("no expiry")
+	}
+	if reason := times.check(time.Now()); reason != "" {
+		return invalid(reason)
+	}
+
+	scopeClaim := a.ScopeClaim
+	if len(scopeClaim) == 0 {
+		scopeClaim = "scope"
+	}
+	var scope Scope
+	for _, v := range claimValues(claims[scopeClaim]) {
+		s, ok := a.Scopes[v]
+		if a.Scopes == nil {
+			s, err = ParseScope(v)
+			ok = err == nil
+		}
+		if ok {
+			scope = max(scope, s)
+		}
+	}
+	if scope == 0 {
+		return invalid("no scope in the " + scopeClaim + " claim")
+	}
+	p := Principal{Scope: scope}
+	p.Subject, _ = claims["sub"].(string)
+	if len(a.TenantClaim) > 0 {
+		p.Tenant, _ = claims[a.TenantClaim].(string)
+	}
+	return p, nil
+}
+
+// numericClaim returns the value of a claim holding seconds since the epoch,
+// nil if it holds none.
+func numericClaim(claim any) *int64 {
+	f, ok := claim.(float64)
+	if !ok {
+		return nil
+	}
+	v := int64(f)
+	return &v
+}
+
+// claimValues returns the values of a claim holding a space separated
+// string or a list of strings.
+func claimValues(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// verifySignature verifies the RS256 or ES256 signature sig of signed.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || k.Curve != elliptic.P256() {
+			break
+		}
+		if len(sig) != 64 {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s doesn't match the key", alg)
+}
+
+// key returns the key of the provider with the key ID kid, fetching the keys
+// if they are stale or kid isn't among them.
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetched) >= oidcKeysTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(a.fetched) >= oidcRefetchAfter {
+		keys, err := a.fetchKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetching the keys of %s: %w", a.Issuer, err)
+		}
+		a.keys, a.fetched = keys, time.Now()
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid OIDC token: unknown key %q", ErrUnauthorized, kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is a key of a JSON Web Key Set, RSA or elliptic curve.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys fetches the signing keys of the provider, by key ID, from the
+// JWKS its discovery document points to.
+func (a *OIDCAuthenticator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != a.Issuer {
+		return nil, fmt.Errorf("discovery document names issuer %q", discovery.Issuer)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	enc := base64.RawURLEncoding
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := enc.DecodeString(k.N)
+			e, errE := enc.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := enc.DecodeString(k.X)
+			y, errY := enc.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+// getJSON decodes the JSON document at url into v.
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v any) error {
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,90 @@
+package dfs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	enc := base64.RawURLEncoding
+
+	var fetches atomic.Int32
+	mux := http.NewServeMux()
+	provider := httptest.NewServer(mux)
+	defer provider.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": provider.URL, "jwks_uri": provider.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kid: "key-1", Kty: "RSA", Use: "sig",
+			N: enc.EncodeToString(key.N.Bytes()), E: enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	sign := func(kid string, claims map[string]any) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+		body, _ := json.Marshal(claims)
+		unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+		digest := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return unsigned + "." + enc.EncodeToString(sig)
+	}
+	claims := func(aud string, exp time.Time) map[string]any {
+		return map[string]any{"iss": provider.URL, "aud": aud, "sub": "alice", "exp": exp.Unix(), "groups": []string{"staff", "dfs-writers"}, "org": "acme"}
+	}
+
+	a := &OIDCAuthenticator{
+		Issuer:      provider.URL,
+		Audience:    "dfs",
+		ScopeClaim:  "groups",
+		Scopes:      map[string]Scope{"dfs-readers": ScopeRead, "dfs-writers": ScopeWrite},
+		TenantClaim: "org",
+	}
+	authenticate := func(token string) (Principal, error) {
+		return a.Authenticate(context.Background(), Credentials{Token: token})
+	}
+
+	p, err := authenticate(sign("key-1", claims("dfs", time.Now().Add(time.Hour))))
+	require.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "alice", Scope: ScopeWrite, Tenant: "acme"}, p)
+
+	_, err = authenticate(sign("key-1", claims("other-app", time.Now().Add(time.Hour))))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	_, err = authenticate(sign("key-1", claims("dfs", time.Now().Add(-time.Minute))))
+	assert.ErrorContains(t, err, "expired")
+	forged := sign("key-1", claims("dfs", time.Now().Add(time.Hour)))
+	_, err = authenticate(forged[:len(forged)-4] + "AAAA")
+	assert.ErrorContains(t, err, "bad signature")
+	assert.EqualValues(t, 1, fetches.Load(), "keys are cached")
+
+	// Tokens signed with unknown keys are refused, the keys fetched again at
+	// most once a minute.
+	_, err = authenticate(sign("key-2", claims("dfs", time.Now().Add(time.Hour))))
+	assert.ErrorContains(t, err, "unknown key")
+	_, err = authenticate(sign("key-2", claims("dfs", time.Now().Add(time.Hour))))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.EqualValues(t, 1, fetches.Load())
+	a.fetched = a.fetched.Add(-oidcRefetchAfter)
+	_, err = authenticate(sign("key-2", claims("dfs", time.Now().Add(time.Hour))))
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.EqualValues(t, 2, fetches.Load())
+}
@@ -0,0 +1,41 @@
+package p2p
+
+import "sync"
+
+// bufferPool hands out byte slices of a fixed size for reuse, so hot read
+// and write paths don't allocate a new buffer per call.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+var (
+	messagePool = newBufferPool(DefaultMaxMessageSize + 1)         // Messages read by DefaultDecoder
+	framePool   = newBufferPool(frameHeaderSize + maxFramePayload) // Frames written by a Session
+	noisePool   = newBufferPool(2 + noiseMaxMessage)               // Noise transport messages
+)
+
+// newBufferPool returns a pool of size byte buffers.
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// get returns a buffer of the pool's size. It must be put back once the
+// caller is done with it and holds no references into it.
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns b to the pool.
+func (p *bufferPool) put(b *[]byte) {
+	if cap(*b) < p.size {
+		return
+	}
+	*b = (*b)[:p.size]
+	p.pool.Put(b)
+}
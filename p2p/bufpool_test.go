@@ -0,0 +1,107 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(16)
+
+	b := p.get()
+	assert.Len(t, *b, 16)
+
+	// Buffers come back at full length however they were resliced.
+	*b = (*b)[:3]
+	p.put(b)
+	assert.Len(t, *p.get(), 16)
+
+	// Buffers too small for the pool are left to the garbage collector.
+	small := make([]byte, 8)
+	p.put(&small)
+	assert.Len(t, *p.get(), 16)
+}
+
+func TestDefaultDecoderCopiesPayload(t *testing.T) {
+	var first, second RPC
+	assert.Nil(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{IncomingMessage, 'a', 'b'}), &first))
+	assert.Nil(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{IncomingMessage, 'c', 'd'}), &second))
+
+	// The pooled buffer is reused; payloads must not share it.
+	assert.Equal(t, []byte("ab"), first.Payload)
+	assert.Equal(t, []byte("cd"), second.Payload)
+}
+
+func BenchmarkDefaultDecoder(b *testing.B) {
+	msg := append([]byte{IncomingMessage}, bytes.Repeat([]byte("m"), 512)...)
+	r := bytes.NewReader(msg)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		var rpc RPC
+		if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSessionWrite(b *testing.B) {
+	s1, s2 := newSessionPair()
+	defer s1.Close()
+	defer s2.Close()
+
+	go func() {
+		st, err := s2.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, st)
+	}()
+	st, err := s1.Open()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+
+	payload := make([]byte, 256*1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := st.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNoiseConn(b *testing.B) {
+	k1, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	k2, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p1, p2, err1, err2 := handshakePair(
+		NewNoiseHandshakeFunc(NoiseConfig{StaticKey: k1}),
+		NewNoiseHandshakeFunc(NoiseConfig{StaticKey: k2}),
+	)
+	if err1 != nil || err2 != nil {
+		b.Fatal(err1, err2)
+	}
+	defer p1.Close()
+	defer p2.Close()
+
+	go io.Copy(io.Discard, p2)
+
+	payload := make([]byte, 256*1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p1.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// readFromChunk is the most ReadFrom hands the underlying connection at once
+// when writes have a timeout.
+const readFromChunk = 256 * 1024
+
+// deadlineConn is a net.Conn whose every Read and Write has to make progress
+// within a timeout, so a peer that stops responding fails the operation
+// instead of blocking it forever. Long transfers are fine as long as data keeps flowing.
+type deadlineConn struct {
+	net.Conn
+	read  time.Duration // Timeout of each Read, 0 for none.
+	write time.Duration // Timeout of each Write, 0 for none.
+
+	mu            sync.Mutex
+	readDeadline  time.Time // Deadline set by the user, applied on top of the timeouts.
+	writeDeadline time.Time
+}
+
+// WithTimeouts returns conn with every Read failing after read and every
+// Write after write without progress. A zero timeout leaves that direction
+// unbounded. Deadlines set on the returned connection still apply.
+func WithTimeouts(conn net.Conn, read time.Duration, write time.Duration) net.Conn {
+	if read <= 0 && write <= 0 {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, read: read, write: write}
+}
+
+// WithoutTimeouts returns conn without the timeouts WithTimeouts gave it, for
+// connections that may stay idle, such as streams carrying a whole connection.
+func WithoutTimeouts(conn net.Conn) net.Conn {
+	c, ok := conn.(*deadlineConn)
+	if !ok {
+		return conn
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn.SetReadDeadline(c.readDeadline) // Drop the deadline of the last timeout
+	c.Conn.SetWriteDeadline(c.writeDeadline)
+	return c.Conn
+}
+
+// Read reads from the connection, failing if no data arrives in time.
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(earliest(c.readDeadline, time.Now().Add(c.read)))
+		c.mu.Unlock()
+	}
+	return c.Conn.Read(b)
+}
+
+// Write writes to the connection, failing if it doesn't take the data in time.
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		c.mu.Lock()
+		c.Conn.SetWriteDeadline(earliest(c.writeDeadline, time.Now().Add(c.write)))
+		c.mu.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+// ReadFrom copies r to the connection. The copy is left to the underlying
+// connection, which may use sendfile; with a write timeout it is handed
+// readFromChunk bytes at a time, each due within the timeout.
+func (c *deadlineConn) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{c}, r)
+	}
+	if c.write <= 0 {
+		return rf.ReadFrom(r)
+	}
+
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: r, N: math.MaxInt64}
+	}
+	var written int64
+	for lr.N > 0 {
+		c.mu.Lock()
+		c.Conn.SetWriteDeadline(earliest(c.writeDeadline, time.Now().Add(c.write)))
+		c.mu.Unlock()
+
+		chunk := min(lr.N, readFromChunk)
+		n, err := rf.ReadFrom(&io.LimitedReader{R: lr.R, N: chunk})
+		written += n
+		lr.N -= n
+		if err != nil || n < chunk {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline Reads fail at, whatever the timeout.
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline Writes fail at, whatever the timeout.
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the earlier of the deadline a, zero meaning none, and b.
+func earliest(a time.Time, b time.Time) time.Time {
+	if !a.IsZero() && a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := WithTimeouts(c1, 50*time.Millisecond, 50*time.Millisecond)
+	defer conn.Close()
+
+	// Nothing arrives, the read gives up.
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Nobody reads, the write gives up.
+	_, err = conn.Write([]byte("x"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// The timeout restarts with every read, so a slow but steady peer is fine.
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(30 * time.Millisecond)
+			c2.Write([]byte{byte(i)})
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		b := make([]byte, 1)
+		_, err := conn.Read(b)
+		assert.Nil(t, err)
+		assert.Equal(t, byte(i), b[0])
+	}
+
+	// An earlier deadline set by the user wins.
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	start = time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+
+	// Zero timeouts leave the connection as it is.
+	assert.Equal(t, c2, WithTimeouts(c2, 0, 0))
+
+	assert.Equal(t, c1, WithoutTimeouts(conn))
+	assert.Equal(t, c2, WithoutTimeouts(c2))
+}
+
+func TestTCPTransportHandshakeTimeout(t *testing.T) {
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       "127.0.0.1:41230",
+		HandshakeTimeout: 100 * time.Millisecond,
+		HandshakeFunc:    NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"}),
+		Decoder:          DefaultDecoder{},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	// A client that connects but never says hello is dropped.
+	conn, err := net.Dial("tcp", "127.0.0.1:41230")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 512)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			break // The listener's hello, then the connection closing
+		}
+	}
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestDeadlineConnReadFrom(t *testing.T) {
+	conn := WithTimeouts(tcpPair(t, io.Discard), 0, time.Second)
+	defer conn.Close()
+
+	// Files are handed to the connection a chunk at a time, to the end or
+	// to the limit they are read up to.
+	n, err := conn.(io.ReaderFrom).ReadFrom(tempFile(t, 1<<20+1))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1<<20+1, n)
+	n, err = conn.(io.ReaderFrom).ReadFrom(&io.LimitedReader{R: tempFile(t, 1<<20), N: 300_000})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 300_000, n)
+}
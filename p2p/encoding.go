@@ -2,50 +2,110 @@ package p2p
 
 import (
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// DefaultMaxMessageSize is the largest message the decoders accept unless
+// configured otherwise, the payload of a single multiplexed frame. Messages
+// only announce data; the data itself follows as a stream of any size.
+const DefaultMaxMessageSize = maxFramePayload
+
+var (
+	// ErrInvalidMessage is returned for bytes that aren't a message.
+	ErrInvalidMessage = errors.New("p2p: invalid message")
+	// ErrOversizedMessage is returned for received messages over the maximum message size.
+	ErrOversizedMessage = errors.New("p2p: message exceeds the maximum message size")
+)
+
 // Decoder is an interface for decoding messages from an io.Reader into an RPC struct.
 type Decoder interface {
 	Decode(io.Reader, *RPC) error // Decode reads from the provided io.Reader and decodes the data into the given RPC struct.
 }
 
+// IsProtocolError reports whether err is a decoder rejecting what a peer sent.
+func IsProtocolError(err error) bool {
+	return errors.Is(err, ErrInvalidMessage) || errors.Is(err, ErrOversizedMessage)
+}
+
+// maxSize returns limit, or DefaultMaxMessageSize if it isn't set.
+func maxSize(limit int) int {
+	if limit <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return limit
+}
+
 // GOBDecoder is a struct that implements the Decoder interface using Go's gob encoding.
-type GOBDecoder struct{}
+type GOBDecoder struct {
+	MaxMessageSize int // Largest message accepted, in encoded bytes (default DefaultMaxMessageSize).
+}
 
 // Decode reads from the given io.Reader and decodes the data into the provided RPC struct using gob encoding.
+// It reads no more than the maximum message size, so a peer can't make it allocate or wait for more.
 func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
-	return gob.NewDecoder(r).Decode(msg)
+	max := maxSize(dec.MaxMessageSize)
+	lr := &io.LimitedReader{R: r, N: int64(max) + 1}
+	if err := gob.NewDecoder(lr).Decode(msg); err != nil {
+		if lr.N <= 0 {
+			return ErrOversizedMessage
+		}
+		return err
+	}
+	if len(msg.Payload) > max {
+		return ErrOversizedMessage
+	}
+	return nil
 }
 
 // DefaultDecoder is a struct that implements the Decoder interface using custom logic.
-type DefaultDecoder struct{}
+type DefaultDecoder struct {
+	MaxMessageSize int // Largest message accepted, marker excluded (default DefaultMaxMessageSize).
+}
 
 // Decode reads from the given io.Reader and decodes the data into the provided RPC struct.
 // It handles both regular messages and incoming streams.
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
+	max := maxSize(dec.MaxMessageSize)
+	var buf *[]byte
+	if max > DefaultMaxMessageSize {
+		large := make([]byte, max+1) // Too large for the pooled buffers
+		buf = &large
+	} else {
+		buf = messagePool.get()
+		defer messagePool.put(buf)
+	}
+
 	// Peek at the first byte to determine if the incoming data is a stream.
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil // If there's an error reading the first byte, return nil.
+	if _, err := io.ReadFull(r, (*buf)[:1]); err != nil {
+		return err // The connection is gone, there is nothing left to decode.
 	}
 
-	// Check if the first byte indicates an incoming stream.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch marker := (*buf)[0]; marker {
+	case IncomingStream:
 		msg.Stream = true // Mark the RPC message as a stream.
 		return nil        // No further decoding needed for streams.
+	case IncomingMessage:
+	default:
+		return fmt.Errorf("%w: unknown marker %#x", ErrInvalidMessage, marker)
 	}
 
-	// If not a stream, read the remaining data into a buffer.
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
-		return err // Return any error encountered while reading the data.
+	// If not a stream, read the remaining data into the buffer, reading one
+	// byte more than the largest message to tell one that is too large.
+	n, err := r.Read((*buf)[:max+1])
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%w: empty message", ErrInvalidMessage)
+		}
+		return err
+	}
+	if n > max {
+		return ErrOversizedMessage
 	}
 
-	// Set the RPC's payload to the data read from the buffer.
-	msg.Payload = buf[:n]
+	// Set the RPC's payload to a copy of the data, the buffer is reused.
+	msg.Payload = append([]byte(nil), (*buf)[:n]...)
 
 	return nil
 }
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderRejectsMalformed(t *testing.T) {
+	var rpc RPC
+
+	// A closed connection is an error, not an empty message read forever
+	assert.ErrorIs(t, DefaultDecoder{}.Decode(bytes.NewReader(nil), &rpc), io.EOF)
+	assert.ErrorIs(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{0x7f, 'a'}), &rpc), ErrInvalidMessage)
+	assert.ErrorIs(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{IncomingMessage}), &rpc), ErrInvalidMessage)
+
+	big := append([]byte{IncomingMessage}, make([]byte, DefaultMaxMessageSize+1)...)
+	assert.ErrorIs(t, DefaultDecoder{}.Decode(bytes.NewReader(big), &rpc), ErrOversizedMessage)
+
+	assert.Nil(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{IncomingStream}), &rpc))
+	assert.True(t, rpc.Stream)
+}
+
+func TestGOBDecoderRejectsOversized(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, gob.NewEncoder(buf).Encode(RPC{Payload: make([]byte, DefaultMaxMessageSize+1)}))
+
+	var rpc RPC
+	assert.ErrorIs(t, GOBDecoder{}.Decode(buf, &rpc), ErrOversizedMessage)
+}
+
+// FuzzDefaultDecoder feeds arbitrary bytes from a peer to the DefaultDecoder,
+// which has to return without panicking and within the maximum message size.
+func FuzzDefaultDecoder(f *testing.F) {
+	f.Add([]byte{IncomingMessage, 'h', 'i'})
+	f.Add([]byte{IncomingStream})
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, r := range []io.Reader{bytes.NewReader(data), iotest.OneByteReader(bytes.NewReader(data))} {
+			var rpc RPC
+			if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+				continue
+			}
+			if len(rpc.Payload) > DefaultMaxMessageSize {
+				t.Fatalf("decoded a %d byte payload", len(rpc.Payload))
+			}
+			if !rpc.Stream && len(rpc.Payload) == 0 {
+				t.Fatal("decoded an empty message")
+			}
+		}
+	})
+}
+
+// FuzzGOBDecoder feeds arbitrary bytes from a peer to the GOBDecoder.
+func FuzzGOBDecoder(f *testing.F) {
+	buf := new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(RPC{From: "peer", Payload: []byte("payload"), Stream: true})
+	f.Add(buf.Bytes())
+	f.Add([]byte{})
+	f.Add([]byte{0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var rpc RPC
+		if err := (GOBDecoder{}).Decode(bytes.NewReader(data), &rpc); err != nil {
+			return
+		}
+		if len(rpc.Payload) > DefaultMaxMessageSize {
+			t.Fatalf("decoded a %d byte payload", len(rpc.Payload))
+		}
+	})
+}
+
+func TestDecoderMaxMessageSize(t *testing.T) {
+	var rpc RPC
+	msg := []byte{IncomingMessage, 'a', 'b', 'c', 'd'}
+	assert.ErrorIs(t, DefaultDecoder{MaxMessageSize: 3}.Decode(bytes.NewReader(msg), &rpc), ErrOversizedMessage)
+	assert.Nil(t, DefaultDecoder{MaxMessageSize: 4}.Decode(bytes.NewReader(msg), &rpc))
+
+	big := append([]byte{IncomingMessage}, make([]byte, DefaultMaxMessageSize+1)...)
+	assert.Nil(t, DefaultDecoder{MaxMessageSize: len(big)}.Decode(bytes.NewReader(big), &rpc))
+	assert.Len(t, rpc.Payload, len(big)-1)
+}
+
+func TestTCPTransportProtocolError(t *testing.T) {
+	reported := make(chan error, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:      "127.0.0.1:41280",
+		HandshakeFunc:   NOPHandshakeFunc,
+		Decoder:         DefaultDecoder{},
+		OnProtocolError: func(_ Peer, err error) { reported <- err },
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:41280")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Garbage is reported, then the connection is dropped.
+	_, err = conn.Write([]byte{0x7f, 'x'})
+	assert.Nil(t, err)
+	select {
+	case err := <-reported:
+		assert.ErrorIs(t, err, ErrInvalidMessage)
+	case <-time.After(time.Second):
+		t.Fatal("protocol error not reported")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
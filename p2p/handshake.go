@@ -1,7 +1,238 @@
 package p2p
 
-// HandshakeFunc?
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
 
+// HandshakeFunc is called for every new connection before the peer is handed
+// to OnPeer. Returning an error drops the connection.
 type HandshakeFunc func(Peer) error
 
+// NOPHandshakeFunc accepts every connection without exchanging anything.
 func NOPHandshakeFunc(Peer) error { return nil }
+
+// ChainHandshakeFuncs returns a HandshakeFunc running fns in order, stopping at
+// the first error. Put handshakes that upgrade the connection (such as Noise)
+// first, so the ones after them run over the upgraded connection.
+func ChainHandshakeFuncs(fns ...HandshakeFunc) HandshakeFunc {
+	return func(p Peer) error {
+		for _, fn := range fns {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// maxHelloSize bounds the hello message a peer may send us, leaving room for
+// the tokens of identity providers as credentials.
+const maxHelloSize = 16 << 10
+
+// errHelloUnsupportedPeer is returned for peers that can't record hello metadata.
+var errHelloUnsupportedPeer = errors.New("p2p: hello handshake requires a peer exposing metadata")
+
+// ErrIncompatibleProtocol is returned by the hello handshake with peers that
+// share no protocol version with the local node.
+var ErrIncompatibleProtocol = errors.New("p2p: no protocol version in common with peer")
+
+// HelloConfig configures the hello handshake.
+type HelloConfig struct {
+	NodeID string // ID of the local node, announced to the peer.
+
+	// AdvertiseAddr is the address the peer should dial to reach the local
+	// node, announced to the peer. If empty, the AdvertiseAddr of the
+	// transport is announced, if it has one.
+	AdvertiseAddr string
+
+	// Version is the highest protocol version announced, ProtocolVersion if
+	// zero. Announcing an older one keeps the node speaking it with every
+	// peer, such as while the rest of a cluster is upgraded.
+	Version int
+
+	// Zone is the failure domain of the local node, such as its rack or
+	// availability zone, announced to the peer. Empty if unknown.
+	Zone string
+
+	// Tier is the storage tier of the local node, such as "hot" or "cold",
+	// announced to the peer. Empty if unknown.
+	Tier string
+
+	// Compression lists the compression algorithms of messages the local
+	// node reads, such as CompressionZstd, most preferred first. The first
+	// algorithm of the dialing side's list the accepting side lists too is
+	// negotiated, see PeerMeta.Compression. None is if either list is empty.
+	Compression []string
+
+	// Credential is presented to the peer in the hello, such as a token of
+	// the cluster's identity provider. It is sent in the clear unless a
+	// handshake encrypting the connection, such as Noise, runs first.
+	Credential string
+
+	// Authenticate checks the node ID and the credential the peer presented.
+	// Returning an error drops the connection. Every peer is accepted if nil.
+	Authenticate func(nodeID string, credential string) error
+}
+
+// CompressionZstd is the algorithm compressing messages as zstd frames.
+const CompressionZstd = "zstd"
+
+// helloMessage is exchanged by both sides of the hello handshake.
+type helloMessage struct {
+	NodeID     string `json:"node_id"`
+	Version    int    `json:"version"`
+	MinVersion int    `json:"min_version,omitempty"` // Oldest version the sender speaks, omitted by older nodes
+	Addr       string `json:"addr,omitempty"`        // Address to dial the sender at, omitted by older nodes
+	Zone       string `json:"zone,omitempty"`        // Zone of the sender, omitted if unknown
+	Tier       string `json:"tier,omitempty"`        // Storage tier of the sender, omitted if unknown
+
+	Compression []string `json:"compression,omitempty"` // Compression algorithms the sender reads, omitted by older nodes
+	Credential  string   `json:"credential,omitempty"`  // Credential of the sender, omitted if it has none
+}
+
+// helloPeer is implemented by peers that record the outcome of the hello handshake.
+type helloPeer interface {
+	Peer
+	setHello(hello helloMessage, version int, compression string, rtt time.Duration)
+	localAdvertiseAddr() string
+}
+
+// NewHelloHandshakeFunc returns a HandshakeFunc that exchanges node IDs,
+// zones, tiers, protocol versions, compression algorithms and credentials with
+// the peer and measures the round-trip time.
+//
+// The dialing side sends its hello first and the accepting side answers with
+// its own, which gives the dialer a round-trip measurement. The dialer then
+// sends a single byte acknowledgement so the accepting side can measure too.
+// Both sides settle on the lower of the two protocol versions, failing with
+// ErrIncompatibleProtocol if either side no longer speaks it.
+func NewHelloHandshakeFunc(cfg HelloConfig) HandshakeFunc {
+	return func(p Peer) error {
+		hp, ok := p.(helloPeer)
+		if !ok {
+			return errHelloUnsupportedPeer
+		}
+
+		local := helloMessage{
+			NodeID:     cfg.NodeID,
+			Version:    ProtocolVersion,
+			MinVersion: MinProtocolVersion,
+			Addr:       cfg.AdvertiseAddr,
+			Zone:       cfg.Zone,
+			Tier:       cfg.Tier,
+
+			Compression: cfg.Compression,
+			Credential:  cfg.Credential,
+		}
+		if cfg.Version > 0 {
+			local.Version = min(cfg.Version, ProtocolVersion)
+		}
+		if len(local.Addr) == 0 {
+			local.Addr = hp.localAdvertiseAddr()
+		}
+
+		var (
+			remote helloMessage
+			rtt    time.Duration
+		)
+		if hp.Outbound() {
+			start := time.Now()
+			if err := writeHello(p, local); err != nil {
+				return err
+			}
+			if err := readHello(p, &remote); err != nil {
+				return err
+			}
+			rtt = time.Since(start)
+			if _, err := p.Write([]byte{0x1}); err != nil {
+				return err
+			}
+		} else {
+			if err := readHello(p, &remote); err != nil {
+				return err
+			}
+			start := time.Now()
+			if err := writeHello(p, local); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(p, make([]byte, 1)); err != nil {
+				return err
+			}
+			rtt = time.Since(start)
+		}
+
+		if remote.Version < 1 {
+			return fmt.Errorf("p2p: peer announced invalid protocol version %d", remote.Version)
+		}
+		if cfg.Authenticate != nil {
+			if err := cfg.Authenticate(remote.NodeID, remote.Credential); err != nil {
+				return fmt.Errorf("p2p: authenticating peer %q: %w", remote.NodeID, err)
+			}
+		}
+
+		version := min(local.Version, remote.Version)
+		if version < max(local.MinVersion, remote.MinVersion) {
+			return fmt.Errorf("%w: speaking versions %d-%d, peer %d-%d", ErrIncompatibleProtocol,
+				local.MinVersion, local.Version, max(remote.MinVersion, 1), remote.Version)
+		}
+		dialer, acceptor := local.Compression, remote.Compression
+		if !hp.Outbound() {
+			dialer, acceptor = acceptor, dialer
+		}
+		hp.setHello(remote, version, negotiateCompression(dialer, acceptor), rtt)
+
+		return nil
+	}
+}
+
+// negotiateCompression returns the first algorithm of dialer also in
+// acceptor, empty if there is none.
+func negotiateCompression(dialer []string, acceptor []string) string {
+	for _, algo := range dialer {
+		if slices.Contains(acceptor, algo) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// writeHello writes msg as JSON prefixed with its 2-byte big-endian length.
+func writeHello(w io.Writer, msg helloMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// readHello reads a hello message written by writeHello.
+func readHello(r io.Reader, msg *helloMessage) error {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint16(size[:])
+	if n > maxHelloSize {
+		return errors.New("p2p: hello message too large")
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, msg)
+}
@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelloHandshake(t *testing.T) {
+	dialer := NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", Zone: "eu-1a", Tier: "cold"})
+	listener := NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"})
+
+	p1, p2, err1, err2 := handshakePair(dialer, listener)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	assert.Equal(t, "listener", p1.ID())
+	assert.Equal(t, "dialer", p2.ID())
+	assert.Equal(t, "eu-1a", p2.Zone())
+	assert.Equal(t, "cold", p2.Tier())
+	assert.Empty(t, p1.Zone())
+	assert.Equal(t, ProtocolVersion, p1.ProtocolVersion())
+	assert.Equal(t, ProtocolVersion, p2.ProtocolVersion())
+	assert.Greater(t, p1.RTT(), time.Duration(0))
+	assert.Greater(t, p2.RTT(), time.Duration(0))
+	assert.Equal(t, "tcp", p1.TransportKind())
+	assert.WithinDuration(t, time.Now(), p1.ConnectedAt(), time.Second)
+}
+
+func TestObserveRTT(t *testing.T) {
+	var info peerInfo
+	info.ObserveRTT(0)
+	assert.Zero(t, info.RTT())
+	info.ObserveRTT(8 * time.Millisecond)
+	assert.Equal(t, 8*time.Millisecond, info.RTT())
+
+	// Samples move the estimate by an eighth of their difference.
+	info.ObserveRTT(16 * time.Millisecond)
+	assert.Equal(t, 9*time.Millisecond, info.RTT())
+	info.ObserveRTT(time.Millisecond)
+	assert.Equal(t, 8*time.Millisecond, info.RTT())
+}
+
+func TestHelloVersionNegotiation(t *testing.T) {
+	// A node held back on an older version speaks it with newer peers.
+	p1, p2, err1, err2 := handshakePair(
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", Version: MinProtocolVersion}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"}),
+	)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, MinProtocolVersion, p1.ProtocolVersion())
+	assert.Equal(t, MinProtocolVersion, p2.ProtocolVersion())
+
+	// Peers that no longer speak any version this node does are refused.
+	c1, c2 := net.Pipe()
+	go func() {
+		var hello helloMessage
+		readHello(c2, &hello)
+		writeHello(c2, helloMessage{NodeID: "future", Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1})
+		c2.Read(make([]byte, 1))
+	}()
+	err := NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer"})(NewTCPPeer(c1, true))
+	assert.ErrorIs(t, err, ErrIncompatibleProtocol)
+}
+
+func TestChainHandshakeFuncs(t *testing.T) {
+	k1, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	k2, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	// The hello runs over the encrypted connection set up by Noise.
+	dialer := ChainHandshakeFuncs(
+		NewNoiseHandshakeFunc(NoiseConfig{StaticKey: k1}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer"}),
+	)
+	listener := ChainHandshakeFuncs(
+		NewNoiseHandshakeFunc(NoiseConfig{StaticKey: k2}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"}),
+	)
+
+	p1, p2, err1, err2 := handshakePair(dialer, listener)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, "listener", p1.ID())
+	assert.Equal(t, "dialer", p2.ID())
+	assert.IsType(t, &noiseConn{}, p1.Conn)
+}
+
+func TestHelloAdvertiseAddr(t *testing.T) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	p2.advertise = "listener.example:3000" // As set by a transport with an AdvertiseAddr
+
+	dialer := NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", AdvertiseAddr: "dialer.example:3000"})
+	listener := NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"})
+	errch := make(chan error)
+	go func() { errch <- listener(p2) }()
+	assert.Nil(t, dialer(p1))
+	assert.Nil(t, <-errch)
+
+	assert.Equal(t, "listener.example:3000", p1.AdvertisedAddr())
+	assert.Equal(t, "dialer.example:3000", p2.AdvertisedAddr())
+	assert.Equal(t, "dialer.example:3000", DialAddr(p2))
+
+	// Peers that don't announce an address are dialed where they connect from.
+	p1, p2, err1, err2 := handshakePair(NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer"}), listener)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Empty(t, p2.AdvertisedAddr())
+	assert.Equal(t, p2.RemoteAddr().String(), DialAddr(p2))
+}
+
+func TestHelloCompressionNegotiation(t *testing.T) {
+	// The dialer's preference wins among the algorithms both sides read.
+	p1, p2, err1, err2 := handshakePair(
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", Compression: []string{"lz4", CompressionZstd}}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener", Compression: []string{CompressionZstd, "lz4"}}),
+	)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, "lz4", p1.Compression())
+	assert.Equal(t, "lz4", p2.Compression())
+
+	// Nodes that don't compress, such as older ones, are sent messages as they are.
+	p1, p2, err1, err2 = handshakePair(
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", Compression: []string{CompressionZstd}}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener"}),
+	)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Empty(t, p1.Compression())
+	assert.Empty(t, p2.Compression())
+}
+
+func TestHelloAuthenticate(t *testing.T) {
+	// Only peers presenting the cluster token are accepted.
+	authenticate := func(nodeID string, credential string) error {
+		if credential != "cluster-token" {
+			return errors.New("unknown credential")
+		}
+		return nil
+	}
+	var presented string
+	_, _, err1, err2 := handshakePair(
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "dialer", Credential: "cluster-token", Authenticate: authenticate}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener", Credential: "cluster-token", Authenticate: func(nodeID string, credential string) error {
+			presented = nodeID + ":" + credential
+			return authenticate(nodeID, credential)
+		}}),
+	)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, "dialer:cluster-token", presented)
+
+	_, _, err1, err2 = handshakePair(
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "intruder", Credential: "guess"}),
+		NewHelloHandshakeFunc(HelloConfig{NodeID: "listener", Authenticate: authenticate}),
+	)
+	assert.Nil(t, err1, "the dialer doesn't check the listener")
+	assert.ErrorContains(t, err2, `authenticating peer "intruder"`)
+}
@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultQueueSize is the number of RPCs queued per peer unless the transport options say otherwise.
+const defaultQueueSize = 256
+
+// QueuePolicy decides what happens to an RPC arriving while its peer's queue is full.
+type QueuePolicy int
+
+const (
+	// QueuePark stops reading from the peer until the queue has room again,
+	// pushing back on the peer without holding up anyone else.
+	QueuePark QueuePolicy = iota
+
+	// QueueDrop drops RPCs arriving on multiplexed streams and closes the
+	// stream, which the sender sees as the request going unanswered. RPCs
+	// read directly off a connection are always parked: the data following
+	// them would be mistaken for the next message otherwise.
+	QueueDrop
+)
+
+// QueueStats are the counters of a peer's RPC queue.
+type QueueStats struct {
+	QueueDepth int    `json:"queue_depth"` // RPCs waiting to be consumed.
+	Parked     uint64 `json:"parked"`      // Times reading from the peer stopped for a full queue.
+	Dropped    uint64 `json:"dropped"`     // RPCs dropped for a full queue.
+}
+
+// inbox is the bounded queue of RPCs received from a single peer. A goroutine
+// moves them on to the transport's shared channel, so a peer sending faster
+// than they are consumed only fills its own queue.
+type inbox struct {
+	ch     chan RPC
+	policy QueuePolicy
+
+	parked  atomic.Uint64
+	dropped atomic.Uint64
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// newInbox returns an inbox of size RPCs feeding out until it is closed.
+func newInbox(size int, policy QueuePolicy, out chan<- RPC) *inbox {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	in := &inbox{
+		ch:     make(chan RPC, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	go in.pump(out)
+	return in
+}
+
+// push queues rpc according to the policy. It reports whether rpc was queued.
+func (in *inbox) push(rpc RPC) bool {
+	select {
+	case <-in.done:
+		in.drop(rpc)
+		return false
+	default:
+	}
+
+	select {
+	case in.ch <- rpc:
+		return true
+	default:
+	}
+
+	if in.policy == QueueDrop && rpc.Conn != nil {
+		in.dropped.Add(1)
+		rpc.Conn.Close()
+		return false
+	}
+
+	in.parked.Add(1)
+	select {
+	case in.ch <- rpc:
+		return true
+	case <-in.done:
+		in.drop(rpc)
+		return false
+	}
+}
+
+// pump moves queued RPCs to out. Once the inbox is closed it delivers what
+// is still queued, since the peer sent it before going away, and stops.
+func (in *inbox) pump(out chan<- RPC) {
+	for {
+		select {
+		case rpc := <-in.ch:
+			out <- rpc
+		case <-in.done:
+			for {
+				select {
+				case rpc := <-in.ch:
+					out <- rpc
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops accepting RPCs once the peer is gone.
+func (in *inbox) close() {
+	in.doneOnce.Do(func() { close(in.done) })
+}
+
+// drop discards rpc, closing the stream it arrived on.
+func (in *inbox) drop(rpc RPC) {
+	in.dropped.Add(1)
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+}
+
+// stats returns the counters of the inbox.
+func (in *inbox) stats() QueueStats {
+	if in == nil {
+		return QueueStats{}
+	}
+	return QueueStats{
+		QueueDepth: len(in.ch),
+		Parked:     in.parked.Load(),
+		Dropped:    in.dropped.Load(),
+	}
+}
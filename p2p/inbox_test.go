@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboxPark(t *testing.T) {
+	out := make(chan RPC)
+	in := newInbox(2, QueuePark, out)
+	defer in.close()
+
+	// The pump holds one RPC while out is blocked, the queue two more
+	assert.True(t, in.push(RPC{Payload: []byte{0}}))
+	assert.Eventually(t, func() bool { return in.stats().QueueDepth == 0 }, time.Second, time.Millisecond)
+	for i := 1; i < 3; i++ {
+		assert.True(t, in.push(RPC{Payload: []byte{byte(i)}}))
+	}
+
+	pushed := make(chan bool)
+	go func() { pushed <- in.push(RPC{Payload: []byte{3}}) }()
+
+	select {
+	case <-pushed:
+		t.Fatal("push returned with a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, QueueStats{QueueDepth: 2, Parked: 1}, in.stats())
+
+	// Consuming unparks the sender, and order is kept
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []byte{byte(i)}, (<-out).Payload)
+	}
+	assert.True(t, <-pushed)
+}
+
+func TestInboxDrop(t *testing.T) {
+	out := make(chan RPC)
+	in := newInbox(1, QueueDrop, out)
+	defer in.close()
+
+	assert.True(t, in.push(RPC{Payload: []byte{0}}))
+	assert.Eventually(t, func() bool { return in.stats().QueueDepth == 0 }, time.Second, time.Millisecond)
+	assert.True(t, in.push(RPC{Payload: []byte{1}}))
+
+	// Stream RPCs are dropped and their stream closed
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	assert.False(t, in.push(RPC{Payload: []byte{2}, Conn: c1}))
+	_, err := c1.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, uint64(1), in.stats().Dropped)
+
+	// Legacy RPCs park regardless
+	pushed := make(chan bool)
+	go func() { pushed <- in.push(RPC{Payload: []byte{3}}) }()
+	assert.Equal(t, []byte{0}, (<-out).Payload)
+	assert.True(t, <-pushed)
+}
+
+func TestInboxClose(t *testing.T) {
+	out := make(chan RPC, 4)
+	in := newInbox(4, QueuePark, out)
+
+	assert.True(t, in.push(RPC{Payload: []byte{0}}))
+	in.close()
+
+	// What was queued before the peer left is still delivered
+	assert.Equal(t, []byte{0}, (<-out).Payload)
+	assert.False(t, in.push(RPC{Payload: []byte{1}}))
+	assert.Equal(t, uint64(1), in.stats().Dropped)
+}
@@ -1,5 +1,7 @@
 package p2p
 
+import "net"
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
@@ -11,4 +13,9 @@ type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+
+	// Conn is the multiplexed stream the RPC arrived on, nil for RPCs read
+	// directly off a connection. Consumers read follow-on data from it, write
+	// responses to it and close it when done.
+	Conn net.Conn
 }
@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats are the traffic counters of a single peer.
+type PeerStats struct {
+	BytesSent     int64 `json:"bytes_sent"`     // Bytes written to the peer since it connected.
+	BytesReceived int64 `json:"bytes_received"` // Bytes read from the peer since it connected.
+	QueueStats          // Counters of the queue of RPCs received from the peer.
+}
+
+// PeerLimits are limits applied to the traffic of a single peer. Zero means unlimited.
+type PeerLimits struct {
+	MaxSendRate int64 `json:"max_send_rate"` // Maximum bytes per second written to the peer.
+	MaxRecvRate int64 `json:"max_recv_rate"` // Maximum bytes per second read from the peer.
+}
+
+// meter counts the traffic of a peer and enforces its limits. It is embedded
+// by the transport specific peer types.
+type meter struct {
+	sent     atomic.Int64
+	received atomic.Int64
+
+	sendLimit rateLimiter
+	recvLimit rateLimiter
+
+	queue *inbox // RPCs received from the peer, set before the peer is handed out
+}
+
+// Stats returns the traffic counters of the peer.
+func (m *meter) Stats() PeerStats {
+	return PeerStats{
+		BytesSent:     m.sent.Load(),
+		BytesReceived: m.received.Load(),
+		QueueStats:    m.queue.stats(),
+	}
+}
+
+// Limits returns the limits currently applied to the peer.
+func (m *meter) Limits() PeerLimits {
+	return PeerLimits{
+		MaxSendRate: m.sendLimit.getRate(),
+		MaxRecvRate: m.recvLimit.getRate(),
+	}
+}
+
+// SetLimits changes the limits applied to the peer. It takes effect immediately,
+// also for transfers already in progress.
+func (m *meter) SetLimits(limits PeerLimits) {
+	m.sendLimit.setRate(limits.MaxSendRate)
+	m.recvLimit.setRate(limits.MaxRecvRate)
+}
+
+// countSent records n bytes written to the peer, waiting if that exceeds the send limit.
+func (m *meter) countSent(n int) {
+	m.sent.Add(int64(n))
+	m.sendLimit.wait(n)
+}
+
+// countReceived records n bytes read from the peer, waiting if that exceeds the receive limit.
+func (m *meter) countReceived(n int) {
+	m.received.Add(int64(n))
+	m.recvLimit.wait(n)
+}
+
+// meteredConn is a net.Conn that reports its traffic to a meter.
+type meteredConn struct {
+	net.Conn
+	m *meter
+}
+
+// Read reads from the connection and records the bytes read.
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.m.countReceived(n)
+	}
+	return n, err
+}
+
+// Write writes to the connection and records the bytes written.
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.m.countSent(n)
+	}
+	return n, err
+}
+
+// ReadFrom copies r to the connection. Without a send limit the copy is left
+// to the underlying connection, which for a plain TCP connection and a file
+// lets the kernel move the data with sendfile, bypassing user space.
+func (c *meteredConn) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok || c.m.sendLimit.getRate() > 0 {
+		return io.Copy(writerOnly{c}, r) // Write every buffer, counting and limiting it
+	}
+
+	n, err := rf.ReadFrom(r)
+	c.m.sent.Add(n)
+	return n, err
+}
+
+// writerOnly hides any ReadFrom method of its writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// rateLimiter is a token bucket holding up to one second worth of bytes.
+// Callers take tokens after the fact and sleep off any debt, so a single large
+// read or write is never rejected, it just delays whatever comes next.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second, 0 means unlimited.
+	tokens float64 // Bytes that may be transferred without waiting, negative when in debt.
+	last   time.Time
+}
+
+// getRate returns the current rate.
+func (l *rateLimiter) getRate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// setRate changes the rate and starts over with a full bucket.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+}
+
+// wait takes n tokens and sleeps until the bucket is out of debt.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeteredConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	m := &meter{}
+	conn := &meteredConn{Conn: c1, m: m}
+
+	go c2.Read(make([]byte, 64))
+	n, err := conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	go c2.Write([]byte("hi"))
+	n, err = conn.Read(make([]byte, 64))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Equal(t, PeerStats{BytesSent: 5, BytesReceived: 2}, m.Stats())
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{}
+	l.setRate(1000)
+
+	// A full second worth of bytes goes through without waiting...
+	start := time.Now()
+	l.wait(1000)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// ...after that the bucket has to refill first.
+	l.wait(200)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// Removing the limit stops the waiting.
+	l.setRate(0)
+	start = time.Now()
+	l.wait(1 << 20)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+// tcpPair returns both ends of a loopback TCP connection, draining the
+// remote end into sink.
+func tcpPair(tb testing.TB, sink io.Writer) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(sink, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// tempFile writes size bytes to a new file and returns it opened for reading.
+func tempFile(tb testing.TB, size int) *os.File {
+	path := filepath.Join(tb.TempDir(), "file")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestMeteredConnReadFrom(t *testing.T) {
+	for _, limit := range []int64{0, 1 << 30} {
+		var sink bytes.Buffer
+		m := &meter{}
+		m.SetLimits(PeerLimits{MaxSendRate: limit})
+		conn := &meteredConn{Conn: tcpPair(t, &sink), m: m}
+
+		n, err := conn.ReadFrom(tempFile(t, 100_000))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(100_000), n)
+		assert.Equal(t, int64(100_000), m.Stats().BytesSent)
+		conn.Close()
+	}
+}
+
+func BenchmarkServeFile(b *testing.B) {
+	const size = 8 << 20
+
+	run := func(b *testing.B, copyFile func(conn *meteredConn, f *os.File) (int64, error)) {
+		conn := &meteredConn{Conn: tcpPair(b, io.Discard), m: &meter{}}
+		defer conn.Close()
+		f := tempFile(b, size)
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f.Seek(0, io.SeekStart)
+			if _, err := copyFile(conn, f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("sendfile", func(b *testing.B) {
+		run(b, func(conn *meteredConn, f *os.File) (int64, error) { return conn.ReadFrom(f) })
+	})
+	b.Run("userspace", func(b *testing.B) {
+		run(b, func(conn *meteredConn, f *os.File) (int64, error) {
+			return io.Copy(writerOnly{conn}, struct{ io.Reader }{f})
+		})
+	})
+}
@@ -0,0 +1,624 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame types understood by the stream multiplexer.
+const (
+	frameData   byte = 0x0 // Payload bytes for an open stream.
+	frameOpen   byte = 0x1 // The sender opened a new stream.
+	frameClose  byte = 0x2 // The sender will not write to the stream anymore.
+	frameWindow byte = 0x3 // The receiver consumed data and grants more send window.
+	frameReset  byte = 0x4 // The receiver refused the stream, its backlog of streams to accept full or its ID not the sender's to open.
+)
+
+const (
+	frameHeaderSize     = 9          // type (1) + stream ID (4) + payload length (4).
+	maxFramePayload     = 32 * 1024  // Largest payload carried by a single frame.
+	initialStreamWindow = 256 * 1024 // Bytes a sender may have in flight per stream.
+	acceptBacklog       = 64         // Inbound streams waiting to be accepted.
+)
+
+var (
+	// ErrSessionClosed is returned when using a multiplexed session (or one of
+	// its streams) after the underlying connection has gone away.
+	ErrSessionClosed = errors.New("p2p: mux session closed")
+	// ErrStreamClosed is returned when writing to a stream that was closed locally.
+	ErrStreamClosed = errors.New("p2p: mux stream closed")
+	// ErrStreamReset is returned when using a stream the remote side refused
+	// because it had too many streams waiting to be accepted.
+	ErrStreamReset = errors.New("p2p: mux stream refused by the remote side")
+	// ErrNotMultiplexed is returned by OpenStream on connections that were not
+	// set up with multiplexing enabled.
+	ErrNotMultiplexed = errors.New("p2p: connection is not multiplexed")
+	// errFrameTooLarge is returned when a peer announces an oversized frame.
+	errFrameTooLarge = errors.New("p2p: mux frame too large")
+	// errWindowExceeded is returned when a peer sends more data on a stream
+	// than the window it was granted.
+	errWindowExceeded = errors.New("p2p: mux stream window exceeded")
+)
+
+// Session multiplexes many independent streams over a single connection so
+// that file transfers and control messages don't have to wait on each other.
+//
+// Every frame on the wire is prefixed with a 9 byte header holding the frame
+// type, the stream ID and the payload length. Streams opened by the dialing
+// side use odd IDs and streams opened by the accepting side use even IDs, so
+// both ends can open streams without coordinating.
+type Session struct {
+	conn net.Conn // The underlying connection shared by all streams.
+
+	mu      sync.Mutex         // Protects nextID, streams and err.
+	nextID  uint32             // ID handed to the next locally opened stream.
+	streams map[uint32]*Stream // Streams that are still open in at least one direction.
+	err     error              // Reason the session was closed.
+
+	writeLock sync.Mutex   // Serializes frames written to conn.
+	acceptch  chan *Stream // Streams opened by the remote side, waiting for Accept.
+	closech   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession starts multiplexing over conn. Outbound must be true on the side
+// that dialed the connection and false on the side that accepted it.
+func NewSession(conn net.Conn, outbound bool) *Session {
+	s := &Session{
+		conn:     conn,
+		nextID:   2,
+		streams:  make(map[uint32]*Stream),
+		acceptch: make(chan *Stream, acceptBacklog),
+		closech:  make(chan struct{}),
+	}
+	if outbound {
+		s.nextID = 1
+	}
+
+	go s.readLoop()
+
+	return s
+}
+
+// Open opens a new stream to the remote side.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the remote side.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptch:
+		return st, nil
+	case <-s.closech:
+		return nil, s.closeErr()
+	}
+}
+
+// Close tears down the session, the underlying connection and all of its streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// closeWithError closes the session once, remembering err as the reason.
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+
+		close(s.closech)
+		s.conn.Close()
+
+		// Wake up everyone blocked on a stream so they observe the closed session.
+		for _, st := range streams {
+			st.wake()
+		}
+	})
+}
+
+// closeErr returns the reason the session was closed.
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return ErrSessionClosed
+	}
+	return s.err
+}
+
+// isClosed reports whether the session has been closed.
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closech:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeFrame writes a single frame to the underlying connection.
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := framePool.get()
+	defer framePool.put(buf)
+
+	frame := (*buf)[:frameHeaderSize+len(payload)]
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.isClosed() {
+		return s.closeErr()
+	}
+
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+
+	return nil
+}
+
+// writeFileFrame writes a data frame carrying the next n bytes of f, which
+// rf, the underlying connection, reads from the file itself. A frame cut short
+// can't be completed, so a failure closes the session.
+func (s *Session) writeFileFrame(id uint32, rf io.ReaderFrom, f *os.File, n int) error {
+	var hdr [frameHeaderSize]byte
+	hdr[0] = frameData
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(n))
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.isClosed() {
+		return s.closeErr()
+	}
+
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	sent, err := rf.ReadFrom(&io.LimitedReader{R: f, N: int64(n)})
+	if err == nil && sent < int64(n) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.closeWithError(err)
+		return err
+	}
+
+	return nil
+}
+
+// readLoop reads frames off the connection and dispatches them to their streams.
+func (s *Session) readLoop() {
+	var (
+		err error
+		hdr = make([]byte, frameHeaderSize)
+	)
+	defer func() {
+		if err == io.EOF {
+			err = ErrSessionClosed
+		}
+		s.closeWithError(err)
+	}()
+
+	for {
+		if _, err = io.ReadFull(s.conn, hdr); err != nil {
+			return
+		}
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		size := binary.BigEndian.Uint32(hdr[5:9])
+		if size > maxFramePayload {
+			err = errFrameTooLarge
+			return
+		}
+
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(s.conn, payload); err != nil {
+			return
+		}
+
+		switch typ {
+		case frameOpen:
+			// The remote side may only open streams of its own parity, and
+			// not one it has open already: taking over a stream would hand
+			// its data to the wrong reader.
+			st := newStream(s, id)
+			s.mu.Lock()
+			_, inUse := s.streams[id]
+			valid := id != 0 && id%2 != s.nextID%2 && !inUse
+			if valid {
+				s.streams[id] = st
+			}
+			s.mu.Unlock()
+			if !valid {
+				go s.writeFrame(frameReset, id, nil)
+				continue
+			}
+
+			// Waiting for room in the backlog would stall every other stream
+			// of the session, so streams that don't fit are refused instead.
+			select {
+			case s.acceptch <- st:
+			default:
+				s.removeStream(id)
+				go s.writeFrame(frameReset, id, nil) // Not to block reading on the write
+			}
+		case frameData:
+			if st := s.stream(id); st != nil {
+				if err = st.pushData(payload); err != nil {
+					return
+				}
+			}
+		case frameClose:
+			if st := s.stream(id); st != nil {
+				st.remoteClose()
+			}
+		case frameWindow:
+			if st := s.stream(id); st != nil && len(payload) == 4 {
+				st.grantWindow(binary.BigEndian.Uint32(payload))
+			}
+		case frameReset:
+			if st := s.stream(id); st != nil {
+				st.reset()
+			}
+		}
+	}
+}
+
+// stream looks up an open stream by ID.
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// removeStream forgets a stream once both directions are closed.
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// Stream is a single bidirectional, flow-controlled stream within a Session.
+// It implements net.Conn so it can be used anywhere a connection is expected.
+//
+// Writes are sent in frames of up to 32KB, split further when the send
+// window has less room left, and every Read returns data from at most one
+// frame. A small Write therefore usually arrives in a Read of its own, but
+// readers can't rely on the boundaries of the sender's writes.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	frames        [][]byte  // Received payloads waiting to be read.
+	unacked       uint32    // Bytes read but not yet returned to the sender as window.
+	recvWindow    uint32    // Bytes the sender may still send before we grant more.
+	sendWindow    uint32    // Bytes we may still send before waiting for a window update.
+	remoteClosed  bool      // The remote side won't send any more data.
+	localClosed   bool      // We won't send any more data.
+	refused       bool      // The remote side refused the stream.
+	readDeadline  time.Time // Zero means no deadline.
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// newStream creates a stream with a full send window.
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       s,
+		recvWindow: initialStreamWindow,
+		sendWindow: initialStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream identifier, unique within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data sent by the remote side. It returns io.EOF once the remote
+// side has closed the stream and all buffered data has been consumed.
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.frames) == 0 {
+		switch {
+		case st.refused:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.sess.isClosed():
+			st.mu.Unlock()
+			return 0, st.sess.closeErr()
+		case !st.readDeadline.IsZero() && !time.Now().Before(st.readDeadline):
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+
+	n := copy(b, st.frames[0])
+	if n == len(st.frames[0]) {
+		st.frames[0] = nil
+		st.frames = st.frames[1:]
+	} else {
+		st.frames[0] = st.frames[0][n:]
+	}
+
+	// Hand the consumed bytes back to the sender in batches to keep the
+	// number of window update frames low.
+	var grant uint32
+	st.unacked += uint32(n)
+	if st.unacked >= initialStreamWindow/4 {
+		grant = st.unacked
+		st.unacked = 0
+		st.recvWindow += grant
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], grant)
+		st.sess.writeFrame(frameWindow, st.id, buf[:])
+	}
+
+	return n, nil
+}
+
+// Write sends b to the remote side, blocking while the send window is exhausted.
+func (st *Stream) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		n, err := st.reserve(len(b) - written)
+		if err != nil {
+			return written, err
+		}
+		if err := st.sess.writeFrame(frameData, st.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// ReadFrom sends what r reads to the remote side. Files, on their own or
+// limited by an io.LimitedReader, are handed a frame at a time to the
+// ReadFrom of the underlying connection, which for a plain TCP connection
+// sends them with sendfile; anything else is copied through Write.
+func (st *Stream) ReadFrom(r io.Reader) (int64, error) {
+	lr, ok := r.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: r, N: math.MaxInt64}
+	}
+	f, isFile := lr.R.(*os.File)
+	rf, canSend := st.sess.conn.(io.ReaderFrom)
+	if !isFile || !canSend {
+		return io.Copy(writerOnly{st}, r)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for left := min(lr.N, info.Size()-offset); left > 0; {
+		n, err := st.reserve(int(min(left, maxFramePayload)))
+		if err != nil {
+			return written, err
+		}
+		if err := st.sess.writeFileFrame(st.id, rf, f, n); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		left -= int64(n)
+		lr.N -= int64(n)
+	}
+
+	return written, nil
+}
+
+// reserve takes up to max bytes, no more than a frame carries, out of the send
+// window, blocking while it is exhausted. It returns the bytes taken.
+func (st *Stream) reserve(max int) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.sendWindow == 0 {
+		switch {
+		case st.localClosed:
+			return 0, ErrStreamClosed
+		case st.refused:
+			return 0, ErrStreamReset
+		case st.sess.isClosed():
+			return 0, st.sess.closeErr()
+		case !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+	if st.localClosed {
+		return 0, ErrStreamClosed
+	}
+	if st.refused {
+		return 0, ErrStreamReset
+	}
+
+	n := max
+	if n > maxFramePayload {
+		n = maxFramePayload
+	}
+	if uint32(n) > st.sendWindow {
+		n = int(st.sendWindow)
+	}
+	st.sendWindow -= uint32(n)
+	return n, nil
+}
+
+// Close closes the writing side of the stream. The remote side will read
+// io.EOF once it has consumed everything written before Close.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+	st.cond.Broadcast()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}
+
+// pushData queues a received payload for reading. It fails if the payload
+// exceeds the window granted to the sender, which then ignores flow control.
+func (st *Stream) pushData(b []byte) error {
+	st.mu.Lock()
+	if uint32(len(b)) > st.recvWindow {
+		st.mu.Unlock()
+		return errWindowExceeded
+	}
+	st.recvWindow -= uint32(len(b))
+	st.frames = append(st.frames, b)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+	return nil
+}
+
+// remoteClose marks the stream as closed by the remote side.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+	st.cond.Broadcast()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+// reset marks the stream as refused by the remote side, which won't read or
+// send anything on it.
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.refused = true
+	st.remoteClosed = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+	st.sess.removeStream(st.id)
+}
+
+// grantWindow adds n bytes to the send window.
+func (st *Stream) grantWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// wake wakes up everyone blocked on the stream after a state change that
+// happened outside of st.mu, such as a closed session or an expired deadline.
+func (st *Stream) wake() {
+	st.mu.Lock()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// SetDeadline sets both the read and write deadlines of the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future and pending Read calls.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.readDeadline = t
+	st.readTimer = st.armTimer(st.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending Write calls.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.writeDeadline = t
+	st.writeTimer = st.armTimer(st.writeTimer, t)
+	return nil
+}
+
+// armTimer replaces timer with one that wakes up blocked readers and writers
+// when the deadline t passes. The caller must hold st.mu.
+func (st *Stream) armTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), st.wake)
+}
@@ -0,0 +1,308 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSessionPair returns two sessions talking to each other over an in-memory connection.
+func newSessionPair() (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	return NewSession(c1, true), NewSession(c2, false)
+}
+
+// TestSessionConcurrentStreams sends several large payloads at once and checks
+// that each of them arrives intact on its own stream.
+func TestSessionConcurrentStreams(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	// Echo every accepted stream back to the sender.
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			payload := bytes.Repeat([]byte(fmt.Sprintf("stream-%d;", i)), 100_000) // Larger than the send window.
+
+			st, err := client.Open()
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			go func() {
+				st.Write(payload)
+				st.Close()
+			}()
+
+			b, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(payload, b), "stream %d payload mismatch", i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestSessionPreservesMessageBoundaries checks that a read never returns data
+// from more than one write.
+func TestSessionPreservesMessageBoundaries(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	assert.Nil(t, err)
+	st.Write([]byte{IncomingMessage})
+	st.Write([]byte("hello"))
+	st.Close()
+
+	remote, err := server.Accept()
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1028)
+	n, err := remote.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{IncomingMessage}, buf[:n])
+
+	n, err = remote.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	_, err = remote.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+// TestSessionClose checks that closing a session unblocks pending reads.
+func TestSessionClose(t *testing.T) {
+	client, server := newSessionPair()
+
+	st, err := client.Open()
+	assert.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	server.Close()
+	assert.NotNil(t, <-done)
+
+	_, err = client.Open()
+	assert.NotNil(t, err)
+}
+
+// TestSessionAcceptBacklog checks that streams opened while the accept
+// backlog is full are refused without holding up the streams already open.
+func TestSessionAcceptBacklog(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	var waiting []*Stream
+	for i := 0; i < acceptBacklog; i++ {
+		st, err := client.Open()
+		require.Nil(t, err)
+		waiting = append(waiting, st)
+	}
+	refused, err := client.Open()
+	require.Nil(t, err)
+	_, err = refused.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = refused.Write([]byte("too late"))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// The streams waiting are accepted and carry data as usual.
+	remote, err := server.Accept()
+	require.Nil(t, err)
+	assert.Equal(t, waiting[0].ID(), remote.ID())
+	go remote.Write([]byte("accepted"))
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(waiting[0], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "accepted", string(buf))
+}
+
+// TestSessionWindowExceeded checks that a peer sending more than the window
+// it was granted gets its session closed rather than buffered without limit.
+func TestSessionWindowExceeded(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	server := NewSession(c2, false)
+	defer server.Close()
+
+	frame := func(typ byte, payload []byte) []byte {
+		hdr := make([]byte, frameHeaderSize)
+		hdr[0] = typ
+		binary.BigEndian.PutUint32(hdr[1:5], 1)
+		binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+		return append(hdr, payload...)
+	}
+	_, err := c1.Write(frame(frameOpen, nil))
+	require.Nil(t, err)
+	data := frame(frameData, make([]byte, maxFramePayload))
+	for sent := 0; sent <= initialStreamWindow; sent += maxFramePayload {
+		if _, err := c1.Write(data); err != nil {
+			break // Closed by the server already
+		}
+	}
+
+	assert.Eventually(t, server.isClosed, time.Second, time.Millisecond)
+	assert.Equal(t, errWindowExceeded, server.closeErr())
+}
+
+// TestSessionRefusesStreamIDs checks that streams opened by the remote side
+// under IDs of the local side, or under IDs open already, are refused without
+// disturbing the stream open under the ID.
+func TestSessionRefusesStreamIDs(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	server := NewSession(c2, false)
+	defer server.Close()
+
+	frame := func(typ byte, id uint32, payload []byte) []byte {
+		hdr := make([]byte, frameHeaderSize)
+		hdr[0] = typ
+		binary.BigEndian.PutUint32(hdr[1:5], id)
+		binary.BigEndian.PutUint32(hdr[5:9], uint32(len(payload)))
+		return append(hdr, payload...)
+	}
+	resets := make(chan uint32, 8)
+	go func() {
+		hdr := make([]byte, frameHeaderSize)
+		for {
+			if _, err := io.ReadFull(c1, hdr); err != nil {
+				return
+			}
+			io.CopyN(io.Discard, c1, int64(binary.BigEndian.Uint32(hdr[5:9])))
+			if hdr[0] == frameReset {
+				resets <- binary.BigEndian.Uint32(hdr[1:5])
+			}
+		}
+	}()
+	write := func(typ byte, id uint32, payload []byte) {
+		_, err := c1.Write(frame(typ, id, payload))
+		require.Nil(t, err)
+	}
+
+	// The dialing side opens odd IDs only, never 0.
+	for _, id := range []uint32{0, 2} {
+		write(frameOpen, id, nil)
+		select {
+		case reset := <-resets:
+			assert.Equal(t, id, reset)
+		case <-time.After(time.Second):
+			t.Fatalf("stream %d wasn't refused", id)
+		}
+	}
+
+	// A stream opened again keeps its reader and its data.
+	write(frameOpen, 1, nil)
+	write(frameData, 1, []byte("first"))
+	write(frameOpen, 1, nil)
+	write(frameData, 1, []byte("second"))
+	select {
+	case reset := <-resets:
+		assert.Equal(t, uint32(1), reset)
+	case <-time.After(time.Second):
+		t.Fatal("stream 1 wasn't refused when opened again")
+	}
+	st, err := server.Accept()
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), st.ID())
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(st, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "firstsecond", string(buf))
+	select {
+	case st := <-server.acceptch:
+		t.Fatalf("stream %d accepted", st.ID())
+	default:
+	}
+}
+
+// TestStreamReadFrom sends files over a session on a TCP connection, which
+// the stream hands to the connection a frame at a time, and checks they
+// arrive intact.
+func TestStreamReadFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	client, server := NewSession(conn, true), NewSession(<-accepted, false)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 1<<20+123) // Larger than the send window, not a multiple of the frame size.
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	for _, tc := range []struct {
+		name string
+		r    func(f *os.File) io.Reader
+		want []byte
+	}{
+		{"file", func(f *os.File) io.Reader { return f }, data},
+		{"limited", func(f *os.File) io.Reader {
+			f.Seek(10, io.SeekStart)
+			return &io.LimitedReader{R: f, N: 500_000}
+		}, data[10:500_010]},
+		{"reader", func(f *os.File) io.Reader { return struct{ io.Reader }{f} }, data},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			defer f.Close()
+
+			st, err := client.Open()
+			require.NoError(t, err)
+			go func() {
+				n, err := st.ReadFrom(tc.r(f))
+				assert.NoError(t, err)
+				assert.EqualValues(t, len(tc.want), n)
+				st.Close()
+			}()
+
+			peer, err := server.Accept()
+			require.NoError(t, err)
+			got, err := io.ReadAll(peer)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(tc.want, got), "got %d bytes, want %d", len(got), len(tc.want))
+		})
+	}
+}
@@ -0,0 +1,535 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// noiseProtocolName names the Noise protocol implemented here. It is mixed into
+// the handshake hash, so both sides must agree on every primitive.
+const noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+
+const (
+	noiseKeySize    = 32    // X25519 public key and symmetric key size.
+	noiseTagSize    = 16    // AES-GCM authentication tag size.
+	noiseMaxMessage = 65535 // Largest Noise transport message.
+)
+
+var (
+	// ErrNoiseDecrypt is returned when a Noise message fails authentication.
+	ErrNoiseDecrypt = errors.New("p2p: noise message authentication failed")
+	// errNoiseUnsupportedPeer is returned for peers whose connection can't be upgraded.
+	errNoiseUnsupportedPeer = errors.New("p2p: noise handshake requires a peer with an upgradable connection")
+)
+
+// connUpgrader is implemented by peers whose connection can be swapped for a
+// wrapped one once the handshake is done.
+type connUpgrader interface {
+	Peer
+	UpgradeConn(func(net.Conn) net.Conn)
+}
+
+// NoiseConfig configures the Noise handshake.
+type NoiseConfig struct {
+	// StaticKey is the node's long-term X25519 identity key.
+	StaticKey *ecdh.PrivateKey
+	// VerifyPeer is called with the remote side's authenticated static public
+	// key. Returning an error aborts the handshake. If nil, any key is accepted.
+	VerifyPeer func(remoteStatic []byte) error
+}
+
+// NewNoiseHandshakeFunc returns a HandshakeFunc that runs a Noise_XX handshake
+// (X25519, AES-GCM, SHA-256) over the peer's connection.
+//
+// XX authenticates both sides' static keys and derives fresh session keys
+// from ephemeral keys on every connection, giving forward secrecy. After the
+// handshake the peer's connection is replaced by an encrypted one, so all
+// subsequent traffic, including streams, goes through the session cipher.
+// The dialing side acts as the Noise initiator.
+func NewNoiseHandshakeFunc(cfg NoiseConfig) HandshakeFunc {
+	return func(p Peer) error {
+		up, ok := p.(connUpgrader)
+		if !ok {
+			return errNoiseUnsupportedPeer
+		}
+
+		hs, err := newNoiseHandshake(cfg.StaticKey, up.Outbound())
+		if err != nil {
+			return err
+		}
+
+		send, recv, err := hs.run(p)
+		if err != nil {
+			return fmt.Errorf("noise handshake: %w", err)
+		}
+
+		if cfg.VerifyPeer != nil {
+			if err := cfg.VerifyPeer(hs.rs.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		up.UpgradeConn(func(conn net.Conn) net.Conn {
+			return &noiseConn{
+				Conn:         conn,
+				send:         send,
+				recv:         recv,
+				remoteStatic: hs.rs.Bytes(),
+			}
+		})
+
+		return nil
+	}
+}
+
+// noiseCipherState is the Noise CipherState: a key and a nonce counter.
+type noiseCipherState struct {
+	aead  cipher.AEAD
+	n     uint64
+	nonce [12]byte // Scratch space for the nonce, sealing and opening never keep it.
+}
+
+// newNoiseCipherState creates a cipher state keyed with k.
+func newNoiseCipherState(k []byte) (*noiseCipherState, error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipherState{aead: aead}, nil
+}
+
+// nonce returns the AES-GCM nonce for the current counter: 32 zero bits
+// followed by the big-endian counter.
+func (cs *noiseCipherState) nextNonce() []byte {
+	binary.BigEndian.PutUint64(cs.nonce[4:], cs.n)
+	return cs.nonce[:]
+}
+
+// encrypt seals plaintext with associated data ad and advances the nonce.
+func (cs *noiseCipherState) encrypt(ad, plaintext []byte) []byte {
+	return cs.seal(nil, ad, plaintext)
+}
+
+// decrypt opens ciphertext with associated data ad and advances the nonce.
+func (cs *noiseCipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return cs.open(nil, ad, ciphertext)
+}
+
+// seal is encrypt appending the ciphertext to dst.
+func (cs *noiseCipherState) seal(dst, ad, plaintext []byte) []byte {
+	out := cs.aead.Seal(dst, cs.nextNonce(), plaintext, ad)
+	cs.n++
+	return out
+}
+
+// open is decrypt appending the plaintext to dst.
+func (cs *noiseCipherState) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	out, err := cs.aead.Open(dst, cs.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseDecrypt
+	}
+	cs.n++
+	return out, nil
+}
+
+// noiseHandshake holds the Noise SymmetricState and HandshakeState of one handshake.
+type noiseHandshake struct {
+	initiator bool
+	ck        []byte            // Chaining key.
+	h         []byte            // Handshake hash.
+	cs        *noiseCipherState // Nil until the first MixKey.
+
+	s  *ecdh.PrivateKey // Local static key.
+	e  *ecdh.PrivateKey // Local ephemeral key.
+	rs *ecdh.PublicKey  // Remote static key.
+	re *ecdh.PublicKey  // Remote ephemeral key.
+}
+
+// newNoiseHandshake initializes the handshake state with an empty prologue.
+func newNoiseHandshake(static *ecdh.PrivateKey, initiator bool) (*noiseHandshake, error) {
+	if static == nil {
+		return nil, errors.New("p2p: noise handshake requires a static key")
+	}
+
+	// The protocol name is shorter than the hash, so it is zero padded.
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+
+	hs := &noiseHandshake{
+		initiator: initiator,
+		ck:        append([]byte(nil), h...),
+		h:         h,
+		s:         static,
+	}
+	hs.mixHash(nil) // Empty prologue.
+
+	return hs, nil
+}
+
+// run performs the three XX messages and returns the cipher states for
+// sending and receiving transport messages.
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+func (hs *noiseHandshake) run(rw io.ReadWriter) (send *noiseCipherState, recv *noiseCipherState, err error) {
+	var err2 error
+	if hs.initiator {
+		if err = hs.writeMessageA(rw); err != nil {
+			return
+		}
+		if err = hs.readMessageB(rw); err != nil {
+			return
+		}
+		if err = hs.writeMessageC(rw); err != nil {
+			return
+		}
+		send, recv, err2 = hs.split()
+	} else {
+		if err = hs.readMessageA(rw); err != nil {
+			return
+		}
+		if err = hs.writeMessageB(rw); err != nil {
+			return
+		}
+		if err = hs.readMessageC(rw); err != nil {
+			return
+		}
+		recv, send, err2 = hs.split()
+	}
+
+	return send, recv, err2
+}
+
+// writeMessageA writes "-> e".
+func (hs *noiseHandshake) writeMessageA(w io.Writer) error {
+	var err error
+	if hs.e, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+
+	msg := hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+	msg = append(msg, hs.encryptAndHash(nil)...) // Empty payload.
+
+	return writeNoiseFrame(w, msg)
+}
+
+// readMessageA reads "-> e".
+func (hs *noiseHandshake) readMessageA(r io.Reader) error {
+	msg, err := readNoiseFrame(r)
+	if err != nil {
+		return err
+	}
+	if len(msg) < noiseKeySize {
+		return errors.New("short handshake message")
+	}
+
+	if hs.re, err = ecdh.X25519().NewPublicKey(msg[:noiseKeySize]); err != nil {
+		return err
+	}
+	hs.mixHash(msg[:noiseKeySize])
+
+	_, err = hs.decryptAndHash(msg[noiseKeySize:])
+	return err
+}
+
+// writeMessageB writes "<- e, ee, s, es".
+func (hs *noiseHandshake) writeMessageB(w io.Writer) error {
+	var err error
+	if hs.e, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+
+	msg := hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+
+	if err := hs.mixDH(hs.e, hs.re); err != nil { // ee
+		return err
+	}
+	msg = append(msg, hs.encryptAndHash(hs.s.PublicKey().Bytes())...) // s
+	if err := hs.mixDH(hs.s, hs.re); err != nil {                     // es
+		return err
+	}
+	msg = append(msg, hs.encryptAndHash(nil)...) // Empty payload.
+
+	return writeNoiseFrame(w, msg)
+}
+
+// readMessageB reads "<- e, ee, s, es".
+func (hs *noiseHandshake) readMessageB(r io.Reader) error {
+	msg, err := readNoiseFrame(r)
+	if err != nil {
+		return err
+	}
+	if len(msg) < 2*noiseKeySize+noiseTagSize {
+		return errors.New("short handshake message")
+	}
+
+	if hs.re, err = ecdh.X25519().NewPublicKey(msg[:noiseKeySize]); err != nil {
+		return err
+	}
+	hs.mixHash(msg[:noiseKeySize])
+	msg = msg[noiseKeySize:]
+
+	if err := hs.mixDH(hs.e, hs.re); err != nil { // ee
+		return err
+	}
+
+	rs, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize]) // s
+	if err != nil {
+		return err
+	}
+	if hs.rs, err = ecdh.X25519().NewPublicKey(rs); err != nil {
+		return err
+	}
+	msg = msg[noiseKeySize+noiseTagSize:]
+
+	if err := hs.mixDH(hs.e, hs.rs); err != nil { // es
+		return err
+	}
+
+	_, err = hs.decryptAndHash(msg)
+	return err
+}
+
+// writeMessageC writes "-> s, se".
+func (hs *noiseHandshake) writeMessageC(w io.Writer) error {
+	msg := hs.encryptAndHash(hs.s.PublicKey().Bytes()) // s
+	if err := hs.mixDH(hs.s, hs.re); err != nil {      // se
+		return err
+	}
+	msg = append(msg, hs.encryptAndHash(nil)...) // Empty payload.
+
+	return writeNoiseFrame(w, msg)
+}
+
+// readMessageC reads "-> s, se".
+func (hs *noiseHandshake) readMessageC(r io.Reader) error {
+	msg, err := readNoiseFrame(r)
+	if err != nil {
+		return err
+	}
+	if len(msg) < noiseKeySize+noiseTagSize {
+		return errors.New("short handshake message")
+	}
+
+	rs, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize]) // s
+	if err != nil {
+		return err
+	}
+	if hs.rs, err = ecdh.X25519().NewPublicKey(rs); err != nil {
+		return err
+	}
+
+	if err := hs.mixDH(hs.e, hs.rs); err != nil { // se
+		return err
+	}
+
+	_, err = hs.decryptAndHash(msg[noiseKeySize+noiseTagSize:])
+	return err
+}
+
+// mixHash sets h = HASH(h || data).
+func (hs *noiseHandshake) mixHash(data []byte) {
+	sum := sha256.Sum256(append(hs.h, data...))
+	hs.h = sum[:]
+}
+
+// mixDH mixes the Diffie-Hellman result of priv and pub into the chaining key.
+func (hs *noiseHandshake) mixDH(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+
+	ck, k := noiseHKDF(hs.ck, shared)
+	hs.ck = ck
+	hs.cs, err = newNoiseCipherState(k)
+	return err
+}
+
+// encryptAndHash encrypts plaintext with the handshake hash as associated data
+// (or passes it through before the first key is mixed in) and hashes the result.
+func (hs *noiseHandshake) encryptAndHash(plaintext []byte) []byte {
+	out := plaintext
+	if hs.cs != nil {
+		out = hs.cs.encrypt(hs.h, plaintext)
+	}
+	hs.mixHash(out)
+	return out
+}
+
+// decryptAndHash reverses encryptAndHash.
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out := ciphertext
+	if hs.cs != nil {
+		var err error
+		if out, err = hs.cs.decrypt(hs.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(ciphertext)
+	return out, nil
+}
+
+// split derives the two transport cipher states: the first one encrypts
+// initiator to responder traffic, the second one the other direction.
+func (hs *noiseHandshake) split() (*noiseCipherState, *noiseCipherState, error) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+
+	c1, err := newNoiseCipherState(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newNoiseCipherState(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c1, c2, nil
+}
+
+// noiseHKDF is the two-output HKDF defined by the Noise specification.
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	tempKey := noiseHMAC(ck, ikm)
+	out1 := noiseHMAC(tempKey, []byte{0x01})
+	out2 := noiseHMAC(tempKey, append(append([]byte(nil), out1...), 0x02))
+	return out1, out2
+}
+
+// noiseHMAC returns HMAC-SHA256(key, data).
+func noiseHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// writeNoiseFrame writes msg prefixed with its 2-byte big-endian length.
+func writeNoiseFrame(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMessage {
+		return errors.New("noise message too large")
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readNoiseFrame reads a length prefixed message written by writeNoiseFrame.
+func readNoiseFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readNoiseFrameInto is readNoiseFrame reading the message into buf, which
+// must hold at least noiseMaxMessage bytes.
+func readNoiseFrameInto(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+
+	msg := buf[:binary.BigEndian.Uint16(buf[:2])]
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// noiseConn encrypts everything written to and decrypts everything read from
+// the wrapped connection with the session keys of a completed handshake.
+// Every Write of up to 64KB becomes one Noise message and every Read returns
+// data from at most one message, preserving message boundaries.
+type noiseConn struct {
+	net.Conn
+
+	writeLock sync.Mutex
+	send      *noiseCipherState
+
+	readLock sync.Mutex
+	recv     *noiseCipherState
+	pending  []byte // Decrypted bytes of the current message not read yet.
+	plain    []byte // Buffer the current message is decrypted into, reused for the next.
+
+	remoteStatic []byte
+}
+
+// RemoteStatic returns the authenticated static public key of the remote side.
+func (c *noiseConn) RemoteStatic() []byte {
+	return c.remoteStatic
+}
+
+// Write encrypts b and writes it to the underlying connection.
+func (c *noiseConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	buf := noisePool.get()
+	defer noisePool.put(buf)
+
+	var written int
+	for written < len(b) {
+		n := len(b) - written
+		if n > noiseMaxMessage-noiseTagSize {
+			n = noiseMaxMessage - noiseTagSize
+		}
+
+		// Seal the message right behind its length prefix
+		frame := c.send.seal((*buf)[:2], nil, b[written:written+n])
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// Read reads and decrypts data from the underlying connection.
+func (c *noiseConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.pending) == 0 {
+		buf := noisePool.get()
+		msg, err := readNoiseFrameInto(c.Conn, *buf)
+		if err == nil {
+			c.plain, err = c.recv.open(c.plain[:0], nil, msg)
+		}
+		noisePool.put(buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.plain
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
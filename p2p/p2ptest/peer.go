@@ -0,0 +1,174 @@
+// Package p2ptest provides in-memory implementations of the p2p interfaces,
+// for testing code built on them without a network: a Transport whose RPCs
+// are delivered by the test and whose peers are connected by it, and a Peer
+// whose connection and streams end in the test.
+package p2ptest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// PeerOpts describes the Peer made by NewPeer.
+type PeerOpts struct {
+	Addr     string        // Address the peer is connected from and announced to be dialed at
+	ID       string        // Node ID announced by the peer, empty if unknown
+	Zone     string        // Zone announced by the peer, empty if unknown
+	Tier     string        // Storage tier announced by the peer, empty if unknown
+	Outbound bool          // Whether the connection was dialed by the node under test
+	RTT      time.Duration // Initial round-trip time estimate, 0 if unknown
+
+	// HandleStream serves every stream opened to the peer, in a goroutine of
+	// its own, and closes it once done. The peer doesn't multiplex streams
+	// if nil: OpenStream returns p2p.ErrNotMultiplexed, and messages and
+	// data are written to the peer itself.
+	HandleStream func(stream net.Conn)
+}
+
+// Peer is a peer connected over net.Pipe: what the node under test writes
+// to it is read from Remote, and what is written to Remote is read from it.
+// Writes block until the other end reads them, as with net.Pipe.
+type Peer struct {
+	net.Conn          // Local end of the pipe
+	Remote   net.Conn // Remote end of the pipe, held by the test
+
+	opts        PeerOpts
+	connectedAt time.Time
+	sent        atomic.Int64
+	received    atomic.Int64
+	streams     atomic.Int32
+
+	mu     sync.Mutex
+	rtt    time.Duration
+	limits p2p.PeerLimits
+}
+
+var _ p2p.Peer = (*Peer)(nil)
+
+// NewPeer returns a peer described by opts, connected now.
+func NewPeer(opts PeerOpts) *Peer {
+	local, remote := net.Pipe()
+	return &Peer{
+		Conn:        local,
+		Remote:      remote,
+		opts:        opts,
+		connectedAt: time.Now(),
+		rtt:         opts.RTT,
+	}
+}
+
+// Read reads what the test wrote to Remote.
+func (p *Peer) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	p.received.Add(int64(n))
+	return n, err
+}
+
+// Write writes b for the test to read from Remote.
+func (p *Peer) Write(b []byte) (int, error) {
+	n, err := p.Conn.Write(b)
+	p.sent.Add(int64(n))
+	return n, err
+}
+
+// Send writes b to the peer in a single write.
+func (p *Peer) Send(b []byte) error {
+	_, err := p.Write(b)
+	return err
+}
+
+// RemoteAddr returns the address the peer is connected from, PeerOpts.Addr.
+func (p *Peer) RemoteAddr() net.Addr {
+	return addr(p.opts.Addr)
+}
+
+// OpenStream opens a stream served by PeerOpts.HandleStream, or returns
+// p2p.ErrNotMultiplexed if there is none.
+func (p *Peer) OpenStream() (net.Conn, error) {
+	if p.opts.HandleStream == nil {
+		return nil, p2p.ErrNotMultiplexed
+	}
+	local, remote := net.Pipe()
+	p.streams.Add(1)
+	go p.opts.HandleStream(remote)
+	return local, nil
+}
+
+// Streams returns how many streams were opened to the peer.
+func (p *Peer) Streams() int {
+	return int(p.streams.Load())
+}
+
+// CloseStream does nothing: the pipe is read by the test, not by a
+// transport waiting for the consumer.
+func (p *Peer) CloseStream() {}
+
+// ID returns PeerOpts.ID.
+func (p *Peer) ID() string { return p.opts.ID }
+
+// AdvertisedAddr returns PeerOpts.Addr.
+func (p *Peer) AdvertisedAddr() string { return p.opts.Addr }
+
+// ProtocolVersion returns p2p.ProtocolVersion.
+func (p *Peer) ProtocolVersion() int { return p2p.ProtocolVersion }
+
+// Compression returns an empty string: messages aren't compressed.
+func (p *Peer) Compression() string { return "" }
+
+// Zone returns PeerOpts.Zone.
+func (p *Peer) Zone() string { return p.opts.Zone }
+
+// Tier returns PeerOpts.Tier.
+func (p *Peer) Tier() string { return p.opts.Tier }
+
+// TransportKind returns "pipe".
+func (p *Peer) TransportKind() string { return "pipe" }
+
+// Outbound returns PeerOpts.Outbound.
+func (p *Peer) Outbound() bool { return p.opts.Outbound }
+
+// ConnectedAt returns when NewPeer made the peer.
+func (p *Peer) ConnectedAt() time.Time { return p.connectedAt }
+
+// RTT returns the round-trip time estimate, the last one observed.
+func (p *Peer) RTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rtt
+}
+
+// ObserveRTT replaces the round-trip time estimate with rtt.
+func (p *Peer) ObserveRTT(rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rtt = rtt
+}
+
+// Stats returns the bytes written to and read from the peer.
+func (p *Peer) Stats() p2p.PeerStats {
+	return p2p.PeerStats{BytesSent: p.sent.Load(), BytesReceived: p.received.Load()}
+}
+
+// Limits returns the limits last set, which aren't enforced.
+func (p *Peer) Limits() p2p.PeerLimits {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limits
+}
+
+// SetLimits records limits, for Limits to return.
+func (p *Peer) SetLimits(limits p2p.PeerLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limits = limits
+}
+
+// addr is the address of a Peer.
+type addr string
+
+func (a addr) Network() string { return "pipe" }
+func (a addr) String() string  { return string(a) }
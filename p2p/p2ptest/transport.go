@@ -0,0 +1,151 @@
+package p2ptest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// ErrClosed is returned by the methods of a Transport once it is closed.
+var ErrClosed = errors.New("p2ptest: transport closed")
+
+// Transport is a transport connecting nothing by itself: the RPCs it
+// consumes are those given to Deliver, inbound peers are those given to
+// Accept, and Dial connects to peers made by DialFunc. The callbacks are
+// called like those of p2p.TCPTransport.
+type Transport struct {
+	ListenAddr       string               // Address returned by Addr
+	OnPeer           func(p2p.Peer) error // Called when a peer connects, which is refused on error
+	OnPeerDisconnect func(p2p.Peer)       // Called once a peer accepted by OnPeer is disconnected
+
+	// DialFunc returns the peer Dial connects to at addr, or the error Dial
+	// fails with. Dial connects to a peer of NewPeer with the Addr and
+	// Outbound options set if nil.
+	DialFunc func(addr string) (*Peer, error)
+
+	rpcch chan p2p.RPC
+
+	mu     sync.Mutex
+	dialed []string
+	peers  map[*Peer]bool
+	closed bool
+}
+
+var _ p2p.Transport = (*Transport)(nil)
+
+// NewTransport returns a transport listening on listenAddr.
+func NewTransport(listenAddr string) *Transport {
+	return &Transport{
+		ListenAddr: listenAddr,
+		rpcch:      make(chan p2p.RPC),
+		peers:      make(map[*Peer]bool),
+	}
+}
+
+// Addr returns ListenAddr.
+func (t *Transport) Addr() string {
+	return t.ListenAddr
+}
+
+// ListenAndAccept does nothing but fail once the transport is closed.
+func (t *Transport) ListenAndAccept() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Consume returns the channel the RPCs given to Deliver are read from.
+func (t *Transport) Consume() <-chan p2p.RPC {
+	return t.rpcch
+}
+
+// Deliver hands rpc to the consumer, waiting for it to read it.
+func (t *Transport) Deliver(rpc p2p.RPC) {
+	t.rpcch <- rpc
+}
+
+// Dial records addr and connects to the peer DialFunc returns for it.
+func (t *Transport) Dial(addr string) error {
+	t.mu.Lock()
+	t.dialed = append(t.dialed, addr)
+	t.mu.Unlock()
+
+	var peer *Peer
+	if t.DialFunc != nil {
+		var err error
+		if peer, err = t.DialFunc(addr); err != nil {
+			return err
+		}
+	} else {
+		peer = NewPeer(PeerOpts{Addr: addr, Outbound: true})
+	}
+	return t.Accept(peer)
+}
+
+// Dialed returns the addresses Dial was called with, in order.
+func (t *Transport) Dialed() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.dialed...)
+}
+
+// Accept connects peer, closing it if OnPeer refuses it.
+func (t *Transport) Accept(peer *Peer) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		peer.Close()
+		return ErrClosed
+	}
+	t.mu.Unlock()
+
+	if t.OnPeer != nil {
+		if err := t.OnPeer(peer); err != nil {
+			peer.Close()
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.peers[peer] = true
+	t.mu.Unlock()
+	return nil
+}
+
+// Disconnect closes peer and tells OnPeerDisconnect, unless the peer was
+// disconnected already.
+func (t *Transport) Disconnect(peer *Peer) {
+	t.mu.Lock()
+	connected := t.peers[peer]
+	delete(t.peers, peer)
+	t.mu.Unlock()
+
+	peer.Close()
+	if connected && t.OnPeerDisconnect != nil {
+		t.OnPeerDisconnect(peer)
+	}
+}
+
+// Close disconnects every peer. Closing it again does nothing.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	peers := make([]*Peer, 0, len(t.peers))
+	for peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+
+	for _, peer := range peers {
+		t.Disconnect(peer)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package p2ptest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	tr := NewTransport("127.0.0.1:3000")
+	var connected, disconnected []p2p.Peer
+	tr.OnPeer = func(p p2p.Peer) error {
+		if p.ID() == "banned" {
+			return errors.New("banned")
+		}
+		connected = append(connected, p)
+		return nil
+	}
+	tr.OnPeerDisconnect = func(p p2p.Peer) { disconnected = append(disconnected, p) }
+	require.NoError(t, tr.ListenAndAccept())
+	assert.Equal(t, "127.0.0.1:3000", tr.Addr())
+
+	// Dialing connects to an outbound peer at the address.
+	require.NoError(t, tr.Dial("127.0.0.1:3001"))
+	require.Len(t, connected, 1)
+	assert.Equal(t, "127.0.0.1:3001", connected[0].RemoteAddr().String())
+	assert.True(t, connected[0].Outbound())
+	tr.DialFunc = func(addr string) (*Peer, error) { return nil, errors.New("unreachable") }
+	assert.Error(t, tr.Dial("127.0.0.1:3002"))
+	assert.Equal(t, []string{"127.0.0.1:3001", "127.0.0.1:3002"}, tr.Dialed())
+
+	// Peers refused are closed.
+	banned := NewPeer(PeerOpts{Addr: "127.0.0.1:3003", ID: "banned"})
+	assert.Error(t, tr.Accept(banned))
+	_, err := banned.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// RPCs delivered are consumed.
+	go tr.Deliver(p2p.RPC{From: "127.0.0.1:3001", Payload: []byte("hello")})
+	rpc := <-tr.Consume()
+	assert.Equal(t, "hello", string(rpc.Payload))
+
+	require.NoError(t, tr.Close())
+	assert.Equal(t, connected, disconnected)
+	assert.ErrorIs(t, tr.ListenAndAccept(), ErrClosed)
+	assert.NoError(t, tr.Close(), "closing again does nothing")
+}
+
+func TestPeer(t *testing.T) {
+	p := NewPeer(PeerOpts{Addr: "127.0.0.1:3001", ID: "remote", Zone: "eu-1"})
+	assert.Equal(t, "remote", p.ID())
+	assert.Equal(t, "eu-1", p.Zone())
+	assert.Equal(t, "127.0.0.1:3001", p2p.DialAddr(p))
+
+	// Without a stream handler, the peer is written to directly.
+	_, err := p.OpenStream()
+	assert.ErrorIs(t, err, p2p.ErrNotMultiplexed)
+	go p.Send([]byte("direct"))
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(p.Remote, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "direct", string(buf))
+	assert.Eventually(t, func() bool { return p.Stats().BytesSent == 6 }, time.Second, time.Millisecond)
+
+	// Streams are served by the handler.
+	p = NewPeer(PeerOpts{Addr: "127.0.0.1:3001", HandleStream: func(stream net.Conn) {
+		defer stream.Close()
+		io.Copy(stream, stream)
+	}})
+	stream, err := p.OpenStream()
+	require.NoError(t, err)
+	go stream.Write([]byte("echo"))
+	_, err = io.ReadFull(stream, buf[:4])
+	require.NoError(t, err)
+	assert.Equal(t, "echo", string(buf[:4]))
+	assert.Equal(t, 1, p.Streams())
+}
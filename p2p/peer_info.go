@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// Versions of the wire protocol, negotiated per connection in the hello
+// handshake: both sides speak the lower of the versions they announce, so
+// nodes of a cluster can be upgraded one at a time.
+//
+//	1 messages are gob encoded as a whole
+//	2 messages name the type of their payload in a fixed header
+//	3 files are sent in chunks checked with a CRC32C
+const (
+	ProtocolVersion    = 3 // Version of the wire protocol spoken by this node
+	MinProtocolVersion = 1 // Oldest version this node still speaks
+)
+
+// rttWeight is the inverse of the weight new samples get in the round-trip
+// time estimate, the smoothing TCP uses (RFC 6298).
+const rttWeight = 8
+
+// peerInfo holds the metadata every Peer exposes. It is embedded by the
+// transport specific peer types, and filled in by the handshake.
+type peerInfo struct {
+	mu          sync.Mutex
+	id          string        // Node ID announced by the peer, empty if unknown.
+	addr        string        // Address the peer announced to be dialed at, empty if unknown.
+	advertise   string        // Address announced to the peer for dialing this node, set by the transport.
+	zone        string        // Zone announced by the peer, empty if unknown.
+	tier        string        // Storage tier announced by the peer, empty if unknown.
+	version     int           // Negotiated protocol version, 0 if unknown.
+	compression string        // Negotiated compression of messages, empty if none.
+	rtt         time.Duration // Round-trip time estimate, 0 if unknown.
+	connectedAt time.Time     // When the connection was established.
+}
+
+// newPeerInfo returns peer metadata for a connection established now.
+func newPeerInfo() peerInfo {
+	return peerInfo{connectedAt: time.Now()}
+}
+
+// ID returns the node ID the peer announced in the handshake, or an empty
+// string if the handshake didn't exchange one.
+func (i *peerInfo) ID() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.id
+}
+
+// AdvertisedAddr returns the address the peer announced in the handshake for
+// dialing it, or an empty string if it didn't announce one.
+func (i *peerInfo) AdvertisedAddr() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.addr
+}
+
+// ProtocolVersion returns the protocol version negotiated with the peer, or 0
+// if the handshake didn't negotiate one.
+func (i *peerInfo) ProtocolVersion() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.version
+}
+
+// Compression returns the compression of messages negotiated with the peer,
+// or an empty string if messages aren't compressed.
+func (i *peerInfo) Compression() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.compression
+}
+
+// Zone returns the zone the peer announced in the handshake, or an empty
+// string if it didn't announce one.
+func (i *peerInfo) Zone() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.zone
+}
+
+// Tier returns the storage tier the peer announced in the handshake, or an
+// empty string if it didn't announce one.
+func (i *peerInfo) Tier() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.tier
+}
+
+// RTT returns the round-trip time estimate for the peer, or 0 if nothing has
+// been measured yet.
+func (i *peerInfo) RTT() time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rtt
+}
+
+// ObserveRTT folds a round-trip time measured with the peer into its
+// estimate, an exponentially weighted moving average starting at the one
+// measured in the handshake.
+func (i *peerInfo) ObserveRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.rtt == 0 {
+		i.rtt = rtt
+		return
+	}
+	i.rtt += (rtt - i.rtt) / rttWeight
+}
+
+// ConnectedAt returns when the connection to the peer was established.
+func (i *peerInfo) ConnectedAt() time.Time {
+	return i.connectedAt
+}
+
+// setHello records what the peer told us in the hello handshake.
+func (i *peerInfo) setHello(hello helloMessage, version int, compression string, rtt time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.id = hello.NodeID
+	i.addr = hello.Addr
+	i.zone = hello.Zone
+	i.tier = hello.Tier
+	i.version = version
+	i.compression = compression
+	i.rtt = rtt
+}
+
+// localAdvertiseAddr returns the address the transport announces to the peer.
+func (i *peerInfo) localAdvertiseAddr() string {
+	return i.advertise
+}
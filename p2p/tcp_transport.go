@@ -1,34 +1,85 @@
 package p2p
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
 )
 
 // TCPPeer represents a peer in the network connected via a TCP connection.
 type TCPPeer struct {
 	net.Conn                 // The underlying TCP connection.
+	peerInfo                 // Metadata exchanged during the handshake.
+	meter                    // Traffic counters and limits.
 	outbound bool            // Indicates whether the connection is outbound or inbound.
 	wg       *sync.WaitGroup // WaitGroup to manage stream synchronization.
+	session  *Session        // Stream multiplexer, nil unless the transport multiplexes connections.
+	kind     string          // What the connection runs over, "tcp" if empty.
 }
 
 // NewTCPPeer creates and returns a new TCPPeer instance.
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
+		peerInfo: newPeerInfo(),
 		outbound: outbound,
 		wg:       &sync.WaitGroup{},
 	}
 }
 
+// Outbound reports whether we dialed the peer (true) or it dialed us (false).
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// TransportKind returns "tcp", or what the connection handed to Attach runs over.
+func (p *TCPPeer) TransportKind() string {
+	if len(p.kind) > 0 {
+		return p.kind
+	}
+	return "tcp"
+}
+
+// UpgradeConn replaces the peer's connection with a wrapped one, e.g. an
+// encrypted session established by the handshake. It must only be called
+// during the handshake.
+func (p *TCPPeer) UpgradeConn(wrap func(net.Conn) net.Conn) {
+	p.Conn = wrap(p.Conn)
+}
+
 // CloseStream signals that the stream has been closed by decrementing the WaitGroup counter.
 func (p *TCPPeer) CloseStream() {
 	p.wg.Done()
 }
 
+// OpenStream opens a new multiplexed stream to the peer. It returns
+// ErrNotMultiplexed if the connection was set up without multiplexing.
+func (p *TCPPeer) OpenStream() (net.Conn, error) {
+	if p.session == nil {
+		return nil, ErrNotMultiplexed
+	}
+	return p.session.Open()
+}
+
+// ReadFrom copies r to the peer's connection, with sendfile where the
+// connection and r allow it.
+func (p *TCPPeer) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := p.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{p.Conn}, r)
+}
+
 // Send writes a byte slice to the peer's TCP connection.
 func (p *TCPPeer) Send(b []byte) error {
 	_, err := p.Conn.Write(b)
@@ -38,9 +89,32 @@ func (p *TCPPeer) Send(b []byte) error {
 // TCPTransportOpts contains configuration options for TCPTransport.
 type TCPTransportOpts struct {
 	ListenAddr    string           // Address where the transport listens for incoming connections.
+	AdvertiseAddr string           // Address peers are told to dial this node at, for nodes behind NAT or in containers.
 	HandshakeFunc HandshakeFunc    // Function for performing the handshake process.
 	Decoder       Decoder          // Decoder for decoding incoming messages.
 	OnPeer        func(Peer) error // Callback function triggered when a new peer is connected.
+
+	// OnPeerDisconnect is called once a peer accepted by OnPeer has disconnected.
+	OnPeerDisconnect func(Peer)
+
+	// OnProtocolError is called when a peer sends something the Decoder
+	// rejects, such as an oversized message, before what carried it is dropped.
+	OnProtocolError func(Peer, error)
+
+	QueueSize   int         // RPCs queued per peer before QueuePolicy applies (default 256).
+	QueuePolicy QueuePolicy // What to do with RPCs arriving while the queue is full.
+
+	DialTimeout      time.Duration // How long dialing a peer may take (default 10s).
+	HandshakeTimeout time.Duration // How long the handshake with a new connection may take (default 10s).
+	ReadTimeout      time.Duration // How long a connection may go without receiving anything before it is dropped, 0 for no limit.
+	WriteTimeout     time.Duration // How long a write to a connection may block before the connection is dropped, 0 for no limit.
+	KeepAlive        time.Duration // Interval of TCP keepalive probes detecting dead connections (default 15s), negative to disable.
+
+	// Multiplex runs every connection through a stream multiplexer after the
+	// handshake. Each incoming stream carries a single message, delivered as an
+	// RPC whose Conn is the stream itself, so transfers no longer block the
+	// connection. Writes must then go through OpenStream instead of the peer.
+	Multiplex bool
 }
 
 // TCPTransport manages the TCP connections for a node in the network.
@@ -75,21 +149,36 @@ func (t *TCPTransport) Close() error {
 
 // Dial attempts to establish an outbound TCP connection to the specified address.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	timeout := t.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: t.KeepAlive}
+	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, true) // Handle the connection in a separate goroutine.
+	go t.handleConn(conn, true, "") // Handle the connection in a separate goroutine.
 
 	return nil
 }
 
+// Attach runs conn, a connection the transport didn't set up itself such as
+// a stream relayed by another peer, like one it dialed (outbound) or accepted:
+// the handshake, multiplexing and OnPeer apply. kind names what the
+// connection runs over, returned by the TransportKind of the peer.
+func (t *TCPTransport) Attach(conn net.Conn, outbound bool, kind string) {
+	go t.handleConn(conn, outbound, kind)
+}
+
 // ListenAndAccept starts the TCP listener and begins accepting incoming connections.
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
 
-	t.listener, err = net.Listen("tcp", t.ListenAddr) // Start listening on the specified address.
+	lc := net.ListenConfig{KeepAlive: t.KeepAlive}                         // Probe accepted connections too.
+	t.listener, err = lc.Listen(context.Background(), "tcp", t.ListenAddr) // Start listening on the specified address.
 	if err != nil {
 		return err
 	}
@@ -113,25 +202,54 @@ func (t *TCPTransport) startAcceptLoop() {
 			fmt.Printf("TCP accept error: %s\n", err) // Log any errors that occur during acceptance.
 		}
 
-		go t.handleConn(conn, false) // Handle the accepted connection in a separate goroutine.
+		go t.handleConn(conn, false, "") // Handle the accepted connection in a separate goroutine.
 	}
 }
 
 // handleConn handles the TCP connection, performing the handshake and processing incoming RPCs.
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+func (t *TCPTransport) handleConn(conn net.Conn, outbound bool, kind string) {
+	var (
+		err       error
+		connected bool // Whether OnPeer accepted the peer.
+	)
+
+	peer := NewTCPPeer(conn, outbound) // Create a new TCPPeer for this connection.
+	peer.advertise = t.AdvertiseAddr
+	peer.kind = kind
 
 	defer func() {
 		fmt.Printf("dropping peer connection: %s", err) // Log the reason for dropping the connection.
 		conn.Close()                                    // Ensure the connection is closed.
-	}()
 
-	peer := NewTCPPeer(conn, outbound) // Create a new TCPPeer for this connection.
+		if connected && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
+	}()
 
-	// Perform the handshake using the provided HandshakeFunc.
+	// Perform the handshake using the provided HandshakeFunc, giving up on
+	// peers that don't complete it in time.
+	timeout := t.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
+	conn.SetDeadline(time.Time{})
+
+	// Count everything after the handshake, including the multiplexer's framing.
+	peer.Conn = &meteredConn{Conn: WithTimeouts(peer.Conn, t.ReadTimeout, t.WriteTimeout), m: &peer.meter}
+	conn = peer.Conn // The handshake may have upgraded the connection.
+
+	// Start multiplexing before anyone gets a chance to open streams to the peer.
+	if t.Multiplex {
+		peer.session = NewSession(conn, outbound)
+	}
+
+	// Queue the peer's RPCs on their own, so it can't crowd out other peers.
+	peer.queue = newInbox(t.QueueSize, t.QueuePolicy, t.rpcch)
+	defer peer.queue.close()
 
 	// If an OnPeer callback is provided, execute it.
 	if t.OnPeer != nil {
@@ -139,6 +257,13 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
+
+	// Multiplexed connections hand every incoming stream off on its own.
+	if peer.session != nil {
+		err = t.acceptStreams(peer)
+		return
+	}
 
 	// Read loop to process incoming RPCs from the peer.
 	for {
@@ -146,6 +271,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		// Decode the incoming RPC from the connection.
 		err = t.Decoder.Decode(conn, &rpc)
 		if err != nil {
+			t.protocolError(peer, err)
 			return
 		}
 
@@ -160,7 +286,43 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			continue
 		}
 
-		// Send the decoded RPC to the transport's RPC channel for further processing.
-		t.rpcch <- rpc
+		// Queue the decoded RPC for further processing.
+		peer.queue.push(rpc)
+	}
+}
+
+// acceptStreams accepts the streams a multiplexed peer opens until the session closes.
+func (t *TCPTransport) acceptStreams(peer *TCPPeer) error {
+	for {
+		stream, err := peer.session.Accept()
+		if err != nil {
+			return err
+		}
+
+		go t.handleStream(peer, stream) // Streams are independent, handle each one on its own.
+	}
+}
+
+// handleStream decodes the message that opens a multiplexed stream and passes
+// it on as an RPC. The stream is left open so the consumer can read any data
+// following the message and write a response.
+func (t *TCPTransport) handleStream(peer *TCPPeer, stream *Stream) {
+	rpc := RPC{}
+	if err := t.Decoder.Decode(stream, &rpc); err != nil || len(rpc.Payload) == 0 {
+		t.protocolError(peer, err)
+		stream.Close() // Nothing we understand, drop the stream.
+		return
+	}
+
+	rpc.From = stream.RemoteAddr().String() // Set the source address of the RPC.
+	rpc.Conn = stream                       // Let the consumer continue on the same stream.
+
+	peer.queue.push(rpc)
+}
+
+// protocolError reports err to OnProtocolError if the Decoder rejected what peer sent.
+func (t *TCPTransport) protocolError(peer *TCPPeer, err error) {
+	if t.OnProtocolError != nil && IsProtocolError(err) {
+		t.OnProtocolError(peer, err)
 	}
 }
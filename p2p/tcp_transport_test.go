@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,3 +26,32 @@ func TestTCPTransport(t *testing.T) {
 	// Test if the TCPTransport can start listening and accepting connections without errors.
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPTransportAttach(t *testing.T) {
+	peers := make(chan Peer, 2)
+	onPeer := func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	tr1 := NewTCPTransport(TCPTransportOpts{HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}, OnPeer: onPeer, Multiplex: true})
+	tr2 := NewTCPTransport(TCPTransportOpts{HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}, OnPeer: onPeer, Multiplex: true})
+
+	// Both ends of a connection set up elsewhere become peers.
+	c1, c2 := net.Pipe()
+	tr1.Attach(c1, true, "relay")
+	tr2.Attach(c2, false, "relay")
+	outbound := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-peers:
+			assert.Equal(t, "relay", p.TransportKind())
+			if p.Outbound() {
+				outbound++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("attached connection never became a peer")
+		}
+	}
+	assert.Equal(t, 1, outbound)
+	assert.Equal(t, "tcp", NewTCPPeer(c1, true).TransportKind())
+}
@@ -1,14 +1,94 @@
 package p2p
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
-// Peer is an interface that represents the remote node.
+// Peer is an interface that represents the remote node. It is made up of the
+// capabilities every transport provides, so code using peers never needs to
+// know which transport a peer belongs to.
 type Peer interface {
+	// Peers are a connection: messages and data of peers that aren't
+	// multiplexed are read from and written to the peer itself.
 	net.Conn
-	Send([]byte) error
+	// Send writes b to the peer in a single write.
+	Send(b []byte) error
+
+	Streamer
+	PeerMeta
+	Metered
+}
+
+// Streamer is implemented by peers that carry independent streams.
+type Streamer interface {
+	// OpenStream opens a new stream to the peer. It returns ErrNotMultiplexed
+	// if the connection doesn't multiplex streams.
+	OpenStream() (net.Conn, error)
+	// CloseStream tells the transport that the consumer is done reading data
+	// that followed a message on the connection itself, so it can resume
+	// reading messages.
 	CloseStream()
 }
 
+// PeerMeta describes a peer and its connection.
+type PeerMeta interface {
+	// ID returns the node ID announced in the handshake, empty if unknown.
+	ID() string
+	// AdvertisedAddr returns the address the peer announced in the handshake
+	// for dialing it, empty if unknown. See DialAddr.
+	AdvertisedAddr() string
+	// ProtocolVersion returns the negotiated protocol version, 0 if unknown.
+	ProtocolVersion() int
+	// Compression returns the algorithm negotiated for compressing the
+	// messages sent to the peer, empty if they aren't compressed.
+	Compression() string
+	// Zone returns the zone the peer announced in the handshake, such as the
+	// rack or availability zone it runs in, empty if unknown.
+	Zone() string
+	// Tier returns the storage tier the peer announced in the handshake, such
+	// as "hot" or "cold", empty if unknown.
+	Tier() string
+	// TransportKind names the transport the peer is connected over ("tcp", "udp", ...).
+	TransportKind() string
+	// Outbound reports whether the connection was dialed by this node, in
+	// which case the remote address is the one the peer listens on.
+	Outbound() bool
+	// RTT returns the current round-trip time estimate, 0 if unknown.
+	RTT() time.Duration
+	// ObserveRTT folds a round-trip time measured by the caller, such as
+	// the time a request took to be answered, into the estimate.
+	ObserveRTT(rtt time.Duration)
+	// ConnectedAt returns when the connection was established.
+	ConnectedAt() time.Time
+}
+
+// Metered is implemented by peers whose traffic is counted and can be limited.
+type Metered interface {
+	// Stats returns the traffic counters of the peer.
+	Stats() PeerStats
+	// Limits returns the limits applied to the peer's traffic.
+	Limits() PeerLimits
+	// SetLimits changes the limits applied to the peer's traffic.
+	SetLimits(PeerLimits)
+}
+
+// DialAddr returns the address to dial p at: the one it announced in the
+// handshake, or else the address it is connected from, which is only where it
+// listens if this node dialed it.
+func DialAddr(p Peer) string {
+	if addr := p.AdvertisedAddr(); len(addr) > 0 {
+		return addr
+	}
+	return p.RemoteAddr().String()
+}
+
+// Both transports' peers implement every capability.
+var (
+	_ Peer = (*TCPPeer)(nil)
+	_ Peer = (*UDPPeer)(nil)
+)
+
 // Transport is anything that handles the communication
 // between the nodes in the network. This can be of the
 // form (TCP, UDP, websockets, ...)
@@ -19,3 +99,9 @@ type Transport interface {
 	Consume() <-chan RPC
 	Close() error
 }
+
+// Both transports implement Transport.
+var (
+	_ Transport = (*TCPTransport)(nil)
+	_ Transport = (*UDPTransport)(nil)
+)
@@ -0,0 +1,665 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet types of the UDP reliability layer.
+const (
+	udpData  byte = 0x1 // Sequenced payload that must be acknowledged.
+	udpAck   byte = 0x2 // Acknowledges a single data packet.
+	udpClose byte = 0x3 // The sender dropped the connection.
+)
+
+const (
+	udpHeaderSize        = 5                      // type (1) + sequence number (4).
+	maxUDPPayload        = 1200                   // Keeps packets below common path MTUs.
+	udpWindow            = 64                     // Packets a sender may run ahead of the oldest unacknowledged one.
+	udpRetransmitTimeout = 200 * time.Millisecond // Wait before resending an unacknowledged packet.
+	udpMaxRetransmits    = 10                     // Resends before the peer is considered gone.
+)
+
+var (
+	// ErrMessageTooLarge is returned when a single Send exceeds what fits in one datagram.
+	ErrMessageTooLarge = fmt.Errorf("p2p: message exceeds %d bytes", maxUDPPayload)
+	// ErrPeerClosed is returned when using a UDP peer that has been closed.
+	ErrPeerClosed = errors.New("p2p: peer closed")
+)
+
+// UDPTransportOpts contains configuration options for UDPTransport.
+type UDPTransportOpts struct {
+	ListenAddr    string           // Address the transport binds its UDP socket to.
+	HandshakeFunc HandshakeFunc    // Function for performing the handshake process.
+	Decoder       Decoder          // Decoder for decoding incoming messages.
+	OnPeer        func(Peer) error // Callback function triggered when a new peer is connected.
+
+	// OnPeerDisconnect is called once a peer accepted by OnPeer has disconnected.
+	OnPeerDisconnect func(Peer)
+
+	// OnProtocolError is called when a peer sends something the Decoder
+	// rejects, such as an oversized message, before what carried it is dropped.
+	OnProtocolError func(Peer, error)
+
+	QueueSize   int         // RPCs queued per peer before QueuePolicy applies (default 256).
+	QueuePolicy QueuePolicy // What to do with RPCs arriving while the queue is full.
+}
+
+// UDPTransport is a Transport over UDP for small, latency sensitive messages
+// such as discovery and control traffic on a LAN.
+//
+// Every Send to a peer becomes one datagram with a sequence number. Receivers
+// acknowledge each datagram, senders retransmit whatever wasn't acknowledged
+// in time and receivers hand payloads out in sequence order, so a peer behaves
+// like an ordered, reliable connection. Large file transfers belong on TCP:
+// there is no congestion control and a single Send is limited to 1200 bytes.
+type UDPTransport struct {
+	UDPTransportOpts
+
+	conn  *net.UDPConn
+	rpcch chan RPC
+
+	mu     sync.Mutex
+	peers  map[string]*UDPPeer
+	closed bool
+
+	// lossy, when set, decides whether an outgoing packet is dropped. Tests
+	// use it to exercise the retransmission logic.
+	lossy func() bool
+}
+
+// NewUDPTransport creates a new UDPTransport instance with the provided options.
+func NewUDPTransport(opts UDPTransportOpts) *UDPTransport {
+	return &UDPTransport{
+		UDPTransportOpts: opts,
+		rpcch:            make(chan RPC, 1024),
+		peers:            make(map[string]*UDPPeer),
+	}
+}
+
+// Addr returns the address the transport is bound to.
+func (t *UDPTransport) Addr() string {
+	if t.conn != nil {
+		return t.conn.LocalAddr().String()
+	}
+	return t.ListenAddr
+}
+
+// Consume returns a read-only channel for consuming incoming RPCs.
+func (t *UDPTransport) Consume() <-chan RPC {
+	return t.rpcch
+}
+
+// ListenAndAccept binds the UDP socket and starts handling incoming packets.
+func (t *UDPTransport) ListenAndAccept() error {
+	addr, err := net.ResolveUDPAddr("udp", t.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	t.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	go t.readLoop()
+	go t.retransmitLoop()
+
+	log.Printf("UDP transport listening on port: %s\n", t.ListenAddr)
+
+	return nil
+}
+
+// Dial sets up a peer for addr. Datagrams to the peer are sent from the
+// listening socket, so ListenAndAccept must have been called first.
+func (t *UDPTransport) Dial(addr string) error {
+	if t.conn == nil {
+		return errors.New("p2p: udp transport is not listening")
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	peer, created := t.getOrCreatePeer(raddr, true)
+	if !created {
+		return nil // Already connected.
+	}
+
+	// An empty data packet announces us to the remote side.
+	if _, err := peer.Write(nil); err != nil {
+		return err
+	}
+
+	go t.handlePeer(peer)
+
+	return nil
+}
+
+// Close closes all peers and the UDP socket.
+func (t *UDPTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	peers := make([]*UDPPeer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+// getOrCreatePeer returns the peer for addr, creating it if it doesn't exist yet.
+func (t *UDPTransport) getOrCreatePeer(addr *net.UDPAddr, outbound bool) (*UDPPeer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if peer, ok := t.peers[addr.String()]; ok {
+		return peer, false
+	}
+
+	peer := newUDPPeer(t, addr, outbound)
+	t.peers[addr.String()] = peer
+
+	return peer, true
+}
+
+// removePeer forgets a closed peer.
+func (t *UDPTransport) removePeer(peer *UDPPeer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.peers[peer.raddr.String()] == peer {
+		delete(t.peers, peer.raddr.String())
+	}
+}
+
+// writePacket sends a single packet to addr.
+func (t *UDPTransport) writePacket(addr *net.UDPAddr, typ byte, seq uint32, payload []byte) error {
+	if t.lossy != nil && t.lossy() {
+		return nil
+	}
+
+	pkt := make([]byte, udpHeaderSize+len(payload))
+	pkt[0] = typ
+	binary.BigEndian.PutUint32(pkt[1:5], seq)
+	copy(pkt[udpHeaderSize:], payload)
+
+	_, err := t.conn.WriteToUDP(pkt, addr)
+	return err
+}
+
+// readLoop reads packets off the socket and dispatches them to their peers.
+func (t *UDPTransport) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("UDP read error: %s\n", err)
+			continue
+		}
+		if n < udpHeaderSize {
+			continue // Not one of ours.
+		}
+
+		typ := buf[0]
+		seq := binary.BigEndian.Uint32(buf[1:5])
+
+		t.mu.Lock()
+		peer, ok := t.peers[addr.String()]
+		closed := t.closed
+		t.mu.Unlock()
+
+		if !ok {
+			// Unknown senders only become peers by sending data.
+			if typ != udpData || closed {
+				continue
+			}
+			peer, _ = t.getOrCreatePeer(addr, false)
+			go t.handlePeer(peer)
+		}
+
+		switch typ {
+		case udpData:
+			payload := make([]byte, n-udpHeaderSize)
+			copy(payload, buf[udpHeaderSize:n])
+			peer.receive(seq, payload)
+		case udpAck:
+			peer.ack(seq)
+		case udpClose:
+			peer.closeLocal()
+		}
+	}
+}
+
+// retransmitLoop periodically resends packets that haven't been acknowledged.
+func (t *UDPTransport) retransmitLoop() {
+	ticker := time.NewTicker(udpRetransmitTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return
+		}
+		peers := make([]*UDPPeer, 0, len(t.peers))
+		for _, peer := range t.peers {
+			peers = append(peers, peer)
+		}
+		t.mu.Unlock()
+
+		for _, peer := range peers {
+			peer.retransmit()
+		}
+	}
+}
+
+// handlePeer performs the handshake and processes incoming RPCs from the peer.
+func (t *UDPTransport) handlePeer(peer *UDPPeer) {
+	var (
+		err       error
+		connected bool // Whether OnPeer accepted the peer.
+	)
+
+	defer func() {
+		log.Printf("dropping udp peer %s: %s\n", peer.raddr, err)
+		peer.Close()
+
+		if connected && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
+	}()
+
+	// Perform the handshake using the provided HandshakeFunc.
+	if err = t.HandshakeFunc(peer); err != nil {
+		return
+	}
+
+	// Queue the peer's RPCs on their own, so it can't crowd out other peers.
+	peer.queue = newInbox(t.QueueSize, t.QueuePolicy, t.rpcch)
+	defer peer.queue.close()
+
+	// If an OnPeer callback is provided, execute it.
+	if t.OnPeer != nil {
+		if err = t.OnPeer(peer); err != nil {
+			return
+		}
+	}
+	connected = true
+
+	// Read loop to process incoming RPCs from the peer.
+	for {
+		rpc := RPC{}
+		if err = t.Decoder.Decode(peer, &rpc); err != nil {
+			t.protocolError(peer, err)
+			return
+		}
+		if peer.isClosed() {
+			err = ErrPeerClosed
+			return
+		}
+
+		rpc.From = peer.raddr.String()
+
+		// Streams are read directly off the peer, wait for the consumer to finish.
+		if rpc.Stream {
+			peer.wg.Add(1)
+			peer.wg.Wait()
+			continue
+		}
+		if len(rpc.Payload) == 0 {
+			continue
+		}
+
+		peer.queue.push(rpc)
+	}
+}
+
+// protocolError reports err to OnProtocolError if the Decoder rejected what peer sent.
+func (t *UDPTransport) protocolError(peer *UDPPeer, err error) {
+	if t.OnProtocolError != nil && IsProtocolError(err) {
+		t.OnProtocolError(peer, err)
+	}
+}
+
+// pendingPacket is a sent data packet waiting for its acknowledgement.
+type pendingPacket struct {
+	payload  []byte
+	sentAt   time.Time
+	attempts int
+}
+
+// UDPPeer represents a peer reached over UDPTransport. It implements net.Conn
+// on top of the reliability layer: every Write is delivered exactly once and in
+// order, and every Read returns the payload of at most one Write.
+type UDPPeer struct {
+	peerInfo // Metadata exchanged during the handshake.
+	meter    // Traffic counters and limits.
+
+	t        *UDPTransport
+	raddr    *net.UDPAddr
+	outbound bool
+	wg       *sync.WaitGroup
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sendSeq  uint32                    // Sequence number of the next outgoing packet.
+	unacked  map[uint32]*pendingPacket // Sent packets waiting to be acknowledged.
+	recvNext uint32                    // Sequence number we deliver next.
+	early    map[uint32][]byte         // Packets that arrived ahead of recvNext.
+	inbox    [][]byte                  // In-order payloads waiting to be read.
+	closed   bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// newUDPPeer creates a peer for the remote address.
+func newUDPPeer(t *UDPTransport, raddr *net.UDPAddr, outbound bool) *UDPPeer {
+	p := &UDPPeer{
+		peerInfo: newPeerInfo(),
+		t:        t,
+		raddr:    raddr,
+		outbound: outbound,
+		wg:       &sync.WaitGroup{},
+		sendSeq:  1,
+		recvNext: 1,
+		unacked:  make(map[uint32]*pendingPacket),
+		early:    make(map[uint32][]byte),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Outbound reports whether we dialed the peer (true) or it contacted us (false).
+func (p *UDPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// TransportKind returns "udp".
+func (p *UDPPeer) TransportKind() string {
+	return "udp"
+}
+
+// Send reliably delivers b to the peer as a single message.
+func (p *UDPPeer) Send(b []byte) error {
+	_, err := p.Write(b)
+	return err
+}
+
+// CloseStream signals that the consumer finished reading a stream.
+func (p *UDPPeer) CloseStream() {
+	p.wg.Done()
+}
+
+// OpenStream is not supported, UDP peers carry a single ordered stream.
+func (p *UDPPeer) OpenStream() (net.Conn, error) {
+	return nil, ErrNotMultiplexed
+}
+
+// Write sends b as one sequenced packet, blocking while the send window is full.
+func (p *UDPPeer) Write(b []byte) (int, error) {
+	if len(b) > maxUDPPayload {
+		return 0, ErrMessageTooLarge
+	}
+
+	p.mu.Lock()
+	for p.sendSeq-p.oldestUnacked() >= udpWindow {
+		if p.closed {
+			p.mu.Unlock()
+			return 0, ErrPeerClosed
+		}
+		if !p.writeDeadline.IsZero() && !time.Now().Before(p.writeDeadline) {
+			p.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.cond.Wait()
+	}
+	if p.closed {
+		p.mu.Unlock()
+		return 0, ErrPeerClosed
+	}
+
+	seq := p.sendSeq
+	p.sendSeq++
+	payload := append([]byte(nil), b...)
+	p.unacked[seq] = &pendingPacket{payload: payload, sentAt: time.Now(), attempts: 1}
+	p.mu.Unlock()
+
+	if err := p.t.writePacket(p.raddr, udpData, seq, payload); err != nil {
+		return 0, err
+	}
+	p.countSent(len(b))
+
+	return len(b), nil
+}
+
+// oldestUnacked returns the lowest sequence number still waiting for an
+// acknowledgement, or the next sequence number if everything was acknowledged.
+// The caller must hold p.mu.
+func (p *UDPPeer) oldestUnacked() uint32 {
+	oldest := p.sendSeq
+	for seq := range p.unacked {
+		if seqBefore(seq, oldest) {
+			oldest = seq
+		}
+	}
+	return oldest
+}
+
+// seqBefore reports whether sequence number a comes before b. Sequence
+// numbers wrap around, so they are compared in serial number arithmetic
+// (RFC 1982): a comes before b if b is less than half the number space ahead.
+// Peers never have more than a window of packets in flight, far less.
+func seqBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// Read returns the next in-order payload received from the peer.
+func (p *UDPPeer) Read(b []byte) (int, error) {
+	n, err := p.read(b)
+	if n > 0 {
+		p.countReceived(n) // Outside of p.mu, this may wait for the receive limit.
+	}
+	return n, err
+}
+
+// read takes the next in-order payload off the inbox.
+func (p *UDPPeer) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.inbox) == 0 {
+		if p.closed {
+			return 0, ErrPeerClosed
+		}
+		if !p.readDeadline.IsZero() && !time.Now().Before(p.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.cond.Wait()
+	}
+
+	n := copy(b, p.inbox[0])
+	if n == len(p.inbox[0]) {
+		p.inbox = p.inbox[1:]
+	} else {
+		p.inbox[0] = p.inbox[0][n:]
+	}
+
+	return n, nil
+}
+
+// receive handles an incoming data packet.
+func (p *UDPPeer) receive(seq uint32, payload []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Senders never run more than a window ahead of what we delivered, so
+	// anything beyond it is bogus. Don't acknowledge it.
+	if !seqBefore(seq, p.recvNext+udpWindow) {
+		return
+	}
+
+	// Acknowledge duplicates too, the previous ack may have been lost.
+	p.t.writePacket(p.raddr, udpAck, seq, nil)
+	if seqBefore(seq, p.recvNext) {
+		return
+	}
+	p.early[seq] = payload
+
+	// Deliver everything that is now in order.
+	for {
+		next, ok := p.early[p.recvNext]
+		if !ok {
+			break
+		}
+		delete(p.early, p.recvNext)
+		p.recvNext++
+		if len(next) > 0 {
+			p.inbox = append(p.inbox, next)
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// ack handles an acknowledgement for a data packet.
+func (p *UDPPeer) ack(seq uint32) {
+	p.mu.Lock()
+	delete(p.unacked, seq)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// retransmit resends overdue packets and closes the peer once a packet has
+// gone unacknowledged for too many attempts.
+func (p *UDPPeer) retransmit() {
+	type resend struct {
+		seq     uint32
+		payload []byte
+	}
+
+	var (
+		due     []resend
+		expired bool
+	)
+	p.mu.Lock()
+	for seq, pkt := range p.unacked {
+		if time.Since(pkt.sentAt) < udpRetransmitTimeout {
+			continue
+		}
+		if pkt.attempts >= udpMaxRetransmits {
+			expired = true
+			break
+		}
+		pkt.attempts++
+		pkt.sentAt = time.Now()
+		due = append(due, resend{seq, pkt.payload})
+	}
+	p.mu.Unlock()
+
+	if expired {
+		p.closeLocal()
+		return
+	}
+
+	for _, r := range due {
+		p.t.writePacket(p.raddr, udpData, r.seq, r.payload)
+	}
+}
+
+// Close notifies the remote side and closes the peer.
+func (p *UDPPeer) Close() error {
+	if p.isClosed() {
+		return nil
+	}
+	p.t.writePacket(p.raddr, udpClose, 0, nil)
+	p.closeLocal()
+	return nil
+}
+
+// closeLocal closes the peer without notifying the remote side.
+func (p *UDPPeer) closeLocal() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+
+	p.t.removePeer(p)
+}
+
+// isClosed reports whether the peer has been closed.
+func (p *UDPPeer) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// LocalAddr returns the address of the transport's UDP socket.
+func (p *UDPPeer) LocalAddr() net.Addr {
+	return p.t.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the remote peer.
+func (p *UDPPeer) RemoteAddr() net.Addr {
+	return p.raddr
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (p *UDPPeer) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future and pending Read calls.
+func (p *UDPPeer) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	p.readTimer = p.armTimer(p.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending Write calls.
+func (p *UDPPeer) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writeDeadline = t
+	p.writeTimer = p.armTimer(p.writeTimer, t)
+	return nil
+}
+
+// armTimer replaces timer with one that wakes up blocked readers and writers
+// when the deadline t passes. The caller must hold p.mu.
+func (p *UDPPeer) armTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUDPTransportReliability sends messages over a link that drops a tenth of
+// all packets and checks they all arrive, exactly once and in order.
+func TestUDPTransportReliability(t *testing.T) {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(1))
+	lossy := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Intn(10) == 0
+	}
+
+	opts := UDPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	}
+
+	peers := make(chan Peer, 1)
+	a := NewUDPTransport(opts)
+	b := NewUDPTransport(opts)
+	a.lossy, b.lossy = lossy, lossy
+	a.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+
+	assert.Nil(t, a.ListenAndAccept())
+	assert.Nil(t, b.ListenAndAccept())
+	defer a.Close()
+	defer b.Close()
+
+	assert.Nil(t, a.Dial(b.Addr()))
+	peer := <-peers
+
+	const count = 100
+	go func() {
+		for i := 0; i < count; i++ {
+			peer.Send([]byte{IncomingMessage})
+			peer.Send([]byte(fmt.Sprintf("message %d", i)))
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case rpc := <-b.Consume():
+			assert.Equal(t, fmt.Sprintf("message %d", i), string(rpc.Payload))
+			assert.Equal(t, a.Addr(), rpc.From)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	assert.Equal(t, ErrMessageTooLarge, peer.Send(make([]byte, maxUDPPayload+1)))
+}
+
+// TestUDPSequenceWraparound checks that packets keep their order when the
+// sequence numbers wrap around.
+func TestUDPSequenceWraparound(t *testing.T) {
+	assert.True(t, seqBefore(math.MaxUint32, 0))
+	assert.False(t, seqBefore(0, math.MaxUint32))
+	assert.False(t, seqBefore(1, 1))
+
+	tr := NewUDPTransport(UDPTransportOpts{ListenAddr: "127.0.0.1:0", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+	p := newUDPPeer(tr, tr.conn.LocalAddr().(*net.UDPAddr), false)
+
+	// Packets arriving out of order across the wrap are delivered in order,
+	// and those delivered before are ignored.
+	p.recvNext = math.MaxUint32 - 1
+	for _, seq := range []uint32{math.MaxUint32, 0, math.MaxUint32 - 1, 1, math.MaxUint32} {
+		p.receive(seq, []byte(fmt.Sprint(seq)))
+	}
+	var got []string
+	for _, b := range p.inbox {
+		got = append(got, string(b))
+	}
+	assert.Equal(t, []string{"4294967294", "4294967295", "0", "1"}, got)
+	assert.Equal(t, uint32(2), p.recvNext)
+
+	// The oldest packet waiting for its ack is the one sent before the wrap.
+	p.sendSeq = 2
+	p.unacked = map[uint32]*pendingPacket{math.MaxUint32: {}, 0: {}, 1: {}}
+	assert.Equal(t, uint32(math.MaxUint32), p.oldestUnacked())
+}
@@ -0,0 +1,8 @@
+package dfs
+
+import "github.com/inagib21/DistributedFileStorageGo/storage"
+
+// Repack garbage collects the packs of the local store, see storage.Store.Repack.
+func (s *FileServer) Repack() (storage.RepackReport, error) {
+	return s.store.Repack()
+}
@@ -0,0 +1,198 @@
+package dfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+const (
+	// defaultPopularityInterval is how often files are checked unless PopularityOpts says otherwise.
+	defaultPopularityInterval = time.Minute
+
+	// defaultPopularCount is the number of objects Popular returns to the admin API unless asked otherwise.
+	defaultPopularCount = 10
+)
+
+// PopularityOpts configures spreading the reads of popular files over more
+// peers.
+//
+// Files of the server read at least HotReads times between two checks are
+// hot: they are replicated to connected peers not holding them yet until
+// Replicas peers do, so the network has more copies to serve them from.
+// Cold peers, which archive what nobody reads, are left out. Copies made
+// that way stay when the file cools down again.
+type PopularityOpts struct {
+	HotReads int64         // Reads between two checks that make a file hot
+	Replicas int           // Peers a hot file is kept on
+	Interval time.Duration // How often files are checked (default 1m)
+}
+
+// FileSpread is emitted when a hot file was replicated to more peers.
+type FileSpread struct {
+	EventMeta
+	Key   string   `json:"key"`   // Key the file was stored under
+	Reads int64    `json:"reads"` // Reads since the previous check
+	To    []string `json:"to"`    // Addresses of the peers the file was sent to
+}
+
+// Popular returns the n objects of the store read most often, replicas held
+// for peers included, most read first. Objects never read are left out.
+func (s *FileServer) Popular(n int) []storage.ObjectMeta {
+	out := []storage.ObjectMeta{}
+	for meta := range s.store.Objects() {
+		if meta.Accesses > 0 {
+			out = append(out, meta)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Accesses != out[j].Accesses {
+			return out[i].Accesses > out[j].Accesses
+		}
+		return out[i].LastAccess.After(out[j].LastAccess)
+	})
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// spreadPopular checks the files of the server every Interval until the
+// server stops.
+func (s *FileServer) spreadPopular() {
+	interval := s.Popularity.Interval
+	if interval <= 0 {
+		interval = defaultPopularityInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Count the reads from the start, those before it don't make files hot
+	reads := make(map[string]int64)
+	for meta := range s.store.Objects() {
+		if meta.ID == s.ID {
+			reads[meta.Key] = meta.Accesses
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := s.spreadHot(reads); err != nil {
+				log.Printf("[%s] spread %d hot files, then failed: %s", s.Transport.Addr(), n, err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// spreadHot replicates the files of the server read at least HotReads times
+// since the access counts in reads to more peers, returning how many files
+// were sent to a peer. It updates reads to the current counts.
+func (s *FileServer) spreadHot(reads map[string]int64) (int, error) {
+	counts := make(map[string]int64)
+	hot := make(map[string]int64) // Reads since the last check of the hot files
+	for meta := range s.store.Objects() {
+		if meta.ID != s.ID {
+			continue
+		}
+		counts[meta.Key] = meta.Accesses
+		if n := meta.Accesses - reads[meta.Key]; n >= s.Popularity.HotReads && n > 0 {
+			hot[meta.Key] = n
+		}
+	}
+	clear(reads)
+	for key, n := range counts {
+		reads[key] = n
+	}
+
+	var peers []p2p.Peer
+	for _, peer := range s.peerList() {
+		if peer.Tier() != TierCold {
+			peers = append(peers, peer)
+		}
+	}
+
+	spread := 0
+	var errs []error
+	for key, n := range hot {
+		to, err := s.spreadFile(key, peers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("spreading (%s): %w", key, err))
+		}
+		if len(to) == 0 {
+			continue
+		}
+		spread++
+		s.events.emit(FileSpread{EventMeta: newEventMeta(), Key: key, Reads: n, To: to})
+	}
+	return spread, errors.Join(errs...)
+}
+
+// spreadFile sends the file stored under key to peers not holding it until
+// Replicas of them do, returning the addresses of the peers it was sent to.
+func (s *FileServer) spreadFile(key string, peers []p2p.Peer) ([]string, error) {
+	hashed := s.hashKey(key)
+	holders := 0
+	var missing []p2p.Peer
+	for _, peer := range peers {
+		stream, err := s.openStream(peer)
+		if err != nil {
+			continue // Legacy peers can't be asked
+		}
+		reply, err := hasFile(stream, s.ID, hashed)
+		stream.Close()
+		switch {
+		case err != nil:
+		case reply.Has:
+			holders++
+		default:
+			missing = append(missing, peer)
+		}
+	}
+	if holders >= s.Popularity.Replicas || len(missing) == 0 {
+		return nil, nil
+	}
+
+	// Replicas sent in the background count as sent once queued
+	var to []string
+	missing = slices.DeleteFunc(missing, func(peer p2p.Peer) bool {
+		if holders < s.Popularity.Replicas && s.queueReplica(peer, key, PriorityRebalance) {
+			holders++
+			to = append(to, peer.RemoteAddr().String())
+			return true
+		}
+		return false
+	})
+	if holders >= s.Popularity.Replicas || len(missing) == 0 {
+		return to, nil
+	}
+
+	sp, err := s.newSpool(key)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.close()
+
+	var errs []error
+	for _, peer := range missing {
+		if holders >= s.Popularity.Replicas {
+			break
+		}
+		msg := Message{Payload: MessageStoreFile{ID: s.ID, Key: hashed, Size: sp.size, Frame: sp.frame(), Retention: s.retentionOf(key), Tenant: s.tenantOf(key), ACL: s.objectACL(key)}}
+		if err := s.replicate(context.Background(), peer, key, &msg, sp, nil); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		holders++
+		to = append(to, peer.RemoteAddr().String())
+	}
+	return to, errors.Join(errs...)
+}
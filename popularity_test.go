@@ -0,0 +1,135 @@
+package dfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpreadHot(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41322")
+	s2 := makeServer(t, "127.0.0.1:41323", "127.0.0.1:41322")
+	s3 := makeServer(t, "127.0.0.1:41324", "127.0.0.1:41322", "127.0.0.1:41323")
+	servers := []*FileServer{s1, s2, s3}
+	s3.Popularity = &PopularityOpts{HotReads: 3, Replicas: 2, Interval: time.Hour} // Checked by hand below
+	for _, s := range servers {
+		s.Coordinator = s1.ID
+		s.ReplicationFactor = 1
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 2 && len(s1.Peers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// holders returns how many peers hold a replica of key stored by s3.
+	holders := func(key string) int {
+		n := 0
+		for _, s := range servers[:2] {
+			if s.store.Has(s3.ID, s3.hashKey(key)) {
+				n++
+			}
+		}
+		return n
+	}
+	require.NoError(t, s3.Store("hot.txt", strings.NewReader("read a lot")))
+	require.NoError(t, s3.Store("cold.txt", strings.NewReader("read once")))
+	require.Eventually(t, func() bool { return holders("hot.txt") == 1 && holders("cold.txt") == 1 }, time.Second, 10*time.Millisecond)
+
+	reads := map[string]int64{}
+	for _, key := range []string{"hot.txt", "hot.txt", "hot.txt", "cold.txt"} {
+		r, err := s3.Get(key)
+		require.NoError(t, err)
+		r.Close()
+	}
+	meta, err := s3.Stat("hot.txt")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, meta.Accesses)
+
+	popular := s3.Popular(1)
+	require.Len(t, popular, 1)
+	assert.Equal(t, "hot.txt", popular[0].Key)
+
+	n, err := s3.spreadHot(reads)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, holders("hot.txt"))
+	assert.Equal(t, 1, holders("cold.txt"))
+	assert.EqualValues(t, 3, reads["hot.txt"])
+
+	// Reads before the last check don't count again.
+	n, err = s3.spreadHot(reads)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	rec := httptest.NewRecorder()
+	s3.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/popular?n=5", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got []storage.ObjectMeta
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.Len(t, got, 2)
+	assert.Equal(t, []string{"hot.txt", "cold.txt"}, []string{got[0].Key, got[1].Key})
+
+	rec = httptest.NewRecorder()
+	s3.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/popular?n=many", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSpreadPopular(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41374")
+	s2 := makeServer(t, "127.0.0.1:41375", "127.0.0.1:41374")
+	s3 := makeServer(t, "127.0.0.1:41376", "127.0.0.1:41374", "127.0.0.1:41375")
+	servers := []*FileServer{s1, s2, s3}
+	s3.Popularity = &PopularityOpts{HotReads: 3, Replicas: 2, Interval: 50 * time.Millisecond}
+	for _, s := range servers {
+		s.Coordinator = s1.ID
+		s.ReplicationFactor = 1
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 2 && len(s1.Peers()) == 2 }, time.Second, 10*time.Millisecond)
+	events, unsubscribe := s3.Subscribe()
+	defer unsubscribe()
+
+	holders := func(key string) int {
+		n := 0
+		for _, s := range servers[:2] {
+			if s.store.Has(s3.ID, s3.hashKey(key)) {
+				n++
+			}
+		}
+		return n
+	}
+	require.NoError(t, s3.Store("hot.txt", strings.NewReader("read a lot")))
+	require.NoError(t, s3.Store("cold.txt", strings.NewReader("read once")))
+	require.Eventually(t, func() bool { return holders("hot.txt") == 1 && holders("cold.txt") == 1 }, time.Second, 10*time.Millisecond)
+
+	// The server finds the file read often on its own and spreads it.
+	for _, key := range []string{"hot.txt", "hot.txt", "hot.txt", "cold.txt"} {
+		r, err := s3.Get(key)
+		require.NoError(t, err)
+		r.Close()
+	}
+	require.Eventually(t, func() bool { return holders("hot.txt") == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, holders("cold.txt"))
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if spread, ok := e.(FileSpread); ok {
+				assert.Equal(t, "hot.txt", spread.Key)
+				assert.EqualValues(t, 3, spread.Reads)
+				return
+			}
+		case <-timeout:
+			t.Fatal("no FileSpread event")
+		}
+	}
+}
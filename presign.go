@@ -0,0 +1,97 @@
+package dfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// ErrInvalidSignature is returned for pre-signed URLs that weren't signed by
+// this server, were tampered with, are used with another method or have
+// expired.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// signedPathPrefix starts the path of every pre-signed URL.
+const signedPathPrefix = "/signed/"
+
+// PresignURL returns the path and query of a URL letting anyone holding it
+// download (method GET) or upload (method PUT) the file stored under key for
+// ttl, so applications can hand their users direct access to storage without
+// proxying the bytes. The URL is served by SignedHandler and the admin API,
+// and signed with a key derived from EncKey; like share tokens, it can't be
+// revoked before it expires.
+func (s *FileServer) PresignURL(method string, key string, ttl time.Duration) (string, error) {
+	if method != http.MethodGet && method != http.MethodPut {
+		return "", fmt.Errorf("pre-signed URLs are for GET and PUT, not %s", method)
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("pre-signed URL ttl must be positive, have %s", ttl)
+	}
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {base64.RawURLEncoding.EncodeToString(s.signURL(method, key, expires))},
+	}
+	return signedPathPrefix + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// verifyURL checks that query signs method on key at now.
+func (s *FileServer) verifyURL(method string, key string, query url.Values, now time.Time) error {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(mac, s.signURL(method, key, expires)) {
+		return ErrInvalidSignature
+	}
+	if now.Unix() >= expires {
+		return fmt.Errorf("%w: expired at %s", ErrInvalidSignature, time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// signURL returns the signature of a pre-signed URL.
+func (s *FileServer) signURL(method string, key string, expires int64) []byte {
+	mac := hmac.New(sha256.New, crypto.DeriveSubkey(s.EncKey, "presigned-url"))
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, key, expires)
+	return mac.Sum(nil)
+}
+
+// SignedHandler returns an HTTP handler serving nothing but the pre-signed
+// URLs of PresignURL, unlike the admin API fit to be exposed to end users.
+// Browsers on other origins may use them as CORS allows.
+func (s *FileServer) SignedHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.handleSigned(mux)
+	return s.withCORS(mux)
+}
+
+// handleSigned adds the endpoints of the pre-signed URLs to mux.
+func (s *FileServer) handleSigned(mux *http.ServeMux) {
+	signed := func(serve func(w http.ResponseWriter, r *http.Request, key string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := r.PathValue("key")
+			if err := s.verifyURL(r.Method, key, r.URL.Query(), time.Now()); err != nil {
+				writeError(w, statusFor(err), err)
+				return
+			}
+			serve(w, r, key)
+		}
+	}
+	mux.HandleFunc("GET /signed/{key...}", signed(func(w http.ResponseWriter, r *http.Request, key string) {
+		s.serveFile(w, r, key, "")
+	}))
+	mux.HandleFunc("PUT /signed/{key...}", signed(s.serveStore))
+}
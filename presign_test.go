@@ -0,0 +1,56 @@
+package dfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresignURL(t *testing.T) {
+	s := newExportServer(t)
+	api := httptest.NewServer(s.SignedHandler())
+	defer api.Close()
+	do := func(method string, path string, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(b)
+	}
+
+	put, err := s.PresignURL(http.MethodPut, "uploads/cat picture.jpg", time.Minute)
+	require.NoError(t, err)
+	res, _ := do(http.MethodPut, put, "meow")
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	get, err := s.PresignURL(http.MethodGet, "uploads/cat picture.jpg", time.Minute)
+	require.NoError(t, err)
+	res, body := do(http.MethodGet, get, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "meow", body)
+
+	// URLs grant their method on their key only, and only until they expire.
+	res, _ = do(http.MethodPut, get, "woof")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = do(http.MethodGet, strings.Replace(get, "cat", "dog", 1), "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, _ = do(http.MethodGet, "/signed/uploads/cat%20picture.jpg", "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	u, _ := url.Parse(get)
+	assert.ErrorIs(t, s.verifyURL(http.MethodGet, "uploads/cat picture.jpg", u.Query(), time.Now().Add(time.Hour)), ErrInvalidSignature)
+	assert.ErrorIs(t, newExportServer(t).verifyURL(http.MethodGet, "uploads/cat picture.jpg", u.Query(), time.Now()), ErrInvalidSignature)
+	_, err = s.PresignURL(http.MethodDelete, "uploads/cat picture.jpg", time.Minute)
+	assert.Error(t, err)
+
+	// Nothing but the pre-signed URLs is served.
+	res, _ = do(http.MethodGet, "/files/uploads/cat picture.jpg", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,241 @@
+package dfs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between two progress reports of a transfer.
+const progressInterval = 100 * time.Millisecond
+
+// Progress is a snapshot of an ongoing Store or Get.
+type Progress struct {
+	Key         string         // Key of the file being transferred
+	Transferred int64          // Bytes transferred so far, locally and to or from all peers
+	Total       int64          // Bytes to transfer in total, -1 while unknown
+	Elapsed     time.Duration  // Time since the transfer started
+	ETA         time.Duration  // Estimated time remaining, 0 if unknown
+	Peers       []PeerProgress // Breakdown per peer, sorted by address
+	Done        bool           // Set on the last report of the transfer
+}
+
+// PeerProgress is the part of a transfer going to or coming from a single peer.
+type PeerProgress struct {
+	Addr        string // Remote address of the peer
+	Transferred int64  // Bytes transferred so far, by the current attempt
+	Total       int64  // Bytes to transfer, -1 if unknown
+	Attempts    int    // Attempts made at sending the file, 0 for transfers from the peer
+	Err         string // Why the transfer failed for good, empty unless it did
+}
+
+// ProgressFunc receives progress reports. It is called at most every 100ms
+// while a transfer is running and once more when it is done.
+type ProgressFunc func(Progress)
+
+// progressTracker collects the progress of a single transfer and reports it.
+// A nil tracker is valid and tracks nothing.
+type progressTracker struct {
+	fn      ProgressFunc
+	key     string
+	started time.Time
+
+	mu          sync.Mutex
+	transferred int64 // Bytes transferred locally
+	total       int64 // Bytes to transfer locally, -1 if unknown
+	peers       map[string]*PeerProgress
+	lastReport  time.Time
+}
+
+// newProgressTracker returns a tracker reporting to fn, or nil if fn is nil.
+func newProgressTracker(key string, total int64, fn ProgressFunc) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{
+		fn:      fn,
+		key:     key,
+		started: time.Now(),
+		total:   total,
+		peers:   make(map[string]*PeerProgress),
+	}
+}
+
+// setTotal sets the number of bytes transferred locally once it is known.
+func (t *progressTracker) setTotal(total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.total = total
+	t.mu.Unlock()
+}
+
+// addPeer adds a peer expected to transfer total bytes.
+func (t *progressTracker) addPeer(addr string, total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.peers[addr] = &PeerProgress{Addr: addr, Total: total}
+	t.mu.Unlock()
+}
+
+// attempt starts a new attempt at sending total bytes to peer, counting
+// its bytes from zero again.
+func (t *progressTracker) attempt(addr string, total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &PeerProgress{Addr: addr}
+		t.peers[addr] = p
+	}
+	p.Transferred, p.Total, p.Err = 0, total, ""
+	p.Attempts++
+	t.mu.Unlock()
+}
+
+// fail records that the transfer to peer failed for good.
+func (t *progressTracker) fail(addr string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if p, ok := t.peers[addr]; ok {
+		p.Err = err.Error()
+	}
+	t.mu.Unlock()
+}
+
+// reader counts the bytes read from r towards peer, or towards the local part if peer is empty.
+func (t *progressTracker) reader(r io.Reader, peer string) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t, peer: peer}
+}
+
+// writer counts the bytes written to w towards peer.
+func (t *progressTracker) writer(w io.Writer, peer string) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &progressWriter{w: w, t: t, peer: peer}
+}
+
+// add records n bytes transferred and reports if the last report is long enough ago.
+func (t *progressTracker) add(peer string, n int) {
+	t.mu.Lock()
+	if len(peer) == 0 {
+		t.transferred += int64(n)
+	} else if p, ok := t.peers[peer]; ok {
+		p.Transferred += int64(n)
+	}
+
+	if time.Since(t.lastReport) < progressInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastReport = time.Now()
+	p := t.snapshot()
+	t.mu.Unlock()
+
+	t.fn(p)
+}
+
+// done sends the final report.
+func (t *progressTracker) done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	p := t.snapshot()
+	t.mu.Unlock()
+
+	p.Done = true
+	p.ETA = 0
+	t.fn(p)
+}
+
+// snapshot builds a report from the current state. The caller must hold t.mu.
+func (t *progressTracker) snapshot() Progress {
+	p := Progress{
+		Key:         t.key,
+		Transferred: t.transferred,
+		Total:       t.total,
+		Elapsed:     time.Since(t.started),
+		Peers:       make([]PeerProgress, 0, len(t.peers)),
+	}
+	for _, peer := range t.peers {
+		p.Peers = append(p.Peers, *peer)
+		p.Transferred += peer.Transferred
+		if p.Total >= 0 && peer.Total >= 0 {
+			p.Total += peer.Total
+		} else {
+			p.Total = -1
+		}
+	}
+	sort.Slice(p.Peers, func(i, j int) bool { return p.Peers[i].Addr < p.Peers[j].Addr })
+
+	// Assume the rest goes as fast as what's done so far.
+	if p.Total > 0 && p.Transferred > 0 && p.Transferred < p.Total {
+		rate := float64(p.Transferred) / float64(p.Elapsed)
+		p.ETA = time.Duration(float64(p.Total-p.Transferred) / rate)
+	}
+
+	return p
+}
+
+// progressReader counts the bytes read through it.
+type progressReader struct {
+	r    io.Reader
+	t    *progressTracker
+	peer string
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.add(r.peer, n)
+	}
+	return n, err
+}
+
+// progressWriter counts the bytes written through it.
+type progressWriter struct {
+	w    io.Writer
+	t    *progressTracker
+	peer string
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if n > 0 {
+		w.t.add(w.peer, n)
+	}
+	return n, err
+}
+
+// sizeOf returns the number of bytes left in r, or -1 if it can't tell.
+func sizeOf(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }: // bytes.Reader, bytes.Buffer, strings.Reader
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
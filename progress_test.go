@@ -0,0 +1,75 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressTracker(t *testing.T) {
+	var reports []Progress
+	tr := newProgressTracker("key", 10, func(p Progress) { reports = append(reports, p) })
+	tr.addPeer("b", 20)
+	tr.addPeer("a", -1)
+
+	io.Copy(io.Discard, tr.reader(strings.NewReader("0123456789"), ""))
+	tr.writer(io.Discard, "b").Write(make([]byte, 5))
+	tr.done()
+
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(15), last.Transferred)
+	assert.Equal(t, int64(-1), last.Total) // Peer "a" didn't tell us how much to expect
+	assert.Equal(t, []PeerProgress{{Addr: "a", Total: -1}, {Addr: "b", Transferred: 5, Total: 20}}, last.Peers)
+
+	// A nil tracker tracks nothing.
+	var nilTracker *progressTracker
+	r := strings.NewReader("data")
+	assert.Equal(t, io.Reader(r), nilTracker.reader(r, ""))
+	nilTracker.done()
+}
+
+func TestProgressETA(t *testing.T) {
+	tr := newProgressTracker("key", 100, func(Progress) {})
+	tr.started = time.Now().Add(-time.Second)
+	tr.transferred = 25
+
+	p := tr.snapshot()
+	assert.InDelta(t, 3*time.Second, p.ETA, float64(100*time.Millisecond))
+}
+
+func TestStoreGetWithProgress(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41120")
+	s2 := makeServer(t, "127.0.0.1:41121", "127.0.0.1:41120")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	data := bytes.Repeat([]byte("x"), 1<<16)
+
+	var stored Progress
+	assert.Nil(t, s2.StoreWithProgress("progress.bin", bytes.NewReader(data), func(p Progress) { stored = p }))
+	assert.True(t, stored.Done)
+	assert.Equal(t, stored.Total, stored.Transferred)
+	assert.Len(t, stored.Peers, 1)
+	assert.Equal(t, int64(len(data)+16), stored.Peers[0].Transferred)
+
+	assert.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("progress.bin")) }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s2.store.Delete(s2.ID, "progress.bin"))
+
+	var fetched Progress
+	r, err := s2.GetWithProgress("progress.bin", func(p Progress) { fetched = p })
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, data, b)
+	assert.True(t, fetched.Done)
+	assert.Len(t, fetched.Peers, 1)
+	assert.Equal(t, int64(len(data)+16), fetched.Transferred)
+}
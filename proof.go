@@ -0,0 +1,283 @@
+package dfs
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	defaultProofInterval = 10 * time.Minute // How often replicas are challenged unless ProofOpts says otherwise
+	defaultProofSamples  = 4                // Files challenged per round unless ProofOpts says otherwise
+	defaultProofLength   = 4 << 10          // Bytes of the range a challenge covers unless ProofOpts says otherwise
+	proofNonceSize       = 16
+	penaltyFailedProof   = 25 // Failed to prove it holds a replica it claimed
+)
+
+// ErrProofFailed is returned for replicas a peer claims to hold but failed to
+// prove it does.
+var ErrProofFailed = errors.New("proof of storage failed")
+
+// ProofOpts configures proof-of-storage challenges, for networks whose peers
+// aren't trusted to keep the replicas they accepted.
+//
+// Every Interval the server picks Samples of its files and challenges the
+// peers holding a replica of them to prove they still do: they answer with a
+// hash of a random range of the replica, salted with a fresh nonce, which only
+// the bytes of the replica produce. Peers failing a challenge are penalized,
+// see FileServerOpts.BanScore, and sent the replica again.
+type ProofOpts struct {
+	Interval time.Duration // How often replicas are challenged (default 10m)
+	Samples  int           // Files challenged per round (default 4)
+	Length   int64         // Bytes of the range a challenge covers (default 4 KiB)
+}
+
+// ProofFailed is emitted when a peer failed to prove it holds a replica.
+type ProofFailed struct {
+	EventMeta
+	Key    string `json:"key"`    // Key the file was stored under
+	Peer   string `json:"peer"`   // Remote address of the peer
+	ID     string `json:"id"`     // Node ID announced by the peer
+	Reason string `json:"reason"` // How the proof failed
+}
+
+// MessageChallenge asks a peer to prove it holds the replica of a file. The
+// peer answers on the same stream with a gob encoded ChallengeReply.
+type MessageChallenge struct {
+	ID     string // ID of the owner of the file
+	Key    string // Hashed key of the file
+	Offset int64  // First plaintext byte of the range
+	Length int64  // Number of bytes in the range
+	Nonce  []byte // Salt of the hash, fresh for every challenge
+}
+
+// ChallengeReply is the answer to a MessageChallenge.
+type ChallengeReply struct {
+	Has bool   // Whether the peer holds the replica
+	IV  []byte // IV the replica was encrypted with
+	Sum []byte // SHA-256 of the nonce followed by the ciphertext of the range
+}
+
+// proofSum returns the hash answering a challenge with nonce over ciphertext.
+func proofSum(nonce []byte, ciphertext io.Reader) ([]byte, error) {
+	h := sha256.New()
+	h.Write(nonce)
+	if _, err := io.Copy(h, ciphertext); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// proveStorage challenges the peers holding replicas of the files of the
+// server every Interval until the server stops.
+func (s *FileServer) proveStorage() {
+	interval := s.Proofs.Interval
+	if interval <= 0 {
+		interval = defaultProofInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if failed, err := s.challengeRound(); err != nil {
+				log.Printf("[%s] challenging replicas failed, %d failed to prove storage: %s", s.Transport.Addr(), failed, err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// challengeRound challenges the peers holding replicas of Samples files of the
+// server picked at random, returning how many peers failed.
+func (s *FileServer) challengeRound() (int, error) {
+	samples := s.Proofs.Samples
+	if samples <= 0 {
+		samples = defaultProofSamples
+	}
+	var keys []string
+	for meta := range s.store.Objects() {
+		if meta.ID == s.ID && meta.Size > 0 {
+			keys = append(keys, meta.Key)
+		}
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > samples {
+		keys = keys[:samples]
+	}
+
+	failed := 0
+	var errs []error
+	for _, key := range keys {
+		peers, err := s.challengeFile(key, s.peerList())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("challenging (%s): %w", key, err))
+		}
+		failed += len(peers)
+	}
+	return failed, errors.Join(errs...)
+}
+
+// challengeFile challenges peers to prove they hold the replica of the file
+// stored under key, over a random range of it. Peers answering they don't
+// hold one are left alone; those that claim to but can't prove it are
+// penalized and sent the replica again. challengeFile returns the peers that
+// failed. Peers without multiplexing can't be challenged.
+func (s *FileServer) challengeFile(key string, peers []p2p.Peer) ([]p2p.Peer, error) {
+	size, r, err := s.readObject(ioBackground, s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("(%s) can't be read at an offset", key)
+	}
+
+	length := s.Proofs.Length
+	if length <= 0 {
+		length = defaultProofLength
+	}
+	length = min(length, size)
+	offset := rand.Int64N(size - length + 1)
+	plain := make([]byte, length)
+	if _, err := ra.ReadAt(plain, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var failed []p2p.Peer
+	for _, peer := range peers {
+		nonce := make([]byte, proofNonceSize)
+		if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+			return failed, err
+		}
+		msg := MessageChallenge{ID: s.ID, Key: s.hashKey(key), Offset: offset, Length: length, Nonce: nonce}
+		err := s.challenge(peer, key, msg, plain)
+		if err == nil || !errors.Is(err, ErrProofFailed) {
+			continue // Proved it, doesn't hold the file, or couldn't be asked
+		}
+
+		failed = append(failed, peer)
+		addr := peer.RemoteAddr().String()
+		s.events.emit(ProofFailed{EventMeta: newEventMeta(), Key: key, Peer: addr, ID: peer.ID(), Reason: err.Error()})
+		s.penalize(peer, penaltyFailedProof, err)
+		if _, err := s.peer(addr); err != nil {
+			continue // Banned
+		}
+		if s.queueReplica(peer, key, PriorityRepair) {
+			continue
+		}
+		if err := s.sendReplica(peer, key); err != nil {
+			s.replicationFailed(key, peer, err)
+			continue
+		}
+		log.Printf("[%s] sent (%s) to (%s) again after a failed proof", s.Transport.Addr(), key, addr)
+		s.audit(AuditReplicaSent, s.ID, s.hashKey(key), 0, addr, nil)
+	}
+	return failed, nil
+}
+
+// challenge sends msg to peer and checks its answer against plain, the range
+// of the file stored under key the challenge covers. It returns an error
+// wrapping ErrProofFailed if the peer claims to hold the replica but its
+// answer is wrong, nil if it answered right or doesn't hold one.
+func (s *FileServer) challenge(peer p2p.Peer, key string, msg MessageChallenge, plain []byte) error {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := writeMessage(stream, &Message{Payload: msg}); err != nil {
+		return err
+	}
+	var reply ChallengeReply
+	if err := gob.NewDecoder(stream).Decode(&reply); err != nil {
+		return err
+	}
+	if !reply.Has {
+		return nil
+	}
+	if len(reply.IV) != crypto.IVSize {
+		return fmt.Errorf("%w: (%s) answered with a %d byte IV", ErrProofFailed, key, len(reply.IV))
+	}
+
+	// The replica is the file encrypted under its IV, the ciphertext of the
+	// range that of the plaintext.
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	ctr, err := crypto.NewCTRAt(objectKey, reply.IV, msg.Offset)
+	if err != nil {
+		return err
+	}
+	ciphertext := make([]byte, len(plain))
+	ctr.XORKeyStream(ciphertext, plain)
+	want, err := proofSum(msg.Nonce, bytes.NewReader(ciphertext))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reply.Sum, want) {
+		return fmt.Errorf("%w: (%s) answered the wrong hash for %d bytes at %d", ErrProofFailed, key, msg.Length, msg.Offset)
+	}
+	return nil
+}
+
+// handleMessageChallenge proves to the peer asking that this server holds the
+// replica of its file.
+func (s *FileServer) handleMessageChallenge(rpc p2p.RPC, msg MessageChallenge) error {
+	if rpc.Conn == nil {
+		return errors.New("storage challenges need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	if !s.store.Has(msg.ID, msg.Key) {
+		return gob.NewEncoder(rpc.Conn).Encode(ChallengeReply{})
+	}
+
+	// A replica that can't be read fails the proof like a wrong one
+	reply := ChallengeReply{Has: true}
+	iv, sum, err := s.proveReplica(msg)
+	if err == nil {
+		reply.IV, reply.Sum = iv, sum
+	}
+	if err := gob.NewEncoder(rpc.Conn).Encode(reply); err != nil {
+		return err
+	}
+	return err
+}
+
+// proveReplica returns the IV of the local replica msg challenges, and the
+// hash of the nonce followed by the ciphertext of the range.
+func (s *FileServer) proveReplica(msg MessageChallenge) ([]byte, []byte, error) {
+	size, r, err := s.readObject(ioBackground, msg.ID, msg.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	ra, ok := r.(io.ReaderAt)
+	if !ok || size < crypto.IVSize || msg.Offset < 0 || msg.Length < 0 {
+		return nil, nil, fmt.Errorf("[%s] can't answer a challenge for (%s)", s.Transport.Addr(), msg.Key)
+	}
+
+	// The replica on disk is the IV followed by the ciphertext
+	iv := make([]byte, crypto.IVSize)
+	if _, err := ra.ReadAt(iv, 0); err != nil {
+		return nil, nil, err
+	}
+	sum, err := proofSum(msg.Nonce, io.NewSectionReader(ra, crypto.IVSize+msg.Offset, msg.Length))
+	return iv, sum, err
+}
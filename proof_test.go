@@ -0,0 +1,70 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProofOfStorage(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41356", StorageRoot: t.TempDir(), ID: "owner", Proofs: &ProofOpts{Interval: time.Hour, Length: 100}})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41357", StorageRoot: t.TempDir(), BootstrapNodes: []string{"127.0.0.1:41356"}})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	events, cancel := s1.Subscribe()
+	defer cancel()
+
+	data := make([]byte, 10<<10)
+	rand.Read(data)
+	key := s1.hashKey("a.bin")
+	require.NoError(t, s1.Store("a.bin", bytes.NewReader(data)))
+	require.Eventually(t, func() bool { return s2.store.Has("owner", key) }, 2*time.Second, 10*time.Millisecond)
+	peer := s1.peerList()[0]
+
+	// Peers holding their replica prove it,
+	failed, err := s1.challengeFile("a.bin", s1.peerList())
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	assert.Zero(t, s1.score(peer))
+
+	// those that lost it are penalized and sent it again,
+	garbage := make([]byte, len(data)+16)
+	rand.Read(garbage)
+	_, err = s2.store.Write("owner", key, bytes.NewReader(garbage))
+	require.NoError(t, err)
+	failed, err = s1.challengeFile("a.bin", s1.peerList())
+	require.NoError(t, err)
+	assert.Equal(t, []p2p.Peer{peer}, failed)
+	assert.Equal(t, penaltyFailedProof, s1.score(peer))
+	require.Eventually(t, func() bool {
+		for {
+			select {
+			case e := <-events:
+				if e, ok := e.(ProofFailed); ok {
+					return assert.Equal(t, "a.bin", e.Key)
+				}
+			default:
+				return false
+			}
+		}
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		failed, err := s1.challengeFile("a.bin", s1.peerList())
+		return err == nil && len(failed) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// and those that never got it are left alone.
+	require.NoError(t, s2.store.Delete("owner", key))
+	failed, err = s1.challengeFile("a.bin", s1.peerList())
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+}
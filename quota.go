@@ -0,0 +1,281 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+const defaultTenantInterval = 24 * time.Hour // Interval TenantQuota.Bandwidth applies to unless it says otherwise
+
+var (
+	// ErrStorageQuotaExceeded is returned for files that would take their
+	// tenant over its storage quota. It wraps ErrQuotaExceeded.
+	ErrStorageQuotaExceeded = fmt.Errorf("%w: tenant exceeds its storage quota", ErrQuotaExceeded)
+	// ErrBandwidthQuotaExceeded is returned for requests of tenants that
+	// transferred all the bytes their quota allows in the current interval.
+	// It wraps ErrQuotaExceeded.
+	ErrBandwidthQuotaExceeded = fmt.Errorf("%w: tenant exceeds the bytes it may transfer per interval", ErrQuotaExceeded)
+)
+
+// TenantQuota limits what a tenant stores and transfers. Tenants are who
+// the credentials of AuthOpts act for; files stored with their credentials,
+// and the replicas of those files on peers, count against their quota.
+type TenantQuota struct {
+	Storage   int64         `json:"storage"`   // Bytes the files of the tenant may take up on each server, unlimited if zero
+	Bandwidth int64         `json:"bandwidth"` // Bytes the tenant may upload and download through the admin API per Interval, unlimited if zero
+	Interval  time.Duration `json:"interval"`  // Interval Bandwidth applies to (default 24h)
+}
+
+// TenantUsage is what a tenant holds on a server and transferred through
+// its admin API in the current interval, with its quota.
+type TenantUsage struct {
+	Tenant      string        `json:"tenant"`
+	Stored      storage.Usage `json:"stored"`      // Files of the tenant and replicas of them held by the server
+	Transferred int64         `json:"transferred"` // Bytes uploaded and downloaded since Since
+	Since       time.Time     `json:"since"`       // Start of the current interval, zero if the tenant transferred nothing
+	Quota       TenantQuota   `json:"quota"`       // Quota of the tenant, zero if it has none
+}
+
+// tenantKey is the context key of the tenant files are stored for.
+type tenantKey struct{}
+
+// ContextWithTenant returns ctx storing files on behalf of tenant:
+// StoreContext counts the files stored with it against the quota of tenant,
+// refusing those that would take it over its storage quota.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant of ctx, empty if it has none.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantTraffic counts the bytes a tenant transferred since start.
+type tenantTraffic struct {
+	start time.Time
+	bytes int64
+}
+
+// tenantTable tracks the bytes every tenant transferred in its current
+// interval. Traffic is kept in memory only, so intervals start over on
+// restart.
+type tenantTable struct {
+	mu      sync.Mutex
+	traffic map[string]*tenantTraffic
+}
+
+// storageLeft returns how many bytes the object stored under key in
+// namespace id may take up without taking tenant over its storage quota, the
+// object it replaces given back; -1 if tenant has no storage quota.
+func (s *FileServer) storageLeft(tenant string, id string, key string) int64 {
+	q := s.Quotas[tenant]
+	if len(tenant) == 0 || q.Storage <= 0 {
+		return -1
+	}
+	left := q.Storage - s.store.UsageOfTenant(tenant).LogicalBytes
+	if prev, ok := s.store.Meta(id, key); ok && prev.Tenant == tenant {
+		left += prev.Size
+	}
+	return max(left, 0)
+}
+
+// limitTenant returns r failing with ErrStorageQuotaExceeded once it has
+// read more than the storage quota of tenant leaves to the object under key
+// in namespace id, r itself if tenant has no storage quota. Readers of known
+// size are refused up front.
+func (s *FileServer) limitTenant(tenant string, id string, key string, r io.Reader) (io.Reader, error) {
+	left := s.storageLeft(tenant, id, key)
+	if left < 0 {
+		return r, nil
+	}
+	if size := sizeOf(r); size > left {
+		return nil, fmt.Errorf("%w: %s has %d bytes left, (%s) has %d", ErrStorageQuotaExceeded, tenant, left, key, size)
+	}
+	return &quotaReader{r: r, left: left, err: func() error {
+		return fmt.Errorf("%w: %s had %d bytes left for (%s)", ErrStorageQuotaExceeded, tenant, left, key)
+	}}, nil
+}
+
+// admitReplica checks the replica msg announces against the storage quota
+// of its tenant.
+func (s *FileServer) admitReplica(msg MessageStoreFile) error {
+	if left := s.storageLeft(msg.Tenant, msg.ID, msg.Key); left >= 0 && msg.Size > left {
+		return fmt.Errorf("%w: %s has %d bytes left, the replica has %d", ErrStorageQuotaExceeded, msg.Tenant, left, msg.Size)
+	}
+	return nil
+}
+
+// assignTenant counts the object stored under key in namespace id against
+// the quotas of tenant, unless tenant is empty.
+func (s *FileServer) assignTenant(id string, key string, tenant string) {
+	if len(tenant) == 0 {
+		return
+	}
+	err := s.store.UpdateMeta(id, key, func(meta *storage.ObjectMeta) { meta.Tenant = tenant })
+	if err != nil {
+		log.Printf("[%s] assigning (%s) to tenant %s failed: %s", s.Transport.Addr(), key, tenant, err)
+	}
+}
+
+// tenantOf returns the tenant of the file stored under key, empty if it has
+// none.
+func (s *FileServer) tenantOf(key string) string {
+	meta, _ := s.store.Meta(s.ID, key)
+	return meta.Tenant
+}
+
+// chargeTenant adds n bytes to the traffic of tenant in its current interval
+// at now and returns when the interval ends. It fails with
+// ErrBandwidthQuotaExceeded once tenant transferred more than its quota
+// allows, or all of it if n is zero.
+func (s *FileServer) chargeTenant(tenant string, n int64, now time.Time) (time.Time, error) {
+	q := s.Quotas[tenant]
+	if q.Bandwidth <= 0 {
+		return time.Time{}, nil
+	}
+	interval := q.Interval
+	if interval <= 0 {
+		interval = defaultTenantInterval
+	}
+
+	t := &s.tenants
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.traffic == nil {
+		t.traffic = make(map[string]*tenantTraffic)
+	}
+	tr := t.traffic[tenant]
+	if tr == nil || now.Sub(tr.start) >= interval {
+		tr = &tenantTraffic{start: now}
+		t.traffic[tenant] = tr
+	}
+	tr.bytes += n
+	end := tr.start.Add(interval)
+	if tr.bytes > q.Bandwidth || n == 0 && tr.bytes >= q.Bandwidth {
+		return end, fmt.Errorf("%w: %s transferred %d of %d bytes until %s", ErrBandwidthQuotaExceeded, tenant, tr.bytes, q.Bandwidth, end.Format(time.RFC3339))
+	}
+	return end, nil
+}
+
+// meterTenant counts the bytes of the request and response of r against the
+// bandwidth quota of tenant, answering with 429 the requests of tenants over
+// it. Uploads fail once they take the tenant over it; downloads started are
+// served to the end.
+func (s *FileServer) meterTenant(w http.ResponseWriter, r *http.Request, tenant string) (http.ResponseWriter, *http.Request, bool) {
+	if s.Quotas[tenant].Bandwidth <= 0 {
+		return w, r, true
+	}
+	now := time.Now()
+	if end, err := s.chargeTenant(tenant, 0, now); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(end.Sub(now).Seconds())+1))
+		writeError(w, statusFor(err), err)
+		return w, r, false
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body := r.Body
+		r = r.Clone(r.Context())
+		r.Body = &meteredBody{ReadCloser: body, charge: func(n int) error {
+			_, err := s.chargeTenant(tenant, int64(n), time.Now())
+			return err
+		}}
+	}
+	return &meteredWriter{ResponseWriter: w, charge: func(n int) { s.chargeTenant(tenant, int64(n), time.Now()) }}, r, true
+}
+
+// quotaReader reads from r until more than left bytes were read, then fails
+// with err.
+type quotaReader struct {
+	r    io.Reader
+	left int64
+	err  func() error
+}
+
+func (q *quotaReader) Read(b []byte) (int, error) {
+	n, err := q.r.Read(b)
+	q.left -= int64(n)
+	if q.left < 0 {
+		return n, q.err()
+	}
+	return n, err
+}
+
+// meteredBody is a request body charging the bytes read from it.
+type meteredBody struct {
+	io.ReadCloser
+	charge func(n int) error
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if chargeErr := b.charge(n); chargeErr != nil {
+			return n, chargeErr
+		}
+	}
+	return n, err
+}
+
+// meteredWriter is a response writer charging the bytes written to it.
+type meteredWriter struct {
+	http.ResponseWriter
+	charge func(n int)
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.charge(n)
+	return n, err
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController.
+func (w *meteredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TenantUsage returns what tenant holds on this server and transferred
+// through its admin API.
+func (s *FileServer) TenantUsage(tenant string) TenantUsage {
+	u := TenantUsage{Tenant: tenant, Stored: s.store.UsageOfTenant(tenant), Quota: s.Quotas[tenant]}
+	s.tenants.mu.Lock()
+	if tr := s.tenants.traffic[tenant]; tr != nil {
+		u.Transferred, u.Since = tr.bytes, tr.start
+	}
+	s.tenants.mu.Unlock()
+	return u
+}
+
+// Tenants returns the usage of every tenant with a quota, objects held by
+// this server or traffic, by name.
+func (s *FileServer) Tenants() []TenantUsage {
+	names := make(map[string]bool)
+	for tenant := range s.Quotas {
+		names[tenant] = true
+	}
+	for tenant := range s.store.UsageByTenant() {
+		names[tenant] = true
+	}
+	s.tenants.mu.Lock()
+	for tenant := range s.tenants.traffic {
+		names[tenant] = true
+	}
+	s.tenants.mu.Unlock()
+
+	usage := make([]TenantUsage, 0, len(names))
+	for tenant := range names {
+		usage = append(usage, s.TenantUsage(tenant))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
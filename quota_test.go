@@ -0,0 +1,72 @@
+package dfs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantQuotas(t *testing.T) {
+	s := newExportServer(t)
+	s.Auth = &AuthOpts{
+		APIKeys: map[string]Scope{"alice-key": ScopeWrite, "bob-key": ScopeWrite, "admin-key": ScopeAdmin},
+		Tenants: map[string]string{"alice-key": "alice", "bob-key": "bob"},
+	}
+	s.Quotas = map[string]TenantQuota{"alice": {Storage: 10}, "bob": {Bandwidth: 20}}
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+	do := func(method string, path string, key string, body io.Reader) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, body)
+		req.Header.Set("X-Api-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	// Files count against the storage quota of their tenant, rewrites giving
+	// back the bytes of the file they replace.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/files/a.txt", "alice-key", strings.NewReader("12345678")).StatusCode)
+	assert.Equal(t, http.StatusInsufficientStorage, do(http.MethodPut, "/files/b.txt", "alice-key", strings.NewReader("123")).StatusCode)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/files/a.txt", "alice-key", strings.NewReader("1234567890")).StatusCode)
+	streamed := io.MultiReader(strings.NewReader("12"), strings.NewReader("34")) // Of unknown size
+	assert.Equal(t, http.StatusInsufficientStorage, do(http.MethodPut, "/files/c.txt", "alice-key", streamed).StatusCode)
+	assert.False(t, s.store.Has(s.ID, "c.txt"))
+
+	// Replicas are refused when they would take their tenant over its quota.
+	err := s.receiveFile("peer:1", strings.NewReader("x"), MessageStoreFile{ID: "peer", Key: "hash", Size: 1, Tenant: "alice"})
+	assert.ErrorIs(t, err, ErrStorageQuotaExceeded)
+	require.NoError(t, s.receiveFile("peer:1", strings.NewReader("replica"), MessageStoreFile{ID: "peer", Key: "hash", Size: 7, Tenant: "bob"}))
+
+	// Tenants over their bandwidth quota are told to come back later.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/files/d.txt", "bob-key", strings.NewReader("0123456789abcde")).StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/files/d.txt", "bob-key", nil).StatusCode)
+	res := do(http.MethodGet, "/files/d.txt", "bob-key", nil)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/tenants", nil)
+	req.Header.Set("X-Api-Key", "admin-key")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var usage []TenantUsage
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&usage))
+	require.Len(t, usage, 2)
+	assert.Equal(t, "alice", usage[0].Tenant)
+	assert.Equal(t, storage.Usage{Objects: 1, LogicalBytes: 10, PhysicalBytes: 10}, usage[0].Stored)
+	assert.Equal(t, TenantQuota{Storage: 10}, usage[0].Quota)
+	assert.Equal(t, "bob", usage[1].Tenant)
+	assert.EqualValues(t, 2, usage[1].Stored.Objects, "the file and the replica")
+	assert.EqualValues(t, 30, usage[1].Transferred)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/tenants", "bob-key", nil).StatusCode)
+}
@@ -0,0 +1,394 @@
+package dfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// MessageGetRange asks a peer for part of a file. Offset and Length count
+// plaintext bytes; the response carries the IV of the file and just the
+// ciphertext of the range, which the requester decrypts on its own.
+type MessageGetRange struct {
+	ID     string // Namespace (server ID) of the file
+	Key    string // Hashed key of the file
+	Offset int64  // First byte of the range
+	Length int64  // Number of bytes in the range
+
+	// Principal is who the range is fetched for, checked against the ACL of
+	// the replica; nil when the server fetches for itself.
+	Principal *Principal
+}
+
+// GetRange returns length bytes of the file stored under key, starting at
+// offset. A negative length reads to the end of the file, and ranges running
+// past the end are cut short. Only the chunks of chunked files the range
+// overlaps are read, and files not held locally are asked from peers for just
+// the range instead of being downloaded as a whole.
+//
+// The returned reader should be closed.
+func (s *FileServer) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	r, _, err := s.getRange(context.Background(), key, offset, length)
+	return r, err
+}
+
+// getRange is GetRange for the principal of ctx, see ACL, also returning the
+// size of the whole file.
+func (s *FileServer) getRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, int64, error) {
+	if offset < 0 {
+		return nil, 0, fmt.Errorf("negative offset %d", offset)
+	}
+	if err := s.checkACL(ctx, key, storage.PermRead); err != nil {
+		return nil, 0, err
+	}
+
+	if s.store.Has(s.ID, key) {
+		size, r, err := s.readObject(ioForeground, s.ID, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.store.Touch(s.ID, key, time.Now())
+		if isChunkManifest(r) {
+			m, err := readChunkManifest(r)
+			if err != nil {
+				return nil, 0, err
+			}
+			return s.chunkRange(m, offset, length)
+		}
+
+		off, n, err := clipRange(size, offset, length)
+		if err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		return &sectionReadCloser{
+			SectionReader: io.NewSectionReader(r.(io.ReaderAt), off, n),
+			Closer:        r,
+		}, size, nil
+	}
+
+	// Peek at the start of the file to find out whether it is chunked. Peers
+	// that can't serve ranges are asked for the whole file instead.
+	head, size, err := s.fetchRange(ctx, key, 0, int64(len(chunkManifestMagic)))
+	if err != nil {
+		r, err := s.get(key, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.Close()
+		if !s.store.Has(s.ID, key) {
+			return nil, 0, fmt.Errorf("[%s] %w: (%s)", s.Transport.Addr(), ErrKeyNotFound, key)
+		}
+		return s.getRange(ctx, key, offset, length)
+	}
+	magic, err := io.ReadAll(head)
+	head.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if string(magic) == chunkManifestMagic {
+		r, err := s.get(key, nil) // Manifests are small, keep a copy
+		if err != nil {
+			return nil, 0, err
+		}
+		m, err := readChunkManifest(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		return s.chunkRange(m, offset, length)
+	}
+
+	off, n, err := clipRange(size, offset, length)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, _, err := s.fetchRange(ctx, key, off, n)
+	return r, size, err
+}
+
+// clipRange returns the part of [offset, offset+length) within a file of size
+// bytes, reading to the end if length is negative.
+func clipRange(size int64, offset int64, length int64) (int64, int64, error) {
+	if offset > size {
+		return 0, 0, fmt.Errorf("offset %d is past the end of the file (%d bytes)", offset, size)
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return offset, length, nil
+}
+
+// chunkRange returns a reader over a range of the chunked file described by m,
+// reading only the overlapping part of each chunk it covers, and the size of
+// the file.
+func (s *FileServer) chunkRange(m *ChunkManifest, offset int64, length int64) (io.ReadCloser, int64, error) {
+	off, n, err := clipRange(m.Size, offset, length)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := &multiRangeReader{}
+	for i, ref := range m.Chunks {
+		start := int64(i) * m.ChunkSize
+		from := max(off, start)
+		to := min(off+n, start+ref.Size)
+		if from >= to {
+			continue
+		}
+
+		ref := ref
+		r.parts = append(r.parts, func() (io.ReadCloser, error) {
+			return s.objectRange(ref.Key, from-start, to-from)
+		})
+	}
+
+	return r, m.Size, nil
+}
+
+// objectRange returns n bytes of the object stored under key starting at off,
+// reading them from local disk or asking a peer for just that range.
+func (s *FileServer) objectRange(key string, off int64, n int64) (io.ReadCloser, error) {
+	if !s.store.Has(s.ID, key) {
+		r, _, err := s.fetchRange(context.Background(), key, off, n)
+		if err == nil {
+			return r, nil
+		}
+
+		// Fall back to fetching the whole object from peers that can't serve ranges
+		r, err = s.get(key, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.Close()
+	}
+
+	_, r, err := s.readObject(ioForeground, s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	s.store.Touch(s.ID, key, time.Now())
+	return &sectionReadCloser{
+		SectionReader: io.NewSectionReader(r.(io.ReaderAt), off, n),
+		Closer:        r,
+	}, nil
+}
+
+// fetchRange asks the multiplexed peers holding the file stored under key,
+// one at a time, for a range of it, for the principal of ctx. It returns a reader decrypting the range as it arrives and
+// the size of the whole file.
+func (s *FileServer) fetchRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, int64, error) {
+	msg := Message{
+		Payload: MessageGetRange{
+			ID:        s.ID,
+			Key:       s.hashKey(key),
+			Offset:    offset,
+			Length:    length,
+			Principal: principalFrom(ctx),
+		},
+	}
+	s.wakeIdle() // Peers closed for being idle may hold the file
+
+	var (
+		r    io.ReadCloser
+		size int64
+	)
+	found, _ := s.locate(s.ID, s.hashKey(key), func(peer p2p.Peer) bool {
+		stream, err := s.openStream(peer)
+		if err != nil {
+			return false // Ranges need a stream of their own
+		}
+
+		r, size, err = s.fetchRangeFromStream(stream, &msg, key, offset)
+		if err != nil {
+			stream.Close()
+			if !errors.Is(err, ErrKeyNotFound) {
+				log.Printf("[%s] fetching range of (%s) from (%s) failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			}
+			return false
+		}
+		return true
+	})
+	if found {
+		return r, size, nil
+	}
+
+	return nil, 0, fmt.Errorf("[%s] %w: no peer served a range of (%s)", s.Transport.Addr(), ErrKeyNotFound, key)
+}
+
+// rangeHeader follows the response code of a served range request.
+type rangeHeader struct {
+	Size   int64 // Plaintext size of the whole file
+	Length int64 // Bytes of ciphertext following the IV
+}
+
+// fetchRangeFromStream sends a range request on stream and reads the header of
+// the response. A peer not serving the request answers with a
+// *ResponseError, which is returned.
+func (s *FileServer) fetchRangeFromStream(stream net.Conn, msg *Message, key string, offset int64) (io.ReadCloser, int64, error) {
+	if err := writeMessage(stream, msg); err != nil {
+		return nil, 0, err
+	}
+	if err := readResponse(stream); err != nil {
+		return nil, 0, err
+	}
+
+	var header rangeHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return nil, 0, err
+	}
+	iv := make([]byte, crypto.IVSize)
+	if _, err := io.ReadFull(stream, iv); err != nil {
+		return nil, 0, err
+	}
+
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctr, err := crypto.NewCTRAt(objectKey, iv, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &streamReadCloser{
+		Reader: cipher.StreamReader{S: ctr, R: io.LimitReader(stream, header.Length)},
+		Closer: stream,
+	}, header.Size, nil
+}
+
+// handleMessageGetRange sends a range of a locally stored file, or of one
+// being downloaded in swarm mode, to the peer asking for it: the size of the
+// file, the length of the range, the IV and the ciphertext of the range.
+func (s *FileServer) handleMessageGetRange(rpc p2p.RPC, msg MessageGetRange) error {
+	if rpc.Conn == nil {
+		return errors.New("range requests need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	if err := s.checkReplicaACL(rpc.From, msg.Principal, msg.ID, msg.Key, storage.PermRead); err != nil {
+		writeResponse(rpc.Conn, err)
+		return err
+	}
+	header, iv, section, ok := s.swarmReplicaRange(msg)
+	if !ok {
+		fileSize, r, err := s.readReplica(msg.ID, msg.Key)
+		if err != nil {
+			writeResponse(rpc.Conn, err) // Tell the peer why it won't get the range
+			return err
+		}
+		defer r.Close()
+
+		if header, iv, section, err = s.replicaRange(r, fileSize, msg); err != nil {
+			writeResponse(rpc.Conn, err)
+			return err
+		}
+	}
+
+	if err := writeResponse(rpc.Conn, nil); err != nil {
+		return err
+	}
+	if err := binary.Write(rpc.Conn, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := rpc.Conn.Write(iv); err != nil {
+		return err
+	}
+	sent, err := io.Copy(rpc.Conn, section)
+	s.audit(AuditReplicaServed, msg.ID, msg.Key, sent, rpc.From, err)
+	s.accountAddr(rpc.From, PeerTraffic{Served: sent})
+	return err
+}
+
+// replicaRange returns the header of the response to msg, the IV and the
+// ciphertext of the range asked for of the replica r of fileSize bytes.
+func (s *FileServer) replicaRange(r io.Reader, fileSize int64, msg MessageGetRange) (rangeHeader, []byte, io.Reader, error) {
+	var header rangeHeader
+	ra, ok := r.(io.ReaderAt)
+	if !ok || fileSize < crypto.IVSize {
+		return header, nil, nil, fmt.Errorf("[%s] can't serve a range of (%s)", s.Transport.Addr(), msg.Key)
+	}
+
+	// The file on disk is the IV followed by the ciphertext
+	iv := make([]byte, crypto.IVSize)
+	if _, err := ra.ReadAt(iv, 0); err != nil {
+		return header, nil, nil, err
+	}
+	size := fileSize - crypto.IVSize
+	if msg.Offset < 0 {
+		return header, nil, nil, fmt.Errorf("negative offset %d", msg.Offset)
+	}
+	off, n, err := clipRange(size, min(msg.Offset, size), msg.Length)
+	if err != nil {
+		return header, nil, nil, err
+	}
+
+	header.Size, header.Length = size, n
+	return header, iv, io.NewSectionReader(ra, crypto.IVSize+off, n), nil
+}
+
+// multiRangeReader reads a sequence of parts, opening each one only when the
+// previous one is done.
+type multiRangeReader struct {
+	parts []func() (io.ReadCloser, error)
+	cur   io.ReadCloser
+}
+
+func (r *multiRangeReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			cur, err := r.parts[0]()
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.parts = cur, r.parts[1:]
+		}
+
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the part being read and drops the rest.
+func (r *multiRangeReader) Close() error {
+	r.parts = nil
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// sectionReadCloser is a section of a file that closes the file when done.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// streamReadCloser reads from a stream and closes it when done.
+type streamReadCloser struct {
+	io.Reader
+	io.Closer
+}
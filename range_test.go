@@ -0,0 +1,100 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readRange reads a range of key on s.
+func readRange(t *testing.T, s *FileServer, key string, offset int64, length int64) string {
+	t.Helper()
+	r, err := s.GetRange(key, offset, length)
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestGetRangeLocal(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41150")
+	s.ChunkSize = 4
+
+	assert.Nil(t, s.Store("plain", strings.NewReader("0123456789")))
+	assert.Nil(t, s.Append("chunked", strings.NewReader("0123456789")))
+
+	for _, key := range []string{"plain", "chunked"} {
+		assert.Equal(t, "2345", readRange(t, s, key, 2, 4))
+		assert.Equal(t, "789", readRange(t, s, key, 7, 100))
+		assert.Equal(t, "56789", readRange(t, s, key, 5, -1))
+		assert.Equal(t, "", readRange(t, s, key, 10, 5))
+
+		_, err := s.GetRange(key, 11, 1)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestGetRangeRemote(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41151")
+	s2 := makeServer(t, "127.0.0.1:41152", "127.0.0.1:41151")
+	s2.ChunkSize = 1024
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	data := make([]byte, 10*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	assert.Nil(t, s2.Store("plain", bytes.NewReader(data)))
+	assert.Nil(t, s2.Append("chunked", bytes.NewReader(data)))
+	m := manifestOf(t, s2, "chunked")
+	assert.Eventually(t, func() bool {
+		for _, ref := range m.Chunks {
+			if !s1.store.Has(s2.ID, s2.hashKey(ref.Key)) {
+				return false
+			}
+		}
+		return s1.store.Has(s2.ID, s2.hashKey("plain")) && s1.store.Has(s2.ID, s2.hashKey("chunked"))
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s2.store.Clear())
+
+	// The plain file is read from the peer without downloading it.
+	assert.Equal(t, string(data[1000:3000]), readRange(t, s2, "plain", 1000, 2000))
+	assert.False(t, s2.store.Has(s2.ID, "plain"))
+
+	// So are the ranges asked for over HTTP.
+	api := httptest.NewServer(s2.AdminHandler())
+	defer api.Close()
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/files/plain", nil)
+	req.Header.Set("Range", "bytes=-100")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, "bytes 10140-10239/10240", res.Header.Get("Content-Range"))
+	assert.Equal(t, data[len(data)-100:], b)
+	assert.False(t, s2.store.Has(s2.ID, "plain"))
+
+	// Only the manifest of the chunked file is kept, chunks are read in part.
+	assert.Equal(t, string(data[1500:5000]), readRange(t, s2, "chunked", 1500, 3500))
+	assert.True(t, s2.store.Has(s2.ID, "chunked"))
+	for _, ref := range m.Chunks {
+		assert.False(t, s2.store.Has(s2.ID, ref.Key))
+	}
+}
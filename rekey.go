@@ -0,0 +1,107 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// MessageRekeyReplicas asks a peer to move the replicas of the files of ID
+// from the plain hashes of their keys, which older servers sent keys as, to
+// the lookup tokens they are sent as now. Only the owner of the files can
+// derive the tokens, and only the owner is listened to.
+type MessageRekeyReplicas struct {
+	ID   string            // ID of the server the files belong to
+	Keys map[string]string // Lookup token of every key, by the plain hash of the key
+}
+
+// RekeyReplicas tells every peer to move the replicas of the files of this
+// server they hold under the plain hashes of the keys, as stored by older
+// versions, to the lookup tokens of the keys, so they are found again. Like
+// Rehash does for the paths of a store, it moves what is there rather than
+// storing the files again. The peers holding such replicas already know the
+// plain hashes, so pairing them with the tokens tells them nothing new about
+// the keys. It returns the number of files peers were told about.
+func (s *FileServer) RekeyReplicas() (int, error) {
+	keys := make(map[string]string)
+	for _, meta := range s.List("") {
+		if hash, token := s.Hasher.Sum([]byte(meta.Key)), s.hashKey(meta.Key); hash != token {
+			keys[hash] = token
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	s.wakeIdle() // Peers closed for being idle may hold replicas
+	if err := s.broadcast(&Message{Payload: MessageRekeyReplicas{ID: s.ID, Keys: keys}}); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// handleMessageRekeyReplicas moves the replicas its owner asks to be moved to
+// their lookup tokens. Replicas it doesn't hold are skipped.
+func (s *FileServer) handleMessageRekeyReplicas(rpc p2p.RPC, msg MessageRekeyReplicas) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	if err := s.checkOwner(rpc.From, msg.ID); err != nil {
+		return err // Only the owner knows which token goes with which hash
+	}
+
+	var errs []error
+	moved := 0
+	for hash, token := range msg.Keys {
+		if !s.store.Has(msg.ID, hash) {
+			continue
+		}
+		if err := s.rekeyReplica(msg.ID, hash, token); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		moved++
+	}
+	log.Printf("[%s] moved %d replicas of (%s) to their lookup tokens", s.Transport.Addr(), moved, msg.ID)
+	return errors.Join(errs...)
+}
+
+// rekeyReplica moves the replica stored under hash by id to token, along
+// with its metadata. If the owner stored the file again since, the replica
+// under token is kept and the one under hash dropped, unless it is retained.
+func (s *FileServer) rekeyReplica(id string, hash string, token string) error {
+	if s.store.Has(id, token) {
+		err := s.store.Delete(id, hash)
+		s.audit(AuditReplicaDeleted, id, hash, 0, "", err)
+		return err
+	}
+
+	meta, _ := s.store.Meta(id, hash)
+	_, r, err := s.readObject(ioBackground, id, hash)
+	if err != nil {
+		return err
+	}
+	_, err = s.writeReplica(id, token, r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("moving (%s) to (%s): %w", hash, token, err)
+	}
+	err = s.store.UpdateMeta(id, token, func(m *storage.ObjectMeta) {
+		m.Tags, m.Retention, m.Tenant, m.ACL = meta.Tags, meta.Retention, meta.Tenant, meta.ACL
+	})
+	if err != nil {
+		return err
+	}
+
+	// The retention moved along with the replica, the old name needn't keep it
+	if err := s.store.UpdateMeta(id, hash, func(m *storage.ObjectMeta) { m.Retention = nil }); err != nil {
+		return err
+	}
+	err = s.store.Delete(id, hash)
+	s.audit(AuditReplicaDeleted, id, hash, 0, "", err)
+	return err
+}
@@ -0,0 +1,59 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekeyReplicas(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41386")
+	s2 := makeServer(t, "127.0.0.1:41387", "127.0.0.1:41386")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	token, hash := s1.hashKey("a.txt"), s1.Hasher.Sum([]byte("a.txt"))
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("rekeyed")))
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, token) }, 2*time.Second, 10*time.Millisecond)
+
+	// Move the replica to the plain hash of the key, as older versions stored it.
+	_, r, err := s2.store.Read(s1.ID, token)
+	require.NoError(t, err)
+	_, err = s2.store.Write(s1.ID, hash, r)
+	r.Close()
+	require.NoError(t, err)
+	require.NoError(t, s2.store.SetRetention(s1.ID, hash, storage.Retention{LegalHold: true}))
+	require.NoError(t, s2.store.Delete(s1.ID, token))
+
+	// Only the owner may have its replicas moved.
+	from := peerWithID(t, s2, s1.ID).RemoteAddr().String()
+	err = s2.handleMessageRekeyReplicas(p2p.RPC{From: from}, MessageRekeyReplicas{ID: "other", Keys: map[string]string{hash: token}})
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	// The owner has the replica moved to the token, retention included.
+	n, err := s1.RekeyReplicas()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, token) && !s2.store.Has(s1.ID, hash) }, 2*time.Second, 10*time.Millisecond)
+	meta, _ := s2.store.Meta(s1.ID, token)
+	assert.Equal(t, &storage.Retention{LegalHold: true}, meta.Retention)
+
+	// and fetches the file from it again.
+	require.NoError(t, s1.store.Delete(s1.ID, "a.txt"))
+	got, err := s1.Get("a.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(got)
+	got.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "rekeyed", string(data))
+}
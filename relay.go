@@ -0,0 +1,409 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	defaultRelayCircuits      = 32        // Circuits a relay carries at once unless RelayOpts says otherwise
+	defaultRelayBytesInterval = time.Hour // Interval RelayOpts.MaxBytes applies to unless RelayOpts says otherwise
+)
+
+// relayTransport is the transport kind of peers connected through a relay.
+const relayTransport = "relay"
+
+// ErrRelayRefused is returned for connections a relay refused to carry. It
+// wraps ErrPermissionDenied.
+var ErrRelayRefused = fmt.Errorf("%w: relay refused", ErrPermissionDenied)
+
+// MessageRelay asks a relay to connect the sender to the peer with ID To. The
+// relay answers with a response; if it accepted, the stream carries the
+// connection from then on.
+type MessageRelay struct {
+	To string // ID of the node to connect to
+}
+
+// MessageRelayed is sent by a relay to the node a peer asked to connect to.
+// The node answers with a response; if it accepted, the stream carries the
+// connection from then on, the node being the accepting side.
+type MessageRelayed struct {
+	From string // ID of the node connecting
+}
+
+// RelayOpts makes a server a relay, forwarding connections between peers
+// that can't connect directly, such as nodes behind NAT that can only dial
+// out. A peer asks the relay to connect it to one of the relay's other peers
+// by ID, see ConnectRelayed. The connection is a stream to the relay spliced
+// with a stream from the relay to the other peer, over which both ends
+// run the handshake like over a dialed one: the relay only sees ciphertext
+// when the peers encrypt their connections.
+//
+// Relays count the bytes they carry for every node, see RelayStats. A relay
+// that doesn't want to carry third-party traffic lists the nodes it carries
+// connections for in Allow, such as the other nodes of its own cluster.
+type RelayOpts struct {
+	MaxCircuits   int           // Connections carried at once (default 32)
+	MaxBytes      int64         // Bytes any one node may send through the relay per BytesInterval, unlimited if zero
+	BytesInterval time.Duration // Interval MaxBytes applies to (default 1h)
+	Allow         []string      // IDs of the only nodes whose connections are carried, both ends must be listed; every peer's if empty
+}
+
+// RelayStats are the counters of a relay.
+type RelayStats struct {
+	Active   int              `json:"active"`   // Connections carried now
+	Circuits int64            `json:"circuits"` // Connections carried since the server started
+	Refused  int64            `json:"refused"`  // Connections refused since the server started
+	Bytes    int64            `json:"bytes"`    // Bytes carried since the server started
+	Nodes    map[string]int64 `json:"nodes"`    // Bytes sent through the relay by every node since the server started
+}
+
+// relayState tracks the connections a relay carries. The zero value is ready
+// to use.
+type relayState struct {
+	mu    sync.Mutex
+	stats RelayStats
+	usage map[string]*peerUsage // Bytes every node sent in the current interval
+}
+
+// RelayStats returns the counters of the connections this server carried as
+// a relay.
+func (s *FileServer) RelayStats() RelayStats {
+	r := &s.relay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Nodes = make(map[string]int64, len(r.stats.Nodes))
+	for id, n := range r.stats.Nodes {
+		stats.Nodes[id] = n
+	}
+	return stats
+}
+
+// admitCircuit checks a connection from the node with ID from to the one with
+// ID to against RelayOpts, counting it as active if it is carried.
+func (s *FileServer) admitCircuit(from string, to string, now time.Time) error {
+	r := &s.relay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := s.checkCircuit(from, to, now)
+	if err != nil {
+		r.stats.Refused++
+		return err
+	}
+	r.stats.Active++
+	r.stats.Circuits++
+	return nil
+}
+
+// checkCircuit is admitCircuit, with the lock of the relay held.
+func (s *FileServer) checkCircuit(from string, to string, now time.Time) error {
+	opts := s.Relay
+	if opts == nil {
+		return fmt.Errorf("%w: [%s] is not a relay", ErrRelayRefused, s.Transport.Addr())
+	}
+	if len(from) == 0 || from == to {
+		return fmt.Errorf("%w: unknown node", ErrRelayRefused)
+	}
+	if len(opts.Allow) > 0 && (!slices.Contains(opts.Allow, from) || !slices.Contains(opts.Allow, to)) {
+		return fmt.Errorf("%w: connections between (%s) and (%s) aren't carried", ErrRelayRefused, from, to)
+	}
+	circuits := opts.MaxCircuits
+	if circuits <= 0 {
+		circuits = defaultRelayCircuits
+	}
+	if s.relay.stats.Active >= circuits {
+		return fmt.Errorf("%w: carrying %d connections already", ErrRelayRefused, s.relay.stats.Active)
+	}
+	if opts.MaxBytes > 0 {
+		for _, id := range []string{from, to} {
+			if u := s.relayUsage(id, now); u.bytes >= opts.MaxBytes {
+				return fmt.Errorf("%w: (%s) sent %d bytes through the relay already", ErrRelayRefused, id, u.bytes)
+			}
+		}
+	}
+	return nil
+}
+
+// relayUsage returns the bytes the node with ID id sent through the relay in
+// the current interval. The caller must hold the lock of the relay.
+func (s *FileServer) relayUsage(id string, now time.Time) *peerUsage {
+	interval := s.Relay.BytesInterval
+	if interval <= 0 {
+		interval = defaultRelayBytesInterval
+	}
+
+	r := &s.relay
+	if r.usage == nil {
+		r.usage = make(map[string]*peerUsage)
+	}
+	u := r.usage[id]
+	if u == nil || now.Sub(u.start) >= interval {
+		u = &peerUsage{start: now}
+		r.usage[id] = u
+	}
+	return u
+}
+
+// countRelayed records n bytes sent through the relay by the node with ID id,
+// reporting whether it may send more.
+func (s *FileServer) countRelayed(id string, n int) bool {
+	r := &s.relay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stats.Nodes == nil {
+		r.stats.Nodes = make(map[string]int64)
+	}
+	r.stats.Bytes += int64(n)
+	r.stats.Nodes[id] += int64(n)
+	if s.Relay == nil || s.Relay.MaxBytes <= 0 {
+		return true
+	}
+	u := s.relayUsage(id, time.Now())
+	u.bytes += int64(n)
+	return u.bytes < s.Relay.MaxBytes
+}
+
+// handleMessageRelay connects the peer asking to the peer it names, carrying
+// the connection between their streams until either end closes it.
+func (s *FileServer) handleMessageRelay(rpc p2p.RPC, msg MessageRelay) error {
+	if rpc.Conn == nil {
+		return errors.New("relay requests need a multiplexed connection")
+	}
+
+	var from string
+	if peer, err := s.peer(rpc.From); err == nil && peer.TransportKind() != relayTransport {
+		from = peer.ID() // Relayed connections aren't relayed again
+	}
+	if err := s.admitCircuit(from, msg.To, time.Now()); err != nil {
+		writeResponse(rpc.Conn, err)
+		rpc.Conn.Close()
+		return err
+	}
+
+	dst, err := s.openCircuit(from, msg.To)
+	if err != nil {
+		s.closeCircuit()
+		writeResponse(rpc.Conn, err)
+		rpc.Conn.Close()
+		return err
+	}
+	if err := writeResponse(rpc.Conn, nil); err != nil {
+		s.closeCircuit()
+		dst.Close()
+		rpc.Conn.Close()
+		return err
+	}
+
+	log.Printf("[%s] relaying (%s) to (%s)", s.Transport.Addr(), from, msg.To)
+	go s.splice(p2p.WithoutTimeouts(rpc.Conn), from, dst, msg.To)
+	return nil
+}
+
+// openCircuit opens a stream to the peer with ID to that the node with ID
+// from is connected through once the peer accepted it.
+func (s *FileServer) openCircuit(from string, to string) (net.Conn, error) {
+	s.peerLock.Lock()
+	peer := s.peerByID(to)
+	s.peerLock.Unlock()
+	if peer == nil || peer.TransportKind() == relayTransport {
+		return nil, fmt.Errorf("%w: (%s) is not connected to [%s]", ErrPeerNotFound, to, s.Transport.Addr())
+	}
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	stream = &peerStream{Conn: stream, version: peer.ProtocolVersion(), compression: peer.Compression()}
+	stream.SetDeadline(time.Now().Add(s.requestTimeout()))
+	if err := writeMessage(stream, &Message{Payload: MessageRelayed{From: from}}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := readResponse(stream); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetDeadline(time.Time{})
+	return stream, nil
+}
+
+// splice copies between the streams of a connection the relay carries,
+// counting what each node sends, until either end closes it or a node
+// exceeds RelayOpts.MaxBytes.
+func (s *FileServer) splice(a net.Conn, aID string, b net.Conn, bID string) {
+	defer s.closeCircuit()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	forward := func(dst net.Conn, src net.Conn, id string) {
+		defer wg.Done()
+		defer a.Close() // Closing either end closes the connection
+		defer b.Close()
+
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+				if !s.countRelayed(id, n) {
+					log.Printf("[%s] (%s) exceeded the bytes it may send through the relay", s.Transport.Addr(), id)
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go forward(b, a, aID)
+	go forward(a, b, bID)
+	wg.Wait()
+
+	log.Printf("[%s] stopped relaying (%s) to (%s)", s.Transport.Addr(), aID, bID)
+}
+
+// closeCircuit counts a connection the relay carried as closed.
+func (s *FileServer) closeCircuit() {
+	s.relay.mu.Lock()
+	s.relay.stats.Active--
+	s.relay.mu.Unlock()
+}
+
+// connAttacher is implemented by transports running connections they didn't
+// set up themselves, such as p2p.TCPTransport.
+type connAttacher interface {
+	Attach(conn net.Conn, outbound bool, kind string)
+}
+
+// handleMessageRelayed accepts a connection a relay carries from another node.
+func (s *FileServer) handleMessageRelayed(rpc p2p.RPC, msg MessageRelayed) error {
+	if rpc.Conn == nil {
+		return errors.New("relayed connections need a multiplexed connection")
+	}
+	attacher, ok := s.Transport.(connAttacher)
+	if !ok {
+		err := fmt.Errorf("[%s] can't accept relayed connections", s.Transport.Addr())
+		writeResponse(rpc.Conn, err)
+		rpc.Conn.Close()
+		return err
+	}
+	if err := writeResponse(rpc.Conn, nil); err != nil {
+		rpc.Conn.Close()
+		return err
+	}
+
+	conn := p2p.WithoutTimeouts(rpc.Conn)
+	attacher.Attach(&relayedConn{Conn: conn, addr: relayAddr{id: msg.From, relay: rpc.From}}, false, relayTransport)
+	return nil
+}
+
+// ConnectRelayed connects to the node with ID id through a relay, for nodes
+// that can't be dialed, such as ones behind NAT. The peers serving as relays,
+// see RelayOpts, are tried closest first until one carries the connection.
+// The node shows up in Peers once the handshake completes.
+func (s *FileServer) ConnectRelayed(id string) error {
+	attacher, ok := s.Transport.(connAttacher)
+	if !ok {
+		return fmt.Errorf("[%s] can't run relayed connections", s.Transport.Addr())
+	}
+
+	relays := s.relays(id)
+	if len(relays) == 0 {
+		return fmt.Errorf("[%s] %w: no relay to reach (%s) through", s.Transport.Addr(), ErrPeerUnavailable, id)
+	}
+	var errs []error
+	for _, relay := range relays {
+		conn, err := s.openRelayed(relay, id)
+		if err != nil {
+			log.Printf("[%s] relay (%s) didn't connect us to (%s): %s", s.Transport.Addr(), relay.RemoteAddr(), id, err)
+			errs = append(errs, err)
+			continue
+		}
+		attacher.Attach(conn, true, relayTransport)
+		return nil
+	}
+	return fmt.Errorf("[%s] %w: no relay connected us to (%s): %w", s.Transport.Addr(), ErrPeerUnavailable, id, errors.Join(errs...))
+}
+
+// relays returns the peers serving as relays, closest first, leaving out the
+// node with ID id itself and peers connected through a relay.
+func (s *FileServer) relays(id string) []p2p.Peer {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		relays []p2p.Peer
+	)
+	for _, peer := range s.peerList() {
+		if peer.ID() == id || peer.TransportKind() == relayTransport {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if info, err := s.askNodeInfo(peer); err == nil && info.Relay {
+				mu.Lock()
+				relays = append(relays, peer)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return rankHolders(relays)
+}
+
+// openRelayed asks relay to connect this server to the node with ID id,
+// returning the connection.
+func (s *FileServer) openRelayed(relay p2p.Peer, id string) (net.Conn, error) {
+	stream, err := relay.OpenStream() // Without timeouts, the connection may idle
+	if err != nil {
+		return nil, err
+	}
+	stream = &peerStream{Conn: stream, version: relay.ProtocolVersion(), compression: relay.Compression()}
+	stream.SetDeadline(time.Now().Add(s.requestTimeout()))
+	if err := writeMessage(stream, &Message{Payload: MessageRelay{To: id}}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := readResponse(stream); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetDeadline(time.Time{})
+	return &relayedConn{Conn: stream, addr: relayAddr{id: id, relay: relay.RemoteAddr().String()}}, nil
+}
+
+// relayedConn is a connection carried by a relay. It has an address of its
+// own, so peers connected through a relay aren't mistaken for the relay.
+type relayedConn struct {
+	net.Conn
+	addr relayAddr
+}
+
+// RemoteAddr returns the address of the node at the other end.
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// relayAddr is the address of a node reached through a relay: its ID at the
+// address of the relay.
+type relayAddr struct {
+	id    string
+	relay string
+}
+
+func (a relayAddr) Network() string { return relayTransport }
+
+func (a relayAddr) String() string { return a.id + "@" + a.relay }
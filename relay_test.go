@@ -0,0 +1,87 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// peerStatus returns the status of the peer of s with the given ID.
+func peerStatus(s *FileServer, id string) (PeerStatus, bool) {
+	for _, peer := range s.Peers() {
+		if peer.ID == id {
+			return peer, true
+		}
+	}
+	return PeerStatus{}, false
+}
+
+func TestRelay(t *testing.T) {
+	relay := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41342", StorageRoot: t.TempDir(), Relay: &RelayOpts{}})
+	s1 := makeServer(t, "127.0.0.1:41343", "127.0.0.1:41342")
+	s2 := makeServer(t, "127.0.0.1:41344", "127.0.0.1:41342")
+	for _, s := range []*FileServer{relay, s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(relay.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	// Only the relay can carry the connection.
+	assert.Len(t, s1.relays(s2.ID), 1)
+	assert.Empty(t, relay.relays(s1.ID))
+	assert.ErrorIs(t, relay.ConnectRelayed(s1.ID), ErrPeerUnavailable)
+
+	require.NoError(t, s1.ConnectRelayed(s2.ID))
+	require.Eventually(t, func() bool {
+		_, ok1 := peerStatus(s1, s2.ID)
+		_, ok2 := peerStatus(s2, s1.ID)
+		return ok1 && ok2
+	}, 2*time.Second, 10*time.Millisecond)
+	peer, _ := peerStatus(s1, s2.ID)
+	assert.Equal(t, "relay", peer.Transport)
+	assert.Equal(t, s2.ID+"@127.0.0.1:41342", peer.Addr)
+
+	// Files reach the peer through the relay.
+	require.NoError(t, s1.Store("key", bytes.NewReader([]byte("relayed"))))
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("key")) }, 2*time.Second, 10*time.Millisecond)
+
+	stats := relay.RelayStats()
+	assert.Equal(t, 1, stats.Active)
+	assert.Equal(t, int64(1), stats.Circuits)
+	assert.Positive(t, stats.Nodes[s1.ID])
+	assert.Positive(t, stats.Nodes[s2.ID])
+	assert.Equal(t, stats.Nodes[s1.ID]+stats.Nodes[s2.ID], stats.Bytes)
+
+	// Closing the relayed connection closes the circuit.
+	require.NoError(t, s1.Disconnect(peer.Addr))
+	require.Eventually(t, func() bool { return relay.RelayStats().Active == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRelayRefused(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41346", "127.0.0.1:41345")
+	s2 := makeServer(t, "127.0.0.1:41347", "127.0.0.1:41345")
+	relay := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41345", StorageRoot: t.TempDir(), Relay: &RelayOpts{Allow: []string{s1.ID, "someone"}}})
+	for _, s := range []*FileServer{relay, s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(relay.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	// A relay carries connections between the nodes it allows only,
+	assert.ErrorIs(t, s1.ConnectRelayed(s2.ID), ErrPermissionDenied)
+	assert.Equal(t, int64(1), relay.RelayStats().Refused)
+
+	// connected to it.
+	err := s1.ConnectRelayed("someone")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not connected")
+	assert.Zero(t, relay.RelayStats().Active)
+
+	// Servers that aren't relays carry nothing.
+	assert.ErrorIs(t, s2.admitCircuit(s1.ID, relay.ID, time.Now()), ErrRelayRefused)
+}
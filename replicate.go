@@ -0,0 +1,215 @@
+package dfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	replicationAttempts = 3                      // Attempts at sending a file to a peer before hinting it
+	replicationBackoff  = 250 * time.Millisecond // Wait before the first retry, doubled for every further one
+)
+
+// spool is a file encrypted once for all peers it is replicated to, kept in
+// a temporary file so every peer can read it at its own pace.
+type spool struct {
+	f    *os.File
+	size int64 // Size of the encrypted file, IV included
+}
+
+// newSpool encrypts the locally stored file under key into a temporary file.
+func (s *FileServer) newSpool(key string) (*spool, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	_, r, err := s.readObject(ioBackground, s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return encryptSpool(objectKey, r)
+}
+
+// encryptSpool encrypts what r reads with encKey into a temporary file.
+func encryptSpool(encKey []byte, r io.Reader) (*spool, error) {
+	f, err := os.CreateTemp("", "dfs-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{f: f}
+
+	n, err := crypto.CopyEncrypt(encKey, r, f)
+	if err != nil {
+		sp.close()
+		return nil, err
+	}
+	sp.size = int64(n)
+	return sp, nil
+}
+
+// frame returns the frame of the encrypted file.
+func (sp *spool) frame() *ReplicaFrame {
+	return replicaFrameOf(sp.size)
+}
+
+// reader returns a reader of the encrypted file from the start. Readers are
+// independent of each other and may be used concurrently.
+func (sp *spool) reader() io.Reader {
+	return io.NewSectionReader(sp.f, 0, sp.size)
+}
+
+// close removes the temporary file.
+func (sp *spool) close() {
+	sp.f.Close()
+	os.Remove(sp.f.Name())
+}
+
+// replicate sends the spooled file under key to peer, retrying with backoff
+// if an attempt fails without the peer refusing the file. It gives up early if the server is stopped. The
+// replica is traced as part of the trace of ctx.
+func (s *FileServer) replicate(ctx context.Context, peer p2p.Peer, key string, msg *Message, sp *spool, progress *progressTracker) (err error) {
+	addr := peer.RemoteAddr().String()
+	backoff := replicationBackoff
+
+	ctx, span := s.startPeerSpan(ctx, "dfs.replicate", peer)
+	span.SetAttributes(attrSize.Int64(sp.size))
+	defer func() { endSpan(span, err) }()
+	msg = s.withTrace(ctx, msg)
+
+	for attempt := 1; ; attempt++ {
+		progress.attempt(addr, sp.size)
+		err = s.sendObject(peer, msg, func(w io.Writer) (int64, error) {
+			return io.Copy(progress.writer(w, addr), sp.reader())
+		})
+		var respErr *ResponseError
+		if err == nil || attempt == replicationAttempts || errors.As(err, &respErr) && respErr.Code != CodeInternal {
+			break // Peers refusing the file would refuse it again
+		}
+		if errors.Is(err, errSlowPeer) {
+			break // Slow peers would be as slow again, they get the file once they reconnect
+		}
+
+		log.Printf("[%s] sending (%s) to (%s) failed, retrying: %s", s.Transport.Addr(), key, addr, err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-s.quitch:
+			return err
+		}
+	}
+
+	if err != nil {
+		progress.fail(addr, err)
+		return err
+	}
+	fmt.Printf("[%s] sent (%d) bytes to (%s)\n", s.Transport.Addr(), sp.size, addr)
+	s.audit(AuditReplicaSent, s.ID, s.hashKey(key), sp.size, addr, nil)
+	return nil
+}
+
+// sendObject sends msg to peer, followed by the data write writes. Multiplexed
+// peers get both on a stream of their own and answer with a response, a
+// *ResponseError being returned if they didn't store the file. Legacy
+// connections get the message, then the stream marker and the data on the
+// connection itself, without an answer. Peers speaking chunkedStreamsVersion
+// get the data in chunks.
+func (s *FileServer) sendObject(peer p2p.Peer, msg *Message, write func(io.Writer) (int64, error)) error {
+	size := msg.Payload.(MessageStoreFile).Size
+	if peer.ProtocolVersion() >= chunkedStreamsVersion {
+		msg, write = chunkedObject(msg, write)
+	}
+
+	stream, err := s.openStream(peer)
+	if errors.Is(err, p2p.ErrNotMultiplexed) {
+		if err := s.broadcastTo([]p2p.Peer{peer}, msg); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 5)
+		if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+			return err
+		}
+		n, err := write(peer)
+		if err == nil {
+			s.account(peer, PeerTraffic{Sent: n})
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	deadline := s.transferDeadline(size)
+	if !deadline.IsZero() {
+		stream.SetWriteDeadline(deadline)
+	}
+
+	if err := writeMessage(stream, msg); err != nil {
+		return slowTransfer(err, deadline)
+	}
+
+	// The peer may refuse the file before it is sent in full, which stops
+	// the sending right away.
+	response := make(chan error, 1)
+	go func() {
+		err := readResponse(stream)
+		if err != nil {
+			stream.SetWriteDeadline(time.Now())
+		}
+		response <- err
+	}()
+
+	n, err := write(stream)
+	err = slowTransfer(err, deadline)
+	if err != nil || n != size {
+		stream.Close() // Let the peer know no more is coming
+	}
+	if respErr := <-response; respErr != nil && !errors.Is(err, errSlowPeer) {
+		return respErr // Says more than the write failing because of it
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("sent %d of %d bytes", n, size)
+	}
+	s.account(peer, PeerTraffic{Sent: n})
+	return nil
+}
+
+// chunkedObject returns msg, a MessageStoreFile, announcing a chunked stream,
+// and write writing its data through a crcWriter. Messages without a frame
+// to announce it in are returned as they are.
+func chunkedObject(msg *Message, write func(io.Writer) (int64, error)) (*Message, func(io.Writer) (int64, error)) {
+	store := msg.Payload.(MessageStoreFile)
+	if store.Frame == nil {
+		return msg, write
+	}
+	frame := *store.Frame
+	frame.Chunked = true
+	store.Frame = &frame
+	chunked := *msg
+	chunked.Payload = store
+
+	return &chunked, func(w io.Writer) (int64, error) {
+		cw := newCRCWriter(w)
+		n, err := write(cw)
+		if err == nil {
+			err = cw.Flush()
+		}
+		return n, err
+	}
+}
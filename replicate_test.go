@@ -0,0 +1,135 @@
+package dfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyPeer is a multiplexed peer whose streams fail to open a number of
+// times before they work. Everything sent on a working stream ends up in
+// received, and files sent are acknowledged.
+type flakyPeer struct {
+	p2p.Peer
+	failures int
+	received chan []byte
+}
+
+func (p *flakyPeer) ID() string           { return "flaky" }
+func (p *flakyPeer) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (p *flakyPeer) ProtocolVersion() int { return p2p.ProtocolVersion }
+func (p *flakyPeer) Compression() string  { return "" }
+
+func (p *flakyPeer) OpenStream() (net.Conn, error) {
+	if p.failures > 0 {
+		p.failures--
+		return nil, errors.New("stream refused")
+	}
+
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		received := new(bytes.Buffer)
+		r := bufio.NewReader(io.TeeReader(c2, received))
+		defer func() { p.received <- received.Bytes() }()
+
+		var msg Message
+		if _, err := r.ReadByte(); err != nil {
+			return
+		}
+		if err := readMessage(r, &msg); err != nil {
+			return
+		}
+		if store, ok := msg.Payload.(MessageStoreFile); ok {
+			io.CopyN(io.Discard, r, store.Size)
+			writeResponse(c2, nil)
+		}
+		io.Copy(io.Discard, r)
+	}()
+	return c1, nil
+}
+
+func TestReplicateRetries(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41222")
+	assert.Nil(t, s.Store("spooled", strings.NewReader("encrypted only once")))
+
+	sp, err := s.newSpool("spooled")
+	assert.Nil(t, err)
+	defer sp.close()
+	assert.Equal(t, int64(len("encrypted only once")+16), sp.size)
+
+	var report Progress
+	progress := newProgressTracker("spooled", -1, func(p Progress) { report = p })
+	msg := &Message{Payload: MessageStoreFile{ID: s.ID, Key: s.hashKey("spooled"), Size: sp.size}}
+
+	// Two failed attempts, the third gets through.
+	peer := &flakyPeer{failures: 2, received: make(chan []byte, 1)}
+	assert.Nil(t, s.replicate(context.Background(), peer, "spooled", msg, sp, progress))
+	progress.done()
+	if assert.Len(t, report.Peers, 1) {
+		assert.Equal(t, 3, report.Peers[0].Attempts)
+		assert.Equal(t, sp.size, report.Peers[0].Transferred)
+		assert.Empty(t, report.Peers[0].Err)
+	}
+
+	// The peer gets the message, then the file encrypted for it.
+	r := bytes.NewReader(<-peer.received)
+	marker, _ := r.ReadByte()
+	assert.Equal(t, byte(p2p.IncomingMessage), marker)
+	var got Message
+	assert.Nil(t, readMessage(r, &got))
+	assert.Equal(t, msg.Payload, got.Payload)
+	plain := new(bytes.Buffer)
+	objectKey, err := s.objectKey("spooled")
+	assert.Nil(t, err)
+	_, err = crypto.CopyDecrypt(objectKey, r, plain)
+	assert.Nil(t, err)
+	assert.Equal(t, "encrypted only once", plain.String())
+
+	// A peer that keeps failing is given up on.
+	peer = &flakyPeer{failures: replicationAttempts, received: make(chan []byte, 1)}
+	progress = newProgressTracker("spooled", -1, func(p Progress) { report = p })
+	assert.NotNil(t, s.replicate(context.Background(), peer, "spooled", msg, sp, progress))
+	progress.done()
+	if assert.Len(t, report.Peers, 1) {
+		assert.Equal(t, replicationAttempts, report.Peers[0].Attempts)
+		assert.Equal(t, "stream refused", report.Peers[0].Err)
+	}
+}
+
+// hungPeer takes requests on its streams but never answers them.
+type hungPeer struct {
+	flakyPeer
+}
+
+func (p *hungPeer) OpenStream() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	return c1, nil
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41225")
+	s.RequestTimeout = 100 * time.Millisecond
+
+	stream, err := s.openStream(&hungPeer{})
+	assert.Nil(t, err)
+	defer stream.Close()
+
+	start := time.Now()
+	msg := &Message{Payload: MessageGetFile{ID: s.ID, Key: s.hashKey("never")}}
+	_, err = fetchFromStream(stream, msg, func(r io.Reader, size int64) (int64, error) { return io.Copy(io.Discard, r) })
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
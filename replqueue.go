@@ -0,0 +1,291 @@
+package dfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	replicationFileName       = "replication.json" // File the replication queue is persisted to
+	defaultReplicationWorkers = 4                  // Replicas sent at once unless ReplicationQueueOpts says otherwise
+)
+
+// ReplicationPriority orders the work of the replication queue, lower first.
+type ReplicationPriority int
+
+// The priorities of replication work, from the most urgent.
+const (
+	PriorityWrite     ReplicationPriority = iota // Replicas of files just stored
+	PriorityRepair                               // Replicas peers missed or lost, see PendingHints and ProofOpts
+	PriorityRebalance                            // Extra replicas of popular files, see PopularityOpts
+)
+
+// ReplicationQueueOpts configures replicating files in the background.
+//
+// Store returns once the file is written locally, and its replicas are sent
+// by Workers goroutines, at most BytesPerSecond bytes a second between them.
+// New writes go first, then repairs, then rebalances, the oldest first within
+// a priority. Work for peers that aren't connected waits until they are.
+// The queue is persisted in the storage root, so pending work survives
+// restarts; replicas that fail to send are left to the hints.
+type ReplicationQueueOpts struct {
+	Workers        int   // Replicas sent at once (default 4)
+	BytesPerSecond int64 // Bytes of replicas sent per second, unlimited if zero
+}
+
+// ReplicationJob is a replica waiting in the replication queue.
+type ReplicationJob struct {
+	Peer     string              `json:"peer"`     // ID of the peer the replica is for
+	Key      string              `json:"key"`      // Key of the file, stored locally
+	Priority ReplicationPriority `json:"priority"` // Where the job goes in the queue
+	Created  time.Time           `json:"created"`  // When the job was queued
+
+	running bool // Whether a worker is sending the replica
+}
+
+// replicationQueue holds the replicas waiting to be sent, persisted as JSON
+// so they survive restarts.
+type replicationQueue struct {
+	path  string
+	wake  chan struct{} // Signalled when there may be work for an idle worker
+	limit *byteLimiter  // Bandwidth of the replicas
+
+	mu   sync.Mutex
+	jobs []*ReplicationJob
+}
+
+// loadReplicationQueue reads the queue persisted at path. A missing file
+// yields an empty queue. Jobs that were running are queued again.
+func loadReplicationQueue(path string, opts ReplicationQueueOpts) (*replicationQueue, error) {
+	q := &replicationQueue{path: path, wake: make(chan struct{}, 1), limit: &byteLimiter{rate: opts.BytesPerSecond}}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return q, err
+	}
+	return q, json.Unmarshal(buf, &q.jobs)
+}
+
+// add queues the replica of key for peer with priority. A job already waiting
+// for the same replica is moved up to priority instead.
+func (q *replicationQueue) add(peer string, key string, priority ReplicationPriority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.Peer == peer && job.Key == key && !job.running {
+			job.Priority = min(job.Priority, priority)
+			q.save()
+			return
+		}
+	}
+	q.jobs = append(q.jobs, &ReplicationJob{Peer: peer, Key: key, Priority: priority, Created: time.Now()})
+	q.save()
+	q.signal()
+}
+
+// next takes the most urgent job for one of the connected peers, marking it
+// running, and returns it with its peer.
+func (q *replicationQueue) next(connected map[string]p2p.Peer) (*ReplicationJob, p2p.Peer, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var best *ReplicationJob
+	for _, job := range q.jobs {
+		if job.running || connected[job.Peer] == nil {
+			continue
+		}
+		if best == nil || job.Priority < best.Priority || job.Priority == best.Priority && job.Created.Before(best.Created) {
+			best = job
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+	best.running = true
+	q.signal() // Another worker may find more
+	return best, connected[best.Peer], true
+}
+
+// done removes job from the queue.
+func (q *replicationQueue) done(job *ReplicationJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	q.save()
+}
+
+// poke wakes an idle worker, to look for work for a peer that just connected.
+func (q *replicationQueue) poke() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.signal()
+}
+
+// signal wakes an idle worker, if any. The caller must hold q.mu.
+func (q *replicationQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// list returns the queued jobs, most urgent first.
+func (q *replicationQueue) list() []ReplicationJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []ReplicationJob{}
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority < jobs[j].Priority
+		}
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
+
+// save persists the queue. The caller must hold q.mu.
+func (q *replicationQueue) save() {
+	buf, err := json.Marshal(q.jobs)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(q.path), os.ModePerm)
+	}
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, buf, 0o644); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		log.Printf("persisting the replication queue failed: %s", err)
+	}
+}
+
+// byteLimiter is a token bucket holding up to one second worth of bytes,
+// shared by the writers it limits. Writers take tokens after the fact and
+// sleep off any debt.
+type byteLimiter struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second, 0 means unlimited
+	tokens float64 // Bytes that may be written without waiting, negative when in debt
+	last   time.Time
+}
+
+// wait takes n tokens and sleeps until the bucket is out of debt.
+func (l *byteLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(l.rate)
+	} else {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// writer returns w limited to the rate of l.
+func (l *byteLimiter) writer(w io.Writer) io.Writer {
+	if l.rate <= 0 {
+		return w
+	}
+	return &limitedWriter{w: w, l: l}
+}
+
+// limitedWriter writes to w at the rate of l.
+type limitedWriter struct {
+	w io.Writer
+	l *byteLimiter
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.l.wait(n)
+	return n, err
+}
+
+// PendingReplication returns the replicas waiting in the replication queue,
+// most urgent first, none if the queue is disabled.
+func (s *FileServer) PendingReplication() []ReplicationJob {
+	if s.queue == nil {
+		return []ReplicationJob{}
+	}
+	return s.queue.list()
+}
+
+// queueReplica queues the replica of the file stored under key for peer with
+// priority, reporting whether it did. Replicas aren't queued if the queue is
+// disabled, nor for peers that didn't announce an ID to be queued under.
+func (s *FileServer) queueReplica(peer p2p.Peer, key string, priority ReplicationPriority) bool {
+	if s.queue == nil || len(peer.ID()) == 0 {
+		return false
+	}
+	s.queue.add(peer.ID(), key, priority)
+	return true
+}
+
+// replicateQueued sends the replicas of the replication queue until the
+// server stops.
+func (s *FileServer) replicateQueued() {
+	for {
+		connected := make(map[string]p2p.Peer)
+		for _, peer := range s.peerList() {
+			if len(peer.ID()) > 0 {
+				connected[peer.ID()] = peer
+			}
+		}
+		job, peer, ok := s.queue.next(connected)
+		if !ok {
+			select {
+			case <-s.queue.wake:
+				continue
+			case <-s.quitch:
+				return
+			}
+		}
+
+		if s.store.Has(s.ID, job.Key) { // Deleted in the meantime otherwise
+			if err := s.sendReplica(peer, job.Key); err != nil {
+				s.replicationFailed(job.Key, peer, err)
+			} else {
+				s.audit(AuditReplicaSent, s.ID, s.hashKey(job.Key), 0, peer.RemoteAddr().String(), nil)
+			}
+		}
+		s.queue.done(job)
+	}
+}
@@ -0,0 +1,93 @@
+package dfs
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), replicationFileName)
+	q, err := loadReplicationQueue(path, ReplicationQueueOpts{})
+	require.NoError(t, err)
+
+	q.add("a", "rebalance", PriorityRebalance)
+	q.add("a", "repair", PriorityRepair)
+	q.add("b", "write", PriorityWrite)
+	q.add("a", "write", PriorityWrite)
+	q.add("a", "promoted", PriorityRebalance)
+	q.add("a", "promoted", PriorityRepair) // Moves the job up instead of queuing it again
+	assert.Len(t, q.list(), 5)
+
+	// New writes go first, then repairs and rebalances, oldest first, for
+	// connected peers only.
+	connected := map[string]p2p.Peer{"a": &p2p.TCPPeer{}}
+	var keys []string
+	for {
+		job, _, ok := q.next(connected)
+		if !ok {
+			break
+		}
+		keys = append(keys, job.Key)
+		if job.Key == "repair" {
+			// The queue survives restarts, running jobs included.
+			loaded, err := loadReplicationQueue(path, ReplicationQueueOpts{})
+			require.NoError(t, err)
+			assert.Len(t, loaded.list(), 5)
+		}
+	}
+	assert.Equal(t, []string{"write", "repair", "promoted", "rebalance"}, keys)
+	for _, job := range slices.Clone(q.jobs) {
+		if job.running {
+			q.done(job)
+		}
+	}
+	jobs := q.list()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "b", jobs[0].Peer)
+}
+
+func TestByteLimiter(t *testing.T) {
+	l := &byteLimiter{rate: 10000}
+	var buf bytes.Buffer
+	w := l.writer(&buf)
+	start := time.Now()
+	for range 3 {
+		_, err := w.Write(make([]byte, 5000))
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "a second worth of bytes goes right away, the rest at the rate")
+	assert.Equal(t, 15000, buf.Len())
+	assert.Same(t, &buf, (&byteLimiter{}).writer(&buf).(*bytes.Buffer), "unlimited writers aren't wrapped")
+}
+
+func TestReplicationQueueReplicas(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41360", StorageRoot: t.TempDir(), ID: "owner", ReplicationQueue: &ReplicationQueueOpts{Workers: 2}})
+	go s1.Start()
+	defer s1.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	// Replicas for peers that aren't connected wait for them.
+	_, err := s1.store.Write(s1.ID, "early.txt", strings.NewReader("early"))
+	require.NoError(t, err)
+	s1.queue.add("replica", "early.txt", PriorityRepair)
+
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41361", StorageRoot: t.TempDir(), ID: "replica", BootstrapNodes: []string{"127.0.0.1:41360"}})
+	go s2.Start()
+	defer s2.Stop()
+	require.Eventually(t, func() bool { return s2.store.Has("owner", s1.hashKey("early.txt")) }, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// Store returns once the file is written locally, its replicas following.
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("contents")))
+	require.Eventually(t, func() bool { return s2.store.Has("owner", s1.hashKey("a.txt")) }, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return len(s1.PendingReplication()) == 0 }, 2*time.Second, 10*time.Millisecond)
+	assert.Empty(t, s1.PendingHints())
+}
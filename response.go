@@ -0,0 +1,179 @@
+package dfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// ResponseCode opens the answer to a request for a file, telling the
+// requester whether the request was served. Peers answer requests they can't
+// serve with a code other than CodeOK instead of leaving them unanswered, so
+// requesters get a definite error instead of a timeout or a garbled read.
+type ResponseCode uint8
+
+const (
+	CodeOK               ResponseCode = iota // The request was served, the response follows
+	CodeFileNotFound                         // The peer doesn't hold the file
+	CodePermissionDenied                     // The peer refuses the request
+	CodeStorageFull                          // The peer has no room left for the file
+	CodeInternal                             // The peer failed for any other reason
+	CodeQuotaExceeded                        // The peer refuses the file for being over its limits
+	CodeImmutable                            // The peer refuses to overwrite or delete an immutable object
+	CodeTenantOverQuota                      // The peer refuses the file for taking its tenant over its storage quota
+	CodeForbidden                            // The peer refuses the request for the ACL of the file, see ACL
+)
+
+// maxResponseDetail is the longest detail sent along with a response code.
+const maxResponseDetail = 1024
+
+var (
+	// ErrPermissionDenied is returned for requests a peer refused to serve.
+	ErrPermissionDenied = storage.ErrPermissionDenied
+	// ErrStorageFull is returned when a peer has no room left for a file.
+	ErrStorageFull = errors.New("storage full")
+)
+
+// String returns the name of the code.
+func (c ResponseCode) String() string {
+	switch c {
+	case CodeOK:
+		return "ok"
+	case CodeFileNotFound:
+		return "file not found"
+	case CodePermissionDenied:
+		return "permission denied"
+	case CodeStorageFull:
+		return "storage full"
+	case CodeInternal:
+		return "internal error"
+	case CodeQuotaExceeded:
+		return "quota exceeded"
+	case CodeImmutable:
+		return "immutable"
+	case CodeTenantOverQuota:
+		return "storage quota exceeded"
+	case CodeForbidden:
+		return "forbidden"
+	default:
+		return fmt.Sprintf("code %d", uint8(c))
+	}
+}
+
+// ResponseError is the answer of a peer that couldn't serve a request. It
+// matches ErrKeyNotFound, ErrPermissionDenied, ErrStorageFull,
+// ErrQuotaExceeded, ErrStorageQuotaExceeded, ErrImmutable and ErrForbidden
+// with errors.Is according to its code.
+// Refusals for being over a quota, of immutable objects or for the ACL of a
+// file are denials as well and match ErrPermissionDenied too.
+type ResponseError struct {
+	Code   ResponseCode // Why the request wasn't served
+	Detail string       // The error of the peer, for logs
+}
+
+// Error returns the code and the detail of the response.
+func (e *ResponseError) Error() string {
+	if len(e.Detail) == 0 {
+		return "peer responded: " + e.Code.String()
+	}
+	return fmt.Sprintf("peer responded: %s: %s", e.Code, e.Detail)
+}
+
+// Unwrap returns the sentinel errors of the code, none for codes without one.
+func (e *ResponseError) Unwrap() []error {
+	switch e.Code {
+	case CodeFileNotFound:
+		return []error{ErrKeyNotFound}
+	case CodePermissionDenied:
+		return []error{ErrPermissionDenied}
+	case CodeStorageFull:
+		return []error{ErrStorageFull}
+	case CodeQuotaExceeded:
+		return []error{ErrQuotaExceeded, ErrPermissionDenied}
+	case CodeTenantOverQuota:
+		return []error{ErrStorageQuotaExceeded, ErrPermissionDenied}
+	case CodeForbidden:
+		return []error{ErrForbidden, ErrPermissionDenied}
+	case CodeImmutable:
+		return []error{ErrImmutable}
+	default:
+		return nil
+	}
+}
+
+// codeFor returns the response code telling a peer about err.
+func codeFor(err error) ResponseCode {
+	var respErr *ResponseError
+	switch {
+	case err == nil:
+		return CodeOK
+	case errors.As(err, &respErr):
+		return respErr.Code
+	case errors.Is(err, ErrKeyNotFound), errors.Is(err, os.ErrNotExist):
+		return CodeFileNotFound
+	case errors.Is(err, ErrStorageQuotaExceeded):
+		return CodeTenantOverQuota
+	case errors.Is(err, ErrQuotaExceeded):
+		return CodeQuotaExceeded
+	case errors.Is(err, ErrImmutable):
+		return CodeImmutable
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, ErrPermissionDenied), errors.Is(err, os.ErrPermission):
+		return CodePermissionDenied
+	case errors.Is(err, ErrStorageFull), errors.Is(err, syscall.ENOSPC):
+		return CodeStorageFull
+	default:
+		return CodeInternal
+	}
+}
+
+// writeResponse answers a request with the code for err, followed by the
+// length and text of err unless it is nil.
+func writeResponse(w io.Writer, err error) error {
+	code := codeFor(err)
+	if code == CodeOK {
+		_, werr := w.Write([]byte{byte(code)})
+		return werr
+	}
+
+	detail := err.Error()
+	if len(detail) > maxResponseDetail {
+		detail = detail[:maxResponseDetail]
+	}
+	buf := make([]byte, 3, 3+len(detail))
+	buf[0] = byte(code)
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(detail)))
+	_, werr := w.Write(append(buf, detail...))
+	return werr
+}
+
+// readResponse reads the answer written by writeResponse. It returns a
+// *ResponseError if the peer didn't serve the request.
+func readResponse(r io.Reader) error {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return err
+	}
+	if ResponseCode(code[0]) == CodeOK {
+		return nil
+	}
+
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if n > maxResponseDetail {
+		return fmt.Errorf("response detail of %d bytes is too long", n)
+	}
+	detail := make([]byte, n)
+	if _, err := io.ReadFull(r, detail); err != nil {
+		return err
+	}
+	return &ResponseError{Code: ResponseCode(code[0]), Detail: string(detail)}
+}
@@ -0,0 +1,111 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponse(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code ResponseCode
+		is   error
+	}{
+		{fmt.Errorf("wrapped: %w", ErrKeyNotFound), CodeFileNotFound, ErrKeyNotFound},
+		{fmt.Errorf("%w: announced 100 bytes", ErrFileTooLarge), CodeQuotaExceeded, ErrQuotaExceeded},
+		{ErrPeerOverQuota, CodeQuotaExceeded, ErrPermissionDenied},
+		{fmt.Errorf("%w: tenant has 0 bytes left", ErrStorageQuotaExceeded), CodeTenantOverQuota, ErrQuotaExceeded},
+		{fmt.Errorf("%w: \"bob\" may not read (key)", ErrForbidden), CodeForbidden, ErrPermissionDenied},
+		{fmt.Errorf("%w: (key) is stored already", ErrImmutable), CodeImmutable, ErrPermissionDenied},
+		{os.ErrPermission, CodePermissionDenied, ErrPermissionDenied},
+		{&os.PathError{Op: "write", Path: "blob", Err: syscall.ENOSPC}, CodeStorageFull, ErrStorageFull},
+		{errors.New("disk on fire"), CodeInternal, nil},
+	} {
+		buf := new(bytes.Buffer)
+		require.NoError(t, writeResponse(buf, tc.err))
+
+		err := readResponse(buf)
+		var respErr *ResponseError
+		require.ErrorAs(t, err, &respErr)
+		assert.Equal(t, tc.code, respErr.Code)
+		assert.Equal(t, tc.err.Error(), respErr.Detail)
+		if tc.is != nil {
+			assert.ErrorIs(t, err, tc.is)
+		}
+		assert.Zero(t, buf.Len())
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, writeResponse(buf, nil))
+	assert.NoError(t, readResponse(buf))
+
+	// Details are cut short.
+	require.NoError(t, writeResponse(buf, errors.New(strings.Repeat("x", 2*maxResponseDetail))))
+	var respErr *ResponseError
+	require.ErrorAs(t, readResponse(buf), &respErr)
+	assert.Len(t, respErr.Detail, maxResponseDetail)
+
+	_, err := io.ReadFull(buf, make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, readResponse(bytes.NewReader([]byte{byte(CodeFileNotFound), 0xff})), io.ErrUnexpectedEOF)
+}
+
+func TestNegativeResponses(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41306")
+	s2 := makeServer(t, "127.0.0.1:41307", "127.0.0.1:41306")
+	s2.MaxFileSize = 64
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.peerList()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	peer := s1.peerList()[0]
+
+	// Files a peer doesn't hold are answered with FileNotFound.
+	stream, err := s1.openStream(peer)
+	require.NoError(t, err)
+	msg := &Message{Payload: MessageGetFile{ID: s1.ID, Key: s1.hashKey("missing")}}
+	_, err = fetchFromStream(stream, msg, func(r io.Reader, size int64) (int64, error) { return io.Copy(io.Discard, r) })
+	stream.Close()
+	var respErr *ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, CodeFileNotFound, respErr.Code)
+
+	// Files over the limits of the peer are refused with QuotaExceeded,
+	// which stops sending them.
+	size := int64(16 << 20)
+	msg = &Message{Payload: MessageStoreFile{ID: s1.ID, Key: s1.hashKey("large"), Size: size}}
+	start := time.Now()
+	err = s1.sendObject(peer, msg, func(w io.Writer) (int64, error) {
+		return io.Copy(w, io.LimitReader(zeroReader{}, size))
+	})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Files taken are acknowledged.
+	msg = &Message{Payload: MessageStoreFile{ID: s1.ID, Key: s1.hashKey("small"), Size: 32}}
+	err = s1.sendObject(peer, msg, func(w io.Writer) (int64, error) {
+		return io.Copy(w, io.LimitReader(zeroReader{}, 32))
+	})
+	assert.NoError(t, err)
+	assert.True(t, s2.store.Has(s1.ID, s1.hashKey("small")))
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,133 @@
+package dfs
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// resumingReader decrypts a file being fetched from a peer. If the transfer
+// breaks off, it carries on from another peer holding the file, asking it for
+// just the part still missing. Peers encrypt their replicas independently, so
+// the transfer is resumed on the plaintext rather than the ciphertext.
+type resumingReader struct {
+	s        *FileServer
+	key      string
+	progress *progressTracker
+
+	size   int64     // Plaintext size of the file
+	off    int64     // Plaintext bytes read so far
+	r      io.Reader // Plaintext from the current peer
+	closer io.Closer // Stream of the current peer, nil for the one fetch opened
+	from   string    // Address of the current peer
+	failed map[string]bool
+}
+
+// newResumingReader returns a reader of the plaintext of the file under key,
+// whose size bytes of ciphertext r is reading from the peer at from.
+func (s *FileServer) newResumingReader(key string, r io.Reader, size int64, from string, progress *progressTracker) (*resumingReader, error) {
+	iv := make([]byte, crypto.IVSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, err
+	}
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := crypto.NewCTRAt(objectKey, iv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumingReader{
+		s:        s,
+		key:      key,
+		progress: progress,
+		size:     size - crypto.IVSize,
+		r:        cipher.StreamReader{S: ctr, R: r},
+		from:     from,
+		failed:   make(map[string]bool),
+	}, nil
+}
+
+func (rr *resumingReader) Read(b []byte) (int, error) {
+	for {
+		if rr.off >= rr.size {
+			return 0, io.EOF
+		}
+		if int64(len(b)) > rr.size-rr.off {
+			b = b[:rr.size-rr.off]
+		}
+
+		n, err := rr.r.Read(b)
+		rr.off += int64(n)
+		if n > 0 || err == nil {
+			return n, nil // A broken transfer fails again on the next read
+		}
+
+		if err := rr.resume(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// resume switches to another peer after the current one failed with cause.
+func (rr *resumingReader) resume(cause error) error {
+	s := rr.s
+	log.Printf("[%s] fetching (%s) from (%s) broke off at byte %d: %s", s.Transport.Addr(), rr.key, rr.from, rr.off, cause)
+
+	rr.failed[rr.from] = true
+	if rr.closer != nil {
+		rr.closer.Close()
+		rr.closer = nil
+	}
+
+	msg := Message{
+		Payload: MessageGetRange{
+			ID:     s.ID,
+			Key:    s.hashKey(rr.key),
+			Offset: rr.off,
+			Length: rr.size - rr.off,
+		},
+	}
+	for _, peer := range s.peerList() {
+		addr := peer.RemoteAddr().String()
+		if rr.failed[addr] {
+			continue
+		}
+		rr.failed[addr] = true // Every peer gets one chance
+
+		stream, err := s.openStream(peer)
+		if err != nil {
+			continue // Ranges need a stream of their own
+		}
+		r, _, err := s.fetchRangeFromStream(stream, &msg, rr.key, rr.off)
+		if err != nil {
+			stream.Close()
+			continue
+		}
+		if deadline := s.transferDeadline(rr.size - rr.off); !deadline.IsZero() {
+			stream.SetReadDeadline(deadline)
+		}
+
+		log.Printf("[%s] resuming (%s) from (%s) at byte %d", s.Transport.Addr(), rr.key, addr, rr.off)
+		rr.progress.addPeer(addr, rr.size-rr.off)
+		rr.r = rr.progress.reader(r, addr)
+		rr.closer = r
+		rr.from = addr
+		return nil
+	}
+
+	return fmt.Errorf("fetching (%s) failed at byte %d and no other peer could resume it: %w", rr.key, rr.off, cause)
+}
+
+// Close closes the stream of the peer resumed from, if any.
+func (rr *resumingReader) Close() error {
+	if rr.closer != nil {
+		return rr.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumingReader(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41223")
+	s2 := makeServer(t, "127.0.0.1:41224", "127.0.0.1:41223")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	data := make([]byte, 100_000)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	assert.Nil(t, s1.Store("resume.bin", bytes.NewReader(data)))
+	assert.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("resume.bin")) }, time.Second, 10*time.Millisecond)
+
+	// A transfer from a peer with its own encryption of the file breaks off halfway.
+	encrypted := new(bytes.Buffer)
+	objectKey, err := s1.objectKey("resume.bin")
+	assert.Nil(t, err)
+	_, err = crypto.CopyEncrypt(objectKey, bytes.NewReader(data), encrypted)
+	assert.Nil(t, err)
+	size := int64(encrypted.Len())
+	broken := func() io.Reader {
+		return &exactReader{r: bytes.NewReader(encrypted.Bytes()[:size/2]), left: size}
+	}
+
+	// The rest comes from s2.
+	rr, err := s1.newResumingReader("resume.bin", broken(), size, "127.0.0.1:1", nil)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(rr)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, s1.Peers()[0].Addr, rr.from)
+	rr.Close()
+
+	// Without another peer to turn to, the error reaches the caller.
+	rr, err = s1.newResumingReader("resume.bin", broken(), size, "127.0.0.1:1", nil)
+	assert.Nil(t, err)
+	rr.failed[s1.Peers()[0].Addr] = true
+	_, err = io.ReadAll(rr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,74 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// MessageSetRetention tells the peers holding a replica of a file about the
+// retention its owner set on it.
+type MessageSetRetention struct {
+	ID        string            // ID of the owner of the file
+	Key       string            // Hashed key of the file
+	Retention storage.Retention // Retention of the file
+}
+
+// SetRetention sets the retention of the file stored under key, see
+// storage.Store.SetRetention, and tells the peers holding its replicas about it.
+// Peers that don't hold one yet get it along with the replica.
+func (s *FileServer) SetRetention(key string, r storage.Retention) error {
+	err := s.store.SetRetention(s.ID, key, r)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+	if err != nil {
+		return err
+	}
+	s.audit(AuditRetention, s.ID, s.hashKey(key), 0, "", nil)
+
+	msg := Message{Payload: MessageSetRetention{ID: s.ID, Key: s.hashKey(key), Retention: r}}
+	if err := s.broadcast(&msg); err != nil {
+		log.Printf("[%s] telling peers about the retention of (%s) failed: %s", s.Transport.Addr(), key, err)
+	}
+	return nil
+}
+
+// retentionOf returns the retention of the file stored under key, nil if it
+// has none.
+func (s *FileServer) retentionOf(key string) *storage.Retention {
+	meta, _ := s.store.Meta(s.ID, key)
+	return meta.Retention
+}
+
+// retainReplica gives the replica just received for msg the retention it was
+// sent with, if any.
+func (s *FileServer) retainReplica(msg MessageStoreFile) {
+	if msg.Retention == nil {
+		return
+	}
+	if err := s.store.SetRetention(msg.ID, msg.Key, *msg.Retention); err != nil {
+		log.Printf("[%s] setting the retention of (%s) failed: %s", s.Transport.Addr(), msg.Key, err)
+	}
+}
+
+// handleMessageSetRetention sets the retention of the local replica of a file.
+func (s *FileServer) handleMessageSetRetention(rpc p2p.RPC, msg MessageSetRetention) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	if err := s.checkOwner(rpc.From, msg.ID); err != nil {
+		return err // Holds can only be lifted by the owner of the file
+	}
+	if !s.store.Has(msg.ID, msg.Key) {
+		return nil // Gets the retention along with the replica
+	}
+	err := s.store.SetRetention(msg.ID, msg.Key, msg.Retention)
+	s.audit(AuditRetention, msg.ID, msg.Key, 0, rpc.From, err)
+	return err
+}
@@ -0,0 +1,88 @@
+package dfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionReplicas(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41353")
+	s2 := makeServer(t, "127.0.0.1:41354", "127.0.0.1:41353")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	key := s1.hashKey("a.txt")
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("data")))
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, key) }, 2*time.Second, 10*time.Millisecond)
+
+	// Replicas get the retention set on the file,
+	require.NoError(t, s1.SetRetention("a.txt", storage.Retention{LegalHold: true}))
+	require.Eventually(t, func() bool {
+		meta, _ := s2.store.Meta(s1.ID, key)
+		return meta.Retention.Retains(time.Now())
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, s1.Delete("a.txt"), ErrImmutable)
+	assert.ErrorIs(t, s2.store.Delete(s1.ID, key), ErrImmutable)
+	assert.ErrorIs(t, s1.SetRetention("missing.txt", storage.Retention{}), ErrKeyNotFound)
+
+	// and peers getting a replica later get it along with the replica.
+	s3 := makeServer(t, "127.0.0.1:41355", "127.0.0.1:41353")
+	go s3.Start()
+	defer s3.Stop()
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s1.sendReplica(peerWithID(t, s1, s3.ID), "a.txt"))
+	meta, ok := s3.store.Meta(s1.ID, key)
+	require.True(t, ok)
+	assert.Equal(t, &storage.Retention{LegalHold: true}, meta.Retention)
+
+	// Lifting the hold lets the file be deleted again.
+	require.NoError(t, s1.SetRetention("a.txt", storage.Retention{}))
+	require.Eventually(t, func() bool {
+		meta, _ := s2.store.Meta(s1.ID, key)
+		return meta.Retention == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s1.Delete("a.txt"))
+	require.Eventually(t, func() bool { return !s2.store.Has(s1.ID, key) }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRetentionOwner(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41377")
+	s2 := makeServer(t, "127.0.0.1:41378", "127.0.0.1:41377")
+	s3 := makeServer(t, "127.0.0.1:41379", "127.0.0.1:41377", "127.0.0.1:41378")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s3.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	key := s1.hashKey("a.txt")
+	require.NoError(t, s1.Store("a.txt", strings.NewReader("data")))
+	require.NoError(t, s1.SetRetention("a.txt", storage.Retention{LegalHold: true}))
+	retained := func() bool {
+		meta, ok := s2.store.Meta(s1.ID, key)
+		return ok && meta.Retention.Retains(time.Now())
+	}
+	require.Eventually(t, retained, 2*time.Second, 10*time.Millisecond)
+
+	// A peer other than the owner can't lift the hold on its replica, nor
+	// delete it.
+	peer := []p2p.Peer{peerWithID(t, s3, s2.ID)}
+	require.NoError(t, s3.broadcastTo(peer, &Message{Payload: MessageSetRetention{ID: s1.ID, Key: key, Retention: storage.Retention{}}}))
+	require.NoError(t, s3.broadcastTo(peer, &Message{Payload: MessageDeleteFile{ID: s1.ID, Key: key}}))
+	assert.Never(t, func() bool { return !retained() }, 300*time.Millisecond, 10*time.Millisecond)
+
+	// The owner still can.
+	require.NoError(t, s1.SetRetention("a.txt", storage.Retention{}))
+	require.Eventually(t, func() bool { return !retained() }, 2*time.Second, 10*time.Millisecond)
+}
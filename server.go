@@ -1,26 +1,216 @@
-package main
+package dfs
 
 import (
-	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
 	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
 )
 
 // FileServerOpts holds configuration options for the FileServer
 type FileServerOpts struct {
-	ID                string            // Unique identifier for the FileServer
-	EncKey            []byte            // Encryption key used for file encryption
-	StorageRoot       string            // Root directory for file storage
-	PathTransformFunc PathTransformFunc // Function to transform file paths
-	Transport         p2p.Transport     // Transport layer for peer-to-peer communication
-	BootstrapNodes    []string          // List of bootstrap nodes to connect to in the network
+	ID                string                    // Unique identifier for the FileServer
+	EncKey            []byte                    // Encryption key used for file encryption
+	StorageRoot       string                    // Root directory for file storage
+	PathTransformFunc storage.PathTransformFunc // Function to transform file paths
+	Transport         p2p.Transport             // Transport layer for peer-to-peer communication
+	BootstrapNodes    []string                  // List of bootstrap nodes to connect to in the network
+	AdvertiseAddr     string                    // Address peers reach this server at, the address of the transport if empty
+	IdentityKey       *ecdh.PrivateKey          // X25519 key share bundles for this server are wrapped with (generated if nil)
+	NoSync            bool                      // Skip fsyncing stored files, trading durability for speed
+	EncryptAtRest     bool                      // Encrypt the local store with a key derived from EncKey, see storage.StoreOpts.EncryptAtRest
+	Zone              string                    // Failure domain of the server, such as its rack or availability zone, see ReplicationFactor
+	Tier              string                    // Storage tier of the server, TierHot, TierWarm or TierCold, see Tiering
+
+	// Hasher turns keys into the lookup tokens they are sent to peers under,
+	// as an HMAC keyed with a secret derived from EncKey, and makes the store
+	// content-addressable with the same function if PathTransformFunc is nil.
+	// Every node of a network must use the same one. Defaults to
+	// crypto.MD5Hasher for compatibility with older nodes; new networks
+	// should use crypto.SHA256Hasher or crypto.BLAKE3Hasher.
+	Hasher crypto.Hasher
+
+	// Layout is how the content-addressed store spreads objects over
+	// directories, see storage.StoreOpts.Layout.
+	Layout storage.CASLayout
+
+	ChunkSize int64 // Size of the chunks Append and WriteAt split files into (default 1 MiB)
+
+	BootstrapConcurrency   int           // Maximum number of bootstrap nodes dialed at once (default 4)
+	BootstrapRetryInterval time.Duration // Initial wait before retrying a failed bootstrap dial (default 2s)
+
+	AdminAddr string // Address to serve the admin HTTP API on, disabled if empty
+
+	Auth *AuthOpts // Require credentials on the admin API, open to anyone if nil
+	CORS *CORSOpts // Answer cross-origin requests to the admin API and pre-signed URLs, disabled if nil
+
+	// AdminTLS serves the admin API over TLS, plain HTTP if nil. Set its
+	// ClientAuth and ClientCAs to ask clients for certificates, see
+	// CertAuthenticator.
+	AdminTLS *tls.Config
+
+	// Quotas limits what the tenants of Auth store and transfer, by tenant.
+	// Servers accepting replicas enforce the storage quotas as well, so every
+	// server of the network should have the same.
+	Quotas map[string]TenantQuota
+
+	Meta *MetaOpts // Keep metadata consistent with raft, disabled if nil
+
+	Audit *AuditOpts // Record every storage operation in an audit log, disabled if nil
+
+	Tiering    *TieringOpts    // Move the objects nobody reads to archive nodes, disabled if nil
+	Popularity *PopularityOpts // Replicate the files read most to more peers, disabled if nil
+	Swarm      *SwarmOpts      // Fetch large files from many peers at once, disabled if nil
+	Proofs     *ProofOpts      // Challenge peers to prove they still hold their replicas, disabled if nil
+
+	ReplicationQueue *ReplicationQueueOpts // Replicate files in the background by priority, disabled if nil
+
+	SFTP *SFTPOpts // Serve the files over SFTP, disabled if nil
+
+	Relay *RelayOpts // Carry connections between peers that can't connect directly, disabled if nil
+
+	AcceptMigration bool // Let peers migrate their objects and identity to this server, see MigrateTo
+
+	// Gateway makes the server an ingress point without storage of its own:
+	// files stored through it are streamed to the peers they are placed on
+	// without being written to its disk, and replicas sent to it are refused.
+	// Their size must be known up front, see ErrSizeRequired. The files
+	// remain the gateway's, fetched and deleted through it like any other.
+	Gateway bool
+
+	// TracerProvider creates the spans traced around storing, fetching and
+	// replicating files, the global provider of OpenTelemetry if nil.
+	// Propagator carries the trace context to peers in message headers,
+	// W3C trace context if nil.
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+
+	// Coordinator is the ID of the server placing new files and arbitrating
+	// deletes, or CoordinatorElected for the leader of the metadata service.
+	// If empty, files are replicated to ReplicationFactor peers picked by
+	// their key, every peer if ReplicationFactor is zero.
+	//
+	// Servers announce their Zone to their peers. The coordinator spreads the
+	// replicas of a file across as many zones as it can, those of the owner
+	// and the other replicas avoided, so losing a zone doesn't lose every copy.
+	Coordinator       string
+	ReplicationFactor int // Servers each file is placed on besides its owner (default 2 when coordinating, every peer otherwise)
+
+	// RequestTimeout is how long a peer may leave a request or transfer
+	// without progress before it is abandoned (default 30s). It bounds every
+	// read and write on the streams requests are made and answered on;
+	// transfers that keep moving may take longer.
+	RequestTimeout time.Duration
+
+	// MinTransferRate is the slowest, in bytes per second, a file may be
+	// sent to or fetched from a peer; unlimited if zero. Every transfer with
+	// a peer is due within RequestTimeout plus the time its size takes at
+	// that rate. Fetches from a peer missing the deadline are resumed from
+	// another peer holding the file, and replicas it missed are sent again
+	// once it reconnects rather than retried right away.
+	MinTransferRate int64
+
+	// IdleTimeout closes connections to peers that have had no traffic for
+	// this long. Peers this server dialed are dialed again when files are
+	// next stored or fetched. Connections are kept open if zero.
+	IdleTimeout time.Duration
+
+	// HeartbeatInterval is how often peers are probed for their round-trip
+	// time, disabled if zero. Lookups measure it too; Get fetches from the
+	// closest holders first. Probes are traffic, so connections probed more
+	// often than IdleTimeout never go idle.
+	HeartbeatInterval time.Duration
+
+	// Workers is the number of goroutines handling incoming messages. Each
+	// peer's messages are handled in order, different peers' concurrently;
+	// messages on their own stream go to any free worker. Further messages
+	// wait in the queues of the peers that sent them, as set up by the
+	// transport. If zero, stream messages get a goroutine each and the rest
+	// are handled one at a time.
+	Workers int
+
+	// MaxStreams caps the streams handled at once, counting the ones peers
+	// opened and the ones opened to peers apart, and MaxPeerStreams the
+	// streams of a single peer; both are unlimited if zero. Streams over a
+	// limit wait for their turn, at most RequestTimeout, and the peers with
+	// streams waiting take turns, so a busy peer can't take every stream
+	// from the others. Relayed connections aren't counted.
+	MaxStreams     int
+	MaxPeerStreams int
+
+	// ForegroundIO caps the reads of stored files serving users, and the
+	// peers fetching files for them, done at once, and BackgroundIO the disk
+	// IO of replicas received, replication, tiering, proofs and handoffs;
+	// both are unlimited if zero. Background IO doesn't start while
+	// foreground reads wait for their turn, so maintenance work doesn't add
+	// to the latency of serving files. Reads take a turn each, replicas are
+	// written in a single one.
+	ForegroundIO int
+	BackgroundIO int
+
+	// MaxFileSize is the largest file that may be stored, locally or by a
+	// peer announcing and sending it, unlimited if zero. MaxPeerBytes bounds the bytes of the files a single peer may
+	// send per PeerBytesInterval (default 1m), unlimited if zero. Peers
+	// breaking either limit, or sending messages the transport rejects, are
+	// penalized; once their score reaches BanScore (default 100) they are
+	// disconnected and refused for BanDuration (default 10m).
+	MaxFileSize       int64
+	MaxPeerBytes      int64
+	PeerBytesInterval time.Duration
+	BanScore          int
+	BanDuration       time.Duration
+
+	// Immutable makes namespaces write-once, objects in them retained for
+	// the duration they map to, forever if zero. See storage.StoreOpts.Immutable;
+	// the namespace of the server's own files is its ID.
+	Immutable map[string]time.Duration
+
+	// PackThreshold packs the objects of up to that many bytes into pack
+	// files, which hold up to PackSize bytes (64 MiB if zero), see
+	// storage.StoreOpts.PackThreshold and Repack. Zero disables packing.
+	PackThreshold int64
+	PackSize      int64
+
+	// MmapThreshold reads the local objects of at least that many bytes
+	// through a memory mapping, see storage.StoreOpts.MmapThreshold. Zero disables
+	// mapping.
+	MmapThreshold int64
+
+	// KMS wraps the keys the server keeps on disk, nil to seal them with a
+	// key derived from EncKey. With a KMS, the keys of key groups are kept
+	// wrapped by it, and every file stored gets a random data key, wrapped by
+	// it as well, which its replicas are encrypted with instead of a key
+	// derived from EncKey. Files stored before keep their derived key. The
+	// data keys of deleted files are dropped, leaving replicas peers failed
+	// to delete unreadable.
+	KMS KMS
+
+	// Storage is where files and the replicas of peers are kept, a
+	// storage.Store under StorageRoot configured from these options if nil.
+	// The server keeps its own files, such as its hints and accounting,
+	// under StorageRoot either way.
+	Storage Store
 }
 
 // FileServer represents a server that handles file storage and retrieval over a network
@@ -30,182 +220,1036 @@ type FileServer struct {
 	peerLock sync.Mutex          // Mutex to protect concurrent access to peers map
 	peers    map[string]p2p.Peer // Map of connected peers identified by their network address
 
-	store  *Store        // Store represents the file storage and management system
-	quitch chan struct{} // Channel to signal the server to stop its operation
+	store      Store                       // Store represents the file storage and management system
+	lookupKey  []byte                      // Secret keys are turned into lookup tokens with, see hashKey
+	bootstrap  *bootstrapManager           // Dials the bootstrap nodes and tracks their status
+	admin      *http.Server                // Admin HTTP API, nil unless AdminAddr is set
+	sftp       *sftpServer                 // SFTP server, nil unless SFTP is set
+	meta       atomic.Pointer[metaService] // Raft node of the metadata service, nil unless this server runs one
+	coord      coordinator                 // Placements made while this server is the coordinator
+	hints      *hintLog                    // Replicas owed to peers that missed them
+	accounts   *accounts                   // Traffic exchanged with every peer
+	queue      *replicationQueue           // Replicas waiting to be sent, nil unless ReplicationQueue is set
+	groups     *keyRing                    // Keys of the groups this server is a member of
+	acls       *aclTable                   // ACLs of prefixes
+	dataKeys   *dataKeyTable               // Data keys of files, nil unless KMS is set
+	knownPeers sync.Map                    // ID → address of every peer ever connected
+	idle       idleReaper                  // Peers closed for being idle
+	scores     peerScores                  // Misbehaviour and traffic of peers
+	auditLog   *auditLog                   // Audit log of storage operations, nil unless Audit is set
+	keyLocks   sync.Map                    // Per key *sync.Mutex serializing Append and WriteAt
+	uploads    uploadTable                 // Multipart uploads in progress
+	tenants    tenantTable                 // Traffic of the tenants of the admin API
+	fetches    flightGroup                 // Fetches of files missing locally in progress
+	swarms     swarmTable                  // Files being downloaded in swarm mode
+	relay      relayState                  // Connections carried as a relay
+	events     eventBus                    // Delivers events to subscribers
+	throughput throughputSampler           // Transfer rates shown by the dashboard
+	gossip     seenSet                     // Key changes relayed recently
+	streamsIn  *streamLimiter              // Streams peers opened, nil unless MaxStreams or MaxPeerStreams is set
+	streamsOut *streamLimiter              // Streams opened to peers, likewise
+	disk       *ioScheduler                // Turns of disk IO, nil unless ForegroundIO or BackgroundIO is set
+	running    atomic.Bool                 // Whether the transport is listening and the server isn't stopped
+	quitch     chan struct{}               // Channel to signal the server to stop its operation
 }
 
 // NewFileServer initializes a new FileServer with the provided options
 func NewFileServer(opts FileServerOpts) *FileServer {
+	// Hash keys like older versions did unless told otherwise
+	if opts.Hasher.New == nil {
+		opts.Hasher = crypto.MD5Hasher
+	}
+
 	// Configure the storage options for the server
-	storeOpts := StoreOpts{
+	storeOpts := storage.StoreOpts{
 		Root:              opts.StorageRoot,       // Set the storage root directory
 		PathTransformFunc: opts.PathTransformFunc, // Set the path transformation function
+		NoSync:            opts.NoSync,            // Whether to skip fsyncing written files
+		EncryptAtRest:     opts.EncryptAtRest,     // Whether to encrypt the objects on disk
+		Immutable:         opts.Immutable,         // Write-once namespaces and their retention
+		PackThreshold:     opts.PackThreshold,     // Objects small enough to be packed
+		PackSize:          opts.PackSize,          // Size packs are appended to up to
+		MmapThreshold:     opts.MmapThreshold,     // Objects large enough to be read through a memory mapping
+	}
+	if opts.EncryptAtRest {
+		storeOpts.EncKey = crypto.DeriveSubkey(opts.EncKey, "at-rest") // Distinct from the keys files are sent to peers with
+	}
+	if opts.PathTransformFunc == nil {
+		storeOpts.Hasher = opts.Hasher // Content-address the store with the same hasher
+		storeOpts.Layout = opts.Layout // Spreading objects over directories as configured
+	}
+
+	// Open the store at the storage root if not provided
+	if opts.Storage == nil {
+		st := storage.NewStore(storeOpts)
+		opts.StorageRoot, opts.Storage = st.Root, st // The store defaults the root
 	}
 
 	// Generate a unique ID for the server if not provided
 	if len(opts.ID) == 0 {
-		opts.ID = generateID()
+		opts.ID = crypto.GenerateID()
+	}
+
+	// Generate an identity key for receiving share bundles if not provided
+	if opts.IdentityKey == nil {
+		opts.IdentityKey, _ = ecdh.X25519().GenerateKey(rand.Reader)
 	}
 
 	// Return a new FileServer instance
-	return &FileServer{
-		FileServerOpts: opts,                      // Assign the provided options to the server
-		store:          NewStore(storeOpts),       // Initialize the file storage system
-		quitch:         make(chan struct{}),       // Initialize the quit channel
-		peers:          make(map[string]p2p.Peer), // Initialize the peers map
+	s := &FileServer{
+		FileServerOpts: opts,                                       // Assign the provided options to the server
+		store:          opts.Storage,                               // Use the file storage system
+		lookupKey:      crypto.DeriveSubkey(opts.EncKey, "lookup"), // Derive the secret of the lookup tokens
+		quitch:         make(chan struct{}),                        // Initialize the quit channel
+		peers:          make(map[string]p2p.Peer),                  // Initialize the peers map
+	}
+	s.streamsIn = newStreamLimiter(opts.MaxStreams, opts.MaxPeerStreams)
+	s.streamsOut = newStreamLimiter(opts.MaxStreams, opts.MaxPeerStreams)
+	s.disk = newIOScheduler(opts.ForegroundIO, opts.BackgroundIO)
+	hints, err := loadHints(filepath.Join(s.StorageRoot, hintsFileName))
+	if err != nil {
+		log.Printf("loading hints failed: %s", err)
+	}
+	s.hints = hints
+	accounts, err := loadAccounts(filepath.Join(s.StorageRoot, accountingFileName))
+	if err != nil {
+		log.Printf("loading peer accounts failed: %s", err)
+	}
+	s.accounts = accounts
+	if opts.ReplicationQueue != nil {
+		if s.queue, err = loadReplicationQueue(filepath.Join(s.StorageRoot, replicationFileName), *opts.ReplicationQueue); err != nil {
+			log.Printf("loading the replication queue failed: %s", err)
+		}
+	}
+	groups, err := loadKeyRing(filepath.Join(s.StorageRoot, groupsFileName), crypto.DeriveSubkey(opts.EncKey, "groups"), opts.KMS)
+	if err != nil {
+		log.Printf("loading group keys failed: %s", err)
+	}
+	s.groups = groups
+	acls, err := loadACLs(filepath.Join(s.StorageRoot, aclsFileName))
+	if err != nil {
+		log.Printf("loading ACLs failed: %s", err)
+	}
+	s.acls = acls
+	if opts.KMS != nil {
+		if s.dataKeys, err = loadDataKeys(filepath.Join(s.StorageRoot, dataKeysFileName), opts.KMS); err != nil {
+			log.Printf("loading data keys failed: %s", err)
+		}
+		// Take over the data keys of a node migrated to this storage root.
+		if identity, _ := LoadIdentity(s.StorageRoot); identity != nil && identity.ID == s.ID {
+			if err := s.dataKeys.adopt(identity.DataKeys); err != nil {
+				log.Printf("adopting the migrated data keys failed: %s", err)
+			}
+		}
 	}
+	if opts.Audit != nil {
+		if s.auditLog, err = openAuditLog(*opts.Audit); err != nil {
+			log.Printf("opening the audit log failed: %s", err)
+		}
+	}
+	s.bootstrap = newBootstrapManager(s.dial, opts.BootstrapNodes, opts.BootstrapConcurrency, opts.BootstrapRetryInterval, s.quitch)
+	if len(opts.AdminAddr) > 0 {
+		s.admin = &http.Server{Addr: opts.AdminAddr, Handler: s.AdminHandler()}
+	}
+	if opts.SFTP != nil {
+		s.sftp = newSFTPServer(s, *opts.SFTP)
+	}
+
+	return s
 }
 
 // broadcast sends a message to all connected peers
 func (s *FileServer) broadcast(msg *Message) error {
+	return s.broadcastTo(s.peerList(), msg)
+}
+
+// broadcastTo sends a message to the given peers. Multiplexed peers receive it
+// on a stream of its own, everyone else directly on the connection.
+func (s *FileServer) broadcastTo(peers []p2p.Peer, msg *Message) error {
+	for _, peer := range peers {
+		stream, err := s.openStream(peer)
+		if errors.Is(err, p2p.ErrNotMultiplexed) {
+			if err := writeMessage(peer, msg); err != nil {
+				return err // Return error if sending fails
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = writeMessage(stream, msg)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil // Return nil if broadcasting succeeds
+}
+
+// defaultRequestTimeout is the RequestTimeout used unless configured otherwise.
+const defaultRequestTimeout = 30 * time.Second
+
+// requestTimeout returns how long peers may leave requests without progress.
+func (s *FileServer) requestTimeout() time.Duration {
+	if s.RequestTimeout > 0 {
+		return s.RequestTimeout
+	}
+	return defaultRequestTimeout
+}
+
+// openStream opens a stream to peer that gives up on the peer if it stops
+// responding for longer than the request timeout. It waits for the turn of
+// the stream under MaxStreams and MaxPeerStreams, which ends once the stream
+// is closed.
+func (s *FileServer) openStream(peer p2p.Peer) (net.Conn, error) {
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	end, err := s.streamsOut.acquire(peer.RemoteAddr().String(), s.requestTimeout(), s.quitch)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("opening a stream to (%s): %w", peer.RemoteAddr(), err)
+	}
+	return &peerStream{
+		Conn:        p2p.WithTimeouts(stream, s.requestTimeout(), s.requestTimeout()),
+		version:     peer.ProtocolVersion(),
+		compression: peer.Compression(),
+		end:         end,
+	}, nil
+}
+
+// peerStream is a stream opened to a peer, which knows the protocol version
+// and the compression of messages negotiated with it.
+type peerStream struct {
+	net.Conn
+	version     int
+	compression string
+	end         func() // Ends the turn of the stream, nil if it didn't take one
+}
+
+// Close closes the stream and ends its turn.
+func (s *peerStream) Close() error {
+	err := s.Conn.Close()
+	if s.end != nil {
+		s.end()
+	}
+	return err
+}
+
+// ProtocolVersion returns the protocol version negotiated with the peer.
+func (s *peerStream) ProtocolVersion() int {
+	return s.version
+}
+
+// Compression returns the compression of messages negotiated with the peer.
+func (s *peerStream) Compression() string {
+	return s.compression
+}
+
+// writeMessage writes the incoming message marker followed by the message to
+// w, encoded for the protocol version spoken with the peer w writes to and
+// compressed if they negotiated it.
+func writeMessage(w io.Writer, msg *Message) error {
 	// Encode the message into a byte buffer
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+	buf, err := encodeMessage(msg, protocolVersionOf(w))
+	if err != nil {
 		return err // Return error if encoding fails
 	}
+	buf = compressMessage(buf, compressionOf(w))
 
-	// Send the encoded message to all peers
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage}) // Notify peer of incoming message
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err // Return error if sending fails
-		}
+	if _, err := w.Write([]byte{p2p.IncomingMessage}); err != nil { // Notify peer of incoming message
+		return err
 	}
+	_, err = w.Write(buf)
+	return err
+}
 
-	return nil // Return nil if broadcasting succeeds
+// peerList returns a snapshot of the currently connected peers.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
 }
 
-// Message represents a generic message to be exchanged between peers
+// ErrDuplicatePeer is returned by OnPeer for a second connection with a node
+// that is already connected, when the existing connection is the one kept.
+var ErrDuplicatePeer = errors.New("duplicate connection with peer")
+
+// Message represents a generic message to be exchanged between peers. The
+// type of its payload is named in its header, see MessageType.
 type Message struct {
-	Payload any // Payload contains the actual data of the message
+	Payload any               // Payload contains the actual data of the message
+	Headers map[string]string // Headers carry metadata such as the trace context
 }
 
 // MessageStoreFile is a specific message type used to store a file
 type MessageStoreFile struct {
-	ID   string // Unique identifier of the file
-	Key  string // Key used to encrypt the file
-	Size int64  // Size of the file in bytes
+	ID        string             // Unique identifier of the file
+	Key       string             // Key used to encrypt the file
+	Size      int64              // Size of the file in bytes
+	Retention *storage.Retention // Retention of the file, nil if it has none
+	Tenant    string             // Tenant the file counts against the quotas of, empty if none
+	ACL       storage.ACL        // ACL of the file, nil if it has none
+	Principal *Principal         // Principal the file is stored for, nil when the server replicates its own files
+
+	// Frame describes the Size bytes following the message. Older servers
+	// don't send it; their replicas are framed like newReplicaFrame does.
+	Frame *ReplicaFrame
 }
 
 // MessageGetFile is a specific message type used to retrieve a file
 type MessageGetFile struct {
 	ID  string // Unique identifier of the file
 	Key string // Key used to identify the file
+
+	// Principal is who the file is fetched for, checked against the ACL of
+	// the replica; nil when the server fetches for itself.
+	Principal *Principal
+
+	// Chunked asks for the file in chunks written by a crcWriter. Only peers
+	// speaking chunkedStreamsVersion are asked to.
+	Chunked bool
+}
+
+// MessageDeleteFile asks a peer to delete its replica of a file
+type MessageDeleteFile struct {
+	ID  string // Unique identifier of the file
+	Key string // Key used to identify the file
+
+	// Principal is who the file is deleted for, checked against the ACL of
+	// the replica; nil when the server deletes for itself.
+	Principal *Principal
 }
 
-// Get retrieves a file from the local storage or network if not found locally
-func (s *FileServer) Get(key string) (io.Reader, error) {
+// Get retrieves a file from the local storage or network if not found locally.
+// The returned reader holds the file open and must be closed. It also
+// implements io.ReaderAt and io.Seeker, reading the local file at any offset,
+// or fetching just the chunks read of chunked files.
+func (s *FileServer) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithProgress(key, nil)
+}
+
+// GetContext is Get, tracing the file being fetched as part of the trace of
+// ctx. Files are fetched for the principal of ctx, if any, and refused with
+// ErrForbidden unless their ACL lets it read them, see ACL.
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.getWithProgress(ctx, key, nil)
+}
+
+// GetWithProgress is Get reporting the progress of fetching the file from the
+// network to fn. Files served from local disk are reported as done right away.
+func (s *FileServer) GetWithProgress(key string, fn ProgressFunc) (io.ReadCloser, error) {
+	return s.getWithProgress(context.Background(), key, fn)
+}
+
+// getWithProgress is GetWithProgress, traced as part of the trace of ctx.
+func (s *FileServer) getWithProgress(ctx context.Context, key string, fn ProgressFunc) (io.ReadCloser, error) {
+	progress := newProgressTracker(key, 0, fn)
+	defer progress.done()
+
+	if err := s.checkACL(ctx, key, storage.PermRead); err != nil {
+		return nil, err
+	}
+	ctx, span := s.tracer().Start(ctx, "dfs.Get", trace.WithAttributes(attrKey.String(s.hashKey(key))))
+	r, err := s.getContext(ctx, key, progress)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Chunked files are stored as a manifest of their chunks
+	return s.openChunked(r)
+}
+
+// get returns the object stored under key as it is, fetching it from the
+// network if it isn't held locally.
+func (s *FileServer) get(key string, progress *progressTracker) (io.ReadCloser, error) {
+	return s.getContext(context.Background(), key, progress)
+}
+
+// getContext is get, tracing the fetch from the network as part of the trace of ctx.
+func (s *FileServer) getContext(ctx context.Context, key string, progress *progressTracker) (io.ReadCloser, error) {
+	span := trace.SpanFromContext(ctx)
+
 	// Check if the file exists locally
-	if s.store.Has(s.ID, key) {
+	hit := s.store.Has(s.ID, key)
+	span.SetAttributes(attrHit.Bool(hit))
+	if hit {
 		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key) // Read the file from local storage
-		return r, err                        // Return the file reader and any error encountered
+		size, r, err := s.readObject(ioForeground, s.ID, key) // Read the file from local storage
+		s.audit(AuditGet, s.ID, s.hashKey(key), size, "", err)
+		s.store.Touch(s.ID, key, time.Now())
+		return r, err // Return the file reader and any error encountered
+	}
+
+	// Gets of the same file at the same time share a single fetch, whose
+	// progress is reported to the first of them only.
+	shared, err := s.fetches.do(key, func() error {
+		// A fetch finishing just now left the file on local disk
+		if s.store.Has(s.ID, key) {
+			return nil
+		}
+
+		// If the file is not found locally, attempt to fetch it from the network
+		fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+
+		// Fetch the encrypted file from a peer and decrypt it into local storage
+		req := MessageGetFile{
+			ID:        s.ID,               // Include the server's ID
+			Key:       s.hashKey(key),     // Include the hashed key of the file
+			Principal: principalFrom(ctx), // Holders check the ACL of the file
+		}
+		from, n, err := s.fetchContext(ctx, req, progress, func(r io.Reader, size int64, from string) (int64, error) {
+			// Transfers breaking off are resumed from another peer
+			rr, err := s.newResumingReader(key, r, size, from, progress)
+			if err != nil {
+				return 0, err
+			}
+			defer rr.Close()
+			return s.store.Write(s.ID, key, rr)
+		})
+		s.audit(AuditGet, s.ID, req.Key, n, from, err)
+		s.accountAddr(from, PeerTraffic{Fetched: n})
+		if err != nil {
+			return err
+		}
+		s.events.emit(FileFetched{EventMeta: newEventMeta(), Key: key, Size: n, From: from})
+		span.SetAttributes(attrSize.Int64(n), attrPeer.String(from))
+		return nil
+	})
+	span.SetAttributes(attrShared.Bool(shared))
+	if err != nil {
+		return nil, err
 	}
 
-	// If the file is not found locally, attempt to fetch it from the network
-	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+	// Read and return the file from local storage after receiving it from the network
+	_, r, err := s.readObject(ioForeground, s.ID, key)
+	return r, err
+}
 
+// fetch requests a file from the network and hands the (still encrypted) data
+// received from a peer to write, along with its size and the address of the
+// peer. Data ending before the announced size fails with io.ErrUnexpectedEOF.
+// It returns the address of the peer the file came from and the number of
+// bytes written. The download is reported to progress.
+func (s *FileServer) fetch(req MessageGetFile, progress *progressTracker, write func(r io.Reader, size int64, from string) (int64, error)) (string, int64, error) {
+	return s.fetchContext(context.Background(), req, progress, write)
+}
+
+// fetchContext is fetch, tracing the request to each peer as part of the
+// trace of ctx. Peers continue the trace while answering.
+func (s *FileServer) fetchContext(ctx context.Context, req MessageGetFile, progress *progressTracker, write func(r io.Reader, size int64, from string) (int64, error)) (string, int64, error) {
 	// Prepare a message to request the file from peers
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,         // Include the server's ID
-			Key: hashKey(key), // Include the hashed key of the file
-		},
+	msg := Message{Payload: req}
+	s.wakeIdle() // Peers closed for being idle may hold the file
+
+	// A lone node is the only one that could hold the file; a node that
+	// should have peers can't tell whether they hold it.
+	if len(s.peerList()) == 0 {
+		if len(s.BootstrapNodes) > 0 {
+			return "", 0, fmt.Errorf("[%s] %w: no peer to fetch (%s) from", s.Transport.Addr(), ErrPeerUnavailable, req.Key)
+		}
+		return "", 0, fmt.Errorf("[%s] %w: (%s) is not on the network", s.Transport.Addr(), ErrKeyNotFound, req.Key)
 	}
 
-	// Broadcast the request to all connected peers
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err // Return error if broadcasting fails
+	if s.Swarm != nil {
+		if from, n, err := s.swarmFetch(ctx, req, progress, write); !errors.Is(err, errNoSwarm) {
+			return from, n, err
+		}
 	}
 
-	time.Sleep(time.Millisecond * 500) // Wait for a short duration to receive responses
+	// Fetch the file from the first multiplexed peer saying it holds it, on a
+	// dedicated stream, moving on to the next holder if the transfer fails.
+	// A holder refusing the request, or failing to answer, is reported if no
+	// other one serves it.
+	var (
+		from        string
+		total       int64
+		refusal     error
+		unreachable error
+	)
+	failed := func(err error) {
+		var respErr *ResponseError
+		switch {
+		case !errors.As(err, &respErr):
+			unreachable = err
+		case respErr.Code != CodeFileNotFound:
+			refusal = err
+		}
+	}
+	found, legacy := s.locate(req.ID, req.Key, func(peer p2p.Peer) bool {
+		stream, err := s.openStream(peer)
+		if err != nil {
+			log.Printf("[%s] open stream to (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			return false
+		}
+		defer stream.Close()
 
-	// Iterate through peers to receive the file
-	for _, peer := range s.peers {
-		// Read the file size from the peer connection
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize) // Read file size as int64
+		peerCtx, span := s.startPeerSpan(ctx, "dfs.fetch", peer)
+		n, err := fetchFromStream(stream, s.withTrace(peerCtx, &msg), func(r io.Reader, size int64) (int64, error) {
+			if deadline := s.transferDeadline(size); !deadline.IsZero() {
+				stream.SetReadDeadline(deadline) // Slow peers are resumed from others
+			}
+			progress.addPeer(peer.RemoteAddr().String(), size)
+			return write(progress.reader(r, peer.RemoteAddr().String()), size, peer.RemoteAddr().String())
+		})
+		span.SetAttributes(attrSize.Int64(n))
+		endSpan(span, err)
+		if err != nil {
+			log.Printf("[%s] fetching (%s) from (%s) failed: %s", s.Transport.Addr(), req.Key, peer.RemoteAddr(), err)
+			failed(err)
+			return false
+		}
 
-		// Write the received file data to local storage
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+		from, total = peer.RemoteAddr().String(), n
+		return true
+	})
+	if found {
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), total, from)
+		return from, total, nil
+	}
+
+	// Peers without multiplexing can't be asked whether they hold the file,
+	// so they are sent the request itself, one at a time.
+	for _, peer := range legacy {
+		n, err := s.fetchLegacy(ctx, peer, &msg, progress, write)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
 		if err != nil {
-			return nil, err // Return error if writing fails
+			log.Printf("[%s] fetching (%s) from (%s) failed: %s", s.Transport.Addr(), req.Key, peer.RemoteAddr(), err)
+			failed(err)
+			continue
 		}
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
 
-		peer.CloseStream() // Close the peer's data stream
+		return peer.RemoteAddr().String(), n, nil
 	}
 
-	// Read and return the file from local storage after receiving it from the network
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	if refusal != nil {
+		return "", 0, fmt.Errorf("[%s] fetching (%s) failed: %w", s.Transport.Addr(), req.Key, refusal)
+	}
+	if unreachable != nil {
+		return "", 0, fmt.Errorf("[%s] %w: fetching (%s) failed: %w", s.Transport.Addr(), ErrPeerUnavailable, req.Key, unreachable)
+	}
+	return "", 0, fmt.Errorf("[%s] %w: (%s) is not on the network", s.Transport.Addr(), ErrKeyNotFound, req.Key)
+}
+
+// fetchLegacy sends a get request to a peer without multiplexing and hands
+// its response to write. A peer not serving the request answers with a
+// *ResponseError, which is returned. A transfer failing half way leaves the
+// rest of the file on the connection, so the peer is disconnected then.
+func (s *FileServer) fetchLegacy(ctx context.Context, peer p2p.Peer, msg *Message, progress *progressTracker, write func(r io.Reader, size int64, from string) (int64, error)) (n int64, err error) {
+	peerCtx, span := s.startPeerSpan(ctx, "dfs.fetch", peer)
+	defer func() {
+		span.SetAttributes(attrSize.Int64(n))
+		endSpan(span, err)
+	}()
+
+	msg, r := chunkedFetch(peer.ProtocolVersion(), msg, peer)
+	if err := s.broadcastTo([]p2p.Peer{peer}, s.withTrace(peerCtx, msg)); err != nil {
+		return 0, err
+	}
+
+	time.Sleep(time.Millisecond * 500) // Wait for the transport to hand over the stream
+
+	err = readResponse(peer)
+	var respErr *ResponseError
+	if err != nil && !errors.As(err, &respErr) {
+		peer.Close()
+		return 0, err
+	}
+	defer peer.CloseStream() // Hand the connection back to the transport
+	if err != nil {
+		return 0, err
+	}
+
+	var fileSize int64
+	if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+		peer.Close()
+		return 0, err
+	}
+
+	from := peer.RemoteAddr().String()
+	progress.addPeer(from, fileSize)
+	n, err = write(progress.reader(&exactReader{r: r, left: fileSize}, from), fileSize, from)
+	if err != nil {
+		peer.Close()
+	}
+	return n, err
+}
+
+// fetchFromStream sends a get request on a multiplexed stream and passes the
+// response and its size to write. A peer not serving the request answers
+// with a *ResponseError, which is returned.
+func fetchFromStream(stream net.Conn, msg *Message, write func(io.Reader, int64) (int64, error)) (int64, error) {
+	msg, r := chunkedFetch(protocolVersionOf(stream), msg, stream)
+	if err := writeMessage(stream, msg); err != nil {
+		return 0, err
+	}
+	if err := readResponse(stream); err != nil {
+		return 0, err
+	}
+
+	var fileSize int64
+	if err := binary.Read(stream, binary.LittleEndian, &fileSize); err != nil {
+		return 0, err
+	}
+
+	return write(&exactReader{r: r, left: fileSize}, fileSize)
+}
+
+// chunkedFetch returns msg, a get request, asking for the file in chunks if
+// the peer speaks version, and the reader of the file the peer answers on
+// stream with.
+func chunkedFetch(version int, msg *Message, stream io.Reader) (*Message, io.Reader) {
+	req, ok := msg.Payload.(MessageGetFile)
+	if !ok || version < chunkedStreamsVersion {
+		return msg, stream
+	}
+	req.Chunked = true
+	chunked := *msg
+	chunked.Payload = req
+	return &chunked, newCRCReader(stream)
+}
+
+// exactReader reads exactly left bytes from r, failing with
+// io.ErrUnexpectedEOF if r ends before that.
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (r *exactReader) Read(b []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.left {
+		b = b[:r.left]
+	}
+	n, err := r.r.Read(b)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Len returns the number of bytes left to read, for sizeOf.
+func (r *exactReader) Len() int {
+	return int(r.left)
 }
 
 // Store saves a file to local storage and broadcasts it to peers
 func (s *FileServer) Store(key string, r io.Reader) error {
-	// Create a buffer to hold the file data temporarily
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer) // TeeReader allows reading and copying simultaneously
-	)
+	return s.StoreWithProgress(key, r, nil)
+}
+
+// StoreContext is Store, tracing the file being stored and replicated as part
+// of the trace of ctx, and storing it on behalf of the tenant of ctx, if any,
+// see ContextWithTenant.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	return s.storeWithProgress(ctx, key, r, nil)
+}
+
+// StoreWithProgress is Store reporting the progress of writing the file to
+// disk and sending it to each peer to fn.
+func (s *FileServer) StoreWithProgress(key string, r io.Reader, fn ProgressFunc) error {
+	return s.storeWithProgress(context.Background(), key, r, fn)
+}
+
+// storeWithProgress is StoreWithProgress, traced as part of the trace of ctx.
+func (s *FileServer) storeWithProgress(ctx context.Context, key string, r io.Reader, fn ProgressFunc) (err error) {
+	progress := newProgressTracker(key, sizeOf(r), fn)
+	defer progress.done()
+
+	if err := s.checkACL(ctx, key, storage.PermWrite); err != nil {
+		return err
+	}
+	ctx, span := s.tracer().Start(ctx, "dfs.Store", trace.WithAttributes(attrKey.String(s.hashKey(key))))
+	defer func() { endSpan(span, err) }()
+
+	if s.Gateway {
+		return s.storeThrough(ctx, key, r, progress)
+	}
+
+	tenant := tenantFrom(ctx)
+	if r, err = s.limitTenant(tenant, s.ID, key, r); err != nil {
+		return err
+	}
 
 	// Write the file data to local storage
-	size, err := s.store.Write(s.ID, key, tee)
+	size, err := s.storeLocal(key, r, progress)
 	if err != nil {
 		return err // Return error if writing fails
 	}
+	s.assignTenant(s.ID, key, tenant)
+	progress.setTotal(size)
+	span.SetAttributes(attrSize.Int64(size))
+
+	replicas := []string{s.ID} // Servers holding a copy once replication is done
+	defer func() { s.recordStored(key, size, replicas) }()
+
+	s.wakeIdle() // Peers closed for being idle may be meant to get a copy
+	sendTo, targets := s.replicaPeers(key, size)
+	s.hintMissing(key, targets) // Servers that are down get the file when they return
+
+	// Replicas sent in the background are recorded as held already
+	sendTo = slices.DeleteFunc(sendTo, func(peer p2p.Peer) bool {
+		if s.queueReplica(peer, key, PriorityWrite) {
+			replicas = append(replicas, peer.ID())
+			return true
+		}
+		return false
+	})
+	if len(sendTo) == 0 {
+		return nil
+	}
+
+	// Encrypt the file once, then send it to every peer on its own goroutine,
+	// so a slow or failing peer doesn't hold up the others.
+	sp, err := s.newSpool(key)
+	if err != nil {
+		for _, peer := range sendTo {
+			s.replicationFailed(key, peer, err)
+		}
+		return err
+	}
+	defer sp.close()
 
 	// Prepare a message to notify peers about the stored file
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,         // Include the server's ID
-			Key:  hashKey(key), // Include the hashed key of the file
-			Size: size + 16,    // Include the size of the file
+			ID:        s.ID,           // Include the server's ID
+			Key:       s.hashKey(key), // Include the hashed key of the file
+			Size:      sp.size,        // Include the size of the encrypted file
+			Frame:     sp.frame(),
+			Tenant:    s.tenantOf(key),
+			ACL:       s.objectACL(key),
+			Principal: principalFrom(ctx),
 		},
 	}
 
-	// Broadcast the stored file information to all connected peers
-	if err := s.broadcast(&msg); err != nil {
-		return err // Return error if broadcasting fails
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, peer := range sendTo {
+		progress.addPeer(peer.RemoteAddr().String(), sp.size)
+
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+
+			if err := s.replicate(ctx, peer, key, &msg, sp, progress); err != nil {
+				s.replicationFailed(key, peer, err)
+				return
+			}
+
+			mu.Lock()
+			replicas = append(replicas, peer.ID())
+			mu.Unlock()
+		}(peer)
 	}
+	wg.Wait()
 
-	time.Sleep(time.Millisecond * 5) // Wait for a short duration before sending the file
+	return nil // Return nil if the file was stored successfully
+}
 
-	// Send the file to all connected peers
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer) // Append each peer to the list of writers
+// storeLocal writes the file r reads to local storage under key, reporting
+// the writing to progress, and announces it. It returns the size of the file.
+func (s *FileServer) storeLocal(key string, r io.Reader, progress *progressTracker) (int64, error) {
+	if size := sizeOf(r); s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return 0, fmt.Errorf("%w: (%s) has %d bytes", ErrFileTooLarge, key, size)
 	}
-	mw := io.MultiWriter(peers...)       // Create a MultiWriter to send the file to multiple peers simultaneously
-	mw.Write([]byte{p2p.IncomingStream}) // Notify peers of an incoming file stream
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
+	if err := s.store.CheckWrite(s.ID, key); err != nil {
+		return 0, err
+	}
+	if err := s.newObjectKey(key); err != nil {
+		return 0, err
+	}
+	kind := KeyStored
+	if s.store.Has(s.ID, key) {
+		kind = KeyUpdated
+	}
+	size, err := s.store.Write(s.ID, key, s.limitFileSize(progress.reader(r, "")))
+	s.audit(AuditStore, s.ID, s.hashKey(key), size, "", err)
 	if err != nil {
-		return err // Return error if copying fails
+		return 0, err
 	}
+	s.events.emit(FileStored{EventMeta: newEventMeta(), ID: s.ID, Key: key, Size: size})
+	s.keyChanged(kind, key, size)
+	return size, nil
+}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+// Delete removes the file stored under key from local storage and asks peers
+// to delete their replicas. The chunks of chunked files are deleted as well.
+// Gateways only ask their peers.
+func (s *FileServer) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
 
-	return nil // Return nil if the file was stored successfully
+// DeleteContext is Delete for the principal of ctx, if any, refused with
+// ErrForbidden unless the ACL of the file lets it delete it, see ACL.
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error {
+	if err := s.checkACL(ctx, key, storage.PermDelete); err != nil {
+		return err
+	}
+	if s.Gateway && !s.store.Has(s.ID, key) {
+		return s.deleteThrough(ctx, key)
+	}
+	if !s.store.Has(s.ID, key) {
+		return fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+
+	keys := []string{key}
+	if _, r, err := s.store.Read(s.ID, key); err == nil {
+		if isChunkManifest(r) {
+			if m, err := readChunkManifest(r); err == nil {
+				for _, ref := range m.Chunks {
+					keys = append(keys, ref.Key)
+				}
+			}
+		} else {
+			r.Close()
+		}
+	}
+
+	for _, k := range keys {
+		err := s.store.Delete(s.ID, k)
+		s.audit(AuditDelete, s.ID, s.hashKey(k), 0, "", err)
+		if err != nil && k == key {
+			return err
+		}
+		s.forgetObjectKey(k)
+
+		if err := s.deleteReplicas(ctx, k); err != nil {
+			log.Printf("[%s] asking peers to delete (%s) failed: %s", s.Transport.Addr(), k, err)
+		}
+	}
+
+	s.recordDeleted(key)
+	s.keyChanged(KeyDeleted, key, 0)
+	return nil
+}
+
+// advertiseAddr returns the address peers reach this server at.
+func (s *FileServer) advertiseAddr() string {
+	if len(s.AdvertiseAddr) > 0 {
+		return s.AdvertiseAddr
+	}
+	return s.Transport.Addr()
+}
+
+// hashKey returns the lookup token a key is stored under on other nodes: an
+// HMAC keyed with a secret only the server holds, so the peers holding its
+// replicas can't recover keys by hashing guesses of them. Servers other than
+// the owner never need to derive the token of a key; they are sent it.
+func (s *FileServer) hashKey(key string) string {
+	return s.Hasher.Token(s.lookupKey, []byte(key))
+}
+
+// replicationFailed reports that the replica of key couldn't be sent to peer.
+func (s *FileServer) replicationFailed(key string, peer p2p.Peer, err error) {
+	log.Printf("[%s] sending (%s) to (%s) failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+	if !errors.Is(err, ErrImmutable) { // Peers refusing to overwrite the file hold it already
+		s.hints.add(peer.ID(), key) // Try again when the peer reconnects
+	}
+	s.audit(AuditReplicationFailed, s.ID, s.hashKey(key), 0, peer.RemoteAddr().String(), err)
+	s.events.emit(ReplicationFailed{EventMeta: newEventMeta(), Key: key, Peer: peer.RemoteAddr().String(), Error: err.Error()})
+}
+
+// objectKey returns the key the given file is encrypted with on other nodes.
+// Every file gets its own key, so handing out the key of one file doesn't give
+// access to any other: its data key with a KMS, see newObjectKey, otherwise a
+// key derived from EncKey.
+func (s *FileServer) objectKey(key string) ([]byte, error) {
+	if s.dataKeys != nil {
+		if dataKey, ok, err := s.dataKeys.get(key); ok || err != nil {
+			return dataKey, err
+		}
+	}
+	return crypto.DeriveKey(s.EncKey, key), nil
 }
 
 // Stop gracefully stops the FileServer by closing the quit channel
 func (s *FileServer) Stop() {
+	s.running.Store(false)
 	close(s.quitch) // Signal the server to stop its operation
+
+	if m := s.meta.Load(); m != nil {
+		m.close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.sftp != nil {
+		s.sftp.close()
+	}
+	if s.auditLog != nil {
+		s.auditLog.close()
+	}
+	s.accounts.save()
+	if err := s.store.CompactIndex(); err != nil {
+		log.Printf("[%s] could not compact metadata index: %s", s.Transport.Addr(), err)
+	}
 }
 
 // OnPeer is triggered when a new peer connects to the server
 func (s *FileServer) OnPeer(p p2p.Peer) error {
-	s.peerLock.Lock()         // Acquire the peer lock to safely modify the peers map
-	defer s.peerLock.Unlock() // Ensure the lock is released after the function exits
+	if s.banned(p, time.Now()) {
+		log.Printf("[%s] refusing banned peer %s", s.Transport.Addr(), p.RemoteAddr())
+		return ErrPeerBanned
+	}
+
+	s.peerLock.Lock() // Acquire the peer lock to safely modify the peers map
+
+	// Nodes dialing each other at the same time end up with two connections.
+	// Both sides keep the same one: the connection dialed by the lower ID.
+	var replaced p2p.Peer
+	if dup := s.peerByID(p.ID()); dup != nil {
+		if p.Outbound() != (s.ID < p.ID()) {
+			s.peerLock.Unlock()
+			log.Printf("[%s] dropping duplicate connection with %s (id=%q)", s.Transport.Addr(), p.RemoteAddr(), p.ID())
+			return ErrDuplicatePeer
+		}
+		delete(s.peers, dup.RemoteAddr().String())
+		replaced = dup
+	}
 
 	s.peers[p.RemoteAddr().String()] = p // Add the new peer to the peers map
+	s.peerLock.Unlock()
+
+	if replaced != nil {
+		log.Printf("[%s] replacing duplicate connection with %s (id=%q)", s.Transport.Addr(), replaced.RemoteAddr(), p.ID())
+		replaced.Close()
+	}
+
+	log.Printf("connected with remote %s (id=%q, transport=%s, version=%d, rtt=%s)",
+		p.RemoteAddr(), p.ID(), p.TransportKind(), p.ProtocolVersion(), p.RTT()) // Log the new connection
+
+	s.events.emit(PeerConnected{EventMeta: newEventMeta(), Addr: p.RemoteAddr().String(), ID: p.ID(), Transport: p.TransportKind()})
 
-	log.Printf("connected with remote %s", p.RemoteAddr()) // Log the new connection
+	if len(p.ID()) > 0 {
+		s.knownPeers.Store(p.ID(), p2p.DialAddr(p))
+		go s.handoff(p) // Deliver the replicas it missed while away
+		if s.queue != nil {
+			s.queue.poke() // Queued replicas may be waiting for it
+		}
+	}
 
 	return nil // Return nil if the peer was successfully added
 }
 
+// peerByID returns the connected peer announcing id, nil if there is none or
+// id is empty. The caller must hold peerLock.
+func (s *FileServer) peerByID(id string) p2p.Peer {
+	if len(id) == 0 {
+		return nil
+	}
+	for _, peer := range s.peers {
+		if peer.ID() == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// OnPeerDisconnect is triggered when a peer accepted by OnPeer disconnects
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	// The address may have been taken over by a newer connection already.
+	addr := p.RemoteAddr().String()
+	if s.peers[addr] == p {
+		delete(s.peers, addr)
+	}
+
+	log.Printf("disconnected from remote %s", addr)
+
+	s.events.emit(PeerDisconnected{EventMeta: newEventMeta(), Addr: addr, ID: p.ID()})
+}
+
+// Start starts listening for peers, connects to the bootstrap nodes and
+// handles incoming messages until the server is stopped.
+func (s *FileServer) Start() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.loop()
+	return nil
+}
+
+// start starts listening for peers and everything running in the background,
+// leaving the messages of peers to loop.
+func (s *FileServer) start() error {
+	if err := s.Transport.ListenAndAccept(); err != nil {
+		return err
+	}
+	s.running.Store(true)
+
+	if err := s.startMeta(); err != nil {
+		return err
+	}
+
+	if s.admin != nil {
+		if err := s.serveAdmin(); err != nil {
+			return err
+		}
+	}
+	if s.sftp != nil {
+		if err := s.sftp.serve(); err != nil {
+			return err
+		}
+	}
+
+	s.bootstrap.start()
+	go s.sampleThroughput()
+	go s.compactIndex()
+	go s.persistAccounts()
+
+	if s.IdleTimeout > 0 {
+		go s.reapIdle()
+	}
+	if s.HeartbeatInterval > 0 {
+		go s.heartbeat()
+	}
+	if s.Tiering != nil {
+		go s.tierObjects()
+	}
+	if s.Popularity != nil {
+		go s.spreadPopular()
+	}
+	if s.Proofs != nil {
+		go s.proveStorage()
+	}
+	if s.ReplicationQueue != nil {
+		workers := s.ReplicationQueue.Workers
+		if workers <= 0 {
+			workers = defaultReplicationWorkers
+		}
+		for range workers {
+			go s.replicateQueued()
+		}
+	}
+	return nil
+}
+
+// dial connects to a remote node through the transport.
+func (s *FileServer) dial(addr string) error {
+	log.Printf("[%s] attempting to connect with remote %s", s.Transport.Addr(), addr)
+	return s.Transport.Dial(addr)
+}
+
 // loop continuously handles incoming messages and peer connections
 func (s *FileServer) loop() {
 	defer func() {
@@ -213,15 +1257,434 @@ func (s *FileServer) loop() {
 		s.Transport.Close() // Ensure the transport layer is closed when the server stops
 	}()
 
+	// A fixed pool of workers handles messages if Workers is set
+	var pool *workerPool
+	if s.Workers > 0 {
+		pool = newWorkerPool(s.Workers, func(rpc p2p.RPC) {
+			if rpc.Conn != nil {
+				s.handleStream(rpc)
+				return
+			}
+			s.handleRPC(rpc)
+		})
+		defer pool.stop()
+	}
+
 	// Continuously listen for incoming messages or quit signal
 	for {
 		select {
 		case rpc := <-s.Transport.Consume(): // Receive a new RPC (Remote Procedure Call) from the transport layer
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decoding error: ", err) // Log decoding errors
+			if pool != nil {
+				if !pool.submit(rpc, s.quitch) {
+					return
+				}
+				continue
+			}
 
+			// Messages on their own stream don't share the connection with
+			// anyone, so they can be handled without holding up the loop.
+			if rpc.Conn != nil {
+				go s.handleStream(rpc)
+				continue
 			}
+			s.handleRPC(rpc)
+		case <-s.quitch: // Stop when the server is asked to quit
+			return
 		}
 	}
 }
+
+// handleStream handles rpc, which arrived on a stream of its own, once the
+// stream gets its turn under MaxStreams and MaxPeerStreams.
+func (s *FileServer) handleStream(rpc p2p.RPC) {
+	end, err := s.streamsIn.acquire(rpc.From, s.requestTimeout(), s.quitch)
+	if err != nil {
+		log.Printf("[%s] dropping a stream of (%s): %s", s.Transport.Addr(), rpc.From, err)
+		rpc.Conn.Close()
+		return
+	}
+	defer end()
+	s.handleRPC(rpc)
+}
+
+// handleRPC decodes the message carried by rpc and dispatches it.
+func (s *FileServer) handleRPC(rpc p2p.RPC) {
+	if rpc.Conn != nil {
+		rpc.Conn = p2p.WithTimeouts(rpc.Conn, s.requestTimeout(), s.requestTimeout())
+	}
+
+	var msg Message
+	if err := decodeMessage(rpc.Payload, &msg); err != nil {
+		log.Println("decoding error: ", err) // Log decoding errors
+		if rpc.Conn != nil {
+			rpc.Conn.Close()
+		}
+		return
+	}
+
+	_, span := s.startHandlerSpan(rpc, &msg)
+	err := s.handleMessage(rpc, &msg)
+	endSpan(span, err)
+	if err != nil {
+		log.Println("handle message error: ", err)
+	}
+}
+
+// handleMessage dispatches a decoded message to the handler for its payload type.
+func (s *FileServer) handleMessage(rpc p2p.RPC, msg *Message) error {
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return s.handleMessageStoreFile(rpc, v)
+	case MessageGetFile:
+		return s.handleMessageGetFile(rpc, v)
+	case MessageHasFile:
+		return s.handleMessageHasFile(rpc, v)
+	case MessageGetRange:
+		return s.handleMessageGetRange(rpc, v)
+	case MessageSearch:
+		return s.handleMessageSearch(rpc, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(rpc, v)
+	case MessageKeyChanged:
+		return s.handleMessageKeyChanged(rpc, v)
+	case MessageNodeInfo:
+		return s.handleMessageNodeInfo(rpc)
+	case MessageMetaRequest:
+		return s.handleMessageMetaRequest(rpc, v)
+	case MessageCoordinate:
+		return s.handleMessageCoordinate(rpc, v)
+	case MessageMigrateObject:
+		return s.handleMessageMigrateObject(rpc, v)
+	case MessageMigrateIdentity:
+		return s.handleMessageMigrateIdentity(rpc, v)
+	case MessageNodeMoved:
+		return s.handleMessageNodeMoved(rpc, v)
+	case MessageGroupKey:
+		return s.handleMessageGroupKey(rpc, v)
+	case MessageRelay:
+		return s.handleMessageRelay(rpc, v)
+	case MessageSetRetention:
+		return s.handleMessageSetRetention(rpc, v)
+	case MessageSetACL:
+		return s.handleMessageSetACL(rpc, v)
+	case MessageRekeyReplicas:
+		return s.handleMessageRekeyReplicas(rpc, v)
+	case MessageChallenge:
+		return s.handleMessageChallenge(rpc, v)
+	case MessageStoreBatch:
+		return s.handleMessageStoreBatch(rpc, v)
+	case MessageGetBatch:
+		return s.handleMessageGetBatch(rpc, v)
+	case MessageRelayed:
+		return s.handleMessageRelayed(rpc, v)
+	}
+
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+	return nil
+}
+
+// handleMessageStoreFile writes the file following a MessageStoreFile to disk.
+func (s *FileServer) handleMessageStoreFile(rpc p2p.RPC, msg MessageStoreFile) error {
+	if rpc.Conn != nil {
+		defer rpc.Conn.Close()
+
+		// The sender waits for the response once the file is sent, or
+		// stops sending when refused early.
+		err := s.receiveFile(rpc.From, rpc.Conn, msg)
+		writeResponse(rpc.Conn, err)
+		return err
+	}
+
+	peer, err := s.peer(rpc.From)
+	if err != nil {
+		return err
+	}
+	if s.Gateway {
+		s.Disconnect(rpc.From) // The file follows on the connection itself
+		return errGatewayReplica
+	}
+	if err := msg.checkFrame(); err != nil {
+		s.Disconnect(rpc.From)
+		return err
+	}
+	if err := s.admitFile(peer, msg.Size, time.Now()); err != nil {
+		s.Disconnect(rpc.From)
+		return err
+	}
+	if err := s.admitReplica(msg); err != nil {
+		s.Disconnect(rpc.From)
+		return err
+	}
+	if err := s.checkWriter(rpc.From, msg); err != nil {
+		s.Disconnect(rpc.From)
+		return err
+	}
+
+	n, err := s.writeReplica(msg.ID, msg.Key, io.LimitReader(msg.reader(peer), msg.Size))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	s.retainReplica(msg)
+	s.assignTenant(msg.ID, msg.Key, msg.Tenant)
+	s.aclReplica(msg)
+	s.audit(AuditReplicaReceived, msg.ID, msg.Key, n, rpc.From, nil)
+	s.accountAddr(rpc.From, PeerTraffic{Stored: n})
+	s.events.emit(FileStored{EventMeta: newEventMeta(), ID: msg.ID, Key: msg.Key, Size: n, From: rpc.From})
+
+	peer.CloseStream() // Let the transport resume reading from the peer
+
+	return nil
+}
+
+// checkFrame returns an error if the stream following msg is framed in a way
+// the server can't read, or isn't as long as msg says.
+func (msg MessageStoreFile) checkFrame() error {
+	if msg.Frame == nil {
+		return nil
+	}
+	return msg.Frame.check(msg.Size)
+}
+
+// reader returns the reader of the file following msg on stream, the stream
+// itself unless it is chunked.
+func (msg MessageStoreFile) reader(stream io.Reader) io.Reader {
+	if msg.Frame != nil && msg.Frame.Chunked {
+		return newCRCReader(stream)
+	}
+	return stream
+}
+
+// receiveFile stores the file following msg on stream, sent by the peer at
+// from.
+func (s *FileServer) receiveFile(from string, stream io.Reader, msg MessageStoreFile) error {
+	if s.Gateway {
+		return errGatewayReplica
+	}
+	if err := msg.checkFrame(); err != nil {
+		return err
+	}
+	if peer, err := s.peer(from); err == nil {
+		if err := s.admitFile(peer, msg.Size, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := s.store.CheckWrite(msg.ID, msg.Key); err != nil {
+		return err // Refused before the file is sent
+	}
+	if err := s.admitReplica(msg); err != nil {
+		return err
+	}
+	if err := s.checkWriter(from, msg); err != nil {
+		return err
+	}
+
+	// The sender may give up halfway and retry on a new stream; replicas
+	// ending early fail before they are stored, so none is kept truncated.
+	r := &exactReader{r: msg.reader(stream), left: msg.Size}
+	n, err := s.writeReplica(msg.ID, msg.Key, r)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("[%s] received %d of %d bytes of (%s): %w", s.Transport.Addr(), msg.Size-r.left, msg.Size, msg.Key, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	s.retainReplica(msg)
+	s.assignTenant(msg.ID, msg.Key, msg.Tenant)
+	s.aclReplica(msg)
+	s.audit(AuditReplicaReceived, msg.ID, msg.Key, n, from, nil)
+	s.accountAddr(from, PeerTraffic{Stored: n})
+	s.events.emit(FileStored{EventMeta: newEventMeta(), ID: msg.ID, Key: msg.Key, Size: n, From: from})
+	return nil
+}
+
+// handleMessageGetFile streams a locally stored file back to the peer asking for it.
+func (s *FileServer) handleMessageGetFile(rpc p2p.RPC, msg MessageGetFile) error {
+	var w io.Writer = rpc.Conn
+	if rpc.Conn != nil {
+		defer rpc.Conn.Close()
+	} else {
+		peer, err := s.peer(rpc.From)
+		if err != nil {
+			return err
+		}
+
+		// Legacy connections need to be told a stream is coming first.
+		if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+			return err
+		}
+		w = peer
+	}
+
+	if err := s.checkReplicaACL(rpc.From, msg.Principal, msg.ID, msg.Key, storage.PermRead); err != nil {
+		writeResponse(w, err)
+		return err
+	}
+	fileSize, r, err := s.readReplica(msg.ID, msg.Key)
+	if err != nil {
+		writeResponse(w, err) // Tell the peer why it won't get the file
+		return err
+	}
+	defer r.Close()
+
+	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+
+	if err := writeResponse(w, nil); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fileSize); err != nil {
+		return err
+	}
+	var n int64
+	if msg.Chunked {
+		cw := newCRCWriter(w)
+		if n, err = io.Copy(cw, r); err == nil {
+			err = cw.Flush()
+		}
+	} else {
+		n, err = sendFile(w, r)
+	}
+	s.audit(AuditReplicaServed, msg.ID, msg.Key, n, rpc.From, err)
+	s.accountAddr(rpc.From, PeerTraffic{Served: n})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, rpc.From)
+
+	return nil
+}
+
+// readReplica opens the file stored under key by id to serve it to a peer.
+func (s *FileServer) readReplica(id string, key string) (int64, io.ReadCloser, error) {
+	if !s.store.Has(id, key) {
+		return 0, nil, fmt.Errorf("[%s] %w: need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), ErrKeyNotFound, key)
+	}
+	s.store.Touch(id, key, time.Now())
+	return s.readObject(ioForeground, id, key)
+}
+
+// sendFile copies the stored file r to w. Files are handed to w as they are,
+// those read in turns of the disk scheduler included, so plain TCP
+// connections and the streams multiplexed over them can serve them with
+// sendfile; encrypted connections copy them through a buffer like io.Copy
+// does.
+func sendFile(w io.Writer, r io.Reader) (int64, error) {
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(w, r)
+	}
+	if f, ok := r.(*scheduledFile); ok {
+		return f.sendTo(rf)
+	}
+	return rf.ReadFrom(r)
+}
+
+// handleMessageDeleteFile deletes the local replica of a file.
+func (s *FileServer) handleMessageDeleteFile(rpc p2p.RPC, msg MessageDeleteFile) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	if err := s.checkDeleter(rpc.From, msg.ID); err != nil {
+		return err
+	}
+	if !s.store.Has(msg.ID, msg.Key) {
+		return nil // Never received the replica, nothing to do
+	}
+	if err := s.checkReplicaACL(rpc.From, msg.Principal, msg.ID, msg.Key, storage.PermDelete); err != nil {
+		return err
+	}
+	err := s.store.Delete(msg.ID, msg.Key)
+	s.audit(AuditReplicaDeleted, msg.ID, msg.Key, 0, rpc.From, err)
+	return err
+}
+
+// peer looks up a connected peer by its remote address.
+func (s *FileServer) peer(addr string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	if !ok {
+		return nil, fmt.Errorf("%w: (%s) is not in the peer list", ErrPeerNotFound, addr)
+	}
+	return peer, nil
+}
+
+// checkOwner returns ErrForbidden unless the peer at addr is the server
+// owning namespace id, as it identified itself in the handshake. Peers may
+// only retain or delete the replicas of their own files.
+func (s *FileServer) checkOwner(addr string, id string) error {
+	peer, err := s.peer(addr)
+	if err != nil {
+		return err
+	}
+	if peer.ID() != id {
+		return fmt.Errorf("%w: (%s) doesn't own the files of (%s)", ErrForbidden, peer.ID(), id)
+	}
+	return nil
+}
+
+// checkDeleter returns ErrForbidden unless the peer at addr may delete the
+// replicas in namespace id: its owner, the coordinator, which deletes the
+// files the servers it places files for delete, or any peer for the shared
+// namespaces of key groups, whose members a server outside the group can't
+// tell apart.
+func (s *FileServer) checkDeleter(addr string, id string) error {
+	peer, err := s.peer(addr)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(id, groupNamespacePrefix) || len(s.Coordinator) > 0 && peer.ID() == s.Coordinator {
+		return nil
+	}
+	return s.checkOwner(addr, id)
+}
+
+// checkWriter returns ErrForbidden unless the peer at addr may store the
+// replica msg carries. Any peer may send a replica this server doesn't hold
+// yet, as those moving replicas between tiers do, but only the owner may
+// overwrite one, for principals the ACL of the replica lets write it. The
+// shared namespaces of key groups are written by any member.
+func (s *FileServer) checkWriter(addr string, msg MessageStoreFile) error {
+	if s.store.Has(msg.ID, msg.Key) && !strings.HasPrefix(msg.ID, groupNamespacePrefix) {
+		if err := s.checkOwner(addr, msg.ID); err != nil {
+			return err
+		}
+	}
+	return s.checkReplicaACL(addr, msg.Principal, msg.ID, msg.Key, storage.PermWrite)
+}
+
+func init() {
+	// Register the payload types carried in Message so gob can decode the
+	// messages of older servers, which encode Message as a whole, under the
+	// names they had when the server was built as package main.
+	gob.RegisterName("main.MessageStoreFile", MessageStoreFile{})
+	gob.RegisterName("main.MessageGetFile", MessageGetFile{})
+	gob.RegisterName("main.MessageHasFile", MessageHasFile{})
+	gob.RegisterName("main.MessageGetRange", MessageGetRange{})
+	gob.RegisterName("main.MessageSearch", MessageSearch{})
+	gob.RegisterName("main.MessageDeleteFile", MessageDeleteFile{})
+	gob.RegisterName("main.MessageKeyChanged", MessageKeyChanged{})
+	gob.RegisterName("main.MessageNodeInfo", MessageNodeInfo{})
+	gob.RegisterName("main.MessageMetaRequest", MessageMetaRequest{})
+	gob.RegisterName("main.MessageCoordinate", MessageCoordinate{})
+	gob.RegisterName("main.MessageMigrateObject", MessageMigrateObject{})
+	gob.RegisterName("main.MessageMigrateIdentity", MessageMigrateIdentity{})
+	gob.RegisterName("main.MessageNodeMoved", MessageNodeMoved{})
+	gob.RegisterName("main.MessageGroupKey", MessageGroupKey{})
+	gob.RegisterName("main.MessageRelay", MessageRelay{})
+	gob.RegisterName("main.MessageRelayed", MessageRelayed{})
+	gob.RegisterName("main.MessageSetRetention", MessageSetRetention{})
+	gob.RegisterName("main.MessageChallenge", MessageChallenge{})
+	gob.RegisterName("main.MessageStoreBatch", MessageStoreBatch{})
+	gob.RegisterName("main.MessageGetBatch", MessageGetBatch{})
+	gob.RegisterName("main.MessageSetACL", MessageSetACL{})
+	gob.RegisterName("main.MessageRekeyReplicas", MessageRekeyReplicas{})
+}
@@ -0,0 +1,335 @@
+package dfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/p2p/p2ptest"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/inagib21/DistributedFileStorageGo/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzHandleRPC feeds arbitrary bytes from a peer through message decoding
+// and dispatch, on a connection of its own and without one, which must
+// neither panic nor hang the server.
+func FuzzHandleRPC(f *testing.F) {
+	for _, payload := range []any{
+		MessageStoreFile{ID: "peer", Key: "key", Size: 16},
+		MessageStoreFile{ID: "peer", Key: "key", Size: 32, Frame: newReplicaFrame(16)},
+		MessageGetFile{ID: "peer", Key: "key"},
+		MessageHasFile{ID: "peer", Key: "key"},
+		MessageGetRange{ID: "peer", Key: "key", Offset: 4, Length: 8},
+		MessageSearch{},
+		MessageDeleteFile{ID: "peer", Key: "key"},
+		MessageKeyChanged{},
+		MessageNodeInfo{},
+		MessageMetaRequest{},
+		MessageCoordinate{},
+		MessageMigrateObject{ID: "peer", Key: "key", Size: 16},
+		MessageMigrateIdentity{},
+		MessageNodeMoved{ID: "peer", Addr: "127.0.0.1:2"},
+		MessageGroupKey{Group: "group"},
+		MessageRelay{To: "peer"},
+		MessageRelayed{From: "peer"},
+		MessageSetRetention{ID: "peer", Key: "key", Retention: storage.Retention{LegalHold: true}},
+		MessageChallenge{ID: "peer", Key: "key", Offset: 1, Length: 8, Nonce: []byte("nonce")},
+		MessageStoreBatch{ID: "peer", Files: []BatchFile{{Key: "key", Size: 16}, {Key: "other", Size: 4}}},
+		MessageGetBatch{ID: "peer", Keys: []string{"key", "other"}},
+		MessageSetACL{ID: "peer", Key: "key", ACL: storage.ACL{{Subject: "alice", Allow: storage.PermRead}}},
+		MessageRekeyReplicas{ID: "peer", Keys: map[string]string{"hash": "token"}},
+	} {
+		for version := p2p.MinProtocolVersion; version <= p2p.ProtocolVersion; version++ {
+			encoded, err := encodeMessage(&Message{Payload: payload, Headers: map[string]string{"traceparent": "x"}}, version)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(encoded, false)
+			f.Add(encoded, true)
+		}
+	}
+	f.Add([]byte{}, false)
+
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	s := NewFileServer(FileServerOpts{
+		StorageRoot: f.TempDir(),
+		EncKey:      crypto.NewEncryptionKey(),
+		Hasher:      crypto.SHA256Hasher,
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0"}),
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte, stream bool) {
+		rpc := p2p.RPC{From: "127.0.0.1:1", Payload: data}
+		if stream {
+			// A peer that sent the message and hung up
+			conn, remote := net.Pipe()
+			remote.Close()
+			rpc.Conn = conn
+		}
+		s.handleRPC(rpc)
+	})
+}
+
+func TestPeerDeduplication(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41299")
+	s2 := makeServer(t, "127.0.0.1:41300")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+	low, high := s1, s2
+	if high.ID < low.ID {
+		low, high = high, low
+	}
+
+	// Both nodes dial each other at the same time, and again once connected.
+	for i := 0; i < 2; i++ {
+		go s1.Connect("127.0.0.1:41300")
+		go s2.Connect("127.0.0.1:41299")
+		time.Sleep(200 * time.Millisecond)
+
+		// A single connection is left, the one dialed by the lower ID.
+		require.Eventually(t, func() bool {
+			lp, hp := low.Peers(), high.Peers()
+			return len(lp) == 1 && len(hp) == 1 && lp[0].Outbound && !hp[0].Outbound
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, high.ID, low.Peers()[0].ID)
+		assert.Equal(t, low.ID, high.Peers()[0].ID)
+	}
+
+	// Messages go over the surviving connection.
+	require.NoError(t, high.Store("deduplicated", bytes.NewReader([]byte("once"))))
+	require.Eventually(t, func() bool { return low.store.Has(high.ID, high.hashKey("deduplicated")) }, 2*time.Second, 10*time.Millisecond)
+}
+
+// openFiles returns the number of file descriptors open in the process,
+// skipping the test where they can't be counted.
+func openFiles(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't count open files: %s", err)
+	}
+	return len(fds)
+}
+
+func TestGetClosesFiles(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41329")
+	s.ChunkSize = 4
+
+	require.NoError(t, s.Store("plain", bytes.NewReader([]byte("not chunked"))))
+	require.NoError(t, s.Append("chunked", bytes.NewReader([]byte("split into chunks"))))
+
+	// Readers opened by every read path hold files only until closed.
+	before := openFiles(t)
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"plain", "chunked"} {
+			r, err := s.Get(key)
+			require.NoError(t, err)
+			_, err = io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			r, err = s.GetRange(key, 2, 4)
+			require.NoError(t, err)
+			_, err = io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			// Closed before read to the end.
+			r, err = s.Get(key)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+		}
+	}
+	assert.LessOrEqual(t, openFiles(t), before)
+}
+
+func TestServerOverMockTransport(t *testing.T) {
+	tr := p2ptest.NewTransport("127.0.0.1:3000")
+	s := NewFileServer(FileServerOpts{
+		StorageRoot: t.TempDir(),
+		EncKey:      crypto.NewEncryptionKey(),
+		Hasher:      crypto.SHA256Hasher,
+		Transport:   tr,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+	go s.Start()
+	defer s.Stop()
+
+	// Files stored are replicated to the peer, on streams of their own.
+	replicas := make(chan MessageStoreFile, 1)
+	peer := p2ptest.NewPeer(p2ptest.PeerOpts{Addr: "127.0.0.1:3001", ID: "remote", HandleStream: func(stream net.Conn) {
+		defer stream.Close()
+		r := bufio.NewReader(stream)
+		var msg Message
+		if _, err := r.ReadByte(); err != nil {
+			return
+		}
+		if err := readMessage(r, &msg); err != nil {
+			return
+		}
+		if store, ok := msg.Payload.(MessageStoreFile); ok {
+			io.CopyN(io.Discard, r, store.Size)
+			writeResponse(stream, nil)
+			replicas <- store
+		}
+	}})
+	require.NoError(t, tr.Accept(peer))
+	require.Len(t, s.Peers(), 1)
+	require.NoError(t, s.Store("a.txt", bytes.NewReader([]byte("mocked"))))
+	select {
+	case replica := <-replicas:
+		assert.Equal(t, s.ID, replica.ID)
+		assert.Equal(t, s.hashKey("a.txt"), replica.Key)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the file wasn't replicated")
+	}
+
+	// Replicas delivered by the peer are stored.
+	payload, err := encodeMessage(&Message{Payload: MessageStoreFile{ID: "remote", Key: "key", Size: 5}}, p2p.ProtocolVersion)
+	require.NoError(t, err)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	go tr.Deliver(p2p.RPC{From: "127.0.0.1:3001", Payload: payload, Conn: conn})
+	_, err = remote.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, readResponse(remote))
+	assert.True(t, s.store.Has("remote", "key"))
+
+	tr.Disconnect(peer)
+	assert.Empty(t, s.Peers())
+}
+
+func TestServerOverMockStore(t *testing.T) {
+	st := storagetest.NewStore()
+	tr := p2ptest.NewTransport("127.0.0.1:3000")
+	s := NewFileServer(FileServerOpts{
+		StorageRoot: t.TempDir(),
+		EncKey:      crypto.NewEncryptionKey(),
+		Hasher:      crypto.SHA256Hasher,
+		Transport:   tr,
+		Storage:     st,
+	})
+	go s.Start()
+	defer s.Stop()
+
+	// Files stored are kept in the store given, not on disk.
+	require.NoError(t, s.Store("a.txt", bytes.NewReader([]byte("mocked"))))
+	assert.True(t, st.Has(s.ID, "a.txt"))
+	assert.NoDirExists(t, filepath.Join(s.StorageRoot, s.ID))
+	r, err := s.Get("a.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "mocked", string(data))
+	assert.EqualValues(t, 1, s.Usage().Namespaces[s.ID].Objects)
+
+	// Tags and retention are kept in its metadata.
+	require.NoError(t, s.SetTags("a.txt", map[string]string{"kind": "text"}))
+	results, err := s.Search(TagQuery{Tags: map[string]string{"kind": "text"}})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, s.SetRetention("a.txt", storage.Retention{LegalHold: true}))
+	assert.ErrorIs(t, s.Delete("a.txt"), ErrImmutable)
+	require.NoError(t, s.SetRetention("a.txt", storage.Retention{}))
+	require.NoError(t, s.Delete("a.txt"))
+	assert.Zero(t, st.Len())
+
+	// Writes the store fails fail the files stored.
+	st.FailWrite = func(id string, key string) error { return io.ErrShortWrite }
+	assert.ErrorIs(t, s.Store("b.txt", bytes.NewReader([]byte("lost"))), io.ErrShortWrite)
+	st.FailWrite = nil
+
+	// Replicas delivered by peers are stored in it too.
+	payload, err := encodeMessage(&Message{Payload: MessageStoreFile{ID: "remote", Key: "key", Size: 5}}, p2p.ProtocolVersion)
+	require.NoError(t, err)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	go tr.Deliver(p2p.RPC{From: "127.0.0.1:3001", Payload: payload, Conn: conn})
+	_, err = remote.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, readResponse(remote))
+	meta, ok := st.Meta("remote", "key")
+	require.True(t, ok)
+	assert.EqualValues(t, 5, meta.Size)
+}
+
+// BenchmarkServeFile measures fetching a file from a peer made by NewNode,
+// which reads its disk in turns of the IO scheduler, over a multiplexed
+// stream: as batches and unchunked gets are served, handing the file to the
+// connection for sendfile, and in chunks checked with a CRC, copied through
+// user space.
+func BenchmarkServeFile(b *testing.B) {
+	const size = 8 << 20
+
+	s1 := makeServer(b, "127.0.0.1:41372")
+	s2 := makeServer(b, "127.0.0.1:41373", "127.0.0.1:41372")
+	s2.disk = newIOScheduler(4, 1)
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(b, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	require.NoError(b, s1.Store("large.bin", bytes.NewReader(bytes.Repeat([]byte("x"), size))))
+	key := s1.hashKey("large.bin")
+	require.Eventually(b, func() bool { return s2.store.Has(s1.ID, key) }, 5*time.Second, 10*time.Millisecond)
+	peer := s1.peerList()[0]
+
+	run := func(b *testing.B, fetch func(stream net.Conn, msg *Message) error) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			stream, err := s1.openStream(peer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = fetch(stream, &Message{Payload: MessageGetFile{ID: s1.ID, Key: key}})
+			stream.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("sendfile", func(b *testing.B) {
+		run(b, func(stream net.Conn, msg *Message) error {
+			if err := writeMessage(stream, msg); err != nil {
+				return err
+			}
+			if err := readResponse(stream); err != nil {
+				return err
+			}
+			var n int64
+			if err := binary.Read(stream, binary.LittleEndian, &n); err != nil {
+				return err
+			}
+			_, err := io.CopyN(io.Discard, stream, n)
+			return err
+		})
+	})
+	b.Run("chunked", func(b *testing.B) {
+		run(b, func(stream net.Conn, msg *Message) error {
+			_, err := fetchFromStream(stream, msg, func(r io.Reader, _ int64) (int64, error) { return io.Copy(io.Discard, r) })
+			return err
+		})
+	})
+}
@@ -0,0 +1,342 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPOpts configures serving the files of a server over SFTP, so backup
+// scripts and other tooling speaking it can store files on the network
+// without a client of their own.
+//
+// Clients log in with one of the public keys of a tenant, whatever their
+// user name, and see the files of the tenant as their home directory. Paths
+// map to keys like those of WebDAVHandler, below the name of the tenant.
+type SFTPOpts struct {
+	Addr    string       // Address to listen for SSH connections on
+	HostKey ssh.Signer   // Key the server proves its identity to clients with
+	Tenants []SFTPTenant // Who may log in, and to which files
+}
+
+// SFTPTenant is a set of SFTP users sharing the files stored under a prefix.
+type SFTPTenant struct {
+	Name string          // Directory of the tenant's files, /backups/db.tar is stored under <Name>/backups/db.tar; every file if empty
+	Keys []ssh.PublicKey // Keys the users of the tenant log in with
+}
+
+// sftpTenantExt is the extension of the ssh.Permissions of a connection
+// holding the name of the tenant it logged in as.
+const sftpTenantExt = "dfs-tenant"
+
+// sftpServer serves SFTP sessions until closed.
+type sftpServer struct {
+	s      *FileServer
+	opts   SFTPOpts
+	config *ssh.ServerConfig
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[*ssh.ServerConn]struct{} // Connections open, closed along with the server
+}
+
+// newSFTPServer returns the SFTP server of s described by opts.
+func newSFTPServer(s *FileServer, opts SFTPOpts) *sftpServer {
+	srv := &sftpServer{s: s, opts: opts, conns: make(map[*ssh.ServerConn]struct{})}
+	srv.config = &ssh.ServerConfig{PublicKeyCallback: srv.authenticate}
+	if opts.HostKey != nil {
+		srv.config.AddHostKey(opts.HostKey)
+	}
+	return srv
+}
+
+// authenticate returns the tenant holding key in the permissions of the
+// connection, or an error for keys of no tenant.
+func (srv *sftpServer) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	for _, tenant := range srv.opts.Tenants {
+		for _, k := range tenant.Keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return &ssh.Permissions{Extensions: map[string]string{sftpTenantExt: tenant.Name}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+// serve starts accepting SSH connections in the background.
+func (srv *sftpServer) serve() error {
+	if srv.opts.HostKey == nil {
+		return errors.New("serving SFTP requires a host key")
+	}
+	ln, err := net.Listen("tcp", srv.opts.Addr)
+	if err != nil {
+		return err
+	}
+	srv.mu.Lock()
+	srv.ln = ln
+	srv.mu.Unlock()
+
+	log.Printf("[%s] SFTP listening on %s", srv.s.Transport.Addr(), ln.Addr())
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("[%s] SFTP stopped: %s", srv.s.Transport.Addr(), err)
+				}
+				return
+			}
+			go srv.handleConn(conn)
+		}
+	}()
+	return nil
+}
+
+// close stops accepting connections and closes the open ones.
+func (srv *sftpServer) close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.ln != nil {
+		srv.ln.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+// handleConn serves the SFTP sessions of conn until it is closed.
+func (srv *sftpServer) handleConn(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, srv.config)
+	if err != nil {
+		log.Printf("[%s] SFTP handshake with %s failed: %s", srv.s.Transport.Addr(), nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+	srv.mu.Lock()
+	srv.conns[conn] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+
+	tenant := conn.Permissions.Extensions[sftpTenantExt]
+	log.Printf("[%s] SFTP login of %s as tenant %q from %s", srv.s.Transport.Addr(), conn.User(), tenant, conn.RemoteAddr())
+
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.handleSession(ch, chReqs, tenant)
+	}
+}
+
+// handleSession serves SFTP on ch once the client asks for the subsystem.
+// Shells and commands are refused.
+func (srv *sftpServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request, tenant string) {
+	defer ch.Close()
+
+	for req := range reqs {
+		var subsystem struct{ Name string }
+		ok := req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		h := &sftpHandler{fs: davFS{s: srv.s}, root: tenant}
+		server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("[%s] SFTP session of tenant %q failed: %s", srv.s.Transport.Addr(), tenant, err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpHandler serves the requests of an SFTP session of a tenant.
+type sftpHandler struct {
+	fs   davFS
+	root string // Name of the tenant, which its paths are below
+}
+
+// name returns the path of p within the files of the server, which can't
+// escape the directory of the tenant.
+func (h *sftpHandler) name(p string) string {
+	return path.Join("/", h.root, path.Clean("/"+p))
+}
+
+// stat describes the file or directory at name. The home directory of the
+// tenant exists before its first file does.
+func (h *sftpHandler) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := h.fs.Stat(ctx, name)
+	if errors.Is(err, os.ErrNotExist) && name == h.name("/") {
+		return &davInfo{name: "/", dir: true}, nil
+	}
+	return info, err
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(r.Context(), h.name(r.Filepath), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	rf, ok := f.(*davFile)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s is a directory", r.Filepath)
+	}
+	return rf, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	pflags := r.Pflags()
+	flag := os.O_WRONLY
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	f, err := h.fs.OpenFile(r.Context(), h.name(r.Filepath), flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*davWriter), nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	ctx, name := r.Context(), h.name(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return nil // Modes and times aren't kept, clients setting them after uploading mustn't fail
+	case "Mkdir":
+		if _, err := h.fs.Stat(ctx, h.name("/")); errors.Is(err, os.ErrNotExist) && h.root != "" {
+			if err := h.fs.Mkdir(ctx, h.name("/"), 0); err != nil {
+				return err // The home directory of the tenant, first made when needed
+			}
+		}
+		return h.fs.Mkdir(ctx, name, 0)
+	case "Rename":
+		if _, err := h.fs.Stat(ctx, h.name(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return h.fs.Rename(ctx, name, h.name(r.Target))
+	case "Remove":
+		info, err := h.fs.Stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", r.Filepath)
+		}
+		return h.fs.RemoveAll(ctx, name)
+	case "Rmdir":
+		f, err := h.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entries, err := f.Readdir(0)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("%s is not empty", r.Filepath)
+		}
+		return h.fs.RemoveAll(ctx, name)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx, name := r.Context(), h.name(r.Filepath)
+	switch r.Method {
+	case "List":
+		if _, err := h.stat(ctx, name); err != nil {
+			return nil, err
+		}
+		f, err := h.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			return sftpLister{}, nil // The empty home directory
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		entries, err := f.Readdir(0)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister(entries), nil
+	case "Stat", "Lstat":
+		info, err := h.stat(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpLister lists files to SFTP clients.
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(out []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[off:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes of the file starting at off, for SFTP clients
+// reading files in parallel.
+func (f *davFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	r, err := f.fs.s.GetRange(f.key, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.ReadFull(r, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// TransferError discards what was written once the SFTP transfer failed,
+// so the file isn't stored cut short when closed.
+func (w *davWriter) TransferError(err error) {
+	w.failed = err
+}
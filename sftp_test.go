@@ -0,0 +1,111 @@
+package dfs
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHKey returns a new ed25519 key for SSH.
+func newSSHKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+// dialSFTP logs in to the SFTP server at addr with key.
+func dialSFTP(addr string, key ssh.Signer) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "backup",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(conn)
+}
+
+func TestSFTP(t *testing.T) {
+	alice, bob, stranger := newSSHKey(t), newSSHKey(t), newSSHKey(t)
+	s := makeServer(t, "127.0.0.1:41335")
+	s.sftp = newSFTPServer(s, SFTPOpts{
+		Addr:    "127.0.0.1:41336",
+		HostKey: newSSHKey(t),
+		Tenants: []SFTPTenant{
+			{Name: "alice", Keys: []ssh.PublicKey{alice.PublicKey()}},
+			{Name: "bob", Keys: []ssh.PublicKey{bob.PublicKey()}},
+		},
+	})
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := dialSFTP("127.0.0.1:41336", stranger)
+	assert.Error(t, err, "keys of no tenant are refused")
+
+	c, err := dialSFTP("127.0.0.1:41336", alice)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Files uploaded land below the directory of the tenant.
+	entries, err := c.ReadDir("/")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	require.NoError(t, c.Mkdir("/backups"))
+	f, err := c.Create("/backups/db.tar")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("nightly dump"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	r, err := s.Get("alice/backups/db.tar")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "nightly dump", string(b))
+
+	f, err = c.Open("/backups/db.tar")
+	require.NoError(t, err)
+	b, err = io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "nightly dump", string(b))
+
+	entries, err = c.ReadDir("/backups")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "db.tar", entries[0].Name())
+	assert.Equal(t, int64(12), entries[0].Size())
+
+	require.NoError(t, c.Rename("/backups/db.tar", "/backups/db.old"))
+	_, err = c.Stat("/backups/db.tar")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Error(t, c.RemoveDirectory("/backups"), "directories with files can't be removed")
+	require.NoError(t, c.Remove("/backups/db.old"))
+	require.NoError(t, c.RemoveDirectory("/backups"))
+	assert.Empty(t, s.List("alice/backups"))
+
+	// Tenants don't see the files of one another, even going up.
+	require.NoError(t, s.Store("bob/secret", strings.NewReader("bob's")))
+	_, err = c.Stat("/../bob/secret")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	cb, err := dialSFTP("127.0.0.1:41336", bob)
+	require.NoError(t, err)
+	defer cb.Close()
+	_, err = cb.Stat("/secret")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,178 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// ErrInvalidShareToken is returned for share tokens that weren't issued by
+// this server, were tampered with or have expired.
+var ErrInvalidShareToken = errors.New("invalid share token")
+
+// shareLinkPrefix is prepended to encoded share bundles to make them recognizable.
+const shareLinkPrefix = "dfs-share:"
+
+// ShareBundle grants its recipient read access to exactly one stored file.
+//
+// It references the file the way other nodes store it (owner ID and hashed key)
+// and carries the file's content key wrapped for the recipient's public key. The
+// content key is derived per file, so redeeming a bundle doesn't reveal the
+// owner's encryption key or give access to any other file.
+type ShareBundle struct {
+	OwnerID    string `json:"owner_id"`    // ID of the server that stored the file
+	KeyHash    string `json:"key_hash"`    // Hashed key the file is stored under on other nodes
+	Ephemeral  []byte `json:"ephemeral"`   // Ephemeral X25519 public key used to wrap the content key
+	WrappedKey []byte `json:"wrapped_key"` // Content key of the file, sealed for the recipient
+}
+
+// Encode returns the bundle as a self-contained share link.
+func (b *ShareBundle) Encode() string {
+	buf, _ := json.Marshal(b)
+	return shareLinkPrefix + base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseShareBundle decodes a share link produced by ShareBundle.Encode.
+func ParseShareBundle(link string) (*ShareBundle, error) {
+	if !strings.HasPrefix(link, shareLinkPrefix) {
+		return nil, errors.New("invalid share link")
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(link, shareLinkPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid share link: %w", err)
+	}
+
+	b := &ShareBundle{}
+	if err := json.Unmarshal(buf, b); err != nil {
+		return nil, fmt.Errorf("invalid share link: %w", err)
+	}
+
+	return b, nil
+}
+
+// PublicKey returns the public key other users wrap share bundles for this server with.
+func (s *FileServer) PublicKey() *ecdh.PublicKey {
+	return s.IdentityKey.PublicKey()
+}
+
+// Share creates a bundle that lets the owner of recipient read the file stored under key.
+func (s *FileServer) Share(key string, recipient *ecdh.PublicKey) (*ShareBundle, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, wrapped, err := crypto.WrapKey(recipient, objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShareBundle{
+		OwnerID:    s.ID,
+		KeyHash:    s.hashKey(key),
+		Ephemeral:  ephemeral,
+		WrappedKey: wrapped,
+	}, nil
+}
+
+// Redeem returns the contents of the file a bundle shared with this server.
+// The encrypted file is fetched from the network unless a replica is already
+// held locally, and kept as a regular replica afterwards. The returned reader
+// should be closed.
+func (s *FileServer) Redeem(b *ShareBundle) (io.ReadCloser, error) {
+	contentKey, err := crypto.UnwrapKey(s.IdentityKey, b.Ephemeral, b.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("share bundle was not issued for this server: %w", err)
+	}
+
+	if !s.store.Has(b.OwnerID, b.KeyHash) {
+		req := MessageGetFile{
+			ID:  b.OwnerID,
+			Key: b.KeyHash,
+		}
+		if _, _, err := s.fetch(req, nil, func(r io.Reader, _ int64, _ string) (int64, error) {
+			return s.store.Write(b.OwnerID, b.KeyHash, r)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	_, r, err := s.store.Read(b.OwnerID, b.KeyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(contentKey, r, buf); err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(buf), nil
+}
+
+// shareToken is the payload of a share token.
+type shareToken struct {
+	Key     string `json:"k"`   // Key of the shared file
+	Expires int64  `json:"exp"` // Unix time the token expires at
+}
+
+// CreateShareToken returns a capability token granting anyone holding it
+// read access to the file stored under key for ttl, through the GET
+// /share/{token} endpoint of the admin API. The token is signed with a key
+// derived from EncKey; it names nothing but the file and can't be revoked
+// before it expires.
+func (s *FileServer) CreateShareToken(key string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("share token ttl must be positive, have %s", ttl)
+	}
+	payload, err := json.Marshal(shareToken{Key: key, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.signShareToken(payload)), nil
+}
+
+// verifyShareToken returns the key of the file token grants access to.
+func (s *FileServer) verifyShareToken(token string, now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidShareToken
+	}
+	payload, err := enc.DecodeString(encPayload)
+	if err != nil {
+		return "", ErrInvalidShareToken
+	}
+	mac, err := enc.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, s.signShareToken(payload)) {
+		return "", ErrInvalidShareToken
+	}
+
+	var t shareToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return "", ErrInvalidShareToken
+	}
+	if now.Unix() >= t.Expires {
+		return "", fmt.Errorf("%w: expired at %s", ErrInvalidShareToken, time.Unix(t.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return t.Key, nil
+}
+
+// signShareToken returns the signature of the payload of a share token.
+func (s *FileServer) signShareToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, crypto.DeriveSubkey(s.EncKey, "share-token"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,89 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareBundleLink(t *testing.T) {
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	contentKey := crypto.DeriveKey(crypto.NewEncryptionKey(), "picture_1.png")
+	ephemeral, wrapped, err := crypto.WrapKey(recipient.PublicKey(), contentKey)
+	assert.Nil(t, err)
+
+	b := &ShareBundle{
+		OwnerID:    crypto.GenerateID(),
+		KeyHash:    crypto.SHA256Hasher.Sum([]byte("picture_1.png")),
+		Ephemeral:  ephemeral,
+		WrappedKey: wrapped,
+	}
+
+	parsed, err := ParseShareBundle(b.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, b, parsed)
+
+	// Only the recipient can recover the content key.
+	key, err := crypto.UnwrapKey(recipient, parsed.Ephemeral, parsed.WrappedKey)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(contentKey, key))
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	_, err = crypto.UnwrapKey(other, parsed.Ephemeral, parsed.WrappedKey)
+	assert.NotNil(t, err)
+
+	_, err = ParseShareBundle("not a link")
+	assert.NotNil(t, err)
+}
+
+func TestShareToken(t *testing.T) {
+	s := newExportServer(t)
+	require.NoError(t, s.Store("docs/report.pdf", strings.NewReader("quarterly numbers")))
+	require.NoError(t, s.Store("secret.txt", strings.NewReader("not shared")))
+	api := httptest.NewServer(s.AdminHandler())
+	defer api.Close()
+
+	token, err := s.CreateShareToken("docs/report.pdf", time.Hour)
+	require.NoError(t, err)
+
+	res, err := http.Get(api.URL + "/share/" + token)
+	require.NoError(t, err)
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "quarterly numbers", string(b))
+	assert.Equal(t, `attachment; filename=report.pdf`, res.Header.Get("Content-Disposition"))
+
+	// Tokens can't be changed to grant access to another file.
+	other, err := s.CreateShareToken("secret.txt", time.Hour)
+	require.NoError(t, err)
+	payload, _, _ := strings.Cut(other, ".")
+	_, mac, _ := strings.Cut(token, ".")
+	res, err = http.Get(api.URL + "/share/" + payload + "." + mac)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// Tokens expire, and only work on the server that issued them.
+	_, err = s.verifyShareToken(token, time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, ErrInvalidShareToken)
+	_, err = newExportServer(t).verifyShareToken(token, time.Now())
+	assert.ErrorIs(t, err, ErrInvalidShareToken)
+	_, err = s.verifyShareToken("garbage", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidShareToken)
+
+	_, err = s.CreateShareToken("docs/report.pdf", 0)
+	assert.Error(t, err)
+}
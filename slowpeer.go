@@ -0,0 +1,30 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errSlowPeer fails transfers with peers slower than MinTransferRate.
+var errSlowPeer = errors.New("peer is slower than the minimum transfer rate")
+
+// transferDeadline returns when a transfer of size bytes with a peer must be
+// done by under MinTransferRate, or the zero time if there is no minimum.
+func (s *FileServer) transferDeadline(size int64) time.Time {
+	if s.MinTransferRate <= 0 {
+		return time.Time{}
+	}
+	took := time.Duration(float64(size) / float64(s.MinTransferRate) * float64(time.Second))
+	return time.Now().Add(s.requestTimeout() + took)
+}
+
+// slowTransfer returns err, the error of a transfer due by deadline, also
+// wrapping errSlowPeer if the transfer failed for running past it.
+func slowTransfer(err error, deadline time.Time) error {
+	if err == nil || deadline.IsZero() || time.Now().Before(deadline) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errSlowPeer, err)
+}
@@ -0,0 +1,83 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/chaos"
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowPeers(t *testing.T) {
+	holders := []*FileServer{makeServer(t, "127.0.0.1:41369"), makeServer(t, "127.0.0.1:41370", "127.0.0.1:41369")}
+	for _, h := range holders {
+		go h.Start()
+		t.Cleanup(h.Stop)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The node under test reaches its peers through a chaos transport and
+	// gives up on those moving less than 10 MB a second.
+	opts := NodeOpts{ListenAddr: "127.0.0.1:41371", BootstrapNodes: []string{"127.0.0.1:41369", "127.0.0.1:41370"}, ID: crypto.GenerateID(), EncKey: crypto.NewEncryptionKey(), StorageRoot: t.TempDir()}
+	tr := chaos.NewTransport(newNodeTransport(opts))
+	s := newNode(opts, tr)
+	tr.OnPeer, tr.OnPeerDisconnect, tr.OnProtocolError = s.OnPeer, s.OnPeerDisconnect, s.OnProtocolError
+	s.RequestTimeout = 200 * time.Millisecond
+	s.MinTransferRate = 10 << 20
+	go s.Start()
+	defer s.Stop()
+	require.Eventually(t, func() bool { return len(s.Peers()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	require.NoError(t, s.Store("a.bin", bytes.NewReader(data)))
+	require.NoError(t, s.store.Delete(s.ID, "a.bin"))
+
+	// A holder slowing down halfway through a fetch, though still making
+	// progress, is given up on once the fetch is due, and the rest of the
+	// file fetched from the other one.
+	var (
+		mu    sync.Mutex
+		slow  string
+		peers []PeerProgress
+	)
+	r, err := s.GetWithProgress("a.bin", func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, peer := range p.Peers {
+			if peer.Transferred > 0 && len(slow) == 0 {
+				slow = peer.Addr
+				tr.SetFaults(slow, chaos.Faults{Latency: 50 * time.Millisecond})
+			}
+		}
+		peers = p.Peers
+	})
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "the fetched file is intact")
+	mu.Lock()
+	assert.NotEmpty(t, slow)
+	assert.Len(t, peers, 2, "fetched from both holders")
+	mu.Unlock()
+
+	// Replicas to a slow peer aren't retried, leaving the peer to get it once
+	// it reconnects.
+	attempts := make(map[string]int)
+	require.NoError(t, s.StoreWithProgress("b.bin", bytes.NewReader(data), func(p Progress) {
+		for _, peer := range p.Peers {
+			attempts[peer.Addr] = peer.Attempts
+		}
+	}))
+	assert.Equal(t, 1, attempts[slow])
+	for _, h := range holders {
+		assert.Equal(t, h.Transport.Addr() != slow, h.store.Has(s.ID, s.hashKey("b.bin")), h.Transport.Addr())
+	}
+}
@@ -0,0 +1,9 @@
+package dfs
+
+import "github.com/inagib21/DistributedFileStorageGo/storage"
+
+// Snapshot writes a consistent point-in-time copy of the server's local store
+// to dst without interrupting the server. See storage.Store.Snapshot.
+func (s *FileServer) Snapshot(dst string) (storage.SnapshotInfo, error) {
+	return s.store.Snapshot(dst)
+}
@@ -0,0 +1,28 @@
+package dfs
+
+// ServerStatus is a point-in-time summary of a FileServer.
+type ServerStatus struct {
+	ID         string            `json:"id"`          // Unique identifier of the server
+	ListenAddr string            `json:"listen_addr"` // Address the transport listens on
+	Peers      []string          `json:"peers"`       // Remote addresses of the connected peers
+	Bootstrap  []BootstrapStatus `json:"bootstrap"`   // Dialing progress of the bootstrap nodes
+	StreamsIn  StreamStats       `json:"streams_in"`  // Streams peers opened, see MaxStreams
+	StreamsOut StreamStats       `json:"streams_out"` // Streams opened to peers, see MaxStreams
+}
+
+// Status reports the current state of the server.
+func (s *FileServer) Status() ServerStatus {
+	status := ServerStatus{
+		ID:         s.ID,
+		ListenAddr: s.Transport.Addr(),
+		Peers:      []string{},
+		Bootstrap:  s.bootstrap.Status(),
+		StreamsIn:  s.streamsIn.stats(),
+		StreamsOut: s.streamsOut.stats(),
+	}
+	for _, peer := range s.peerList() {
+		status.Peers = append(status.Peers, peer.RemoteAddr().String())
+	}
+
+	return status
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Permission is what an ACL entry allows on the objects of its ACL, any
+// combination of PermRead, PermWrite and PermDelete. It is written as their
+// names separated by commas, such as "read,write".
+type Permission uint8
+
+const (
+	PermRead   Permission = 1 << iota // Fetch the object
+	PermWrite                         // Store the object, overwriting it if it exists
+	PermDelete                        // Delete the object
+)
+
+// permName is the name of a permission.
+type permName struct {
+	perm Permission
+	name string
+}
+
+// permNames are the names of the permissions, in the order they are written.
+var permNames = []permName{{PermRead, "read"}, {PermWrite, "write"}, {PermDelete, "delete"}}
+
+func (p Permission) String() string {
+	var names []string
+	for _, n := range permNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePermission returns the permission written as names of permissions
+// separated by commas, such as "read,delete", or as "none".
+func ParsePermission(s string) (Permission, error) {
+	if s == "none" {
+		return 0, nil
+	}
+	var p Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(permNames, func(n permName) bool { return n.name == name })
+		if i < 0 {
+			return 0, fmt.Errorf("unknown permission %q, must be read, write or delete", name)
+		}
+		p |= permNames[i].perm
+	}
+	return p, nil
+}
+
+// MarshalText writes p as its names, see String.
+func (p Permission) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText reads the names of p, see ParsePermission.
+func (p *Permission) UnmarshalText(text []byte) error {
+	v, err := ParsePermission(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// ACLEntry grants the principals of a subject permissions on the objects of
+// its ACL.
+type ACLEntry struct {
+	Subject string     `json:"subject"` // Subject of the principals it applies to, see dfs.Principal; "*" for every principal
+	Allow   Permission `json:"allow"`   // What they may do with the objects
+}
+
+// ACL lists who may do what with an object, or with the objects under a
+// prefix. The store keeps the ACL of every object in its metadata; nodes
+// enforce them, refusing principals the permissions their ACL doesn't grant
+// them with dfs.ErrForbidden unless they have the admin scope.
+//
+// ACLs apply to the requests made for a principal: those of the admin API
+// with dfs.AuthOpts set, and those made with a context of
+// dfs.ContextWithPrincipal. The ACL of an object takes precedence over those
+// of the prefixes it is under, the longest of which applies; objects without
+// any are open to every principal the scope of its credentials allows.
+type ACL []ACLEntry
+
+// Allows reports whether a grants perm to the principals of subject.
+func (a ACL) Allows(subject string, perm Permission) bool {
+	var granted Permission
+	for _, e := range a {
+		if e.Subject == "*" || e.Subject == subject {
+			granted |= e.Allow
+		}
+	}
+	return granted&perm == perm
+}
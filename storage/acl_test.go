@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermission(t *testing.T) {
+	var acl ACL
+	require.NoError(t, json.Unmarshal([]byte(`[{"subject":"alice","allow":"read, delete"},{"subject":"*","allow":"none"}]`), &acl))
+	assert.Equal(t, ACL{{Subject: "alice", Allow: PermRead | PermDelete}, {Subject: "*"}}, acl)
+	buf, err := json.Marshal(acl)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"subject":"alice","allow":"read,delete"},{"subject":"*","allow":"none"}]`, string(buf))
+
+	_, err = ParsePermission("read,execute")
+	assert.Error(t, err)
+	assert.True(t, acl.Allows("alice", PermRead|PermDelete))
+	assert.False(t, acl.Allows("alice", PermWrite))
+	assert.False(t, acl.Allows("bob", PermRead))
+}
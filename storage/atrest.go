@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// atRestOverhead returns the bytes objects take on disk besides their
+// contents: the IV they are encrypted with at rest, if they are.
+func (s *Store) atRestOverhead() int64 {
+	if s.EncryptAtRest {
+		return aes.BlockSize
+	}
+	return 0
+}
+
+// atRestCipher returns the name of the cipher objects are encrypted with at
+// rest, empty if they aren't.
+func (s *Store) atRestCipher() string {
+	if !s.EncryptAtRest {
+		return ""
+	}
+	return fmt.Sprintf("aes-%d-ctr", len(s.EncKey)*8)
+}
+
+// atRestWriter returns the writer the contents of an object are written to
+// f through: f itself, or a writer encrypting them with EncKey after writing
+// a fresh IV to f if EncryptAtRest is set.
+func (s *Store) atRestWriter(f io.Writer) (io.Writer, error) {
+	if !s.EncryptAtRest {
+		return f, nil
+	}
+
+	block, err := aes.NewCipher(s.EncKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting at rest: %w", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(iv); err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: f}, nil
+}
+
+// atRestReader returns the size of the contents of the object encrypted at
+// rest in f, which has fileSize bytes, and a reader decrypting them.
+func (s *Store) atRestReader(f readerAtCloser, fileSize int64) (int64, io.ReadCloser, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := f.ReadAt(iv, 0); err != nil {
+		f.Close()
+		return 0, nil, fmt.Errorf("%w: object too short to be encrypted at rest: %w", ErrChecksumMismatch, err)
+	}
+	if _, err := aes.NewCipher(s.EncKey); err != nil {
+		f.Close()
+		return 0, nil, fmt.Errorf("decrypting at rest: %w", err)
+	}
+
+	size := fileSize - aes.BlockSize
+	return size, &atRestFile{f: f, key: s.EncKey, iv: iv, size: size}, nil
+}
+
+// readerAtCloser is a file objects are read from at an offset.
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// atRestFile decrypts an object encrypted at rest. Like the file it reads,
+// it can be read at any offset and seeked, so ranges of the object can be
+// read without decrypting what comes before them.
+type atRestFile struct {
+	f    readerAtCloser
+	key  []byte
+	iv   []byte
+	size int64 // Size of the contents
+	off  int64 // Offset Read continues at
+}
+
+func (r *atRestFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n, err := r.f.ReadAt(b, aes.BlockSize+off)
+	stream, cerr := crypto.NewCTRAt(r.key, r.iv, off)
+	if cerr != nil {
+		return 0, cerr
+	}
+	stream.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (r *atRestFile) Read(b []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(b, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // Reported by the next Read
+	}
+	return n, err
+}
+
+func (r *atRestFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Len returns the number of bytes left to read.
+func (r *atRestFile) Len() int {
+	return int(max(r.size-r.off, 0))
+}
+
+func (r *atRestFile) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreEncryptAtRest(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncryptAtRest: true, EncKey: crypto.NewEncryptionKey()})
+	data := []byte("nobody reading the disk sees this")
+
+	n, err := s.Write("id", "key", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// The file on disk is the IV and the ciphertext.
+	raw, err := os.ReadFile(filepath.Join(s.Root, "id", s.PathTransformFunc("key").FullPath()))
+	require.NoError(t, err)
+	assert.Len(t, raw, len(data)+16)
+	assert.NotContains(t, string(raw), "nobody")
+
+	meta, ok := s.index.get("id", "key")
+	require.True(t, ok)
+	assert.Equal(t, int64(len(data)), meta.Size)
+
+	size, r, err := s.Read("id", "key")
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(len(data)), size)
+	assert.Equal(t, len(data), r.(interface{ Len() int }).Len())
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Ranges are decrypted without what comes before them.
+	part := make([]byte, 7)
+	_, err = r.(io.ReaderAt).ReadAt(part, 24)
+	require.NoError(t, err)
+	assert.Equal(t, "sees th", string(part))
+
+	// Another key reads garbage.
+	other := NewStore(StoreOpts{Root: s.Root, EncryptAtRest: true, EncKey: crypto.NewEncryptionKey()})
+	_, r2, err := other.Read("id", "key")
+	require.NoError(t, err)
+	defer r2.Close()
+	got, _ = io.ReadAll(r2)
+	assert.NotEqual(t, data, got)
+}
@@ -0,0 +1,47 @@
+package storage
+
+// ContentManifest describes what an object holds. The store fills in the
+// checksum and encryption of every object it writes; the rest is given by
+// whoever stores a file with StoreWithContent and, unlike tags, is replaced
+// when the file is stored again. Files written with Append and WriteAt keep
+// their description but have no checksum. Manifests are kept in the index of
+// the server holding the object and aren't sent to peers.
+type ContentManifest struct {
+	ContentType string            `json:"content_type,omitempty"` // MIME type of the contents
+	Filename    string            `json:"filename,omitempty"`     // Name of the file the contents came from
+	Metadata    map[string]string `json:"metadata,omitempty"`     // User metadata
+	Checksum    string            `json:"checksum,omitempty"`     // Hex SHA-256 of the contents as written
+	Encryption  string            `json:"encryption,omitempty"`   // Cipher the object is encrypted with at rest, empty if none
+}
+
+// SetContent sets the content type, filename and metadata of the manifest of
+// an object, keeping the checksum and encryption the store recorded.
+func (s *Store) SetContent(id string, key string, m ContentManifest) error {
+	metadata := make(map[string]string, len(m.Metadata))
+	for k, v := range m.Metadata {
+		metadata[k] = v
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	m.Metadata = metadata
+
+	return s.index.update(id, key, func(meta *ObjectMeta) {
+		meta.Content = meta.Content.DescribedAs(&m)
+	})
+}
+
+// DescribedAs returns a copy of c with the content type, filename and
+// metadata of desc, keeping the checksum and encryption of c. Either may be nil.
+func (c *ContentManifest) DescribedAs(desc *ContentManifest) *ContentManifest {
+	out := ContentManifest{}
+	if c != nil {
+		out = *c
+	}
+	out.ContentType, out.Filename, out.Metadata = "", "", nil
+	if desc != nil {
+		out.ContentType, out.Filename, out.Metadata = desc.ContentType, desc.Filename, desc.Metadata
+	}
+	return &out
+}
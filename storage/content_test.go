@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentManifestEncryptAtRest(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncryptAtRest: true, EncKey: crypto.NewEncryptionKey()})
+	_, err := s.Write("id", "key", strings.NewReader("secret"))
+	require.NoError(t, err)
+
+	meta, ok := s.index.get("id", "key")
+	require.True(t, ok)
+	sum := sha256.Sum256([]byte("secret"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), meta.Content.Checksum) // Of the plaintext
+	assert.Equal(t, "aes-256-ctr", meta.Content.Encryption)
+}
@@ -0,0 +1,17 @@
+// Package storage is the local storage of a node: a Store keeps objects in
+// files below a storage root, each under the key it was written with and the
+// namespace (the ID of the node owning it) it belongs to, along with a
+// metadata index recording their sizes, checksums, tags, retention and ACLs.
+//
+// Writes are atomic and logged to the write-ahead log of the index before
+// they are made, so a crash leaves either version of an object behind and
+// the index agreeing with the disk once the store is opened again. Objects
+// can be laid out by their key or by its hash with a CASLayout, packed into
+// larger files when small, encrypted at rest, and made immutable for a
+// while. Fsck checks a storage root against its index, Snapshot and Export
+// copy it while the store keeps serving, and MigrateLayout, Rehash and
+// Repack reorganize it.
+//
+// Package dfs runs a Store for every node; open one with NewStore on its own
+// to inspect or repair a storage root while no node uses it.
+package storage
@@ -0,0 +1,17 @@
+package storage
+
+import "errors"
+
+// Errors returned by Store besides those of the file system, so callers can
+// tell failures apart with errors.Is. Package dfs returns the same errors,
+// under the same names, for the files of a node.
+var (
+	// ErrChecksumMismatch is returned for objects that don't match the
+	// checksum they were written with, or can't have been written at all,
+	// such as objects too short to hold the IV they are encrypted with at rest.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrPermissionDenied is returned for writes and deletes the store
+	// refuses. It is wrapped by the errors telling why, such as ErrImmutable.
+	ErrPermissionDenied = errors.New("permission denied")
+)
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	exportHeaderName = "export.json" // First entry of an archive, describing it
+	exportFormat     = 1             // Version of the archive layout
+
+	// PAX records carrying the metadata of every object in an archive.
+	paxObjectID      = "DFS.id"
+	paxObjectKey     = "DFS.key"
+	paxObjectTags    = "DFS.tags"
+	paxObjectContent = "DFS.content"
+)
+
+// ArchiveInfo describes an archive written by Export or read by Import.
+type ArchiveInfo struct {
+	Format    int       `json:"format"`          // Version of the archive layout
+	Node      string    `json:"node"`            // ID of the server the archive was exported from
+	CreatedAt time.Time `json:"created_at"`      // When the export started
+	Since     time.Time `json:"since,omitempty"` // Objects written before this are left out, zero for a full export
+	Objects   int       `json:"-"`               // Number of objects exported or imported
+	Bytes     int64     `json:"-"`               // Total size of the objects exported or imported
+}
+
+// Export writes every object last written at since or later and its
+// metadata to w as a tar archive, exported from node, and describes the
+// archive written. The store keeps serving reads and writes meanwhile.
+func (s *Store) Export(w io.Writer, node string, since time.Time) (ArchiveInfo, error) {
+	info := ArchiveInfo{Format: exportFormat, Node: node, CreatedAt: time.Now().UTC(), Since: since}
+	return info, s.writeArchive(w, &info)
+}
+
+// writeArchive writes the archive described by info to w, counting the
+// objects written into it.
+func (s *Store) writeArchive(w io.Writer, info *ArchiveInfo) error {
+	tw := tar.NewWriter(w)
+
+	header, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: exportHeaderName, Mode: 0o644, Size: int64(len(header)), ModTime: info.CreatedAt}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(header); err != nil {
+		return err
+	}
+
+	// Copy-on-write view of the index, writers keep going
+	entries := s.index.snapshot()
+	metas := make([]ObjectMeta, 0, len(entries))
+	for _, meta := range entries {
+		if meta.ModTime.Before(info.Since) {
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].ID != metas[j].ID {
+			return metas[i].ID < metas[j].ID
+		}
+		return metas[i].Key < metas[j].Key
+	})
+
+	for _, meta := range metas {
+		n, err := s.exportObject(tw, meta)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted since the index was read
+		}
+		if err != nil {
+			return fmt.Errorf("exporting (%s) failed: %w", meta.Key, err)
+		}
+		info.Objects++
+		info.Bytes += n
+	}
+
+	return tw.Close()
+}
+
+// exportObject writes a single object to tw.
+func (s *Store) exportObject(tw *tar.Writer, meta ObjectMeta) (int64, error) {
+	// Sizes come from the open file, the object may have been replaced since
+	size, r, err := s.readStream(meta.ID, meta.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	hdr := &tar.Header{
+		Name:    "objects/" + meta.ID + "/" + hex.EncodeToString([]byte(meta.Key)),
+		Mode:    0o644,
+		Size:    size,
+		ModTime: meta.ModTime,
+		Format:  tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxObjectID:  meta.ID,
+			paxObjectKey: meta.Key,
+		},
+	}
+	if len(meta.Tags) > 0 {
+		tags, err := json.Marshal(meta.Tags)
+		if err != nil {
+			return 0, err
+		}
+		hdr.PAXRecords[paxObjectTags] = string(tags)
+	}
+	if meta.Content != nil {
+		content, err := json.Marshal(meta.Content)
+		if err != nil {
+			return 0, err
+		}
+		hdr.PAXRecords[paxObjectContent] = string(content)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(tw, r)
+}
+
+// Import writes the objects of an archive read from r to the store.
+func (s *Store) Import(r io.Reader) (ArchiveInfo, error) {
+	var info ArchiveInfo
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return info, fmt.Errorf("reading the archive header failed: %w", err)
+	}
+	if hdr.Name != exportHeaderName {
+		return info, fmt.Errorf("not an export archive: starts with %q", hdr.Name)
+	}
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&info); err != nil {
+		return info, fmt.Errorf("reading the archive header failed: %w", err)
+	}
+	if info.Format != exportFormat {
+		return info, fmt.Errorf("unsupported archive format %d", info.Format)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return info, nil
+		}
+		if err != nil {
+			return info, err
+		}
+
+		id, key := hdr.PAXRecords[paxObjectID], hdr.PAXRecords[paxObjectKey]
+		if len(id) == 0 || len(key) == 0 {
+			return info, fmt.Errorf("archive entry %q isn't an object", hdr.Name)
+		}
+		var tags map[string]string
+		if raw, ok := hdr.PAXRecords[paxObjectTags]; ok {
+			if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+				return info, fmt.Errorf("reading the tags of (%s) failed: %w", key, err)
+			}
+		}
+		var content *ContentManifest
+		if raw, ok := hdr.PAXRecords[paxObjectContent]; ok {
+			if err := json.Unmarshal([]byte(raw), &content); err != nil {
+				return info, fmt.Errorf("reading the manifest of (%s) failed: %w", key, err)
+			}
+		}
+
+		n, err := s.Write(id, key, tr)
+		if err == nil && n != hdr.Size {
+			s.Delete(id, key) // Don't keep a truncated object
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return info, fmt.Errorf("importing (%s) failed: %w", key, err)
+		}
+
+		s.blobLock.Lock()
+		err = s.index.update(id, key, func(meta *ObjectMeta) {
+			meta.ModTime = hdr.ModTime
+			meta.Tags = tags
+			meta.Content = meta.Content.DescribedAs(content)
+		})
+		s.blobLock.Unlock()
+		if err != nil {
+			return info, err
+		}
+
+		info.Objects++
+		info.Bytes += n
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FsckReport is what Store.Fsck found. Objects are named "id/key", files and
+// directories by their path relative to the storage root.
+type FsckReport struct {
+	Objects   int      `json:"objects"`             // Objects found on disk
+	Missing   []string `json:"missing,omitempty"`   // Objects in the index whose file is gone
+	Unindexed []string `json:"unindexed,omitempty"` // Files the index has no entry for
+	Reindexed []string `json:"reindexed,omitempty"` // Unindexed files whose key the layout gives away, indexed again on repair
+	Corrupt   []string `json:"corrupt,omitempty"`   // Objects failing checksum verification
+	Orphans   []string `json:"orphans,omitempty"`   // Directories holding no object, left by partial writes
+}
+
+// OK reports whether Fsck found nothing wrong.
+func (r FsckReport) OK() bool {
+	return len(r.Missing)+len(r.Unindexed)+len(r.Corrupt)+len(r.Orphans) == 0
+}
+
+// Fsck scans the storage root and checks it against the index: every object
+// is read back and verified against its checksum, indexed objects whose file
+// is gone and files the index doesn't know of are reported, and so are the
+// directories left without objects by writes and deletes a crash interrupted.
+// Packed objects are verified in their pack.
+//
+// With repair set, the index is rebuilt from the objects on disk: missing
+// objects are dropped from it, and unindexed files are indexed again if the
+// key they were stored under can be told from their path, as it can in
+// stores that aren't content-addressed. Orphaned directories are removed.
+// Corrupt objects are only reported; they are left for replication to heal.
+// Writes wait while the store is checked.
+func (s *Store) Fsck(repair bool) (FsckReport, error) {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	var report FsckReport
+	entries := s.index.snapshot()
+	indexed := make(map[string]indexKey, len(entries)) // By path relative to the storage root
+	for k, meta := range entries {
+		if meta.Pack != nil {
+			continue // Checked in their pack below
+		}
+		indexed[path.Join(k.id, filepath.ToSlash(s.PathTransformFunc(k.key).FullPath()))] = k
+	}
+	found := make(map[indexKey]bool)
+	var reindexed []ObjectMeta
+
+	namespaces, err := os.ReadDir(s.Root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	for _, ns := range namespaces {
+		if !ns.IsDir() || ns.Name() == packDirName {
+			continue // The index, the packs and other state of the store
+		}
+		id := ns.Name()
+		nsRoot := filepath.Join(s.Root, id)
+		used := make(map[string]bool) // Directories holding an object
+		var dirs []string
+
+		err := filepath.WalkDir(nsRoot, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(nsRoot, p)
+			if d.IsDir() {
+				if p != nsRoot {
+					dirs = append(dirs, rel)
+				}
+				return nil
+			}
+			if strings.HasSuffix(d.Name(), ".tmp") {
+				return nil // Removed when the store is opened
+			}
+			for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+				used[dir] = true
+			}
+
+			report.Objects++
+			name := path.Join(id, filepath.ToSlash(rel))
+			if k, ok := indexed[name]; ok {
+				found[k] = true
+				if !s.verify(k.id, k.key, entries[k]) {
+					log.Printf("fsck: (%s/%s) fails checksum verification", k.id, k.key)
+					report.Corrupt = append(report.Corrupt, k.id+"/"+k.key)
+				}
+				return nil
+			}
+
+			log.Printf("fsck: (%s) is not in the index", name)
+			report.Unindexed = append(report.Unindexed, name)
+			if key, ok := s.keyOf(id, rel); ok {
+				meta, err := s.metaOf(id, key, p)
+				if err != nil {
+					return err
+				}
+				report.Reindexed = append(report.Reindexed, id+"/"+key)
+				reindexed = append(reindexed, meta)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+
+		for _, dir := range dirs {
+			if !used[dir] {
+				report.Orphans = append(report.Orphans, path.Join(id, filepath.ToSlash(dir)))
+			}
+		}
+	}
+
+	for k, meta := range entries {
+		if meta.Pack == nil || !s.packHolds(*meta.Pack) {
+			continue
+		}
+		report.Objects++
+		found[k] = true
+		if !s.verify(k.id, k.key, meta) {
+			log.Printf("fsck: (%s/%s) fails checksum verification", k.id, k.key)
+			report.Corrupt = append(report.Corrupt, k.id+"/"+k.key)
+		}
+	}
+
+	var missing []indexKey
+	for k := range entries {
+		if !found[k] {
+			log.Printf("fsck: (%s/%s) is indexed but not on disk", k.id, k.key)
+			report.Missing = append(report.Missing, k.id+"/"+k.key)
+			missing = append(missing, k)
+		}
+	}
+	for _, list := range [][]string{report.Missing, report.Unindexed, report.Reindexed, report.Corrupt, report.Orphans} {
+		sort.Strings(list)
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	// Deepest directories first, so their parents are empty by the time they are removed
+	for i := len(report.Orphans) - 1; i >= 0; i-- {
+		if err := os.Remove(filepath.Join(s.Root, filepath.FromSlash(report.Orphans[i]))); err != nil {
+			return report, err
+		}
+	}
+
+	ix := s.index
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.detach()
+	for _, k := range missing {
+		ix.apply(walRecord{Op: walRemove, Meta: ObjectMeta{ID: k.id, Key: k.key}})
+	}
+	for _, meta := range reindexed {
+		ix.apply(walRecord{Op: walPut, Meta: meta})
+	}
+	return report, ix.save()
+}
+
+// keyOf returns the key the object at rel, relative to the directory of
+// namespace id, is stored under, if the path transform gives it away: the
+// path is the key twice over for DefaultPathTransformFunc, or its file name
+// is the key.
+func (s *Store) keyOf(id string, rel string) (string, bool) {
+	rel = filepath.ToSlash(rel)
+	candidates := []string{path.Base(rel)}
+	if half := len(rel) / 2; len(rel)%2 == 1 && rel[half] == '/' && rel[:half] == rel[half+1:] {
+		candidates = append(candidates, rel[:half])
+	}
+	for _, key := range candidates {
+		pathKey, err := s.pathKey(id, key)
+		if err == nil && filepath.ToSlash(pathKey.FullPath()) == rel {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// verify reports whether the object stored under key reads back as meta
+// describes it. Objects without a checksum only need to be readable.
+func (s *Store) verify(id string, key string, meta ObjectMeta) bool {
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil || n != meta.Size {
+		return false
+	}
+	return meta.Content == nil || len(meta.Content.Checksum) == 0 || hex.EncodeToString(h.Sum(nil)) == meta.Content.Checksum
+}
+
+// metaOf returns the metadata of the unindexed object stored under key in
+// the file at p, as commit would have recorded it.
+func (s *Store) metaOf(id string, key string, p string) (ObjectMeta, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	return ObjectMeta{
+		ID:       id,
+		Key:      key,
+		Size:     n,
+		DiskSize: fi.Size(),
+		ModTime:  fi.ModTime(),
+		Content: &ContentManifest{
+			Checksum:   hex.EncodeToString(h.Sum(nil)),
+			Encryption: s.atRestCipher(),
+		},
+	}, nil
+}
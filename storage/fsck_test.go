@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), NoSync: true})
+	for _, key := range []string{"good", "corrupt", "missing", "unindexed"} {
+		_, err := s.Write("id", key, bytes.NewReader([]byte("contents of "+key)))
+		require.NoError(t, err)
+	}
+	report, err := s.Fsck(false)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, report.Objects)
+
+	path := func(key string) string {
+		return filepath.Join(s.Root, "id", s.PathTransformFunc(key).FullPath())
+	}
+	require.NoError(t, os.WriteFile(path("corrupt"), []byte("contents of CORRUPT"), 0o644))
+	require.NoError(t, os.Remove(path("missing")))
+	require.NoError(t, s.index.remove("id", "unindexed", nil))
+	require.NoError(t, os.MkdirAll(filepath.Join(s.Root, "id", "partial", "write"), os.ModePerm))
+
+	report, err = s.Fsck(false)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, FsckReport{
+		Objects:   3,
+		Missing:   []string{"id/missing"},
+		Unindexed: []string{"id/unindexed/unindexed"},
+		Reindexed: []string{"id/unindexed"},
+		Corrupt:   []string{"id/corrupt"},
+		Orphans:   []string{"id/missing", "id/partial", "id/partial/write"},
+	}, report)
+	_, ok := s.index.get("id", "missing")
+	assert.True(t, ok, "nothing is repaired without repair")
+
+	// Repairing rebuilds the index from the objects on disk.
+	_, err = s.Fsck(true)
+	require.NoError(t, err)
+	reopened := NewStore(s.StoreOpts)
+	_, ok = reopened.index.get("id", "missing")
+	assert.False(t, ok)
+	meta, ok := reopened.index.get("id", "unindexed")
+	require.True(t, ok)
+	assert.Equal(t, int64(len("contents of unindexed")), meta.Size)
+	assert.NoDirExists(t, filepath.Join(s.Root, "id", "partial"))
+
+	report, err = reopened.Fsck(false)
+	require.NoError(t, err)
+	assert.Equal(t, FsckReport{Objects: 3, Corrupt: []string{"id/corrupt"}}, report, "corrupt objects are left alone")
+}
+
+func TestFsckContentAddressed(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), Hasher: crypto.SHA256Hasher, NoSync: true})
+	_, err := s.Write("id", "key", bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+	require.NoError(t, s.index.remove("id", "key", nil))
+
+	// The key of content-addressed objects can't be told from their path.
+	report, err := s.Fsck(true)
+	require.NoError(t, err)
+	assert.Len(t, report.Unindexed, 1)
+	assert.Empty(t, report.Reindexed)
+	assert.Empty(t, report.Orphans)
+	assert.True(t, s.Has("id", "key"), "unindexed objects are kept")
+}
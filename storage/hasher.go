@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// NewCASPathTransformFunc returns a content-addressable path transformation
+// using h: the hex digest of the key, split into directories of 5 characters.
+// NewCASLayoutPathTransformFunc lays objects out differently.
+func NewCASPathTransformFunc(h crypto.Hasher) PathTransformFunc {
+	return NewCASLayoutPathTransformFunc(h, DefaultCASLayout)
+}
+
+// Rehash moves every object in the store to the path to assigns it, and
+// switches the store over to to. Use it to migrate an existing storage root
+// to a different hasher:
+//
+//	store.Rehash(NewCASPathTransformFunc(SHA256Hasher))
+//
+// Only objects recorded in the metadata index can be moved, as paths can't be
+// turned back into keys. Replicas stay under the key hash their owner sent, so
+// they keep being found by owners that hash keys the old way; owners switching
+// hashers should store their files again. It returns the number of objects moved.
+// The store must not be used by anyone else while it is being rehashed.
+func (s *Store) Rehash(to PathTransformFunc) (int, error) {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	moved := 0
+	for _, meta := range s.index.snapshot() {
+		if meta.Pack != nil {
+			continue // Packs aren't laid out by key
+		}
+		from := s.PathTransformFunc(meta.Key)
+		dest := to(meta.Key)
+		if err := dest.validate(); err != nil {
+			return moved, err
+		}
+		if from.FullPath() == dest.FullPath() {
+			continue
+		}
+
+		src := filepath.Join(s.Root, meta.ID, from.FullPath())
+		dst := filepath.Join(s.Root, meta.ID, dest.FullPath())
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // Indexed but gone from disk, nothing to move
+			}
+			return moved, err
+		}
+		removeEmptyDirs(filepath.Dir(src), filepath.Join(s.Root, meta.ID))
+		moved++
+	}
+
+	s.PathTransformFunc = to
+	return moved, nil
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including, stop
+// for as long as they are empty.
+func removeEmptyDirs(dir string, stop string) {
+	for dir != stop && len(dir) > len(stop) {
+		if err := os.Remove(dir); err != nil {
+			return // Not empty, or gone already
+		}
+		dir = filepath.Dir(dir)
+	}
+}
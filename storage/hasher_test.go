@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCASPathTransformFunc(t *testing.T) {
+	// The SHA-1 transform is the one CASPathTransformFunc always used.
+	assert.Equal(t, CASPathTransformFunc("momsbestpicture"), NewCASPathTransformFunc(crypto.SHA1Hasher)("momsbestpicture"))
+
+	pathKey := NewCASPathTransformFunc(crypto.SHA256Hasher)("momsbestpicture")
+	assert.Len(t, pathKey.Filename, 64)
+	assert.Nil(t, pathKey.validate())
+}
+
+func TestStoreRehash(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), Hasher: crypto.SHA1Hasher})
+	id := crypto.GenerateID()
+
+	for i := 0; i < 10; i++ {
+		_, err := s.Write(id, fmt.Sprintf("foo_%d", i), bytes.NewReader([]byte("some data")))
+		assert.Nil(t, err)
+	}
+
+	moved, err := s.Rehash(NewCASPathTransformFunc(crypto.BLAKE3Hasher))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, moved)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		_, r, err := s.Read(id, key)
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "some data", string(b))
+
+		// The old layout is gone.
+		_, err = os.Stat(filepath.Join(s.Root, id, CASPathTransformFunc(key).FirstPathName()))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Reopening the store with the new hasher finds everything.
+	reopened := NewStore(StoreOpts{Root: s.Root, Hasher: crypto.BLAKE3Hasher})
+	assert.True(t, reopened.Has(id, "foo_0"))
+}
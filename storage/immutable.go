@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrImmutable is returned for writes to keys already stored in a write-once
+// namespace, and for deletes of objects whose retention hasn't expired yet,
+// see StoreOpts.Immutable, as well as for writes and deletes of objects kept
+// by a Retention. It wraps ErrPermissionDenied.
+var ErrImmutable = fmt.Errorf("%w: object is immutable", ErrPermissionDenied)
+
+// CheckWrite returns ErrImmutable if key is stored already in namespace id
+// and the namespace is write-once, or its object is retained.
+func (s *Store) CheckWrite(id string, key string) error {
+	meta, ok := s.index.get(id, key)
+	if !ok {
+		return nil
+	}
+	if _, immutable := s.Immutable[id]; immutable {
+		return fmt.Errorf("%w: (%s) is stored already", ErrImmutable, key)
+	}
+	if meta.Retention.Retains(time.Now()) {
+		return meta.Retention.retainedErr(key)
+	}
+	return nil
+}
+
+// CheckDelete returns ErrImmutable if the object stored under key is
+// retained at now, by its own retention or that of its write-once
+// namespace id.
+func (s *Store) CheckDelete(id string, key string, now time.Time) error {
+	meta, ok := s.index.get(id, key)
+	if !ok {
+		return nil
+	}
+	if meta.Retention.Retains(now) {
+		return meta.Retention.retainedErr(key)
+	}
+	retention, ok := s.Immutable[id]
+	if !ok {
+		return nil
+	}
+	if retention == 0 {
+		return fmt.Errorf("%w: (%s) is retained forever", ErrImmutable, key)
+	}
+	if until := meta.ModTime.Add(retention); now.Before(until) {
+		return fmt.Errorf("%w: (%s) is retained until %s", ErrImmutable, key, until.Format(time.RFC3339))
+	}
+	return nil
+}
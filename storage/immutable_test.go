@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutable(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), NoSync: true, Immutable: map[string]time.Duration{"locked": 0, "retained": time.Hour}})
+	for _, id := range []string{"locked", "retained", "mutable"} {
+		_, err := s.Write(id, "key", bytes.NewReader([]byte("first")))
+		require.NoError(t, err)
+	}
+
+	// Keys of immutable namespaces are written once,
+	_, err := s.Write("locked", "key", bytes.NewReader([]byte("second")))
+	assert.ErrorIs(t, err, ErrImmutable)
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	_, r, err := s.Read("locked", "key")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "first", string(b))
+	_, err = s.Write("mutable", "key", bytes.NewReader([]byte("second")))
+	assert.NoError(t, err)
+
+	// and deleted once their retention expires.
+	assert.ErrorIs(t, s.Delete("locked", "key"), ErrImmutable)
+	assert.ErrorIs(t, s.Delete("retained", "key"), ErrImmutable)
+	assert.True(t, s.Has("retained", "key"))
+	require.NoError(t, s.index.update("retained", "key", func(meta *ObjectMeta) {
+		meta.ModTime = meta.ModTime.Add(-2 * time.Hour)
+	}))
+	require.NoError(t, s.Delete("retained", "key"))
+	_, err = s.Write("retained", "key", bytes.NewReader([]byte("second")))
+	assert.NoError(t, err, "deleted keys may be written again")
+	assert.NoError(t, s.Delete("mutable", "key"))
+}
@@ -0,0 +1,450 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"iter"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexFileName is the name of the metadata index file inside the storage root.
+const indexFileName = "index.json"
+
+// ObjectMeta describes a single object held by a Store.
+type ObjectMeta struct {
+	ID      string    `json:"id"`       // Namespace (server ID) the object belongs to
+	Key     string    `json:"key"`      // Key the object was written under
+	Size    int64     `json:"size"`     // Size of the object in bytes, as read
+	ModTime time.Time `json:"mod_time"` // Time the object was last written
+
+	// DiskSize is how many bytes the file holding the object takes up, at
+	// rest encryption included. Objects written by older versions have none,
+	// Size stands in for it.
+	DiskSize int64 `json:"disk_size,omitempty"`
+
+	// LastAccess is when the object was last read, zero if never, and
+	// Accesses how often it was read, rewrites included. Reads are recorded
+	// in memory and persisted when the index is next compacted.
+	LastAccess time.Time `json:"last_access,omitempty"`
+	Accesses   int64     `json:"accesses,omitempty"`
+
+	Tags    map[string]string `json:"tags,omitempty"`    // User defined tags, kept when the object is rewritten
+	Content *ContentManifest  `json:"content,omitempty"` // What the object holds, nil for objects written by older versions
+
+	Retention *Retention `json:"retention,omitempty"` // Keeps the object from being deleted or overwritten, nil if nothing does
+
+	Tenant string `json:"tenant,omitempty"` // Tenant the object counts against the quotas of, kept when the object is rewritten
+	ACL    ACL    `json:"acl,omitempty"`    // Who may do what with the object, kept when the object is rewritten; nil if its prefixes decide
+
+	Pack *PackLocation `json:"pack,omitempty"` // Where the object is in its pack, nil for objects in a file of their own
+}
+
+// indexKey identifies an object within the index.
+type indexKey struct {
+	id  string
+	key string
+}
+
+// metaIndex is the metadata index of a Store, persisted as JSON next to the objects.
+// Changes are appended to a write-ahead log before they are made, see wal.go,
+// and folded into the JSON file when the index is compacted.
+//
+// The entries map is copy-on-write: snapshot hands out the current map and marks
+// it shared, and the next mutation copies it before changing anything. Taking a
+// snapshot is therefore O(1) and never blocks writers for long.
+type metaIndex struct {
+	path string // File the index is persisted to
+	sync bool   // Whether to fsync the index when persisting it
+
+	mu      sync.Mutex
+	entries map[indexKey]ObjectMeta
+	usage   map[string]Usage // Totals of the entries by namespace, kept up to date with every change
+	tenants map[string]Usage // Totals of the entries by tenant, likewise
+	shared  bool             // entries is referenced by a snapshot and must not be mutated
+	err     error            // Why the index last failed to load or persist, nil once it persists again
+
+	logged   int                    // Records in the write-ahead log, folded into the file by the next compaction
+	dirty    bool                   // Whether reads were recorded since the last compaction
+	replayed map[indexKey]walRecord // Last record of every key replayed from the log, for Store.recoverIndex
+}
+
+// loadIndex reads the index persisted at path. A missing file yields an empty index.
+func loadIndex(path string) (*metaIndex, error) {
+	ix := &metaIndex{
+		path:    path,
+		entries: make(map[indexKey]ObjectMeta),
+		usage:   make(map[string]Usage),
+		tenants: make(map[string]Usage),
+	}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ix, ix.replay() // Changes made before the first compaction
+	}
+	if err != nil {
+		return ix, err
+	}
+
+	var metas []ObjectMeta
+	if err := json.Unmarshal(buf, &metas); err != nil {
+		return ix, err
+	}
+	for _, meta := range metas {
+		ix.entries[indexKey{meta.ID, meta.Key}] = meta
+		ix.account(meta, 1)
+	}
+
+	return ix, ix.replay()
+}
+
+// get returns the metadata of a single object.
+func (ix *metaIndex) get(id string, key string) (ObjectMeta, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	meta, ok := ix.entries[indexKey{id, key}]
+	return meta, ok
+}
+
+// put adds or replaces the metadata of an object. The change is logged
+// before move, if not nil, moves the object into place, and is undone if
+// moving it fails.
+func (ix *metaIndex) put(meta ObjectMeta, move func() error) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	rec, undo := walRecord{Op: walPut, Meta: meta}, walRecord{Op: walRemove, Meta: meta}
+	prev, ok := ix.entries[indexKey{meta.ID, meta.Key}]
+	if ok {
+		rec.Prev = &prev
+		undo = walRecord{Op: walPut, Meta: prev}
+	}
+	if err := ix.log(rec); err != nil {
+		return err
+	}
+	if move != nil {
+		if err := move(); err != nil {
+			ix.log(undo)
+			return err
+		}
+	}
+
+	ix.detach()
+	if ok {
+		ix.account(prev, -1)
+	}
+	ix.entries[indexKey{meta.ID, meta.Key}] = meta
+	ix.account(meta, 1)
+
+	return ix.compactIfDue()
+}
+
+// update changes the metadata of an existing object with fn and logs the
+// change. It returns os.ErrNotExist if the object isn't in the index.
+func (ix *metaIndex) update(id string, key string, fn func(*ObjectMeta)) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	prev, ok := ix.entries[indexKey{id, key}]
+	if !ok {
+		return os.ErrNotExist
+	}
+	meta := prev
+	fn(&meta)
+	if err := ix.log(walRecord{Op: walPut, Meta: meta, Prev: &prev}); err != nil {
+		return err
+	}
+	ix.detach()
+	ix.account(prev, -1)
+	ix.entries[indexKey{id, key}] = meta
+	ix.account(meta, 1)
+
+	return ix.compactIfDue()
+}
+
+// touch records that an object was read at t without persisting the index,
+// which would cost a write per read.
+func (ix *metaIndex) touch(id string, key string, t time.Time) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	meta, ok := ix.entries[indexKey{id, key}]
+	if !ok {
+		return
+	}
+	ix.detach()
+	meta.Accesses++
+	if t.After(meta.LastAccess) {
+		meta.LastAccess = t
+	}
+	ix.entries[indexKey{id, key}] = meta
+	ix.dirty = true
+}
+
+// remove drops an object from the index. The change is logged before del,
+// if not nil, deletes the object, and is undone if deleting it fails. Objects
+// the index doesn't know of are deleted all the same.
+func (ix *metaIndex) remove(id string, key string, del func() error) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	meta, ok := ix.entries[indexKey{id, key}]
+	if !ok {
+		if del != nil {
+			return del()
+		}
+		return nil
+	}
+	if err := ix.log(walRecord{Op: walRemove, Meta: meta}); err != nil {
+		return err
+	}
+	if del != nil {
+		if err := del(); err != nil {
+			ix.log(walRecord{Op: walPut, Meta: meta})
+			return err
+		}
+	}
+	ix.detach()
+	delete(ix.entries, indexKey{id, key})
+	ix.account(meta, -1)
+
+	return ix.compactIfDue()
+}
+
+// reset drops every entry from the index.
+func (ix *metaIndex) reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.entries = make(map[indexKey]ObjectMeta)
+	ix.usage = make(map[string]Usage)
+	ix.tenants = make(map[string]Usage)
+	ix.shared = false
+	ix.logged, ix.dirty = 0, false
+}
+
+// account adds meta to the usage of its namespace and tenant, or takes it
+// away if sign is -1. The caller must hold ix.mu.
+func (ix *metaIndex) account(meta ObjectMeta, sign int64) {
+	accountIn(ix.usage, meta.ID, meta, sign)
+	if len(meta.Tenant) > 0 {
+		accountIn(ix.tenants, meta.Tenant, meta, sign)
+	}
+}
+
+// accountIn adds meta to the usage under name in totals, or takes it away
+// if sign is -1.
+func accountIn(totals map[string]Usage, name string, meta ObjectMeta, sign int64) {
+	u := totals[name]
+	u.Objects += sign
+	u.LogicalBytes += sign * meta.Size
+	u.PhysicalBytes += sign * meta.diskSize()
+	if u.Objects == 0 {
+		delete(totals, name)
+		return
+	}
+	totals[name] = u
+}
+
+// usageOf returns the usage of namespace id.
+func (ix *metaIndex) usageOf(id string) Usage {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	return ix.usage[id]
+}
+
+// usageOfTenant returns the usage of the objects of tenant.
+func (ix *metaIndex) usageOfTenant(tenant string) Usage {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	return ix.tenants[tenant]
+}
+
+// usageByTenant returns the usage of every tenant holding objects.
+func (ix *metaIndex) usageByTenant() map[string]Usage {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	out := make(map[string]Usage, len(ix.tenants))
+	for tenant, u := range ix.tenants {
+		out[tenant] = u
+	}
+	return out
+}
+
+// usageByNamespace returns the usage of every namespace holding objects.
+func (ix *metaIndex) usageByNamespace() map[string]Usage {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	out := make(map[string]Usage, len(ix.usage))
+	for id, u := range ix.usage {
+		out[id] = u
+	}
+	return out
+}
+
+// snapshot returns a consistent, read-only view of the index.
+func (ix *metaIndex) snapshot() map[indexKey]ObjectMeta {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.shared = true
+	return ix.entries
+}
+
+// detach copies the entries map if a snapshot still references it. The caller must hold ix.mu.
+func (ix *metaIndex) detach() {
+	if !ix.shared {
+		return
+	}
+
+	entries := make(map[indexKey]ObjectMeta, len(ix.entries))
+	for k, v := range ix.entries {
+		entries[k] = v
+	}
+	ix.entries = entries
+	ix.shared = false
+}
+
+// save persists the whole index and drops the write-ahead log it now holds
+// every change of. The caller must hold ix.mu.
+func (ix *metaIndex) save() error {
+	ix.err = writeIndexFile(ix.path, ix.entries, ix.sync)
+	if ix.err == nil {
+		ix.err = removeWAL(walPath(ix.path))
+	}
+	if ix.err == nil {
+		ix.logged, ix.dirty = 0, false
+	}
+	return ix.err
+}
+
+// health returns why the index last failed to load or persist, nil if it didn't.
+func (ix *metaIndex) health() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	return ix.err
+}
+
+// Meta returns the metadata the index holds of an object.
+func (s *Store) Meta(id string, key string) (ObjectMeta, bool) {
+	return s.index.get(id, key)
+}
+
+// UpdateMeta changes the metadata of an object with fn and persists the
+// change. It returns os.ErrNotExist if the index doesn't hold the object.
+func (s *Store) UpdateMeta(id string, key string, fn func(*ObjectMeta)) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	return s.index.update(id, key, fn)
+}
+
+// Touch records that an object was read at t. Reads are persisted along
+// with the next change of the index, or when it is compacted.
+func (s *Store) Touch(id string, key string, t time.Time) {
+	s.index.touch(id, key, t)
+}
+
+// Objects returns the metadata of every object the store holds, in no
+// particular order. It iterates over a snapshot of the index, so writers
+// aren't held up meanwhile.
+func (s *Store) Objects() iter.Seq[ObjectMeta] {
+	entries := s.index.snapshot()
+	return func(yield func(ObjectMeta) bool) {
+		for _, meta := range entries {
+			if !yield(meta) {
+				return
+			}
+		}
+	}
+}
+
+// Len returns the number of objects the store holds.
+func (s *Store) Len() int {
+	return len(s.index.snapshot())
+}
+
+// UsageByNamespace returns the usage of every namespace holding objects.
+func (s *Store) UsageByNamespace() map[string]Usage {
+	return s.index.usageByNamespace()
+}
+
+// UsageOfTenant returns the usage of the objects of tenant.
+func (s *Store) UsageOfTenant(tenant string) Usage {
+	return s.index.usageOfTenant(tenant)
+}
+
+// UsageByTenant returns the usage of every tenant holding objects.
+func (s *Store) UsageByTenant() map[string]Usage {
+	return s.index.usageByTenant()
+}
+
+// Health returns why the metadata index last failed to load or persist, nil
+// if it didn't.
+func (s *Store) Health() error {
+	return s.index.health()
+}
+
+// CompactIndex persists the whole metadata index and drops its write-ahead
+// log, if it changed since it was last compacted.
+func (s *Store) CompactIndex() error {
+	return s.index.compact()
+}
+
+// writeIndexFile atomically writes entries as a JSON index file at path,
+// fsyncing the file and its directory if durable is set.
+func writeIndexFile(path string, entries map[indexKey]ObjectMeta, durable bool) error {
+	metas := make([]ObjectMeta, 0, len(entries))
+	for _, meta := range entries {
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].ID != metas[j].ID {
+			return metas[i].ID < metas[j].ID
+		}
+		return metas[i].Key < metas[j].Key
+	})
+
+	buf, err := json.Marshal(metas)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// layoutFileName is the name of the file the layout of a content-addressed
+// store is recorded in once migrated, inside the storage root.
+const layoutFileName = "layout.json"
+
+// CASLayout is how a content-addressable store spreads objects over
+// directories: the hex digest of the key is split into Depth directories of
+// BlockSize characters each, and the object is named after the whole digest.
+type CASLayout struct {
+	BlockSize int `json:"block_size"` // Characters of the digest per directory, 5 if zero
+	Depth     int `json:"depth"`      // Levels of directories, as many as the digest fills if zero
+}
+
+var (
+	// DefaultCASLayout is the layout stores always used: directories of 5
+	// characters, 8 levels deep for SHA-1 and 12 for SHA-256 and BLAKE3.
+	DefaultCASLayout = CASLayout{BlockSize: 5}
+	// FanOutCASLayout is a flat layout of two levels of 256 directories,
+	// for filesystems that slow down with deep directory trees. It keeps
+	// directories below a few hundred objects up to tens of millions of them.
+	FanOutCASLayout = CASLayout{BlockSize: 2, Depth: 2}
+)
+
+// normalize returns the layout with defaults filled in and the depth bounded
+// by what a digest of digestLen characters fills.
+func (l CASLayout) normalize(digestLen int) CASLayout {
+	if l.BlockSize <= 0 {
+		l.BlockSize = DefaultCASLayout.BlockSize
+	}
+	if levels := digestLen / l.BlockSize; l.Depth <= 0 || l.Depth > levels {
+		l.Depth = levels
+	}
+	return l
+}
+
+// NewCASLayoutPathTransformFunc returns a content-addressable path
+// transformation using h, spreading objects over directories as l says.
+func NewCASLayoutPathTransformFunc(h crypto.Hasher, l CASLayout) PathTransformFunc {
+	return func(key string) PathKey {
+		hashStr := h.Sum([]byte(key))
+		l := l.normalize(len(hashStr))
+
+		paths := make([]string, l.Depth)
+		for i := range paths {
+			paths[i] = hashStr[i*l.BlockSize : (i+1)*l.BlockSize]
+		}
+
+		return PathKey{
+			PathName: filepath.Join(paths...),
+			Filename: hashStr,
+		}
+	}
+}
+
+// Relayout moves every object in the content-addressed store to where layout
+// l puts it, like Rehash does, and records l in the storage root for
+// MigrateLayout. It returns the number of objects moved.
+func (s *Store) Relayout(l CASLayout) (int, error) {
+	if s.Hasher.New == nil {
+		return 0, errors.New("only content-addressed stores have a layout")
+	}
+
+	moved, err := s.Rehash(NewCASLayoutPathTransformFunc(s.Hasher, l))
+	if err != nil {
+		return moved, err
+	}
+	s.Layout = l
+	return moved, saveLayout(s.Root, l)
+}
+
+// MigrateLayout moves the objects of the store at root, content-addressed
+// with h, from the layout recorded there to l. Roots without a recorded
+// layout are in DefaultCASLayout. Roots in l already are left alone. Nothing
+// else may use the store during the migration; run it before starting the
+// server. It returns the number of objects moved.
+func MigrateLayout(root string, h crypto.Hasher, l CASLayout) (int, error) {
+	from, err := loadLayout(root)
+	if err != nil {
+		return 0, err
+	}
+	digestLen := len(h.Sum(nil))
+	if from.normalize(digestLen) == l.normalize(digestLen) {
+		return 0, nil
+	}
+
+	s := NewStore(StoreOpts{Root: root, Hasher: h, Layout: from})
+	return s.Relayout(l)
+}
+
+// loadLayout returns the layout recorded in the storage root at root,
+// DefaultCASLayout if none is.
+func loadLayout(root string) (CASLayout, error) {
+	buf, err := os.ReadFile(filepath.Join(root, layoutFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultCASLayout, nil
+	}
+	if err != nil {
+		return CASLayout{}, err
+	}
+
+	var l CASLayout
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return CASLayout{}, fmt.Errorf("%s: %w", layoutFileName, err)
+	}
+	return l, nil
+}
+
+// saveLayout records l as the layout of the storage root at root.
+func saveLayout(root string, l CASLayout) error {
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return err
+	}
+	path := filepath.Join(root, layoutFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCASLayout(t *testing.T) {
+	digest := crypto.SHA256Hasher.Sum([]byte("momsbestpicture"))
+
+	// The default layout is the one NewCASPathTransformFunc always used.
+	pathKey := NewCASLayoutPathTransformFunc(crypto.SHA256Hasher, CASLayout{})("momsbestpicture")
+	assert.Equal(t, NewCASPathTransformFunc(crypto.SHA256Hasher)("momsbestpicture"), pathKey)
+	assert.Len(t, strings.Split(filepath.ToSlash(pathKey.PathName), "/"), 12)
+
+	pathKey = NewCASLayoutPathTransformFunc(crypto.SHA256Hasher, FanOutCASLayout)("momsbestpicture")
+	assert.Equal(t, filepath.Join(digest[:2], digest[2:4]), pathKey.PathName)
+	assert.Equal(t, digest, pathKey.Filename)
+	assert.Nil(t, pathKey.validate())
+
+	// Layouts deeper than the digest stop at its end.
+	pathKey = NewCASLayoutPathTransformFunc(crypto.SHA256Hasher, CASLayout{BlockSize: 32, Depth: 5})("momsbestpicture")
+	assert.Equal(t, filepath.Join(digest[:32], digest[32:]), pathKey.PathName)
+}
+
+func TestMigrateLayout(t *testing.T) {
+	root := t.TempDir()
+	id := crypto.GenerateID()
+	s := NewStore(StoreOpts{Root: root, Hasher: crypto.SHA256Hasher})
+	for i := 0; i < 10; i++ {
+		_, err := s.Write(id, fmt.Sprintf("foo_%d", i), bytes.NewReader([]byte("some data")))
+		require.NoError(t, err)
+	}
+
+	moved, err := MigrateLayout(root, crypto.SHA256Hasher, FanOutCASLayout)
+	require.NoError(t, err)
+	assert.Equal(t, 10, moved)
+	moved, err = MigrateLayout(root, crypto.SHA256Hasher, FanOutCASLayout)
+	require.NoError(t, err)
+	assert.Zero(t, moved, "a store in the layout already is left alone")
+
+	s = NewStore(StoreOpts{Root: root, Hasher: crypto.SHA256Hasher, Layout: FanOutCASLayout})
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		_, r, err := s.Read(id, key)
+		require.NoError(t, err)
+		b, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "some data", string(b))
+
+		// The old layout is gone.
+		_, err = os.Stat(filepath.Join(root, id, NewCASPathTransformFunc(crypto.SHA256Hasher)(key).FirstPathName()))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Objects sharing a directory survive the deletion of one another.
+	moved, err = s.Relayout(CASLayout{BlockSize: 1, Depth: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 10, moved)
+	var siblings []string
+	first := s.PathTransformFunc("foo_0").PathName
+	for i := 0; len(siblings) < 2; i++ {
+		key := fmt.Sprintf("bar_%d", i)
+		if s.PathTransformFunc(key).PathName == first {
+			_, err := s.Write(id, key, bytes.NewReader([]byte("sibling")))
+			require.NoError(t, err)
+			siblings = append(siblings, key)
+		}
+	}
+	require.NoError(t, s.Delete(id, siblings[0]))
+	assert.False(t, s.Has(id, siblings[0]))
+	assert.True(t, s.Has(id, siblings[1]))
+	assert.True(t, s.Has(id, "foo_0"))
+
+	// Back to the default layout.
+	moved, err = MigrateLayout(root, crypto.SHA256Hasher, DefaultCASLayout)
+	require.NoError(t, err)
+	assert.Equal(t, 11, moved)
+	assert.True(t, NewStore(StoreOpts{Root: root, Hasher: crypto.SHA256Hasher}).Has(id, siblings[1]))
+}
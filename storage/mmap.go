@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// errMmapUnsupported is returned by mapFile where files can't be mapped.
+var errMmapUnsupported = errors.New("memory mapping files is not supported on this platform")
+
+// mapFile maps the size bytes of f into memory, read-only. Only 64-bit
+// platforms map files, their address space being large enough for any. The
+// mapping stays valid once f is closed.
+func mapFile(f *os.File, size int64) (*mappedFile, error) {
+	if strconv.IntSize < 64 || size <= 0 || size > math.MaxInt {
+		return nil, errMmapUnsupported
+	}
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data: data}, nil
+}
+
+// mappedFile reads an object mapped into memory. Reads are copies out of
+// the mapping rather than system calls, which pays off for the many small
+// range reads of large objects. Like the file it maps, it can be read at any
+// offset and seeked. Objects are replaced by moving a new file into place,
+// never by truncating the mapped one, so the mapping stays readable.
+type mappedFile struct {
+	data []byte // Mapping, nil once closed
+	off  int64  // Offset Read continues at
+}
+
+func (m *mappedFile) ReadAt(b []byte, off int64) (int, error) {
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mappedFile) Read(b []byte) (int, error) {
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[m.off:])
+	m.off += int64(n)
+	return n, nil
+}
+
+// WriteTo writes the rest of the mapping to w in one go, sparing io.Copy the
+// buffer.
+func (m *mappedFile) WriteTo(w io.Writer) (int64, error) {
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return 0, nil
+	}
+	n, err := w.Write(m.data[m.off:])
+	m.off += int64(n)
+	return int64(n), err
+}
+
+func (m *mappedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	m.off = offset
+	return offset, nil
+}
+
+// Len returns the number of bytes left to read.
+func (m *mappedFile) Len() int {
+	return int(max(int64(len(m.data))-m.off, 0))
+}
+
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return os.ErrClosed
+	}
+	err := munmap(m.data)
+	m.data = nil
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+
+package storage
+
+import "os"
+
+// mmap is not supported on this platform, files are read as they are.
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmap is not supported on this platform.
+func munmap(b []byte) error {
+	return errMmapUnsupported
+}
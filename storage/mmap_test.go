@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapRead(t *testing.T) {
+	if runtime.GOOS != "linux" || strconv.IntSize < 64 {
+		t.Skip("files are only mapped on 64-bit linux in this test")
+	}
+	for _, atRest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("at rest %v", atRest), func(t *testing.T) {
+			s := NewStore(StoreOpts{Root: t.TempDir(), MmapThreshold: 10, EncryptAtRest: atRest, EncKey: bytes.Repeat([]byte{1}, 32)})
+			contents := strings.Repeat("0123456789", 100)
+			_, err := s.Write("id", "large", strings.NewReader(contents))
+			require.NoError(t, err)
+			_, err = s.Write("id", "small", strings.NewReader("tiny"))
+			require.NoError(t, err)
+
+			size, r, err := s.Read("id", "large")
+			require.NoError(t, err)
+			assert.EqualValues(t, len(contents), size)
+			if !atRest {
+				assert.IsType(t, &mappedFile{}, r)
+			}
+			b := make([]byte, 4)
+			_, err = r.(io.ReaderAt).ReadAt(b, 998)
+			assert.ErrorIs(t, err, io.EOF)
+			_, err = r.(io.ReaderAt).ReadAt(b, 13)
+			require.NoError(t, err)
+			assert.Equal(t, "3456", string(b))
+			_, err = r.(io.Seeker).Seek(990, io.SeekStart)
+			require.NoError(t, err)
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "0123456789", string(rest))
+			require.NoError(t, r.Close())
+
+			// Mappings outlive their object being replaced.
+			_, r, err = s.Read("id", "large")
+			require.NoError(t, err)
+			_, err = s.Write("id", "large", strings.NewReader(strings.Repeat("x", 20)))
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, contents, string(got))
+			r.Close()
+
+			// Objects below the threshold are read from their file.
+			_, r, err = s.Read("id", "small")
+			require.NoError(t, err)
+			if !atRest {
+				assert.IsType(t, &os.File{}, r)
+			}
+			r.Close()
+		})
+	}
+}
+
+func TestMappedFileClosed(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "mapped")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString("mapped")
+	require.NoError(t, err)
+
+	m, err := mapFile(f, 6)
+	if err != nil {
+		t.Skip(err)
+	}
+	require.NoError(t, m.Close())
+	_, err = m.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrClosed)
+	_, err = m.ReadAt(make([]byte, 1), 0)
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+const (
+	packDirName     = ".packs"   // Directory of the storage root the packs are kept in
+	packMagic       = "DFSPACK1" // Start of every pack
+	defaultPackSize = 64 << 20   // Bytes a pack is appended to up to unless StoreOpts says otherwise
+)
+
+// PackLocation is where a packed object is: the Length bytes at Offset of
+// the pack named Pack, at rest encryption included.
+type PackLocation struct {
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// packWriter appends objects to the pack of a store, starting a new pack
+// once the current one is full. Packs are only ever appended to; the objects
+// in them are found through the metadata index.
+type packWriter struct {
+	dir    string
+	limit  int64 // Bytes a pack is appended to up to, defaultPackSize if zero
+	noSync bool
+
+	mu   sync.Mutex
+	f    *os.File // Pack appended to, nil until the next append opens one
+	name string
+	size int64
+}
+
+// append appends blob to the current pack and returns where it went. The
+// blob is on disk once sync returns.
+func (p *packWriter) append(blob []byte) (PackLocation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limit := p.limit
+	if limit <= 0 {
+		limit = defaultPackSize
+	}
+	if p.f != nil && p.size+int64(len(blob)) > limit {
+		if err := p.seal(); err != nil {
+			return PackLocation{}, err
+		}
+	}
+	if p.f == nil {
+		if err := p.open(); err != nil {
+			return PackLocation{}, err
+		}
+	}
+
+	loc := PackLocation{Pack: p.name, Offset: p.size, Length: int64(len(blob))}
+	n, err := p.f.Write(blob)
+	p.size += int64(n) // Torn appends are skipped over by the next one
+	return loc, err
+}
+
+// sync fsyncs the current pack. Packs that were full are fsynced already.
+func (p *packWriter) sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.f == nil || p.noSync {
+		return nil
+	}
+	return p.f.Sync()
+}
+
+// sealed seals the current pack and returns the names of every pack, none
+// of which is appended to anymore.
+func (p *packWriter) sealed() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.seal(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".pack") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// path returns the path of the pack named name.
+func (p *packWriter) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// open starts a new pack. The caller must hold p.mu.
+func (p *packWriter) open() error {
+	if err := os.MkdirAll(p.dir, os.ModePerm); err != nil {
+		return err
+	}
+	name := "pack-" + crypto.GenerateID()[:16] + ".pack"
+	f, err := os.OpenFile(p.path(name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(packMagic)); err != nil {
+		f.Close()
+		os.Remove(p.path(name))
+		return err
+	}
+	if !p.noSync {
+		if err := syncDir(p.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	p.f, p.name, p.size = f, name, int64(len(packMagic))
+	return nil
+}
+
+// seal closes the current pack, if any, so the next append starts a new one.
+// The caller must hold p.mu.
+func (p *packWriter) seal() error {
+	if p.f == nil {
+		return nil
+	}
+	var err error
+	if !p.noSync {
+		err = p.f.Sync()
+	}
+	if closeErr := p.f.Close(); err == nil {
+		err = closeErr
+	}
+	p.f = nil
+	return err
+}
+
+// writePacked appends the object data to the pack and indexes it there,
+// removing the file the previous version of the object had, if any.
+func (s *Store) writePacked(id string, key string, data []byte) (int64, error) {
+	pathKey, err := s.pathKey(id, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.CheckWrite(id, key); err != nil {
+		return 0, err
+	}
+	var blob bytes.Buffer
+	w, err := s.atRestWriter(&blob)
+	if err != nil {
+		return 0, err
+	}
+	w.Write(data) // Writing to a buffer doesn't fail
+	h := sha256.New()
+	h.Write(data)
+
+	for {
+		loc, err := s.packs.append(blob.Bytes())
+		if err == nil {
+			err = s.packs.sync()
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		s.blobLock.Lock()
+		if _, err := os.Stat(s.packs.path(loc.Pack)); errors.Is(err, os.ErrNotExist) {
+			s.blobLock.Unlock()
+			continue // Repack deleted the pack before the object was indexed in it
+		}
+		err = s.CheckWrite(id, key)
+		if err == nil {
+			meta := s.newMeta(id, key, loc.Length, h)
+			meta.Pack = &loc
+			err = s.index.put(meta, func() error { return s.removeLoose(id, pathKey) })
+		}
+		s.blobLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(data)), nil
+	}
+}
+
+// removeLoose removes the file of the object at pathKey in namespace id, if
+// there is one, along with the directories left empty.
+func (s *Store) removeLoose(id string, pathKey PathKey) error {
+	path := filepath.Join(s.Root, id, pathKey.FullPath())
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(path), filepath.Join(s.Root, id))
+	return nil
+}
+
+// openPacked returns the size of the object at loc and a reader of it.
+func (s *Store) openPacked(loc PackLocation) (int64, io.ReadCloser, error) {
+	f, err := os.Open(s.packs.path(loc.Pack))
+	if err != nil {
+		return 0, nil, err
+	}
+	r := &packedObject{SectionReader: io.NewSectionReader(f, loc.Offset, loc.Length), f: f}
+	if s.EncryptAtRest {
+		return s.atRestReader(r, loc.Length)
+	}
+	return loc.Length, r, nil
+}
+
+// readPacked returns the size of the object stored under key and a reader
+// of it if it is packed. Repack moves objects to another pack before it
+// deletes theirs, so the object is looked up again if its pack is gone.
+func (s *Store) readPacked(id string, key string) (int64, io.ReadCloser, bool, error) {
+	for range 2 {
+		meta, ok := s.index.get(id, key)
+		if !ok || meta.Pack == nil {
+			return 0, nil, false, nil
+		}
+		size, r, err := s.openPacked(*meta.Pack)
+		if !errors.Is(err, os.ErrNotExist) {
+			return size, r, true, err
+		}
+	}
+	return 0, nil, false, nil
+}
+
+// packedObject reads an object out of its pack. Like the files of other
+// objects, it can be read at any offset and seeked.
+type packedObject struct {
+	*io.SectionReader
+	f *os.File
+}
+
+// Len returns the number of bytes left to read.
+func (o *packedObject) Len() int {
+	off, _ := o.Seek(0, io.SeekCurrent)
+	return int(o.Size() - off)
+}
+
+func (o *packedObject) Close() error {
+	return o.f.Close()
+}
+
+// packHolds reports whether the pack of loc holds the whole object.
+func (s *Store) packHolds(loc PackLocation) bool {
+	fi, err := os.Stat(s.packs.path(loc.Pack))
+	return err == nil && fi.Size() >= loc.Offset+loc.Length
+}
+
+// RepackReport is what Store.Repack did.
+type RepackReport struct {
+	Packed    int   `json:"packed"`    // Small objects moved from files of their own into a pack
+	Moved     int   `json:"moved"`     // Objects moved out of packs that were deleted
+	Removed   int   `json:"removed"`   // Packs deleted
+	Reclaimed int64 `json:"reclaimed"` // Bytes of the deleted packs no object used
+}
+
+// Repack garbage collects the packs of the store. Packs the objects deleted
+// or replaced since they were packed take up more than half of are deleted,
+// after the objects still in them are moved to a new pack. Objects small
+// enough to be packed that have a file of their own, such as those written
+// before packing was enabled, are packed too. Writes wait while the store is
+// repacked; reads don't.
+func (s *Store) Repack() (RepackReport, error) {
+	var report RepackReport
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	// Objects written from now on go to a new pack, left alone
+	names, err := s.packs.sealed()
+	if err != nil {
+		return report, err
+	}
+	entries := s.index.snapshot()
+	live := make(map[string]int64) // Bytes of the objects in each pack
+	for _, meta := range entries {
+		if meta.Pack != nil {
+			live[meta.Pack.Pack] += meta.Pack.Length
+		}
+	}
+	drop := make(map[string]bool)
+	sort.Strings(names)
+	for _, name := range names {
+		fi, err := os.Stat(s.packs.path(name))
+		if err != nil {
+			return report, err
+		}
+		if size := fi.Size() - int64(len(packMagic)); 2*live[name] < size {
+			drop[name] = true
+			report.Reclaimed += size - live[name]
+		}
+	}
+
+	// Copy the objects to move first, so they are on disk before the index
+	// points to them.
+	var moved []ObjectMeta
+	for _, meta := range entries {
+		loose := meta.Pack == nil
+		if loose && (s.PackThreshold <= 0 || meta.Size > s.PackThreshold) || !loose && !drop[meta.Pack.Pack] {
+			continue
+		}
+		blob, err := s.readRaw(meta)
+		if loose && (errors.Is(err, os.ErrNotExist) || err == nil && int64(len(blob)) != meta.diskSize()) {
+			continue // Not as indexed, left for Fsck
+		}
+		if err != nil {
+			return report, err
+		}
+		loc, err := s.packs.append(blob)
+		if err != nil {
+			return report, err
+		}
+		if loose {
+			report.Packed++
+		} else {
+			report.Moved++
+		}
+		meta.Pack, meta.DiskSize = &loc, loc.Length
+		moved = append(moved, meta)
+	}
+	if err := s.packs.sync(); err != nil {
+		return report, err
+	}
+	for _, meta := range moved {
+		pathKey := s.PathTransformFunc(meta.Key)
+		if err := s.index.put(meta, func() error { return s.removeLoose(meta.ID, pathKey) }); err != nil {
+			return report, err
+		}
+	}
+
+	// Packs go last, once no object points to them
+	for _, name := range names {
+		if !drop[name] {
+			continue
+		}
+		if err := os.Remove(s.packs.path(name)); err != nil {
+			return report, err
+		}
+		report.Removed++
+	}
+	return report, nil
+}
+
+// readRaw returns the object meta describes as it is on disk, encrypted if
+// it is encrypted at rest.
+func (s *Store) readRaw(meta ObjectMeta) ([]byte, error) {
+	if meta.Pack == nil {
+		return os.ReadFile(filepath.Join(s.Root, meta.ID, s.PathTransformFunc(meta.Key).FullPath()))
+	}
+
+	f, err := os.Open(s.packs.path(meta.Pack.Pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blob := make([]byte, meta.Pack.Length)
+	if _, err := f.ReadAt(blob, meta.Pack.Offset); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
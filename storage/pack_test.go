@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readObject(t *testing.T, s *Store, id string, key string) string {
+	t.Helper()
+	_, r, err := s.Read(id, key)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestPackedObjects(t *testing.T) {
+	for _, atRest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("at rest %v", atRest), func(t *testing.T) {
+			root := t.TempDir()
+			opts := StoreOpts{Root: root, PackThreshold: 16, EncryptAtRest: atRest, EncKey: bytes.Repeat([]byte{1}, 32)}
+			s := NewStore(opts)
+			loose := func(key string) bool {
+				_, err := os.Stat(filepath.Join(root, "id", s.PathTransformFunc(key).FullPath()))
+				return err == nil
+			}
+
+			// Small objects go to a pack, larger ones to a file of their own.
+			_, err := s.Write("id", "small", strings.NewReader("tiny"))
+			require.NoError(t, err)
+			_, err = s.Write("id", "large", strings.NewReader(strings.Repeat("x", 17)))
+			require.NoError(t, err)
+			assert.False(t, loose("small"))
+			assert.True(t, loose("large"))
+			assert.True(t, s.Has("id", "small"))
+			assert.Equal(t, "tiny", readObject(t, s, "id", "small"))
+
+			size, r, err := s.Read("id", "small")
+			require.NoError(t, err)
+			assert.EqualValues(t, 4, size)
+			b := make([]byte, 2)
+			_, err = r.(io.ReaderAt).ReadAt(b, 1)
+			require.NoError(t, err)
+			assert.Equal(t, "in", string(b))
+			r.Close()
+
+			// Objects move between packs and files as they change size.
+			_, err = s.Write("id", "large", strings.NewReader("short"))
+			require.NoError(t, err)
+			assert.False(t, loose("large"))
+			_, err = s.Write("id", "small", strings.NewReader(strings.Repeat("y", 20)))
+			require.NoError(t, err)
+			assert.True(t, loose("small"))
+			assert.Equal(t, "short", readObject(t, s, "id", "large"))
+
+			// Packs survive restarts and pass the checks.
+			s = NewStore(opts)
+			assert.Equal(t, "short", readObject(t, s, "id", "large"))
+			report, err := s.Fsck(false)
+			require.NoError(t, err)
+			assert.True(t, report.OK(), "%+v", report)
+			assert.Equal(t, 2, report.Objects)
+
+			require.NoError(t, s.Delete("id", "large"))
+			assert.False(t, s.Has("id", "large"))
+		})
+	}
+}
+
+func TestRepack(t *testing.T) {
+	root := t.TempDir()
+
+	// Objects written before packing was enabled are packed by Repack.
+	s := NewStore(StoreOpts{Root: root})
+	_, err := s.Write("id", "old", strings.NewReader("old"))
+	require.NoError(t, err)
+
+	s = NewStore(StoreOpts{Root: root, PackThreshold: 64, PackSize: 256})
+	for i := range 20 {
+		_, err := s.Write("id", fmt.Sprint(i), strings.NewReader(strings.Repeat("z", 32)))
+		require.NoError(t, err)
+	}
+	packs, err := os.ReadDir(filepath.Join(root, packDirName))
+	require.NoError(t, err)
+	assert.Len(t, packs, 3)
+	for i := range 18 {
+		require.NoError(t, s.Delete("id", fmt.Sprint(i)))
+	}
+
+	report, err := s.Repack()
+	require.NoError(t, err)
+	assert.Equal(t, RepackReport{Packed: 1, Moved: 2, Removed: 3, Reclaimed: 18 * 32}, report)
+	packs, err = os.ReadDir(filepath.Join(root, packDirName))
+	require.NoError(t, err)
+	assert.Len(t, packs, 1)
+	assert.Equal(t, "old", readObject(t, s, "id", "old"))
+	assert.Equal(t, strings.Repeat("z", 32), readObject(t, s, "id", "19"))
+	_, err = os.Stat(filepath.Join(root, "id", s.PathTransformFunc("old").FullPath()))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Snapshots take the packs along.
+	dst := filepath.Join(t.TempDir(), "snapshot")
+	_, err = s.Snapshot(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "old", readObject(t, NewStore(StoreOpts{Root: dst}), "id", "old"))
+
+	// Nothing left to collect.
+	report, err = s.Repack()
+	require.NoError(t, err)
+	assert.Equal(t, RepackReport{}, report)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Retention keeps an object from being deleted or overwritten, for backups
+// and records that must be kept for compliance. It is stored in the metadata
+// of the object and enforced by every server holding it, deletes and writes
+// being refused with ErrImmutable while it is in effect. Archiving to cold
+// nodes leaves retained objects alone.
+type Retention struct {
+	// Until is when the object may be deleted at the earliest. It can be
+	// moved later, never earlier.
+	Until time.Time `json:"until,omitempty"`
+
+	// LegalHold keeps the object whatever Until says, until the hold is
+	// lifted.
+	LegalHold bool `json:"legal_hold,omitempty"`
+}
+
+// Retains reports whether r keeps its object at now.
+func (r *Retention) Retains(now time.Time) bool {
+	return r != nil && (r.LegalHold || now.Before(r.Until))
+}
+
+// retainedErr returns ErrImmutable for key, kept by r.
+func (r *Retention) retainedErr(key string) error {
+	if r.LegalHold {
+		return fmt.Errorf("%w: (%s) is under legal hold", ErrImmutable, key)
+	}
+	return fmt.Errorf("%w: (%s) is retained until %s", ErrImmutable, key, r.Until.Format(time.RFC3339))
+}
+
+// SetRetention sets the retention of an object. The date it is retained until
+// can only be moved later, and is refused with ErrImmutable otherwise; a legal
+// hold can be placed and lifted at any time.
+func (s *Store) SetRetention(id string, key string, r Retention) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	meta, ok := s.index.get(id, key)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if meta.Retention != nil && r.Until.Before(meta.Retention.Until) {
+		return fmt.Errorf("%w: the retention of (%s) can't be shortened", ErrImmutable, key)
+	}
+
+	var retention *Retention
+	if !r.Until.IsZero() || r.LegalHold {
+		retention = &r
+	}
+	return s.index.update(id, key, func(meta *ObjectMeta) {
+		meta.Retention = retention
+	})
+}
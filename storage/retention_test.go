@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), NoSync: true})
+	_, err := s.Write("id", "key", bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+
+	until := time.Now().Add(time.Hour)
+	require.NoError(t, s.SetRetention("id", "key", Retention{Until: until}))
+	assert.ErrorIs(t, s.SetRetention("id", "key", Retention{Until: until.Add(-time.Minute)}), ErrImmutable, "retention can't be shortened")
+	assert.ErrorIs(t, s.SetRetention("id", "missing", Retention{LegalHold: true}), os.ErrNotExist)
+
+	// Retained objects are neither deleted nor overwritten,
+	assert.ErrorIs(t, s.Delete("id", "key"), ErrImmutable)
+	_, err = s.Write("id", "key", bytes.NewReader([]byte("overwritten")))
+	assert.ErrorIs(t, err, ErrImmutable)
+	meta, _ := s.index.get("id", "key")
+	assert.Equal(t, int64(len("data")), meta.Size)
+	assert.True(t, until.Equal(meta.Retention.Until))
+	assert.NoError(t, s.CheckDelete("id", "key", until.Add(time.Second)), "the retention expires")
+
+	// and held ones not even once it expires.
+	require.NoError(t, s.SetRetention("id", "key", Retention{Until: until, LegalHold: true}))
+	assert.ErrorIs(t, s.CheckDelete("id", "key", until.Add(time.Second)), ErrImmutable)
+	require.NoError(t, s.SetRetention("id", "key", Retention{Until: until}))
+
+	// The retention survives restarts.
+	reopened := NewStore(s.StoreOpts)
+	meta, _ = reopened.index.get("id", "key")
+	require.NotNil(t, meta.Retention)
+	assert.True(t, until.Equal(meta.Retention.Until))
+	assert.False(t, meta.Retention.LegalHold)
+}
@@ -0,0 +1,355 @@
+// Package storagetest provides an in-memory store with the methods of
+// storage.Store, for testing code built on a store without a disk: objects
+// and their metadata are kept in maps, and writes can be made to fail by the
+// test.
+package storagetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// objectKey identifies an object within a Store.
+type objectKey struct {
+	id  string
+	key string
+}
+
+// Store is a store keeping its objects in memory. Its maintenance methods
+// have nothing to check or compact, and it can't be snapshotted, exported
+// or imported.
+type Store struct {
+	// FailWrite returns the error writing key in namespace id fails with,
+	// nil to let the write go ahead. Writes never fail if nil.
+	FailWrite func(id string, key string) error
+
+	mu    sync.Mutex
+	data  map[objectKey][]byte
+	metas map[objectKey]storage.ObjectMeta
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{
+		data:  make(map[objectKey][]byte),
+		metas: make(map[objectKey]storage.ObjectMeta),
+	}
+}
+
+// Has reports whether key is stored in namespace id.
+func (s *Store) Has(id string, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.data[objectKey{id, key}]
+	return ok
+}
+
+// Read returns the size and contents of the object stored under key, or
+// os.ErrNotExist.
+func (s *Store) Read(id string, key string) (int64, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.data[objectKey{id, key}]
+	if !ok {
+		return 0, nil, fmt.Errorf("storagetest: read (%s): %w", key, os.ErrNotExist)
+	}
+	return int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Write stores what is read from r under key, keeping the tags, tenant, ACL
+// and accesses of the object it replaces like storage.Store does. Objects
+// under retention are refused with storage.ErrImmutable.
+func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	if s.FailWrite != nil {
+		if err := s.FailWrite(id, key); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWrite(id, key); err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(data)
+	meta := storage.ObjectMeta{
+		ID:       id,
+		Key:      key,
+		Size:     int64(len(data)),
+		DiskSize: int64(len(data)),
+		ModTime:  time.Now(),
+		Content:  &storage.ContentManifest{Checksum: hex.EncodeToString(sum[:])},
+	}
+	if prev, ok := s.metas[objectKey{id, key}]; ok {
+		meta.Tags = prev.Tags
+		meta.Tenant, meta.ACL = prev.Tenant, prev.ACL
+		meta.LastAccess, meta.Accesses = prev.LastAccess, prev.Accesses
+	}
+	s.data[objectKey{id, key}] = data
+	s.metas[objectKey{id, key}] = meta
+	return int64(len(data)), nil
+}
+
+// Delete removes the object stored under key, unless it is under
+// retention. Deleting an object that doesn't exist does nothing.
+func (s *Store) Delete(id string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkDelete(id, key, time.Now()); err != nil {
+		return err
+	}
+	delete(s.data, objectKey{id, key})
+	delete(s.metas, objectKey{id, key})
+	return nil
+}
+
+// Clear removes every object.
+func (s *Store) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.data)
+	clear(s.metas)
+	return nil
+}
+
+// Meta returns the metadata of the object stored under key.
+func (s *Store) Meta(id string, key string) (storage.ObjectMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.metas[objectKey{id, key}]
+	return meta, ok
+}
+
+// UpdateMeta changes the metadata of the object stored under key with fn,
+// or returns os.ErrNotExist.
+func (s *Store) UpdateMeta(id string, key string, fn func(*storage.ObjectMeta)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(id, key, fn)
+}
+
+// update is UpdateMeta with the lock held.
+func (s *Store) update(id string, key string, fn func(*storage.ObjectMeta)) error {
+	meta, ok := s.metas[objectKey{id, key}]
+	if !ok {
+		return os.ErrNotExist
+	}
+	fn(&meta)
+	s.metas[objectKey{id, key}] = meta
+	return nil
+}
+
+// Touch records that the object stored under key was read at t.
+func (s *Store) Touch(id string, key string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.update(id, key, func(meta *storage.ObjectMeta) {
+		meta.Accesses++
+		if t.After(meta.LastAccess) {
+			meta.LastAccess = t
+		}
+	})
+}
+
+// Objects returns the metadata of every object, in no particular order.
+func (s *Store) Objects() iter.Seq[storage.ObjectMeta] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Values(maps.Clone(s.metas))
+}
+
+// Len returns the number of objects.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.metas)
+}
+
+// CheckWrite returns storage.ErrImmutable if the object stored under key is
+// retained.
+func (s *Store) CheckWrite(id string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkWrite(id, key)
+}
+
+// checkWrite is CheckWrite with the lock held.
+func (s *Store) checkWrite(id string, key string) error {
+	return s.checkDelete(id, key, time.Now())
+}
+
+// CheckDelete returns storage.ErrImmutable if the object stored under key is
+// retained at now.
+func (s *Store) CheckDelete(id string, key string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkDelete(id, key, now)
+}
+
+// checkDelete is CheckDelete with the lock held.
+func (s *Store) checkDelete(id string, key string, now time.Time) error {
+	if meta := s.metas[objectKey{id, key}]; meta.Retention.Retains(now) {
+		return fmt.Errorf("%w: (%s) is retained", storage.ErrImmutable, key)
+	}
+	return nil
+}
+
+// SetRetention sets the retention of the object stored under key. The date
+// it is retained until can only be moved later.
+func (s *Store) SetRetention(id string, key string, r storage.Retention) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if meta, ok := s.metas[objectKey{id, key}]; ok && meta.Retention != nil && r.Until.Before(meta.Retention.Until) {
+		return fmt.Errorf("%w: the retention of (%s) can't be shortened", storage.ErrImmutable, key)
+	}
+	var retention *storage.Retention
+	if !r.Until.IsZero() || r.LegalHold {
+		retention = &r
+	}
+	return s.update(id, key, func(meta *storage.ObjectMeta) { meta.Retention = retention })
+}
+
+// SetTags replaces the tags of the object stored under key.
+func (s *Store) SetTags(id string, key string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tags = maps.Clone(tags)
+	if len(tags) == 0 {
+		tags = nil
+	}
+	return s.update(id, key, func(meta *storage.ObjectMeta) { meta.Tags = tags })
+}
+
+// Search returns the metadata of every object in namespace id having the
+// tags of query, by key. A tag queried with "*" matches any value.
+func (s *Store) Search(id string, query map[string]string) []storage.ObjectMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []storage.ObjectMeta
+	for _, meta := range s.metas {
+		if meta.ID == id && len(meta.Tags) > 0 && matchTags(query, meta.Tags) {
+			out = append(out, meta)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// matchTags reports whether tags satisfy every tag of the query.
+func matchTags(query map[string]string, tags map[string]string) bool {
+	for k, want := range query {
+		have, ok := tags[k]
+		if !ok || (want != "*" && have != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetContent describes what the object stored under key holds, keeping its
+// checksum.
+func (s *Store) SetContent(id string, key string, m storage.ContentManifest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.Metadata = maps.Clone(m.Metadata); len(m.Metadata) == 0 {
+		m.Metadata = nil
+	}
+	return s.update(id, key, func(meta *storage.ObjectMeta) { meta.Content = meta.Content.DescribedAs(&m) })
+}
+
+// UsageByNamespace returns the usage of every namespace holding objects.
+func (s *Store) UsageByNamespace() map[string]storage.Usage {
+	return s.usageBy(func(meta storage.ObjectMeta) string { return meta.ID })
+}
+
+// UsageOfTenant returns the usage of the objects of tenant.
+func (s *Store) UsageOfTenant(tenant string) storage.Usage {
+	return s.UsageByTenant()[tenant]
+}
+
+// UsageByTenant returns the usage of every tenant holding objects.
+func (s *Store) UsageByTenant() map[string]storage.Usage {
+	return s.usageBy(func(meta storage.ObjectMeta) string { return meta.Tenant })
+}
+
+// usageBy returns the usage of the objects grouped by name, leaving out
+// those it names nothing.
+func (s *Store) usageBy(name func(storage.ObjectMeta) string) map[string]storage.Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]storage.Usage)
+	for _, meta := range s.metas {
+		if n := name(meta); len(n) > 0 {
+			out[n] = out[n].Add(storage.Usage{Objects: 1, LogicalBytes: meta.Size, PhysicalBytes: meta.DiskSize})
+		}
+	}
+	return out
+}
+
+// Health returns nil, there is no index to persist.
+func (s *Store) Health() error {
+	return nil
+}
+
+// CompactIndex does nothing, there is no index to compact.
+func (s *Store) CompactIndex() error {
+	return nil
+}
+
+// Fsck reports the objects, which can't go missing or get corrupted.
+func (s *Store) Fsck(repair bool) (storage.FsckReport, error) {
+	return storage.FsckReport{Objects: s.Len()}, nil
+}
+
+// Repack does nothing, there are no packs.
+func (s *Store) Repack() (storage.RepackReport, error) {
+	return storage.RepackReport{}, nil
+}
+
+// Snapshot fails with errors.ErrUnsupported.
+func (s *Store) Snapshot(dst string) (storage.SnapshotInfo, error) {
+	return storage.SnapshotInfo{}, fmt.Errorf("storagetest: snapshot: %w", errors.ErrUnsupported)
+}
+
+// Export fails with errors.ErrUnsupported.
+func (s *Store) Export(w io.Writer, node string, since time.Time) (storage.ArchiveInfo, error) {
+	return storage.ArchiveInfo{}, fmt.Errorf("storagetest: export: %w", errors.ErrUnsupported)
+}
+
+// Import fails with errors.ErrUnsupported.
+func (s *Store) Import(r io.Reader) (storage.ArchiveInfo, error) {
+	return storage.ArchiveInfo{}, fmt.Errorf("storagetest: import: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,76 @@
+package storagetest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+
+	// Objects written are read back, with their metadata.
+	n, err := s.Write("node", "a.txt", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+	assert.True(t, s.Has("node", "a.txt"))
+	assert.False(t, s.Has("other", "a.txt"))
+	size, r, err := s.Read("node", "a.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, size)
+	assert.Equal(t, "hello", string(data))
+	meta, ok := s.Meta("node", "a.txt")
+	require.True(t, ok)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", meta.Content.Checksum)
+	_, _, err = s.Read("node", "missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Tags, tenants and accesses are kept when objects are rewritten.
+	require.NoError(t, s.SetTags("node", "a.txt", map[string]string{"kind": "text"}))
+	require.NoError(t, s.UpdateMeta("node", "a.txt", func(meta *storage.ObjectMeta) { meta.Tenant = "acme" }))
+	s.Touch("node", "a.txt", time.Now())
+	_, err = s.Write("node", "a.txt", strings.NewReader("hello again"))
+	require.NoError(t, err)
+	meta, _ = s.Meta("node", "a.txt")
+	assert.Equal(t, map[string]string{"kind": "text"}, meta.Tags)
+	assert.EqualValues(t, 1, meta.Accesses)
+	assert.Equal(t, storage.Usage{Objects: 1, LogicalBytes: 11, PhysicalBytes: 11}, s.UsageOfTenant("acme"))
+	assert.Len(t, s.Search("node", map[string]string{"kind": "*"}), 1)
+	assert.Empty(t, s.Search("other", map[string]string{"kind": "*"}))
+
+	// Retained objects can't be written or deleted.
+	require.NoError(t, s.SetRetention("node", "a.txt", storage.Retention{LegalHold: true}))
+	_, err = s.Write("node", "a.txt", strings.NewReader("lost"))
+	assert.ErrorIs(t, err, storage.ErrImmutable)
+	assert.ErrorIs(t, s.Delete("node", "a.txt"), storage.ErrImmutable)
+	require.NoError(t, s.SetRetention("node", "a.txt", storage.Retention{}))
+
+	// Writes fail as the test says.
+	s.FailWrite = func(id string, key string) error { return errors.New("disk full") }
+	_, err = s.Write("node", "b.txt", strings.NewReader("lost"))
+	assert.Error(t, err)
+	assert.False(t, s.Has("node", "b.txt"))
+	s.FailWrite = nil
+
+	_, err = s.Write("other", "b.txt", strings.NewReader("b"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	assert.Len(t, slices.Collect(s.Objects()), 2)
+	assert.Len(t, s.UsageByNamespace(), 2)
+	require.NoError(t, s.Delete("node", "a.txt"))
+	require.NoError(t, s.Delete("node", "a.txt"), "deleting again does nothing")
+	require.NoError(t, s.Clear())
+	assert.Zero(t, s.Len())
+	_, err = s.Snapshot(t.TempDir())
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+// defaultRootFolderName is the default name for the root storage folder.
+const defaultRootFolderName = "ggnetwork"
+
+// CASPathTransformFunc implements a Content-Addressable Storage (CAS) path transformation.
+// It creates a unique file path based on the SHA1 hash of the key.
+// Use NewCASPathTransformFunc for stronger hash functions.
+func CASPathTransformFunc(key string) PathKey {
+	return NewCASPathTransformFunc(crypto.SHA1Hasher)(key)
+}
+
+// PathTransformFunc is a type for functions that transform keys into file paths.
+type PathTransformFunc func(string) PathKey
+
+// PathKey represents a transformed file path and filename.
+// Both are relative to the directory of the object's namespace.
+type PathKey struct {
+	PathName string
+	Filename string
+}
+
+// FirstPathName returns the first component of the path.
+func (p PathKey) FirstPathName() string {
+	paths := strings.Split(filepath.ToSlash(filepath.Clean(p.PathName)), "/")
+	return paths[0]
+}
+
+// FullPath returns the complete path including filename.
+func (p PathKey) FullPath() string {
+	return filepath.Join(p.PathName, p.Filename)
+}
+
+// ErrInvalidKey is returned for keys and IDs that don't map to a path inside the storage root.
+var ErrInvalidKey = errors.New("invalid key")
+
+// validate checks that the object stays within the directory of its namespace,
+// so keys like "../../etc/passwd" can't read or write anywhere else. The path
+// must not resolve to the namespace directory itself either, as deleting the
+// object removes the directories it leaves empty.
+func (p PathKey) validate() error {
+	if !filepath.IsLocal(p.PathName) || !filepath.IsLocal(p.FullPath()) || filepath.Clean(p.PathName) == "." {
+		return fmt.Errorf("%w: path %q escapes the storage root", ErrInvalidKey, p.FullPath())
+	}
+	return nil
+}
+
+// StoreOpts contains options for configuring the Store.
+type StoreOpts struct {
+	Root              string
+	PathTransformFunc PathTransformFunc
+
+	// Hasher makes the store content-addressable with the given hash function
+	// when no PathTransformFunc is set, laying objects out as Layout says
+	// (DefaultCASLayout if zero). The layout must not change once the store
+	// holds objects; MigrateLayout moves them to another one.
+	Hasher crypto.Hasher
+	Layout CASLayout
+
+	// NoSync skips fsyncing objects and their directories after writing them.
+	// Writes get faster, but the most recent ones may be lost on a crash or
+	// power failure. Objects are still moved into place atomically either way.
+	NoSync bool
+
+	// EncryptAtRest encrypts objects with EncKey as they are written and
+	// decrypts them as they are read, so the files below Root can't be read
+	// without the key. Sizes, reads and ranges are those of the plaintext.
+	// It must not change once the store holds objects.
+	EncryptAtRest bool
+	EncKey        []byte // 32 byte key objects are encrypted with at rest
+
+	// Immutable makes the namespaces it maps write-once: once a key is
+	// stored, it can't be written again, and the object is only deleted once
+	// it is older than the retention mapped to its namespace, never if zero.
+	// Namespaces are the IDs objects are stored under; peers refuse replicas
+	// overwriting the objects of immutable namespaces with ErrImmutable.
+	Immutable map[string]time.Duration
+
+	// PackThreshold packs objects of up to that many bytes into pack files,
+	// large append-only files holding many objects one after the other, so
+	// millions of small objects don't take up as many inodes. A pack is
+	// appended to until it holds PackSize bytes (64 MiB if zero). Reads of
+	// packed objects are no different; the space of the packed objects
+	// deleted or replaced since is reclaimed by Repack. Zero disables packing.
+	PackThreshold int64
+	PackSize      int64
+
+	// MmapThreshold reads the objects of at least that many bytes through a
+	// read-only memory mapping on 64-bit platforms that support it, sparing
+	// the system call of every read when serving many concurrent range reads
+	// of large objects. Objects that can't be mapped are read from their file
+	// as usual. Zero disables mapping.
+	MmapThreshold int64
+}
+
+// DefaultPathTransformFunc is a simple path transform function that uses the key directly.
+// Keys that would escape the storage root, such as absolute paths or keys
+// containing "..", are rejected by the store with ErrInvalidKey.
+var DefaultPathTransformFunc = func(key string) PathKey {
+	return PathKey{
+		PathName: key,
+		Filename: key,
+	}
+}
+
+// Store represents the file storage system.
+type Store struct {
+	StoreOpts
+
+	index    *metaIndex   // Metadata of every object held by the store
+	blobLock sync.RWMutex // Held for writing while objects are replaced or removed, and for reading while a snapshot links them
+	packs    *packWriter  // Pack small objects are appended to
+}
+
+// NewStore creates a new Store with the given options.
+func NewStore(opts StoreOpts) *Store {
+	// Set default values if not provided
+	if opts.PathTransformFunc == nil && opts.Hasher.New != nil {
+		opts.PathTransformFunc = NewCASLayoutPathTransformFunc(opts.Hasher, opts.Layout)
+	}
+	if opts.PathTransformFunc == nil {
+		opts.PathTransformFunc = DefaultPathTransformFunc
+	}
+	if len(opts.Root) == 0 {
+		opts.Root = defaultRootFolderName
+	}
+
+	// Load the metadata index, starting from an empty one if it can't be read
+	index, err := loadIndex(filepath.Join(opts.Root, indexFileName))
+	if err != nil {
+		log.Printf("could not load metadata index, starting empty: %s", err)
+		index.err = err
+	}
+	index.sync = !opts.NoSync
+
+	// Temporary files are left behind by writes interrupted by a crash
+	if err := removeTempFiles(opts.Root); err != nil {
+		log.Printf("could not remove leftover temporary files: %s", err)
+	}
+
+	s := &Store{
+		StoreOpts: opts,
+		index:     index,
+		packs:     &packWriter{dir: filepath.Join(opts.Root, packDirName), limit: opts.PackSize, noSync: opts.NoSync},
+	}
+	s.recoverIndex()
+	return s
+}
+
+// pathKey transforms key and checks that the object ends up inside the directory of namespace id.
+func (s *Store) pathKey(id string, key string) (PathKey, error) {
+	// IDs are sent by peers, they must name a single directory
+	if !filepath.IsLocal(id) || strings.ContainsAny(id, `/\`) || id == packDirName {
+		return PathKey{}, fmt.Errorf("%w: id %q is not a valid directory name", ErrInvalidKey, id)
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	if err := pathKey.validate(); err != nil {
+		return PathKey{}, err
+	}
+	return pathKey, nil
+}
+
+// Has checks if a file exists in the store.
+func (s *Store) Has(id string, key string) bool {
+	pathKey, err := s.pathKey(id, key)
+	if err != nil {
+		return false
+	}
+	if meta, ok := s.index.get(id, key); ok && meta.Pack != nil {
+		return true
+	}
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+
+	_, err = os.Stat(fullPathWithRoot)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Clear removes all files from the store.
+func (s *Store) Clear() error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	s.index.reset()
+	return os.RemoveAll(s.Root)
+}
+
+// Delete removes a file from the store. Objects of immutable namespaces, and
+// objects with a Retention, are refused with ErrImmutable until their
+// retention expires.
+func (s *Store) Delete(id string, key string) error {
+	pathKey, err := s.pathKey(id, key)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		log.Printf("deleted [%s] from disk", pathKey.Filename)
+	}()
+
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	if err := s.CheckDelete(id, key, time.Now()); err != nil {
+		return err
+	}
+
+	// Directories are shared by the objects of flat layouts, so only the ones
+	// left empty are removed along with the object.
+	return s.index.remove(id, key, func() error {
+		if err := os.RemoveAll(fullPathWithRoot); err != nil {
+			return err
+		}
+		removeEmptyDirs(filepath.Dir(fullPathWithRoot), filepath.Join(s.Root, id))
+		return nil
+	})
+}
+
+// Write stores a file in the store.
+func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
+	return s.writeStream(id, key, r)
+}
+
+// WriteDecrypt stores an encrypted file in the store.
+func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+	f, err := s.openFileForWriting(id, key)
+	if err != nil {
+		return 0, err
+	}
+	w, err := s.atRestWriter(f)
+	if err != nil {
+		return 0, s.commit(id, key, f, err, nil)
+	}
+	h := sha256.New()
+	n, err := crypto.CopyDecrypt(encKey, r, io.MultiWriter(w, h))
+	return int64(n), s.commit(id, key, f, err, h)
+}
+
+// openFileForWriting prepares a temporary file next to the final location of
+// the object. Data is only moved into place by commit once it was fully written.
+func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
+	pathKey, err := s.pathKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+	pathNameWithRoot := filepath.Join(s.Root, id, pathKey.PathName)
+	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(pathNameWithRoot, pathKey.Filename+".*.tmp")
+}
+
+// commit closes the temporary file f and, if writing it succeeded, renames it
+// over the object's final path and records the object in the index, with the
+// checksum of its contents hashed into h. The index logs the object before it
+// is renamed, so a crash in between can be told apart on the next start.
+// Renaming gives the object a fresh inode, so snapshots holding a hard link to
+// the previous version keep seeing the old contents.
+func (s *Store) commit(id string, key string, f *os.File, writeErr error, h hash.Hash) error {
+	tmpName := f.Name()
+
+	fi, err := f.Stat()
+	if err == nil && writeErr == nil && !s.NoSync {
+		err = f.Sync() // Make sure the data is on disk before it becomes visible
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if writeErr != nil {
+		err = writeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	pathKey := s.PathTransformFunc(key) // Validated by openFileForWriting already
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	if err := s.CheckWrite(id, key); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	meta := s.newMeta(id, key, fi.Size(), h)
+	if err := s.index.put(meta, func() error { return os.Rename(tmpName, fullPathWithRoot) }); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if !s.NoSync {
+		// Persist the rename itself, it lives in the directory entry
+		return syncDir(filepath.Dir(fullPathWithRoot))
+	}
+	return nil
+}
+
+// newMeta returns the metadata of the object written under key, taking up
+// diskSize bytes on disk, whose contents hashed into h. What belongs to the
+// key rather than to one version of the object is kept from the previous one.
+func (s *Store) newMeta(id string, key string, diskSize int64, h hash.Hash) ObjectMeta {
+	meta := ObjectMeta{
+		ID:       id,
+		Key:      key,
+		Size:     diskSize - s.atRestOverhead(),
+		DiskSize: diskSize,
+		ModTime:  time.Now(),
+		Content: &ContentManifest{
+			Checksum:   hex.EncodeToString(h.Sum(nil)),
+			Encryption: s.atRestCipher(),
+		},
+	}
+	if prev, ok := s.index.get(id, key); ok {
+		meta.Tags = prev.Tags // Tags belong to the key, not to one version of the object
+		meta.Tenant, meta.ACL = prev.Tenant, prev.ACL
+		meta.LastAccess, meta.Accesses = prev.LastAccess, prev.Accesses
+	}
+	return meta
+}
+
+// syncDir fsyncs the directory at path, persisting the entries created or renamed in it.
+func syncDir(path string) error {
+	// Windows can't fsync directories, renames there are durable once they return
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// removeTempFiles deletes the temporary files of unfinished writes below root.
+func removeTempFiles(root string) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".tmp") {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // Nothing written yet
+	}
+	return err
+}
+
+// writeStream writes data from a reader to a file, or to a pack if it is
+// small enough.
+func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+	if s.PackThreshold > 0 {
+		data, err := io.ReadAll(io.LimitReader(r, s.PackThreshold+1))
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) <= s.PackThreshold {
+			return s.writePacked(id, key, data)
+		}
+		r = io.MultiReader(bytes.NewReader(data), r)
+	}
+
+	f, err := s.openFileForWriting(id, key)
+	if err != nil {
+		return 0, err
+	}
+	w, err := s.atRestWriter(f)
+	if err != nil {
+		return 0, s.commit(id, key, f, err, nil)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	return n, s.commit(id, key, f, err, h)
+}
+
+// Read retrieves a file from the store, returning its size and a reader the
+// caller must close.
+func (s *Store) Read(id string, key string) (int64, io.ReadCloser, error) {
+	return s.readStream(id, key)
+}
+
+// readStream reads data from a file into a reader.
+func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
+	pathKey, err := s.pathKey(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size, r, packed, err := s.readPacked(id, key); packed {
+		return size, r, err
+	}
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+
+	file, err := os.Open(fullPathWithRoot)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	if s.MmapThreshold > 0 && fi.Size() >= s.MmapThreshold {
+		if m, err := mapFile(file, fi.Size()); err == nil {
+			file.Close() // The mapping outlives the file
+			if s.EncryptAtRest {
+				return s.atRestReader(m, fi.Size())
+			}
+			return fi.Size(), m, nil
+		}
+	}
+	if s.EncryptAtRest {
+		return s.atRestReader(file, fi.Size())
+	}
+
+	return fi.Size(), file, nil
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+)
+
+func TestPathTransformFunc(t *testing.T) {
+	key := "momsbestpicture"
+	pathKey := CASPathTransformFunc(key)
+	expectedFilename := "6804429f74181a63c50c3d81d733a12f14a353ff"
+	expectedPathName := filepath.FromSlash("68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff")
+	if pathKey.PathName != expectedPathName {
+		t.Errorf("have %s want %s", pathKey.PathName, expectedPathName)
+	}
+
+	if pathKey.Filename != expectedFilename {
+		t.Errorf("have %s want %s", pathKey.Filename, expectedFilename)
+	}
+}
+
+func TestPathKeyValidate(t *testing.T) {
+	valid := []string{"foo", "foo.txt", "dir/foo", "a/../b"}
+	for _, key := range valid {
+		if err := DefaultPathTransformFunc(key).validate(); err != nil {
+			t.Errorf("expected key %q to be valid, have %s", key, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "a/..", "../foo", "foo/../..", "/etc/passwd", "foo/../../bar"}
+	for _, key := range invalid {
+		if err := DefaultPathTransformFunc(key).validate(); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected key %q to be invalid, have %v", key, err)
+		}
+	}
+
+	// Content addressed paths are always fine, whatever the key.
+	for _, key := range invalid {
+		if err := CASPathTransformFunc(key).validate(); err != nil {
+			t.Errorf("expected CAS path of %q to be valid, have %s", key, err)
+		}
+	}
+}
+
+func TestStoreRejectsTraversal(t *testing.T) {
+	s := NewStore(StoreOpts{Root: filepath.Join(t.TempDir(), "root")})
+
+	if _, err := s.Write("id", "../../escaped", bytes.NewReader([]byte("data"))); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for key, have %v", err)
+	}
+	if _, err := s.Write("../escaped", "foo", bytes.NewReader([]byte("data"))); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for id, have %v", err)
+	}
+	if _, _, err := s.Read("id", "../../escaped"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey on read, have %v", err)
+	}
+	if err := s.Delete("id/..", "foo"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey on delete, have %v", err)
+	}
+	if s.Has("id", "../../escaped") {
+		t.Error("expected to NOT have an escaping key")
+	}
+
+	// Nothing may have been written next to the root.
+	entries, _ := os.ReadDir(filepath.Dir(s.Root))
+	if len(entries) > 1 {
+		t.Errorf("expected only the root directory, have %d entries", len(entries))
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		data := []byte("some jpg bytes")
+
+		if _, err := s.writeStream(id, key, bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+
+		if ok := s.Has(id, key); !ok {
+			t.Errorf("expected to have key %s", key)
+		}
+
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != string(data) {
+			t.Errorf("want %s have %s", data, b)
+		}
+
+		if err := s.Delete(id, key); err != nil {
+			t.Error(err)
+		}
+
+		if ok := s.Has(id, key); ok {
+			t.Errorf("expected to NOT have key %s", key)
+		}
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("version 1"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := t.TempDir()
+	info, err := s.Snapshot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Objects != 10 {
+		t.Errorf("want 10 objects in snapshot have %d", info.Objects)
+	}
+
+	// Changes after the snapshot must not leak into it.
+	if _, err := s.Write(id, "foo_0", bytes.NewReader([]byte("version 2"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "foo_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := NewStore(StoreOpts{
+		Root:              dst,
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		_, r, err := snap.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != "version 1" {
+			t.Errorf("want %s have %s", "version 1", b)
+		}
+		if _, ok := snap.index.get(id, key); !ok {
+			t.Errorf("expected snapshot index to have key %s", key)
+		}
+	}
+}
+
+func TestStoreInterruptedWrite(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	// A write failing halfway must not leave anything Has() would report.
+	r := io.MultiReader(bytes.NewReader([]byte("half a file")), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := s.Write(id, "foo", r); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if s.Has(id, "foo") {
+		t.Error("expected to NOT have key foo after a failed write")
+	}
+
+	// Temporary files left behind by a crash are removed when the store is opened.
+	pathKey := s.PathTransformFunc("foo")
+	dir := filepath.Join(s.Root, id, pathKey.PathName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, pathKey.Filename+".123.tmp")
+	if err := os.WriteFile(tmp, []byte("half a file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	NewStore(s.StoreOpts)
+	if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %s to be removed, have %v", tmp, err)
+	}
+	if s.Has(id, "foo") {
+		t.Error("expected to NOT have key foo")
+	}
+}
+
+// openFiles returns the number of file descriptors open in the process,
+// skipping the test where they can't be counted.
+func openFiles(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't count open files: %s", err)
+	}
+	return len(fds)
+}
+
+func TestStoreReadClose(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	_, err := s.writeStream(id, "key", bytes.NewReader([]byte("some jpg bytes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := openFiles(t)
+	for i := 0; i < 100; i++ {
+		_, r, err := s.Read(id, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d files leaked by 100 reads", after-before)
+	}
+}
+
+func newStore() *Store {
+	opts := StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	return NewStore(opts)
+}
+
+func teardown(t *testing.T, s *Store) {
+	if err := s.Clear(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPathKeyValidateWindows(t *testing.T) {
+	invalid := []string{`..\foo`, `foo\..\..\bar`, `C:\Windows\System32`, `C:foo`, `\\server\share\foo`, `NUL`, `foo\COM1`}
+	for _, key := range invalid {
+		if err := DefaultPathTransformFunc(key).validate(); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("expected key %q to be invalid, have %v", key, err)
+		}
+	}
+
+	if err := DefaultPathTransformFunc(`dir\foo`).validate(); err != nil {
+		t.Errorf("expected key to be valid, have %s", err)
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"sort"
+)
+
+// matchTags reports whether tags satisfy every tag of the query.
+func matchTags(query map[string]string, tags map[string]string) bool {
+	for k, want := range query {
+		have, ok := tags[k]
+		if !ok || (want != "*" && have != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTags replaces the tags of an object. An empty map removes all of them.
+func (s *Store) SetTags(id string, key string, tags map[string]string) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	if len(copied) == 0 {
+		copied = nil
+	}
+
+	return s.index.update(id, key, func(meta *ObjectMeta) {
+		meta.Tags = copied
+	})
+}
+
+// Search returns the metadata of every object in namespace id whose tags match query.
+func (s *Store) Search(id string, query map[string]string) []ObjectMeta {
+	var out []ObjectMeta
+	for _, meta := range s.index.snapshot() {
+		if meta.ID == id && len(meta.Tags) > 0 && matchTags(query, meta.Tags) {
+			out = append(out, meta)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
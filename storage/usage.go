@@ -0,0 +1,31 @@
+package storage
+
+// Usage is how much a namespace, or a whole store, holds. It is kept up to
+// date as objects are written and deleted, so asking for it is cheap.
+type Usage struct {
+	Objects       int64 `json:"objects"`        // Number of objects
+	LogicalBytes  int64 `json:"logical_bytes"`  // Size of the objects as read
+	PhysicalBytes int64 `json:"physical_bytes"` // Bytes the objects take up on disk, at rest encryption included
+}
+
+// Add returns the sum of u and o.
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		Objects:       u.Objects + o.Objects,
+		LogicalBytes:  u.LogicalBytes + o.LogicalBytes,
+		PhysicalBytes: u.PhysicalBytes + o.PhysicalBytes,
+	}
+}
+
+// diskSize returns how many bytes the object takes up on disk.
+func (m ObjectMeta) diskSize() int64 {
+	if m.DiskSize > 0 {
+		return m.DiskSize
+	}
+	return m.Size
+}
+
+// Usage returns the usage of namespace id.
+func (s *Store) Usage(id string) Usage {
+	return s.index.usageOf(id)
+}
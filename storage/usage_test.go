@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreUsage(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncryptAtRest: true, EncKey: crypto.NewEncryptionKey()})
+	assert.Zero(t, s.Usage("a"))
+
+	for _, key := range []string{"one", "two"} {
+		_, err := s.Write("a", key, strings.NewReader("0123456789"))
+		require.NoError(t, err)
+	}
+	_, err := s.Write("b", "one", strings.NewReader("01234"))
+	require.NoError(t, err)
+
+	// Encrypted objects take up their IV on disk too.
+	assert.Equal(t, Usage{Objects: 2, LogicalBytes: 20, PhysicalBytes: 52}, s.Usage("a"))
+	assert.Equal(t, Usage{Objects: 1, LogicalBytes: 5, PhysicalBytes: 21}, s.Usage("b"))
+
+	// Rewrites replace the object, deletes take it away.
+	_, err = s.Write("a", "one", strings.NewReader("01234"))
+	require.NoError(t, err)
+	require.NoError(t, s.Delete("a", "two"))
+	require.NoError(t, s.SetTags("a", "one", map[string]string{"kept": "yes"}))
+	assert.Equal(t, Usage{Objects: 1, LogicalBytes: 5, PhysicalBytes: 21}, s.Usage("a"))
+
+	// The usage is rebuilt from the index when the store is opened again.
+	reopened := NewStore(s.StoreOpts)
+	assert.Equal(t, s.Usage("a"), reopened.Usage("a"))
+	assert.Equal(t, s.Usage("b"), reopened.Usage("b"))
+
+	require.NoError(t, s.Delete("b", "one"))
+	assert.Zero(t, s.Usage("b"))
+	assert.NotContains(t, s.index.usageByNamespace(), "b")
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	walPut    = "put"    // Record adding or replacing the metadata of an object
+	walRemove = "remove" // Record dropping an object from the index
+
+	// indexCompactRecords is how many records the write-ahead log of the
+	// index may hold before the index is compacted right away.
+	indexCompactRecords = 1000
+)
+
+// walRecord is a change of the metadata index, as appended to its write-ahead
+// log. Changes are logged before the objects they describe are moved into
+// place or deleted, so a crash in between leaves a record of what was about
+// to happen, checked against the objects on the next start.
+type walRecord struct {
+	Op   string      `json:"op"`             // walPut or walRemove
+	Meta ObjectMeta  `json:"meta"`           // Metadata put, or of the object removed
+	Prev *ObjectMeta `json:"prev,omitempty"` // Metadata replaced by a put, nil if there was none
+}
+
+// walPath returns the path of the write-ahead log of the index persisted at path.
+func walPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".wal"
+}
+
+// log appends rec to the write-ahead log, fsyncing it unless the store
+// doesn't. The caller must hold ix.mu.
+func (ix *metaIndex) log(rec walRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	path := walPath(ix.path)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		ix.err = err
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		ix.err = err
+		return err
+	}
+	_, err = f.Write(append(buf, '\n'))
+	if err == nil && ix.sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && ix.sync && ix.logged == 0 {
+		err = syncDir(filepath.Dir(path)) // The log was just created
+	}
+
+	ix.err = err
+	if err == nil {
+		ix.logged++
+	}
+	return err
+}
+
+// replay applies the records of the write-ahead log to the index loaded from
+// its file. A record torn by a crash while it was appended ends the log and is
+// cut off it.
+func (ix *metaIndex) replay() error {
+	path := walPath(ix.path)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ix.replayed = make(map[indexKey]walRecord)
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		var rec walRecord
+		if err != nil || json.Unmarshal(line, &rec) != nil {
+			log.Printf("dropping torn record at offset %d of the index log", offset)
+			return os.Truncate(path, offset)
+		}
+		offset += int64(len(line))
+
+		ix.apply(rec)
+		ix.replayed[indexKey{rec.Meta.ID, rec.Meta.Key}] = rec
+		ix.logged++
+	}
+}
+
+// apply makes the change rec records. The caller must hold ix.mu.
+func (ix *metaIndex) apply(rec walRecord) {
+	k := indexKey{rec.Meta.ID, rec.Meta.Key}
+	if prev, ok := ix.entries[k]; ok {
+		delete(ix.entries, k)
+		ix.account(prev, -1)
+	}
+	if rec.Op == walPut {
+		ix.entries[k] = rec.Meta
+		ix.account(rec.Meta, 1)
+	}
+}
+
+// compactIfDue compacts the index once the write-ahead log grew long. The
+// change just logged is safe either way, so failing to compact is only
+// recorded for the health checks. The caller must hold ix.mu.
+func (ix *metaIndex) compactIfDue() error {
+	if ix.logged < indexCompactRecords {
+		return nil
+	}
+	if err := ix.save(); err != nil {
+		log.Printf("could not compact metadata index: %s", err)
+	}
+	return nil
+}
+
+// compact persists the whole index and drops its write-ahead log, if it
+// changed since the last compaction.
+func (ix *metaIndex) compact() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.logged == 0 && !ix.dirty {
+		return nil
+	}
+	return ix.save()
+}
+
+// removeWAL deletes the write-ahead log at path, if there is one.
+func removeWAL(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// recoverIndex checks the objects the replayed write-ahead log changed
+// against the disk and compacts the index. Objects logged but never moved into
+// place are dropped from the index, or get their previous metadata back if
+// the previous version is still there, and objects logged as removed or
+// packed but still in a file of their own have the file deleted.
+func (s *Store) recoverIndex() {
+	ix := s.index
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for k, rec := range ix.replayed {
+		pathKey, err := s.pathKey(k.id, k.key)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(s.Root, k.id, pathKey.FullPath())
+		fi, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("could not check (%s) against the metadata index: %s", k.key, err)
+			continue
+		}
+
+		// Packed objects are on disk once their pack holds them; the file of
+		// their previous version, if any, is removed once they are indexed.
+		onDisk := func(meta ObjectMeta) bool {
+			if meta.Pack != nil {
+				return s.packHolds(*meta.Pack)
+			}
+			return err == nil && fi.Size() == meta.diskSize()
+		}
+		meta, ok := ix.entries[k]
+		switch {
+		case !ok && err == nil:
+			log.Printf("finishing the interrupted delete of (%s)", k.key)
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("could not delete (%s): %s", k.key, err)
+				continue
+			}
+			removeEmptyDirs(filepath.Dir(path), filepath.Join(s.Root, k.id))
+		case ok && !onDisk(meta):
+			if rec.Prev != nil && onDisk(*rec.Prev) {
+				log.Printf("restoring the metadata of (%s), its write was interrupted", k.key)
+				ix.apply(walRecord{Op: walPut, Meta: *rec.Prev})
+			} else {
+				log.Printf("dropping (%s) from the metadata index, its write was interrupted", k.key)
+				ix.apply(walRecord{Op: walRemove, Meta: meta})
+			}
+		case ok && meta.Pack != nil && err == nil:
+			log.Printf("finishing the interrupted packing of (%s)", k.key)
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("could not delete the file of (%s): %s", k.key, err)
+				continue
+			}
+			removeEmptyDirs(filepath.Dir(path), filepath.Join(s.Root, k.id))
+		}
+	}
+	ix.replayed = nil
+
+	if ix.logged > 0 {
+		if err := ix.save(); err != nil {
+			log.Printf("could not compact metadata index: %s", err)
+		}
+	}
+}
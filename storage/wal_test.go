@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logRecord appends rec to the write-ahead log of s without applying it, as
+// if the store crashed right after logging it.
+func logRecord(t *testing.T, s *Store, rec walRecord) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	require.NoError(t, s.index.log(rec))
+}
+
+func TestIndexWAL(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), NoSync: true})
+	for _, key := range []string{"a", "b"} {
+		_, err := s.Write("id", key, bytes.NewReader([]byte(key)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.SetTags("id", "a", map[string]string{"k": "v"}))
+	require.NoError(t, s.Delete("id", "b"))
+
+	// Changes are appended to the log instead of rewriting the index.
+	assert.NoFileExists(t, filepath.Join(s.Root, indexFileName))
+	assert.FileExists(t, walPath(s.index.path))
+
+	// They are replayed on the next start, and the index compacted.
+	reopened := NewStore(s.StoreOpts)
+	meta, ok := reopened.index.get("id", "a")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"k": "v"}, meta.Tags)
+	_, ok = reopened.index.get("id", "b")
+	assert.False(t, ok)
+	assert.Equal(t, Usage{Objects: 1, LogicalBytes: 1, PhysicalBytes: 1}, reopened.Usage("id"))
+	assert.FileExists(t, filepath.Join(s.Root, indexFileName))
+	assert.NoFileExists(t, walPath(s.index.path))
+
+	// Long logs are compacted right away.
+	for i := 0; i < indexCompactRecords; i++ {
+		_, err := reopened.Write("id", fmt.Sprintf("key_%d", i), bytes.NewReader([]byte("data")))
+		require.NoError(t, err)
+	}
+	assert.NoFileExists(t, walPath(s.index.path))
+	assert.Len(t, NewStore(s.StoreOpts).index.snapshot(), indexCompactRecords+1)
+}
+
+func TestIndexRecovery(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), NoSync: true})
+	for _, key := range []string{"kept", "deleted"} {
+		_, err := s.Write("id", key, bytes.NewReader([]byte(key)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.index.compact())
+	kept, _ := s.index.get("id", "kept")
+	deleted, _ := s.index.get("id", "deleted")
+
+	// Crashes after logging writes that never moved their object into place,
+	rewritten := kept
+	rewritten.Size, rewritten.DiskSize = 100, 100
+	logRecord(t, s, walRecord{Op: walPut, Meta: rewritten, Prev: &kept})
+	logRecord(t, s, walRecord{Op: walPut, Meta: ObjectMeta{ID: "id", Key: "unwritten", Size: 4, DiskSize: 4}})
+	// a delete that didn't delete the object,
+	logRecord(t, s, walRecord{Op: walRemove, Meta: deleted})
+	// and while appending a record.
+	f, err := os.OpenFile(walPath(s.index.path), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"put","meta":{"id":"id","key":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened := NewStore(s.StoreOpts)
+	meta, ok := reopened.index.get("id", "kept")
+	assert.True(t, ok)
+	assert.Equal(t, kept.Content, meta.Content, "the previous version is still there")
+	assert.Equal(t, int64(len("kept")), meta.Size)
+	_, ok = reopened.index.get("id", "unwritten")
+	assert.False(t, ok)
+	_, ok = reopened.index.get("id", "torn")
+	assert.False(t, ok)
+	_, ok = reopened.index.get("id", "deleted")
+	assert.False(t, ok)
+	assert.False(t, reopened.Has("id", "deleted"))
+	assert.NoFileExists(t, walPath(s.index.path))
+}
@@ -1,183 +1,94 @@
-package main
+package dfs
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
-	"errors"
-	"fmt"
 	"io"
-	"log"
-	"os"
-	"strings"
-)
-
-// defaultRootFolderName is the default name for the root storage folder.
-const defaultRootFolderName = "ggnetwork"
-
-// CASPathTransformFunc implements a Content-Addressable Storage (CAS) path transformation.
-// It creates a unique file path based on the SHA1 hash of the key.
-func CASPathTransformFunc(key string) PathKey {
-	// Generate SHA1 hash of the key
-	hash := sha1.Sum([]byte(key))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Create a path structure by splitting the hash into blocks
-	blocksize := 5
-	sliceLen := len(hashStr) / blocksize
-	paths := make([]string, sliceLen)
-
-	for i := 0; i < sliceLen; i++ {
-		from, to := i*blocksize, (i*blocksize)+blocksize
-		paths[i] = hashStr[from:to]
-	}
-
-	// Return the PathKey structure
-	return PathKey{
-		PathName: strings.Join(paths, "/"),
-		Filename: hashStr,
-	}
-}
+	"iter"
+	"time"
 
-// PathTransformFunc is a type for functions that transform keys into file paths.
-type PathTransformFunc func(string) PathKey
-
-// PathKey represents a transformed file path and filename.
-type PathKey struct {
-	PathName string
-	Filename string
-}
-
-// FirstPathName returns the first component of the path.
-func (p PathKey) FirstPathName() string {
-	paths := strings.Split(p.PathName, "/")
-	if len(paths) == 0 {
-		return ""
-	}
-	return paths[0]
-}
-
-// FullPath returns the complete path including filename.
-func (p PathKey) FullPath() string {
-	return fmt.Sprintf("%s/%s", p.PathName, p.Filename)
-}
-
-// StoreOpts contains options for configuring the Store.
-type StoreOpts struct {
-	Root              string
-	PathTransformFunc PathTransformFunc
-}
-
-// DefaultPathTransformFunc is a simple path transform function that uses the key directly.
-var DefaultPathTransformFunc = func(key string) PathKey {
-	return PathKey{
-		PathName: key,
-		Filename: key,
-	}
-}
-
-// Store represents the file storage system.
-type Store struct {
-	StoreOpts
-}
-
-// NewStore creates a new Store with the given options.
-func NewStore(opts StoreOpts) *Store {
-	// Set default values if not provided
-	if opts.PathTransformFunc == nil {
-		opts.PathTransformFunc = DefaultPathTransformFunc
-	}
-	if len(opts.Root) == 0 {
-		opts.Root = defaultRootFolderName
-	}
-
-	return &Store{
-		StoreOpts: opts,
-	}
-}
-
-// Has checks if a file exists in the store.
-func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
-}
-
-// Clear removes all files from the store.
-func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
-}
-
-// Delete removes a file from the store.
-func (s *Store) Delete(id string, key string) error {
-	pathKey := s.PathTransformFunc(key)
-
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathKey.Filename)
-	}()
-
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
-
-	return os.RemoveAll(firstPathNameWithRoot)
-}
-
-// Write stores a file in the store.
-func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
-}
-
-// WriteDecrypt stores an encrypted file in the store.
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
-}
-
-// openFileForWriting prepares a file for writing.
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
-	}
-
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	return os.Create(fullPathWithRoot)
-}
-
-// writeStream writes data from a reader to a file.
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	return io.Copy(f, r)
-}
-
-// Read retrieves a file from the store.
-func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
-}
-
-// readStream reads data from a file into a reader.
-func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	file, err := os.Open(fullPathWithRoot)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	fi, err := file.Stat()
-	if err != nil {
-		return 0, nil, err
-	}
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
 
-	return fi.Size(), file, nil
-}
+// Store is the local storage a FileServer keeps its files and the replicas of
+// its peers in, namespaced by the ID of the node owning them. It is made up
+// of the capabilities the server relies on, so servers can be run over
+// storage other than a storage.Store, such as the in-memory one of package
+// storagetest. See FileServerOpts.Storage.
+type Store interface {
+	ObjectStore
+	MetaStore
+	Maintainer
+}
+
+// ObjectStore reads and writes objects.
+type ObjectStore interface {
+	// Has reports whether the object stored under key in namespace id exists.
+	Has(id string, key string) bool
+	// Read opens the object, returning its size.
+	Read(id string, key string) (int64, io.ReadCloser, error)
+	// Write stores r as the object, replacing any previous one, and returns
+	// the number of bytes written.
+	Write(id string, key string, r io.Reader) (int64, error)
+	// Delete removes the object. Deleting an object that doesn't exist isn't
+	// an error.
+	Delete(id string, key string) error
+	// Clear removes every object.
+	Clear() error
+}
+
+// MetaStore indexes objects, and keeps their metadata and what they use.
+type MetaStore interface {
+	// Meta returns the metadata of the object, false if it doesn't exist.
+	Meta(id string, key string) (storage.ObjectMeta, bool)
+	// UpdateMeta changes the metadata of the object with fn.
+	UpdateMeta(id string, key string, fn func(*storage.ObjectMeta)) error
+	// Touch records that the object was read at t.
+	Touch(id string, key string, t time.Time)
+	// Objects iterates over the metadata of every object.
+	Objects() iter.Seq[storage.ObjectMeta]
+	// Len returns the number of objects.
+	Len() int
+
+	// CheckWrite returns storage.ErrImmutable if the object can't be written.
+	CheckWrite(id string, key string) error
+	// CheckDelete returns storage.ErrImmutable if the object can't be deleted
+	// at now.
+	CheckDelete(id string, key string, now time.Time) error
+	// SetRetention places the object under retention r.
+	SetRetention(id string, key string, r storage.Retention) error
+	// SetTags replaces the tags of the object.
+	SetTags(id string, key string, tags map[string]string) error
+	// Search returns the objects in namespace id carrying every tag of query.
+	Search(id string, query map[string]string) []storage.ObjectMeta
+	// SetContent records what the object holds.
+	SetContent(id string, key string, m storage.ContentManifest) error
+
+	// UsageByNamespace returns what the objects of every namespace use.
+	UsageByNamespace() map[string]storage.Usage
+	// UsageOfTenant returns what the objects of tenant use.
+	UsageOfTenant(tenant string) storage.Usage
+	// UsageByTenant returns what the objects of every tenant use.
+	UsageByTenant() map[string]storage.Usage
+}
+
+// Maintainer checks, compacts and archives a store.
+type Maintainer interface {
+	// Health returns why the index last failed to load or persist, nil if
+	// it didn't.
+	Health() error
+	// CompactIndex persists the whole index, dropping its write-ahead log.
+	CompactIndex() error
+	// Fsck checks the objects against the index, repairing it if told to.
+	Fsck(repair bool) (storage.FsckReport, error)
+	// Repack garbage collects the packs small objects are kept in.
+	Repack() (storage.RepackReport, error)
+	// Snapshot writes a point-in-time copy of the store to dst.
+	Snapshot(dst string) (storage.SnapshotInfo, error)
+	// Export writes every object last written at since or later to w as an
+	// archive exported from node, which Import reads.
+	Export(w io.Writer, node string, since time.Time) (storage.ArchiveInfo, error)
+	// Import stores the objects of an archive written by Export.
+	Import(r io.Reader) (storage.ArchiveInfo, error)
+}
+
+// storage.Store implements Store.
+var _ Store = (*storage.Store)(nil)
@@ -0,0 +1,187 @@
+package dfs
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// errStreamsBusy fails streams that waited longer than the request
+	// timeout for their turn under MaxStreams and MaxPeerStreams.
+	errStreamsBusy = errors.New("too many streams open, gave up waiting for a turn")
+	// errStreamsStopped fails streams waiting for their turn when the server stops.
+	errStreamsStopped = errors.New("server stopped while the stream waited for a turn")
+)
+
+// streamLimiter caps the streams handled at once, overall and per peer.
+// Streams over either limit wait in the queue of their peer. Whenever a
+// stream ends, the peers with streams waiting take turns starting theirs,
+// so a peer opening many streams waits on its own ones instead of crowding
+// out the others.
+type streamLimiter struct {
+	max     int // Streams at once overall, unlimited if zero
+	perPeer int // Streams at once per peer, unlimited if zero
+
+	mu     sync.Mutex
+	active int
+	peers  map[string]*streamQueue
+	turns  []string // Peers with streams waiting, in the order they get their turn
+}
+
+// streamQueue holds the streams of a single peer.
+type streamQueue struct {
+	active  int
+	waiting []chan struct{} // Closed when the stream gets its turn
+}
+
+// StreamStats are the counters of a stream limiter.
+type StreamStats struct {
+	Active  int `json:"active"`  // Streams being handled
+	Waiting int `json:"waiting"` // Streams waiting for their turn
+}
+
+// newStreamLimiter returns a limiter of max streams at once, perPeer of a
+// single peer, or nil if neither is limited.
+func newStreamLimiter(max int, perPeer int) *streamLimiter {
+	if max <= 0 && perPeer <= 0 {
+		return nil
+	}
+	return &streamLimiter{max: max, perPeer: perPeer, peers: make(map[string]*streamQueue)}
+}
+
+// acquire waits for the turn of a stream of peer, at most timeout or until
+// quit closes. The function returned ends the stream; calling it again does
+// nothing.
+func (l *streamLimiter) acquire(peer string, timeout time.Duration, quit <-chan struct{}) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	q := l.queue(peer)
+	if len(q.waiting) == 0 && l.free(q) {
+		l.start(q)
+		l.mu.Unlock()
+		return l.ender(peer), nil
+	}
+	turn := make(chan struct{})
+	q.waiting = append(q.waiting, turn)
+	if len(q.waiting) == 1 {
+		l.turns = append(l.turns, peer)
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-turn:
+		return l.ender(peer), nil
+	case <-timer.C:
+		err = errStreamsBusy
+	case <-quit:
+		err = errStreamsStopped
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-turn:
+		l.end(peer) // Got its turn meanwhile, which goes to the next
+	default:
+		q.waiting = slices.DeleteFunc(q.waiting, func(c chan struct{}) bool { return c == turn })
+		if len(q.waiting) == 0 {
+			l.turns = slices.DeleteFunc(l.turns, func(p string) bool { return p == peer })
+		}
+		l.forget(peer, q)
+	}
+	return nil, err
+}
+
+// stats returns the streams being handled and waiting.
+func (l *streamLimiter) stats() StreamStats {
+	if l == nil {
+		return StreamStats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := StreamStats{Active: l.active}
+	for _, q := range l.peers {
+		stats.Waiting += len(q.waiting)
+	}
+	return stats
+}
+
+// queue returns the queue of peer, added if it has none.
+func (l *streamLimiter) queue(peer string) *streamQueue {
+	q, ok := l.peers[peer]
+	if !ok {
+		q = &streamQueue{}
+		l.peers[peer] = q
+	}
+	return q
+}
+
+// free reports whether a stream of q may start now.
+func (l *streamLimiter) free(q *streamQueue) bool {
+	return (l.max <= 0 || l.active < l.max) && (l.perPeer <= 0 || q.active < l.perPeer)
+}
+
+// start counts a stream of q as started.
+func (l *streamLimiter) start(q *streamQueue) {
+	l.active++
+	q.active++
+}
+
+// ender returns the function ending a stream of peer once.
+func (l *streamLimiter) ender(peer string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.end(peer)
+		})
+	}
+}
+
+// end counts a stream of peer as ended and starts the streams now allowed to.
+func (l *streamLimiter) end(peer string) {
+	q := l.peers[peer]
+	l.active--
+	q.active--
+	l.forget(peer, q)
+	l.dispatch()
+}
+
+// forget drops the queue of peer once it has no stream left.
+func (l *streamLimiter) forget(peer string, q *streamQueue) {
+	if q.active == 0 && len(q.waiting) == 0 {
+		delete(l.peers, peer)
+	}
+}
+
+// dispatch starts waiting streams while the limits allow, one per peer in
+// turn: a peer starting a stream goes to the back of the line.
+func (l *streamLimiter) dispatch() {
+	for i := 0; i < len(l.turns) && (l.max <= 0 || l.active < l.max); {
+		peer := l.turns[i]
+		q := l.peers[peer]
+		if !l.free(q) {
+			i++ // At its own limit, the next peer goes
+			continue
+		}
+
+		turn := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		l.start(q)
+		close(turn)
+
+		l.turns = slices.Delete(l.turns, i, i+1)
+		if len(q.waiting) > 0 {
+			l.turns = append(l.turns, peer)
+		}
+	}
+}
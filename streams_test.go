@@ -0,0 +1,71 @@
+package dfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	assert.Nil(t, newStreamLimiter(0, 0))
+	var unlimited *streamLimiter
+	end, err := unlimited.acquire("a", time.Second, nil)
+	require.NoError(t, err)
+	end()
+	assert.Equal(t, StreamStats{}, unlimited.stats())
+
+	l := newStreamLimiter(3, 2)
+	endA1, err := l.acquire("a", time.Second, nil)
+	require.NoError(t, err)
+	endA2, err := l.acquire("a", time.Second, nil)
+	require.NoError(t, err)
+
+	// A peer at its own limit waits, even with streams to spare overall.
+	_, err = l.acquire("a", 10*time.Millisecond, nil)
+	assert.ErrorIs(t, err, errStreamsBusy)
+	endB1, err := l.acquire("b", time.Second, nil)
+	require.NoError(t, err)
+	assert.Equal(t, StreamStats{Active: 3}, l.stats())
+
+	// So do peers once every stream is taken.
+	quit := make(chan struct{})
+	close(quit)
+	_, err = l.acquire("c", time.Second, quit)
+	assert.ErrorIs(t, err, errStreamsStopped)
+
+	endA1()
+	endA2()
+	endB1()
+	endB1() // Ending it again does nothing
+	assert.Equal(t, StreamStats{}, l.stats())
+	assert.Empty(t, l.peers)
+
+	// Streams ending go to the waiting peers in turn: a peer with many
+	// streams waiting gets one, then the next peer gets its go.
+	l = newStreamLimiter(1, 0)
+	end, err = l.acquire("b", time.Second, nil)
+	require.NoError(t, err)
+	started := make(chan string)
+	for i, peer := range []string{"a", "a", "a", "c"} {
+		go func() {
+			end, err := l.acquire(peer, 5*time.Second, nil)
+			if assert.NoError(t, err) {
+				started <- peer
+				end()
+			}
+		}()
+		// Queue them in order.
+		assert.Eventually(t, func() bool { return l.stats().Waiting == i+1 }, time.Second, time.Millisecond)
+	}
+	assert.Equal(t, StreamStats{Active: 1, Waiting: 4}, l.stats())
+	end()
+	var order []string
+	for range 4 {
+		order = append(order, <-started)
+	}
+	assert.Equal(t, []string{"a", "c", "a", "a"}, order)
+	assert.Eventually(t, func() bool { return l.stats() == StreamStats{} }, time.Second, time.Millisecond)
+	assert.Empty(t, l.turns)
+}
@@ -0,0 +1,413 @@
+package dfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	defaultSwarmMinSize   = 64 << 20 // Smallest replica downloaded in swarm mode unless SwarmOpts says otherwise
+	defaultSwarmPieceSize = 4 << 20  // Size of the pieces unless SwarmOpts says otherwise
+	defaultSwarmParallel  = 4        // Pieces fetched at once unless SwarmOpts says otherwise
+)
+
+// errNoSwarm is returned by swarmFetch for files better fetched from a
+// single peer, too small or held by one peer only.
+var errNoSwarm = errors.New("not worth a swarm")
+
+// SwarmOpts configures downloading large files from many peers at once, like
+// BitTorrent.
+//
+// Before fetching a file, every peer is asked whether it holds it. Replicas
+// of at least MinSize bytes that more than one peer can send are split into
+// pieces of PieceSize bytes, fetched Parallel at a time from different peers,
+// rarest first. Servers downloading a file in swarm mode advertise the
+// pieces they completed in their answers, and serve them to other
+// downloaders, so many servers fetching the same popular file, such as one of
+// a group or a share bundle, take load off the peers holding its replicas.
+//
+// Fetches ask every peer once more than they would otherwise, for the size
+// of the file.
+type SwarmOpts struct {
+	MinSize   int64 // Smallest replica fetched in swarm mode (default 64 MiB)
+	PieceSize int64 // Size of the pieces (default 4 MiB)
+	Parallel  int   // Pieces fetched at once (default 4)
+}
+
+// pieceSet is a bitfield of the pieces of a file, bit i set once piece i is
+// complete.
+type pieceSet []byte
+
+func newPieceSet(n int) pieceSet {
+	return make(pieceSet, (n+7)/8)
+}
+
+// has reports whether piece i is in the set.
+func (ps pieceSet) has(i int) bool {
+	return i/8 < len(ps) && ps[i/8]&(1<<(i%8)) != 0
+}
+
+// add adds piece i to the set.
+func (ps pieceSet) add(i int) {
+	ps[i/8] |= 1 << (i % 8)
+}
+
+// swarmDownload is a file being downloaded in swarm mode, assembled in a
+// temporary file laid out like the replica: the IV followed by the ciphertext.
+type swarmDownload struct {
+	size      int64 // Size of the replica, IV included
+	pieceSize int64
+	pieces    int
+	file      *os.File
+
+	mu       sync.Mutex
+	have     pieceSet // Pieces written to file
+	complete int      // Number of pieces in have
+}
+
+// pieceRange returns the plaintext offset and length of piece i.
+func (d *swarmDownload) pieceRange(i int) (int64, int64) {
+	off := int64(i) * d.pieceSize
+	return off, min(d.pieceSize, d.size-crypto.IVSize-off)
+}
+
+// snapshot returns a copy of the pieces completed.
+func (d *swarmDownload) snapshot() pieceSet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(pieceSet(nil), d.have...)
+}
+
+// covers reports whether the pieces completed hold the plaintext range
+// [off, off+n).
+func (d *swarmDownload) covers(off int64, n int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.complete == 0 || off < 0 || n < 0 || off+n > d.size-crypto.IVSize {
+		return false // The IV came with the first piece
+	}
+	for i := int(off / d.pieceSize); int64(i)*d.pieceSize < off+n; i++ {
+		if !d.have.has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// swarmTable holds the swarm downloads in progress, by namespace and hashed
+// key. The zero value is ready to use.
+type swarmTable struct {
+	mu        sync.Mutex
+	downloads map[string]*swarmDownload
+}
+
+func (t *swarmTable) get(id string, key string) *swarmDownload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.downloads[id+"/"+key]
+}
+
+// start registers the download d of the replica stored under key by id,
+// returning false if the replica is being downloaded already.
+func (t *swarmTable) start(id string, key string, d *swarmDownload) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.downloads == nil {
+		t.downloads = make(map[string]*swarmDownload)
+	}
+	if _, ok := t.downloads[id+"/"+key]; ok {
+		return false
+	}
+	t.downloads[id+"/"+key] = d
+	return true
+}
+
+func (t *swarmTable) finish(id string, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.downloads, id+"/"+key)
+}
+
+// swarmSource is a peer a swarm download can fetch pieces from.
+type swarmSource struct {
+	peer   p2p.Peer
+	pieces pieceSet // Pieces the peer holds, nil if it holds the whole replica
+	busy   int      // Pieces being fetched from the peer
+	failed bool     // Left out for the rest of the round
+}
+
+func (src *swarmSource) has(i int) bool {
+	return src.pieces == nil || src.pieces.has(i)
+}
+
+// swarmSources asks every multiplexed peer whether it holds the replica
+// stored under key by id, returning the peers holding it or part of it, and
+// the size of the replica.
+func (s *FileServer) swarmSources(id string, key string) ([]*swarmSource, int64) {
+	peers := s.peerList()
+	answers := make(chan hasFileAnswer, len(peers))
+	asked := 0
+	for _, peer := range peers {
+		stream, err := s.openStream(peer)
+		if err != nil {
+			continue // Legacy peers can't be asked
+		}
+		asked++
+		go func() {
+			defer stream.Close()
+			reply, err := hasFile(stream, id, key)
+			answers <- hasFileAnswer{peer: peer, reply: reply, err: err}
+		}()
+	}
+
+	var (
+		sources []*swarmSource
+		size    int64
+	)
+	for ; asked > 0; asked-- {
+		a := <-answers
+		switch {
+		case a.err != nil:
+		case a.reply.Has:
+			sources = append(sources, &swarmSource{peer: a.peer})
+			size = a.reply.Size
+		case a.reply.Pieces != nil:
+			sources = append(sources, &swarmSource{peer: a.peer, pieces: a.reply.Pieces})
+			if size == 0 {
+				size = a.reply.Size
+			}
+		}
+	}
+	return sources, size
+}
+
+// swarmFetch downloads the replica req asks for in swarm mode and hands it
+// to write like fetchContext, returning the addresses of the peers it came
+// from. It returns errNoSwarm for replicas better fetched from one peer.
+func (s *FileServer) swarmFetch(ctx context.Context, req MessageGetFile, progress *progressTracker, write func(r io.Reader, size int64, from string) (int64, error)) (string, int64, error) {
+	minSize, pieceSize, parallel := s.Swarm.MinSize, s.Swarm.PieceSize, s.Swarm.Parallel
+	if minSize <= 0 {
+		minSize = defaultSwarmMinSize
+	}
+	if pieceSize <= 0 {
+		pieceSize = defaultSwarmPieceSize
+	}
+	if parallel <= 0 {
+		parallel = defaultSwarmParallel
+	}
+
+	sources, size := s.swarmSources(req.ID, req.Key)
+	if len(sources) < 2 || size < minSize || size <= crypto.IVSize {
+		return "", 0, errNoSwarm
+	}
+
+	file, err := os.CreateTemp("", "dfs-swarm-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	d := &swarmDownload{size: size, pieceSize: pieceSize, file: file}
+	d.pieces = int((size - crypto.IVSize + pieceSize - 1) / pieceSize)
+	d.have = newPieceSet(d.pieces)
+	if !s.swarms.start(req.ID, req.Key, d) {
+		return "", 0, errNoSwarm // Fetched by another Get, which fetch waits for
+	}
+	defer s.swarms.finish(req.ID, req.Key)
+
+	from := make(map[string]bool)
+	for round := 0; ; round++ {
+		if round > 0 {
+			// Downloaders asked before have more pieces by now
+			if sources, _ = s.swarmSources(req.ID, req.Key); len(sources) == 0 {
+				return "", 0, fmt.Errorf("[%s] %w: no peer holds (%s) anymore", s.Transport.Addr(), ErrPeerUnavailable, req.Key)
+			}
+		}
+		fetched, err := s.swarmRound(ctx, req, d, sources, parallel, progress, from)
+		if err != nil {
+			return "", 0, err
+		}
+		if d.complete == d.pieces {
+			break
+		}
+		if fetched == 0 {
+			return "", 0, fmt.Errorf("[%s] %w: no peer served the %d missing pieces of (%s)", s.Transport.Addr(), ErrPeerUnavailable, d.pieces-d.complete, req.Key)
+		}
+	}
+
+	addrs := make([]string, 0, len(from))
+	for addr := range from {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Printf("[%s] received (%d) bytes of (%s) from a swarm of %d peers\n", s.Transport.Addr(), size, req.Key, len(addrs))
+
+	n, err := write(io.NewSectionReader(file, 0, size), size, strings.Join(addrs, ","))
+	return strings.Join(addrs, ","), n, err
+}
+
+// swarmRound fetches the missing pieces of d the sources hold, rarest first,
+// parallel pieces at a time, each from the least busy source holding it.
+// Sources failing are left out for the rest of the round. It returns the
+// number of pieces fetched and adds the addresses of the peers they came
+// from to from.
+func (s *FileServer) swarmRound(ctx context.Context, req MessageGetFile, d *swarmDownload, sources []*swarmSource, parallel int, progress *progressTracker, from map[string]bool) (int, error) {
+	// Rarest first, so the pieces few peers hold spread before those go away
+	have := d.snapshot()
+	count := make([]int, d.pieces)
+	var missing []int
+	for i := 0; i < d.pieces; i++ {
+		for _, src := range sources {
+			if src.has(i) {
+				count[i]++
+			}
+		}
+		if !have.has(i) && count[i] > 0 {
+			missing = append(missing, i)
+		}
+	}
+	sort.SliceStable(missing, func(a, b int) bool { return count[missing[a]] < count[missing[b]] })
+
+	var (
+		mu      sync.Mutex
+		cond    = sync.NewCond(&mu)
+		fetched int
+		wg      sync.WaitGroup
+	)
+	// pick returns the least busy source holding piece i once it has room
+	// for another piece, nil if none is left.
+	pick := func(i int) *swarmSource {
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			var best *swarmSource
+			for _, src := range sources {
+				if !src.failed && src.has(i) && (best == nil || src.busy < best.busy) {
+					best = src
+				}
+			}
+			if best == nil || ctx.Err() != nil {
+				return nil
+			}
+			if best.busy < max(1, parallel/len(sources)) {
+				best.busy++
+				return best
+			}
+			cond.Wait()
+		}
+	}
+
+	sem := make(chan struct{}, parallel)
+	for _, i := range missing {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			for {
+				src := pick(i)
+				if src == nil {
+					return // Left for the next round
+				}
+				addr := src.peer.RemoteAddr().String()
+				err := s.fetchPiece(src.peer, req, d, i, progress)
+
+				mu.Lock()
+				src.busy--
+				if err != nil {
+					log.Printf("[%s] fetching piece %d of (%s) from (%s) failed: %s", s.Transport.Addr(), i, req.Key, addr, err)
+					src.failed = true
+				} else {
+					fetched++
+					from[addr] = true
+				}
+				cond.Broadcast()
+				mu.Unlock()
+				if err == nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return fetched, ctx.Err()
+}
+
+// fetchPiece fetches piece i of the replica from peer into d.
+func (s *FileServer) fetchPiece(peer p2p.Peer, req MessageGetFile, d *swarmDownload, i int, progress *progressTracker) error {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	off, n := d.pieceRange(i)
+	msg := Message{Payload: MessageGetRange{ID: req.ID, Key: req.Key, Offset: off, Length: n, Principal: req.Principal}}
+	if err := writeMessage(stream, &msg); err != nil {
+		return err
+	}
+	if err := readResponse(stream); err != nil {
+		return err
+	}
+	var header rangeHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Size != d.size-crypto.IVSize || header.Length != n {
+		return fmt.Errorf("peer sent %d of %d bytes instead of %d of %d", header.Length, header.Size, n, d.size-crypto.IVSize)
+	}
+
+	// The pieces are the replica as stored, the IV first
+	iv := make([]byte, crypto.IVSize)
+	if _, err := io.ReadFull(stream, iv); err != nil {
+		return err
+	}
+	addr := peer.RemoteAddr().String()
+	progress.attempt(addr, n)
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(progress.reader(stream, addr), buf); err != nil {
+		return err
+	}
+	if _, err := d.file.WriteAt(iv, 0); err != nil {
+		return err
+	}
+	if _, err := d.file.WriteAt(buf, crypto.IVSize+off); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.have.add(i)
+	d.complete++
+	d.mu.Unlock()
+	return nil
+}
+
+// swarmReplicaRange returns the header, the IV and the ciphertext of the
+// range msg asks for of a replica downloaded in swarm mode, if the pieces
+// downloaded so far hold it.
+func (s *FileServer) swarmReplicaRange(msg MessageGetRange) (rangeHeader, []byte, io.Reader, bool) {
+	d := s.swarms.get(msg.ID, msg.Key)
+	if d == nil || !d.covers(msg.Offset, msg.Length) {
+		return rangeHeader{}, nil, nil, false
+	}
+	iv := make([]byte, crypto.IVSize)
+	if _, err := d.file.ReadAt(iv, 0); err != nil {
+		return rangeHeader{}, nil, nil, false
+	}
+	header := rangeHeader{Size: d.size - crypto.IVSize, Length: msg.Length}
+	return header, iv, io.NewSectionReader(d.file, crypto.IVSize+msg.Offset, msg.Length), true
+}
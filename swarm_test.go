@@ -0,0 +1,123 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// peerWithID returns the peer of s with the given ID.
+func peerWithID(t *testing.T, s *FileServer, id string) p2p.Peer {
+	for _, peer := range s.peerList() {
+		if peer.ID() == id {
+			return peer
+		}
+	}
+	t.Fatalf("no peer %s", id)
+	return nil
+}
+
+func TestSwarmFetch(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41337")
+	s2 := makeServer(t, "127.0.0.1:41338", "127.0.0.1:41337")
+	s3 := makeServer(t, "127.0.0.1:41339", "127.0.0.1:41337", "127.0.0.1:41338")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 2 && len(s3.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	key := s1.hashKey("big")
+	require.NoError(t, s1.Store("big", bytes.NewReader(data)))
+	require.Eventually(t, func() bool {
+		return s2.store.Has(s1.ID, key) && s3.store.Has(s1.ID, key)
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s1.store.Delete(s1.ID, "big"))
+
+	// Small files are fetched from one peer.
+	s1.Swarm = &SwarmOpts{MinSize: 1 << 20}
+	req := MessageGetFile{ID: s1.ID, Key: key}
+	_, _, err := s1.swarmFetch(context.Background(), req, nil, nil)
+	assert.ErrorIs(t, err, errNoSwarm)
+
+	// Large ones from every holder, a piece at a time.
+	s1.Swarm = &SwarmOpts{MinSize: 1, PieceSize: 4096, Parallel: 4}
+	from, _, err := s1.swarmFetch(context.Background(), req, nil, func(r io.Reader, size int64, from string) (int64, error) {
+		return io.Copy(io.Discard, r)
+	})
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(from, ","), 2)
+	assert.Nil(t, s1.swarms.get(s1.ID, key), "the download is done")
+
+	r, err := s1.Get("big")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestSwarmAdvertise(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41340")
+	s2 := makeServer(t, "127.0.0.1:41341", "127.0.0.1:41340")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// s2 is halfway through downloading a replica of 16+10 bytes it doesn't hold.
+	replica := []byte("0123456789abcdef0123456789")
+	file := newTempFile(t)
+	_, err := file.WriteAt(replica[:21], 0)
+	require.NoError(t, err)
+	d := &swarmDownload{size: int64(len(replica)), pieceSize: 5, pieces: 2, file: file, have: newPieceSet(2)}
+	d.have.add(0)
+	d.complete = 1
+	require.True(t, s2.swarms.start("owner", "key", d))
+	assert.False(t, s2.swarms.start("owner", "key", d))
+	defer s2.swarms.finish("owner", "key")
+
+	// It advertises the pieces it completed,
+	stream, err := s1.openStream(peerWithID(t, s1, s2.ID))
+	require.NoError(t, err)
+	reply, err := hasFile(stream, "owner", "key")
+	stream.Close()
+	require.NoError(t, err)
+	assert.False(t, reply.Has)
+	assert.Equal(t, int64(len(replica)), reply.Size)
+	assert.True(t, pieceSet(reply.Pieces).has(0))
+	assert.False(t, pieceSet(reply.Pieces).has(1))
+
+	// and serves them.
+	got := &swarmDownload{size: d.size, pieceSize: 5, pieces: 2, file: newTempFile(t), have: newPieceSet(2)}
+	req := MessageGetFile{ID: "owner", Key: "key"}
+	require.NoError(t, s1.fetchPiece(peerWithID(t, s1, s2.ID), req, got, 0, nil))
+	buf := make([]byte, 21)
+	_, err = got.file.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, replica[:21], buf)
+
+	assert.Error(t, s1.fetchPiece(peerWithID(t, s1, s2.ID), req, got, 1, nil))
+}
+
+// newTempFile returns a temporary file removed with the test.
+func newTempFile(t *testing.T) *os.File {
+	file, err := os.CreateTemp(t.TempDir(), "swarm")
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+	return file
+}
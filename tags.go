@@ -0,0 +1,150 @@
+package dfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// TagQuery selects files by their tags.
+type TagQuery struct {
+	// Tags every matching file must have. A value of "*" matches any value.
+	Tags map[string]string
+
+	// Remote also asks connected peers for matching files of their own.
+	Remote bool
+}
+
+// SearchResult is a file matching a TagQuery.
+type SearchResult struct {
+	Owner string            // ID of the server that stored the file
+	Key   string            // Key the file was stored under
+	Size  int64             // Size of the file on its owner's disk
+	Tags  map[string]string // Tags of the file
+	Peer  string            // Address of the peer that answered, empty for local files
+}
+
+// MessageSearch asks a peer for its own files matching a set of tags. The
+// peer answers on the same stream with a gob encoded []SearchResult.
+type MessageSearch struct {
+	Tags map[string]string
+}
+
+// SetTags replaces the tags of the file stored under key. An empty map
+// removes all of them. Tags are kept when the file is stored again.
+func (s *FileServer) SetTags(key string, tags map[string]string) error {
+	err := s.store.SetTags(s.ID, key, tags)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+	return err
+}
+
+// Tags returns the tags of the file stored under key.
+func (s *FileServer) Tags(key string) (map[string]string, error) {
+	meta, ok := s.store.Meta(s.ID, key)
+	if !ok {
+		return nil, fmt.Errorf("%w: (%s) is not stored locally", ErrKeyNotFound, key)
+	}
+	return meta.Tags, nil
+}
+
+// Search returns the files matching q, sorted by owner and key. Only tagged
+// files are ever returned. Peers that fail to answer are left out of the results.
+func (s *FileServer) Search(q TagQuery) ([]SearchResult, error) {
+	if len(q.Tags) == 0 {
+		return nil, errors.New("empty tag query")
+	}
+
+	results := s.searchLocal(q.Tags)
+
+	if q.Remote {
+		var (
+			mu sync.Mutex
+			wg sync.WaitGroup
+		)
+		for _, peer := range s.peerList() {
+			wg.Add(1)
+			go func(peer p2p.Peer) {
+				defer wg.Done()
+
+				remote, err := s.searchPeer(peer, q.Tags)
+				if err != nil {
+					log.Printf("[%s] searching (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+					return
+				}
+
+				mu.Lock()
+				results = append(results, remote...)
+				mu.Unlock()
+			}(peer)
+		}
+		wg.Wait()
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Owner != results[j].Owner {
+			return results[i].Owner < results[j].Owner
+		}
+		return results[i].Key < results[j].Key
+	})
+
+	return results, nil
+}
+
+// searchLocal returns the files this server stored that match query.
+func (s *FileServer) searchLocal(query map[string]string) []SearchResult {
+	var results []SearchResult
+	for _, meta := range s.store.Search(s.ID, query) {
+		results = append(results, SearchResult{
+			Owner: meta.ID,
+			Key:   meta.Key,
+			Size:  meta.Size,
+			Tags:  meta.Tags,
+		})
+	}
+	return results
+}
+
+// searchPeer asks peer for its files matching query.
+func (s *FileServer) searchPeer(peer p2p.Peer, query map[string]string) ([]SearchResult, error) {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return nil, err // Searching needs a stream to read the answer from
+	}
+	defer stream.Close()
+
+	if err := writeMessage(stream, &Message{Payload: MessageSearch{Tags: query}}); err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	if err := gob.NewDecoder(stream).Decode(&results); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Peer = peer.RemoteAddr().String()
+	}
+
+	return results, nil
+}
+
+// handleMessageSearch answers a search with the matching files this server stored.
+func (s *FileServer) handleMessageSearch(rpc p2p.RPC, msg MessageSearch) error {
+	if rpc.Conn == nil {
+		return errors.New("searches need a multiplexed connection")
+	}
+	defer rpc.Conn.Close()
+
+	results := []SearchResult{}
+	if len(msg.Tags) > 0 {
+		results = append(results, s.searchLocal(msg.Tags)...)
+	}
+	return gob.NewEncoder(rpc.Conn).Encode(results)
+}
@@ -0,0 +1,87 @@
+package dfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTags(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41160")
+
+	err := s.SetTags("missing", map[string]string{"a": "b"})
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+
+	assert.Nil(t, s.Store("report", strings.NewReader("q1")))
+	assert.Nil(t, s.Store("photo", strings.NewReader("jpg")))
+	assert.Nil(t, s.Store("untagged", strings.NewReader("x")))
+	assert.Nil(t, s.SetTags("report", map[string]string{"type": "doc", "year": "2024"}))
+	assert.Nil(t, s.SetTags("photo", map[string]string{"type": "image", "year": "2024"}))
+
+	// Tags survive storing the file again
+	assert.Nil(t, s.Store("report", strings.NewReader("q2")))
+	tags, err := s.Tags("report")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"type": "doc", "year": "2024"}, tags)
+
+	keys := func(q TagQuery) []string {
+		results, err := s.Search(q)
+		assert.Nil(t, err)
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Key)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"report"}, keys(TagQuery{Tags: map[string]string{"type": "doc"}}))
+	assert.Equal(t, []string{"photo", "report"}, keys(TagQuery{Tags: map[string]string{"year": "2024"}}))
+	assert.Equal(t, []string{"photo", "report"}, keys(TagQuery{Tags: map[string]string{"type": "*"}}))
+	assert.Empty(t, keys(TagQuery{Tags: map[string]string{"type": "doc", "year": "2023"}}))
+
+	_, err = s.Search(TagQuery{})
+	assert.NotNil(t, err)
+
+	// Tags are persisted in the index
+	reopened := storage.NewStore(s.store.(*storage.Store).StoreOpts)
+	assert.Len(t, reopened.Search(s.ID, map[string]string{"type": "image"}), 1)
+}
+
+func TestSearchRemote(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41161")
+	s2 := makeServer(t, "127.0.0.1:41162", "127.0.0.1:41161")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s1.Store("one", strings.NewReader("1")))
+	assert.Nil(t, s1.SetTags("one", map[string]string{"project": "x"}))
+	assert.Nil(t, s2.Store("two", strings.NewReader("2")))
+	assert.Nil(t, s2.SetTags("two", map[string]string{"project": "x"}))
+
+	q := TagQuery{Tags: map[string]string{"project": "x"}}
+	local, err := s2.Search(q)
+	assert.Nil(t, err)
+	assert.Len(t, local, 1)
+	assert.Equal(t, "", local[0].Peer)
+
+	q.Remote = true
+	results, err := s2.Search(q)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	for _, r := range results {
+		if r.Owner == s1.ID {
+			assert.Equal(t, "one", r.Key)
+			assert.NotEqual(t, "", r.Peer)
+		} else {
+			assert.Equal(t, "two", r.Key)
+			assert.Equal(t, "", r.Peer)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package dfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+)
+
+// Storage tiers of servers, announced to their peers.
+const (
+	TierHot  = "hot"  // Fast storage, such as SSDs, for the objects in use
+	TierWarm = "warm" // Storage for objects read now and then
+	TierCold = "cold" // Archive storage the objects nobody reads are moved to
+)
+
+// defaultTieringInterval is how often objects are checked unless TieringOpts says otherwise.
+const defaultTieringInterval = time.Minute
+
+// TieringOpts configures moving the objects nobody reads off a server to
+// archive nodes, peers of TierCold.
+//
+// An object neither read nor written for ColdAfter is sent to an archive
+// node, unless one holds it already, and dropped from the local store. Files
+// of the server moved that way are fetched back, and kept, when next read;
+// until then they aren't listed by List. Replicas held for peers are moved
+// the same way, their owners fetch them from the archive node. Nothing is
+// moved while no archive node is connected.
+type TieringOpts struct {
+	ColdAfter time.Duration // How long an object must go unused to be moved
+	Interval  time.Duration // How often objects are checked (default 1m)
+}
+
+// FileArchived is emitted when an object nobody read was moved to an archive
+// node and dropped from the local store.
+type FileArchived struct {
+	EventMeta
+	ID   string `json:"id"`   // Namespace (server ID) the object belongs to
+	Key  string `json:"key"`  // Key the object was stored under
+	Size int64  `json:"size"` // Size of the object
+	To   string `json:"to"`   // Archive node holding the object
+}
+
+// tierObjects checks the objects of the store every Interval until the
+// server stops.
+func (s *FileServer) tierObjects() {
+	interval := s.Tiering.Interval
+	if interval <= 0 {
+		interval = defaultTieringInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := s.archiveCold(time.Now()); err != nil {
+				log.Printf("[%s] archived %d cold objects, then failed: %s", s.Transport.Addr(), n, err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// archiveCold moves the objects unused for ColdAfter at now to archive
+// nodes, returning how many were moved. Objects one fails to be moved are
+// kept and tried again next time.
+func (s *FileServer) archiveCold(now time.Time) (int, error) {
+	if s.Tier == TierCold || s.Gateway {
+		return 0, nil
+	}
+
+	var archives []p2p.Peer
+	for _, peer := range s.peerList() {
+		if peer.Tier() == TierCold {
+			archives = append(archives, peer)
+		}
+	}
+	if len(archives) == 0 {
+		return 0, nil
+	}
+
+	moved := 0
+	var errs []error
+	for meta := range s.store.Objects() {
+		last := meta.ModTime
+		if meta.LastAccess.After(last) {
+			last = meta.LastAccess
+		}
+		if now.Sub(last) < s.Tiering.ColdAfter || s.store.CheckDelete(meta.ID, meta.Key, now) != nil {
+			continue // Still in use, or can't be deleted once archived
+		}
+
+		to, err := s.archive(meta, archives)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("archiving (%s): %w", meta.Key, err))
+			continue
+		}
+		if err := s.store.Delete(meta.ID, meta.Key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		moved++
+
+		s.audit(AuditArchived, meta.ID, s.wireKey(meta), meta.Size, to, nil)
+		s.events.emit(FileArchived{EventMeta: newEventMeta(), ID: meta.ID, Key: meta.Key, Size: meta.Size, To: to})
+	}
+	return moved, errors.Join(errs...)
+}
+
+// wireKey returns the key peers know the object of meta under: the hash of
+// the key for the server's own files, the key itself for replicas.
+func (s *FileServer) wireKey(meta storage.ObjectMeta) string {
+	if meta.ID == s.ID {
+		return s.hashKey(meta.Key)
+	}
+	return meta.Key
+}
+
+// archive makes sure one of archives holds the object of meta, sending it to
+// the first one if none does. It returns the address of the holder.
+func (s *FileServer) archive(meta storage.ObjectMeta, archives []p2p.Peer) (string, error) {
+	key := s.wireKey(meta)
+	for _, peer := range archives {
+		stream, err := s.openStream(peer)
+		if err != nil {
+			continue // Legacy peers can't be asked
+		}
+		reply, err := hasFile(stream, meta.ID, key)
+		stream.Close()
+		if err == nil && reply.Has {
+			return peer.RemoteAddr().String(), nil
+		}
+	}
+
+	peer := archives[0]
+	if meta.ID == s.ID {
+		// The server's own files are kept in plaintext, peers get them encrypted
+		sp, err := s.newSpool(meta.Key)
+		if err != nil {
+			return "", err
+		}
+		defer sp.close()
+		msg := Message{Payload: MessageStoreFile{ID: s.ID, Key: key, Size: sp.size, Frame: sp.frame()}}
+		return peer.RemoteAddr().String(), s.replicate(context.Background(), peer, meta.Key, &msg, sp, nil)
+	}
+
+	size, r, err := s.readObject(ioBackground, meta.ID, meta.Key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	msg := Message{Payload: MessageStoreFile{ID: meta.ID, Key: key, Size: size, Frame: replicaFrameOf(size)}}
+	return peer.RemoteAddr().String(), s.sendObject(peer, &msg, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package dfs
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveCold(t *testing.T) {
+	s1 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41320", StorageRoot: t.TempDir(), Tier: TierHot, ColdAfter: time.Hour})
+	s2 := NewNode(NodeOpts{ListenAddr: "127.0.0.1:41321", StorageRoot: t.TempDir(), BootstrapNodes: []string{"127.0.0.1:41320"}, Tier: TierCold})
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, TierCold, s1.Peers()[0].Tier)
+
+	// One file replicated to the archive node already, one kept only locally.
+	require.NoError(t, s1.Store("replicated.txt", strings.NewReader("replicated")))
+	_, err := s1.store.Write(s1.ID, "local.txt", strings.NewReader("local only"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("replicated.txt")) }, 2*time.Second, 10*time.Millisecond)
+
+	// Reads keep objects hot.
+	r, err := s1.Get("replicated.txt")
+	require.NoError(t, err)
+	r.Close()
+	meta, err := s1.Stat("replicated.txt")
+	require.NoError(t, err)
+	assert.False(t, meta.LastAccess.IsZero())
+
+	n, err := s1.archiveCold(time.Now().Add(30 * time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = s1.archiveCold(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, s1.store.Has(s1.ID, "replicated.txt"))
+	assert.False(t, s1.store.Has(s1.ID, "local.txt"))
+	assert.True(t, s2.store.Has(s1.ID, s1.hashKey("local.txt")))
+
+	// Archived files are fetched back when read.
+	r, err = s1.Get("local.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "local only", string(got))
+	assert.True(t, s1.store.Has(s1.ID, "local.txt"))
+
+	// Archive nodes keep what they hold.
+	n, err = s2.archiveCold(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
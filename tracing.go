@@ -0,0 +1,97 @@
+package dfs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// tracerName is the instrumentation name spans of the server are created with.
+const tracerName = "github.com/inagib21/DistributedFileStorageGo"
+
+// Attributes set on the spans of the server. Keys are hashed like they are on
+// other nodes, so traces don't leak the names of files.
+const (
+	attrKey    = attribute.Key("dfs.key")          // Hashed key of the file
+	attrSize   = attribute.Key("dfs.size")         // Bytes stored, sent or received
+	attrPeer   = attribute.Key("dfs.peer")         // Address of the peer
+	attrID     = attribute.Key("dfs.peer_id")      // Node ID of the peer
+	attrHit    = attribute.Key("dfs.local_hit")    // Whether Get found the file on local disk
+	attrShared = attribute.Key("dfs.shared_fetch") // Whether Get waited for the fetch of another Get
+)
+
+// tracer returns the tracer spans of the server are created with.
+func (s *FileServer) tracer() trace.Tracer {
+	tp := s.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// propagator returns the propagator carrying trace context in message headers.
+func (s *FileServer) propagator() propagation.TextMapPropagator {
+	if s.Propagator != nil {
+		return s.Propagator
+	}
+	return propagation.TraceContext{}
+}
+
+// withTrace returns a copy of msg carrying the trace context of ctx in its headers.
+func (s *FileServer) withTrace(ctx context.Context, msg *Message) *Message {
+	headers := propagation.MapCarrier{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	s.propagator().Inject(ctx, headers)
+
+	traced := *msg
+	traced.Headers = headers
+	return &traced
+}
+
+// startPeerSpan starts a span for a request to peer.
+func (s *FileServer) startPeerSpan(ctx context.Context, name string, peer p2p.Peer) (context.Context, trace.Span) {
+	return s.tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrPeer.String(peer.RemoteAddr().String()), attrID.String(peer.ID())),
+	)
+}
+
+// startHandlerSpan starts the span handling msg, received from peer, as a
+// child of the span the peer sent it from.
+func (s *FileServer) startHandlerSpan(rpc p2p.RPC, msg *Message) (context.Context, trace.Span) {
+	ctx := s.propagator().Extract(context.Background(), propagation.MapCarrier(msg.Headers))
+	return s.tracer().Start(ctx, "dfs.handle "+payloadName(msg.Payload),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrPeer.String(rpc.From)),
+	)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// payloadName returns the name of the type of a message payload.
+func payloadName(payload any) string {
+	if payload == nil {
+		return "<nil>"
+	}
+	if t := reflect.TypeOf(payload); len(t.Name()) > 0 {
+		return t.Name()
+	}
+	return fmt.Sprintf("%T", payload)
+}
@@ -0,0 +1,83 @@
+package dfs
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// findSpan returns the first ended span called name.
+func findSpan(rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range rec.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41291")
+	s2 := makeServer(t, "127.0.0.1:41292", "127.0.0.1:41291")
+	recorders := make([]*tracetest.SpanRecorder, 2)
+	for i, s := range []*FileServer{s1, s2} {
+		recorders[i] = tracetest.NewSpanRecorder()
+		s.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorders[i]))
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	rec1, rec2 := recorders[0], recorders[1]
+	require.Eventually(t, func() bool { return len(s1.Peers()) == 1 && len(s2.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// The replica is handled as part of the trace of the caller.
+	ctx, root := s2.tracer().Start(context.Background(), "test")
+	require.NoError(t, s2.StoreContext(ctx, "traced", strings.NewReader("followed across nodes")))
+	root.End()
+
+	store := findSpan(rec2, "dfs.Store")
+	require.NotNil(t, store)
+	assert.Equal(t, root.SpanContext().SpanID(), store.Parent().SpanID())
+	replicate := findSpan(rec2, "dfs.replicate")
+	require.NotNil(t, replicate)
+	assert.Equal(t, store.SpanContext().SpanID(), replicate.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindClient, replicate.SpanKind())
+
+	var handled sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		handled = findSpan(rec1, "dfs.handle MessageStoreFile")
+		return handled != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, root.SpanContext().TraceID(), handled.SpanContext().TraceID())
+	assert.Equal(t, replicate.SpanContext().SpanID(), handled.Parent().SpanID())
+	assert.Equal(t, trace.SpanKindServer, handled.SpanKind())
+
+	// A Get fetching from a peer is traced end to end as well.
+	require.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("traced")) }, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s2.store.Delete(s2.ID, "traced"))
+	r, err := s2.Get("traced")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "followed across nodes", string(b))
+
+	get := findSpan(rec2, "dfs.Get")
+	require.NotNil(t, get)
+	fetch := findSpan(rec2, "dfs.fetch")
+	require.NotNil(t, fetch)
+	assert.Equal(t, get.SpanContext().SpanID(), fetch.Parent().SpanID())
+	require.Eventually(t, func() bool {
+		handled = findSpan(rec1, "dfs.handle MessageGetFile")
+		return handled != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, fetch.SpanContext().SpanID(), handled.Parent().SpanID())
+	assert.Equal(t, get.SpanContext().TraceID(), handled.SpanContext().TraceID())
+}
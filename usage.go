@@ -0,0 +1,20 @@
+package dfs
+
+import "github.com/inagib21/DistributedFileStorageGo/storage"
+
+// StoreUsage is the usage of a server's store, in total and by namespace.
+type StoreUsage struct {
+	storage.Usage
+	Namespaces map[string]storage.Usage `json:"namespaces"` // Usage by namespace (server ID), the server's own files under its ID
+}
+
+// Usage returns how much the store of the server holds: its own files,
+// the chunks and manifests of chunked files included, and the replicas it
+// keeps for peers and groups, each namespace on its own.
+func (s *FileServer) Usage() StoreUsage {
+	usage := StoreUsage{Namespaces: s.store.UsageByNamespace()}
+	for _, u := range usage.Namespaces {
+		usage.Usage = usage.Usage.Add(u)
+	}
+	return usage
+}
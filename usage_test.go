@@ -0,0 +1,33 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServerUsage(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41330")
+
+	require.NoError(t, s.Store("file", bytes.NewReader([]byte("some data"))))
+	_, err := s.store.Write("peer", "replica", bytes.NewReader([]byte("replica")))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got StoreUsage
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, s.Usage(), got)
+	assert.Equal(t, storage.Usage{Objects: 2, LogicalBytes: 16, PhysicalBytes: 16}, got.Usage)
+	assert.Equal(t, map[string]storage.Usage{
+		s.ID:   {Objects: 1, LogicalBytes: 9, PhysicalBytes: 9},
+		"peer": {Objects: 1, LogicalBytes: 7, PhysicalBytes: 7},
+	}, got.Namespaces)
+}
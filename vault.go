@@ -0,0 +1,88 @@
+package dfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VaultKMS wraps keys with a key of the transit secrets engine of HashiCorp
+// Vault, which never leaves Vault. The token must be allowed to update
+// transit/encrypt/<Key> and transit/decrypt/<Key>.
+type VaultKMS struct {
+	Addr   string       // URL of Vault, such as https://vault.example.com:8200
+	Token  string       // Token authenticating the requests
+	Key    string       // Name of the transit key wrapping the keys
+	Mount  string       // Path the transit engine is mounted at, "transit" if empty
+	Client *http.Client // Client making the requests, http.DefaultClient if nil
+}
+
+// Encrypt wraps plaintext with the transit key, returning the ciphertext
+// Vault answers with, such as "vault:v1:...".
+func (v *VaultKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	var res struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := v.post(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(res.Data.Ciphertext), nil
+}
+
+// Decrypt unwraps a ciphertext returned by Encrypt.
+func (v *VaultKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	var res struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.post(ctx, "decrypt", map[string]string{"ciphertext": string(ciphertext)}, &res); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Data.Plaintext)
+}
+
+// post posts body to the op endpoint of the transit key and decodes the
+// answer into res.
+func (v *VaultKMS) post(ctx context.Context, op string, body any, res any) error {
+	mount := v.Mount
+	if len(mount) == 0 {
+		mount = "transit"
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimSuffix(v.Addr, "/"), strings.Trim(mount, "/"), op, v.Key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr)
+		return fmt.Errorf("vault %s with key %q: %s %s", op, v.Key, resp.Status, strings.Join(vaultErr.Errors, "; "))
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
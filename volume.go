@@ -0,0 +1,218 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// volumeMagic starts the header of every volume, telling it apart from regular file contents.
+	volumeMagic = "dfs-volume:v1\n"
+
+	defaultVolumeBlockSize = 64 << 10 // Block size of volumes created without one
+
+	volumeBlockSep = "#block-" // Separates the name of a volume from the index in the keys of its blocks
+)
+
+// ErrNotVolume is returned when opening a file that isn't a volume as one.
+var ErrNotVolume = errors.New("not a volume")
+
+// VolumeInfo describes a volume. It is stored under the name of the volume,
+// every block written as an object of its own, so writing part of a volume
+// only rewrites and re-replicates the blocks it touches.
+type VolumeInfo struct {
+	Size      int64 `json:"size"`       // Size of the volume in bytes
+	BlockSize int64 `json:"block_size"` // Size of every block
+}
+
+// Volume is a fixed-size block device stored on the network, such as the
+// disk image of a virtual machine. Blocks never written read as zeros and
+// take up no space, though reading them asks the peers for them first.
+// Volumes can be read and written concurrently; writes to the same block are
+// serialized.
+type Volume struct {
+	s    *FileServer
+	name string
+	info VolumeInfo
+}
+
+// CreateVolume creates a volume of size bytes under name, split into blocks
+// of blockSize bytes (64 KiB if zero). Every byte reads as zero until written.
+func (s *FileServer) CreateVolume(name string, size int64, blockSize int64) (*Volume, error) {
+	if blockSize == 0 {
+		blockSize = defaultVolumeBlockSize
+	}
+	if size < 0 || blockSize < 0 {
+		return nil, fmt.Errorf("invalid volume size %d with blocks of %d bytes", size, blockSize)
+	}
+	if isChunkKey(name) {
+		return nil, fmt.Errorf("%w: volume name (%s) is reserved for blocks and chunks", ErrInvalidKey, name)
+	}
+
+	info := VolumeInfo{Size: size, BlockSize: blockSize}
+	buf, _ := json.Marshal(info)
+	if err := s.Store(name, bytes.NewReader(append([]byte(volumeMagic), buf...))); err != nil {
+		return nil, err
+	}
+	return &Volume{s: s, name: name, info: info}, nil
+}
+
+// OpenVolume opens the volume stored under name, fetching its header from
+// the network unless it is held locally.
+func (s *FileServer) OpenVolume(name string) (*Volume, error) {
+	r, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(buf, []byte(volumeMagic)) {
+		return nil, fmt.Errorf("%w: (%s)", ErrNotVolume, name)
+	}
+
+	v := &Volume{s: s, name: name}
+	if err := json.Unmarshal(buf[len(volumeMagic):], &v.info); err != nil {
+		return nil, fmt.Errorf("invalid volume header: %w", err)
+	}
+	if v.info.Size < 0 || v.info.BlockSize <= 0 {
+		return nil, fmt.Errorf("invalid volume header: size %d with blocks of %d bytes", v.info.Size, v.info.BlockSize)
+	}
+	return v, nil
+}
+
+// DeleteVolume deletes the volume stored under name with every block of it,
+// locally and on every peer.
+func (s *FileServer) DeleteVolume(name string) error {
+	v, err := s.OpenVolume(name)
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < v.blocks(); i++ {
+		err := s.Delete(v.blockKey(i))
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
+	return s.Delete(name)
+}
+
+// Name returns the name the volume is stored under.
+func (v *Volume) Name() string {
+	return v.name
+}
+
+// Info returns the size and block size of the volume.
+func (v *Volume) Info() VolumeInfo {
+	return v.info
+}
+
+// Size returns the size of the volume in bytes.
+func (v *Volume) Size() int64 {
+	return v.info.Size
+}
+
+// ReadAt reads len(p) bytes of the volume starting at off, fetching the
+// blocks it covers from the network unless they are held locally. Reads
+// past the end of the volume are cut short with io.EOF.
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	n := 0
+	for n < len(p) && off < v.info.Size {
+		i, within := off/v.info.BlockSize, off%v.info.BlockSize
+		block, err := v.readBlock(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], block[within:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the volume starting at off. Blocks written in part
+// are read, changed and written back whole; every block written is stored
+// and replicated like a file. Writes past the end of the volume fail after
+// writing what fits.
+func (v *Volume) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	n := 0
+	for n < len(p) && off < v.info.Size {
+		i, within := off/v.info.BlockSize, off%v.info.BlockSize
+		m := int(min(int64(len(p)-n), v.info.BlockSize-within, v.info.Size-off))
+		if err := v.writeBlock(i, within, p[n:n+m]); err != nil {
+			return n, err
+		}
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, fmt.Errorf("write of %d bytes at %d runs past the end of volume (%s), which is %d bytes long", len(p), off-int64(n), v.name, v.info.Size)
+	}
+	return n, nil
+}
+
+// blocks returns the number of blocks of the volume.
+func (v *Volume) blocks() int64 {
+	return (v.info.Size + v.info.BlockSize - 1) / v.info.BlockSize
+}
+
+// blockKey returns the key block i is stored under.
+func (v *Volume) blockKey(i int64) string {
+	return fmt.Sprintf("%s%s%d", v.name, volumeBlockSep, i)
+}
+
+// readBlock returns the contents of block i, zeros if it was never written.
+// The last block is as long as what is left of the volume.
+func (v *Volume) readBlock(i int64) ([]byte, error) {
+	size := min(v.info.BlockSize, v.info.Size-i*v.info.BlockSize)
+	block := make([]byte, size)
+
+	r, err := v.s.get(v.blockKey(i), nil)
+	if errors.Is(err, ErrKeyNotFound) {
+		return block, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("block %d of volume (%s) is damaged: %w", i, v.name, err)
+	}
+	return block, nil
+}
+
+// writeBlock writes data to block i, starting at off within the block.
+// Blocks written whole aren't read first.
+func (v *Volume) writeBlock(i int64, off int64, data []byte) error {
+	key := v.blockKey(i)
+	unlock := v.s.lockKey(key)
+	defer unlock()
+
+	if off == 0 && int64(len(data)) == min(v.info.BlockSize, v.info.Size-i*v.info.BlockSize) {
+		return v.s.Store(key, bytes.NewReader(data))
+	}
+	block, err := v.readBlock(i)
+	if err != nil {
+		return err
+	}
+	copy(block[off:], data)
+	return v.s.Store(key, bytes.NewReader(block))
+}
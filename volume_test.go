@@ -0,0 +1,96 @@
+package dfs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41331")
+
+	v, err := s.CreateVolume("disk.img", 10, 4)
+	require.NoError(t, err)
+	assert.Equal(t, VolumeInfo{Size: 10, BlockSize: 4}, v.Info())
+
+	// Nothing written reads as zeros.
+	buf := make([]byte, 10)
+	n, err := v.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, make([]byte, 10), buf)
+
+	// Writes spanning blocks only store the blocks they touch.
+	n, err = v.WriteAt([]byte("abcde"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, s.store.Has(s.ID, v.blockKey(0)))
+	assert.True(t, s.store.Has(s.ID, v.blockKey(1)))
+	assert.False(t, s.store.Has(s.ID, v.blockKey(2)))
+
+	v, err = s.OpenVolume("disk.img")
+	require.NoError(t, err)
+	n, err = v.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x00abcde\x00\x00\x00", string(buf[:n]))
+
+	// The last block is cut short at the end of the volume.
+	n, err = v.WriteAt([]byte("xyz"), 8)
+	assert.Error(t, err)
+	assert.Equal(t, 2, n)
+	n, err = v.ReadAt(buf[:4], 7)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "\x00xy", string(buf[:n]))
+
+	got, err := io.ReadAll(io.NewSectionReader(v, 0, v.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x00abcde\x00xy", string(got))
+
+	_, err = s.OpenVolume("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, s.Store("plain", strings.NewReader("not a volume")))
+	_, err = s.OpenVolume("plain")
+	assert.ErrorIs(t, err, ErrNotVolume)
+	_, err = s.CreateVolume("disk.img"+volumeBlockSep+"0", 10, 4)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	require.NoError(t, s.DeleteVolume("disk.img"))
+	for i := int64(0); i < v.blocks(); i++ {
+		assert.False(t, s.store.Has(s.ID, v.blockKey(i)))
+	}
+	assert.False(t, s.store.Has(s.ID, "disk.img"))
+}
+
+func TestVolumeFromPeers(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41332")
+	s2 := makeServer(t, "127.0.0.1:41333", "127.0.0.1:41332")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	v, err := s2.CreateVolume("vm.img", 1<<20, 0)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("block device "), 10000)
+	_, err = v.WriteAt(data, 1000)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return s1.store.Has(s2.ID, s2.hashKey(v.blockKey(1)))
+	}, time.Second, 10*time.Millisecond)
+
+	// Blocks lost locally are read from the replicas of the peer.
+	for i := int64(0); i < 2; i++ {
+		require.NoError(t, s2.store.Delete(s2.ID, v.blockKey(i)))
+	}
+	got := make([]byte, len(data))
+	_, err = v.ReadAt(got, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
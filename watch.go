@@ -0,0 +1,182 @@
+package dfs
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/crypto"
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+const (
+	// maxGossipHops is the number of times a key change is passed on before
+	// it is dropped, bounding how far it travels in networks with cycles.
+	maxGossipHops = 8
+
+	// gossipSeenTTL is how long the IDs of relayed key changes are remembered
+	// to drop copies arriving over other paths.
+	gossipSeenTTL = 5 * time.Minute
+)
+
+// ChangeKind tells what happened to a key.
+type ChangeKind string
+
+const (
+	KeyStored  ChangeKind = "stored"  // The key was stored for the first time
+	KeyUpdated ChangeKind = "updated" // The key was stored again, replacing its contents
+	KeyDeleted ChangeKind = "deleted" // The key was deleted
+)
+
+// KeyChanged is emitted when a key was stored, updated or deleted, on this
+// server or any other server of the network. Only the owner of a key knows
+// it; the changes of other servers carry its lookup token instead.
+type KeyChanged struct {
+	EventMeta
+	Change string     `json:"change"`         // Unique ID of the change
+	Kind   ChangeKind `json:"kind"`           // What happened to the key
+	Owner  string     `json:"owner"`          // ID of the server the key belongs to
+	Key    string     `json:"key"`            // Key that changed, its lookup token for keys of other servers
+	Size   int64      `json:"size,omitempty"` // Size of the new contents, zero for deletes
+	From   string     `json:"from,omitempty"` // Peer that relayed the change, empty for local changes
+}
+
+// MessageKeyChanged announces a key change to peers, who pass it on to their
+// own peers so it reaches the whole network.
+type MessageKeyChanged struct {
+	Change string     // Unique ID of the change
+	Kind   ChangeKind // What happened to the key
+	Owner  string     // ID of the server the key belongs to
+	Key    string     // Lookup token of the key that changed, see hashKey
+	Size   int64      // Size of the new contents
+	Time   time.Time  // When the change happened on its owner
+	Hops   int        // Number of times the change has been passed on
+}
+
+// Watch returns a channel receiving the changes of every key of this server
+// starting with prefix, and a function that cancels the watch and closes the
+// channel. An empty prefix watches all keys, those of every other server of
+// the network included, which are known by their lookup tokens only.
+//
+// Like Subscribe, a watcher that falls behind misses changes until it catches up.
+func (s *FileServer) Watch(prefix string) (<-chan KeyChanged, func()) {
+	events, cancel := s.Subscribe()
+	ch := make(chan KeyChanged, eventBufferSize)
+
+	go func() {
+		defer close(ch)
+		for ev := range events {
+			change, ok := ev.(KeyChanged)
+			if !ok || (len(prefix) > 0 && (len(change.From) > 0 || !strings.HasPrefix(change.Key, prefix))) {
+				continue
+			}
+			select {
+			case ch <- change:
+			default: // Watcher is behind, drop the change
+			}
+		}
+	}()
+
+	return ch, cancel
+}
+
+// keyChanged announces a change of one of this server's keys to local
+// watchers and, under its lookup token, to the network. Chunks of chunked
+// files are not announced, only their manifests.
+func (s *FileServer) keyChanged(kind ChangeKind, key string, size int64) {
+	if isChunkKey(key) {
+		return
+	}
+
+	msg := MessageKeyChanged{
+		Change: crypto.GenerateID(),
+		Kind:   kind,
+		Owner:  s.ID,
+		Key:    key,
+		Size:   size,
+		Time:   time.Now(),
+	}
+	s.gossip.seen(msg.Change)
+	s.emitKeyChanged(msg, "")
+	msg.Key = s.hashKey(key) // Peers can't tell keys from their tokens
+	s.relayKeyChanged(msg, "")
+}
+
+// handleMessageKeyChanged delivers a key change announced by a peer to local
+// watchers and passes it on, unless it has been seen before.
+func (s *FileServer) handleMessageKeyChanged(rpc p2p.RPC, msg MessageKeyChanged) error {
+	if rpc.Conn != nil {
+		rpc.Conn.Close()
+	}
+
+	if !s.gossip.seen(msg.Change) {
+		return nil
+	}
+
+	s.emitKeyChanged(msg, rpc.From)
+	if msg.Hops+1 < maxGossipHops {
+		msg.Hops++
+		go s.relayKeyChanged(msg, rpc.From)
+	}
+	return nil
+}
+
+// emitKeyChanged delivers a key change to local watchers.
+func (s *FileServer) emitKeyChanged(msg MessageKeyChanged, from string) {
+	s.events.emit(KeyChanged{
+		EventMeta: EventMeta{Time: msg.Time},
+		Change:    msg.Change,
+		Kind:      msg.Kind,
+		Owner:     msg.Owner,
+		Key:       msg.Key,
+		Size:      msg.Size,
+		From:      from,
+	})
+}
+
+// relayKeyChanged sends a key change to every peer but the one it came from.
+func (s *FileServer) relayKeyChanged(msg MessageKeyChanged, from string) {
+	var peers []p2p.Peer
+	for _, peer := range s.peerList() {
+		if peer.RemoteAddr().String() != from {
+			peers = append(peers, peer)
+		}
+	}
+
+	if err := s.broadcastTo(peers, &Message{Payload: msg}); err != nil {
+		log.Printf("[%s] announcing change of (%s) failed: %s", s.Transport.Addr(), msg.Key, err)
+	}
+}
+
+// seenSet remembers the IDs of recently relayed key changes.
+type seenSet struct {
+	mu     sync.Mutex
+	ids    map[string]time.Time
+	pruned time.Time // Last time expired IDs were dropped
+}
+
+// seen records id and reports whether it is new.
+func (ss *seenSet) seen(id string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	if ss.ids == nil {
+		ss.ids = make(map[string]time.Time)
+	}
+	if now.Sub(ss.pruned) > gossipSeenTTL {
+		for k, t := range ss.ids {
+			if now.Sub(t) > gossipSeenTTL {
+				delete(ss.ids, k)
+			}
+		}
+		ss.pruned = now
+	}
+
+	if _, ok := ss.ids[id]; ok {
+		return false
+	}
+	ss.ids[id] = now
+	return true
+}
@@ -0,0 +1,78 @@
+package dfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextChange returns the next change on ch.
+func nextChange(t *testing.T, ch <-chan KeyChanged) KeyChanged {
+	t.Helper()
+	select {
+	case change := <-ch:
+		return change
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a key change")
+		return KeyChanged{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// s3 only hears about changes on s1 through s2
+	s1 := makeServer(t, "127.0.0.1:41170")
+	s2 := makeServer(t, "127.0.0.1:41171", "127.0.0.1:41170")
+	s3 := makeServer(t, "127.0.0.1:41172", "127.0.0.1:41171")
+	for _, s := range []*FileServer{s1, s2, s3} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	local, cancelLocal := s1.Watch("docs/")
+	defer cancelLocal()
+	remote, cancelRemote := s3.Watch("")
+	defer cancelRemote()
+	prefixed, cancelPrefixed := s3.Watch("docs/")
+	defer cancelPrefixed()
+
+	assert.Nil(t, s1.Store("other", strings.NewReader("ignored")))
+	assert.Nil(t, s1.Store("docs/a", strings.NewReader("first")))
+
+	// Peers are told the lookup token of the key, not the key itself.
+	assert.Equal(t, s1.hashKey("other"), nextChange(t, remote).Key)
+	stored := nextChange(t, remote)
+	assert.Equal(t, KeyStored, stored.Kind)
+	assert.Equal(t, s1.hashKey("docs/a"), stored.Key)
+	assert.Equal(t, s1.ID, stored.Owner)
+	assert.Equal(t, int64(5), stored.Size)
+	assert.NotEmpty(t, stored.From)
+	own := nextChange(t, local)
+	assert.Equal(t, stored.Change, own.Change)
+	assert.Equal(t, "docs/a", own.Key)
+	assert.Empty(t, own.From)
+
+	assert.Nil(t, s1.Store("docs/a", strings.NewReader("second")))
+	assert.Equal(t, KeyUpdated, nextChange(t, remote).Kind)
+
+	assert.Eventually(t, func() bool { return s2.store.Has(s1.ID, s1.hashKey("docs/a")) }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s1.Delete("docs/a"))
+	deleted := nextChange(t, remote)
+	assert.Equal(t, KeyDeleted, deleted.Kind)
+	assert.Equal(t, s1.hashKey("docs/a"), deleted.Key)
+	assert.False(t, s1.store.Has(s1.ID, "docs/a"))
+	assert.Eventually(t, func() bool { return !s2.store.Has(s1.ID, s1.hashKey("docs/a")) }, time.Second, 10*time.Millisecond)
+
+	// Every change arrives only once, however many paths it takes, and the
+	// keys of other servers can't be watched by prefix.
+	select {
+	case change := <-remote:
+		t.Fatalf("unexpected change %+v", change)
+	case change := <-prefixed:
+		t.Fatalf("unexpected change %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
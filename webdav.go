@@ -0,0 +1,433 @@
+package dfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/storage"
+	"golang.org/x/net/webdav"
+)
+
+// davDirSuffix ends the keys of the empty objects marking directories created
+// over WebDAV, which would vanish with their last file otherwise.
+const davDirSuffix = "/"
+
+// WebDAVHandler returns a WebDAV server over the files of the server, so
+// desktop systems can mount them as a network drive. Paths below prefix map
+// to keys: /photos/cat.jpg is the file stored under photos/cat.jpg, and
+// directories are the key prefixes ending in a slash, such as those of the
+// directories stored with StoreDir. Files are written when closed, and stored
+// and replicated like any other. The admin API serves it below /dav/.
+func (s *FileServer) WebDAVHandler(prefix string) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: davFS{s: s},
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// davFS is the webdav.FileSystem of the files of a server.
+type davFS struct {
+	s *FileServer
+}
+
+// davKey returns the key of the file at name, empty for the root.
+func davKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// davPrefix returns the prefix of the keys within the directory dir.
+func davPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + davDirSuffix
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := davKey(name)
+	if _, err := d.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	if parent := davKey(path.Dir("/" + key)); parent != "" {
+		if info, err := d.Stat(ctx, parent); err != nil || !info.IsDir() {
+			return os.ErrNotExist
+		}
+	}
+	return d.s.StoreContext(ctx, key+davDirSuffix, strings.NewReader(""))
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := davKey(name)
+	info, err := d.Stat(ctx, name)
+	if err == nil && info.IsDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &davDir{fs: d, key: key, info: info}, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		return &davFile{fs: d, key: key, info: info.(*davInfo)}, nil
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if exists && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+
+	// Writes go to a temporary file, stored when closed.
+	tmp, err := os.CreateTemp("", "dfs-dav-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &davWriter{File: tmp, fs: d, key: key, ctx: context.WithoutCancel(ctx)}
+	if exists && flag&os.O_TRUNC == 0 {
+		if err := w.load(); err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	key := davKey(name)
+	if key == "" {
+		return os.ErrPermission
+	}
+
+	removed := false
+	for _, meta := range d.s.List(key) {
+		if meta.Key == key || strings.HasPrefix(meta.Key, davPrefix(key)) {
+			if err := d.s.DeleteContext(ctx, meta.Key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := davKey(oldName), davKey(newName)
+	if from == "" || to == "" {
+		return os.ErrPermission
+	}
+
+	moved := false
+	for _, meta := range d.s.List(from) {
+		var dest string
+		switch {
+		case meta.Key == from:
+			dest = to
+		case strings.HasPrefix(meta.Key, davPrefix(from)):
+			dest = davPrefix(to) + strings.TrimPrefix(meta.Key, davPrefix(from))
+		default:
+			continue
+		}
+		if isChunkKey(meta.Key) {
+			continue // Moved with their file, and deleted along with its old name
+		}
+		if err := d.s.copyFile(ctx, meta.Key, dest); err != nil {
+			return err
+		}
+		if err := d.s.DeleteContext(ctx, meta.Key); err != nil {
+			return err
+		}
+		moved = true
+	}
+	if !moved {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	key := davKey(name)
+	if key == "" {
+		return &davInfo{name: "/", dir: true}, nil
+	}
+
+	// Directories stored with StoreDir hold their manifest under their own
+	// key, and show as the directory of the files within.
+	if meta, err := d.s.Stat(key); err == nil && !isChunkKey(key) && len(d.s.List(davPrefix(key))) == 0 {
+		info := &davInfo{name: path.Base(key), size: d.s.fileSize(meta), modTime: meta.ModTime}
+		if meta.Content != nil {
+			info.contentType = meta.Content.ContentType
+		}
+		return info, nil
+	}
+
+	info := &davInfo{name: path.Base(key), dir: true}
+	found := false
+	for _, meta := range d.s.List(davPrefix(key)) {
+		found = true
+		if meta.ModTime.After(info.modTime) {
+			info.modTime = meta.ModTime
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return info, nil
+}
+
+// copyFile stores the contents of the file under from, chunked files
+// included, under to as well, keeping its manifest.
+func (s *FileServer) copyFile(ctx context.Context, from string, to string) error {
+	r, err := s.GetContext(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var m storage.ContentManifest
+	if meta, err := s.Stat(from); err == nil && meta.Content != nil {
+		m = *meta.Content
+	}
+	return s.StoreWithContent(ctx, to, r, m)
+}
+
+// fileSize returns the size of the file described by meta, which for chunked
+// files is the one their manifest records.
+func (s *FileServer) fileSize(meta storage.ObjectMeta) int64 {
+	_, r, err := s.readObject(ioForeground, meta.ID, meta.Key)
+	if err != nil {
+		return meta.Size
+	}
+	if !isChunkManifest(r) {
+		r.Close()
+		return meta.Size
+	}
+	m, err := readChunkManifest(r)
+	if err != nil {
+		return meta.Size
+	}
+	return m.Size
+}
+
+// davInfo describes a file or directory served over WebDAV.
+type davInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	contentType string // From the manifest of the file, guessed from its name if empty
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modTime }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() any           { return nil }
+
+func (i *davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// ContentType returns the content type recorded in the manifest of the file,
+// for webdav.ContentTyper.
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.contentType, nil
+}
+
+// davFile reads a file served over WebDAV, fetching it from the offset it
+// was seeked to.
+type davFile struct {
+	fs     davFS
+	key    string
+	info   *davInfo
+	offset int64
+	r      io.ReadCloser // Reads from offset, opened by the first read after a seek
+}
+
+func (f *davFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		if f.offset >= f.info.size {
+			return 0, io.EOF
+		}
+		r, err := f.fs.s.GetRange(f.key, f.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+	}
+	n, err := f.r.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	if offset != f.offset && f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davFile) Close() error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+func (f *davFile) Write(b []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davFile) Stat() (fs.FileInfo, error)               { return f.info, nil }
+
+// davWriter collects a file written over WebDAV in a temporary file and
+// stores it when closed.
+type davWriter struct {
+	*os.File
+	fs     davFS
+	key    string
+	ctx    context.Context
+	failed error // Why writing failed, nothing is stored when closed if set
+}
+
+// load copies the current contents of the file into the temporary file.
+func (w *davWriter) load() error {
+	r, err := w.fs.s.GetContext(w.ctx, w.key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w.File, r); err != nil {
+		return err
+	}
+	_, err = w.File.Seek(0, io.SeekStart)
+	return err
+}
+
+// discard removes the temporary file.
+func (w *davWriter) discard() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+func (w *davWriter) Close() error {
+	defer w.discard()
+	if w.failed != nil {
+		return w.failed
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.fs.s.StoreContext(w.ctx, w.key, w.File)
+}
+
+func (w *davWriter) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	fi, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davInfo{name: path.Base(w.key), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// davDir lists a directory served over WebDAV.
+type davDir struct {
+	fs      davFS
+	key     string
+	info    fs.FileInfo
+	entries []fs.FileInfo // Left to list, nil until the first Readdir
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.entries == nil {
+		d.entries = d.list()
+	}
+	if count <= 0 {
+		out := d.entries
+		d.entries = []fs.FileInfo{}
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+// list returns the files and directories within the directory, sorted by name.
+func (d *davDir) list() []fs.FileInfo {
+	prefix := davPrefix(d.key)
+	files := map[string]fs.FileInfo{}
+	for _, meta := range d.fs.s.List(prefix) {
+		rest := strings.TrimPrefix(meta.Key, prefix)
+		if rest == "" || isChunkKey(meta.Key) {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		if _, ok := files[name]; ok && !isDir {
+			continue
+		}
+		if isDir {
+			if info, ok := files[name].(*davInfo); ok && info.dir {
+				if meta.ModTime.After(info.modTime) {
+					info.modTime = meta.ModTime
+				}
+				continue
+			}
+			files[name] = &davInfo{name: name, dir: true, modTime: meta.ModTime}
+			continue
+		}
+		info := &davInfo{name: name, size: d.fs.s.fileSize(meta), modTime: meta.ModTime}
+		if meta.Content != nil {
+			info.contentType = meta.Content.ContentType
+		}
+		files[name] = info
+	}
+
+	out := make([]fs.FileInfo, 0, len(files))
+	for _, info := range files {
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+func (d *davDir) Read(b []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Write(b []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDir) Close() error                                 { return nil }
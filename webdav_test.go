@@ -0,0 +1,78 @@
+package dfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAV(t *testing.T) {
+	s := makeServer(t, "127.0.0.1:41334")
+	h := s.AdminHandler()
+
+	dav := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/dav"+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Files put over WebDAV are stored under their path.
+	assert.Equal(t, http.StatusCreated, dav("MKCOL", "/docs", "").Code)
+	assert.Equal(t, http.StatusCreated, dav("PUT", "/docs/notes.txt", "some notes").Code)
+	r, err := s.Get("docs/notes.txt")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "some notes", string(b))
+
+	// Files stored otherwise show up too, chunks hidden.
+	require.NoError(t, s.Store("docs/sub/deep.txt", strings.NewReader("deep")))
+	require.NoError(t, s.Store("docs/big"+chunkKeySep+"0", strings.NewReader("chunk")))
+	rec := dav("PROPFIND", "/docs/", "", "Depth", "1")
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "/dav/docs/notes.txt")
+	assert.Contains(t, body, "/dav/docs/sub/")
+	assert.NotContains(t, body, "deep.txt")
+	assert.NotContains(t, body, chunkKeySep)
+
+	rec = dav("GET", "/docs/notes.txt", "", "Range", "bytes=5-")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "notes", rec.Body.String())
+
+	// Moving a directory moves every file within it.
+	assert.Equal(t, http.StatusCreated, dav("MOVE", "/docs", "", "Destination", "/dav/archive").Code)
+	assert.Equal(t, http.StatusNotFound, dav("GET", "/docs/notes.txt", "").Code)
+	assert.Equal(t, "deep", dav("GET", "/archive/sub/deep.txt", "").Body.String())
+	assert.Equal(t, "some notes", dav("GET", "/archive/notes.txt", "").Body.String())
+
+	// Empty directories are kept until deleted.
+	assert.Equal(t, http.StatusCreated, dav("MKCOL", "/empty", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, dav("MKCOL", "/empty", "").Code)
+	assert.Equal(t, http.StatusMultiStatus, dav("PROPFIND", "/empty", "", "Depth", "0").Code)
+	assert.Equal(t, http.StatusNoContent, dav("DELETE", "/empty", "").Code)
+	assert.Equal(t, http.StatusNotFound, dav("PROPFIND", "/empty", "", "Depth", "0").Code)
+
+	assert.Equal(t, http.StatusNoContent, dav("DELETE", "/archive", "").Code)
+	assert.Empty(t, s.List("archive"))
+
+	// Directories stored with StoreDir are browsable, their manifest hidden.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644))
+	require.NoError(t, s.StoreDir("tree", dir))
+	rec = dav("PROPFIND", "/tree", "", "Depth", "1")
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/dav/tree/a.txt")
+	assert.Contains(t, rec.Body.String(), "<D:collection")
+}
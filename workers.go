@@ -0,0 +1,90 @@
+package dfs
+
+import (
+	"hash/fnv"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+)
+
+// laneSize is the number of messages queued for each worker's lane.
+const laneSize = 64
+
+// workerPool handles incoming messages on a fixed number of goroutines.
+//
+// Messages on their own stream are independent and go to whichever worker is
+// free. Messages read directly off a peer's connection must be handled in the
+// order they arrived, since the data following them is read from the same
+// connection; each peer is assigned a lane that a single worker drains, so a
+// peer's messages stay in order while different peers are handled at once.
+type workerPool struct {
+	shared chan p2p.RPC   // Stream messages, taken by any worker
+	lanes  []chan p2p.RPC // Connection messages, one lane per worker
+	done   chan struct{}
+}
+
+// newWorkerPool starts n workers passing messages to handle.
+func newWorkerPool(n int, handle func(p2p.RPC)) *workerPool {
+	p := &workerPool{
+		shared: make(chan p2p.RPC),
+		lanes:  make([]chan p2p.RPC, n),
+		done:   make(chan struct{}),
+	}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan p2p.RPC, laneSize)
+		go p.work(p.lanes[i], handle)
+	}
+	return p
+}
+
+// work handles the messages of lane and shared stream messages until the pool stops.
+func (p *workerPool) work(lane <-chan p2p.RPC, handle func(p2p.RPC)) {
+	for {
+		// Messages of the lane go first, their peer is waiting on them
+		select {
+		case rpc := <-lane:
+			handle(rpc)
+			continue
+		default:
+		}
+
+		select {
+		case rpc := <-lane:
+			handle(rpc)
+		case rpc := <-p.shared:
+			handle(rpc)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// submit hands rpc to a worker, waiting while they are all busy. It reports
+// false if quit closed first, in which case rpc is dropped.
+func (p *workerPool) submit(rpc p2p.RPC, quit <-chan struct{}) bool {
+	ch := p.shared
+	if rpc.Conn == nil {
+		ch = p.lanes[laneOf(rpc.From, len(p.lanes))]
+	}
+
+	select {
+	case ch <- rpc:
+		return true
+	case <-quit:
+		if rpc.Conn != nil {
+			rpc.Conn.Close()
+		}
+		return false
+	}
+}
+
+// stop makes the workers exit once they finish the message at hand.
+func (p *workerPool) stop() {
+	close(p.done)
+}
+
+// laneOf returns the lane of the peer at addr among n.
+func laneOf(addr string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,96 @@
+package dfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inagib21/DistributedFileStorageGo/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkers(t *testing.T) {
+	s1 := makeServer(t, "127.0.0.1:41220")
+	s1.Workers = 1
+	s2 := makeServer(t, "127.0.0.1:41221", "127.0.0.1:41220")
+	for _, s := range []*FileServer{s1, s2} {
+		go s.Start()
+		defer s.Stop()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return len(s2.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, s2.Store("pooled", strings.NewReader("0123456789")))
+	assert.Eventually(t, func() bool { return s1.store.Has(s2.ID, s2.hashKey("pooled")) }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s2.store.Clear())
+
+	// Requests queue up for the single worker of s1 and are all served.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "2345", readRange(t, s2, "pooled", 2, 4))
+		}()
+	}
+	wg.Wait()
+
+	peers := s1.Peers()
+	if assert.Len(t, peers, 1) {
+		assert.Zero(t, peers[0].QueueDepth)
+		assert.Zero(t, peers[0].Dropped)
+	}
+}
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	// Two peers on different lanes
+	slow, fast := "slow:1", ""
+	for i := 0; len(fast) == 0; i++ {
+		if addr := fmt.Sprintf("fast:%d", i); laneOf(addr, 2) != laneOf(slow, 2) {
+			fast = addr
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		handled = make(map[string][]byte)
+		unblock = make(chan struct{})
+		done    = make(chan struct{}, 20)
+	)
+	pool := newWorkerPool(2, func(rpc p2p.RPC) {
+		if rpc.From == slow && rpc.Payload[0] == 0 {
+			<-unblock
+		}
+		mu.Lock()
+		handled[rpc.From] = append(handled[rpc.From], rpc.Payload[0])
+		mu.Unlock()
+		done <- struct{}{}
+	})
+	defer pool.stop()
+
+	quit := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		assert.True(t, pool.submit(p2p.RPC{From: slow, Payload: []byte{byte(i)}}, quit))
+		assert.True(t, pool.submit(p2p.RPC{From: fast, Payload: []byte{byte(i)}}, quit))
+	}
+
+	// The fast peer isn't held up by the slow one
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	mu.Lock()
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, handled[fast])
+	assert.Empty(t, handled[slow])
+	mu.Unlock()
+
+	// The slow peer's messages are handled in order once it continues
+	close(unblock)
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	mu.Lock()
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, handled[slow])
+	mu.Unlock()
+}